@@ -132,6 +132,7 @@ build() {
 	mkdir -p "${builddir}/systemd"
 	cp dist/systemd/*.service "${builddir}/systemd/"
 	cp maddy.conf "${builddir}/maddy.conf"
+	cp maddy.conf.satellite "${builddir}/maddy.conf.satellite"
 }
 
 install() {
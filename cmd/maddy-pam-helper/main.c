@@ -1,6 +1,7 @@
 #define _POSIX_C_SOURCE 200809L
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
 #include <security/pam_appl.h>
 #include "pam.h"
 
@@ -9,7 +10,7 @@ I really doubt it is a good idea to bring Go to the binary whose primary task
 is to call libpam using CGo anyway.
 */
 
-int run(void) {
+int run(int flags, int print_env) {
     char *username = NULL, *password = NULL;
     size_t username_buf_len = 0, password_buf_len = 0;
 
@@ -33,7 +34,8 @@ int run(void) {
         password[password_len - 1] = 0;
     }
 
-    struct error_obj err = run_pam_auth(username, password);
+    char **env = NULL;
+    struct error_obj err = run_pam_auth(username, password, flags, print_env ? &env : NULL);
     if (err.status != 0) {
         if (err.status == 2) {
             fprintf(stderr, "%s: %s\n", err.func_name, err.error_msg);
@@ -41,11 +43,33 @@ int run(void) {
         return err.status;
     }
 
+    if (env != NULL) {
+        for (char **entry = env; *entry != NULL; entry++) {
+            // Output is line-oriented, skip values that would break it.
+            if (strchr(*entry, '\n') == NULL) {
+                printf("%s\n", *entry);
+            }
+            free(*entry);
+        }
+        free(env);
+    }
+
     return 0;
 }
 
 #ifndef CGO
-int main() {
-    return run();
+int main(int argc, char **argv) {
+    int flags = 0, print_env = 0;
+    for (int i = 1; i < argc; i++) {
+        if (strcmp(argv[i], "--session") == 0) {
+            flags |= RUN_PAM_SESSION;
+        } else if (strcmp(argv[i], "--env") == 0) {
+            print_env = 1;
+        } else {
+            fprintf(stderr, "unknown argument: %s\n", argv[i]);
+            return 2;
+        }
+    }
+    return run(flags, print_env);
 }
 #endif
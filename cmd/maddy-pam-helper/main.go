@@ -21,10 +21,15 @@ package main
 /*
 #cgo LDFLAGS: -lpam
 #cgo CFLAGS: -DCGO -Wall -Wextra -Werror -Wno-unused-parameter -Wno-error=unused-parameter -Wpedantic -std=c99
-extern int run();
+extern int run(int flags, int print_env);
+#include "pam.h"
 */
 import "C"
-import "os"
+
+import (
+	"fmt"
+	"os"
+)
 
 /*
 Apparently, some people would not want to build it manually by calling GCC.
@@ -33,6 +38,19 @@ bigger than one built using only C compiler.
 */
 
 func main() {
-	i := int(C.run())
+	var flags, printEnv C.int
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "--session":
+			flags |= C.RUN_PAM_SESSION
+		case "--env":
+			printEnv = 1
+		default:
+			fmt.Fprintln(os.Stderr, "unknown argument:", arg)
+			os.Exit(2)
+		}
+	}
+
+	i := int(C.run(flags, printEnv))
 	os.Exit(i)
 }
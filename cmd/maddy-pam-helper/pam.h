@@ -24,4 +24,14 @@ struct error_obj {
     const char* error_msg;
 };
 
-struct error_obj run_pam_auth(const char *username, char *password);
+// Also open (and immediately close) a PAM session after successful
+// authentication.
+#define RUN_PAM_SESSION 1
+
+// status is 0 on success, 1 for invalid credentials, 2 for other errors and
+// 3 if credentials are valid but the account cannot be used (expired,
+// locked or not allowed at this time).
+//
+// If env is not NULL, it is set to the NULL-terminated PAM environment list
+// (see pam_getenvlist(3)) that should be freed by the caller.
+struct error_obj run_pam_auth(const char *username, char *password, int flags, char ***env);
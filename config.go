@@ -21,8 +21,11 @@ package maddy
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -36,41 +39,149 @@ Config matchers for module interfaces.
 // configuration directive it was constructed from, allowing
 // dynamic reinitialization for purposes of log file rotation.
 type logOut struct {
-	args []string
+	args   []string
+	redact map[string]log.Redaction
 	log.Output
 }
 
-func logOutput(_ *config.Map, node config.Node) (interface{}, error) {
+func (l logOut) WriteEntry(e log.Entry) {
+	log.WriteEntry(l.Output, e)
+}
+
+func logOutput(m *config.Map, node config.Node) (interface{}, error) {
 	if len(node.Args) == 0 {
 		return nil, config.NodeErr(node, "expected at least 1 argument")
 	}
-	if len(node.Children) != 0 {
-		return nil, config.NodeErr(node, "can't declare block here")
+
+	redact := make(map[string]log.Redaction)
+	for _, child := range node.Children {
+		if child.Name != "redact" {
+			return nil, config.NodeErr(child, "unknown directive: %s", child.Name)
+		}
+		r, err := logRedaction(m, child)
+		if err != nil {
+			return nil, err
+		}
+
+		// No targets - apply to all of them.
+		if len(child.Args) == 0 {
+			redact[""] = r
+			continue
+		}
+		for _, target := range child.Args {
+			found := false
+			for _, arg := range node.Args {
+				if arg == target {
+					found = true
+				}
+			}
+			if !found {
+				return nil, config.NodeErr(child, "unknown log target: %s", target)
+			}
+			redact[target] = r
+		}
 	}
 
-	return LogOutputOption(node.Args)
+	return logOutputs(node.Args, redact)
+}
+
+// logRedaction parses the redact block:
+//
+//	redact [targets...] {
+//	    addresses hash
+//	    ips truncate
+//	    subjects remove
+//	    hash_key "long random string"
+//	}
+func logRedaction(m *config.Map, node config.Node) (log.Redaction, error) {
+	var (
+		r       log.Redaction
+		hashKey string
+	)
+	cm := config.NewMap(m.Globals, node)
+	config.EnumMapped(cm, "addresses", false, false, log.RedactModes, log.RedactOff, &r.Addresses)
+	config.EnumMapped(cm, "ips", false, false, log.RedactModes, log.RedactOff, &r.IPs)
+	config.EnumMapped(cm, "subjects", false, false, log.RedactModes, log.RedactOff, &r.Subjects)
+	cm.String("hash_key", false, false, "", &hashKey)
+	if _, err := cm.Process(); err != nil {
+		return log.Redaction{}, err
+	}
+
+	if hashKey != "" && len(hashKey) < 16 {
+		return log.Redaction{}, config.NodeErr(node, "hash_key should be at least 16 characters long")
+	}
+	r.HashKey = []byte(hashKey)
+	return r, nil
 }
 
 func LogOutputOption(args []string) (log.Output, error) {
+	return logOutputs(args, nil)
+}
+
+// logOutputs creates outputs for targets, redact contains redaction settings
+// for targets, "" key is used for targets not listed explicitly.
+func logOutputs(args []string, redact map[string]log.Redaction) (log.Output, error) {
 	outs := make([]log.Output, 0, len(args))
 	for i, arg := range args {
+		target := arg
+		add := func(out log.Output) {
+			r, ok := redact[target]
+			if !ok {
+				r, ok = redact[""]
+			}
+			if ok {
+				out = log.RedactOutput(out, r)
+			}
+			outs = append(outs, out)
+		}
+
+		// json: prefix selects JSON formatting for the target.
+		jsonFmt := strings.HasPrefix(arg, "json:")
+		arg = strings.TrimPrefix(arg, "json:")
+
 		switch arg {
-		case "stderr":
-			outs = append(outs, log.WriterOutput(os.Stderr, false))
-		case "stderr_ts":
-			outs = append(outs, log.WriterOutput(os.Stderr, true))
+		case "stderr", "stderr_ts":
+			if jsonFmt {
+				add(log.WriterJSONOutput(os.Stderr))
+				continue
+			}
+			add(log.WriterOutput(os.Stderr, arg == "stderr_ts"))
 		case "syslog":
+			if jsonFmt {
+				return nil, errors.New("JSON formatting is not supported for syslog")
+			}
 			syslogOut, err := log.SyslogOutput()
 			if err != nil {
 				return nil, fmt.Errorf("failed to connect to syslog daemon: %v", err)
 			}
-			outs = append(outs, syslogOut)
+			add(syslogOut)
+		case "journald":
+			if jsonFmt {
+				return nil, errors.New("JSON formatting is not supported for journald")
+			}
+			journalOut, err := log.JournaldOutput()
+			if err != nil {
+				return nil, err
+			}
+			add(journalOut)
 		case "off":
 			if len(args) != 1 {
 				return nil, errors.New("'off' can't be combined with other log targets")
 			}
 			return log.NopOutput{}, nil
 		default:
+			if strings.HasPrefix(arg, "syslog:") {
+				if jsonFmt {
+					return nil, errors.New("JSON formatting is not supported for syslog")
+				}
+				syslogOut, err := netSyslogOutput(strings.TrimPrefix(arg, "syslog:"))
+				if err != nil {
+					return nil, err
+				}
+				add(syslogOut)
+				continue
+			}
+
 			// Log file paths are converted to absolute to make sure
 			// we will be able to recreate them in right location
 			// after changing working directory to the state dir.
@@ -81,20 +192,65 @@ func LogOutputOption(args []string) (log.Output, error) {
 			// We change the actual argument, so logOut object will
 			// keep the absolute path for reinitialization.
 			args[i] = absPath
+			if jsonFmt {
+				args[i] = "json:" + absPath
+			}
+			if r, ok := redact[target]; ok {
+				redact[args[i]] = r
+			}
 
 			w, err := os.OpenFile(absPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create log file: %v", err)
 			}
 
-			outs = append(outs, log.WriteCloserOutput(w, true))
+			if jsonFmt {
+				add(log.WriteCloserJSONOutput(w))
+				continue
+			}
+			add(log.WriteCloserOutput(w, true))
 		}
 	}
 
 	if len(outs) == 1 {
-		return logOut{args, outs[0]}, nil
+		return logOut{args, redact, outs[0]}, nil
+	}
+	return logOut{args, redact, log.MultiOutput(outs...)}, nil
+}
+
+// netSyslogOutput creates the output for the syslog server specified as
+// udp://host:port, tcp://host:port or unix:///path, with optional facility
+// query parameter (e.g. udp://192.0.2.1:514?facility=local0).
+func netSyslogOutput(target string) (log.Output, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("malformed syslog address: %v", err)
+	}
+
+	facility := 2 // mail
+	if name := u.Query().Get("facility"); name != "" {
+		facility, err = log.SyslogFacility(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out log.Output
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "514")
+		}
+		out, err = log.NetSyslogOutput(u.Scheme, u.Host, facility)
+	case "unix":
+		out, err = log.NetSyslogOutput("unixgram", u.Path, facility)
+	default:
+		return nil, fmt.Errorf("unsupported syslog transport: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog server: %v", err)
 	}
-	return logOut{args, log.MultiOutput(outs...)}, nil
+	return out, nil
 }
 
 func defaultLogOutput() (interface{}, error) {
@@ -108,7 +264,7 @@ func reinitLogging() {
 		return
 	}
 
-	newOut, err := LogOutputOption(out.args)
+	newOut, err := logOutputs(out.args, out.redact)
 	if err != nil {
 		log.Println("Can't reinitialize logger:", err)
 		return
@@ -20,9 +20,6 @@ package tls
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"os"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -34,6 +31,7 @@ func TLSClientBlock(_ *config.Map, node config.Node) (interface{}, error) {
 	childM := config.NewMap(nil, node)
 	var (
 		tlsVersions       [2]uint16
+		profile           string
 		rootCAPaths       []string
 		certPath, keyPath string
 	)
@@ -41,6 +39,7 @@ func TLSClientBlock(_ *config.Map, node config.Node) (interface{}, error) {
 	childM.StringList("root_ca", false, false, nil, &rootCAPaths)
 	childM.String("cert", false, false, "", &certPath)
 	childM.String("key", false, false, "", &keyPath)
+	childM.Enum("profile", false, false, TLSProfiles, "", &profile)
 	childM.Custom("protocols", false, false, func() (interface{}, error) {
 		return [2]uint16{0, 0}, nil
 	}, TLSVersionsDirective, &tlsVersions)
@@ -56,15 +55,9 @@ func TLSClientBlock(_ *config.Map, node config.Node) (interface{}, error) {
 	}
 
 	if len(rootCAPaths) != 0 {
-		pool := x509.NewCertPool()
-		for _, path := range rootCAPaths {
-			blob, err := os.ReadFile(path)
-			if err != nil {
-				return nil, err
-			}
-			if !pool.AppendCertsFromPEM(blob) {
-				return nil, fmt.Errorf("no certificates was loaded from %s", path)
-			}
+		pool, err := loadCertPool(rootCAPaths)
+		if err != nil {
+			return nil, err
 		}
 		cfg.RootCAs = pool
 	}
@@ -80,6 +73,8 @@ func TLSClientBlock(_ *config.Map, node config.Node) (interface{}, error) {
 		}
 	}
 
+	applyProfile(&cfg, &tlsVersions, profile)
+
 	cfg.MinVersion = tlsVersions[0]
 	cfg.MaxVersion = tlsVersions[1]
 	log.Debugf("tls: min version: %x, max version: %x", tlsVersions[0], tlsVersions[1])
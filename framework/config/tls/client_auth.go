@@ -0,0 +1,140 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// clientAuth is the client certificate policy of the endpoint.
+type clientAuth struct {
+	mode         string
+	pool         *x509.CertPool
+	fingerprints module.Table
+}
+
+func loadCertPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, fmt.Errorf("no certificates was loaded from %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// apply configures c to request client certificates according to the
+// policy.
+//
+// Certificates are verified by verifyConnection instead of crypto/tls so
+// certificates that are listed in the fingerprint table are accepted
+// even if they are not signed by the CA (e.g. self-signed ones).
+func (ca *clientAuth) apply(c *tls.Config) {
+	switch ca.mode {
+	case "request":
+		c.ClientAuth = tls.RequestClientCert
+	case "require":
+		c.ClientAuth = tls.RequireAnyClientCert
+	default:
+		return
+	}
+	// Sent to clients as a hint to select the certificate.
+	c.ClientCAs = ca.pool
+	c.VerifyConnection = ca.verifyConnection
+}
+
+func (ca *clientAuth) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		// Not sent, crypto/tls already rejected the connection if the
+		// certificate is required.
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+
+	if ca.fingerprints != nil {
+		_, ok, err := ca.fingerprints.Lookup(context.Background(), CertFingerprint(leaf))
+		if err != nil {
+			return fmt.Errorf("tls: client certificate lookup failed: %w", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	if ca.pool != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         ca.pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("tls: client certificate verification failed: %w", err)
+	}
+
+	return errors.New("tls: unknown client certificate")
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the certificate as a
+// lowercase hex string, as used in client certificate tables.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIdentity returns the identity from the client certificate verified
+// according to the endpoint policy. Empty string is returned if the client
+// did not present a certificate.
+//
+// The identity is the subject common name, the first email address or DNS
+// name of the certificate or, if all of them are missing, the certificate
+// fingerprint.
+func ClientIdentity(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	leaf := state.PeerCertificates[0]
+	switch {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName
+	case len(leaf.EmailAddresses) != 0:
+		return leaf.EmailAddresses[0]
+	case len(leaf.DNSNames) != 0:
+		return leaf.DNSNames[0]
+	}
+	return CertFingerprint(leaf)
+}
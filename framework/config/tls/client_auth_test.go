@@ -0,0 +1,136 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func genCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientAuth_Verify(t *testing.T) {
+	ca, caKey := genCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	signed, _ := genCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "relay.example.org"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	serverOnly, _ := genCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "mx.example.org"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	selfSigned, _ := genCert(t, &x509.Certificate{
+		EmailAddresses: []string{"backup@example.org"},
+	}, nil, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	policy := clientAuth{
+		mode: "require",
+		pool: pool,
+		fingerprints: testutils.Table{M: map[string]string{
+			CertFingerprint(selfSigned): "",
+		}},
+	}
+
+	test := func(cert *x509.Certificate, ok bool, identity string) {
+		t.Helper()
+		state := tls.ConnectionState{}
+		if cert != nil {
+			state.PeerCertificates = []*x509.Certificate{cert}
+		}
+		err := policy.verifyConnection(state)
+		if ok && err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if !ok && err == nil {
+			t.Errorf("Expected an error")
+		}
+		if ok {
+			if got := ClientIdentity(state); got != identity {
+				t.Errorf("Wrong identity: %q, want %q", got, identity)
+			}
+		}
+	}
+
+	test(nil, true, "")
+	test(signed, true, "relay.example.org")
+	test(selfSigned, true, "backup@example.org")
+	test(serverOnly, false, "")
+
+	policy.fingerprints = nil
+	test(selfSigned, false, "")
+
+	policy.pool = nil
+	test(signed, false, "")
+}
+
+func TestClientAuth_Apply(t *testing.T) {
+	c := tls.Config{}
+	(&clientAuth{mode: "none"}).apply(&c)
+	if c.ClientAuth != tls.NoClientCert || c.VerifyConnection != nil {
+		t.Error("none mode changed the config")
+	}
+
+	(&clientAuth{mode: "request"}).apply(&c)
+	if c.ClientAuth != tls.RequestClientCert || c.VerifyConnection == nil {
+		t.Error("request mode is not applied")
+	}
+
+	(&clientAuth{mode: "require"}).apply(&c)
+	if c.ClientAuth != tls.RequireAnyClientCert {
+		t.Error("require mode is not applied")
+	}
+}
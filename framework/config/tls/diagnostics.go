@@ -0,0 +1,333 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// diagnostics logs TLS handshakes of selected clients and optionally writes
+// session secrets to the key log file to decrypt captured traffic.
+type diagnostics struct {
+	clients   []net.IPNet
+	listeners []string
+	keyLog    *keyLogWriter
+	log       log.Logger
+}
+
+func diagnosticsDirective(m *config.Map, node config.Node) (interface{}, error) {
+	d := &diagnostics{
+		log: log.Logger{Name: "tls"},
+	}
+	var (
+		clients    []string
+		keyLogPath string
+	)
+	childM := config.NewMap(m.Globals, node)
+	childM.StringList("clients", false, false, nil, &clients)
+	childM.StringList("listeners", false, false, nil, &d.listeners)
+	childM.String("key_log", false, false, "", &keyLogPath)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	for _, client := range clients {
+		if !strings.Contains(client, "/") {
+			if strings.Contains(client, ":") {
+				client += "/128"
+			} else {
+				client += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		d.clients = append(d.clients, *ipNet)
+	}
+	for _, l := range d.listeners {
+		if _, _, err := net.SplitHostPort(l); err != nil {
+			return nil, config.NodeErr(node, "invalid listener address: %v", err)
+		}
+	}
+
+	if keyLogPath != "" {
+		d.keyLog = sharedKeyLog(keyLogPath)
+		log.Printf("tls: key log is enabled (%s), recorded TLS sessions can be decrypted using it", keyLogPath)
+	}
+
+	return d, nil
+}
+
+// matches checks whether the handshake should be logged.
+func (d *diagnostics) matches(hello *tls.ClientHelloInfo) bool {
+	if hello.Conn == nil {
+		return len(d.clients) == 0 && len(d.listeners) == 0
+	}
+
+	if len(d.clients) != 0 {
+		tcpAddr, ok := hello.Conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		found := false
+		for _, ipNet := range d.clients {
+			if ipNet.Contains(tcpAddr.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(d.listeners) != 0 {
+		tcpAddr, ok := hello.Conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		found := false
+		for _, l := range d.listeners {
+			host, port, _ := net.SplitHostPort(l)
+			if port != fmt.Sprint(tcpAddr.Port) {
+				continue
+			}
+			if host == "" || net.ParseIP(host).Equal(tcpAddr.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// configForClient wraps the configuration returned by get to log the
+// handshake progress.
+//
+// crypto/tls does not report handshake errors to the configuration owner,
+// so the likely failure reason is determined by comparing ClientHello
+// with the configuration. Failures that happen later (e.g. the client not
+// trusting the certificate) are visible only as a missing "handshake
+// completed" message.
+func (d *diagnostics) configForClient(hello *tls.ClientHelloInfo, get func() (*tls.Config, error)) (*tls.Config, error) {
+	cfg, err := get()
+	if !d.matches(hello) || cfg == nil {
+		return cfg, err
+	}
+
+	fields := []interface{}{
+		"sni", hello.ServerName,
+		"versions", versionNames(hello.SupportedVersions),
+		"ciphers", cipherNames(hello.CipherSuites),
+		"curves", hello.SupportedCurves,
+	}
+	if hello.Conn != nil {
+		fields = append(fields,
+			"remote_addr", hello.Conn.RemoteAddr(),
+			"local_addr", hello.Conn.LocalAddr())
+	}
+
+	if err != nil {
+		d.log.Error("handshake failed", err, fields...)
+		return nil, err
+	}
+	if reason := handshakeProblem(cfg, hello); reason != "" {
+		d.log.Msg("handshake failed", append(fields, "reason", reason)...)
+	} else {
+		d.log.Msg("handshake started", fields...)
+	}
+
+	if d.keyLog != nil {
+		cfg.KeyLogWriter = d.keyLog
+	}
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				d.log.Error("handshake failed", err, fields...)
+				return err
+			}
+		}
+		d.log.Msg("handshake completed", append(fields,
+			"version", versionName(state.Version),
+			"cipher", tls.CipherSuiteName(state.CipherSuite),
+			"client_cert", len(state.PeerCertificates) != 0)...)
+		return nil
+	}
+
+	return cfg, nil
+}
+
+// handshakeProblem determines why the handshake with the client will fail.
+// It returns an empty string if no problem is found.
+func handshakeProblem(cfg *tls.Config, hello *tls.ClientHelloInfo) string {
+	minVer, maxVer := cfg.MinVersion, cfg.MaxVersion
+	if minVer == 0 {
+		minVer = tls.VersionTLS12
+	}
+	if maxVer == 0 {
+		maxVer = tls.VersionTLS13
+	}
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if v >= minVer && v <= maxVer && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return fmt.Sprintf("no common protocol version, server allows %s - %s",
+			versionName(minVer), versionName(maxVer))
+	}
+
+	serverCurves := cfg.CurvePreferences
+	if len(serverCurves) == 0 {
+		serverCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+	}
+	commonCurve := false
+	for _, c := range hello.SupportedCurves {
+		for _, sc := range serverCurves {
+			if c == sc {
+				commonCurve = true
+			}
+		}
+	}
+
+	// TLS 1.3 cipher suites are not configurable and supported by all
+	// clients, but an ECDHE key exchange is always used.
+	if version == tls.VersionTLS13 {
+		if !commonCurve {
+			return "no common key exchange group"
+		}
+	} else {
+		serverCiphers := cfg.CipherSuites
+		if len(serverCiphers) == 0 {
+			for _, c := range tls.CipherSuites() {
+				serverCiphers = append(serverCiphers, c.ID)
+			}
+		}
+		usable := false
+		for _, c := range hello.CipherSuites {
+			for _, sc := range serverCiphers {
+				if c != sc {
+					continue
+				}
+				if commonCurve || !strings.HasPrefix(tls.CipherSuiteName(c), "TLS_ECDHE_") {
+					usable = true
+				}
+			}
+		}
+		if !usable {
+			return fmt.Sprintf("no common cipher suite for %s", versionName(version))
+		}
+	}
+
+	if cfg.GetCertificate != nil {
+		cert, err := cfg.GetCertificate(hello)
+		if err != nil {
+			return fmt.Sprintf("no certificate: %v", err)
+		}
+		if cert == nil && len(cfg.Certificates) == 0 {
+			return "no certificate"
+		}
+	} else if len(cfg.Certificates) == 0 {
+		return "no certificate"
+	}
+
+	return ""
+}
+
+func versionName(v uint16) string {
+	for name, val := range strVersionsMap {
+		if val == v && name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func versionNames(versions []uint16) []string {
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		names = append(names, versionName(v))
+	}
+	return names
+}
+
+func cipherNames(ciphers []uint16) []string {
+	names := make([]string, 0, len(ciphers))
+	for _, c := range ciphers {
+		names = append(names, tls.CipherSuiteName(c))
+	}
+	return names
+}
+
+// keyLogWriter appends session secrets to the file in the NSS key log
+// format (SSLKEYLOGFILE). The file is opened on the first write so relative
+// paths are resolved against the state directory.
+type keyLogWriter struct {
+	path string
+
+	lock sync.Mutex
+	f    *os.File
+}
+
+var (
+	keyLogs     = map[string]*keyLogWriter{}
+	keyLogsLock sync.Mutex
+)
+
+func sharedKeyLog(path string) *keyLogWriter {
+	keyLogsLock.Lock()
+	defer keyLogsLock.Unlock()
+
+	if w, ok := keyLogs[path]; ok {
+		return w
+	}
+	w := &keyLogWriter{path: path}
+	keyLogs[path] = w
+	return w
+}
+
+func (w *keyLogWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Printf("tls: cannot open key log: %v", err)
+			return 0, err
+		}
+		w.f = f
+	}
+	return w.f.Write(b)
+}
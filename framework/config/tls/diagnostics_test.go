@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestDiagnostics_Matches(t *testing.T) {
+	_, client, _ := net.ParseCIDR("192.0.2.0/24")
+	d := diagnostics{
+		clients:   []net.IPNet{*client},
+		listeners: []string{":465", "127.0.0.1:993"},
+	}
+	conn := func(local string, port int, remote string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{Conn: addrConn{
+			local:  &net.TCPAddr{IP: net.ParseIP(local), Port: port},
+			remote: &net.TCPAddr{IP: net.ParseIP(remote), Port: 12345},
+		}}
+	}
+
+	if !d.matches(conn("203.0.113.1", 465, "192.0.2.1")) {
+		t.Error("expected match")
+	}
+	if d.matches(conn("203.0.113.1", 465, "192.0.3.1")) {
+		t.Error("unexpected match for other client")
+	}
+	if !d.matches(conn("127.0.0.1", 993, "192.0.2.1")) {
+		t.Error("expected match")
+	}
+	if d.matches(conn("127.0.0.2", 993, "192.0.2.1")) {
+		t.Error("unexpected match for other listener")
+	}
+	if d.matches(conn("127.0.0.1", 25, "192.0.2.1")) {
+		t.Error("unexpected match for other listener")
+	}
+}
+
+func TestHandshakeProblem(t *testing.T) {
+	cert, key := genCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mx.example.org"}}, nil, nil)
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+
+	test := func(hello tls.ClientHelloInfo, expected string) {
+		t.Helper()
+		reason := handshakeProblem(cfg, &hello)
+		if !strings.HasPrefix(reason, expected) || (expected == "" && reason != "") {
+			t.Errorf("expected %q, got %q", expected, reason)
+		}
+	}
+
+	test(tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+	}, "")
+	test(tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS11, tls.VersionTLS10},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+	}, "no common protocol version")
+	test(tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+	}, "no common cipher suite")
+	test(tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveID(0xfe00)},
+	}, "no common cipher suite")
+	test(tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveID(0xfe00)},
+	}, "no common key exchange group")
+
+	cfg.Certificates = nil
+	test(tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+	}, "no certificate")
+}
+
+func TestDiagnostics_KeyLog(t *testing.T) {
+	cert, key := genCert(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "mx.example.org"},
+		DNSNames: []string{"mx.example.org"},
+	}, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	keyLogPath := filepath.Join(t.TempDir(), "keys.log")
+	d := &diagnostics{
+		keyLog: &keyLogWriter{path: keyLogPath},
+		log:    testutils.Logger(t, "tls"),
+	}
+	serverCfg := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return d.configForClient(hello, func() (*tls.Config, error) {
+				return &tls.Config{
+					Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+				}, nil
+			})
+		},
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tls.Server(serverConn, serverCfg).Handshake()
+	}()
+	client := tls.Client(clientConn, &tls.Config{ServerName: "mx.example.org", RootCAs: pool})
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	keyLog, err := os.ReadFile(keyLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(keyLog), "CLIENT_HANDSHAKE_TRAFFIC_SECRET ") {
+		t.Errorf("unexpected key log contents: %q", keyLog)
+	}
+}
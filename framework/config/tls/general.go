@@ -66,6 +66,82 @@ var strCurvesMap = map[string]tls.CurveID{
 	"X25519": tls.X25519,
 }
 
+// tlsProfile is a named set of TLS settings based on Mozilla recommendations
+// for server-side TLS (https://wiki.mozilla.org/Security/Server_Side_TLS).
+type tlsProfile struct {
+	versions [2]uint16
+	ciphers  []uint16
+	curves   []tls.CurveID
+}
+
+var (
+	profileCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+
+	intermediateCiphers = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	}
+)
+
+var tlsProfiles = map[string]tlsProfile{
+	// TLS 1.3 cipher suites are not configurable and all of them are
+	// considered secure.
+	"modern": {
+		versions: [2]uint16{tls.VersionTLS13, tls.VersionTLS13},
+		curves:   profileCurves,
+	},
+	"intermediate": {
+		versions: [2]uint16{tls.VersionTLS12, tls.VersionTLS13},
+		ciphers:  intermediateCiphers,
+		curves:   profileCurves,
+	},
+	"old": {
+		versions: [2]uint16{tls.VersionTLS10, tls.VersionTLS13},
+		ciphers: append(append([]uint16{}, intermediateCiphers...),
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		),
+		curves: profileCurves,
+	},
+}
+
+// TLSProfiles lists names of available TLS profiles.
+var TLSProfiles = []string{"modern", "intermediate", "old"}
+
+// applyProfile sets TLS versions, cipher suites and curves from the named
+// profile unless they are set explicitly.
+func applyProfile(c *tls.Config, versions *[2]uint16, name string) {
+	profile, ok := tlsProfiles[name]
+	if !ok {
+		return
+	}
+	log.Debugln("tls: using profile", name)
+
+	if *versions == [2]uint16{} {
+		*versions = profile.versions
+	}
+	if c.CipherSuites == nil {
+		c.CipherSuites = profile.ciphers
+	}
+	if c.CurvePreferences == nil {
+		c.CurvePreferences = profile.curves
+	}
+}
+
 // TLSversionsDirective parses directive with arguments that specify
 // minimum and maximum supported TLS versions.
 //
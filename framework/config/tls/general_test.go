@@ -0,0 +1,64 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestTLSClientBlock_Profile(t *testing.T) {
+	test := func(directives []config.Node, versions [2]uint16, ciphers []uint16) {
+		t.Helper()
+
+		cfgI, err := TLSClientBlock(nil, config.Node{Children: directives})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := cfgI.(*tls.Config)
+		if cfg.MinVersion != versions[0] || cfg.MaxVersion != versions[1] {
+			t.Errorf("Wrong versions: %x %x", cfg.MinVersion, cfg.MaxVersion)
+		}
+		if !reflect.DeepEqual(cfg.CipherSuites, ciphers) {
+			t.Errorf("Wrong ciphers: %v", cfg.CipherSuites)
+		}
+	}
+
+	test(nil, [2]uint16{0, 0}, nil)
+	test([]config.Node{
+		{Name: "profile", Args: []string{"modern"}},
+	}, [2]uint16{tls.VersionTLS13, tls.VersionTLS13}, nil)
+	test([]config.Node{
+		{Name: "profile", Args: []string{"intermediate"}},
+	}, [2]uint16{tls.VersionTLS12, tls.VersionTLS13}, intermediateCiphers)
+	test([]config.Node{
+		{Name: "profile", Args: []string{"intermediate"}},
+		{Name: "protocols", Args: []string{"tls1.1", "tls1.3"}},
+		{Name: "ciphers", Args: []string{"ECDHE-RSA-WITH-AES128-CBC-SHA"}},
+	}, [2]uint16{tls.VersionTLS11, tls.VersionTLS13}, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA})
+
+	if _, err := TLSClientBlock(nil, config.Node{Children: []config.Node{
+		{Name: "profile", Args: []string{"ancient"}},
+	}}); err == nil {
+		t.Error("Expected an error for unknown profile")
+	}
+}
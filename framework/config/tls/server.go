@@ -20,6 +20,7 @@ package tls
 
 import (
 	"crypto/tls"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -30,6 +31,8 @@ import (
 type TLSConfig struct {
 	loader  module.TLSLoader
 	baseCfg *tls.Config
+	tickets *ticketKeys
+	diag    *diagnostics
 }
 
 func (cfg *TLSConfig) Get() (*tls.Config, error) {
@@ -37,6 +40,9 @@ func (cfg *TLSConfig) Get() (*tls.Config, error) {
 		return nil, nil
 	}
 	tlsCfg := cfg.baseCfg.Clone()
+	if cfg.tickets != nil {
+		tlsCfg.SetSessionTicketKeys(cfg.tickets.current(time.Now()))
+	}
 
 	err := cfg.loader.ConfigureTLS(tlsCfg)
 	if err != nil {
@@ -63,16 +69,16 @@ func TLSDirective(m *config.Map, node config.Node) (interface{}, error) {
 
 	return &tls.Config{
 		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if cfg.diag != nil {
+				return cfg.diag.configForClient(hello, cfg.Get)
+			}
 			return cfg.Get()
 		},
 	}, nil
 }
 
 func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSConfig, error) {
-	baseCfg := tls.Config{
-		// Workaround for issue https://github.com/foxcpp/maddy/issues/730
-		SessionTicketsDisabled: true,
-	}
+	baseCfg := tls.Config{}
 
 	var loader module.TLSLoader
 	if len(blockNode.Args) > 0 {
@@ -87,7 +93,18 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 	}
 
 	childM := config.NewMap(globals, blockNode)
-	var tlsVersions [2]uint16
+	var (
+		tlsVersions  [2]uint16
+		profile      string
+		clientPolicy clientAuth
+		clientCAs    []string
+
+		sessionTickets bool
+		ticketRotate   time.Duration
+		ticketKeyFile  string
+
+		diag *diagnostics
+	)
 
 	childM.Custom("loader", false, false, func() (interface{}, error) {
 		return loader, nil
@@ -97,8 +114,9 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 		return l, err
 	}, &loader)
 
+	childM.Enum("profile", false, false, TLSProfiles, "", &profile)
 	childM.Custom("protocols", false, false, func() (interface{}, error) {
-		return [2]uint16{tls.VersionTLS10, 0}, nil
+		return [2]uint16{}, nil
 	}, TLSVersionsDirective, &tlsVersions)
 
 	childM.Custom("ciphers", false, false, func() (interface{}, error) {
@@ -109,10 +127,55 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 		return nil, nil
 	}, TLSCurvesDirective, &baseCfg.CurvePreferences)
 
+	childM.Enum("client_auth", false, false,
+		[]string{"none", "request", "require"}, "none", &clientPolicy.mode)
+	childM.StringList("client_ca", false, false, nil, &clientCAs)
+	modconfig.Table(childM, "client_fingerprints", false, false, nil, &clientPolicy.fingerprints)
+
+	childM.Bool("session_tickets", false, false, &sessionTickets)
+	childM.Duration("session_ticket_rotate", false, false, 24*time.Hour, &ticketRotate)
+	childM.String("session_ticket_key_file", false, false, "tls_ticket_keys", &ticketKeyFile)
+
+	childM.Custom("diagnostics", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, diagnosticsDirective, &diag)
+
 	if _, err := childM.Process(); err != nil {
 		return nil, err
 	}
 
+	if len(clientCAs) != 0 {
+		var err error
+		clientPolicy.pool, err = loadCertPool(clientCAs)
+		if err != nil {
+			return nil, config.NodeErr(blockNode, "%v", err)
+		}
+	}
+	if clientPolicy.mode != "none" && clientPolicy.pool == nil && clientPolicy.fingerprints == nil {
+		return nil, config.NodeErr(blockNode, "client_ca or client_fingerprints is required to verify client certificates")
+	}
+	clientPolicy.apply(&baseCfg)
+
+	var tickets *ticketKeys
+	if sessionTickets {
+		if ticketRotate < time.Minute {
+			return nil, config.NodeErr(blockNode, "session_ticket_rotate should be at least 1m")
+		}
+		var err error
+		tickets, err = sharedTicketKeys(ticketKeyFile, ticketRotate)
+		if err != nil {
+			return nil, config.NodeErr(blockNode, "%v", err)
+		}
+	} else {
+		// Workaround for issue https://github.com/foxcpp/maddy/issues/730
+		baseCfg.SessionTicketsDisabled = true
+	}
+
+	applyProfile(&baseCfg, &tlsVersions, profile)
+	if tlsVersions == [2]uint16{} {
+		tlsVersions = [2]uint16{tls.VersionTLS10, 0}
+	}
+
 	if len(baseCfg.CipherSuites) != 0 {
 		baseCfg.PreferServerCipherSuites = true
 	}
@@ -124,5 +187,7 @@ func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSCo
 	return &TLSConfig{
 		loader:  loader,
 		baseCfg: &baseCfg,
+		tickets: tickets,
+		diag:    diag,
 	}, nil
 }
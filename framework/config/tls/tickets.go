@@ -0,0 +1,209 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// ticketCheckInterval is how often the key file is checked for changes made
+// by other processes.
+const ticketCheckInterval = 10 * time.Second
+
+// ticketKeys manages TLS session ticket keys.
+//
+// Keys are stored in the file so sessions can be resumed after restart or
+// using another server that shares the file. The new key is generated once
+// the newest one is older than the rotation interval, keys older than two
+// intervals are removed so tickets can't be decrypted after that.
+type ticketKeys struct {
+	path     string
+	interval time.Duration
+	log      log.Logger
+
+	lock    sync.Mutex
+	keys    []ticketKey // newest first
+	cached  [][32]byte
+	modTime time.Time
+	checked time.Time
+}
+
+type ticketKey struct {
+	Created time.Time `json:"created"`
+	Key     []byte    `json:"key"`
+}
+
+var (
+	ticketManagers     = map[string]*ticketKeys{}
+	ticketManagersLock sync.Mutex
+)
+
+// sharedTicketKeys returns the key manager for the file, all TLS
+// configurations using the same file share it.
+func sharedTicketKeys(path string, interval time.Duration) (*ticketKeys, error) {
+	ticketManagersLock.Lock()
+	defer ticketManagersLock.Unlock()
+
+	if tk, ok := ticketManagers[path]; ok {
+		if tk.interval != interval {
+			return nil, fmt.Errorf("conflicting session_ticket_rotate values for %s", path)
+		}
+		return tk, nil
+	}
+	tk := &ticketKeys{
+		path:     path,
+		interval: interval,
+		log:      log.Logger{Name: "tls", Debug: log.DefaultLogger.Debug},
+	}
+	ticketManagers[path] = tk
+	return tk, nil
+}
+
+// current returns keys to use for session tickets, the first one is used to
+// encrypt new tickets.
+func (tk *ticketKeys) current(now time.Time) [][32]byte {
+	tk.lock.Lock()
+	defer tk.lock.Unlock()
+
+	if tk.checked.IsZero() || now.Sub(tk.checked) >= ticketCheckInterval {
+		tk.checked = now
+		if err := tk.reload(); err != nil {
+			tk.log.Error("cannot read session ticket keys", err, "path", tk.path)
+		}
+	}
+	if tk.expired(now) {
+		// Another server sharing the file might have rotated keys already.
+		if err := tk.reload(); err != nil {
+			tk.log.Error("cannot read session ticket keys", err, "path", tk.path)
+		}
+		if tk.expired(now) {
+			tk.rotate(now)
+		}
+	}
+	return tk.cached
+}
+
+func (tk *ticketKeys) expired(now time.Time) bool {
+	return len(tk.keys) == 0 || now.Sub(tk.keys[0].Created) >= tk.interval
+}
+
+func (tk *ticketKeys) reload() error {
+	info, err := os.Stat(tk.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if info.ModTime().Equal(tk.modTime) {
+		return nil
+	}
+
+	blob, err := os.ReadFile(tk.path)
+	if err != nil {
+		return err
+	}
+	var keys []ticketKey
+	if err := json.Unmarshal(blob, &keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if len(key.Key) != 32 {
+			return fmt.Errorf("invalid key length: %d", len(key.Key))
+		}
+	}
+
+	tk.modTime = info.ModTime()
+	tk.setKeys(keys)
+	tk.log.Debugln("loaded", len(keys), "session ticket keys from", tk.path)
+	return nil
+}
+
+func (tk *ticketKeys) setKeys(keys []ticketKey) {
+	tk.keys = keys
+	tk.cached = make([][32]byte, len(keys))
+	for i, key := range keys {
+		copy(tk.cached[i][:], key.Key)
+	}
+}
+
+func (tk *ticketKeys) rotate(now time.Time) {
+	newKey := ticketKey{Created: now, Key: make([]byte, 32)}
+	if _, err := rand.Read(newKey.Key); err != nil {
+		tk.log.Error("cannot generate session ticket key", err)
+		return
+	}
+
+	keys := []ticketKey{newKey}
+	for _, key := range tk.keys {
+		if now.Sub(key.Created) < 2*tk.interval {
+			keys = append(keys, key)
+		}
+	}
+	tk.setKeys(keys)
+	tk.log.Debugln("rotated session ticket keys in", tk.path)
+
+	// Keys are still used if the file can't be written, but will not
+	// survive restart.
+	if err := tk.write(); err != nil {
+		tk.log.Error("cannot save session ticket keys", err, "path", tk.path)
+	}
+}
+
+func (tk *ticketKeys) write() error {
+	blob, err := json.Marshal(tk.keys)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(tk.path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(tk.path), filepath.Base(tk.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), tk.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(tk.path)
+	if err != nil {
+		return err
+	}
+	tk.modTime = info.ModTime()
+	return nil
+}
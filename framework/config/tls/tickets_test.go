@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTicketKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	now := time.Now()
+
+	node1 := &ticketKeys{path: path, interval: time.Hour}
+	node2 := &ticketKeys{path: path, interval: time.Hour}
+
+	keys := node1.current(now)
+	if len(keys) != 1 {
+		t.Fatal("Expected one key, got", len(keys))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Error("Wrong key file permissions:", info.Mode())
+	}
+
+	// Second server (or the same one after restart) uses the same keys.
+	if keys2 := node2.current(now); len(keys2) != 1 || keys2[0] != keys[0] {
+		t.Fatal("Keys are not shared")
+	}
+
+	// Not rotated before the interval passes.
+	if keys2 := node1.current(now.Add(30 * time.Minute)); len(keys2) != 1 || keys2[0] != keys[0] {
+		t.Fatal("Keys rotated too early")
+	}
+
+	// Rotated, the old key is kept to decrypt tickets issued using it.
+	rotated := node1.current(now.Add(61 * time.Minute))
+	if len(rotated) != 2 || rotated[1] != keys[0] || rotated[0] == keys[0] {
+		t.Fatal("Keys are not rotated")
+	}
+
+	// Picked up by the second server instead of rotating its own keys.
+	if keys2 := node2.current(now.Add(62 * time.Minute)); len(keys2) != 2 || keys2[0] != rotated[0] {
+		t.Fatal("Rotated keys are not shared")
+	}
+
+	// The old key is removed after two intervals.
+	rotated2 := node1.current(now.Add(125 * time.Minute))
+	if len(rotated2) != 2 || rotated2[1] != rotated[0] {
+		t.Fatal("Old key is not removed")
+	}
+}
+
+func TestTicketKeys_Malformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(`[{"created":"2020-01-01T00:00:00Z","key":"AAAA"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := &ticketKeys{path: path, interval: time.Hour}
+	if err := tk.reload(); err == nil {
+		t.Fatal("Expected an error")
+	}
+	// New key is generated anyway.
+	if keys := tk.current(time.Now()); len(keys) != 1 {
+		t.Fatal("Expected one key, got", len(keys))
+	}
+}
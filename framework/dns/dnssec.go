@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/slowlog"
 	"github.com/miekg/dns"
 )
 
@@ -85,6 +86,8 @@ func isLoopback(addr string) bool {
 }
 
 func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	defer slowlog.Start(ctx, slowlog.DNS, dns.TypeToString[msg.Question[0].Qtype]+" "+msg.Question[0].Name).End()
+
 	var resp *dns.Msg
 	var lastErr error
 	for _, srv := range e.Cfg.Servers {
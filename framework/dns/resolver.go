@@ -28,6 +28,8 @@ import (
 	"context"
 	"net"
 	"strings"
+
+	"github.com/foxcpp/maddy/framework/slowlog"
 )
 
 // Resolver is an interface that describes DNS-related methods used by maddy.
@@ -57,5 +59,35 @@ func DefaultResolver() Resolver {
 		override(overrideServ)
 	}
 
-	return net.DefaultResolver
+	return timedResolver{net.DefaultResolver}
+}
+
+// timedResolver reports slow lookups using the slowlog package.
+type timedResolver struct {
+	*net.Resolver
+}
+
+func (r timedResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	defer slowlog.Start(ctx, slowlog.DNS, "PTR "+addr).End()
+	return r.Resolver.LookupAddr(ctx, addr)
+}
+
+func (r timedResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	defer slowlog.Start(ctx, slowlog.DNS, "A/AAAA "+host).End()
+	return r.Resolver.LookupHost(ctx, host)
+}
+
+func (r timedResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	defer slowlog.Start(ctx, slowlog.DNS, "MX "+name).End()
+	return r.Resolver.LookupMX(ctx, name)
+}
+
+func (r timedResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	defer slowlog.Start(ctx, slowlog.DNS, "TXT "+name).End()
+	return r.Resolver.LookupTXT(ctx, name)
+}
+
+func (r timedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	defer slowlog.Start(ctx, slowlog.DNS, "A/AAAA "+host).End()
+	return r.Resolver.LookupIPAddr(ctx, host)
 }
@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DebugOverride is the debug logging state set at runtime using SetDebug.
+type DebugOverride struct {
+	// Module selector, empty for the override applied to all loggers.
+	Module string `json:"module,omitempty"`
+	Debug  bool   `json:"debug"`
+}
+
+// debugOverrides is an immutable set of overrides, it is replaced as
+// a whole on change so loggers can check it without locking.
+type debugOverrides struct {
+	global  *bool
+	modules map[string]bool
+}
+
+var (
+	overrides     atomic.Pointer[debugOverrides]
+	overridesLock sync.Mutex // serializes writers
+)
+
+// match returns the override for the logger with the specified name and
+// instance, if any.
+//
+// Selector matches the logger if it is equal to the instance name or the
+// logger name. Parent loggers (e.g. "smtp" for "smtp/sasl") and full module
+// names (e.g. "target.remote" for "remote") are matched too.
+func (o *debugOverrides) match(name, instance string) (debug, ok bool) {
+	if instance != "" {
+		if debug, ok := o.modules[instance]; ok {
+			return debug, true
+		}
+	}
+	for name != "" {
+		for sel, debug := range o.modules {
+			if sel == name || strings.HasSuffix(sel, "."+name) {
+				return debug, true
+			}
+		}
+		slash := strings.LastIndexByte(name, '/')
+		if slash == -1 {
+			break
+		}
+		name = name[:slash]
+	}
+	return false, false
+}
+
+// updateOverrides replaces current overrides with a copy modified by f.
+func updateOverrides(f func(*debugOverrides)) {
+	overridesLock.Lock()
+	defer overridesLock.Unlock()
+
+	updated := &debugOverrides{modules: make(map[string]bool)}
+	if cur := overrides.Load(); cur != nil {
+		updated.global = cur.global
+		for sel, debug := range cur.modules {
+			updated.modules[sel] = debug
+		}
+	}
+	f(updated)
+	overrides.Store(updated)
+}
+
+// SetDebug enables or disables debug logging at runtime regardless of the
+// configuration. If module is empty, the change applies to all loggers
+// that have no module-specific override.
+func SetDebug(module string, debug bool) {
+	updateOverrides(func(o *debugOverrides) {
+		if module == "" {
+			o.global = &debug
+			return
+		}
+		o.modules[module] = debug
+	})
+}
+
+// ResetDebug removes the override set by SetDebug for the module. If module
+// is empty, all overrides are removed.
+func ResetDebug(module string) {
+	updateOverrides(func(o *debugOverrides) {
+		if module == "" {
+			o.global = nil
+			o.modules = map[string]bool{}
+			return
+		}
+		delete(o.modules, module)
+	})
+}
+
+// DebugOverrides returns overrides set using SetDebug, the global one (if
+// any) goes first, others are sorted by the module selector.
+func DebugOverrides() []DebugOverride {
+	o := overrides.Load()
+	if o == nil {
+		return nil
+	}
+
+	res := make([]DebugOverride, 0, len(o.modules)+1)
+	if o.global != nil {
+		res = append(res, DebugOverride{Debug: *o.global})
+	}
+	for sel, debug := range o.modules {
+		res = append(res, DebugOverride{Module: sel, Debug: debug})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Module < res[j].Module
+	})
+	return res
+}
+
+// IsDebug reports whether debug messages should be written by the logger.
+// Overrides set by SetDebug take precedence over the Debug field.
+func (l Logger) IsDebug() bool {
+	o := overrides.Load()
+	if o == nil {
+		return l.Debug
+	}
+	if debug, ok := o.match(l.Name, l.Instance); ok {
+		return debug
+	}
+	if o.global != nil {
+		return *o.global
+	}
+	return l.Debug
+}
@@ -0,0 +1,75 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDebugOverrides(t *testing.T) {
+	defer ResetDebug("")
+
+	remote := Logger{Name: "remote", Instance: "outbound_delivery"}
+	dane := Logger{Name: "remote/dane"}
+	smtp := Logger{Name: "smtp", Debug: true}
+
+	check := func(l Logger, expected bool) {
+		t.Helper()
+		if l.IsDebug() != expected {
+			t.Errorf("IsDebug for %s/%s = %v, expected %v", l.Name, l.Instance, l.IsDebug(), expected)
+		}
+	}
+
+	check(remote, false)
+	check(smtp, true)
+
+	SetDebug("target.remote", true)
+	check(remote, true)
+	check(dane, true)
+	check(smtp, true)
+
+	SetDebug("", false)
+	check(remote, true)
+	check(smtp, false)
+
+	// Instance selector takes precedence.
+	SetDebug("outbound_delivery", false)
+	check(remote, false)
+	check(dane, true)
+
+	expected := []DebugOverride{
+		{Debug: false},
+		{Module: "outbound_delivery", Debug: false},
+		{Module: "target.remote", Debug: true},
+	}
+	if overrides := DebugOverrides(); !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("Wrong overrides: %+v", overrides)
+	}
+
+	ResetDebug("outbound_delivery")
+	check(remote, true)
+
+	ResetDebug("")
+	check(remote, false)
+	check(smtp, true)
+	if overrides := DebugOverrides(); len(overrides) != 0 {
+		t.Errorf("Overrides are not removed: %+v", overrides)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournaldOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	out, err := newJournaldOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	l := Logger{Out: out, Name: "queue", Instance: "remote_queue"}
+	l.Msg("delivery attempt", "trace_id", "0123456789abcdef", "reason", "line 1\nline 2", "delay", time.Second)
+
+	buf := make([]byte, 4096)
+	_ = sock.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := sock.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf[:n]
+
+	for _, field := range []string{
+		"MESSAGE=queue: delivery attempt\t{\"delay\":\"1s\",\"reason\":\"line 1\\nline 2\",\"trace_id\":\"0123456789abcdef\"}\n",
+		"PRIORITY=6\n",
+		"SYSLOG_IDENTIFIER=maddy\n",
+		"MADDY_MODULE=queue\n",
+		"MADDY_INSTANCE=remote_queue\n",
+		"MADDY_TRACE_ID=0123456789abcdef\n",
+		"MADDY_DELAY=1s\n",
+	} {
+		if !bytes.Contains(msg, []byte(field)) {
+			t.Errorf("Missing field %q in %q", field, msg)
+		}
+	}
+
+	var multiline bytes.Buffer
+	multiline.WriteString("MADDY_REASON\n")
+	_ = binary.Write(&multiline, binary.LittleEndian, uint64(len("line 1\nline 2")))
+	multiline.WriteString("line 1\nline 2\n")
+	if !bytes.Contains(msg, multiline.Bytes()) {
+		t.Errorf("Missing binary-safe field in %q", msg)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type jsonOutput struct {
+	wc io.WriteCloser
+}
+
+func (j jsonOutput) Write(stamp time.Time, debug bool, msg string) {
+	level := LevelInfo
+	if debug {
+		level = LevelDebug
+	}
+	j.WriteEntry(Entry{Stamp: stamp, Level: level, Message: msg})
+}
+
+func (j jsonOutput) WriteEntry(e Entry) {
+	builder := strings.Builder{}
+	if err := marshalEntry(&builder, e); err != nil {
+		// Fallback to writing the message without fields.
+		builder.Reset()
+		_ = marshalEntry(&builder, Entry{
+			Stamp:    e.Stamp,
+			Level:    e.Level,
+			Module:   e.Module,
+			Instance: e.Instance,
+			Message:  fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, e.Message, e.Fields),
+		})
+	}
+	builder.WriteRune('\n')
+	if _, err := io.WriteString(j.wc, builder.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to write message to log: %v\n", err)
+	}
+}
+
+func (j jsonOutput) Close() error {
+	return j.wc.Close()
+}
+
+// marshalEntry writes the entry as a single-line JSON object.
+//
+// The trace_id field is moved to the top level so messages related to one
+// email message can be found easily, other fields are placed in the
+// "fields" object.
+func marshalEntry(output *strings.Builder, e Entry) error {
+	writeField := func(key string, val interface{}) error {
+		jsonVal, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		output.WriteString(`,"`)
+		output.WriteString(key)
+		output.WriteString(`":`)
+		output.Write(jsonVal)
+		return nil
+	}
+
+	output.WriteString(`{"ts":"`)
+	output.WriteString(e.Stamp.UTC().Format("2006-01-02T15:04:05.000Z"))
+	output.WriteRune('"')
+	if err := writeField("level", e.Level); err != nil {
+		return err
+	}
+	if e.Module != "" {
+		if err := writeField("module", e.Module); err != nil {
+			return err
+		}
+	}
+	if e.Instance != "" {
+		if err := writeField("instance", e.Instance); err != nil {
+			return err
+		}
+	}
+	if err := writeField("msg", e.Message); err != nil {
+		return err
+	}
+
+	fields := e.Fields
+	if traceID, ok := fields["trace_id"]; ok {
+		if err := writeField("trace_id", traceID); err != nil {
+			return err
+		}
+		fields = make(map[string]interface{}, len(e.Fields))
+		for k, v := range e.Fields {
+			if k != "trace_id" {
+				fields[k] = v
+			}
+		}
+	}
+	if len(fields) != 0 {
+		output.WriteString(`,"fields":`)
+		if err := marshalOrderedJSON(output, fields); err != nil {
+			return err
+		}
+	}
+
+	output.WriteRune('}')
+	return nil
+}
+
+// WriteCloserJSONOutput returns a log.Output implementation that will write
+// messages to the provided io.WriteCloser as JSON objects, one per line.
+//
+// Each object contains the timestamp ("ts", ISO 8601 in UTC), level ("debug",
+// "info" or "error"), "module", "instance" and "msg" keys. The trace ID of
+// the email message is included in the "trace_id" key, other
+// fields are in the "fields" object.
+//
+// Closing returned log.Output object will close the underlying
+// io.WriteCloser.
+//
+// As with WriteCloserOutput, goroutine-safety depends on the io.Writer.
+func WriteCloserJSONOutput(wc io.WriteCloser) Output {
+	return jsonOutput{wc}
+}
+
+// WriterJSONOutput returns a log.Output implementation that will write
+// messages to the provided io.Writer as JSON objects, see
+// WriteCloserJSONOutput for details.
+//
+// Closing returned log.Output object will have no effect on the
+// underlying io.Writer.
+func WriterJSONOutput(w io.Writer) Output {
+	return jsonOutput{nopCloser{w}}
+}
@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONOutput(t *testing.T) {
+	var jsonBuf, textBuf strings.Builder
+	l := Logger{
+		Out: MultiOutput(
+			WriterJSONOutput(&jsonBuf),
+			FuncOutput(func(_ time.Time, debug bool, msg string) {
+				textBuf.WriteString(msg)
+				textBuf.WriteRune('\n')
+			}, func() error { return nil }),
+		),
+		Name:     "queue",
+		Instance: "remote_queue",
+		Fields:   map[string]interface{}{"trace_id": "0123456789abcdef"},
+	}
+
+	l.Error("delivery failed", errors.New("connection refused"), "rcpt", "foo@example.org", "delay", time.Second)
+	l.Printf("plain %d", 1)
+
+	if textBuf.String() != "queue: delivery failed\t{\"delay\":\"1s\",\"rcpt\":\"foo@example.org\",\"reason\":\"connection refused\",\"trace_id\":\"0123456789abcdef\"}\n"+
+		"queue: plain 1\t{\"trace_id\":\"0123456789abcdef\"}\n" {
+		t.Errorf("Wrong text output: %q", textBuf.String())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(jsonBuf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", jsonBuf.String())
+	}
+	var entry struct {
+		TS       string                 `json:"ts"`
+		Level    string                 `json:"level"`
+		Module   string                 `json:"module"`
+		Instance string                 `json:"instance"`
+		Msg      string                 `json:"msg"`
+		TraceID  string                 `json:"trace_id"`
+		Fields   map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse("2006-01-02T15:04:05.000Z", entry.TS); err != nil {
+		t.Error("Wrong timestamp:", err)
+	}
+	if entry.Level != "error" || entry.Module != "queue" || entry.Instance != "remote_queue" ||
+		entry.Msg != "delivery failed" || entry.TraceID != "0123456789abcdef" {
+		t.Errorf("Wrong entry: %+v", entry)
+	}
+	if len(entry.Fields) != 3 || entry.Fields["rcpt"] != "foo@example.org" ||
+		entry.Fields["reason"] != "connection refused" || entry.Fields["delay"] != "1s" {
+		t.Errorf("Wrong fields: %v", entry.Fields)
+	}
+
+	if !strings.HasSuffix(lines[1], `,"level":"info","module":"queue","instance":"remote_queue","msg":"plain 1","trace_id":"0123456789abcdef"}`) {
+		t.Errorf("Wrong entry: %s", lines[1])
+	}
+}
@@ -42,9 +42,12 @@ import (
 // No serialization is provided by Logger, its log.Output responsibility to
 // ensure goroutine-safety if necessary.
 type Logger struct {
-	Out   Output
-	Name  string
-	Debug bool
+	Out  Output
+	Name string
+	// Name of the module instance. It is included only in structured
+	// (JSON) output.
+	Instance string
+	Debug    bool
 
 	// Additional fields that will be added
 	// to the Msg output.
@@ -57,25 +60,25 @@ func (l Logger) Zap() *zap.Logger {
 }
 
 func (l Logger) Debugf(format string, val ...interface{}) {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return
 	}
-	l.log(true, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.logMsg(LevelDebug, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Debugln(val ...interface{}) {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return
 	}
-	l.log(true, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.logMsg(LevelDebug, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
 }
 
 func (l Logger) Printf(format string, val ...interface{}) {
-	l.log(false, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.logMsg(LevelInfo, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Println(val ...interface{}) {
-	l.log(false, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.logMsg(LevelInfo, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
 }
 
 // Msg writes an event log message in a machine-readable format (currently
@@ -95,7 +98,7 @@ func (l Logger) Println(val ...interface{}) {
 func (l Logger) Msg(msg string, fields ...interface{}) {
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(false, l.formatMsg(msg, m))
+	l.logMsg(LevelInfo, msg, m)
 }
 
 // Error writes an event log message in a machine-readable format (currently
@@ -127,16 +130,16 @@ func (l Logger) Error(msg string, err error, fields ...interface{}) {
 	}
 	fieldsToMap(fields, allFields)
 
-	l.log(false, l.formatMsg(msg, allFields))
+	l.logMsg(LevelError, msg, allFields)
 }
 
 func (l Logger) DebugMsg(kind string, fields ...interface{}) {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return
 	}
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(true, l.formatMsg(kind, m))
+	l.logMsg(LevelDebug, kind, m)
 }
 
 func fieldsToMap(fields []interface{}, out map[string]interface{}) {
@@ -159,19 +162,26 @@ func fieldsToMap(fields []interface{}, out map[string]interface{}) {
 	}
 }
 
-func (l Logger) formatMsg(msg string, fields map[string]interface{}) string {
-	formatted := strings.Builder{}
-
-	formatted.WriteString(msg)
-	formatted.WriteRune('\t')
-
-	if len(l.Fields)+len(fields) != 0 {
+// logMsg adds logger fields to the message and sends it to the output.
+func (l Logger) logMsg(level Level, msg string, fields map[string]interface{}) {
+	if len(l.Fields) != 0 {
 		if fields == nil {
-			fields = make(map[string]interface{})
+			fields = make(map[string]interface{}, len(l.Fields))
 		}
 		for k, v := range l.Fields {
 			fields[k] = v
 		}
+	}
+	l.log(Entry{Level: level, Message: msg, Fields: fields}, formatMsg(msg, fields))
+}
+
+func formatMsg(msg string, fields map[string]interface{}) string {
+	formatted := strings.Builder{}
+
+	formatted.WriteString(msg)
+	formatted.WriteRune('\t')
+
+	if len(fields) != 0 {
 		if err := marshalOrderedJSON(&formatted, fields); err != nil {
 			// Fallback to printing the message with minimal processing.
 			return fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, msg, fields)
@@ -189,32 +199,41 @@ type LogFormatter interface {
 // to it will be written as a separate log messages.
 // No line-buffering is done.
 func (l Logger) Write(s []byte) (int, error) {
-	l.log(false, strings.TrimRight(string(s), "\n"))
+	msg := strings.TrimRight(string(s), "\n")
+	l.log(Entry{Level: LevelInfo, Message: msg}, msg)
 	return len(s), nil
 }
 
 // DebugWriter returns a writer that will act like Logger.Write
-// but will use debug flag on messages. If Logger.Debug is false,
+// but will use debug flag on messages. If Logger.IsDebug is false,
 // Write method of returned object will be no-op.
 func (l Logger) DebugWriter() io.Writer {
-	if !l.Debug {
+	if !l.IsDebug() {
 		return io.Discard
 	}
 	l.Debug = true
 	return &l
 }
 
-func (l Logger) log(debug bool, s string) {
+// log sends the entry to the output. text is the message formatted for
+// plain-text outputs.
+func (l Logger) log(e Entry, text string) {
 	if l.Name != "" {
-		s = l.Name + ": " + s
+		text = l.Name + ": " + text
 	}
+	e.Stamp = time.Now()
+	e.Module = l.Name
+	e.Instance = l.Instance
+	e.text = text
+
+	notifySubscribers(e)
 
 	if l.Out != nil {
-		l.Out.Write(time.Now(), debug, s)
+		WriteEntry(l.Out, e)
 		return
 	}
 	if DefaultLogger.Out != nil {
-		DefaultLogger.Out.Write(time.Now(), debug, s)
+		WriteEntry(DefaultLogger.Out, e)
 		return
 	}
 
@@ -52,21 +52,7 @@ func marshalOrderedJSON(output *strings.Builder, m map[string]interface{}) error
 		output.Write(jsonKey)
 		output.WriteString(":")
 
-		val := m[key]
-		switch casted := val.(type) {
-		case time.Time:
-			val = casted.Format("2006-01-02T15:04:05.000")
-		case time.Duration:
-			val = casted.String()
-		case LogFormatter:
-			val = casted.FormatLog()
-		case fmt.Stringer:
-			val = casted.String()
-		case error:
-			val = casted.Error()
-		}
-
-		jsonValue, err := json.Marshal(val)
+		jsonValue, err := json.Marshal(formatValue(m[key]))
 		if err != nil {
 			return err
 		}
@@ -76,3 +62,21 @@ func marshalOrderedJSON(output *strings.Builder, m map[string]interface{}) error
 
 	return nil
 }
+
+// formatValue converts the field value into the form used in the log
+// message.
+func formatValue(val interface{}) interface{} {
+	switch casted := val.(type) {
+	case time.Time:
+		return casted.Format("2006-01-02T15:04:05.000")
+	case time.Duration:
+		return casted.String()
+	case LogFormatter:
+		return casted.FormatLog()
+	case fmt.Stringer:
+		return casted.String()
+	case error:
+		return casted.Error()
+	}
+	return val
+}
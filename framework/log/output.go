@@ -27,6 +27,45 @@ type Output interface {
 	Close() error
 }
 
+// Level is the severity of the log message.
+type Level string
+
+const (
+	LevelDebug Level = "debug"
+	LevelInfo  Level = "info"
+	LevelError Level = "error"
+)
+
+// Entry is the log message in a structured form.
+type Entry struct {
+	Stamp    time.Time
+	Level    Level
+	Module   string
+	Instance string
+	Message  string
+	Fields   map[string]interface{}
+
+	// Message formatted for outputs that do not implement EntryOutput.
+	text string
+}
+
+// EntryOutput is implemented by outputs that use the structured form of
+// messages (e.g. to serialize them as JSON).
+type EntryOutput interface {
+	Output
+	WriteEntry(e Entry)
+}
+
+// WriteEntry writes the entry to the output using the structured form if
+// it is supported or the formatted message otherwise.
+func WriteEntry(out Output, e Entry) {
+	if eo, ok := out.(EntryOutput); ok {
+		eo.WriteEntry(e)
+		return
+	}
+	out.Write(e.Stamp, e.Level == LevelDebug, e.text)
+}
+
 type multiOut struct {
 	outs []Output
 }
@@ -37,6 +76,12 @@ func (m multiOut) Write(stamp time.Time, debug bool, msg string) {
 	}
 }
 
+func (m multiOut) WriteEntry(e Entry) {
+	for _, out := range m.outs {
+		WriteEntry(out, e)
+	}
+}
+
 func (m multiOut) Close() error {
 	for _, out := range m.outs {
 		if err := out.Close(); err != nil {
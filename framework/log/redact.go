@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RedactMode specifies how personal data is redacted in log messages.
+type RedactMode int
+
+const (
+	// RedactOff leaves the value as is.
+	RedactOff RedactMode = iota
+	// RedactHash replaces the value with the truncated HMAC-SHA256 hash, so
+	// messages about the same address can still be correlated. The domain
+	// of email addresses is preserved.
+	RedactHash
+	// RedactTruncate keeps only the less specific part of the value: the
+	// domain of email addresses, the /24 (IPv4) or /48 (IPv6) network of IP
+	// addresses and the first few characters of the subject.
+	RedactTruncate
+	// RedactRemove replaces the value with "[redacted]".
+	RedactRemove
+)
+
+// RedactModes maps configuration values to redaction modes.
+var RedactModes = map[string]RedactMode{
+	"off":      RedactOff,
+	"hash":     RedactHash,
+	"truncate": RedactTruncate,
+	"remove":   RedactRemove,
+}
+
+// Redaction specifies how personal data is redacted in messages written to
+// an output.
+//
+// Email addresses and IP addresses are redacted in message texts and all
+// textual fields, subjects are redacted in fields named "subject" (or ending
+// with "_subject").
+type Redaction struct {
+	Addresses RedactMode
+	IPs       RedactMode
+	Subjects  RedactMode
+
+	// Key used for hashing, if it is empty, hashes of commonly used values
+	// can be reversed using a dictionary.
+	HashKey []byte
+}
+
+const (
+	redactedValue = "[redacted]"
+	// Amount of subject characters kept by RedactTruncate.
+	subjectTruncateLen = 10
+)
+
+var (
+	addressRe = regexp.MustCompile(`[\p{L}\p{N}.!#$%&'*+/=?^_{|}~-]+@[\p{L}\p{N}-]+(?:\.[\p{L}\p{N}-]+)+`)
+	ipv4Re    = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`)
+	ipv6Re    = regexp.MustCompile(`[0-9a-fA-F]*:[0-9a-fA-F]*:[0-9a-fA-F:.]*`)
+)
+
+func (r Redaction) hash(prefix, value string) string {
+	mac := hmac.New(sha256.New, r.HashKey)
+	mac.Write([]byte(strings.ToLower(value)))
+	return prefix + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+func (r Redaction) address(addr string) string {
+	at := strings.LastIndexByte(addr, '@')
+	switch r.Addresses {
+	case RedactHash:
+		return r.hash("", addr) + addr[at:]
+	case RedactTruncate:
+		return "***" + addr[at:]
+	case RedactRemove:
+		return redactedValue
+	}
+	return addr
+}
+
+func (r Redaction) ip(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return value
+	}
+	switch r.IPs {
+	case RedactHash:
+		return r.hash("ip-", ip.String())
+	case RedactTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case RedactRemove:
+		return redactedValue
+	}
+	return value
+}
+
+func (r Redaction) subject(subj string) string {
+	switch r.Subjects {
+	case RedactHash:
+		return r.hash("", subj)
+	case RedactTruncate:
+		runes := []rune(subj)
+		if len(runes) <= subjectTruncateLen {
+			return subj
+		}
+		return string(runes[:subjectTruncateLen]) + "..."
+	case RedactRemove:
+		return redactedValue
+	}
+	return subj
+}
+
+// text redacts email and IP addresses in the free-form text.
+func (r Redaction) text(s string) string {
+	if r.Addresses != RedactOff && strings.IndexByte(s, '@') != -1 {
+		s = addressRe.ReplaceAllStringFunc(s, r.address)
+	}
+	if r.IPs != RedactOff {
+		s = ipv4Re.ReplaceAllStringFunc(s, r.ip)
+		if strings.Count(s, ":") >= 2 {
+			s = ipv6Re.ReplaceAllStringFunc(s, r.ip)
+		}
+	}
+	return s
+}
+
+// field redacts the value of the message field. Non-textual values (numbers,
+// timestamps, etc) are returned as is.
+func (r Redaction) field(key string, value interface{}) interface{} {
+	if key == "subject" || strings.HasSuffix(key, "_subject") {
+		if r.Subjects == RedactOff {
+			return value
+		}
+		return r.subject(fmt.Sprint(value))
+	}
+
+	switch v := value.(type) {
+	case string:
+		return r.text(v)
+	case []string:
+		redacted := make([]string, len(v))
+		for i, s := range v {
+			redacted[i] = r.text(s)
+		}
+		return redacted
+	case time.Time, time.Duration:
+		return v
+	case LogFormatter:
+		return r.text(v.FormatLog())
+	case error:
+		return r.text(v.Error())
+	case fmt.Stringer:
+		return r.text(v.String())
+	}
+	return value
+}
+
+type redactOut struct {
+	out Output
+	r   Redaction
+}
+
+// RedactOutput returns the output that redacts personal data in messages
+// before writing them to out.
+func RedactOutput(out Output, r Redaction) Output {
+	return redactOut{out: out, r: r}
+}
+
+func (o redactOut) Write(stamp time.Time, debug bool, msg string) {
+	o.out.Write(stamp, debug, o.r.text(msg))
+}
+
+func (o redactOut) WriteEntry(e Entry) {
+	e.Message = o.r.text(e.Message)
+	if len(e.Fields) == 0 {
+		e.text = o.r.text(e.text)
+		WriteEntry(o.out, e)
+		return
+	}
+
+	fields := make(map[string]interface{}, len(e.Fields))
+	for k, v := range e.Fields {
+		fields[k] = o.r.field(k, v)
+	}
+	e.Fields = fields
+	e.text = formatMsg(e.Message, fields)
+	if e.Module != "" {
+		e.text = e.Module + ": " + e.text
+	}
+	WriteEntry(o.out, e)
+}
+
+func (o redactOut) Close() error {
+	return o.out.Close()
+}
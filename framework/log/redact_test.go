@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactOutput(t *testing.T) {
+	var plain, redacted strings.Builder
+	textOut := func(b *strings.Builder) Output {
+		return FuncOutput(func(_ time.Time, _ bool, msg string) {
+			b.WriteString(msg)
+			b.WriteRune('\n')
+		}, func() error { return nil })
+	}
+	l := Logger{
+		Out: MultiOutput(
+			textOut(&plain),
+			RedactOutput(textOut(&redacted), Redaction{
+				Addresses: RedactTruncate,
+				IPs:       RedactTruncate,
+				Subjects:  RedactRemove,
+			}),
+		),
+		Name: "smtp",
+	}
+
+	l.Msg("incoming message",
+		"sender", "foo@example.org",
+		"src_ip", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 41234},
+		"subject", "Hello",
+		"size", 123)
+	l.Error("RCPT error", errors.New("no such user: bar@example.com"), "src_ip", "[2001:db8:1:2::1]:25")
+	l.Printf("connection from 192.0.2.1 closed at 12:00:00")
+
+	if !strings.Contains(plain.String(), "foo@example.org") {
+		t.Fatalf("unredacted output is changed: %q", plain.String())
+	}
+	want := "smtp: incoming message\t{\"sender\":\"***@example.org\",\"size\":123,\"src_ip\":\"192.0.2.0:41234\",\"subject\":\"[redacted]\"}\n" +
+		"smtp: RCPT error\t{\"reason\":\"no such user: ***@example.com\",\"src_ip\":\"[2001:db8:1::]:25\"}\n" +
+		"smtp: connection from 192.0.2.0 closed at 12:00:00\t\n"
+	if redacted.String() != want {
+		t.Errorf("wrong redacted output:\n%s\nwant:\n%s", redacted.String(), want)
+	}
+}
+
+func TestRedaction_Hash(t *testing.T) {
+	r := Redaction{
+		Addresses: RedactHash,
+		IPs:       RedactHash,
+		Subjects:  RedactTruncate,
+		HashKey:   []byte("0123456789abcdef"),
+	}
+
+	first := r.text("from Foo@example.org")
+	if first == "from Foo@example.org" || !strings.HasSuffix(first, "@example.org") {
+		t.Fatalf("address is not hashed: %s", first)
+	}
+	if second := r.text("from foo@example.org"); second != first {
+		t.Errorf("hash is not stable: %s != %s", first, second)
+	}
+	if ip := r.text("192.0.2.1"); !strings.HasPrefix(ip, "ip-") {
+		t.Errorf("IP is not hashed: %s", ip)
+	}
+	if subj := r.field("subject", "Quarterly report for Q3"); subj != "Quarterly ..." {
+		t.Errorf("wrong truncated subject: %v", subj)
+	}
+	if v := r.field("delay", time.Second); v != time.Second {
+		t.Errorf("non-textual field is changed: %v", v)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type subscriber struct {
+	f func(Entry)
+}
+
+var (
+	subscribers     atomic.Pointer[[]*subscriber]
+	subscribersLock sync.Mutex // serializes writers
+)
+
+// Subscribe registers f to be called for each logged message, regardless of
+// the configured output. Debug messages are passed only if debug logging
+// is enabled for the logger.
+//
+// f is called synchronously by the goroutine writing the message and
+// should not block or write log messages itself.
+//
+// Returned function removes the subscription.
+func Subscribe(f func(Entry)) (cancel func()) {
+	sub := &subscriber{f: f}
+	updateSubscribers(func(subs []*subscriber) []*subscriber {
+		return append(subs, sub)
+	})
+	return func() {
+		updateSubscribers(func(subs []*subscriber) []*subscriber {
+			for i, s := range subs {
+				if s == sub {
+					return append(subs[:i], subs[i+1:]...)
+				}
+			}
+			return subs
+		})
+	}
+}
+
+// updateSubscribers replaces the list of subscribers with a copy modified
+// by f.
+func updateSubscribers(f func([]*subscriber) []*subscriber) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	var updated []*subscriber
+	if cur := subscribers.Load(); cur != nil {
+		updated = append(updated, *cur...)
+	}
+	updated = f(updated)
+	subscribers.Store(&updated)
+}
+
+func notifySubscribers(e Entry) {
+	subs := subscribers.Load()
+	if subs == nil {
+		return
+	}
+	for _, s := range *subs {
+		s.f(e)
+	}
+}
+
+// MarshalJSON encodes the entry the same way as JSON log output does.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	builder := strings.Builder{}
+	if err := marshalEntry(&builder, e); err != nil {
+		return nil, err
+	}
+	return []byte(builder.String()), nil
+}
+
+// FromModule reports whether the entry is written by the module matching
+// selector. Selector has the same meaning as for SetDebug: logger name,
+// its parent name (e.g. "smtp" for "smtp/sasl"), full module name or
+// instance name.
+func (e Entry) FromModule(selector string) bool {
+	if e.Instance != "" && e.Instance == selector {
+		return true
+	}
+	for name := e.Module; name != ""; {
+		if selector == name || strings.HasSuffix(selector, "."+name) {
+			return true
+		}
+		slash := strings.LastIndexByte(name, '/')
+		if slash == -1 {
+			break
+		}
+		name = name[:slash]
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import "testing"
+
+func TestSubscribe(t *testing.T) {
+	var got []Entry
+	cancel := Subscribe(func(e Entry) {
+		got = append(got, e)
+	})
+
+	l := Logger{Name: "remote", Out: NopOutput{}}
+	l.Msg("delivered", "rcpt", "foo@example.org")
+	l.Debugf("not written")
+	cancel()
+	l.Msg("after cancel")
+
+	if len(got) != 1 {
+		t.Fatalf("wrong entries: %+v", got)
+	}
+	if got[0].Message != "delivered" || got[0].Module != "remote" || got[0].Fields["rcpt"] != "foo@example.org" {
+		t.Fatalf("wrong entry: %+v", got[0])
+	}
+}
+
+func TestEntry_FromModule(t *testing.T) {
+	e := Entry{Module: "remote/dane", Instance: "outbound_delivery"}
+	for sel, expected := range map[string]bool{
+		"remote/dane":       true,
+		"remote":            true,
+		"target.remote":     true,
+		"outbound_delivery": true,
+		"dane":              false,
+		"smtp":              false,
+		"target.smtp":       false,
+	} {
+		if actual := e.FromModule(sel); actual != expected {
+			t.Errorf("FromModule(%q) = %v, want %v", sel, actual, expected)
+		}
+	}
+}
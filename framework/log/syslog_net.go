@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// SyslogFacility returns the numeric code of the syslog facility.
+func SyslogFacility(name string) (int, error) {
+	facility, ok := syslogFacilities[name]
+	if !ok {
+		return 0, fmt.Errorf("log: unknown syslog facility: %s", name)
+	}
+	return facility, nil
+}
+
+func syslogSeverity(level Level) int {
+	switch level {
+	case LevelDebug:
+		return 7
+	case LevelError:
+		return 3
+	default:
+		return 6
+	}
+}
+
+type netSyslogOut struct {
+	network  string
+	addr     string
+	facility int
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (s *netSyslogOut) Write(stamp time.Time, debug bool, msg string) {
+	level := LevelInfo
+	if debug {
+		level = LevelDebug
+	}
+	s.send(stamp, level, "", msg)
+}
+
+func (s *netSyslogOut) WriteEntry(e Entry) {
+	s.send(e.Stamp, e.Level, e.Module, e.text)
+}
+
+// format formats the message according to RFC 5424.
+func (s *netSyslogOut) format(stamp time.Time, level Level, msgID, msg string) string {
+	if msgID == "" {
+		msgID = "-"
+	} else if len(msgID) > 32 {
+		msgID = msgID[:32]
+	}
+	return fmt.Sprintf("<%d>1 %s %s maddy %d %s - %s",
+		s.facility*8+syslogSeverity(level),
+		stamp.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		s.hostname, os.Getpid(), msgID, msg)
+}
+
+func (s *netSyslogOut) send(stamp time.Time, level Level, msgID, msg string) {
+	formatted := s.format(stamp, level, msgID, msg)
+	if s.network == "tcp" {
+		// Octet counting framing (RFC 6587).
+		formatted = strconv.Itoa(len(formatted)) + " " + formatted
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Retry once to reconnect if the connection was closed by the server.
+	var err error
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			s.conn, err = net.DialTimeout(s.network, s.addr, 10*time.Second)
+			if err != nil {
+				continue
+			}
+		}
+		if _, err = s.conn.Write([]byte(formatted)); err == nil {
+			return
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	fmt.Fprintf(os.Stderr, "!!! Failed to send message to syslog server: %v\n", err)
+}
+
+func (s *netSyslogOut) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// NetSyslogOutput returns a log.Output implementation that will send
+// messages to the syslog server in the RFC 5424 format.
+//
+// network should be "udp", "tcp" or "unixgram". Messages sent over TCP use
+// the octet counting framing (RFC 6587). Module name is used as MSGID.
+//
+// Returned log.Output object is goroutine-safe.
+func NetSyslogOutput(network, addr string, facility int) (Output, error) {
+	switch network {
+	case "udp", "tcp", "unixgram":
+	default:
+		return nil, fmt.Errorf("log: unsupported syslog transport: %s", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &netSyslogOut{
+		network:  network,
+		addr:     addr,
+		facility: facility,
+		hostname: strings.ReplaceAll(hostname, " ", "_"),
+	}
+
+	s.conn, err = net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("log: %w", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var rfc5424Line = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z \S+ maddy \d+ (\S+) - (.*)$`)
+
+func TestNetSyslogOutput_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	out, err := NetSyslogOutput("udp", pc.LocalAddr().String(), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	l := Logger{Out: out, Name: "smtp"}
+	l.Error("DATA error", net.ErrClosed)
+
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := rfc5424Line.FindStringSubmatch(string(buf[:n]))
+	if match == nil {
+		t.Fatalf("Malformed message: %q", buf[:n])
+	}
+	// local0.err
+	if match[1] != "131" || match[2] != "smtp" || !strings.HasPrefix(match[3], "smtp: DATA error\t{") {
+		t.Errorf("Wrong message: %q", buf[:n])
+	}
+}
+
+func TestNetSyslogOutput_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	out, err := NetSyslogOutput("tcp", ln.Addr().String(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l := Logger{Out: out, Debug: true}
+	l.Debugf("first")
+	l.Printf("second")
+
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []struct {
+		pri, msg string
+	}{
+		{"23", "first\t"},
+		{"22", "second\t"},
+	} {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		match := rfc5424Line.FindStringSubmatch(string(msg))
+		if match == nil {
+			t.Fatalf("Malformed message: %q", msg)
+		}
+		if match[1] != expected.pri || match[2] != "-" || match[3] != expected.msg {
+			t.Errorf("Wrong message: %q", msg)
+		}
+	}
+}
@@ -18,7 +18,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package module
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
 
 // ErrUnknownCredentials should be returned by auth. provider if supplied
 // credentials are valid for it but are not recognized (e.g. not found in
@@ -42,3 +47,36 @@ type PlainUserDB interface {
 	SetUserPassword(username, password string) error
 	DeleteUser(username string) error
 }
+
+// AuthAttempt describes a single authentication attempt for AuthPolicy
+// modules.
+type AuthAttempt struct {
+	// Username as it was provided by the client.
+	Username string
+
+	// Password provided by the client. AuthPolicy implementations should
+	// never store or send it as is.
+	Password string
+
+	// Address of the client. Can be nil if not known.
+	RemoteAddr net.Addr
+}
+
+// AuthPolicy is the interface implemented by modules that make
+// allow/deny decisions for authentication attempts based on information
+// external to the credentials store (e.g. a brute-force detection daemon).
+//
+// Modules implementing this interface should be registered with
+// "auth_policy." prefix in name.
+type AuthPolicy interface {
+	// AllowAuth is called before credentials are checked.
+	//
+	// If it returns an error, the attempt is rejected. If it returns non-zero
+	// delay, the caller should wait for the specified duration before
+	// checking credentials.
+	AllowAuth(ctx context.Context, attempt AuthAttempt) (delay time.Duration, err error)
+
+	// ReportAuth is called after credentials are checked with the result
+	// of this check.
+	ReportAuth(ctx context.Context, attempt AuthAttempt, success bool)
+}
@@ -20,6 +20,7 @@ package module
 
 import (
 	"context"
+	"io"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -103,6 +104,11 @@ type CheckResult struct {
 	// This value is copied into MsgMetadata by the msgpipeline.
 	Quarantine bool
 
+	// Score is the numeric result of the check (e.g. the spam score), if the
+	// check produces one. It can be referenced by pipeline check rules
+	// regardless of the action taken by the check.
+	Score float64
+
 	// AuthResult is the information that is supposed to
 	// be included in Authentication-Results header.
 	AuthResult []authres.Result
@@ -110,4 +116,36 @@ type CheckResult struct {
 	// Header is the header fields that should be
 	// added to the header after all checks.
 	Header textproto.Header
+
+	// Rewrite is the message that should replace the checked one.
+	// Only results returned by CheckBody can set it.
+	//
+	// Fields from Header and Authentication-Results are added
+	// on top of the replaced header. If multiple checks rewrite the message,
+	// only one rewrite is used and the rest is discarded.
+	Rewrite *MsgRewrite
+}
+
+// MsgRewrite is the replacement for the message returned by the check.
+//
+// The Body buffer is never removed by the caller so it should either be the
+// body passed to CheckBody (if only the header is changed) or not hold any
+// resources besides memory (e.g. be a buffer.MemoryBuffer).
+type MsgRewrite struct {
+	Header textproto.Header
+	Body   buffer.Buffer
+}
+
+// SpamLearner is an optional interface that can be implemented by Check
+// modules that use trainable classifiers.
+//
+// It is used by storage modules to report messages moved into and out of
+// the Junk mailbox by users.
+type SpamLearner interface {
+	// LearnMessage trains the classifier using the full message
+	// (header and body) read from msg.
+	//
+	// username is the account name of the user that classified the message,
+	// it can be used to select per-user statistics.
+	LearnMessage(ctx context.Context, username string, spam bool, msg io.Reader) error
 }
@@ -28,10 +28,11 @@ import (
 // Modifier is the module interface for modules that can mutate the
 // processed message or its meta-data.
 //
-// Currently, the message body can't be mutated for efficiency and
-// correctness reasons: It would require "rebuffering" (see buffer.Buffer doc),
+// Generally, the message body should not be mutated for efficiency and
+// correctness reasons: It requires "rebuffering" (see buffer.Buffer doc),
 // can invalidate assertions made on the body contents before modification and
-// will break DKIM signatures.
+// will break DKIM signatures. Modifiers that have to change it (e.g. to add
+// a footer) should implement BodyModifierState.
 //
 // Only message header can be modified. Furthermore, it is highly discouraged for
 // modifiers to remove or change existing fields to prevent issues outlined
@@ -73,11 +74,32 @@ type ModifierState interface {
 	// RewriteBody modifies passed Header argument and may optionally
 	// inspect the passed body buffer to make a decision on new header field values.
 	//
-	// There is no way to modify the body and RewriteBody should avoid
-	// removing existing header fields and changing their values.
+	// The body can't be modified (see BodyModifierState) and RewriteBody
+	// should avoid removing existing header fields and changing their values.
 	RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error
 
 	// Close is called after the message processing ends, even if any of the
 	// Rewrite* functions return an error.
 	Close() error
 }
+
+// BodyModifierState is an optional interface that can be implemented by
+// ModifierState to replace the message body.
+type BodyModifierState interface {
+	// ModifyBody is called instead of RewriteBody and returns the new
+	// message body. The passed body should be returned if it is not changed.
+	//
+	// The returned buffer is never removed by the caller so it should not
+	// hold any resources besides memory (e.g. be a buffer.MemoryBuffer).
+	ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+}
+
+// RewriteBody calls ModifyBody if the state implements BodyModifierState
+// and RewriteBody otherwise. It returns the body that should be used
+// further.
+func RewriteBody(ctx context.Context, state ModifierState, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	if bodyState, ok := state.(BodyModifierState); ok {
+		return bodyState.ModifyBody(ctx, h, body)
+	}
+	return body, state.RewriteBody(ctx, h, body)
+}
@@ -67,6 +67,11 @@ type ConnState struct {
 	// This field should be cleaned if the ConnState object is serialized
 	AuthPassword string
 
+	// Identity from the TLS client certificate verified according to the
+	// client_auth policy of the endpoint. Empty if the client did not
+	// present a certificate.
+	TLSClientIdentity string
+
 	ModData ModSpecificData
 }
 
@@ -86,6 +91,14 @@ type MsgMetadata struct {
 	// message source module.
 	ID string
 
+	// Stable identifier assigned when the message is received. Unlike ID,
+	// it is not changed when the message is passed through the queue and is
+	// also used for DSNs generated for the message, so it can be used to
+	// find all log entries related to the message.
+	//
+	// Empty for messages received by older versions.
+	TraceID string `json:",omitempty"`
+
 	// Original message sender address as it was received by the message source.
 	//
 	// Note that this field is meant for use for tracing purposes.
@@ -106,6 +119,13 @@ type MsgMetadata struct {
 	// the message. It is set only by the message pipeline.
 	Quarantine bool
 
+	// CheckScores contains scores returned by checks (see CheckResult.Score)
+	// keyed by the check name used in pipeline check rules.
+	//
+	// This field is set by the message pipeline after all checks are
+	// executed, so it can be used by modifiers and delivery targets.
+	CheckScores map[string]float64 `json:",omitempty"`
+
 	// OriginalRcpts contains the mapping from the final recipient to the
 	// recipient that was presented by the client.
 	//
@@ -117,6 +137,13 @@ type MsgMetadata struct {
 	// which is usually unwanted.
 	OriginalRcpts map[string]string
 
+	// RcptDetails contains the detail (subaddress) part of recipient
+	// addresses keyed by the recipient address before and after the
+	// rewrite by modify.subaddress, e.g. "tag" for user+tag@example.org.
+	//
+	// Use RcptDetail to get the value for the final recipient.
+	RcptDetails map[string]string `json:",omitempty"`
+
 	// SMTPOpts contains the SMTP MAIL FROM command arguments, if the message
 	// was accepted over SMTP or SMTP-like protocol (such as LMTP).
 	//
@@ -145,14 +172,56 @@ type MsgMetadata struct {
 // - SrcAddr is not copied and copy field references original value.
 func (msgMeta *MsgMetadata) DeepCopy() *MsgMetadata {
 	cpy := *msgMeta
+	if msgMeta.CheckScores != nil {
+		cpy.CheckScores = make(map[string]float64, len(msgMeta.CheckScores))
+		for k, v := range msgMeta.CheckScores {
+			cpy.CheckScores[k] = v
+		}
+	}
+	if msgMeta.RcptDetails != nil {
+		cpy.RcptDetails = make(map[string]string, len(msgMeta.RcptDetails))
+		for k, v := range msgMeta.RcptDetails {
+			cpy.RcptDetails[k] = v
+		}
+	}
 	// There is no good way to copy net.Addr, but it should not be
 	// modified by anything anyway so we are safe.
 	return &cpy
 }
 
+// RcptDetail returns the detail part of the recipient address recorded in
+// RcptDetails. Recipient rewrites done after the detail was recorded are
+// followed using OriginalRcpts.
+func (msgMeta *MsgMetadata) RcptDetail(rcpt string) (string, bool) {
+	seen := make(map[string]struct{})
+	for {
+		if detail, ok := msgMeta.RcptDetails[rcpt]; ok {
+			return detail, true
+		}
+		seen[rcpt] = struct{}{}
+
+		original, ok := msgMeta.OriginalRcpts[rcpt]
+		if !ok {
+			return "", false
+		}
+		if _, ok := seen[original]; ok {
+			return "", false
+		}
+		rcpt = original
+	}
+}
+
 // GenerateMsgID generates a string usable as MsgID field in module.MsgMeta.
 func GenerateMsgID() (string, error) {
 	rawID := make([]byte, 4)
 	_, err := io.ReadFull(rand.Reader, rawID)
 	return hex.EncodeToString(rawID), err
 }
+
+// GenerateTraceID generates a string usable as TraceID field in
+// module.MsgMeta.
+func GenerateTraceID() (string, error) {
+	rawID := make([]byte, 8)
+	_, err := io.ReadFull(rand.Reader, rawID)
+	return hex.EncodeToString(rawID), err
+}
@@ -0,0 +1,47 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"time"
+)
+
+// SharedState is the interface implemented by modules that provide storage
+// for short-lived runtime state (counters, timestamps, etc) that may need to
+// be shared between multiple server instances, e.g. for rate limiting.
+//
+// Modules implementing this interface should be registered with "state."
+// prefix in name.
+type SharedState interface {
+	// Incr atomically increments the counter stored under the key and returns
+	// the new value. If the key does not exist, it is created with the value
+	// of 1 and set to expire after ttl.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+
+	// Get returns the value stored under the key.
+	Get(ctx context.Context, key string) (string, bool, error)
+
+	// Set stores the value under the key replacing the existing one. The key
+	// expires after ttl.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+
+	// Del removes the key. It is not an error if key does not exist.
+	Del(ctx context.Context, key string) error
+}
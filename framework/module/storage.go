@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"context"
+
 	imapbackend "github.com/emersion/go-imap/backend"
 )
 
@@ -48,3 +50,15 @@ type ManageableStorage interface {
 	CreateIMAPAcct(username string) error
 	DeleteIMAPAcct(username string) error
 }
+
+// QuotaStorage is an optional interface implemented by Storage modules that
+// support per-account storage quotas.
+type QuotaStorage interface {
+	// QuotaUsage returns the amount of storage used by the account the
+	// message for rcptTo would be delivered to along with the account
+	// quota, both in bytes. Zero limit means no quota is set for the account.
+	//
+	// Address to account name mapping is done the same way as for message
+	// delivery.
+	QuotaUsage(ctx context.Context, rcptTo string) (used, limit int64, err error)
+}
@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package panics implements reporting of panics recovered in connection
+// and delivery handlers.
+//
+// Handlers that should survive a panic use Recover:
+//
+//	defer panics.Recover(s.log, "SMTP DATA", "msg_id", msgID)
+//
+// Or call Report from an existing recover() block if the panic needs to be
+// converted into an error.
+package panics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaxReports is the maximum amount of diagnostic bundles kept in the reports
+// directory. New panics are still logged once it is reached, but no
+// bundles are written.
+const MaxReports = 50
+
+var (
+	reportsLock sync.Mutex
+	reportsDir  string
+	version     string
+)
+
+var panicsCnt = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Name:      "panics",
+		Help:      "Panics recovered by connection and delivery handlers",
+	},
+	[]string{"module"},
+)
+
+// Configure sets the directory diagnostic bundles are written to. Empty dir
+// disables them. ver is included into bundles.
+func Configure(dir, ver string) {
+	reportsLock.Lock()
+	defer reportsLock.Unlock()
+	reportsDir = dir
+	version = ver
+}
+
+// Recover recovers the panic, if any, and reports it using Report. It should
+// be called directly by defer statement.
+func Recover(l log.Logger, what string, fields ...interface{}) {
+	if v := recover(); v != nil {
+		Report(l, what, v, debug.Stack(), fields...)
+	}
+}
+
+// Report logs the recovered panic value v using logger l, increments the
+// maddy_panics counter and writes the diagnostic bundle if enabled.
+//
+// what describes the operation that panicked (e.g. "SMTP DATA"), fields are
+// key-value pairs as accepted by log.Logger.Msg, typically they contain the
+// message ID.
+func Report(l log.Logger, what string, v interface{}, stack []byte, fields ...interface{}) {
+	module := l.Name
+	if module == "" {
+		module = "unknown"
+	}
+	panicsCnt.WithLabelValues(module).Inc()
+
+	logFields := make([]interface{}, 0, len(fields)+6)
+	logFields = append(logFields, fields...)
+	logFields = append(logFields, "context", what)
+	if path, err := writeBundle(l, what, v, stack, fields); err != nil {
+		logFields = append(logFields, "report_err", err)
+	} else if path != "" {
+		logFields = append(logFields, "report", path)
+	}
+	logFields = append(logFields, "stack", string(stack))
+
+	l.Error("panic recovered", fmt.Errorf("%v", v), logFields...)
+}
+
+// ServerLog is the logger for go-smtp and go-imap servers (ErrorLog field).
+// It reports panics recovered by these libraries using Report.
+type ServerLog struct {
+	Log log.Logger
+	// What is the context passed to Report.
+	What string
+	// Discard disables logging of messages other than panics.
+	Discard bool
+}
+
+func (l ServerLog) Printf(format string, v ...interface{}) {
+	// Both libraries use "panic serving %v: %v\n%s" with the remote
+	// address, panic value and the stack.
+	if strings.HasPrefix(format, "panic serving") && len(v) == 3 {
+		stack, _ := v[2].([]byte)
+		Report(l.Log, l.What, v[1], stack, "src_ip", fmt.Sprint(v[0]))
+		return
+	}
+	if !l.Discard {
+		l.Log.Printf(format, v...)
+	}
+}
+
+func (l ServerLog) Println(v ...interface{}) {
+	if !l.Discard {
+		l.Log.Println(v...)
+	}
+}
+
+func writeBundle(l log.Logger, what string, v interface{}, stack []byte, fields []interface{}) (string, error) {
+	reportsLock.Lock()
+	defer reportsLock.Unlock()
+
+	if reportsDir == "" {
+		return "", nil
+	}
+
+	existing, err := filepath.Glob(filepath.Join(reportsDir, "panic-*.txt"))
+	if err != nil {
+		return "", err
+	}
+	if len(existing) >= MaxReports {
+		return "", fmt.Errorf("reports limit reached (%d), remove old reports from %s", MaxReports, reportsDir)
+	}
+
+	if err := os.MkdirAll(reportsDir, 0o700); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	f, err := os.CreateTemp(reportsDir, "panic-"+now.UTC().Format("20060102T150405")+"-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(formatBundle(now, l, what, v, stack, fields))
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+func formatBundle(now time.Time, l log.Logger, what string, v interface{}, stack []byte, fields []interface{}) string {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "maddy panic report")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "Time:", now.UTC().Format(time.RFC3339))
+	fmt.Fprintln(&b, "Version:", version)
+	fmt.Fprintf(&b, "Runtime: %s %s/%s, %d goroutines\n", runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.NumGoroutine())
+	fmt.Fprintln(&b, "Module:", l.Name)
+	fmt.Fprintln(&b, "Instance:", l.Instance)
+	fmt.Fprintln(&b, "Context:", what)
+
+	ctxFields := make([]string, 0, len(l.Fields)+len(fields)/2)
+	for k, fv := range l.Fields {
+		ctxFields = append(ctxFields, fmt.Sprintf("%s=%v", k, fv))
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		ctxFields = append(ctxFields, fmt.Sprintf("%v=%v", fields[i], fields[i+1]))
+	}
+	sort.Strings(ctxFields)
+	for _, f := range ctxFields {
+		fmt.Fprintln(&b, "Field:", f)
+	}
+
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "Panic:", v)
+	fmt.Fprintln(&b)
+	b.Write(stack)
+
+	// Dump all goroutines to help with debugging of deadlocks and races
+	// that lead to the panic.
+	buf := make([]byte, 1024*1024)
+	buf = buf[:runtime.Stack(buf, true)]
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "All goroutines:")
+	fmt.Fprintln(&b)
+	b.Write(buf)
+
+	return b.String()
+}
+
+func init() {
+	prometheus.MustRegister(panicsCnt)
+}
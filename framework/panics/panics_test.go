@@ -0,0 +1,106 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package panics
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecover(t *testing.T) {
+	var entries []log.Entry
+	cancel := log.Subscribe(func(e log.Entry) {
+		if e.Module == "test_panics" {
+			entries = append(entries, e)
+		}
+	})
+	defer cancel()
+
+	dir := t.TempDir()
+	Configure(dir, "1.2.3")
+	defer Configure("", "")
+
+	l := log.Logger{Name: "test_panics", Instance: "inst"}
+	func() {
+		defer Recover(l, "test op", "msg_id", "aabbcc")
+		panic("oops")
+	}()
+
+	if len(entries) != 1 {
+		t.Fatalf("expected one log message, got %d", len(entries))
+	}
+	f := entries[0].Fields
+	if f["reason"] != "oops" || f["msg_id"] != "aabbcc" || f["context"] != "test op" {
+		t.Errorf("wrong fields: %v", f)
+	}
+	if !strings.Contains(f["stack"].(string), "TestRecover") {
+		t.Errorf("stack does not contain the panicking function: %v", f["stack"])
+	}
+	if cnt := testutil.ToFloat64(panicsCnt.WithLabelValues("test_panics")); cnt != 1 {
+		t.Errorf("wrong counter value: %v", cnt)
+	}
+
+	report, err := os.ReadFile(f["report"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Version: 1.2.3", "Instance: inst", "Context: test op", "Field: msg_id=aabbcc", "Panic: oops", "All goroutines:"} {
+		if !strings.Contains(string(report), s) {
+			t.Errorf("report does not contain %q:\n%s", s, report)
+		}
+	}
+}
+
+func TestRecover_NoPanic(t *testing.T) {
+	l := log.Logger{Name: "test_panics_none"}
+	func() {
+		defer Recover(l, "test op")
+	}()
+	if cnt := testutil.ToFloat64(panicsCnt.WithLabelValues("test_panics_none")); cnt != 0 {
+		t.Errorf("wrong counter value: %v", cnt)
+	}
+}
+
+func TestServerLog(t *testing.T) {
+	var entries []log.Entry
+	cancel := log.Subscribe(func(e log.Entry) {
+		if e.Module == "test_serverlog" {
+			entries = append(entries, e)
+		}
+	})
+	defer cancel()
+
+	l := ServerLog{Log: log.Logger{Name: "test_serverlog"}, What: "SMTP connection", Discard: true}
+	l.Printf("cannot read command: %v", "EOF")
+	if len(entries) != 0 {
+		t.Fatalf("unexpected log messages: %+v", entries)
+	}
+
+	l.Printf("panic serving %v: %v\n%s", "127.0.0.1:1234", "oops", []byte("stack"))
+	if len(entries) != 1 {
+		t.Fatalf("expected one log message, got %d", len(entries))
+	}
+	if f := entries[0].Fields; f["reason"] != "oops" || f["src_ip"] != "127.0.0.1:1234" || f["stack"] != "stack" {
+		t.Errorf("wrong fields: %v", f)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package slowlog implements logging of operations that take longer than
+// configured thresholds.
+//
+// Operations are timed using Start:
+//
+//	defer slowlog.Start(ctx, slowlog.DNS, "MX example.org").End()
+//
+// If the threshold for the operation kind is not set, Start and End are
+// no-op.
+package slowlog
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operation kinds.
+const (
+	Storage = "storage"
+	Blob    = "blob"
+	DNS     = "dns"
+	Check   = "check"
+)
+
+// Config contains thresholds for each operation kind, zero value disables
+// logging for the kind.
+type Config struct {
+	Storage time.Duration
+	Blob    time.Duration
+	DNS     time.Duration
+	Check   time.Duration
+}
+
+func (c *Config) threshold(kind string) time.Duration {
+	switch kind {
+	case Storage:
+		return c.Storage
+	case Blob:
+		return c.Blob
+	case DNS:
+		return c.DNS
+	case Check:
+		return c.Check
+	}
+	return 0
+}
+
+var (
+	current atomic.Pointer[Config]
+	logger  = log.Logger{Name: "slowlog"}
+)
+
+var slowOperations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "slowlog",
+		Name:      "operations",
+		Help:      "Operations that took longer than the configured threshold",
+	},
+	[]string{"kind"},
+)
+
+// Directive parses the slow_log block:
+//
+//	slow_log {
+//	    storage 500ms
+//	    blob 1s
+//	    dns 2s
+//	    check 5s
+//	}
+func Directive(m *config.Map, node config.Node) (interface{}, error) {
+	cfg := &Config{}
+
+	childM := config.NewMap(m.Globals, node)
+	childM.Duration("storage", false, false, time.Second, &cfg.Storage)
+	childM.Duration("blob", false, false, time.Second, &cfg.Blob)
+	childM.Duration("dns", false, false, 2*time.Second, &cfg.DNS)
+	childM.Duration("check", false, false, 5*time.Second, &cfg.Check)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Configure sets thresholds used for all operations. nil disables logging.
+func Configure(cfg *Config) {
+	current.Store(cfg)
+}
+
+type traceIDKey struct{}
+
+// ContextWithTraceID returns the context that will make operations started
+// with it include the message trace ID (module.MsgMetadata.TraceID) in log
+// messages.
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// Op is a timed operation.
+type Op struct {
+	kind, name string
+	traceID    string
+	start      time.Time
+	threshold  time.Duration
+}
+
+// Start starts timing the operation. name should describe the operation, e.g.
+// the queried domain name or the check name.
+func Start(ctx context.Context, kind, name string) Op {
+	cfg := current.Load()
+	if cfg == nil {
+		return Op{}
+	}
+	threshold := cfg.threshold(kind)
+	if threshold <= 0 {
+		return Op{}
+	}
+
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return Op{
+		kind:      kind,
+		name:      name,
+		traceID:   traceID,
+		start:     time.Now(),
+		threshold: threshold,
+	}
+}
+
+// End logs the operation if it took longer than the threshold.
+func (op Op) End() {
+	if op.threshold == 0 {
+		return
+	}
+	duration := time.Since(op.start)
+	if duration < op.threshold {
+		return
+	}
+
+	slowOperations.WithLabelValues(op.kind).Inc()
+	fields := []interface{}{
+		"kind", op.kind,
+		"op", op.name,
+		"duration", duration.Round(time.Millisecond),
+		"threshold", op.threshold,
+	}
+	if op.traceID != "" {
+		fields = append(fields, "trace_id", op.traceID)
+	}
+	logger.Msg("slow operation", fields...)
+}
+
+func init() {
+	prometheus.MustRegister(slowOperations)
+}
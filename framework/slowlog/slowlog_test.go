@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package slowlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+func TestOp(t *testing.T) {
+	var entries []log.Entry
+	cancel := log.Subscribe(func(e log.Entry) {
+		if e.Module == "slowlog" {
+			entries = append(entries, e)
+		}
+	})
+	defer cancel()
+
+	Configure(&Config{DNS: 10 * time.Millisecond})
+	defer Configure(nil)
+
+	ctx := ContextWithTraceID(context.Background(), "aabbcc")
+
+	// Below the threshold.
+	Start(ctx, DNS, "MX example.org").End()
+	// No threshold for the kind.
+	op := Start(ctx, Check, "spf")
+	time.Sleep(20 * time.Millisecond)
+	op.End()
+	if len(entries) != 0 {
+		t.Fatalf("unexpected log messages: %+v", entries)
+	}
+
+	op = Start(ctx, DNS, "TXT example.org")
+	time.Sleep(20 * time.Millisecond)
+	op.End()
+	if len(entries) != 1 {
+		t.Fatalf("expected one log message, got %d", len(entries))
+	}
+	if f := entries[0].Fields; f["kind"] != DNS || f["op"] != "TXT example.org" || f["trace_id"] != "aabbcc" {
+		t.Errorf("wrong fields: %v", f)
+	}
+}
+
+func TestOp_Disabled(t *testing.T) {
+	Configure(nil)
+	op := Start(context.Background(), Storage, "lookup")
+	if op != (Op{}) {
+		t.Fatalf("operation is timed when disabled: %+v", op)
+	}
+	op.End()
+}
@@ -19,6 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package external
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
@@ -26,30 +29,57 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 )
 
+// ErrAccountUnavailable is returned by helper functions if the helper
+// signals (using exit code 3) that credentials are valid but the account
+// cannot be used.
+var ErrAccountUnavailable = errors.New("helperauth: account is unavailable")
+
 func AuthUsingHelper(binaryPath, accountName, password string) error {
-	cmd := exec.Command(binaryPath)
+	_, err := AuthUsingHelperOutput(binaryPath, nil, accountName, password)
+	return err
+}
+
+// AuthUsingHelperOutput is similar to AuthUsingHelper but also passes
+// additional arguments to the helper and returns non-empty lines it wrote to
+// stdout.
+func AuthUsingHelperOutput(binaryPath string, args []string, accountName, password string) ([]string, error) {
+	cmd := exec.Command(binaryPath, args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return fmt.Errorf("helperauth: stdin init: %w", err)
+		return nil, fmt.Errorf("helperauth: stdin init: %w", err)
 	}
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("helperauth: process start: %w", err)
+		return nil, fmt.Errorf("helperauth: process start: %w", err)
 	}
 	if _, err := io.WriteString(stdin, accountName+"\n"); err != nil {
-		return fmt.Errorf("helperauth: stdin write: %w", err)
+		return nil, fmt.Errorf("helperauth: stdin write: %w", err)
 	}
 	if _, err := io.WriteString(stdin, password+"\n"); err != nil {
-		return fmt.Errorf("helperauth: stdin write: %w", err)
+		return nil, fmt.Errorf("helperauth: stdin write: %w", err)
 	}
 	if err := cmd.Wait(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			// Exit code 1 is for authentication failure.
-			if exitErr.ExitCode() != 1 {
-				return fmt.Errorf("helperauth: %w: %v", err, string(exitErr.Stderr))
+			// Exit code 1 is for authentication failure, 3 is for valid
+			// credentials of an unusable account.
+			switch exitErr.ExitCode() {
+			case 1:
+				return nil, module.ErrUnknownCredentials
+			case 3:
+				return nil, ErrAccountUnavailable
 			}
-			return module.ErrUnknownCredentials
+			return nil, fmt.Errorf("helperauth: %w: %v", err, string(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("helperauth: process wait: %w", err)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
 		}
-		return fmt.Errorf("helperauth: process wait: %w", err)
 	}
-	return nil
+	return lines, nil
 }
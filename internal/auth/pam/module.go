@@ -19,10 +19,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pam
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -34,6 +37,13 @@ type Auth struct {
 	instName   string
 	useHelper  bool
 	helperPath string
+	session    bool
+	lookupEnv  string
+
+	// Value of lookupEnv variable in PAM environment of the last successful
+	// authentication for each user.
+	envLock sync.Mutex
+	env     map[string]string
 
 	Log log.Logger
 }
@@ -45,6 +55,7 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 	return &Auth{
 		instName: instName,
 		Log:      log.Logger{Name: modName},
+		env:      map[string]string{},
 	}, nil
 }
 
@@ -59,6 +70,8 @@ func (a *Auth) InstanceName() string {
 func (a *Auth) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &a.Log.Debug)
 	cfg.Bool("use_helper", false, false, &a.useHelper)
+	cfg.Bool("session", false, false, &a.session)
+	cfg.String("lookup_env", false, false, "", &a.lookupEnv)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -76,19 +89,85 @@ func (a *Auth) Init(cfg *config.Map) error {
 	return nil
 }
 
+// Max. amount of users lookup_env values are remembered for. If it is
+// exceeded, values for arbitrary users are forgotten.
+const maxEnvUsers = 10000
+
 func (a *Auth) AuthPlain(username, password string) error {
+	var (
+		env []string
+		err error
+	)
 	if a.useHelper {
-		if err := external.AuthUsingHelper(a.helperPath, username, password); err != nil {
-			return err
+		var args []string
+		if a.session {
+			args = append(args, "--session")
+		}
+		// Helper binaries from older versions do not support the flag, so
+		// it is only passed when needed.
+		if a.lookupEnv != "" {
+			args = append(args, "--env")
 		}
+		env, err = external.AuthUsingHelperOutput(a.helperPath, args, username, password)
+		if errors.Is(err, external.ErrAccountUnavailable) {
+			err = ErrAccountUnavailable
+		}
+	} else {
+		env, err = runPAMAuth(username, password, a.session)
 	}
-	err := runPAMAuth(username, password)
 	if err != nil {
 		return err
 	}
+
+	if a.lookupEnv == "" {
+		return nil
+	}
+
+	a.envLock.Lock()
+	defer a.envLock.Unlock()
+	val, ok := envValue(env, a.lookupEnv)
+	if !ok {
+		delete(a.env, username)
+		return nil
+	}
+	if _, ok := a.env[username]; !ok && len(a.env) >= maxEnvUsers {
+		for name := range a.env {
+			delete(a.env, name)
+			break
+		}
+	}
+	a.env[username] = val
+
 	return nil
 }
 
+// envValue returns the value of the variable from the PAM environment list
+// in NAME=value form.
+func envValue(env []string, name string) (string, bool) {
+	for _, entry := range env {
+		entryName, value, ok := strings.Cut(entry, "=")
+		if ok && entryName == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Lookup implements module.Table. It returns the value of the PAM environment
+// variable specified using lookup_env directive as it was set during the last
+// successful authentication of the user.
+func (a *Auth) Lookup(_ context.Context, username string) (string, bool, error) {
+	if a.lookupEnv == "" {
+		return "", false, errors.New("pam: lookup_env is not configured")
+	}
+
+	a.envLock.Lock()
+	defer a.envLock.Unlock()
+
+	val, ok := a.env[username]
+	return val, ok, nil
+}
+
 func init() {
 	module.Register("auth.pam", New)
 }
@@ -0,0 +1,146 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pam
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// testHelper mimics maddy-pam-helper. Only the --env flag is accepted if
+// envSupported is set, similarly to helper binaries of older versions.
+func testHelper(t *testing.T, envSupported bool) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported")
+	}
+
+	envCase := ""
+	if envSupported {
+		envCase = `--env) print_env=1 ;;`
+	}
+	script := `#!/bin/sh
+print_env=0
+for arg in "$@"; do
+	case "$arg" in
+	` + envCase + `
+	*) echo "unknown argument: $arg" >&2; exit 2 ;;
+	esac
+done
+read -r user
+read -r pass
+if [ "$pass" != "secret" ]; then
+	exit 1
+fi
+if [ "$user" = "expired" ]; then
+	exit 3
+fi
+if [ $print_env = 1 ]; then
+	echo "HOME=/home/$user"
+	echo "INVALID"
+	echo
+	echo "MAIL_ACCOUNT=$user@example.org"
+fi
+`
+	path := filepath.Join(t.TempDir(), "maddy-pam-helper")
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testAuth(helperPath, lookupEnv string) *Auth {
+	return &Auth{
+		useHelper:  true,
+		helperPath: helperPath,
+		lookupEnv:  lookupEnv,
+		env:        map[string]string{},
+		Log:        log.Logger{Out: log.NopOutput{}},
+	}
+}
+
+func TestAuthPlain_Helper(t *testing.T) {
+	a := testAuth(testHelper(t, false), "")
+
+	if err := a.AuthPlain("user", "secret"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("user", "wrong"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Fatal("Expected ErrUnknownCredentials, got", err)
+	}
+	if err := a.AuthPlain("expired", "secret"); !errors.Is(err, ErrAccountUnavailable) {
+		t.Fatal("Expected ErrAccountUnavailable, got", err)
+	}
+	if _, _, err := a.Lookup(context.Background(), "user"); err == nil {
+		t.Fatal("Expected an error for Lookup without lookup_env")
+	}
+}
+
+func TestAuthPlain_LookupEnv(t *testing.T) {
+	a := testAuth(testHelper(t, true), "MAIL_ACCOUNT")
+
+	if _, ok, err := a.Lookup(context.Background(), "user"); err != nil || ok {
+		t.Fatal("Unexpected lookup result before authentication:", ok, err)
+	}
+	if err := a.AuthPlain("user", "secret"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	val, ok, err := a.Lookup(context.Background(), "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || val != "user@example.org" {
+		t.Fatalf("Wrong lookup result: %v %q", ok, val)
+	}
+
+	a.lookupEnv = "MISSING"
+	if err := a.AuthPlain("user", "secret"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if _, ok, _ := a.Lookup(context.Background(), "user"); ok {
+		t.Fatal("Value of missing variable is returned")
+	}
+}
+
+func TestEnvValue(t *testing.T) {
+	env := []string{"HOME=/home/user", "INVALID", "EMPTY=", "A=b=c"}
+	for _, c := range []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"HOME", "/home/user", true},
+		{"EMPTY", "", true},
+		{"A", "b=c", true},
+		{"INVALID", "", false},
+		{"MISSING", "", false},
+	} {
+		value, ok := envValue(env, c.name)
+		if value != c.value || ok != c.ok {
+			t.Errorf("envValue(%s): expected %q %v, got %q %v", c.name, c.value, c.ok, value, ok)
+		}
+	}
+}
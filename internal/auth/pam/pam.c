@@ -46,57 +46,87 @@ static int conv_func(int num_msg, const struct pam_message **msg, struct pam_res
     return PAM_SUCCESS;
 }
 
-struct error_obj run_pam_auth(const char *username, char *password) {
+static struct error_obj make_error(pam_handle_t *handle, int status, const char *func_name, int pam_status) {
+    struct error_obj ret_val;
+    ret_val.status = status;
+    ret_val.func_name = func_name;
+    ret_val.error_msg = pam_strerror(handle, pam_status);
+    return ret_val;
+}
+
+struct error_obj run_pam_auth(const char *username, char *password, int flags, char ***env) {
     const struct pam_conv local_conv = { conv_func, password };
     pam_handle_t *local_auth = NULL;
+    struct error_obj ret_val;
+
+    if (env != NULL) {
+        *env = NULL;
+    }
+
     int status = pam_start("maddy", username, &local_conv, &local_auth);
     if (status != PAM_SUCCESS) {
-        struct error_obj ret_val;
-        ret_val.status = 2;
-        ret_val.func_name = "pam_start";
-        ret_val.error_msg = pam_strerror(local_auth, status);
-        return ret_val;
+        return make_error(local_auth, 2, "pam_start", status);
     }
 
     status = pam_authenticate(local_auth, PAM_SILENT|PAM_DISALLOW_NULL_AUTHTOK);
     if (status != PAM_SUCCESS) {
-        struct error_obj ret_val;
         if (status == PAM_AUTH_ERR || status == PAM_USER_UNKNOWN) {
-            ret_val.status = 1;
+            ret_val = make_error(local_auth, 1, "pam_authenticate", status);
         } else {
-            ret_val.status = 2;
+            ret_val = make_error(local_auth, 2, "pam_authenticate", status);
         }
-        ret_val.func_name = "pam_authenticate";
-        ret_val.error_msg = pam_strerror(local_auth, status);
+        pam_end(local_auth, status);
         return ret_val;
     }
 
     status = pam_acct_mgmt(local_auth, PAM_SILENT|PAM_DISALLOW_NULL_AUTHTOK);
     if (status != PAM_SUCCESS) {
-        struct error_obj ret_val;
-        if (status == PAM_AUTH_ERR || status == PAM_USER_UNKNOWN || status == PAM_NEW_AUTHTOK_REQD) {
-            ret_val.status = 1;
+        if (status == PAM_AUTH_ERR || status == PAM_USER_UNKNOWN) {
+            ret_val = make_error(local_auth, 1, "pam_acct_mgmt", status);
+        } else if (status == PAM_ACCT_EXPIRED || status == PAM_PERM_DENIED ||
+                   status == PAM_NEW_AUTHTOK_REQD || status == PAM_AUTHTOK_EXPIRED) {
+            // Credentials are valid, but the account cannot be used right now.
+            ret_val = make_error(local_auth, 3, "pam_acct_mgmt", status);
         } else {
-            ret_val.status = 2;
+            ret_val = make_error(local_auth, 2, "pam_acct_mgmt", status);
         }
-        ret_val.func_name = "pam_acct_mgmt";
-        ret_val.error_msg = pam_strerror(local_auth, status);
+        pam_end(local_auth, status);
         return ret_val;
     }
 
+    if (flags & RUN_PAM_SESSION) {
+        status = pam_setcred(local_auth, PAM_ESTABLISH_CRED|PAM_SILENT);
+        if (status != PAM_SUCCESS) {
+            ret_val = make_error(local_auth, 2, "pam_setcred", status);
+            pam_end(local_auth, status);
+            return ret_val;
+        }
+        status = pam_open_session(local_auth, PAM_SILENT);
+        if (status != PAM_SUCCESS) {
+            ret_val = make_error(local_auth, 2, "pam_open_session", status);
+            pam_setcred(local_auth, PAM_DELETE_CRED|PAM_SILENT);
+            pam_end(local_auth, status);
+            return ret_val;
+        }
+    }
+
+    if (env != NULL) {
+        // Caller is responsible for freeing the list.
+        *env = pam_getenvlist(local_auth);
+    }
+
+    if (flags & RUN_PAM_SESSION) {
+        pam_close_session(local_auth, PAM_SILENT);
+        pam_setcred(local_auth, PAM_DELETE_CRED|PAM_SILENT);
+    }
+
     status = pam_end(local_auth, status);
     if (status != PAM_SUCCESS) {
-        struct error_obj ret_val;
-        ret_val.status = 2;
-        ret_val.func_name = "pam_end";
-        ret_val.error_msg = pam_strerror(local_auth, status);
-        return ret_val;
+        return make_error(NULL, 2, "pam_end", status);
     }
 
-    struct error_obj ret_val;
     ret_val.status = 0;
     ret_val.func_name = NULL;
     ret_val.error_msg = NULL;
     return ret_val;
 }
-
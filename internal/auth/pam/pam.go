@@ -38,19 +38,42 @@ import (
 
 const canCallDirectly = true
 
-var ErrInvalidCredentials = errors.New("pam: invalid credentials or unknown user")
+var (
+	ErrInvalidCredentials = errors.New("pam: invalid credentials or unknown user")
+	ErrAccountUnavailable = errors.New("pam: account is expired or access is not allowed")
+)
 
-func runPAMAuth(username, password string) error {
+func runPAMAuth(username, password string, session bool) ([]string, error) {
 	usernameC := C.CString(username)
 	passwordC := C.CString(password)
 	defer C.free(unsafe.Pointer(usernameC))
 	defer C.free(unsafe.Pointer(passwordC))
-	errObj := C.run_pam_auth(usernameC, passwordC)
-	if errObj.status == 1 {
-		return ErrInvalidCredentials
+
+	var flags C.int
+	if session {
+		flags |= C.RUN_PAM_SESSION
+	}
+
+	var envC **C.char
+	errObj := C.run_pam_auth(usernameC, passwordC, flags, &envC)
+	switch errObj.status {
+	case 1:
+		return nil, ErrInvalidCredentials
+	case 2:
+		return nil, fmt.Errorf("%s: %s", C.GoString(errObj.func_name), C.GoString(errObj.error_msg))
+	case 3:
+		return nil, fmt.Errorf("%w: %s", ErrAccountUnavailable, C.GoString(errObj.error_msg))
 	}
-	if errObj.status == 2 {
-		return fmt.Errorf("%s: %s", C.GoString(errObj.func_name), C.GoString(errObj.error_msg))
+
+	if envC == nil {
+		return nil, nil
+	}
+	defer C.free(unsafe.Pointer(envC))
+
+	var env []string
+	for entry := envC; *entry != nil; entry = (**C.char)(unsafe.Add(unsafe.Pointer(entry), unsafe.Sizeof(*entry))) {
+		env = append(env, C.GoString(*entry))
+		C.free(unsafe.Pointer(*entry))
 	}
-	return nil
+	return env, nil
 }
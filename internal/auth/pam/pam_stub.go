@@ -27,8 +27,11 @@ import (
 
 const canCallDirectly = false
 
-var ErrInvalidCredentials = errors.New("pam: invalid credentials or unknown user")
+var (
+	ErrInvalidCredentials = errors.New("pam: invalid credentials or unknown user")
+	ErrAccountUnavailable = errors.New("pam: account is expired or access is not allowed")
+)
 
-func runPAMAuth(username, password string) error {
-	return errors.New("pam: Can't call libpam directly")
+func runPAMAuth(username, password string, session bool) ([]string, error) {
+	return nil, errors.New("pam: Can't call libpam directly")
 }
@@ -0,0 +1,102 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// CredsArgs are the arguments of "creds.*" control commands. The commands
+// work with any module.PlainUserDB, Hash and BcryptCost can be used only with
+// auth.pass_table.
+type CredsArgs struct {
+	CfgBlock   string `json:"cfg_block"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	BcryptCost int    `json:"bcrypt_cost,omitempty"`
+}
+
+func lookupUserDB(name string) (module.PlainUserDB, error) {
+	if name == "" {
+		return nil, errors.New("creds: cfg_block is required")
+	}
+	mod, err := module.GetInstance(name)
+	if err != nil {
+		return nil, fmt.Errorf("creds: %w", err)
+	}
+	db, ok := mod.(module.PlainUserDB)
+	if !ok {
+		return nil, fmt.Errorf("creds: configuration block %s is not a local credentials store", name)
+	}
+	return db, nil
+}
+
+// credsCommand wraps the handler for a command that operates on the
+// credentials store. Username is required if needUser is true.
+func credsCommand(needUser bool, f func(db module.PlainUserDB, args CredsArgs) (interface{}, error)) control.Handler {
+	return func(rawArgs json.RawMessage) (interface{}, error) {
+		var args CredsArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		if needUser && args.Username == "" {
+			return nil, errors.New("creds: username is required")
+		}
+		db, err := lookupUserDB(args.CfgBlock)
+		if err != nil {
+			return nil, err
+		}
+		return f(db, args)
+	}
+}
+
+func init() {
+	control.Register("creds.list", credsCommand(false, func(db module.PlainUserDB, _ CredsArgs) (interface{}, error) {
+		users, err := db.ListUsers()
+		if err != nil {
+			return nil, err
+		}
+		if users == nil {
+			users = []string{}
+		}
+		return users, nil
+	}))
+	control.RegisterSensitive("creds.create", credsCommand(true, func(db module.PlainUserDB, args CredsArgs) (interface{}, error) {
+		if a, ok := db.(*Auth); ok && args.Hash != "" {
+			return nil, a.CreateUserHash(args.Username, args.Password, args.Hash, HashOpts{
+				BcryptCost: args.BcryptCost,
+			})
+		} else if !ok && (args.Hash != "" || args.BcryptCost != 0) {
+			return nil, errors.New("creds: hash cannot be used with non-pass_table credentials store")
+		}
+		return nil, db.CreateUser(args.Username, args.Password)
+	}))
+	control.Register("creds.remove", credsCommand(true, func(db module.PlainUserDB, args CredsArgs) (interface{}, error) {
+		return nil, db.DeleteUser(args.Username)
+	}))
+	control.RegisterSensitive("creds.password", credsCommand(true, func(db module.PlainUserDB, args CredsArgs) (interface{}, error) {
+		return nil, db.SetUserPassword(args.Username, args.Password)
+	}))
+}
@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrPasswordExpired is returned by AuthPlain if the stored password is older
+// than the configured maximum age. The password should be reset using
+// 'maddy creds password' to make the account usable again.
+var ErrPasswordExpired = errors.New("pass_table: password expired")
+
+// Policy describes requirements for new passwords.
+type Policy struct {
+	// Minimal password length, in Unicode code points.
+	MinLength int
+
+	// Minimal number of distinct character classes (lowercase letters,
+	// uppercase letters, digits, everything else) the password should
+	// contain.
+	MinClasses int
+
+	// Maximal password age. Zero means passwords never expire.
+	MaxAge time.Duration
+}
+
+// Check verifies that the password satisfies the policy.
+//
+// It should be called by any code that allows users or administrators to set
+// a new password.
+func (p Policy) Check(password string) error {
+	length := 0
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		length++
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	if length < p.MinLength {
+		return fmt.Errorf("password is too short, at least %d characters are required", p.MinLength)
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return fmt.Errorf("password should contain at least %d of: lowercase letters, uppercase letters, digits, other characters", p.MinClasses)
+	}
+
+	return nil
+}
+
+// Expired reports whether a password changed at the specified time is
+// expired according to the policy.
+//
+// Zero changed time means the password age is not known (e.g. the entry was
+// created using 'maddy hash') and it is never considered expired.
+func (p Policy) Expired(changed, now time.Time) bool {
+	if p.MaxAge == 0 || changed.IsZero() {
+		return false
+	}
+	return now.Sub(changed) > p.MaxAge
+}
+
+const changedAttr = "changed="
+
+// parseEntry splits the stored table value into the hash algorithm, hash
+// string and the password change time.
+//
+// The value format is "algo:hash[;changed=UNIX_TIMESTAMP]". ';' is not used by
+// any of the supported hash encodings.
+func parseEntry(value string) (algo, hash string, changed time.Time, err error) {
+	parts := strings.Split(value, ";")
+	for _, attr := range parts[1:] {
+		if !strings.HasPrefix(attr, changedAttr) {
+			continue
+		}
+		ts, err := strconv.ParseInt(strings.TrimPrefix(attr, changedAttr), 10, 64)
+		if err != nil {
+			return "", "", time.Time{}, fmt.Errorf("malformed change timestamp: %w", err)
+		}
+		changed = time.Unix(ts, 0)
+	}
+
+	algoHash := strings.SplitN(parts[0], ":", 2)
+	if len(algoHash) != 2 {
+		return "", "", time.Time{}, errors.New("no hash tag")
+	}
+	return algoHash[0], algoHash[1], changed, nil
+}
+
+func formatEntry(algo, hash string, changed time.Time) string {
+	return algo + ":" + hash + ";" + changedAttr + strconv.FormatInt(changed.Unix(), 10)
+}
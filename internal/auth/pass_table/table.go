@@ -20,8 +20,9 @@ package pass_table
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -35,7 +36,8 @@ type Auth struct {
 	instName   string
 	inlineArgs []string
 
-	table module.Table
+	table  module.Table
+	policy Policy
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -52,8 +54,22 @@ func (a *Auth) Init(cfg *config.Map) error {
 	}
 
 	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
-	_, err := cfg.Process()
-	return err
+	cfg.Int("password_min_length", false, false, 0, &a.policy.MinLength)
+	cfg.Int("password_min_classes", false, false, 0, &a.policy.MinClasses)
+	cfg.Duration("password_max_age", false, false, 0, &a.policy.MaxAge)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if a.policy.MinClasses > 4 {
+		return fmt.Errorf("%s: password_min_classes should be in range 0-4", a.modName)
+	}
+	return nil
+}
+
+// Policy returns the password policy used for new passwords.
+func (a *Auth) Policy() Policy {
+	return a.policy
 }
 
 func (a *Auth) Name() string {
@@ -87,15 +103,22 @@ func (a *Auth) AuthPlain(username, password string) error {
 		return err
 	}
 
-	parts := strings.SplitN(hash, ":", 2)
-	if len(parts) != 2 {
-		return fmt.Errorf("%s: auth plain %s: no hash tag", a.modName, key)
+	algo, hashSalt, changed, err := parseEntry(hash)
+	if err != nil {
+		return fmt.Errorf("%s: auth plain %s: %w", a.modName, key, err)
 	}
-	hashVerify := HashVerify[parts[0]]
+	hashVerify := HashVerify[algo]
 	if hashVerify == nil {
-		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", a.modName, key, parts[0])
+		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", a.modName, key, algo)
 	}
-	return hashVerify(password, parts[1])
+	if err := hashVerify(password, hashSalt); err != nil {
+		return err
+	}
+
+	if a.policy.Expired(changed, time.Now()) {
+		return ErrPasswordExpired
+	}
+	return nil
 }
 
 func (a *Auth) ListUsers() ([]string, error) {
@@ -140,12 +163,16 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 		return fmt.Errorf("%s: credentials for %s already exist", a.modName, key)
 	}
 
+	if err := a.policy.Check(password); err != nil {
+		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
+	}
+
 	hash, err := HashCompute[hashAlgo](opts, password)
 	if err != nil {
 		return fmt.Errorf("%s: create user %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, hashAlgo+":"+hash); err != nil {
+	if err := tbl.SetKey(key, formatEntry(hashAlgo, hash, time.Now())); err != nil {
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
 	return nil
@@ -162,6 +189,20 @@ func (a *Auth) SetUserPassword(username, password string) error {
 		return fmt.Errorf("%s: set password %s (raw): %w", a.modName, username, err)
 	}
 
+	if err := a.policy.Check(password); err != nil {
+		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
+	}
+
+	// With password expiry enabled, the reset should actually change the
+	// password, otherwise the expired one would be valid for another
+	// password_max_age.
+	if a.policy.MaxAge != 0 {
+		err := a.AuthPlain(key, password)
+		if err == nil || errors.Is(err, ErrPasswordExpired) {
+			return fmt.Errorf("%s: set password %s: new password should differ from the current one", a.modName, key)
+		}
+	}
+
 	// TODO: Allow to customize hash function.
 	hash, err := HashCompute[HashBcrypt](HashOpts{
 		BcryptCost: bcrypt.DefaultCost,
@@ -170,7 +211,7 @@ func (a *Auth) SetUserPassword(username, password string) error {
 		return fmt.Errorf("%s: set password %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, formatEntry(HashBcrypt, hash, time.Now())); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
 	return nil
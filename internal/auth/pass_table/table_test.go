@@ -19,7 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"errors"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -62,3 +65,100 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func TestAuth_PasswordPolicy(t *testing.T) {
+	tbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a := &Auth{
+		modName: "pass_table",
+		table:   tbl,
+		policy: Policy{
+			MinLength:  8,
+			MinClasses: 3,
+			MaxAge:     24 * time.Hour,
+		},
+	}
+
+	if err := a.CreateUser("foxcpp", "short"); err == nil {
+		t.Error("Expected too short password to be rejected")
+	}
+	if err := a.CreateUser("foxcpp", "onlylowercase"); err == nil {
+		t.Error("Expected password with one character class to be rejected")
+	}
+	if err := a.CreateUser("foxcpp", "Passw0rdOK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", "Passw0rdOK"); err != nil {
+		t.Fatal("Fresh password rejected:", err)
+	}
+
+	// Pretend the password was set two days ago.
+	algo, hash, _, err := parseEntry(tbl.M["foxcpp"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.M["foxcpp"] = formatEntry(algo, hash, time.Now().Add(-48*time.Hour))
+
+	if err := a.AuthPlain("foxcpp", "Passw0rdOK"); !errors.Is(err, ErrPasswordExpired) {
+		t.Fatal("Expected ErrPasswordExpired, got", err)
+	}
+	if err := a.AuthPlain("foxcpp", "wrong-password"); err == nil || errors.Is(err, ErrPasswordExpired) {
+		t.Fatal("Expected hash mismatch error for wrong password, got", err)
+	}
+
+	if err := a.SetUserPassword("foxcpp", "Passw0rdOK"); err == nil {
+		t.Error("Expected reset to the same password to be rejected")
+	}
+	if err := a.SetUserPassword("foxcpp", "weak"); err == nil {
+		t.Error("Expected reset to a weak password to be rejected")
+	}
+	if err := a.SetUserPassword("foxcpp", "N3wPassword"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", "N3wPassword"); err != nil {
+		t.Fatal("Reset password rejected:", err)
+	}
+}
+
+func TestAuth_LegacyEntryNoExpiry(t *testing.T) {
+	addSHA256()
+
+	a := &Auth{
+		modName: "pass_table",
+		table: testutils.Table{
+			M: map[string]string{
+				"foxcpp": "sha256:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=",
+				"old":    "sha256:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=;changed=" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10),
+			},
+		},
+		policy: Policy{MaxAge: time.Minute},
+	}
+
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Error("Entry without change time should not expire:", err)
+	}
+	if err := a.AuthPlain("old", "password"); !errors.Is(err, ErrPasswordExpired) {
+		t.Error("Expected ErrPasswordExpired, got", err)
+	}
+}
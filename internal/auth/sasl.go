@@ -23,18 +23,22 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/limits"
 )
 
 var (
 	ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
 	ErrInvalidAuthCred = errors.New("auth: invalid credentials")
+	ErrTooManyAttempts = exterrors.WithTemporary(errors.New("auth: too many authentication attempts"), true)
 )
 
 // SASLAuth is a wrapper that initializes sasl.Server using authenticators that
@@ -49,9 +53,23 @@ type SASLAuth struct {
 	Log         log.Logger
 	OnlyFirstID bool
 
+	// Name is used as the module label in metrics, usually it is the name
+	// of the endpoint.
+	Name string
+
 	AuthMap       module.Table
 	AuthNormalize authz.NormalizeFunc
 
+	// Limits restricts the rate of authentication attempts per-IP ("ip"
+	// scope) and per-username ("user" scope). If it is nil, no limits
+	// are applied.
+	Limits *limits.Group
+
+	// Policy is consulted before credentials are checked to decide whether
+	// the attempt should be allowed at all. It is also notified about
+	// the result of each attempt. Can be nil.
+	Policy module.AuthPolicy
+
 	Plain []module.PlainAuth
 }
 
@@ -93,14 +111,86 @@ func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (st
 	return mapped, nil
 }
 
-func (s *SASLAuth) AuthPlain(username, password string) error {
+// limitsKey returns the username used as a key for per-user limits.
+//
+// It is normalized so the client can't bypass the limit by changing the
+// username case, etc.
+func (s *SASLAuth) limitsKey(username string) string {
+	if s.AuthNormalize == nil {
+		return username
+	}
+	norm, err := s.AuthNormalize(username)
+	if err != nil {
+		return username
+	}
+	return norm
+}
+
+func remoteIP(remoteAddr net.Addr) net.IP {
+	switch addr := remoteAddr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// AuthPlain checks the username:password pair using all configured
+// providers.
+//
+// remoteAddr is the address of the client that is attempting to
+// authenticate, it is used to apply limits and policy. It can be nil.
+// ctx is the context of the client connection, waiting for limits and
+// policy is aborted when it is cancelled.
+func (s *SASLAuth) AuthPlain(ctx context.Context, remoteAddr net.Addr, username, password string) error {
 	if len(s.Plain) == 0 {
 		return ErrUnsupportedMech
 	}
 
+	if s.Limits != nil {
+		ip := remoteIP(remoteAddr)
+		key := s.limitsKey(username)
+		if err := s.Limits.TakeAuth(ctx, ip, key); err != nil {
+			s.Log.Msg("authentication attempts limit exceeded", "username", username, "src_ip", remoteAddr, "reason", err)
+			return ErrTooManyAttempts
+		}
+		defer s.Limits.ReleaseAuth(ip, key)
+	}
+
+	attempt := module.AuthAttempt{
+		Username:   username,
+		Password:   password,
+		RemoteAddr: remoteAddr,
+	}
+	if s.Policy != nil {
+		delay, err := s.Policy.AllowAuth(ctx, attempt)
+		if err != nil {
+			return fmt.Errorf("rejected by auth. policy: %w", err)
+		}
+		if delay != 0 {
+			s.Log.DebugMsg("delaying authentication attempt per policy", "username", username, "src_ip", remoteAddr, "delay", delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	err := s.checkProviders(ctx, username, password)
+
+	if s.Policy != nil {
+		s.Policy.ReportAuth(ctx, attempt, err == nil)
+	}
+
+	return err
+}
+
+func (s *SASLAuth) checkProviders(ctx context.Context, username, password string) error {
 	var lastErr error
 	for _, p := range s.Plain {
-		username, err := s.usernameForAuth(context.TODO(), username)
+		username, err := s.usernameForAuth(ctx, username)
 		if err != nil {
 			return err
 		}
@@ -114,8 +204,17 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
+// RecordFailure updates metrics for the failed authentication attempt. It
+// should be called by users of AuthPlain, failures of sasl.Server instances
+// returned by CreateSASL are recorded automatically.
+func (s *SASLAuth) RecordFailure(mech string) {
+	authFailures.WithLabelValues(s.Name, mech).Inc()
+}
+
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
-func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(identity string) error) sasl.Server {
+//
+// ctx should be cancelled when the client connection is closed.
+func (s *SASLAuth) CreateSASL(ctx context.Context, mech string, remoteAddr net.Addr, successCb func(identity string) error) sasl.Server {
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
@@ -126,9 +225,10 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return ErrInvalidAuthCred
 			}
 
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlain(ctx, remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				s.RecordFailure(mech)
 				return ErrInvalidAuthCred
 			}
 
@@ -136,9 +236,10 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 		})
 	case sasl.Login:
 		return sasl.NewLoginServer(func(username, password string) error {
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlain(ctx, remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				s.RecordFailure(mech)
 				return ErrInvalidAuthCred
 			}
 
@@ -168,6 +269,25 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 	return nil
 }
 
+// LimitsDirective is a matcher for the 'auth_limits' directive that
+// references top-level or inline 'limits' block.
+func LimitsDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var g *limits.Group
+	if err := modconfig.GroupFromNode("limits", node.Args, node, m.Globals, &g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// PolicyDirective is a matcher for the 'auth_policy' directive.
+func PolicyDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var p module.AuthPolicy
+	if err := modconfig.ModuleFromNode("auth_policy", node.Args, node, m.Globals, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
 type FailingSASLServ struct{ Err error }
 
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
@@ -19,11 +19,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package auth
 
 import (
+	"context"
 	"errors"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -52,7 +56,7 @@ func TestCreateSASL(t *testing.T) {
 	}
 
 	t.Run("XWHATEVER", func(t *testing.T) {
-		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, func(string) error { return nil })
+		srv := a.CreateSASL(context.Background(), "XWHATEVER", &net.TCPAddr{}, func(string) error { return nil })
 		_, _, err := srv.Next([]byte(""))
 		if err == nil {
 			t.Error("No error for XWHATEVER use")
@@ -60,7 +64,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+		srv := a.CreateSASL(context.Background(), "PLAIN", &net.TCPAddr{}, func(id string) error {
 			if id != "user1" {
 				t.Fatal("Wrong auth. identities passed to callback:", id)
 			}
@@ -74,7 +78,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN with authorization identity", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+		srv := a.CreateSASL(context.Background(), "PLAIN", &net.TCPAddr{}, func(id string) error {
 			if id != "user1" {
 				t.Fatal("Wrong authorization identity passed:", id)
 			}
@@ -87,3 +91,72 @@ func TestCreateSASL(t *testing.T) {
 		}
 	})
 }
+
+func TestSASLAuth_UserLimits(t *testing.T) {
+	mod, err := limits.New("limits", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "user", Args: []string{"rate", "1", "1h"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	a := SASLAuth{
+		Log:    testutils.Logger(t, "saslauth"),
+		Limits: mod.(*limits.Group),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+					"user2": true,
+				},
+			},
+		},
+	}
+
+	if err := a.AuthPlain(context.Background(), &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}, "user1", "aa"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	// Different IP, same user.
+	if err := a.AuthPlain(context.Background(), &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8)}, "user1", "aa"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatal("Expected ErrTooManyAttempts, got", err)
+	}
+	// Other users are not affected.
+	if err := a.AuthPlain(context.Background(), &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8)}, "user2", "aa"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+type delayPolicy struct {
+	delay time.Duration
+}
+
+func (p delayPolicy) AllowAuth(context.Context, module.AuthAttempt) (time.Duration, error) {
+	return p.delay, nil
+}
+
+func (delayPolicy) ReportAuth(context.Context, module.AuthAttempt, bool) {}
+
+func TestAuthPlain_Cancelled(t *testing.T) {
+	a := SASLAuth{
+		Log:    testutils.Logger(t, "saslauth"),
+		Policy: delayPolicy{delay: time.Hour},
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.AuthPlain(ctx, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}, "user1", "aa"); !errors.Is(err, context.Canceled) {
+		t.Fatal("Expected context.Canceled, got", err)
+	}
+}
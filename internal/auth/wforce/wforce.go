@@ -0,0 +1,278 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package wforce implements an authentication policy module that consults
+// a weakforced-compatible (wforce) policy daemon before authentication
+// attempts and reports their results to it.
+//
+// This allows multiple servers to share the brute-force detection state.
+package wforce
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "auth_policy.wforce"
+
+var ErrDenied = errors.New("wforce: authentication attempt denied by policy")
+
+type Policy struct {
+	instName string
+	log      log.Logger
+
+	url          string
+	password     string
+	hashNonce    string
+	hashTruncate int
+	failOpen     bool
+	maxDelay     time.Duration
+
+	client *http.Client
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	p := &Policy{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		p.url = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return p, nil
+}
+
+func (p *Policy) Name() string {
+	return modName
+}
+
+func (p *Policy) InstanceName() string {
+	return p.instName
+}
+
+func (p *Policy) Init(cfg *config.Map) error {
+	var (
+		tlsConfig tls.Config
+		timeout   time.Duration
+	)
+
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	cfg.String("url", false, false, p.url, &p.url)
+	cfg.String("password", false, false, "", &p.password)
+	cfg.String("hash_nonce", false, false, "", &p.hashNonce)
+	cfg.Int("hash_truncate", false, false, 12, &p.hashTruncate)
+	cfg.Duration("timeout", false, false, 2*time.Second, &timeout)
+	cfg.Duration("max_delay", false, false, 10*time.Second, &p.maxDelay)
+	cfg.Bool("fail_open", false, true, &p.failOpen)
+	cfg.Bool("debug", true, false, &p.log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if p.url == "" {
+		return fmt.Errorf("%s: url is required", modName)
+	}
+	p.url = strings.TrimSuffix(p.url, "/")
+	if p.hashTruncate < 0 || p.hashTruncate > sha256.Size*8 {
+		return fmt.Errorf("%s: hash_truncate should be between 0 and %d", modName, sha256.Size*8)
+	}
+
+	p.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tlsConfig,
+		},
+	}
+
+	return nil
+}
+
+// pwHash returns the truncated hash of the password. It allows the policy
+// daemon to detect repeated attempts with the same password without
+// disclosing it.
+//
+// The algorithm matches Dovecot auth_policy_hash_* settings:
+// hex(SHA256(nonce || login || '\0' || password)) truncated to hashTruncate
+// bits.
+func (p *Policy) pwHash(username, password string) string {
+	if p.hashTruncate == 0 {
+		return ""
+	}
+
+	h := sha256.New()
+	h.Write([]byte(p.hashNonce))
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	sum := h.Sum(nil)
+
+	bytesCnt := (p.hashTruncate + 7) / 8
+	trunc := sum[:bytesCnt]
+	if rem := p.hashTruncate % 8; rem != 0 {
+		// Shift out the extra bits, keeping the most significant ones.
+		shifted := make([]byte, bytesCnt)
+		var carry byte
+		for i := 0; i < bytesCnt; i++ {
+			shifted[i] = carry | (trunc[i] >> (8 - rem))
+			carry = trunc[i] << rem
+		}
+		trunc = shifted
+	}
+
+	return hex.EncodeToString(trunc)
+}
+
+func remoteIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
+
+type allowReq struct {
+	Login  string `json:"login"`
+	Remote string `json:"remote"`
+	PwHash string `json:"pwhash,omitempty"`
+}
+
+type allowResp struct {
+	Status int    `json:"status"`
+	Msg    string `json:"msg"`
+}
+
+type reportReq struct {
+	Login        string `json:"login"`
+	Remote       string `json:"remote"`
+	PwHash       string `json:"pwhash,omitempty"`
+	Success      bool   `json:"success"`
+	PolicyReject bool   `json:"policy_reject"`
+}
+
+func (p *Policy) request(ctx context.Context, command string, reqBody, respBody interface{}) error {
+	blob, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/?command="+command, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "maddy")
+	if p.password != "" {
+		req.SetBasicAuth("wforce", p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	if respBody == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(respBody)
+}
+
+func (p *Policy) AllowAuth(ctx context.Context, attempt module.AuthAttempt) (time.Duration, error) {
+	var resp allowResp
+	err := p.request(ctx, "allow", allowReq{
+		Login:  attempt.Username,
+		Remote: remoteIP(attempt.RemoteAddr),
+		PwHash: p.pwHash(attempt.Username, attempt.Password),
+	}, &resp)
+	if err != nil {
+		p.log.Error("allow request failed", err, "username", attempt.Username, "src_ip", attempt.RemoteAddr)
+		if p.failOpen {
+			return 0, nil
+		}
+		return 0, exterrors.WithTemporary(fmt.Errorf("%s: %w", modName, err), true)
+	}
+
+	switch {
+	case resp.Status < 0:
+		p.log.Msg("authentication attempt denied", "username", attempt.Username, "src_ip", attempt.RemoteAddr, "msg", resp.Msg)
+		// Credentials are not checked for denied attempts so ReportAuth is
+		// not called for them, report the attempt here.
+		p.report(ctx, attempt, false, true)
+		return 0, ErrDenied
+	case resp.Status > 0:
+		delay := time.Duration(resp.Status) * time.Second
+		if delay > p.maxDelay {
+			delay = p.maxDelay
+		}
+		p.log.DebugMsg("authentication attempt tarpitted", "username", attempt.Username, "src_ip", attempt.RemoteAddr, "delay", delay, "msg", resp.Msg)
+		return delay, nil
+	}
+
+	return 0, nil
+}
+
+func (p *Policy) ReportAuth(ctx context.Context, attempt module.AuthAttempt, success bool) {
+	p.report(ctx, attempt, success, false)
+}
+
+func (p *Policy) report(ctx context.Context, attempt module.AuthAttempt, success, policyReject bool) {
+	err := p.request(ctx, "report", reportReq{
+		Login:        attempt.Username,
+		Remote:       remoteIP(attempt.RemoteAddr),
+		PwHash:       p.pwHash(attempt.Username, attempt.Password),
+		Success:      success,
+		PolicyReject: policyReject,
+	}, nil)
+	if err != nil {
+		p.log.Error("report request failed", err, "username", attempt.Username, "src_ip", attempt.RemoteAddr)
+	}
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package wforce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testPolicy(t *testing.T, url string, extra ...config.Node) *Policy {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, []string{url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mod.(*Policy)
+	p.log = testutils.Logger(t, modName)
+	if err := p.Init(config.NewMap(nil, config.Node{Children: append([]config.Node{
+		{Name: "password", Args: []string{"secret"}},
+	}, extra...)})); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPolicy(t *testing.T) {
+	var reports []reportReq
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pass, ok := r.BasicAuth(); !ok || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Query().Get("command") {
+		case "allow":
+			var req allowReq
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			if req.Remote != "1.2.3.4" {
+				t.Error("Wrong remote:", req.Remote)
+			}
+			status := 0
+			switch req.Login {
+			case "denied":
+				status = -1
+			case "delayed":
+				status = 100
+			}
+			json.NewEncoder(w).Encode(allowResp{Status: status})
+		case "report":
+			var req reportReq
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			reports = append(reports, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p := testPolicy(t, srv.URL, config.Node{Name: "max_delay", Args: []string{"1s"}})
+	remote := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}
+
+	delay, err := p.AllowAuth(context.Background(), module.AuthAttempt{Username: "user", Password: "pass", RemoteAddr: remote})
+	if err != nil || delay != 0 {
+		t.Fatal("Unexpected result for allowed user:", delay, err)
+	}
+	_, err = p.AllowAuth(context.Background(), module.AuthAttempt{Username: "denied", RemoteAddr: remote})
+	if !errors.Is(err, ErrDenied) {
+		t.Fatal("Expected ErrDenied, got", err)
+	}
+	if len(reports) != 1 {
+		t.Fatal("Expected denied attempt to be reported, got", len(reports))
+	}
+	if reports[0].Login != "denied" || reports[0].Success || !reports[0].PolicyReject {
+		t.Error("Wrong report for denied attempt:", reports[0])
+	}
+	reports = nil
+	delay, err = p.AllowAuth(context.Background(), module.AuthAttempt{Username: "delayed", RemoteAddr: remote})
+	if err != nil || delay != 1*time.Second {
+		t.Fatal("Expected delay limited by max_delay, got", delay, err)
+	}
+
+	p.ReportAuth(context.Background(), module.AuthAttempt{Username: "user", Password: "pass", RemoteAddr: remote}, true)
+	if len(reports) != 1 {
+		t.Fatal("Expected one report, got", len(reports))
+	}
+	if reports[0].Login != "user" || !reports[0].Success || reports[0].PolicyReject {
+		t.Error("Wrong report:", reports[0])
+	}
+	if reports[0].PwHash != p.pwHash("user", "pass") || len(reports[0].PwHash) != 4 {
+		t.Error("Wrong pwhash:", reports[0].PwHash)
+	}
+}
+
+func TestPolicy_Unavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p := testPolicy(t, srv.URL)
+	if _, err := p.AllowAuth(context.Background(), module.AuthAttempt{Username: "user"}); err != nil {
+		t.Fatal("Expected fail-open behavior, got", err)
+	}
+
+	p = testPolicy(t, srv.URL, config.Node{Name: "fail_open", Args: []string{"no"}})
+	_, err := p.AllowAuth(context.Background(), module.AuthAttempt{Username: "user"})
+	if err == nil || !exterrors.IsTemporary(err) {
+		t.Fatal("Expected temporary error, got", err)
+	}
+}
@@ -0,0 +1,418 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package callout implements the check.callout module that verifies
+// existence of the sender mailbox by probing MX servers of its domain.
+package callout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.callout"
+
+// maxMXTries is the amount of MX hosts to try before giving up.
+const maxMXTries = 2
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	hostname    string
+	mailFrom    string
+	timeout     time.Duration
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	cacheSize   int
+	skipDomains map[string]struct{}
+	failAction  modconfig.FailAction
+	errAction   modconfig.FailAction
+
+	domainLimits *limiters.BucketSet
+
+	cacheLck sync.Mutex
+	cache    map[string]cacheEntry
+
+	resolver dns.Resolver
+	dialer   func(ctx context.Context, network, addr string) (net.Conn, error)
+	port     string
+}
+
+type cacheEntry struct {
+	exists bool
+	reply  string
+	expiry time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		cache:    make(map[string]cacheEntry),
+		resolver: dns.DefaultResolver(),
+		dialer:   (&net.Dialer{}).DialContext,
+		port:     "25",
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		skipDomains []string
+		limitSpec   string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, true, "", &c.hostname)
+	cfg.String("mail_from", false, false, "", &c.mailFrom)
+	cfg.Duration("timeout", false, false, 30*time.Second, &c.timeout)
+	cfg.Duration("positive_cache_ttl", false, false, 24*time.Hour, &c.positiveTTL)
+	cfg.Duration("negative_cache_ttl", false, false, 2*time.Hour, &c.negativeTTL)
+	cfg.Int("cache_size", false, false, 10000, &c.cacheSize)
+	cfg.String("domain_limit", false, false, "rate 10 1m, concurrency 2", &limitSpec)
+	cfg.StringList("skip_domains", false, false, nil, &skipDomains)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	c.hostname, err = idna.ToASCII(c.hostname)
+	if err != nil {
+		return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", modName, err)
+	}
+
+	c.skipDomains = make(map[string]struct{}, len(skipDomains))
+	for _, domain := range skipDomains {
+		domain, err := dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("%s: invalid domain in skip_domains: %w", modName, err)
+		}
+		c.skipDomains[domain] = struct{}{}
+	}
+
+	if limitSpec != "" {
+		ctor, err := limits.ParseSpec(limitSpec)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		c.domainLimits = limiters.NewBucketSet(ctor, 1*time.Minute, 20010)
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.domainLimits != nil {
+		c.domainLimits.Close()
+	}
+	return nil
+}
+
+func (c *Check) cacheGet(addr string) (cacheEntry, bool) {
+	c.cacheLck.Lock()
+	defer c.cacheLck.Unlock()
+
+	entry, ok := c.cache[addr]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(entry.expiry) {
+		delete(c.cache, addr)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *Check) cachePut(addr string, exists bool, reply string) {
+	ttl := c.negativeTTL
+	if exists {
+		ttl = c.positiveTTL
+	}
+	if ttl <= 0 || c.cacheSize <= 0 {
+		return
+	}
+
+	c.cacheLck.Lock()
+	defer c.cacheLck.Unlock()
+
+	now := time.Now()
+	if len(c.cache) >= c.cacheSize {
+		for k, entry := range c.cache {
+			if now.After(entry.expiry) {
+				delete(c.cache, k)
+			}
+		}
+	}
+	// Still full? Evict random entries.
+	for k := range c.cache {
+		if len(c.cache) < c.cacheSize {
+			break
+		}
+		delete(c.cache, k)
+	}
+
+	c.cache[addr] = cacheEntry{
+		exists: exists,
+		reply:  reply,
+		expiry: now.Add(ttl),
+	}
+}
+
+// errNotVerified is returned by probe if the verification result is
+// inconclusive.
+var errNotVerified = errors.New("callout: sender address not verified")
+
+// lookupMX returns the list of hosts to probe for the domain, ordered
+// by preference. It returns an empty list if the domain has a null MX record.
+func (c *Check) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	records, err := c.resolver.LookupMX(ctx, dns.FQDN(domain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+
+	// RFC 5321 Section 5.1, implicit MX.
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		if record.Host == "." {
+			// RFC 7505 null MX.
+			return nil, nil
+		}
+		hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+	}
+	return hosts, nil
+}
+
+// probe checks whether the address is accepted by the host. It returns
+// errNotVerified (possibly wrapped) if that cannot be determined.
+func (c *Check) probe(ctx context.Context, log log.Logger, host, addr string) (exists bool, reply string, err error) {
+	conn := smtpconn.New()
+	conn.Dialer = c.dialer
+	conn.ConnectTimeout = c.timeout
+	conn.CommandTimeout = c.timeout
+	conn.Hostname = c.hostname
+	conn.Log = log
+
+	if _, err := conn.Connect(ctx, config.Endpoint{
+		Scheme: "tcp",
+		Host:   host,
+		Port:   c.port,
+	}, false, nil); err != nil {
+		return false, "", fmt.Errorf("%w: %v", errNotVerified, err)
+	}
+	defer conn.Close()
+
+	if err := conn.Mail(ctx, c.mailFrom, smtp.MailOptions{}); err != nil {
+		// Broken servers reject null sender. We can't tell anything about
+		// the mailbox then.
+		return false, "", fmt.Errorf("%w: %v", errNotVerified, err)
+	}
+
+	err = conn.Rcpt(ctx, addr, smtp.RcptOptions{})
+	if err == nil {
+		return true, "", nil
+	}
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code/100 == 5 {
+		return false, smtpErr.Message, nil
+	}
+	return false, "", fmt.Errorf("%w: %v", errNotVerified, err)
+}
+
+// verify checks whether the sender mailbox exists. It returns errNotVerified
+// (possibly wrapped) if that cannot be determined.
+func (c *Check) verify(ctx context.Context, log log.Logger, addr, domain string) (exists bool, reply string, err error) {
+	if c.domainLimits != nil {
+		limitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := c.domainLimits.TakeContext(limitCtx, domain)
+		cancel()
+		if err != nil {
+			return false, "", fmt.Errorf("%w: rate limit exceeded for domain", errNotVerified)
+		}
+		defer c.domainLimits.Release(domain)
+	}
+
+	hosts, err := c.lookupMX(ctx, domain)
+	if err != nil {
+		return false, "", fmt.Errorf("%w: %v", errNotVerified, err)
+	}
+	if len(hosts) == 0 {
+		return false, "Domain does not accept mail (null MX)", nil
+	}
+	if len(hosts) > maxMXTries {
+		hosts = hosts[:maxMXTries]
+	}
+
+	for _, host := range hosts {
+		exists, reply, err = c.probe(ctx, log, host, addr)
+		if err == nil {
+			return exists, reply, nil
+		}
+		log.DebugMsg("probe failed", "host", host, "reason", err)
+	}
+	return false, "", err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckSender").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.Msg("locally generated message, ignoring")
+		return module.CheckResult{}
+	}
+	if mailFrom == "" {
+		return module.CheckResult{}
+	}
+
+	addr, err := address.ForLookup(mailFrom)
+	if err != nil {
+		s.log.DebugMsg("malformed address, ignoring", "address", mailFrom)
+		return module.CheckResult{}
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return module.CheckResult{}
+	}
+	if _, ok := s.c.skipDomains[domain]; ok {
+		return module.CheckResult{}
+	}
+
+	entry, ok := s.c.cacheGet(addr)
+	if !ok {
+		aDomain, err := idna.ToASCII(domain)
+		if err != nil {
+			return module.CheckResult{}
+		}
+		exists, reply, err := s.c.verify(ctx, s.log, mailFrom, aDomain)
+		if err != nil {
+			return s.c.errAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 1, 8},
+					Message:      "Unable to verify the sender address",
+					CheckName:    modName,
+					Err:          err,
+				},
+			})
+		}
+		s.c.cachePut(addr, exists, reply)
+		entry = cacheEntry{exists: exists, reply: reply}
+	} else {
+		s.log.DebugMsg("using cached result", "address", addr, "exists", entry.exists)
+	}
+
+	if entry.exists {
+		return module.CheckResult{}
+	}
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
+			Message:      "Sender address rejected: mailbox does not exist",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"remote_reply": entry.reply,
+			},
+		},
+	})
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
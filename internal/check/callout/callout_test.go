@@ -0,0 +1,203 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package callout
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// .invalid TLD is used here to make sure if there is something wrong about
+// DNS hooks and lookups go to the real Internet, they will not result in
+// any useful data that can lead to outgoing connections being made.
+
+var testZones = map[string]mockdns.Zone{
+	"example.invalid.": {
+		MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+	},
+	"mx.example.invalid.": {
+		A: []string{"127.0.0.1"},
+	},
+	"nullmx.invalid.": {
+		MX: []net.MX{{Host: ".", Pref: 0}},
+	},
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func testCheck(t *testing.T, port string, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	resolver := &mockdns.Resolver{Zones: testZones}
+	c.resolver = resolver
+	c.dialer = resolver.DialContext
+	c.port = port
+	c.log = testutils.Logger(t, modName)
+
+	cfg = append(cfg, config.Node{Name: "hostname", Args: []string{"mx.example.org"}})
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func checkSender(t *testing.T, c *Check, mailFrom string) module.CheckResult {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:   t.Name(),
+		Conn: &module.ConnState{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return s.CheckSender(context.Background(), mailFrom)
+}
+
+func TestCallout(t *testing.T) {
+	port := freePort(t)
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+port)
+	defer srv.Close()
+	be.RcptErr = map[string]error{
+		"nobody@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"busy@example.invalid": &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 1},
+			Message:      "Try again later",
+		},
+	}
+
+	c := testCheck(t, port, nil)
+
+	if res := checkSender(t, c, "user@example.invalid"); res.Reject || res.Reason != nil {
+		t.Fatal("Unexpected check failure:", res.Reason)
+	}
+	if be.MailFromCounter != 1 {
+		t.Fatal("Probe is not done")
+	}
+	if be.SessionCounter == 0 {
+		t.Fatal("No sessions")
+	}
+
+	res := checkSender(t, c, "nobody@example.invalid")
+	if !res.Reject {
+		t.Fatal("Non-existent sender is not rejected")
+	}
+	smtpErr, ok := res.Reason.(*exterrors.SMTPError)
+	if !ok || smtpErr.Code != 550 || smtpErr.Misc["remote_reply"] != "No such user" {
+		t.Fatal("Wrong reason:", res.Reason)
+	}
+
+	// Temporary errors are ignored by default.
+	if res := checkSender(t, c, "busy@example.invalid"); res.Reject || res.Quarantine {
+		t.Fatal("Temporary failure is not ignored:", res.Reason)
+	}
+
+	// Null MX domains do not accept mail at all.
+	if res := checkSender(t, c, "user@nullmx.invalid"); !res.Reject {
+		t.Fatal("Null MX sender is not rejected")
+	}
+
+	// Null sender is not checked.
+	if res := checkSender(t, c, ""); res.Reject {
+		t.Fatal("Null sender is rejected")
+	}
+}
+
+func TestCallout_Cache(t *testing.T) {
+	port := freePort(t)
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+port)
+	be.RcptErr = map[string]error{
+		"nobody@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+
+	c := testCheck(t, port, nil)
+	checkSender(t, c, "user@example.invalid")
+	checkSender(t, c, "nobody@example.invalid")
+	srv.Close()
+
+	if res := checkSender(t, c, "USER@example.invalid"); res.Reject || res.Reason != nil {
+		t.Fatal("Unexpected check failure:", res.Reason)
+	}
+	if res := checkSender(t, c, "nobody@example.invalid"); !res.Reject {
+		t.Fatal("Cached negative result is not used")
+	}
+	if be.MailFromCounter != 2 {
+		t.Fatal("Wrong amount of probes:", be.MailFromCounter)
+	}
+}
+
+func TestCallout_Unreachable(t *testing.T) {
+	port := freePort(t)
+
+	c := testCheck(t, port, []config.Node{
+		{Name: "error_action", Args: []string{"reject"}},
+	})
+	res := checkSender(t, c, "user@example.invalid")
+	if !res.Reject {
+		t.Fatal("Message is not rejected")
+	}
+	if !exterrors.IsTemporary(res.Reason) {
+		t.Fatal("Non-temporary error:", res.Reason)
+	}
+}
+
+func TestCallout_SkipDomains(t *testing.T) {
+	port := freePort(t)
+	tarpit := testutils.FailOnConn(t, "127.0.0.1:"+port)
+	defer tarpit.Close()
+
+	c := testCheck(t, port, []config.Node{
+		{Name: "skip_domains", Args: []string{"EXAMPLE.invalid"}},
+		{Name: "error_action", Args: []string{"reject"}},
+	})
+	if res := checkSender(t, c, "user@example.invalid"); res.Reject || res.Reason != nil {
+		t.Fatal("Unexpected check failure:", res.Reason)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package clamav implements the check.clamav module that scans messages for
+// viruses using the clamd daemon from ClamAV.
+package clamav
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.clamav"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	endpoint       string
+	network        string
+	addr           string
+	failOpen       bool
+	infectedAction modconfig.FailAction
+	addHeader      bool
+	maxSize        int64
+	timeout        time.Duration
+
+	// Idle clamd sessions, nil if disabled.
+	pool *pool.P
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.endpoint = inlineArgs[0]
+	case 0:
+		c.endpoint = "unix:///run/clamav/clamd.ctl"
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		maxIdleCount int
+		maxIdleTime  int64
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpoint, &c.endpoint)
+	cfg.Bool("fail_open", false, false, &c.failOpen)
+	cfg.Custom("infected_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.infectedAction)
+	cfg.Bool("add_header", false, true, &c.addHeader)
+	cfg.DataSize("max_size", false, false, 25*1024*1024, &c.maxSize)
+	cfg.Duration("timeout", false, false, 1*time.Minute, &c.timeout)
+	cfg.Int("conn_max_idle_count", false, false, 4, &maxIdleCount)
+	cfg.Int64("conn_max_idle_time", false, false, 20, &maxIdleTime)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	endp, err := config.ParseEndpoint(c.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	switch endp.Scheme {
+	case "tcp", "unix":
+	default:
+		return fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
+	}
+	c.network = endp.Network()
+	c.addr = endp.Address()
+
+	if maxIdleCount > 0 {
+		c.pool = pool.New(pool.Config{
+			MaxKeys:             1,
+			MaxConnsPerKey:      maxIdleCount,
+			MaxConnLifetimeSec:  maxIdleTime,
+			StaleKeyLifetimeSec: maxIdleTime * 2,
+		})
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.pool != nil {
+		c.pool.Close()
+	}
+	return nil
+}
+
+func (c *Check) getConn(ctx context.Context) (*clamdConn, error) {
+	if c.pool != nil {
+		conn, err := c.pool.Get(ctx, "")
+		if err == nil && conn != nil {
+			return conn.(*clamdConn), nil
+		}
+	}
+	return dialClamd(ctx, c.network, c.addr, c.pool != nil, c.timeout)
+}
+
+func (c *Check) putConn(conn *clamdConn) {
+	if c.pool == nil || conn.broken {
+		conn.Close()
+		return
+	}
+	c.pool.Return("", conn)
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) ioError(err error) module.CheckResult {
+	if s.c.failOpen {
+		s.log.Error("I/O error, message is not scanned", err)
+		return module.CheckResult{}
+	}
+
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during policy check",
+			CheckName:    modName,
+			Err:          err,
+			Misc: map[string]interface{}{
+				"endpoint": s.c.endpoint,
+			},
+		},
+	}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	if s.c.maxSize > 0 && int64(body.Len()) > s.c.maxSize {
+		s.log.Msg("message is too big, not scanning", "size", body.Len(), "max_size", s.c.maxSize)
+		return module.CheckResult{}
+	}
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	defer bodyR.Close()
+
+	conn, err := s.c.getConn(ctx)
+	if err != nil {
+		return s.ioError(err)
+	}
+	virus, err := conn.instream(ctx, io.MultiReader(&hdrBuf, bodyR), s.c.timeout)
+	s.c.putConn(conn)
+	if err != nil {
+		return s.ioError(err)
+	}
+
+	if virus == "" {
+		s.log.DebugMsg("message is clean")
+		res := module.CheckResult{}
+		if s.c.addHeader {
+			res.Header = textproto.Header{}
+			res.Header.Add("X-Virus-Status", "Clean")
+		}
+		return res
+	}
+
+	res := module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message contains a virus",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"virus": virus,
+			},
+		},
+	}
+	if s.c.addHeader {
+		res.Header = textproto.Header{}
+		res.Header.Add("X-Virus-Status", "Infected ("+virus+")")
+	}
+	return s.c.infectedAction.Apply(res)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
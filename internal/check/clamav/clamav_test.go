@@ -0,0 +1,299 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testMsg = `From: <foxcpp@example.org>
+To: <test@example.org>
+Subject: Test
+
+Hello!
+`
+
+// fakeClamd implements enough of the clamd protocol to test the module.
+// Scanned data containing "EICAR" is reported as infected and data
+// containing "BROKEN" causes an error reply.
+type fakeClamd struct {
+	l     net.Listener
+	conns int32
+	wg    sync.WaitGroup
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeClamd{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&f.conns, 1)
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		f.wg.Wait()
+	})
+	return f
+}
+
+func (f *fakeClamd) endpoint() string {
+	return "tcp://" + f.l.Addr().String()
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	session := false
+	id := 1
+
+	reply := func(s string) {
+		if session {
+			s = strconv.Itoa(id) + ": " + s
+			id++
+		}
+		io.WriteString(conn, s+"\x00")
+	}
+
+	for {
+		cmd, err := rd.ReadString(0)
+		if err != nil {
+			return
+		}
+		switch strings.TrimSuffix(cmd, "\x00") {
+		case "zIDSESSION":
+			session = true
+			continue
+		case "zPING":
+			reply("PONG")
+		case "zEND":
+			return
+		case "zINSTREAM":
+			var data bytes.Buffer
+			for {
+				var l uint32
+				if err := binary.Read(rd, binary.BigEndian, &l); err != nil {
+					return
+				}
+				if l == 0 {
+					break
+				}
+				if _, err := io.CopyN(&data, rd, int64(l)); err != nil {
+					return
+				}
+			}
+			switch {
+			case bytes.Contains(data.Bytes(), []byte("EICAR")):
+				reply("stream: Eicar-Signature FOUND")
+			case bytes.Contains(data.Bytes(), []byte("BROKEN")):
+				reply("Something happened. ERROR")
+			default:
+				reply("stream: OK")
+			}
+		default:
+			reply("UNKNOWN COMMAND")
+		}
+		if !session {
+			return
+		}
+	}
+}
+
+func testCheck(t *testing.T, endpoint string, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, []string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := mod.(*Check)
+	check.log = testutils.Logger(t, modName)
+	if err := check.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { check.Close() })
+	return check
+}
+
+func runCheck(t *testing.T, check *Check, msg string) module.CheckResult {
+	t.Helper()
+	s, err := check.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	hdr, buf := testutils.BodyFromStr(t, msg)
+	return s.CheckBody(context.Background(), hdr, buf)
+}
+
+func TestCheck_Clean(t *testing.T) {
+	f := newFakeClamd(t)
+	check := testCheck(t, f.endpoint(), nil)
+
+	res := runCheck(t, check, testMsg)
+	if res.Reject || res.Quarantine || res.Reason != nil {
+		t.Fatal("Unexpected check failure:", res.Reason)
+	}
+	if got := res.Header.Get("X-Virus-Status"); got != "Clean" {
+		t.Fatal("Wrong X-Virus-Status:", got)
+	}
+}
+
+func TestCheck_Infected(t *testing.T) {
+	f := newFakeClamd(t)
+
+	t.Run("reject", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), nil)
+		res := runCheck(t, check, testMsg+"EICAR\n")
+		if !res.Reject {
+			t.Fatal("Message is not rejected")
+		}
+		smtpErr, ok := res.Reason.(*exterrors.SMTPError)
+		if !ok || smtpErr.Code != 554 || smtpErr.Misc["virus"] != "Eicar-Signature" {
+			t.Fatal("Wrong reason:", res.Reason)
+		}
+		if got := res.Header.Get("X-Virus-Status"); got != "Infected (Eicar-Signature)" {
+			t.Fatal("Wrong X-Virus-Status:", got)
+		}
+	})
+	t.Run("quarantine", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "infected_action", Args: []string{"quarantine"}},
+		})
+		res := runCheck(t, check, testMsg+"EICAR\n")
+		if res.Reject || !res.Quarantine {
+			t.Fatal("Message is not quarantined")
+		}
+	})
+	t.Run("no header", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "add_header", Args: []string{"no"}},
+		})
+		res := runCheck(t, check, testMsg+"EICAR\n")
+		if res.Header.Len() != 0 {
+			t.Fatal("Header is added")
+		}
+	})
+}
+
+func TestCheck_Error(t *testing.T) {
+	f := newFakeClamd(t)
+
+	t.Run("fail closed", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), nil)
+		res := runCheck(t, check, testMsg+"BROKEN\n")
+		if !res.Reject {
+			t.Fatal("Message is not rejected")
+		}
+		if exterrors.IsTemporary(res.Reason) == false {
+			t.Fatal("Non-temporary error:", res.Reason)
+		}
+	})
+	t.Run("fail open", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "fail_open", Args: []string{"yes"}},
+		})
+		res := runCheck(t, check, testMsg+"BROKEN\n")
+		if res.Reject || res.Quarantine || res.Reason != nil {
+			t.Fatal("Unexpected check failure:", res.Reason)
+		}
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+
+		check := testCheck(t, "tcp://"+addr, nil)
+		res := runCheck(t, check, testMsg)
+		if !res.Reject {
+			t.Fatal("Message is not rejected")
+		}
+	})
+}
+
+func TestCheck_Pooling(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		f := newFakeClamd(t)
+		check := testCheck(t, f.endpoint(), nil)
+		for i := 0; i < 3; i++ {
+			if res := runCheck(t, check, testMsg); res.Reason != nil {
+				t.Fatal("Unexpected check failure:", res.Reason)
+			}
+		}
+		if conns := atomic.LoadInt32(&f.conns); conns != 1 {
+			t.Fatal("Expected 1 connection, got", conns)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		f := newFakeClamd(t)
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "conn_max_idle_count", Args: []string{"0"}},
+		})
+		for i := 0; i < 3; i++ {
+			if res := runCheck(t, check, testMsg); res.Reason != nil {
+				t.Fatal("Unexpected check failure:", res.Reason)
+			}
+		}
+		if conns := atomic.LoadInt32(&f.conns); conns != 3 {
+			t.Fatal("Expected 3 connections, got", conns)
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		f := newFakeClamd(t)
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "fail_open", Args: []string{"yes"}},
+		})
+		runCheck(t, check, testMsg+"BROKEN\n")
+		runCheck(t, check, testMsg)
+		// Connection after the error is not reused.
+		if conns := atomic.LoadInt32(&f.conns); conns != 2 {
+			t.Fatal("Expected 2 connections, got", conns)
+		}
+	})
+}
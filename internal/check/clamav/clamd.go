@@ -0,0 +1,200 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client for the clamd protocol, see clamd(8).
+
+const chunkSize = 64 * 1024
+
+type clamdConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+
+	// Set if IDSESSION is used and the connection can be used for
+	// multiple commands.
+	session bool
+	nextID  int
+	// Set if the connection is in undefined state.
+	broken bool
+
+	lastUseAt time.Time
+}
+
+func dialClamd(ctx context.Context, network, addr string, session bool, timeout time.Duration) (*clamdConn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &clamdConn{
+		conn:      conn,
+		rd:        bufio.NewReader(conn),
+		session:   session,
+		nextID:    1,
+		lastUseAt: time.Now(),
+	}
+	if session {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := io.WriteString(conn, "zIDSESSION\x00"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// readReply reads the NUL-terminated reply, stripping the request ID used in
+// sessions.
+func (c *clamdConn) readReply() (string, error) {
+	reply, err := c.rd.ReadString(0)
+	if err != nil {
+		c.broken = true
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+
+	if c.session {
+		idStr, rest, ok := strings.Cut(reply, ": ")
+		if !ok {
+			c.broken = true
+			return "", fmt.Errorf("malformed reply: %s", reply)
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id != c.nextID {
+			c.broken = true
+			return "", fmt.Errorf("unexpected request ID in reply: %s", reply)
+		}
+		c.nextID++
+		reply = rest
+	}
+	return reply, nil
+}
+
+func (c *clamdConn) setDeadline(ctx context.Context, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// instream sends the data to clamd for scanning. It returns the signature
+// name if the data is infected or an empty string otherwise.
+func (c *clamdConn) instream(ctx context.Context, r io.Reader, timeout time.Duration) (string, error) {
+	c.setDeadline(ctx, timeout)
+	defer func() {
+		c.lastUseAt = time.Now()
+	}()
+
+	if _, err := io.WriteString(c.conn, "zINSTREAM\x00"); err != nil {
+		c.broken = true
+		return "", err
+	}
+
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := c.conn.Write(buf[:4+n]); err != nil {
+				c.broken = true
+				// clamd closes the connection if the size limit is
+				// exceeded, the reply is still there.
+				if reply, replyErr := c.readReply(); replyErr == nil {
+					return parseReply(reply)
+				}
+				return "", err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			c.broken = true
+			return "", err
+		}
+	}
+	if _, err := c.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		c.broken = true
+		return "", err
+	}
+
+	reply, err := c.readReply()
+	if err != nil {
+		return "", err
+	}
+	virus, err := parseReply(reply)
+	if err != nil {
+		c.broken = true
+	}
+	return virus, err
+}
+
+func parseReply(reply string) (string, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		virus := strings.TrimSuffix(reply, " FOUND")
+		if _, name, ok := strings.Cut(virus, ": "); ok {
+			virus = name
+		}
+		return virus, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", fmt.Errorf("clamd error: %s", strings.TrimSuffix(reply, " ERROR"))
+	}
+	return "", fmt.Errorf("unexpected reply: %s", reply)
+}
+
+func (c *clamdConn) Usable() bool {
+	if c.broken || !c.session {
+		return false
+	}
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c.conn, "zPING\x00"); err != nil {
+		c.broken = true
+		return false
+	}
+	reply, err := c.readReply()
+	return err == nil && reply == "PONG"
+}
+
+func (c *clamdConn) LastUseAt() time.Time {
+	return c.lastUseAt
+}
+
+func (c *clamdConn) Close() error {
+	if c.session && !c.broken {
+		c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c.conn, "zEND\x00")
+	}
+	return c.conn.Close()
+}
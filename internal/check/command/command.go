@@ -32,6 +32,7 @@ import (
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -54,6 +55,11 @@ const (
 	StageBody       = "body"
 )
 
+// actionField is the name of the header field that can be included in the
+// command output to specify the action to take, using the same syntax as
+// the 'code' directive. It is not added to the message header.
+const actionField = "X-Maddy-Action"
+
 var placeholderRe = regexp.MustCompile(`{[a-zA-Z0-9_]+?}`)
 
 type Check struct {
@@ -64,6 +70,7 @@ type Check struct {
 	actions map[int]modconfig.FailAction
 	cmd     string
 	cmdArgs []string
+	timeout time.Duration
 }
 
 func New(modName, instName string, aliases, inlineArgs []string) (module.Module, error) {
@@ -106,6 +113,7 @@ func (c *Check) Init(cfg *config.Map) error {
 	cfg.Enum("run_on", false, false,
 		[]string{StageConnection, StageSender, StageRcpt, StageBody}, StageBody,
 		(*string)(&c.stage))
+	cfg.Duration("timeout", false, false, 1*time.Minute, &c.timeout)
 
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
@@ -165,6 +173,11 @@ func (s *state) expandCommand(address string) (string, []string) {
 					return ""
 				}
 				return s.msgMeta.Conn.AuthUser
+			case "{tls_client}":
+				if s.msgMeta.Conn == nil {
+					return ""
+				}
+				return s.msgMeta.Conn.TLSClientIdentity
 			case "{source_ip}":
 				if s.msgMeta.Conn == nil {
 					return ""
@@ -207,8 +220,14 @@ func (s *state) expandCommand(address string) (string, []string) {
 	return s.c.cmd, expArgs
 }
 
-func (s *state) run(cmdName string, args []string, stdin io.Reader) module.CheckResult {
-	cmd := exec.Command(cmdName, args...)
+func (s *state) run(ctx context.Context, cmdName string, args []string, stdin io.Reader) module.CheckResult {
+	if s.c.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.c.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, cmdName, args...)
 	cmd.Stdin = stdin
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -241,8 +260,28 @@ func (s *state) run(cmdName string, args []string, stdin io.Reader) module.Check
 		}
 	}
 
-	bufOut := bufio.NewReader(stdout)
-	hdr, err := textproto.ReadHeader(bufOut)
+	// Read the output in a separate goroutine since it can be kept open
+	// by child processes even after the command is killed on timeout.
+	type readRes struct {
+		hdr textproto.Header
+		err error
+	}
+	readCh := make(chan readRes, 1)
+	go func() {
+		hdr, err := textproto.ReadHeader(bufio.NewReader(stdout))
+		readCh <- readRes{hdr, err}
+	}()
+
+	var hdr textproto.Header
+	select {
+	case r := <-readCh:
+		hdr, err = r.hdr, r.err
+	case <-ctx.Done():
+		// The process is killed by exec.CommandContext, Wait closes stdout.
+		_ = cmd.Wait()
+		<-readCh
+		return s.timeoutRes(module.CheckResult{}, cmd.String())
+	}
 	if err != nil && !errors.Is(err, io.EOF) {
 		if err := cmd.Process.Signal(os.Interrupt); err != nil {
 			s.log.Error("failed to kill process", err)
@@ -263,9 +302,14 @@ func (s *state) run(cmdName string, args []string, stdin io.Reader) module.Check
 	}
 
 	res := module.CheckResult{}
+	actionVal := hdr.Get(actionField)
+	hdr.Del(actionField)
 	res.Header = hdr
 
 	err = cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return s.timeoutRes(res, cmd.String())
+	}
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
 			// If that's not ExitError, the process may still be running. We do
@@ -276,6 +320,63 @@ func (s *state) run(cmdName string, args []string, stdin io.Reader) module.Check
 		}
 		return s.errorRes(err, res, cmd.String())
 	}
+	if actionVal != "" {
+		return s.outputActionRes(actionVal, res, cmd.String())
+	}
+	return res
+}
+
+func (s *state) timeoutRes(res module.CheckResult, cmdLine string) module.CheckResult {
+	res.Reason = &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+		Message:      "Internal server error",
+		CheckName:    "command",
+		Err:          context.DeadlineExceeded,
+		Reason:       "command timed out",
+		Misc: map[string]interface{}{
+			"cmd":     cmdLine,
+			"timeout": s.c.timeout.String(),
+		},
+	}
+	res.Reject = true
+	return res
+}
+
+// outputActionRes applies the action specified by the command in the
+// X-Maddy-Action field.
+func (s *state) outputActionRes(val string, res module.CheckResult, cmdLine string) module.CheckResult {
+	action, err := modconfig.ParseActionDirective(strings.SplitN(strings.TrimSpace(val), " ", 4))
+	if err != nil {
+		res.Reason = &exterrors.SMTPError{
+			Code:      450,
+			Message:   "Internal server error",
+			CheckName: "command",
+			Err:       err,
+			Reason:    "malformed " + actionField,
+			Misc: map[string]interface{}{
+				"cmd":    cmdLine,
+				"action": val,
+			},
+		}
+		res.Reject = true
+		return res
+	}
+
+	res.Reason = &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected for due to a local policy",
+		CheckName:    "command",
+		Misc: map[string]interface{}{
+			"cmd":    cmdLine,
+			"action": val,
+		},
+	}
+	res = action.Apply(res)
+	if !res.Reject && !res.Quarantine {
+		res.Reason = nil
+	}
 	return res
 }
 
@@ -334,7 +435,7 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 	defer trace.StartRegion(ctx, "command/CheckConnection-"+s.c.cmd).End()
 
 	cmdName, cmdArgs := s.expandCommand("")
-	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
+	return s.run(ctx, cmdName, cmdArgs, bytes.NewReader(nil))
 }
 
 func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
@@ -347,7 +448,7 @@ func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult
 	defer trace.StartRegion(ctx, "command/CheckSender"+s.c.cmd).End()
 
 	cmdName, cmdArgs := s.expandCommand(addr)
-	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
+	return s.run(ctx, cmdName, cmdArgs, bytes.NewReader(nil))
 }
 
 func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
@@ -359,7 +460,7 @@ func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
 	defer trace.StartRegion(ctx, "command/CheckRcpt"+s.c.cmd).End()
 
 	cmdName, cmdArgs := s.expandCommand(addr)
-	return s.run(cmdName, cmdArgs, bytes.NewReader(nil))
+	return s.run(ctx, cmdName, cmdArgs, bytes.NewReader(nil))
 }
 
 func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
@@ -389,7 +490,7 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 		}
 	}
 
-	return s.run(cmdName, cmdArgs, io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
+	return s.run(ctx, cmdName, cmdArgs, io.MultiReader(bytes.NewReader(buf.Bytes()), bR))
 }
 
 func (s *state) Close() error {
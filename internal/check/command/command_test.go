@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package command
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, script string, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, []string{"sh", "-c", script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func runBody(t *testing.T, c *Check) module.CheckResult {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	hdr, body := testutils.BodyFromStr(t, "Subject: test\r\n\r\nHello!\r\n")
+	return s.CheckBody(context.Background(), hdr, body)
+}
+
+func TestCommand_ExitCodes(t *testing.T) {
+	res := runBody(t, testCheck(t, "cat >/dev/null; printf 'X-Test: 1\\r\\n\\r\\n'", nil))
+	if res.Reject || res.Quarantine || res.Reason != nil {
+		t.Fatal("Unexpected check failure:", res.Reason)
+	}
+	if res.Header.Get("X-Test") != "1" {
+		t.Error("Header from output is not added")
+	}
+
+	res = runBody(t, testCheck(t, "cat >/dev/null; exit 1", nil))
+	if !res.Reject {
+		t.Error("Exit code 1 does not reject the message")
+	}
+
+	res = runBody(t, testCheck(t, "cat >/dev/null; exit 2", nil))
+	if res.Reject || !res.Quarantine {
+		t.Error("Exit code 2 does not quarantine the message")
+	}
+
+	res = runBody(t, testCheck(t, "cat >/dev/null; exit 3", []config.Node{
+		{Name: "code", Args: []string{"3", "quarantine"}},
+	}))
+	if !res.Quarantine {
+		t.Error("code directive is not applied")
+	}
+}
+
+func TestCommand_OutputAction(t *testing.T) {
+	res := runBody(t, testCheck(t, "cat >/dev/null; printf 'X-Maddy-Action: quarantine\\r\\nX-Test: 1\\r\\n\\r\\n'", nil))
+	if !res.Quarantine || res.Reject {
+		t.Error("Message is not quarantined")
+	}
+	if res.Header.Has(actionField) {
+		t.Error("Action field is added to the message")
+	}
+	if res.Header.Get("X-Test") != "1" {
+		t.Error("Header from output is not added")
+	}
+
+	res = runBody(t, testCheck(t, "cat >/dev/null; printf 'X-Maddy-Action: reject 550 5.7.1 Go away now\\r\\n\\r\\n'", nil))
+	if !res.Reject {
+		t.Fatal("Message is not rejected")
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != 550 || smtpErr.Message != "Go away now" {
+		t.Error("Wrong reason:", res.Reason)
+	}
+
+	res = runBody(t, testCheck(t, "cat >/dev/null; printf 'X-Maddy-Action: ignore\\r\\n\\r\\n'", nil))
+	if res.Reject || res.Quarantine || res.Reason != nil {
+		t.Error("Unexpected check failure:", res.Reason)
+	}
+
+	res = runBody(t, testCheck(t, "cat >/dev/null; printf 'X-Maddy-Action: explode\\r\\n\\r\\n'", nil))
+	if !res.Reject || !exterrors.IsTemporaryOrUnspec(res.Reason) {
+		t.Error("Malformed action is not a temporary error:", res.Reason)
+	}
+}
+
+func TestCommand_Timeout(t *testing.T) {
+	res := runBody(t, testCheck(t, "cat >/dev/null; sleep 5", []config.Node{
+		{Name: "timeout", Args: []string{"100ms"}},
+	}))
+	if !res.Reject {
+		t.Fatal("Message is not rejected")
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != 451 {
+		t.Error("Wrong reason:", res.Reason)
+	}
+}
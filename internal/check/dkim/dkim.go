@@ -37,6 +37,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	maddydmarc "github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -49,6 +50,9 @@ type Check struct {
 	noSigAction     modconfig.FailAction
 	failOpen        bool
 
+	requiredDomains module.Table
+	requiredAction  modconfig.FailAction
+
 	resolver dns.Resolver
 }
 
@@ -77,6 +81,11 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.noSigAction)
+	modconfig.Table(cfg, "required_domains", false, false, nil, &c.requiredDomains)
+	cfg.Custom("required_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.requiredAction)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
@@ -125,19 +134,23 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 		} else {
 			d.log.Debugf("no signatures present")
 		}
-		return d.c.noSigAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
-				Message:      "No DKIM signatures",
-				CheckName:    "check.dkim",
-			},
+		res := module.CheckResult{
 			AuthResult: []authres.Result{
 				&authres.DKIMResult{
 					Value: authres.ResultNone,
 				},
 			},
-		})
+		}
+		if reqRes, ok := d.checkRequired(ctx, header, res, nil); ok {
+			return reqRes
+		}
+		res.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
+			Message:      "No DKIM signatures",
+			CheckName:    "check.dkim",
+		}
+		return d.c.noSigAction.Apply(res)
 	}
 
 	b := bytes.Buffer{}
@@ -174,10 +187,24 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 		}
 	}
 
-	goodSigs := false
+	// Verifications are returned in the same order as signatures in the
+	// header.
+	sigFields := header.Values("DKIM-Signature")
+
+	var (
+		goodSigs    = false
+		passDomains []string
+		res         = module.CheckResult{AuthResult: make([]authres.Result, 0, len(verifications))}
+	)
+	for i, verif := range verifications {
+		var tags map[string]string
+		if i < len(sigFields) {
+			tags = parseTags(sigFields[i])
+			if !strings.EqualFold(tags["d"], verif.Domain) {
+				tags = nil
+			}
+		}
 
-	res := module.CheckResult{AuthResult: make([]authres.Result, 0, len(verifications))}
-	for _, verif := range verifications {
 		val := authres.ResultValue(authres.ResultPass)
 		reason := ""
 		if verif.Err != nil {
@@ -187,11 +214,13 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 			if !d.c.brokenSigAction.Reject || !d.c.brokenSigAction.Quarantine {
 				d.log.DebugMsg("bad signature", "domain", verif.Domain, "identifier", verif.Identifier)
 			}
+			d.reportKeyProblem(verif, tags)
 			if dkim.IsPermFail(verif.Err) {
 				val = authres.ResultPermError
 			}
 			if dkim.IsTempFail(verif.Err) {
 				if !d.c.failOpen {
+					verifiedSigs.WithLabelValues(d.c.instName, string(authres.ResultTempError)).Inc()
 					return module.CheckResult{
 						Reject: true,
 						Reason: &exterrors.SMTPError{
@@ -206,12 +235,8 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 				val = authres.ResultTempError
 			}
 
-			res.AuthResult = append(res.AuthResult, &authres.DKIMResult{
-				Value:      val,
-				Reason:     reason,
-				Domain:     verif.Domain,
-				Identifier: verif.Identifier,
-			})
+			verifiedSigs.WithLabelValues(d.c.instName, string(val)).Inc()
+			res.AuthResult = append(res.AuthResult, sigResult(val, reason, verif, tags))
 			continue
 		}
 
@@ -228,15 +253,16 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 
 		if val == authres.ResultPass {
 			goodSigs = true
+			passDomains = append(passDomains, verif.Domain)
 			d.log.DebugMsg("good signature", "domain", verif.Domain, "identifier", verif.Identifier)
 		}
 
-		res.AuthResult = append(res.AuthResult, &authres.DKIMResult{
-			Value:      val,
-			Reason:     reason,
-			Domain:     verif.Domain,
-			Identifier: verif.Identifier,
-		})
+		verifiedSigs.WithLabelValues(d.c.instName, string(val)).Inc()
+		res.AuthResult = append(res.AuthResult, sigResult(val, reason, verif, tags))
+	}
+
+	if reqRes, ok := d.checkRequired(ctx, header, res, passDomains); ok {
+		return reqRes
 	}
 
 	if !goodSigs {
@@ -251,6 +277,135 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 	return res
 }
 
+// parseTags parses the DKIM-Signature tag list (RFC 6376, Section 3.2).
+func parseTags(field string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(field, ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+	return tags
+}
+
+// sigResult creates the Authentication-Results entry for the signature.
+//
+// authres.DKIMResult does not support header.s, header.a and header.b
+// properties (RFC 6008) that are needed to tell multiple signatures
+// apart, so authres.GenericResult is used instead.
+func sigResult(val authres.ResultValue, reason string, verif *dkim.Verification, tags map[string]string) authres.Result {
+	params := map[string]string{
+		"reason":   reason,
+		"header.d": verif.Domain,
+		"header.i": verif.Identifier,
+		"header.s": tags["s"],
+		"header.a": tags["a"],
+	}
+	if b := tags["b"]; len(b) > 8 {
+		params["header.b"] = b[:8]
+	} else {
+		params["header.b"] = b
+	}
+	return &authres.GenericResult{
+		Method: "dkim",
+		Value:  val,
+		Params: params,
+	}
+}
+
+// reportKeyProblem logs and counts signature failures that are caused by
+// missing, revoked or malformed keys and expired signatures. These usually
+// indicate a misconfiguration on the sender side rather than a forgery.
+func (d *dkimCheckState) reportKeyProblem(verif *dkim.Verification, tags map[string]string) {
+	errStr := verif.Err.Error()
+
+	var problem string
+	switch {
+	case strings.Contains(errStr, "no key for signature"):
+		problem = "key_missing"
+	case strings.Contains(errStr, "key revoked"):
+		problem = "key_revoked"
+	case strings.Contains(errStr, "signature has expired"):
+		problem = "sig_expired"
+	case strings.Contains(errStr, "key syntax error"),
+		strings.Contains(errStr, "no valid key found"),
+		strings.Contains(errStr, "multiple TXT records found for key"),
+		strings.Contains(errStr, "incompatible public key version"),
+		strings.Contains(errStr, "unsupported key algorithm"):
+		problem = "key_invalid"
+	default:
+		return
+	}
+
+	keyProblems.WithLabelValues(d.c.instName, problem).Inc()
+	d.log.Msg("DKIM key problem", "problem", problem, "domain", verif.Domain,
+		"selector", tags["s"], "reason", strings.TrimPrefix(errStr, "dkim: "))
+}
+
+// checkRequired checks whether the message has a valid signature from the
+// domain listed for the From domain in the required_domains table.
+//
+// It returns the result to use and true if the requirement is not met.
+func (d *dkimCheckState) checkRequired(ctx context.Context, header textproto.Header, res module.CheckResult, passDomains []string) (module.CheckResult, bool) {
+	if d.c.requiredDomains == nil {
+		return module.CheckResult{}, false
+	}
+
+	fromDomain, err := maddydmarc.ExtractFromDomain(header)
+	if err != nil {
+		d.log.DebugMsg("cannot extract From domain", "err", err)
+		return module.CheckResult{}, false
+	}
+
+	var required []string
+	for domain := strings.ToLower(fromDomain); domain != ""; {
+		val, ok, err := d.c.requiredDomains.Lookup(ctx, domain)
+		if err != nil {
+			d.log.Error("required_domains lookup failed", err, "domain", domain)
+			return module.CheckResult{}, false
+		}
+		if ok {
+			required = strings.Fields(strings.ReplaceAll(val, ",", " "))
+			if len(required) == 0 {
+				required = []string{domain}
+			}
+			break
+		}
+
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	if required == nil {
+		return module.CheckResult{}, false
+	}
+
+	for _, passDomain := range passDomains {
+		for _, reqDomain := range required {
+			if dns.Equal(passDomain, reqDomain) ||
+				strings.HasSuffix(strings.ToLower(dns.FQDN(passDomain)), "."+strings.ToLower(dns.FQDN(reqDomain))) {
+				return module.CheckResult{}, false
+			}
+		}
+	}
+
+	d.log.Msg("required DKIM signature is missing", "from_domain", fromDomain, "required", required)
+	res.Reason = &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
+		Message:      "Valid DKIM signature from " + required[0] + " is required",
+		CheckName:    "check.dkim",
+		Misc: map[string]interface{}{
+			"from_domain": fromDomain,
+		},
+	}
+	return d.c.requiredAction.Apply(res), true
+}
+
 func (d *dkimCheckState) Name() string {
 	return "check.dkim"
 }
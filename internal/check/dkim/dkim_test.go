@@ -30,6 +30,7 @@ import (
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	maddydmarc "github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -357,8 +358,68 @@ func TestDkimVerify_FailOpen(t *testing.T) {
 	if len(result.AuthResult) != 1 {
 		t.Fatal("Wrong amount of auth. result fields:", len(result.AuthResult))
 	}
-	resVal := result.AuthResult[0].(*authres.DKIMResult).Value
+	dkimRes, _, ok := maddydmarc.AsDKIMResult(result.AuthResult[0])
+	if !ok {
+		t.Fatal("Not a DKIM result:", result.AuthResult[0])
+	}
+	resVal := dkimRes.Value
 	if resVal != authres.ResultTempError {
 		t.Fatal("Result is not temp. error:", resVal)
 	}
 }
+
+func TestDkimVerify_RequiredDomains(t *testing.T) {
+	test := func(t *testing.T, required map[string]string, msg string, reject bool) {
+		t.Helper()
+
+		check := testCheck(t, testZones, nil)
+		check.requiredDomains = testutils.Table{M: required}
+
+		s, err := check.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			ID: "test_required",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, buf := testutils.BodyFromStr(t, msg)
+		result := s.CheckBody(context.Background(), hdr, buf)
+		t.Log("auth. result:", authres.Format("", result.AuthResult))
+
+		if result.Reject != reject {
+			t.Fatalf("want reject=%v, got %+v", reject, result)
+		}
+	}
+
+	t.Run("signed by required domain", func(t *testing.T) {
+		test(t, map[string]string{"football.example.com": "example.com"}, verifiedMailString, false)
+	})
+	t.Run("not signed by required domain", func(t *testing.T) {
+		// Parent domain entry applies to football.example.com.
+		test(t, map[string]string{"example.com": "other.example"}, verifiedMailString, true)
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		test(t, map[string]string{"football.example.com": ""}, unsignedMailString, true)
+	})
+	t.Run("not in table", func(t *testing.T) {
+		test(t, map[string]string{"other.example": ""}, unsignedMailString, false)
+	})
+}
+
+func TestDkimVerify_SignatureDetails(t *testing.T) {
+	check := testCheck(t, testZones, nil)
+
+	s, err := check.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID: "test_details",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, buf := testutils.BodyFromStr(t, verifiedMailString)
+	result := s.CheckBody(context.Background(), hdr, buf)
+
+	want := "; dkim=pass header.a=rsa-sha256 header.b=AuUoFEfD header.d=example.com " +
+		"header.i=joe@football.example.com header.s=brisbane"
+	if got := authres.Format("", result.AuthResult); got != want {
+		t.Fatalf("wrong auth. result:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	verifiedSigs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "check_dkim",
+			Name:      "signatures",
+			Help:      "Verified DKIM signatures by result (pass, fail, permerror, temperror)",
+		},
+		[]string{"module", "result"},
+	)
+	keyProblems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "check_dkim",
+			Name:      "key_problems",
+			Help:      "DKIM signatures that failed due to signing key or expiration problems (key_missing, key_revoked, key_invalid, sig_expired)",
+		},
+		[]string{"module", "problem"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(verifiedSigs)
+	prometheus.MustRegister(keyProblems)
+}
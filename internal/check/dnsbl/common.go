@@ -32,6 +32,10 @@ type ListedErr struct {
 	Identity string
 	List     string
 	Reason   string
+
+	// Score is the score assigned by the list configuration
+	// to the returned addresses.
+	Score int
 }
 
 func (le ListedErr) Fields() map[string]interface{} {
@@ -66,6 +70,14 @@ func checkDomain(ctx context.Context, resolver dns.Resolver, cfg List, domain st
 		return nil
 	}
 
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	score := cfg.listedScore(ips)
+
 	// Attempt to extract explanation string.
 	txts, err := resolver.LookupTXT(context.Background(), query)
 	if err != nil || len(txts) == 0 {
@@ -75,6 +87,7 @@ func checkDomain(ctx context.Context, resolver dns.Resolver, cfg List, domain st
 			Identity: domain,
 			List:     cfg.Zone,
 			Reason:   strings.Join(addrs, "; "),
+			Score:    score,
 		}
 	}
 
@@ -85,6 +98,7 @@ func checkDomain(ctx context.Context, resolver dns.Resolver, cfg List, domain st
 		Identity: domain,
 		List:     cfg.Zone,
 		Reason:   strings.Join(txts, "; "),
+		Score:    score,
 	}
 }
 
@@ -134,6 +148,12 @@ addrsLoop:
 		return nil
 	}
 
+	ips := make([]net.IP, 0, len(filteredAddrs))
+	for _, addr := range filteredAddrs {
+		ips = append(ips, addr.IP)
+	}
+	score := cfg.listedScore(ips)
+
 	// Attempt to extract explanation string.
 	txts, err := resolver.LookupTXT(ctx, query)
 	if err != nil || len(txts) == 0 {
@@ -149,6 +169,7 @@ addrsLoop:
 			Identity: ip.String(),
 			List:     cfg.Zone,
 			Reason:   strings.Join(reasonParts, "; "),
+			Score:    score,
 		}
 	}
 
@@ -159,6 +180,7 @@ addrsLoop:
 		Identity: ip.String(),
 		List:     cfg.Zone,
 		Reason:   strings.Join(txts, "; "),
+		Score:    score,
 	}
 }
 
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"net"
 	"runtime/trace"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -49,6 +50,73 @@ type List struct {
 
 	ScoreAdj  int
 	Responses []net.IPNet
+
+	// ResponseScores overrides ScoreAdj for specific response addresses.
+	ResponseScores []ResponseScore
+}
+
+type ResponseScore struct {
+	Nets  []net.IPNet
+	Score int
+}
+
+// addrScore returns the score to use if the list returned the specified
+// address.
+func (l List) addrScore(addr net.IP) int {
+	for _, rs := range l.ResponseScores {
+		for _, n := range rs.Nets {
+			if n.Contains(addr) {
+				return rs.Score
+			}
+		}
+	}
+	return l.ScoreAdj
+}
+
+// listedScore returns the score to use if the list returned the specified
+// addresses. The highest score is used if multiple addresses are returned.
+func (l List) listedScore(addrs []net.IP) int {
+	if len(addrs) == 0 {
+		return l.ScoreAdj
+	}
+	score := l.addrScore(addrs[0])
+	for _, addr := range addrs[1:] {
+		if s := l.addrScore(addr); s > score {
+			score = s
+		}
+	}
+	return score
+}
+
+// hasNegativeScore reports whether the list can decrease the total score.
+func (l List) hasNegativeScore() bool {
+	if l.ScoreAdj < 0 {
+		return true
+	}
+	for _, rs := range l.ResponseScores {
+		if rs.Score < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNets(vals []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(vals))
+	for _, val := range vals {
+		// If there is no / - it is a plain IP address, append
+		// '/32'.
+		if !strings.Contains(val, "/") {
+			val += "/32"
+		}
+
+		_, ipNet, err := net.ParseCIDR(val)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
 }
 
 var defaultBL = List{
@@ -117,6 +185,7 @@ func (bl *DNSBL) readListCfg(node config.Node) error {
 	var (
 		listCfg      List
 		responseNets []string
+		err          error
 	)
 
 	cfg := config.NewMap(nil, node)
@@ -126,29 +195,38 @@ func (bl *DNSBL) readListCfg(node config.Node) error {
 	cfg.Bool("mailfrom", false, defaultBL.EHLO, &listCfg.MAILFROM)
 	cfg.Int("score", false, false, 1, &listCfg.ScoreAdj)
 	cfg.StringList("responses", false, false, []string{"127.0.0.1/24"}, &responseNets)
+	cfg.Callback("response_score", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected at least 2 arguments")
+		}
+		score, err := strconv.Atoi(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "invalid score: %v", err)
+		}
+		nets, err := parseNets(node.Args[1:])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		listCfg.ResponseScores = append(listCfg.ResponseScores, ResponseScore{
+			Nets:  nets,
+			Score: score,
+		})
+		return nil
+	})
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	for _, resp := range responseNets {
-		// If there is no / - it is a plain IP address, append
-		// '/32'.
-		if !strings.Contains(resp, "/") {
-			resp += "/32"
-		}
-
-		_, ipNet, err := net.ParseCIDR(resp)
-		if err != nil {
-			return err
-		}
-		listCfg.Responses = append(listCfg.Responses, *ipNet)
+	listCfg.Responses, err = parseNets(responseNets)
+	if err != nil {
+		return err
 	}
 
 	for _, zone := range append([]string{node.Name}, node.Args...) {
 		zoneCfg := listCfg
 		zoneCfg.Zone = zone
 
-		if listCfg.ScoreAdj < 0 {
+		if listCfg.hasNegativeScore() {
 			if zoneCfg.EHLO {
 				return errors.New("dnsbl: 'ehlo' should not be used with negative score")
 			}
@@ -314,7 +392,7 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 				defer lck.Unlock()
 				listedOn = append(listedOn, listErr.List)
 				reasons = append(reasons, listErr.Reason)
-				score += list.ScoreAdj
+				score += listErr.Score
 			}
 			return nil
 		})
@@ -335,32 +413,48 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 		}
 	}
 
+	if len(listedOn) != 0 {
+		bl.log.DebugMsg("listed", "score", score, "listed_on", listedOn, "reasons", reasons)
+	}
+
 	if score >= bl.rejectThres {
 		return module.CheckResult{
 			Reject: true,
+			Score:  float64(score),
 			Reason: &exterrors.SMTPError{
 				Code:         554,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
 				Message:      "Client identity is listed in the used DNSBL",
 				Err:          err,
 				CheckName:    "dnsbl",
+				Misc: map[string]interface{}{
+					"score":     score,
+					"listed_on": listedOn,
+					"reason":    reasons,
+				},
 			},
 		}
 	}
 	if score >= bl.quarantineThres {
 		return module.CheckResult{
 			Quarantine: true,
+			Score:      float64(score),
 			Reason: &exterrors.SMTPError{
 				Code:         554,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
 				Message:      "Client identity is listed in the used DNSBL",
 				Err:          err,
 				CheckName:    "dnsbl",
+				Misc: map[string]interface{}{
+					"score":     score,
+					"listed_on": listedOn,
+					"reason":    reasons,
+				},
 			},
 		}
 	}
 
-	return module.CheckResult{}
+	return module.CheckResult{Score: float64(score)}
 }
 
 // CheckConnection implements module.EarlyCheck.
@@ -25,6 +25,8 @@ import (
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -192,6 +194,56 @@ func TestCheckLists(t *testing.T) {
 		false, false,
 	)
 
+	// Per-response scores, highest is used.
+	zenLike := List{
+		Zone:       "example.org",
+		ClientIPv4: true,
+		ScoreAdj:   1,
+		ResponseScores: []ResponseScore{
+			{Nets: []net.IPNet{{IP: net.IPv4(127, 0, 0, 10), Mask: net.CIDRMask(31, 32)}}, Score: 0},
+			{Nets: []net.IPNet{{IP: net.IPv4(127, 0, 0, 2), Mask: net.CIDRMask(32, 32)}}, Score: 2},
+		},
+	}
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.11"},
+		},
+	}, []List{zenLike}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", false, false,
+	)
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.4"},
+		},
+	}, []List{zenLike}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", false, true,
+	)
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.10", "127.0.0.2"},
+		},
+	}, []List{zenLike}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", true, false,
+	)
+
+	// Whitelist response overrides blocklist.
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.2"},
+		},
+		"4.3.2.1.example.net.": {
+			A: []string{"127.0.10.3"},
+		},
+	}, []List{zenLike, {
+		Zone:       "example.net",
+		ClientIPv4: true,
+		ResponseScores: []ResponseScore{
+			{Nets: []net.IPNet{{IP: net.IPv4(127, 0, 10, 3), Mask: net.CIDRMask(32, 32)}}, Score: -2},
+		},
+	}}, net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com", false, false,
+	)
+
 	// DNS error, hard-fail (reject)
 	test(map[string]mockdns.Zone{
 		"4.3.2.2.example.org.": {
@@ -211,3 +263,48 @@ func TestCheckLists(t *testing.T) {
 		true, false,
 	)
 }
+
+func TestReadListCfg(t *testing.T) {
+	// Lists are tested asynchronously, so testutils.Logger can't be used here.
+	bl := &DNSBL{
+		resolver: &mockdns.Resolver{},
+		log:      log.Logger{Name: "dnsbl"},
+	}
+	err := bl.readListCfg(config.Node{
+		Name: "zen.example.org",
+		Children: []config.Node{
+			{Name: "responses", Args: []string{"127.0.0.1/24"}},
+			{Name: "response_score", Args: []string{"0", "127.0.0.10", "127.0.0.11"}},
+			{Name: "response_score", Args: []string{"5", "127.0.0.2/31"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bl.bls) != 1 {
+		t.Fatal("Wrong amount of lists:", len(bl.bls))
+	}
+	list := bl.bls[0]
+	for addr, score := range map[string]int{
+		"127.0.0.10": 0,
+		"127.0.0.11": 0,
+		"127.0.0.2":  5,
+		"127.0.0.3":  5,
+		"127.0.0.4":  1,
+	} {
+		if got := list.addrScore(net.ParseIP(addr)); got != score {
+			t.Errorf("%s: expected score %d, got %d", addr, score, got)
+		}
+	}
+
+	err = bl.readListCfg(config.Node{
+		Name: "dnswl.example.org",
+		Children: []config.Node{
+			{Name: "ehlo", Args: []string{"yes"}},
+			{Name: "response_score", Args: []string{"-5", "127.0.10.0/24"}},
+		},
+	})
+	if err == nil {
+		t.Fatal("Expected error for ehlo with negative score")
+	}
+}
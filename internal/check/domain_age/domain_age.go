@@ -0,0 +1,363 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package domain_age implements the check.domain_age module that scores
+// messages from recently registered or recently observed domains.
+package domain_age
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"runtime/trace"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	modName = "check.domain_age"
+
+	keyPrefix  = "domain_age:"
+	keyStarted = keyPrefix + "started"
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	state module.SharedState
+	rdap  *rdapClient
+
+	newAge        time.Duration
+	newScore      int
+	historyTTL    time.Duration
+	registeredAge time.Duration
+	registeredScr int
+	rdapCacheTTL  time.Duration
+
+	quarantineThres int
+	rejectThres     int
+	excludeDomains  map[string]struct{}
+
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		useRDAP        bool
+		bootstrapURL   string
+		rdapTimeout    time.Duration
+		excludeDomains []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("state", false, false, func() (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", []string{"memory"}, config.Node{}, nil, &st)
+		return st, err
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", node.Args, node, m.Globals, &st)
+		return st, err
+	}, &c.state)
+	cfg.Duration("new_domain_age", false, false, 7*24*time.Hour, &c.newAge)
+	cfg.Int("new_domain_score", false, false, 1, &c.newScore)
+	cfg.Duration("history_ttl", false, false, 90*24*time.Hour, &c.historyTTL)
+	cfg.Bool("rdap", false, false, &useRDAP)
+	cfg.String("rdap_bootstrap", false, false, defaultBootstrapURL, &bootstrapURL)
+	cfg.Duration("rdap_timeout", false, false, 5*time.Second, &rdapTimeout)
+	cfg.Duration("rdap_cache_ttl", false, false, 24*time.Hour, &c.rdapCacheTTL)
+	cfg.Duration("registered_age", false, false, 30*24*time.Hour, &c.registeredAge)
+	cfg.Int("registered_score", false, false, 1, &c.registeredScr)
+	cfg.Int("quarantine_threshold", false, false, 1, &c.quarantineThres)
+	cfg.Int("reject_threshold", false, false, 9999, &c.rejectThres)
+	cfg.StringList("exclude_domains", false, false, nil, &excludeDomains)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.historyTTL < c.newAge {
+		return config.NodeErr(cfg.Block, "history_ttl should not be less than new_domain_age")
+	}
+	if useRDAP {
+		c.rdap = &rdapClient{
+			bootstrapURL: bootstrapURL,
+			client:       &http.Client{Timeout: rdapTimeout},
+		}
+	}
+
+	c.excludeDomains = make(map[string]struct{}, len(excludeDomains))
+	for _, d := range excludeDomains {
+		dom, err := dns.ForLookup(d)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid domain %s: %v", d, err)
+		}
+		c.excludeDomains[dom] = struct{}{}
+	}
+	return nil
+}
+
+func parseTime(val string) (time.Time, error) {
+	ts, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ts == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(ts, 0), nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// firstSeen records the domain as seen and returns the time it was first
+// seen at.
+//
+// Zero time is returned if history is not collected for long enough to tell
+// whether the domain is new.
+func (c *Check) firstSeen(ctx context.Context, domain string) (time.Time, error) {
+	now := c.now()
+
+	// Do not report all domains as new until we have enough history.
+	started := now
+	startedVal, ok, err := c.state.Get(ctx, keyStarted)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok {
+		started, err = parseTime(startedVal)
+		if err != nil {
+			return time.Time{}, err
+		}
+	} else if err := c.state.Set(ctx, keyStarted, formatTime(now), c.historyTTL); err != nil {
+		return time.Time{}, err
+	}
+
+	key := keyPrefix + "seen:" + domain
+	seen := now
+	seenVal, ok, err := c.state.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok {
+		seen, err = parseTime(seenVal)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	// Refresh TTL so domains that are seen regularly are not forgotten.
+	if err := c.state.Set(ctx, key, formatTime(seen), c.historyTTL); err != nil {
+		return time.Time{}, err
+	}
+
+	if now.Sub(started) < c.newAge {
+		return time.Time{}, nil
+	}
+	return seen, nil
+}
+
+// registered returns the domain registration date, using the cached value
+// if possible.
+func (c *Check) registered(ctx context.Context, domain string) (time.Time, error) {
+	key := keyPrefix + "registered:" + domain
+	val, ok, err := c.state.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok {
+		return parseTime(val)
+	}
+
+	regDate, err := c.rdap.registered(ctx, domain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := c.state.Set(ctx, key, formatTime(regDate), c.rdapCacheTTL); err != nil {
+		return time.Time{}, err
+	}
+	return regDate, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// orgDomain returns the registered domain for the address or empty string
+// if it should not be checked.
+func (s *state) orgDomain(addr string) string {
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return ""
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return ""
+	}
+	domain, err = publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return ""
+	}
+	if _, ok := s.c.excludeDomains[domain]; ok {
+		return ""
+	}
+	return domain
+}
+
+// score returns the score for the domain. Errors are logged and
+// corresponding checks are skipped.
+func (s *state) score(ctx context.Context, domain string) (int, map[string]interface{}) {
+	var (
+		score int
+		misc  = map[string]interface{}{"domain": domain}
+		now   = s.c.now()
+	)
+
+	seen, err := s.c.firstSeen(ctx, domain)
+	if err != nil {
+		s.log.Error("state store error", err, "domain", domain)
+	} else if !seen.IsZero() && now.Sub(seen) < s.c.newAge {
+		score += s.c.newScore
+		misc["first_seen"] = seen.UTC().Format(time.RFC3339)
+	}
+
+	if s.c.rdap != nil {
+		reg, err := s.c.registered(ctx, domain)
+		if err != nil {
+			s.log.Error("registration date lookup failed", err, "domain", domain)
+		} else if !reg.IsZero() && now.Sub(reg) < s.c.registeredAge {
+			score += s.c.registeredScr
+			misc["registered"] = reg.UTC().Format(time.RFC3339)
+		}
+	}
+
+	misc["score"] = score
+	return score, misc
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	// Do not check messages sent by local users.
+	if s.msgMeta.Conn == nil || s.msgMeta.Conn.AuthUser != "" {
+		return module.CheckResult{}
+	}
+
+	domains := make([]string, 0, 2)
+	if d := s.orgDomain(s.msgMeta.OriginalFrom); d != "" {
+		domains = append(domains, d)
+	}
+	if fromAddrs, err := mail.ParseAddressList(hdr.Get("From")); err == nil && len(fromAddrs) != 0 {
+		if d := s.orgDomain(fromAddrs[0].Address); d != "" && (len(domains) == 0 || domains[0] != d) {
+			domains = append(domains, d)
+		}
+	}
+
+	var (
+		maxScore int
+		maxMisc  map[string]interface{}
+	)
+	for _, d := range domains {
+		score, misc := s.score(ctx, d)
+		s.log.DebugMsg("domain age score", "domain", d, "details", misc)
+		if maxMisc == nil || score > maxScore {
+			maxScore, maxMisc = score, misc
+		}
+	}
+
+	if maxScore < s.c.quarantineThres || maxScore == 0 {
+		return module.CheckResult{Score: float64(maxScore)}
+	}
+	return module.CheckResult{
+		Reject:     maxScore >= s.c.rejectThres,
+		Quarantine: maxScore < s.c.rejectThres,
+		Score:      float64(maxScore),
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Sender domain is too new",
+			CheckName:    modName,
+			Misc:         maxMisc,
+		},
+	}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
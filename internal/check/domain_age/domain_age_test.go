@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package domain_age
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+
+	_ "github.com/foxcpp/maddy/internal/state"
+)
+
+func initCheck(t *testing.T, cfg []config.Node, now *time.Time) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	c.now = func() time.Time { return *now }
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkMsg(t *testing.T, c *Check, mailFrom, from string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: mailFrom,
+		Conn:         &module.ConnState{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr, body := testutils.BodyFromStr(t, "From: "+from+"\r\n\r\nHello!\r\n")
+	return st.CheckBody(context.Background(), hdr, body)
+}
+
+func TestFirstSeen(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	c := initCheck(t, []config.Node{
+		{Name: "new_domain_age", Args: []string{"24h"}},
+	}, &now)
+
+	// Learning period.
+	if res := checkMsg(t, c, "a@old.example.org", "<a@old.example.org>"); res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result during learning: %+v", res)
+	}
+
+	now = now.Add(25 * time.Hour)
+	if res := checkMsg(t, c, "a@mail.old.example.org", "<a@old.example.org>"); res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result for known domain: %+v", res)
+	}
+	if res := checkMsg(t, c, "a@old.example.org", "<a@new.example.net>"); !res.Quarantine {
+		t.Fatalf("expected quarantine for new header From domain: %+v", res)
+	}
+
+	now = now.Add(25 * time.Hour)
+	if res := checkMsg(t, c, "a@new.example.net", "<a@new.example.net>"); res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result for known domain: %+v", res)
+	}
+}
+
+func TestRDAP(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+
+	lookups := 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dns.json":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"services": [][][]string{{{"test"}, {srv.URL + "/rdap/"}}},
+			})
+		case "/rdap/domain/fresh.test":
+			lookups++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"events": []map[string]string{
+					{"eventAction": "registration", "eventDate": "2026-10-10T00:00:00Z"},
+				},
+			})
+		case "/rdap/domain/old.test":
+			lookups++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"events": []map[string]string{
+					{"eventAction": "registration", "eventDate": "2001-01-01T00:00:00Z"},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := initCheck(t, []config.Node{
+		{Name: "rdap", Args: []string{"yes"}},
+		{Name: "rdap_bootstrap", Args: []string{srv.URL + "/dns.json"}},
+		{Name: "registered_score", Args: []string{"5"}},
+		{Name: "reject_threshold", Args: []string{"5"}},
+	}, &now)
+
+	for i := 0; i < 2; i++ {
+		if res := checkMsg(t, c, "a@fresh.test", "<a@fresh.test>"); !res.Reject {
+			t.Fatalf("expected reject for fresh domain: %+v", res)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected lookup result to be cached, got %d lookups", lookups)
+	}
+
+	if res := checkMsg(t, c, "a@old.test", "<a@old.test>"); res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result for old domain: %+v", res)
+	}
+	// Not found and unknown TLDs are not scored.
+	if res := checkMsg(t, c, "a@missing.test", "<a@missing.test>"); res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result for missing domain: %+v", res)
+	}
+	if res := checkMsg(t, c, "a@example.invalid", "<a@example.invalid>"); res.Quarantine || res.Reject {
+		t.Fatalf("unexpected result for unknown TLD: %+v", res)
+	}
+}
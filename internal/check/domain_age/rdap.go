@@ -0,0 +1,147 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package domain_age
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBootstrapURL = "https://data.iana.org/rdap/dns.json"
+	bootstrapTTL        = 24 * time.Hour
+	maxRDAPResponse     = 1024 * 1024
+)
+
+var errNoRDAPServer = errors.New("domain_age: no RDAP server for TLD")
+
+// rdapClient looks up domain registration dates using RDAP (RFC 9082,
+// RFC 9083). RDAP servers are discovered using the IANA bootstrap registry
+// (RFC 9224).
+type rdapClient struct {
+	bootstrapURL string
+	client       *http.Client
+
+	lock        sync.Mutex
+	servers     map[string]string
+	lastFetched time.Time
+}
+
+func (c *rdapClient) get(ctx context.Context, url string, v interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("domain_age: unexpected RDAP response status: %v", resp.Status)
+	}
+	return resp.StatusCode, json.NewDecoder(io.LimitReader(resp.Body, maxRDAPResponse)).Decode(v)
+}
+
+// server returns the base URL of the RDAP server for the TLD.
+func (c *rdapClient) server(ctx context.Context, tld string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.servers == nil || time.Since(c.lastFetched) > bootstrapTTL {
+		var bootstrap struct {
+			Services [][][]string `json:"services"`
+		}
+		if _, err := c.get(ctx, c.bootstrapURL, &bootstrap); err != nil {
+			// Keep using the stale copy if we have one.
+			if c.servers == nil {
+				return "", err
+			}
+		} else {
+			servers := make(map[string]string)
+			for _, svc := range bootstrap.Services {
+				if len(svc) != 2 || len(svc[1]) == 0 {
+					continue
+				}
+				// Prefer HTTPS URLs.
+				url := svc[1][0]
+				for _, u := range svc[1] {
+					if strings.HasPrefix(u, "https://") {
+						url = u
+						break
+					}
+				}
+				for _, t := range svc[0] {
+					servers[strings.ToLower(t)] = url
+				}
+			}
+			c.servers = servers
+			c.lastFetched = time.Now()
+		}
+	}
+
+	srv, ok := c.servers[tld]
+	if !ok {
+		return "", errNoRDAPServer
+	}
+	return srv, nil
+}
+
+// registered returns the registration date of the domain.
+//
+// Zero time is returned if the domain is not found or the RDAP server does
+// not provide the registration date.
+func (c *rdapClient) registered(ctx context.Context, domain string) (time.Time, error) {
+	tld := domain[strings.LastIndexByte(domain, '.')+1:]
+	srv, err := c.server(ctx, tld)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var resp struct {
+		Events []struct {
+			Action string    `json:"eventAction"`
+			Date   time.Time `json:"eventDate"`
+		} `json:"events"`
+	}
+	status, err := c.get(ctx, strings.TrimSuffix(srv, "/")+"/domain/"+domain, &resp)
+	if status == http.StatusNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, ev := range resp.Events {
+		if ev.Action == "registration" {
+			return ev.Date, nil
+		}
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,285 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package flood implements the check.flood module that limits the amount
+// of messages and recipients per unauthenticated sender address, sender
+// domain and client IP.
+package flood
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName   = "check.flood"
+	keyPrefix = "flood:"
+)
+
+// limit is the max. amount of messages and recipients in a window for a
+// single scope. Zero value means no limit.
+type limit struct {
+	messages int
+	rcpts    int
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	state  module.SharedState
+	window time.Duration
+
+	senderLimit limit
+	domainLimit limit
+	ipLimit     limit
+
+	floodAction    modconfig.FailAction
+	excludeDomains map[string]struct{}
+
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var excludeDomains []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("state", false, false, func() (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", []string{"memory"}, config.Node{}, nil, &st)
+		return st, err
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", node.Args, node, m.Globals, &st)
+		return st, err
+	}, &c.state)
+	cfg.Duration("window", false, false, 1*time.Hour, &c.window)
+	cfg.Int("sender_messages", false, false, 200, &c.senderLimit.messages)
+	cfg.Int("sender_rcpts", false, false, 1000, &c.senderLimit.rcpts)
+	cfg.Int("domain_messages", false, false, 0, &c.domainLimit.messages)
+	cfg.Int("domain_rcpts", false, false, 0, &c.domainLimit.rcpts)
+	cfg.Int("ip_messages", false, false, 500, &c.ipLimit.messages)
+	cfg.Int("ip_rcpts", false, false, 2500, &c.ipLimit.rcpts)
+	cfg.Custom("flood_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.floodAction)
+	cfg.StringList("exclude_domains", false, false, nil, &excludeDomains)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.window <= 0 {
+		return config.NodeErr(cfg.Block, "window should be positive")
+	}
+
+	c.excludeDomains = make(map[string]struct{}, len(excludeDomains))
+	for _, d := range excludeDomains {
+		dom, err := dns.ForLookup(d)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid domain %s: %v", d, err)
+		}
+		c.excludeDomains[dom] = struct{}{}
+	}
+
+	return nil
+}
+
+// count increments the counter for the key and returns the estimated amount
+// of events in the sliding window ending now.
+//
+// The estimate is computed using counters for the current and the previous
+// fixed windows, the previous one is weighted by the part of it that
+// overlaps with the sliding window.
+func (c *Check) count(ctx context.Context, key string) (float64, error) {
+	now := c.now()
+	idx := now.UnixNano() / int64(c.window)
+	elapsed := float64(now.UnixNano()%int64(c.window)) / float64(c.window)
+
+	cur, err := c.state.Incr(ctx, key+":"+strconv.FormatInt(idx, 10), 2*c.window)
+	if err != nil {
+		return 0, err
+	}
+	prev, err := c.getInt(ctx, key+":"+strconv.FormatInt(idx-1, 10))
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(prev)*(1-elapsed) + float64(cur), nil
+}
+
+func (c *Check) getInt(ctx context.Context, key string) (int64, error) {
+	val, ok, err := c.state.Get(ctx, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	skip   bool
+	scopes []scope
+}
+
+type scope struct {
+	name  string
+	key   string
+	limit limit
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// CheckSender determines scopes for the message and counts it.
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckSender").End()
+
+	// Limits apply only to messages from other servers.
+	if s.msgMeta.Conn == nil || s.msgMeta.Conn.AuthUser != "" {
+		s.skip = true
+		return module.CheckResult{}
+	}
+
+	if mailFrom != "" {
+		addr, err := address.ForLookup(mailFrom)
+		if err != nil {
+			s.log.Error("malformed sender address", err, "mail_from", mailFrom)
+			addr = mailFrom
+		}
+		_, domain, err := address.Split(addr)
+		if err == nil && domain != "" {
+			if _, ok := s.c.excludeDomains[domain]; ok {
+				s.skip = true
+				return module.CheckResult{}
+			}
+			s.scopes = append(s.scopes,
+				scope{name: "sender", key: keyPrefix + "sender:" + addr, limit: s.c.senderLimit},
+				scope{name: "domain", key: keyPrefix + "domain:" + domain, limit: s.c.domainLimit})
+		}
+	}
+	if tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		s.scopes = append(s.scopes, scope{name: "ip", key: keyPrefix + "ip:" + tcpAddr.IP.String(), limit: s.c.ipLimit})
+	}
+
+	return s.checkScopes(ctx, "msgs", func(l limit) int { return l.messages })
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckRcpt").End()
+
+	if s.skip {
+		return module.CheckResult{}
+	}
+	return s.checkScopes(ctx, "rcpts", func(l limit) int { return l.rcpts })
+}
+
+// checkScopes counts the event for all scopes with the limit set and returns
+// the rejection if any of limits is exceeded.
+func (s *state) checkScopes(ctx context.Context, kind string, max func(limit) int) module.CheckResult {
+	for _, sc := range s.scopes {
+		maxVal := max(sc.limit)
+		if maxVal == 0 {
+			continue
+		}
+
+		cnt, err := s.c.count(ctx, sc.key+":"+kind)
+		if err != nil {
+			// Do not stop the message flow if the state store is not
+			// available.
+			s.log.Error("state store error, limit is not enforced", err, "scope", sc.name)
+			continue
+		}
+		if cnt <= float64(maxVal) {
+			continue
+		}
+
+		return s.c.floodAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+				Message:      "Too many messages from the sender, try again later",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"scope": sc.name,
+					"kind":  kind,
+					"count": int(cnt),
+					"limit": maxVal,
+				},
+			},
+		})
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package flood
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+
+	_ "github.com/foxcpp/maddy/internal/state"
+)
+
+func initCheck(t *testing.T, cfg []config.Node, now *time.Time) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	c.now = func() time.Time { return *now }
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// checkMsg runs checks for a message and returns the first failed result.
+func checkMsg(t *testing.T, c *Check, conn *module.ConnState, mailFrom string, rcpts ...string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: mailFrom,
+		Conn:         conn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if res := st.CheckSender(context.Background(), mailFrom); res.Reason != nil {
+		return res
+	}
+	for _, rcpt := range rcpts {
+		if res := st.CheckRcpt(context.Background(), rcpt); res.Reason != nil {
+			return res
+		}
+	}
+	return module.CheckResult{}
+}
+
+func remoteConn(ip string) *module.ConnState {
+	return &module.ConnState{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+	}
+}
+
+func TestSenderLimit(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	c := initCheck(t, []config.Node{
+		{Name: "sender_messages", Args: []string{"3"}},
+		{Name: "ip_messages", Args: []string{"0"}},
+	}, &now)
+
+	for i := 0; i < 3; i++ {
+		if res := checkMsg(t, c, remoteConn("192.0.2.1"), "a@example.org", "b@example.com"); res.Reason != nil {
+			t.Fatalf("unexpected rejection for message %d: %v", i, res.Reason)
+		}
+	}
+
+	res := checkMsg(t, c, remoteConn("192.0.2.2"), "A@Example.org", "b@example.com")
+	if !res.Reject {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	if code := res.Reason.(*exterrors.SMTPError).Code; code != 451 {
+		t.Fatalf("wrong code: %v", code)
+	}
+
+	// Other senders are not affected.
+	if res := checkMsg(t, c, remoteConn("192.0.2.1"), "c@example.org", "b@example.com"); res.Reason != nil {
+		t.Fatalf("unexpected rejection: %v", res.Reason)
+	}
+
+	// 4 messages in the previous window, 2/3 of it is still in the sliding
+	// window.
+	now = now.Add(80 * time.Minute)
+	if res := checkMsg(t, c, remoteConn("192.0.2.1"), "a@example.org", "b@example.com"); !res.Reject {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	now = now.Add(30 * time.Minute)
+	if res := checkMsg(t, c, remoteConn("192.0.2.1"), "a@example.org", "b@example.com"); res.Reason != nil {
+		t.Fatalf("unexpected rejection: %v", res.Reason)
+	}
+}
+
+func TestRcptLimit(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	c := initCheck(t, []config.Node{
+		{Name: "sender_rcpts", Args: []string{"0"}},
+		{Name: "domain_rcpts", Args: []string{"4"}},
+		{Name: "flood_action", Args: []string{"quarantine"}},
+	}, &now)
+
+	if res := checkMsg(t, c, remoteConn("192.0.2.1"), "a@example.org", "1@example.com", "2@example.com"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+	if res := checkMsg(t, c, remoteConn("192.0.2.1"), "b@example.org", "3@example.com", "4@example.com"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+	res := checkMsg(t, c, remoteConn("192.0.2.1"), "c@example.org", "5@example.com")
+	if !res.Quarantine || res.Reject {
+		t.Fatalf("expected quarantine, got %+v", res)
+	}
+}
+
+func TestIPLimit(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	c := initCheck(t, []config.Node{
+		{Name: "ip_messages", Args: []string{"2"}},
+	}, &now)
+
+	checkMsg(t, c, remoteConn("192.0.2.1"), "", "1@example.com")
+	checkMsg(t, c, remoteConn("192.0.2.1"), "a@example.org", "1@example.com")
+	if res := checkMsg(t, c, remoteConn("192.0.2.1"), "b@example.net", "1@example.com"); !res.Reject {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	if res := checkMsg(t, c, remoteConn("192.0.2.2"), "b@example.net", "1@example.com"); res.Reason != nil {
+		t.Fatalf("unexpected rejection: %v", res.Reason)
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	c := initCheck(t, []config.Node{
+		{Name: "sender_messages", Args: []string{"1"}},
+		{Name: "exclude_domains", Args: []string{"EXAMPLE.net"}},
+	}, &now)
+
+	authConn := remoteConn("192.0.2.1")
+	authConn.AuthUser = "a@example.org"
+	for i := 0; i < 3; i++ {
+		if res := checkMsg(t, c, authConn, "a@example.org", "b@example.com"); res.Reason != nil {
+			t.Fatalf("unexpected rejection for authenticated sender: %v", res.Reason)
+		}
+		if res := checkMsg(t, c, nil, "a@example.org", "b@example.com"); res.Reason != nil {
+			t.Fatalf("unexpected rejection for locally generated message: %v", res.Reason)
+		}
+		if res := checkMsg(t, c, remoteConn("192.0.2.1"), "a@example.net", "b@example.com"); res.Reason != nil {
+			t.Fatalf("unexpected rejection for excluded domain: %v", res.Reason)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package geoip implements the check.geoip module that scores or rejects
+// connections based on the country and autonomous system of the client
+// IP address using MaxMind databases.
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const modName = "check.geoip"
+
+// ErrDenied is returned by AllowAuth for authentication attempts from
+// locations rejected by the submission policy.
+var ErrDenied = errors.New("geoip: authentication attempts from this location are not allowed")
+
+// geoDB is the subset of maxminddb.Reader methods used by the check.
+type geoDB interface {
+	Lookup(ip net.IP, result interface{}) error
+	Close() error
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+type policy struct {
+	countryScores map[string]int
+	asnScores     map[uint]int
+
+	// Scores for countries and ASNs not listed explicitly ("*").
+	otherCountryScore int
+	otherASNScore     int
+
+	quarantineThreshold int
+	rejectThreshold     int
+}
+
+func (p *policy) score(country string, asn uint) int {
+	score := 0
+	if country != "" {
+		if s, ok := p.countryScores[country]; ok {
+			score += s
+		} else {
+			score += p.otherCountryScore
+		}
+	}
+	if asn != 0 {
+		if s, ok := p.asnScores[asn]; ok {
+			score += s
+		} else {
+			score += p.otherASNScore
+		}
+	}
+	return score
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	countryDB geoDB
+	asnDB     geoDB
+
+	// Policy for unauthenticated (MX) and authenticated (submission)
+	// connections. nil if not configured.
+	mx         *policy
+	submission *policy
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var countryDBPath, asnDBPath string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("country_db", false, false, "", &countryDBPath)
+	cfg.String("asn_db", false, false, "", &asnDBPath)
+	cfg.Callback("mx", func(_ *config.Map, node config.Node) error {
+		if c.mx != nil {
+			return config.NodeErr(node, "duplicate 'mx' block")
+		}
+		var err error
+		c.mx, err = readPolicyCfg(node)
+		return err
+	})
+	cfg.Callback("submission", func(_ *config.Map, node config.Node) error {
+		if c.submission != nil {
+			return config.NodeErr(node, "duplicate 'submission' block")
+		}
+		var err error
+		c.submission, err = readPolicyCfg(node)
+		return err
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if countryDBPath == "" && asnDBPath == "" {
+		return fmt.Errorf("%s: at least one of country_db and asn_db is required", modName)
+	}
+	if c.mx == nil && c.submission == nil {
+		c.log.Msg("no policies configured, check is no-op")
+	}
+
+	if countryDBPath != "" {
+		db, err := maxminddb.Open(countryDBPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		c.countryDB = db
+	}
+	if asnDBPath != "" {
+		db, err := maxminddb.Open(asnDBPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		c.asnDB = db
+	}
+
+	return nil
+}
+
+func readPolicyCfg(node config.Node) (*policy, error) {
+	p := &policy{
+		countryScores: map[string]int{},
+		asnScores:     map[uint]int{},
+	}
+
+	cfg := config.NewMap(nil, node)
+	cfg.Callback("country_score", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected at least 2 arguments")
+		}
+		score, err := strconv.Atoi(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "invalid score: %v", err)
+		}
+		for _, code := range node.Args[1:] {
+			if code == "*" {
+				p.otherCountryScore = score
+				continue
+			}
+			if len(code) != 2 {
+				return config.NodeErr(node, "invalid country code: %s", code)
+			}
+			p.countryScores[strings.ToUpper(code)] = score
+		}
+		return nil
+	})
+	cfg.Callback("asn_score", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected at least 2 arguments")
+		}
+		score, err := strconv.Atoi(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "invalid score: %v", err)
+		}
+		for _, asnStr := range node.Args[1:] {
+			if asnStr == "*" {
+				p.otherASNScore = score
+				continue
+			}
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asnStr), "AS"), 10, 32)
+			if err != nil || asn == 0 {
+				return config.NodeErr(node, "invalid AS number: %s", asnStr)
+			}
+			p.asnScores[uint(asn)] = score
+		}
+		return nil
+	})
+	cfg.Int("quarantine_threshold", false, false, 1, &p.quarantineThreshold)
+	cfg.Int("reject_threshold", false, false, 9999, &p.rejectThreshold)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (c *Check) Close() error {
+	var err error
+	if c.countryDB != nil {
+		err = c.countryDB.Close()
+	}
+	if c.asnDB != nil {
+		if asnErr := c.asnDB.Close(); err == nil {
+			err = asnErr
+		}
+	}
+	return err
+}
+
+// lookup returns the country code and AS number for the IP address.
+//
+// Empty country code or zero AS number means that the address is not
+// present in the corresponding database.
+func (c *Check) lookup(ip net.IP) (country string, asn uint, org string, err error) {
+	if c.countryDB != nil {
+		var rec countryRecord
+		if err := c.countryDB.Lookup(ip, &rec); err != nil {
+			return "", 0, "", fmt.Errorf("country lookup: %w", err)
+		}
+		country = strings.ToUpper(rec.Country.ISOCode)
+	}
+	if c.asnDB != nil {
+		var rec asnRecord
+		if err := c.asnDB.Lookup(ip, &rec); err != nil {
+			return "", 0, "", fmt.Errorf("ASN lookup: %w", err)
+		}
+		asn = rec.ASN
+		org = rec.Org
+	}
+	return country, asn, org, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.Msg("locally generated message, ignoring")
+		return module.CheckResult{}
+	}
+
+	p, policyName := s.c.mx, "mx"
+	if s.msgMeta.Conn.AuthUser != "" {
+		p, policyName = s.c.submission, "submission"
+	}
+	if p == nil {
+		return module.CheckResult{}
+	}
+
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.Msg("non-TCP/IP source, ignoring")
+		return module.CheckResult{}
+	}
+
+	country, asn, org, err := s.c.lookup(tcpAddr.IP)
+	if err != nil {
+		s.log.Error("database lookup failed", err, "ip", tcpAddr.IP.String())
+		return module.CheckResult{}
+	}
+	score := p.score(country, asn)
+
+	s.log.DebugMsg("client location", "ip", tcpAddr.IP.String(), "country", country,
+		"asn", asn, "as_org", org, "policy", policyName, "score", score)
+
+	misc := map[string]interface{}{
+		"ip":      tcpAddr.IP.String(),
+		"country": country,
+		"asn":     asn,
+		"policy":  policyName,
+		"score":   score,
+	}
+	if score >= p.rejectThreshold {
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Connections from your location are not allowed",
+				CheckName:    modName,
+				Misc:         misc,
+			},
+		}
+	}
+	if score >= p.quarantineThreshold {
+		return module.CheckResult{
+			Quarantine: true,
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Connections from your location are not allowed",
+				CheckName:    modName,
+				Misc:         misc,
+			},
+		}
+	}
+
+	return module.CheckResult{}
+}
+
+// AllowAuth implements module.AuthPolicy. Attempts are rejected if their
+// score according to the submission policy reaches reject_threshold.
+func (c *Check) AllowAuth(ctx context.Context, attempt module.AuthAttempt) (time.Duration, error) {
+	if c.submission == nil {
+		return 0, nil
+	}
+	tcpAddr, ok := attempt.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return 0, nil
+	}
+
+	country, asn, org, err := c.lookup(tcpAddr.IP)
+	if err != nil {
+		c.log.Error("database lookup failed", err, "ip", tcpAddr.IP.String())
+		return 0, nil
+	}
+	score := c.submission.score(country, asn)
+
+	c.log.DebugMsg("client location", "ip", tcpAddr.IP.String(), "country", country,
+		"asn", asn, "as_org", org, "policy", "submission", "score", score, "username", attempt.Username)
+
+	if score >= c.submission.rejectThreshold {
+		c.log.Msg("authentication attempt denied", "username", attempt.Username, "src_ip", tcpAddr.IP.String(),
+			"country", country, "asn", asn, "score", score)
+		return 0, ErrDenied
+	}
+	return 0, nil
+}
+
+// ReportAuth implements module.AuthPolicy, it is no-op.
+func (c *Check) ReportAuth(ctx context.Context, attempt module.AuthAttempt, success bool) {}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,218 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package geoip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mockDB struct {
+	countries map[string]string
+	asns      map[string]uint
+}
+
+func (db mockDB) Lookup(ip net.IP, result interface{}) error {
+	switch rec := result.(type) {
+	case *countryRecord:
+		rec.Country.ISOCode = db.countries[ip.String()]
+	case *asnRecord:
+		rec.ASN = db.asns[ip.String()]
+	}
+	return nil
+}
+
+func (mockDB) Close() error {
+	return nil
+}
+
+func testCheck(t *testing.T, cfg string) *Check {
+	t.Helper()
+
+	nodes, err := parser.Read(strings.NewReader(cfg), "literal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Check{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+	}
+	for _, node := range nodes {
+		p, err := readPolicyCfg(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch node.Name {
+		case "mx":
+			c.mx = p
+		case "submission":
+			c.submission = p
+		}
+	}
+
+	db := mockDB{
+		countries: map[string]string{
+			"192.0.2.1": "de",
+			"192.0.2.2": "RU",
+			"192.0.2.3": "US",
+		},
+		asns: map[string]uint{
+			"192.0.2.1": 64496,
+			"192.0.2.2": 64497,
+			"192.0.2.3": 64498,
+		},
+	}
+	c.countryDB = db
+	c.asnDB = db
+	return c
+}
+
+func checkConn(t *testing.T, c *Check, ip, authUser string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID: "test",
+		Conn: &module.ConnState{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+			AuthUser:   authUser,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	return st.CheckConnection(context.Background())
+}
+
+func TestCheck_MX(t *testing.T) {
+	c := testCheck(t, `
+		mx {
+			country_score 5 ru cn
+			asn_score 10 AS64498
+			quarantine_threshold 5
+			reject_threshold 10
+		}`)
+
+	if res := checkConn(t, c, "192.0.2.1", ""); res.Reject || res.Quarantine {
+		t.Errorf("192.0.2.1: unexpected result: %+v", res)
+	}
+	if res := checkConn(t, c, "192.0.2.2", ""); res.Reject || !res.Quarantine {
+		t.Errorf("192.0.2.2: expected quarantine, got %+v", res)
+	}
+	if res := checkConn(t, c, "192.0.2.3", ""); !res.Reject {
+		t.Errorf("192.0.2.3: expected reject, got %+v", res)
+	}
+	// Not present in the database.
+	if res := checkConn(t, c, "10.0.0.1", ""); res.Reject || res.Quarantine {
+		t.Errorf("10.0.0.1: unexpected result: %+v", res)
+	}
+	// No submission policy.
+	if res := checkConn(t, c, "192.0.2.3", "user@example.org"); res.Reject || res.Quarantine {
+		t.Errorf("192.0.2.3 (auth): unexpected result: %+v", res)
+	}
+}
+
+func TestCheck_Submission(t *testing.T) {
+	c := testCheck(t, `
+		submission {
+			country_score 0 DE
+			country_score 10 *
+			asn_score -10 64497
+			reject_threshold 10
+		}`)
+
+	if res := checkConn(t, c, "192.0.2.1", "user@example.org"); res.Reject || res.Quarantine {
+		t.Errorf("192.0.2.1: unexpected result: %+v", res)
+	}
+	if res := checkConn(t, c, "192.0.2.2", "user@example.org"); res.Reject || res.Quarantine {
+		t.Errorf("192.0.2.2: unexpected result: %+v", res)
+	}
+	if res := checkConn(t, c, "192.0.2.3", "user@example.org"); !res.Reject {
+		t.Errorf("192.0.2.3: expected reject, got %+v", res)
+	}
+	if res := checkConn(t, c, "10.0.0.1", "user@example.org"); res.Reject || res.Quarantine {
+		t.Errorf("10.0.0.1: unexpected result: %+v", res)
+	}
+	// No MX policy.
+	if res := checkConn(t, c, "192.0.2.3", ""); res.Reject || res.Quarantine {
+		t.Errorf("192.0.2.3 (mx): unexpected result: %+v", res)
+	}
+}
+
+func TestCheck_AllowAuth(t *testing.T) {
+	c := testCheck(t, `
+		submission {
+			country_score 0 DE
+			country_score 10 *
+			reject_threshold 10
+		}`)
+
+	allow := func(ip string) error {
+		t.Helper()
+		_, err := c.AllowAuth(context.Background(), module.AuthAttempt{
+			Username:   "user@example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 587},
+		})
+		return err
+	}
+	if err := allow("192.0.2.1"); err != nil {
+		t.Errorf("192.0.2.1: unexpected error: %v", err)
+	}
+	if err := allow("192.0.2.3"); !errors.Is(err, ErrDenied) {
+		t.Errorf("192.0.2.3: expected ErrDenied, got %v", err)
+	}
+	if err := allow("10.0.0.1"); err != nil {
+		t.Errorf("10.0.0.1: unexpected error: %v", err)
+	}
+
+	// No submission policy.
+	c = testCheck(t, `
+		mx {
+			country_score 10 *
+			reject_threshold 10
+		}`)
+	if err := allow("192.0.2.3"); err != nil {
+		t.Errorf("192.0.2.3 (mx only): unexpected error: %v", err)
+	}
+}
+
+func TestReadPolicyCfg_Invalid(t *testing.T) {
+	for _, cfg := range []string{
+		`mx { country_score 5 }`,
+		`mx { country_score X RU }`,
+		`mx { country_score 5 RUS }`,
+		`mx { asn_score 5 ASX }`,
+		`mx { asn_score 5 0 }`,
+	} {
+		nodes, err := parser.Read(strings.NewReader(cfg), "literal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPolicyCfg(nodes[0]); err == nil {
+			t.Errorf("expected error for %s", cfg)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package header_policy implements the check.header_policy module that
+// checks the message header for missing or duplicate fields, size limits
+// and malformed line endings.
+package header_policy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.header_policy"
+
+var (
+	defaultRequired = []string{"Date", "From", "Message-ID"}
+
+	// Fields that can occur at most once per RFC 5322, section 3.6.
+	singleFields = []string{
+		"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc",
+		"Message-ID", "In-Reply-To", "References", "Subject",
+	}
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	required      []string
+	maxFields     int
+	maxHeaderSize int64
+	checkBody     bool
+
+	missingAction   modconfig.FailAction
+	duplicateAction modconfig.FailAction
+	limitsAction    modconfig.FailAction
+	bareLFAction    modconfig.FailAction
+	nulAction       modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func actionDefault(action modconfig.FailAction) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		return action, nil
+	}
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("required_fields", false, false, defaultRequired, &c.required)
+	cfg.Int("max_fields", false, false, 1000, &c.maxFields)
+	cfg.DataSize("max_header_size", false, false, 64*1024, &c.maxHeaderSize)
+	cfg.Bool("check_body", false, true, &c.checkBody)
+	cfg.Custom("missing_action", false, false,
+		actionDefault(modconfig.FailAction{Quarantine: true}),
+		modconfig.FailActionDirective, &c.missingAction)
+	cfg.Custom("duplicate_action", false, false,
+		actionDefault(modconfig.FailAction{Reject: true}),
+		modconfig.FailActionDirective, &c.duplicateAction)
+	cfg.Custom("limits_action", false, false,
+		actionDefault(modconfig.FailAction{Reject: true}),
+		modconfig.FailActionDirective, &c.limitsAction)
+	cfg.Custom("bare_lf_action", false, false,
+		actionDefault(modconfig.FailAction{Quarantine: true}),
+		modconfig.FailActionDirective, &c.bareLFAction)
+	cfg.Custom("nul_action", false, false,
+		actionDefault(modconfig.FailAction{Reject: true}),
+		modconfig.FailActionDirective, &c.nulAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// lineEndings reports whether r contains bare LF characters (not preceded by
+// CR) or NUL bytes.
+func lineEndings(r io.Reader) (bareLF, nul bool, err error) {
+	br := bufio.NewReader(r)
+	var prev byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return bareLF, nul, nil
+			}
+			return bareLF, nul, err
+		}
+		switch b {
+		case '\n':
+			if prev != '\r' {
+				bareLF = true
+			}
+		case 0:
+			nul = true
+		}
+		if bareLF && nul {
+			return bareLF, nul, nil
+		}
+		prev = b
+	}
+}
+
+func (s *state) violation(action modconfig.FailAction, code exterrors.EnhancedCode, msg string, misc map[string]interface{}) module.CheckResult {
+	s.log.DebugMsg("header policy violation", "reason", msg, "details", misc)
+	return action.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: code,
+			Message:      msg,
+			CheckName:    modName,
+			Misc:         misc,
+		},
+	})
+}
+
+// checkHeader returns the results for all policy violations found in the
+// header. Violations with the "ignore" action are included too.
+func (s *state) checkHeader(hdr textproto.Header) ([]module.CheckResult, error) {
+	var (
+		results    []module.CheckResult
+		fieldCount int
+		headerSize int64
+		nul        bool
+	)
+
+	fields := hdr.Fields()
+	for fields.Next() {
+		fieldCount++
+		raw, err := fields.Raw()
+		if err != nil {
+			return nil, err
+		}
+		headerSize += int64(len(raw))
+		// Line endings are normalized by the header parser so only NUL is
+		// checked here.
+		nul = nul || bytes.IndexByte(raw, 0) != -1
+	}
+
+	if s.c.maxFields != 0 && fieldCount > s.c.maxFields {
+		results = append(results, s.violation(s.c.limitsAction, exterrors.EnhancedCode{5, 6, 0},
+			"Too many header fields", map[string]interface{}{"fields": fieldCount}))
+	}
+	if s.c.maxHeaderSize != 0 && headerSize > s.c.maxHeaderSize {
+		results = append(results, s.violation(s.c.limitsAction, exterrors.EnhancedCode{5, 6, 0},
+			"Message header is too big", map[string]interface{}{"size": headerSize}))
+	}
+	if nul {
+		results = append(results, s.violation(s.c.nulAction, exterrors.EnhancedCode{5, 6, 0},
+			"NUL character in message header", nil))
+	}
+	for _, name := range s.c.required {
+		if !hdr.Has(name) {
+			results = append(results, s.violation(s.c.missingAction, exterrors.EnhancedCode{5, 6, 0},
+				"Missing required header field", map[string]interface{}{"field": name}))
+		}
+	}
+
+	for _, name := range singleFields {
+		if count := len(hdr.Values(name)); count > 1 {
+			results = append(results, s.violation(s.c.duplicateAction, exterrors.EnhancedCode{5, 6, 0},
+				"Duplicate header field", map[string]interface{}{"field": name, "count": count}))
+		}
+	}
+
+	// RFC 5322, section 3.6.2: From with multiple mailboxes requires Sender.
+	if from := hdr.Get("From"); from != "" && !hdr.Has("Sender") {
+		if addrs, err := mail.ParseAddressList(from); err == nil && len(addrs) > 1 {
+			results = append(results, s.violation(s.c.duplicateAction, exterrors.EnhancedCode{5, 6, 0},
+				"Multiple From addresses without Sender", map[string]interface{}{"count": len(addrs)}))
+		}
+	}
+
+	return results, nil
+}
+
+func (s *state) checkBody(body buffer.Buffer) ([]module.CheckResult, error) {
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	bareLF, nul, err := lineEndings(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []module.CheckResult
+	if nul {
+		results = append(results, s.violation(s.c.nulAction, exterrors.EnhancedCode{5, 6, 0},
+			"NUL character in message body", nil))
+	}
+	if bareLF {
+		results = append(results, s.violation(s.c.bareLFAction, exterrors.EnhancedCode{5, 6, 0},
+			"Bare LF in message body", nil))
+	}
+	return results, nil
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	results, err := s.checkHeader(hdr)
+	if err == nil && s.c.checkBody {
+		var bodyResults []module.CheckResult
+		bodyResults, err = s.checkBody(body)
+		results = append(results, bodyResults...)
+	}
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{
+					"check":    modName,
+					"smtp_msg": "Internal I/O error",
+				}),
+				true,
+			),
+		}
+	}
+
+	// The first rejection wins, otherwise the message is quarantined if
+	// any violation requires that.
+	var quarantine *module.CheckResult
+	for i, res := range results {
+		if res.Reject {
+			return res
+		}
+		if res.Quarantine && quarantine == nil {
+			quarantine = &results[i]
+		}
+	}
+	if quarantine != nil {
+		return *quarantine
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
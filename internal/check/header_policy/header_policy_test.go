@@ -0,0 +1,114 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package header_policy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const validHeader = "From: <sender@example.org>\r\n" +
+	"To: <rcpt@example.com>\r\n" +
+	"Date: Wed, 14 Oct 2026 12:00:00 +0000\r\n" +
+	"Message-ID: <1@example.org>\r\n" +
+	"Subject: Test\r\n"
+
+func initCheck(t *testing.T, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkMsg(t *testing.T, c *Check, msg string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr, body := testutils.BodyFromStr(t, msg)
+	return st.CheckBody(context.Background(), hdr, body)
+}
+
+func TestCheck(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "max_fields", Args: []string{"10"}},
+	})
+
+	test := func(name, msg string, reject, quarantine bool) {
+		t.Run(name, func(t *testing.T) {
+			res := checkMsg(t, c, msg)
+			if res.Reject != reject || res.Quarantine != quarantine {
+				t.Fatalf("wrong result, want reject=%v quarantine=%v, got %+v", reject, quarantine, res)
+			}
+		})
+	}
+
+	test("valid", validHeader+"\r\nHello!\r\n", false, false)
+	test("missing Message-ID",
+		strings.Replace(validHeader, "Message-ID: <1@example.org>\r\n", "", 1)+"\r\nHello!\r\n",
+		false, true)
+	test("duplicate From", "From: <other@example.org>\r\n"+validHeader+"\r\nHello!\r\n", true, false)
+	test("multiple From addresses",
+		strings.Replace(validHeader, "<sender@example.org>", "<a@example.org>, <b@example.org>", 1)+"\r\nHello!\r\n",
+		true, false)
+	test("multiple From addresses with Sender",
+		"Sender: <a@example.org>\r\n"+
+			strings.Replace(validHeader, "<sender@example.org>", "<a@example.org>, <b@example.org>", 1)+"\r\nHello!\r\n",
+		false, false)
+	test("too many fields", validHeader+strings.Repeat("X-Test: 1\r\n", 6)+"\r\nHello!\r\n", true, false)
+	test("bare LF in body", validHeader+"\r\nHello!\nWorld\r\n", false, true)
+	test("NUL in body", validHeader+"\r\nHello\x00!\r\n", true, false)
+	// Rejection takes precedence over quarantine.
+	test("NUL and bare LF", validHeader+"\r\nHello\x00!\n", true, false)
+}
+
+func TestCheck_Actions(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "required_fields", Args: []string{"From", "X-Required"}},
+		{Name: "missing_action", Args: []string{"reject"}},
+		{Name: "duplicate_action", Args: []string{"ignore"}},
+		{Name: "check_body", Args: []string{"no"}},
+	})
+
+	if res := checkMsg(t, c, validHeader+"\r\nHello!\r\n"); !res.Reject {
+		t.Errorf("expected reject for missing field, got %+v", res)
+	}
+
+	msg := "X-Required: 1\r\nFrom: <other@example.org>\r\n" + validHeader + "\r\nHello\x00!\r\n"
+	if res := checkMsg(t, c, msg); res.Reject || res.Quarantine {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
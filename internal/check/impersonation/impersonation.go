@@ -0,0 +1,358 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package impersonation implements the check.impersonation module that
+// detects messages using display names of protected persons and domains that
+// look like protected ones.
+package impersonation
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.impersonation"
+
+// keysTable is implemented by tables that can list their keys. It is
+// needed since display names are matched approximately.
+type keysTable interface {
+	module.Table
+	Keys() ([]string, error)
+}
+
+type protectedDomain struct {
+	name     string
+	skeleton string
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	protectedNames   keysTable
+	protectedDomains []protectedDomain
+	maxDistance      int
+
+	impersonationAction modconfig.FailAction
+	lookalikeAction     modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		names   module.Table
+		domains []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	modconfig.Table(cfg, "protected_names", false, false, nil, &names)
+	cfg.StringList("protected_domains", false, false, nil, &domains)
+	cfg.Int("max_distance", false, false, 1, &c.maxDistance)
+	cfg.Custom("impersonation_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.impersonationAction)
+	cfg.Custom("lookalike_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.lookalikeAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if names != nil {
+		keys, ok := names.(keysTable)
+		if !ok {
+			return config.NodeErr(cfg.Block, "protected_names table should support listing keys (e.g. file, static or sql_table)")
+		}
+		c.protectedNames = keys
+	}
+
+	for _, d := range domains {
+		dom, err := normalizeDomain(d)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid domain %s: %v", d, err)
+		}
+		c.protectedDomains = append(c.protectedDomains, protectedDomain{
+			name:     dom,
+			skeleton: skeleton(dom),
+		})
+	}
+
+	return nil
+}
+
+// normalizeDomain converts the domain into the lower-case Unicode form.
+func normalizeDomain(domain string) (string, error) {
+	domain, err := dns.ForLookup(domain)
+	if err != nil {
+		return "", err
+	}
+	return idna.ToUnicode(domain)
+}
+
+// isDomainOrSubdomain reports whether domain is parent or its subdomain.
+func isDomainOrSubdomain(domain, parent string) bool {
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+// lookalike returns the protected domain the domain is made to look like, if
+// any.
+func (c *Check) lookalike(domain string) string {
+	domSkel := skeleton(domain)
+	for _, p := range c.protectedDomains {
+		if isDomainOrSubdomain(domain, p.name) {
+			return ""
+		}
+	}
+	for _, p := range c.protectedDomains {
+		switch {
+		case domSkel == p.skeleton:
+		case strings.HasPrefix(domain, p.name+"."):
+			// example.org.attacker.com
+		case distance(domSkel, p.skeleton) <= c.maxDistance:
+		default:
+			continue
+		}
+		return p.name
+	}
+	return ""
+}
+
+// allowed reports whether the sender address is allowed to use the
+// protected name. allowedList is a comma or whitespace separated list of
+// addresses and domains, protected domains are used if it is empty.
+func (c *Check) allowed(addr, domain, allowedList string) bool {
+	entries := strings.FieldsFunc(allowedList, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(entries) == 0 {
+		for _, p := range c.protectedDomains {
+			if isDomainOrSubdomain(domain, p.name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, entry := range entries {
+		if strings.Contains(entry, "@") {
+			entryAddr, err := address.ForLookup(entry)
+			if err == nil && entryAddr == addr {
+				return true
+			}
+			continue
+		}
+		entryDomain, err := normalizeDomain(entry)
+		if err == nil && isDomainOrSubdomain(domain, entryDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) impersonation(ctx context.Context, name, addr, domain string) module.CheckResult {
+	fail := func(reason string, misc map[string]interface{}) module.CheckResult {
+		misc["reason"] = reason
+		misc["from"] = addr
+		return s.c.impersonationAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Message looks like an impersonation attempt",
+				CheckName:    modName,
+				Misc:         misc,
+			},
+		})
+	}
+
+	// "ceo@example.org" <attacker@example.com>
+	for _, word := range strings.Fields(name) {
+		word = strings.Trim(word, `"'<>()[],;`)
+		if !strings.Contains(word, "@") {
+			continue
+		}
+		nameAddr, err := address.ForLookup(word)
+		if err != nil {
+			continue
+		}
+		_, nameDomain, err := address.Split(nameAddr)
+		if err != nil {
+			continue
+		}
+		nameDomain, err = normalizeDomain(nameDomain)
+		if err != nil || isDomainOrSubdomain(domain, nameDomain) {
+			continue
+		}
+		for _, p := range s.c.protectedDomains {
+			if isDomainOrSubdomain(nameDomain, p.name) {
+				return fail("address in display name", map[string]interface{}{"display_addr": nameAddr})
+			}
+		}
+	}
+
+	if s.c.protectedNames == nil {
+		return module.CheckResult{}
+	}
+	keys, err := s.c.protectedNames.Keys()
+	if err != nil {
+		s.log.Error("failed to list protected names", err)
+		return module.CheckResult{}
+	}
+	tokens := nameTokens(name)
+	for _, key := range keys {
+		if !containsTokens(tokens, nameTokens(key)) {
+			continue
+		}
+		allowedList, err := s.allowedList(ctx, key)
+		if err != nil {
+			s.log.Error("protected name lookup failed", err, "name", key)
+			continue
+		}
+		if s.c.allowed(addr, domain, allowedList) {
+			continue
+		}
+		return fail("protected name", map[string]interface{}{"protected_name": key})
+	}
+	return module.CheckResult{}
+}
+
+// allowedList returns the list of senders allowed to use the protected name.
+func (s *state) allowedList(ctx context.Context, key string) (string, error) {
+	if multi, ok := s.c.protectedNames.(module.MultiTable); ok {
+		vals, err := multi.LookupMulti(ctx, key)
+		return strings.Join(vals, ","), err
+	}
+	val, _, err := s.c.protectedNames.Lookup(ctx, key)
+	return val, err
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	// Authenticated users are allowed to use any names.
+	if s.msgMeta.Conn == nil || s.msgMeta.Conn.AuthUser != "" {
+		return module.CheckResult{}
+	}
+
+	fromAddrs, err := mail.ParseAddressList(header.Get("From"))
+	if err != nil || len(fromAddrs) == 0 {
+		// Malformed From is reported by other checks.
+		s.log.DebugMsg("missing or malformed From field", "err", err)
+		return module.CheckResult{}
+	}
+	from := fromAddrs[0]
+
+	addr, err := address.ForLookup(from.Address)
+	if err != nil {
+		return module.CheckResult{}
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil {
+		return module.CheckResult{}
+	}
+	domain, err = normalizeDomain(domain)
+	if err != nil {
+		return module.CheckResult{}
+	}
+
+	if protected := s.c.lookalike(domain); protected != "" {
+		return s.c.lookalikeAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Sender domain looks like a protected domain",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"from":      addr,
+					"protected": protected,
+				},
+			},
+		})
+	}
+
+	if from.Name == "" {
+		return module.CheckResult{}
+	}
+	return s.impersonation(ctx, from.Name, addr, domain)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
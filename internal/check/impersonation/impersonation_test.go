@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package impersonation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type namesTable struct {
+	testutils.Table
+}
+
+func (t namesTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t.M))
+	for k := range t.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func TestSkeleton(t *testing.T) {
+	for _, c := range [][2]string{
+		{"John Smith", "john smlth"},
+		{"Jоhn Smіth", "john smlth"}, // Cyrillic о and і
+		{"J0HN SMITH", "john smlth"},
+		{"Jöhn Smíth", "john smlth"},
+		{"Ｊｏｈｎ", "john"},
+		{"exarnple.org", "example.org"},
+		{"examp1e.org", "example.org"},
+		{"раураl.com", "paypal.com"},
+	} {
+		if got := skeleton(c[0]); got != c[1] {
+			t.Errorf("skeleton(%q): want %q, got %q", c[0], c[1], got)
+		}
+	}
+
+	for _, spoof := range []string{"BILL", "BiII", "Bi1l"} {
+		if skeleton(spoof) != skeleton("Bill") {
+			t.Errorf("%s does not match Bill", spoof)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		d    int
+	}{
+		{"", "", 0},
+		{"example.org", "example.org", 0},
+		{"example.org", "exampe.org", 1},
+		{"example.org", "examplle.org", 1},
+		{"example.org", "exmaple.org", 2},
+		{"example.org", "example.com", 3},
+	} {
+		if d := distance(c.a, c.b); d != c.d {
+			t.Errorf("distance(%q, %q): want %d, got %d", c.a, c.b, c.d, d)
+		}
+	}
+}
+
+func TestContainsTokens(t *testing.T) {
+	name := nameTokens("Smith, John (CEO)")
+	if !containsTokens(name, nameTokens("john smith")) {
+		t.Error("reversed name is not matched")
+	}
+	if !containsTokens(name, nameTokens("ceo")) {
+		t.Error("single word is not matched")
+	}
+	if containsTokens(name, nameTokens("smith ceo")) {
+		t.Error("non-contiguous words are matched")
+	}
+	if containsTokens(nameTokens("John"), nameTokens("john smith")) {
+		t.Error("partial name is matched")
+	}
+}
+
+func testCheck(t *testing.T, c *Check, authUser, from string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:   "test",
+		Conn: &module.ConnState{AuthUser: authUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr, body := testutils.BodyFromStr(t, "From: "+from+"\r\n\r\nHello!\r\n")
+	return st.CheckBody(context.Background(), hdr, body)
+}
+
+func TestCheck(t *testing.T) {
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if err := c.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "protected_domains", Args: []string{"example.org"}},
+			{Name: "lookalike_action", Args: []string{"reject"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	c.protectedNames = namesTable{testutils.Table{M: map[string]string{
+		"john smith":    "",
+		"jane doe":      "jane@example.net, example.com",
+		"finance dept.": "",
+	}}}
+
+	for _, tc := range []struct {
+		from          string
+		authUser      string
+		impersonation bool
+		lookalike     bool
+	}{
+		{from: `"John Smith" <john@example.org>`},
+		{from: `"John Smith" <john@mail.example.org>`},
+		{from: `John Smith <john@example.com>`, impersonation: true},
+		{from: `"Smith, John" <ceo@example.com>`, impersonation: true},
+		{from: `=?utf-8?b?0IhvaG4gU23RlnRo?= <john@example.com>`, impersonation: true},
+		{from: `"J0hn  Smith (CEO)" <john@example.com>`, impersonation: true},
+		{from: `John Smith <john@example.com>`, authUser: "john"},
+		{from: `John Smithson <john@example.com>`},
+		{from: `Jane Doe <jane@example.net>`},
+		{from: `Jane Doe <jane@sub.example.com>`},
+		{from: `Jane Doe <jane2@example.net>`, impersonation: true},
+		{from: `Finance Dept <billing@example.com>`, impersonation: true},
+		{from: `"ceo@example.org" <ceo@example.com>`, impersonation: true},
+		{from: `"ceo@example.net" <ceo@example.com>`},
+		{from: `Someone <a@examp1e.org>`, lookalike: true},
+		{from: `Someone <a@exarnple.org>`, lookalike: true},
+		{from: `Someone <a@exampie.org>`, lookalike: true},
+		{from: `Someone <a@example.org.example.com>`, lookalike: true},
+		{from: `Someone <a@xn--exmple-cua.org>`, lookalike: true},
+		{from: `Someone <a@example.com>`},
+		{from: `Someone <a@sub.example.org>`},
+		{from: `<a@example.net>`},
+	} {
+		res := testCheck(t, c, tc.authUser, tc.from)
+		if tc.lookalike {
+			if !res.Reject {
+				t.Errorf("%s: expected lookalike rejection, got %+v", tc.from, res)
+			}
+			continue
+		}
+		if res.Reject {
+			t.Errorf("%s: unexpected rejection: %v", tc.from, res.Reason)
+		}
+		if res.Quarantine != tc.impersonation {
+			t.Errorf("%s: want quarantine=%v, got %v (%v)", tc.from, tc.impersonation, res.Quarantine, res.Reason)
+		}
+	}
+}
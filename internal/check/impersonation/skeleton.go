@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package impersonation
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// confusables maps characters commonly used to imitate Latin letters to
+// these letters. Mapping is done before case folding so uppercase letters
+// that look like different lowercase ones (e.g. I and l) are handled. All
+// variants of i and l are mapped to l so skeletons of the upper-case and
+// lower-case versions of a string are the same.
+//
+// This is a small subset of Unicode TR 39 confusables relevant for Latin
+// names and domains.
+var confusables = map[rune]rune{
+	// Digits and symbols.
+	'0': 'o', '1': 'l', '|': 'l', 'I': 'l', 'i': 'l', '$': 's',
+
+	// Cyrillic.
+	'а': 'a', 'А': 'a', 'в': 'b', 'В': 'b', 'е': 'e', 'Е': 'e', 'к': 'k',
+	'К': 'k', 'м': 'm', 'М': 'm', 'н': 'h', 'Н': 'h', 'о': 'o', 'О': 'o',
+	'р': 'p', 'Р': 'p', 'с': 'c', 'С': 'c', 'т': 't', 'Т': 't', 'у': 'y',
+	'У': 'y', 'х': 'x', 'Х': 'x', 'ѕ': 's', 'Ѕ': 's', 'і': 'l', 'І': 'l',
+	'ј': 'j', 'Ј': 'j', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'һ': 'h', 'ӏ': 'l',
+	'Ӏ': 'l', 'ɡ': 'g',
+
+	// Greek.
+	'α': 'a', 'Α': 'a', 'β': 'b', 'Β': 'b', 'γ': 'y', 'ε': 'e', 'Ε': 'e',
+	'Ζ': 'z', 'η': 'n', 'Η': 'h', 'ι': 'l', 'Ι': 'l', 'κ': 'k', 'Κ': 'k',
+	'Μ': 'm', 'ν': 'v', 'Ν': 'n', 'ο': 'o', 'Ο': 'o', 'ρ': 'p', 'Ρ': 'p',
+	'τ': 't', 'Τ': 't', 'υ': 'u', 'Υ': 'y', 'χ': 'x', 'Χ': 'x', 'ω': 'w',
+
+	// Latin.
+	'ı': 'l', 'ℓ': 'l', 'ß': 's',
+}
+
+// confusableSeqs are multi-character sequences that look like a single
+// letter. They are replaced after case folding.
+var confusableSeqs = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// skeleton returns the string with visually similar characters replaced
+// with the same ones, so strings that look the same have equal skeletons.
+//
+// Compatibility decomposition is applied first, so full-width and
+// mathematical letters are replaced with regular ones and diacritics are
+// removed.
+func skeleton(s string) string {
+	s = norm.NFKD.String(s)
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if repl, ok := confusables[r]; ok {
+			r = repl
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return confusableSeqs.Replace(b.String())
+}
+
+// nameTokens splits the skeleton of the name into words ignoring
+// punctuation.
+func nameTokens(name string) []string {
+	return strings.FieldsFunc(skeleton(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsTokens reports whether needle occurs in haystack as a contiguous
+// sequence of words in the same or reversed order ("Smith, John").
+func containsTokens(haystack, needle []string) bool {
+	if len(needle) == 0 || len(needle) > len(haystack) {
+		return false
+	}
+	reversed := make([]string, len(needle))
+	for i, tok := range needle {
+		reversed[len(needle)-1-i] = tok
+	}
+
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		if equalTokens(haystack[i:i+len(needle)], needle) || equalTokens(haystack[i:i+len(needle)], reversed) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalTokens(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// distance returns the Levenshtein edit distance between a and b.
+func distance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(br)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,168 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package milter
+
+import (
+	"bytes"
+	"net/textproto"
+
+	gotextproto "github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// modifiedMsg is the message as it is changed by milters.
+type modifiedMsg struct {
+	header gotextproto.Header
+	body   buffer.Buffer
+
+	// added contains fields added on top of the header. They are returned
+	// as CheckResult.Header if the message is not otherwise modified.
+	added gotextproto.Header
+
+	// rewritten is set if the header was changed in a way that cannot be
+	// expressed by prepending fields or if the body was replaced.
+	rewritten bool
+
+	quarantine       bool
+	quarantineReason error
+}
+
+func newModifiedMsg(header gotextproto.Header, body buffer.Buffer) *modifiedMsg {
+	return &modifiedMsg{
+		header: header.Copy(),
+		body:   body,
+	}
+}
+
+// toCRLF replaces bare LF line endings used by some milters with CRLF.
+func toCRLF(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte{'\r', '\n'}, []byte{'\n'})
+	return bytes.ReplaceAll(b, []byte{'\n'}, []byte{'\r', '\n'})
+}
+
+func formatField(name, value string) []byte {
+	// Header field might be arbitarly folded by the caller and we want
+	// to preserve that exact format in case it is important (DKIM
+	// signature is added by milter).
+	field := make([]byte, 0, len(name)+2+len(value)+2)
+	field = append(field, name...)
+	field = append(field, ':', ' ')
+	field = append(field, toCRLF([]byte(value))...)
+	field = append(field, '\r', '\n')
+	return field
+}
+
+// rawFields returns raw header fields in the order they appear in the
+// message.
+func rawFields(h gotextproto.Header) [][]byte {
+	fields := make([][]byte, 0, h.Len())
+	for f := h.Fields(); f.Next(); {
+		raw, err := f.Raw()
+		if err != nil {
+			// Field was added without raw representation and contains
+			// invalid characters, it cannot be serialized anyway.
+			continue
+		}
+		fields = append(fields, raw)
+	}
+	return fields
+}
+
+func headerFromFields(fields [][]byte) gotextproto.Header {
+	var h gotextproto.Header
+	// AddRaw prepends the field.
+	for i := len(fields) - 1; i >= 0; i-- {
+		h.AddRaw(fields[i])
+	}
+	return h
+}
+
+// addField adds the field on top of the header.
+func (m *modifiedMsg) addField(name, value string) {
+	field := formatField(name, value)
+	m.header.AddRaw(field)
+	m.added.AddRaw(field)
+}
+
+// insertField inserts the field at the specified 0-based position in the
+// header.
+func (m *modifiedMsg) insertField(idx int, name, value string) {
+	if idx == 0 {
+		m.addField(name, value)
+		return
+	}
+
+	fields := rawFields(m.header)
+	if idx > len(fields) {
+		idx = len(fields)
+	}
+	fields = append(fields, nil)
+	copy(fields[idx+1:], fields[idx:])
+	fields[idx] = formatField(name, value)
+
+	m.header = headerFromFields(fields)
+	m.rewritten = true
+}
+
+// changeField replaces the value of the idx-th (starting at 1) field with
+// the specified name. The field is removed if value is empty and added if
+// there are less than idx fields with that name.
+func (m *modifiedMsg) changeField(name string, idx int, value string) {
+	if idx == 0 {
+		idx = 1
+	}
+	key := textproto.CanonicalMIMEHeaderKey(name)
+
+	fields := rawFields(m.header)
+	found := false
+	n := 0
+	for i, field := range fields {
+		colon := bytes.IndexByte(field, ':')
+		if textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(field[:colon]))) != key {
+			continue
+		}
+		n++
+		if n != idx {
+			continue
+		}
+
+		found = true
+		if value == "" {
+			fields = append(fields[:i], fields[i+1:]...)
+		} else {
+			fields[i] = formatField(name, value)
+		}
+		break
+	}
+	if !found {
+		if value == "" {
+			return
+		}
+		fields = append(fields, formatField(name, value))
+	}
+
+	m.header = headerFromFields(fields)
+	m.rewritten = true
+}
+
+// replaceBody replaces the message body.
+func (m *modifiedMsg) replaceBody(body []byte) {
+	m.body = buffer.MemoryBuffer{Slice: toCRLF(body)}
+	m.rewritten = true
+}
@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -38,10 +39,21 @@ import (
 
 const modName = "check.milter"
 
+// milterConn is a configured milter server.
+type milterConn struct {
+	endpoint string
+	cl       *milter.Client
+
+	// failOpen specifies that the milter should be skipped on I/O errors
+	// instead of rejecting the message with the temporary error.
+	failOpen bool
+}
+
 type Check struct {
-	cl        *milter.Client
+	milters   []*milterConn
 	milterUrl string
 	failOpen  bool
+	hostname  string
 	instName  string
 	log       log.Logger
 }
@@ -70,68 +82,151 @@ func (c *Check) InstanceName() string {
 }
 
 func (c *Check) Init(cfg *config.Map) error {
+	var milterBlocks []config.Node
+
+	cfg.String("hostname", true, false, "", &c.hostname)
 	cfg.String("endpoint", false, false, c.milterUrl, &c.milterUrl)
 	cfg.Bool("fail_open", false, false, &c.failOpen)
+	cfg.Callback("milter", func(_ *config.Map, node config.Node) error {
+		milterBlocks = append(milterBlocks, node)
+		return nil
+	})
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	if c.milterUrl == "" {
+	if c.milterUrl != "" {
+		m, err := c.newMilterConn(c.milterUrl, c.failOpen, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		c.milters = append(c.milters, m)
+	}
+
+	for _, node := range milterBlocks {
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "exactly one argument is required (endpoint)")
+		}
+
+		var (
+			onFailure string
+			timeout   time.Duration
+		)
+		defaultFailure := "tempfail"
+		if c.failOpen {
+			defaultFailure = "accept"
+		}
+		blockCfg := config.NewMap(cfg.Globals, node)
+		blockCfg.Enum("on_failure", false, false, []string{"accept", "tempfail"}, defaultFailure, &onFailure)
+		blockCfg.Duration("timeout", false, false, 10*time.Second, &timeout)
+		if _, err := blockCfg.Process(); err != nil {
+			return err
+		}
+
+		m, err := c.newMilterConn(node.Args[0], onFailure == "accept", timeout)
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		c.milters = append(c.milters, m)
+	}
+
+	if len(c.milters) == 0 {
 		return fmt.Errorf("%s: milter endpoint is not set", modName)
 	}
 
-	endp, err := config.ParseEndpoint(c.milterUrl)
+	return nil
+}
+
+func (c *Check) newMilterConn(endpoint string, failOpen bool, timeout time.Duration) (*milterConn, error) {
+	endp, err := config.ParseEndpoint(endpoint)
 	if err != nil {
-		return fmt.Errorf("%s: %v", modName, err)
+		return nil, fmt.Errorf("%s: %v", modName, err)
 	}
 
 	switch endp.Scheme {
 	case "tcp", "unix":
 	default:
-		return fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
+		return nil, fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
 	}
 	if endp.Path != "" {
-		return fmt.Errorf("%s: stray path in endpoint: %v", modName, endp)
+		return nil, fmt.Errorf("%s: stray path in endpoint: %v", modName, endp)
 	}
 
-	c.cl = milter.NewClientWithOptions(endp.Network(), endp.Address(), milter.ClientOptions{
-		Dialer: &net.Dialer{
-			Timeout: 10 * time.Second,
-		},
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		ActionMask:   milter.OptAddHeader | milter.OptQuarantine,
-		ProtocolMask: 0,
-	})
+	return &milterConn{
+		endpoint: endpoint,
+		failOpen: failOpen,
+		cl: milter.NewClientWithOptions(endp.Network(), endp.Address(), milter.ClientOptions{
+			Dialer: &net.Dialer{
+				Timeout: timeout,
+			},
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+			ActionMask: milter.OptAddHeader | milter.OptChangeHeader |
+				milter.OptChangeBody | milter.OptQuarantine,
+			ProtocolMask: 0,
+		}),
+	}, nil
+}
 
-	return nil
+// milterSession is the per-message state for a single milter.
+type milterSession struct {
+	m       *milterConn
+	session *milter.ClientSession
+
+	// skipChecks is set if the milter accepted the message or failed and
+	// should not be consulted anymore.
+	skipChecks bool
 }
 
 type state struct {
-	c          *Check
-	session    *milter.ClientSession
-	msgMeta    *module.MsgMetadata
-	skipChecks bool
-	log        log.Logger
+	c        *Check
+	sessions []*milterSession
+	msgMeta  *module.MsgMetadata
+	log      log.Logger
 }
 
 func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
-	session, err := c.cl.Session()
-	if err != nil {
-		return nil, err
-	}
-	return &state{
+	s := &state{
 		c:       c,
-		session: session,
 		msgMeta: msgMeta,
 		log:     target.DeliveryLogger(c.log, msgMeta),
-	}, nil
+	}
+	for _, m := range c.milters {
+		session, err := m.cl.Session()
+		if err != nil {
+			if m.failOpen {
+				s.log.Error("I/O error", err, "milter", m.endpoint)
+				continue
+			}
+			s.Close()
+			return nil, err
+		}
+		s.sessions = append(s.sessions, &milterSession{
+			m:       m,
+			session: session,
+		})
+	}
+	return s, nil
 }
 
-func (s *state) handleAction(act *milter.Action) module.CheckResult {
+// forEach calls the function for each milter that was not skipped, in the
+// configured order. It stops on the first result that rejects the message.
+func (s *state) forEach(f func(ms *milterSession) module.CheckResult) module.CheckResult {
+	for _, ms := range s.sessions {
+		if ms.skipChecks {
+			continue
+		}
+		if res := f(ms); res.Reject {
+			return res
+		}
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) handleAction(ms *milterSession, act *milter.Action) module.CheckResult {
 	switch act.Code {
 	case milter.ActAccept:
-		s.skipChecks = true
+		ms.skipChecks = true
 		return module.CheckResult{}
 	case milter.ActContinue:
 		return module.CheckResult{}
@@ -145,7 +240,7 @@ func (s *state) handleAction(act *milter.Action) module.CheckResult {
 				Reason:       "reply code action",
 				CheckName:    "milter",
 				Misc: map[string]interface{}{
-					"milter": s.c.milterUrl,
+					"milter": ms.m.endpoint,
 				},
 			},
 		}
@@ -162,7 +257,7 @@ func (s *state) handleAction(act *milter.Action) module.CheckResult {
 				Reason:       "reject action",
 				CheckName:    "milter",
 				Misc: map[string]interface{}{
-					"milter": s.c.milterUrl,
+					"milter": ms.m.endpoint,
 				},
 			},
 		}
@@ -176,82 +271,142 @@ func (s *state) handleAction(act *milter.Action) module.CheckResult {
 				Reason:       "reject action",
 				CheckName:    "milter",
 				Misc: map[string]interface{}{
-					"milter": s.c.milterUrl,
+					"milter": ms.m.endpoint,
 				},
 			},
 		}
 	default:
-		s.log.Msg("unknown action code ignored", "code", act.Code, "milter", s.c.milterUrl)
+		s.log.Msg("unknown action code ignored", "code", act.Code, "milter", ms.m.endpoint)
 		return module.CheckResult{}
 	}
 }
 
-// apply applies the modification actions returned by milter to the check results object.
-func (s *state) apply(modifyActs []milter.ModifyAction, res module.CheckResult) module.CheckResult {
-	out := res
+// apply applies the modification actions returned by milter to the message
+// being modified.
+func (s *state) apply(ms *milterSession, modifyActs []milter.ModifyAction, msg *modifiedMsg) {
+	var newBody []byte
 	for _, act := range modifyActs {
 		switch act.Code {
 		case milter.ActAddRcpt, milter.ActDelRcpt:
-			s.log.Msg("envelope changes are not supported", "rcpt", act.Rcpt, "code", act.Code, "milter", s.c.milterUrl)
+			s.log.Msg("envelope changes are not supported", "rcpt", act.Rcpt, "code", act.Code, "milter", ms.m.endpoint)
 		case milter.ActChangeFrom:
-			s.log.Msg("envelope changes are not supported", "from", act.From, "code", act.Code, "milter", s.c.milterUrl)
+			s.log.Msg("envelope changes are not supported", "from", act.From, "code", act.Code, "milter", ms.m.endpoint)
 		case milter.ActChangeHeader:
-			s.log.Msg("header field changes are not supported", "field", act.HeaderName, "milter", s.c.milterUrl)
+			msg.changeField(act.HeaderName, int(act.HeaderIndex), act.HeaderValue)
 		case milter.ActInsertHeader:
-			if act.HeaderIndex != 1 {
-				s.log.Msg("header inserting not on top is not supported, prepending instead", "field", act.HeaderName, "milter", s.c.milterUrl)
-			}
-			fallthrough
+			msg.insertField(int(act.HeaderIndex), act.HeaderName, act.HeaderValue)
 		case milter.ActAddHeader:
-			// Header field might be arbitarly folded by the caller and we want
-			// to preserve that exact format in case it is important (DKIM
-			// signature is added by milter).
-			field := make([]byte, 0, len(act.HeaderName)+2+len(act.HeaderValue)+2)
-			field = append(field, act.HeaderName...)
-			field = append(field, ':', ' ')
-			field = append(field, act.HeaderValue...)
-			field = append(field, '\r', '\n')
-			out.Header.AddRaw(field)
+			msg.addField(act.HeaderName, act.HeaderValue)
+		case milter.ActReplBody:
+			// Replacement body can be sent in multiple chunks.
+			newBody = append(newBody, act.Body...)
 		case milter.ActQuarantine:
-			out.Quarantine = true
-			out.Reason = exterrors.WithFields(errors.New("milter quarantine action"), map[string]interface{}{
+			msg.quarantine = true
+			msg.quarantineReason = exterrors.WithFields(errors.New("milter quarantine action"), map[string]interface{}{
 				"check":  "milter",
-				"milter": s.c.milterUrl,
+				"milter": ms.m.endpoint,
 				"reason": act.Reason,
 			})
 		}
 	}
-	return out
+	if newBody != nil {
+		msg.replaceBody(newBody)
+	}
+}
+
+func (s *state) connMacros() []string {
+	fields := make([]string, 0, 7*2)
+	fields = append(fields, "{daemon_name}", "maddy")
+	if s.c.hostname != "" {
+		fields = append(fields, "j", s.c.hostname)
+	}
+
+	switch lAddr := s.msgMeta.Conn.LocalAddr.(type) {
+	case *net.TCPAddr:
+		fields = append(fields, "{if_name}", "unknown", "{if_addr}", lAddr.IP.String())
+	default:
+		fields = append(fields, "{if_name}", "unknown", "{if_addr}", "0.0.0.0")
+	}
+
+	if rAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		clientAddr := rAddr.IP.String()
+		if v4 := rAddr.IP.To4(); v4 != nil {
+			clientAddr = v4.String()
+		}
+		clientName := "[" + clientAddr + "]"
+		if s.msgMeta.Conn.RDNSName != nil {
+			name, err := s.msgMeta.Conn.RDNSName.Get()
+			if err == nil && name != nil {
+				clientName = name.(string)
+			}
+		}
+		fields = append(fields,
+			"{client_addr}", clientAddr,
+			"{client_port}", strconv.Itoa(rAddr.Port),
+			"{client_name}", clientName,
+			"_", clientName+" ["+clientAddr+"]",
+		)
+	}
+
+	return fields
+}
+
+func (s *state) heloMacros() []string {
+	tlsState := s.msgMeta.Conn.TLS
+	if !tlsState.HandshakeComplete {
+		return nil
+	}
+
+	fields := make([]string, 0, 4*2)
+	switch tlsState.Version {
+	case tls.VersionTLS10:
+		fields = append(fields, "{tls_version}", "TLSv1")
+	case tls.VersionTLS11:
+		fields = append(fields, "{tls_version}", "TLSv1.1")
+	case tls.VersionTLS12:
+		fields = append(fields, "{tls_version}", "TLSv1.2")
+	case tls.VersionTLS13:
+		fields = append(fields, "{tls_version}", "TLSv1.3")
+	}
+	fields = append(fields, "{cipher}", tls.CipherSuiteName(tlsState.CipherSuite))
+
+	if len(tlsState.PeerCertificates) != 0 {
+		fields = append(fields, "{cert_subject}",
+			tlsState.PeerCertificates[len(tlsState.PeerCertificates)-1].Subject.String())
+		fields = append(fields, "{cert_issuer}",
+			tlsState.PeerCertificates[len(tlsState.PeerCertificates)-1].Issuer.String())
+	}
+	return fields
 }
 
 func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return s.forEach(func(ms *milterSession) module.CheckResult {
+		return s.checkConnection(ms)
+	})
+}
+
+func (s *state) checkConnection(ms *milterSession) module.CheckResult {
 	if s.msgMeta.Conn == nil {
 		// Submit some dummy values as the message is likely generated locally.
 
-		act, err := s.session.Conn("localhost", milter.FamilyInet, 25, "127.0.0.1")
+		act, err := ms.session.Conn("localhost", milter.FamilyInet, 25, "127.0.0.1")
 		if err != nil {
-			return s.ioError(err)
+			return s.ioError(ms, err)
 		}
 		if act.Code != milter.ActContinue {
-			return s.handleAction(act)
+			return s.handleAction(ms, act)
 		}
 
-		act, err = s.session.Helo("localhost")
+		act, err = ms.session.Helo("localhost")
 		if err != nil {
-			return s.ioError(err)
+			return s.ioError(ms, err)
 		}
-		return s.handleAction(act)
+		return s.handleAction(ms, act)
 	}
 
-	if !s.session.ProtocolOption(milter.OptNoConnect) {
-		if err := s.session.Macros(milter.CodeConn,
-			"daemon_name", "maddy",
-			"if_name", "unknown",
-			"if_addr", "0.0.0.0",
-			// TODO: $j
-			// TODO: $_
-		); err != nil {
-			return s.ioError(err)
+	if !ms.session.ProtocolOption(milter.OptNoConnect) {
+		if err := ms.session.Macros(milter.CodeConn, s.connMacros()...); err != nil {
+			return s.ioError(ms, err)
 		}
 
 		var (
@@ -277,57 +432,35 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 			protoFamily = milter.FamilyUnknown
 		}
 
-		act, err := s.session.Conn(s.msgMeta.Conn.Hostname, protoFamily, port, addr)
+		act, err := ms.session.Conn(s.msgMeta.Conn.Hostname, protoFamily, port, addr)
 		if err != nil {
-			return s.ioError(err)
+			return s.ioError(ms, err)
 		}
 		if act.Code != milter.ActContinue {
-			return s.handleAction(act)
+			return s.handleAction(ms, act)
 		}
 	}
 
-	if !s.session.ProtocolOption(milter.OptNoHelo) {
-		if s.msgMeta.Conn.TLS.HandshakeComplete {
-			fields := make([]string, 0, 4*2)
-			tlsState := s.msgMeta.Conn.TLS
-
-			switch tlsState.Version {
-			case tls.VersionTLS10:
-				fields = append(fields, "tls_version", "TLSv1")
-			case tls.VersionTLS11:
-				fields = append(fields, "tls_version", "TLSv1.1")
-			case tls.VersionTLS12:
-				fields = append(fields, "tls_version", "TLSv1.2")
-			case tls.VersionTLS13:
-				fields = append(fields, "tls_version", "TLSv1.3")
-			}
-			fields = append(fields, "cipher", tls.CipherSuiteName(tlsState.CipherSuite))
-
-			if len(tlsState.PeerCertificates) != 0 {
-				fields = append(fields, "cert_subject",
-					tlsState.PeerCertificates[len(tlsState.PeerCertificates)-1].Subject.String())
-				fields = append(fields, "cert_issuer",
-					tlsState.PeerCertificates[len(tlsState.PeerCertificates)-1].Issuer.String())
-			}
-
-			if err := s.session.Macros(milter.CodeHelo, fields...); err != nil {
-				return s.ioError(err)
+	if !ms.session.ProtocolOption(milter.OptNoHelo) {
+		if fields := s.heloMacros(); len(fields) != 0 {
+			if err := ms.session.Macros(milter.CodeHelo, fields...); err != nil {
+				return s.ioError(ms, err)
 			}
 		}
-		act, err := s.session.Helo(s.msgMeta.Conn.Hostname)
+		act, err := ms.session.Helo(s.msgMeta.Conn.Hostname)
 		if err != nil {
-			return s.ioError(err)
+			return s.ioError(ms, err)
 		}
-		return s.handleAction(act)
+		return s.handleAction(ms, act)
 	}
 
 	return module.CheckResult{}
 }
 
-func (s *state) ioError(err error) module.CheckResult {
-	if s.c.failOpen {
-		s.skipChecks = true // silently permit processing to continue
-		s.c.log.Error("I/O error", err)
+func (s *state) ioError(ms *milterSession, err error) module.CheckResult {
+	if ms.m.failOpen {
+		ms.skipChecks = true // silently permit processing to continue
+		s.log.Error("I/O error", err, "milter", ms.m.endpoint)
 		return module.CheckResult{}
 	}
 
@@ -340,25 +473,17 @@ func (s *state) ioError(err error) module.CheckResult {
 			Err:          err,
 			CheckName:    "milter",
 			Misc: map[string]interface{}{
-				"milter": s.c.milterUrl,
+				"milter": ms.m.endpoint,
 			},
 		},
 	}
 }
 
 func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
-	if s.skipChecks || s.session.ProtocolOption(milter.OptNoMailFrom) {
-		return module.CheckResult{}
-	}
-
-	fields := make([]string, 0, 2)
-	fields = append(fields, "i", s.msgMeta.ID)
-	// TODO: fields = append(fields, "auth_type", s.msgMeta.???)
-	if s.msgMeta.Conn.AuthUser != "" {
-		fields = append(fields, "auth_authen", s.msgMeta.Conn.AuthUser)
-	}
-	if err := s.session.Macros(milter.CodeMail, fields...); err != nil {
-		return s.ioError(err)
+	fields := make([]string, 0, 3*2)
+	fields = append(fields, "i", s.msgMeta.ID, "{mail_addr}", mailFrom)
+	if s.msgMeta.Conn != nil && s.msgMeta.Conn.AuthUser != "" {
+		fields = append(fields, "{auth_authen}", s.msgMeta.Conn.AuthUser)
 	}
 
 	esmtpArgs := make([]string, 0, 2)
@@ -366,45 +491,81 @@ func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckRe
 		esmtpArgs = append(esmtpArgs, "SMTPUTF8")
 	}
 
-	act, err := s.session.Mail(mailFrom, esmtpArgs)
-	if err != nil {
-		return s.ioError(err)
-	}
-	return s.handleAction(act)
+	return s.forEach(func(ms *milterSession) module.CheckResult {
+		if ms.session.ProtocolOption(milter.OptNoMailFrom) {
+			return module.CheckResult{}
+		}
+
+		if err := ms.session.Macros(milter.CodeMail, fields...); err != nil {
+			return s.ioError(ms, err)
+		}
+
+		act, err := ms.session.Mail(mailFrom, esmtpArgs)
+		if err != nil {
+			return s.ioError(ms, err)
+		}
+		return s.handleAction(ms, act)
+	})
 }
 
 func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
-	if s.skipChecks {
-		return module.CheckResult{}
-	}
+	return s.forEach(func(ms *milterSession) module.CheckResult {
+		if ms.session.ProtocolOption(milter.OptNoRcptTo) {
+			return module.CheckResult{}
+		}
 
-	act, err := s.session.Rcpt(rcptTo, nil)
-	if err != nil {
-		return s.ioError(err)
-	}
-	return s.handleAction(act)
+		if err := ms.session.Macros(milter.CodeRcpt, "{rcpt_addr}", rcptTo); err != nil {
+			return s.ioError(ms, err)
+		}
+
+		act, err := ms.session.Rcpt(rcptTo, nil)
+		if err != nil {
+			return s.ioError(ms, err)
+		}
+		return s.handleAction(ms, act)
+	})
 }
 
 func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
-	if s.skipChecks {
-		return module.CheckResult{}
+	// Each milter sees modifications done by the previous ones.
+	msg := newModifiedMsg(header, body)
+
+	res := s.forEach(func(ms *milterSession) module.CheckResult {
+		return s.checkBody(ms, msg)
+	})
+	if res.Reject {
+		return res
 	}
 
-	act, err := s.session.Header(header)
+	res.Quarantine = msg.quarantine
+	res.Reason = msg.quarantineReason
+	if msg.rewritten {
+		res.Rewrite = &module.MsgRewrite{
+			Header: msg.header,
+			Body:   msg.body,
+		}
+	} else {
+		res.Header = msg.added
+	}
+	return res
+}
+
+func (s *state) checkBody(ms *milterSession, msg *modifiedMsg) module.CheckResult {
+	act, err := ms.session.Header(msg.header)
 	if err != nil {
-		return s.ioError(err)
+		return s.ioError(ms, err)
 	}
 	if act.Code != milter.ActContinue {
-		return s.handleAction(act)
+		return s.handleAction(ms, act)
 	}
 
 	var modifyAct []milter.ModifyAction
 
-	if !s.session.ProtocolOption(milter.OptNoBody) {
+	if !ms.session.ProtocolOption(milter.OptNoBody) {
 		// body.Open can be expensive for on-disk buffering.
-		r, err := body.Open()
+		r, err := msg.body.Open()
 		if err != nil {
-			// Not ioError(err) because fail_open directive is applied only for external I/O.
+			// Not ioError(err) because failure policy is applied only for external I/O.
 			return module.CheckResult{
 				Reject: true,
 				Reason: &exterrors.SMTPError{
@@ -414,29 +575,40 @@ func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buf
 					Err:          err,
 					CheckName:    "milter",
 					Misc: map[string]interface{}{
-						"milter": s.c.milterUrl,
+						"milter": ms.m.endpoint,
 					},
 				},
 			}
 		}
+		defer r.Close()
 
-		modifyAct, act, err = s.session.BodyReadFrom(r)
+		modifyAct, act, err = ms.session.BodyReadFrom(r)
 		if err != nil {
-			return s.ioError(err)
+			return s.ioError(ms, err)
 		}
 	} else {
-		modifyAct, act, err = s.session.End()
+		modifyAct, act, err = ms.session.End()
 		if err != nil {
-			return s.ioError(err)
+			return s.ioError(ms, err)
 		}
 	}
 
-	result := s.handleAction(act)
-	return s.apply(modifyAct, result)
+	result := s.handleAction(ms, act)
+	if result.Reject {
+		return result
+	}
+	s.apply(ms, modifyAct, msg)
+	return result
 }
 
 func (s *state) Close() error {
-	return s.session.Close()
+	var lastErr error
+	for _, ms := range s.sessions {
+		if err := ms.session.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
 var (
@@ -0,0 +1,373 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package milter
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-milter"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// testMilter records the information it receives and modifies the message
+// using the body callback.
+type testMilter struct {
+	milter.NoOpMilter
+
+	mu      sync.Mutex
+	macros  map[string]string
+	headers textproto.MIMEHeader
+	body    string
+
+	onBody func(m *milter.Modifier) (milter.Response, error)
+}
+
+func (tm *testMilter) recordMacros(m *milter.Modifier) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for k, v := range m.Macros {
+		tm.macros[k] = v
+	}
+}
+
+func (tm *testMilter) Connect(host string, family string, port uint16, addr net.IP, m *milter.Modifier) (milter.Response, error) {
+	tm.recordMacros(m)
+	return milter.RespContinue, nil
+}
+
+func (tm *testMilter) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
+	tm.recordMacros(m)
+	return milter.RespContinue, nil
+}
+
+func (tm *testMilter) RcptTo(rcptTo string, m *milter.Modifier) (milter.Response, error) {
+	tm.recordMacros(m)
+	return milter.RespContinue, nil
+}
+
+func (tm *testMilter) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.headers = h
+	return milter.RespContinue, nil
+}
+
+func (tm *testMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.body += string(chunk)
+	return milter.RespContinue, nil
+}
+
+func (tm *testMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	if tm.onBody != nil {
+		return tm.onBody(m)
+	}
+	return milter.RespAccept, nil
+}
+
+func startMilter(t *testing.T, onBody func(m *milter.Modifier) (milter.Response, error)) (*testMilter, string) {
+	t.Helper()
+
+	tm := &testMilter{
+		macros: map[string]string{},
+		onBody: onBody,
+	}
+	srv := milter.Server{
+		NewMilter: func() milter.Milter {
+			return tm
+		},
+		Actions: milter.OptAddHeader | milter.OptChangeHeader | milter.OptChangeBody | milter.OptQuarantine,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { srv.Close() })
+
+	return tm, "tcp://" + l.Addr().String()
+}
+
+func initCheck(t *testing.T, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func runCheck(t *testing.T, c *Check, msg string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID: "testmsg",
+		Conn: &module.ConnState{
+			Hostname:   "client.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1234},
+			LocalAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25},
+			AuthUser:   "user",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	for _, res := range []module.CheckResult{
+		st.CheckConnection(context.Background()),
+		st.CheckSender(context.Background(), "sender@example.org"),
+		st.CheckRcpt(context.Background(), "rcpt@example.com"),
+	} {
+		if res.Reason != nil {
+			return res
+		}
+	}
+
+	hdr, body := testutils.BodyFromStr(t, msg)
+	return st.CheckBody(context.Background(), hdr, body)
+}
+
+const testMsg = "From: <sender@example.org>\r\n" +
+	"Subject: Hello\r\n" +
+	"X-Spam: old\r\n" +
+	"X-Spam: old2\r\n" +
+	"\r\n" +
+	"Hello!\r\n"
+
+func TestMilter_Macros(t *testing.T) {
+	tm, endp := startMilter(t, nil)
+	c := initCheck(t, []config.Node{
+		{Name: "hostname", Args: []string{"mx.example.org"}},
+		{Name: "endpoint", Args: []string{endp}},
+	})
+
+	res := runCheck(t, c, testMsg)
+	if res.Reason != nil {
+		t.Fatal("Unexpected error:", res.Reason)
+	}
+
+	for k, v := range map[string]string{
+		"j":             "mx.example.org",
+		"{client_addr}": "127.0.0.2",
+		"{client_port}": "1234",
+		"{if_addr}":     "127.0.0.1",
+		"i":             "testmsg",
+		"{mail_addr}":   "sender@example.org",
+		"{auth_authen}": "user",
+		"{rcpt_addr}":   "rcpt@example.com",
+		"{daemon_name}": "maddy",
+		"{client_name}": "[127.0.0.2]",
+	} {
+		if tm.macros[k] != v {
+			t.Errorf("Wrong value of macro %s: want %q, got %q", k, v, tm.macros[k])
+		}
+	}
+}
+
+func TestMilter_Chain(t *testing.T) {
+	_, endp1 := startMilter(t, func(m *milter.Modifier) (milter.Response, error) {
+		if err := m.AddHeader("X-First", "yes"); err != nil {
+			return nil, err
+		}
+		if err := m.ChangeHeader(1, "Subject", "[TAG] Hello"); err != nil {
+			return nil, err
+		}
+		if err := m.ChangeHeader(2, "X-Spam", ""); err != nil {
+			return nil, err
+		}
+		return milter.RespAccept, nil
+	})
+	tm2, endp2 := startMilter(t, func(m *milter.Modifier) (milter.Response, error) {
+		if err := m.ReplaceBody([]byte("Replaced\r\n")); err != nil {
+			return nil, err
+		}
+		return milter.RespAccept, nil
+	})
+	c := initCheck(t, []config.Node{
+		{Name: "milter", Args: []string{endp1}},
+		{Name: "milter", Args: []string{endp2}},
+	})
+
+	res := runCheck(t, c, testMsg)
+	if res.Reason != nil {
+		t.Fatal("Unexpected error:", res.Reason)
+	}
+
+	// Second milter should see changes done by the first one.
+	if got := tm2.headers.Get("Subject"); got != "[TAG] Hello" {
+		t.Errorf("Second milter got wrong Subject: %q", got)
+	}
+	if got := tm2.headers.Get("X-First"); got != "yes" {
+		t.Errorf("Second milter got wrong X-First: %q", got)
+	}
+	if got := tm2.body; got != "Hello!\r\n" {
+		t.Errorf("Second milter got wrong body: %q", got)
+	}
+
+	if res.Rewrite == nil {
+		t.Fatal("Message is not rewritten")
+	}
+	if got := res.Rewrite.Header.Get("Subject"); got != "[TAG] Hello" {
+		t.Errorf("Wrong Subject: %q", got)
+	}
+	if got := res.Rewrite.Header.Values("X-Spam"); len(got) != 1 || got[0] != "old" {
+		t.Errorf("Wrong X-Spam: %v", got)
+	}
+	if got := res.Rewrite.Header.Get("X-First"); got != "yes" {
+		t.Errorf("Wrong X-First: %q", got)
+	}
+	r, err := res.Rewrite.Body.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Replaced\r\n" {
+		t.Errorf("Wrong body: %q", body)
+	}
+}
+
+func TestMilter_AddHeaderOnly(t *testing.T) {
+	_, endp := startMilter(t, func(m *milter.Modifier) (milter.Response, error) {
+		if err := m.AddHeader("X-Added", "yes"); err != nil {
+			return nil, err
+		}
+		return milter.RespAccept, nil
+	})
+	c := initCheck(t, []config.Node{
+		{Name: "milter", Args: []string{endp}},
+	})
+
+	res := runCheck(t, c, testMsg)
+	if res.Reason != nil {
+		t.Fatal("Unexpected error:", res.Reason)
+	}
+	if res.Rewrite != nil {
+		t.Error("Message should not be rewritten")
+	}
+	if got := res.Header.Get("X-Added"); got != "yes" {
+		t.Errorf("Wrong X-Added: %q", got)
+	}
+}
+
+func TestMilter_RejectStopsChain(t *testing.T) {
+	_, endp1 := startMilter(t, func(m *milter.Modifier) (milter.Response, error) {
+		return milter.RespReject, nil
+	})
+	tm2, endp2 := startMilter(t, nil)
+	c := initCheck(t, []config.Node{
+		{Name: "milter", Args: []string{endp1}},
+		{Name: "milter", Args: []string{endp2}},
+	})
+
+	res := runCheck(t, c, testMsg)
+	if !res.Reject {
+		t.Fatal("Message is not rejected")
+	}
+	if tm2.headers != nil {
+		t.Error("Second milter received the message")
+	}
+}
+
+func TestMilter_FailurePolicy(t *testing.T) {
+	// Get an address nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadEndp := "tcp://" + l.Addr().String()
+	l.Close()
+
+	t.Run("accept", func(t *testing.T) {
+		_, endp := startMilter(t, func(m *milter.Modifier) (milter.Response, error) {
+			if err := m.AddHeader("X-Added", "yes"); err != nil {
+				return nil, err
+			}
+			return milter.RespAccept, nil
+		})
+		c := initCheck(t, []config.Node{
+			{Name: "milter", Args: []string{deadEndp}, Children: []config.Node{
+				{Name: "on_failure", Args: []string{"accept"}},
+			}},
+			{Name: "milter", Args: []string{endp}},
+		})
+
+		res := runCheck(t, c, testMsg)
+		if res.Reason != nil {
+			t.Fatal("Unexpected error:", res.Reason)
+		}
+		if got := res.Header.Get("X-Added"); got != "yes" {
+			t.Errorf("Wrong X-Added: %q", got)
+		}
+	})
+	t.Run("tempfail", func(t *testing.T) {
+		c := initCheck(t, []config.Node{
+			{Name: "milter", Args: []string{deadEndp}},
+		})
+		_, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "testmsg"})
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+	t.Run("fail_open default", func(t *testing.T) {
+		c := initCheck(t, []config.Node{
+			{Name: "fail_open", Args: []string{"yes"}},
+			{Name: "milter", Args: []string{deadEndp}},
+		})
+		res := runCheck(t, c, testMsg)
+		if res.Reason != nil {
+			t.Fatal("Unexpected error:", res.Reason)
+		}
+	})
+}
+
+func TestModifiedMsg_InsertField(t *testing.T) {
+	hdr, body := testutils.BodyFromStr(t, testMsg)
+	msg := newModifiedMsg(hdr, body)
+	msg.insertField(1, "X-Inserted", "yes")
+	if !msg.rewritten {
+		t.Error("Message is not marked as rewritten")
+	}
+
+	var keys []string
+	for f := msg.header.Fields(); f.Next(); {
+		keys = append(keys, f.Key())
+	}
+	if got := strings.Join(keys, " "); got != "From X-Inserted Subject X-Spam X-Spam" {
+		t.Errorf("Wrong fields order: %s", got)
+	}
+}
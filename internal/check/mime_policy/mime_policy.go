@@ -0,0 +1,348 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mime_policy implements the check.mime_policy module that
+// rejects messages with banned attachments or malformed MIME structure.
+package mime_policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.mime_policy"
+
+var (
+	defaultBannedExts = []string{
+		// Executables and scripts.
+		"exe", "com", "scr", "pif", "bat", "cmd", "cpl", "msi", "msp",
+		"js", "jse", "vbs", "vbe", "wsf", "wsh", "hta", "ps1", "jar", "lnk",
+		// Macro-enabled Office documents.
+		"docm", "dotm", "xlsm", "xltm", "xlam", "pptm", "potm", "ppam", "ppsm", "sldm",
+	}
+	defaultBannedTypes = []string{
+		"application/x-msdownload",
+		"application/x-dosexec",
+		"application/x-msdos-program",
+		"application/x-ms-installer",
+		"application/hta",
+		"application/javascript",
+		"application/x-javascript",
+		"application/vnd.ms-word.document.macroenabled.12",
+		"application/vnd.ms-word.template.macroenabled.12",
+		"application/vnd.ms-excel.sheet.macroenabled.12",
+		"application/vnd.ms-excel.template.macroenabled.12",
+		"application/vnd.ms-excel.addin.macroenabled.12",
+		"application/vnd.ms-powerpoint.presentation.macroenabled.12",
+		"application/vnd.ms-powerpoint.template.macroenabled.12",
+		"application/vnd.ms-powerpoint.addin.macroenabled.12",
+		"application/vnd.ms-powerpoint.slideshow.macroenabled.12",
+	}
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	bannedExts      map[string]struct{}
+	bannedTypes     map[string]struct{}
+	maxDepth        int
+	maxParts        int
+	bannedAction    modconfig.FailAction
+	malformedAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var bannedExts, bannedTypes []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("banned_extensions", false, false, defaultBannedExts, &bannedExts)
+	cfg.StringList("banned_types", false, false, defaultBannedTypes, &bannedTypes)
+	cfg.Int("max_depth", false, false, 10, &c.maxDepth)
+	cfg.Int("max_parts", false, false, 500, &c.maxParts)
+	cfg.Custom("banned_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.bannedAction)
+	cfg.Custom("malformed_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.malformedAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.bannedExts = make(map[string]struct{}, len(bannedExts))
+	for _, ext := range bannedExts {
+		c.bannedExts[strings.ToLower(strings.TrimPrefix(ext, "."))] = struct{}{}
+	}
+	c.bannedTypes = make(map[string]struct{}, len(bannedTypes))
+	for _, typ := range bannedTypes {
+		c.bannedTypes[strings.ToLower(typ)] = struct{}{}
+	}
+
+	return nil
+}
+
+// violation describes the reason the message is not acceptable per the
+// configured policy.
+type violation struct {
+	banned bool
+	reason string
+	misc   map[string]interface{}
+}
+
+func (v *violation) Error() string {
+	return v.reason
+}
+
+func malformed(reason string, err error) *violation {
+	v := &violation{reason: reason, misc: map[string]interface{}{}}
+	if err != nil {
+		v.misc["error"] = err.Error()
+	}
+	return v
+}
+
+type walker struct {
+	c     *Check
+	parts int
+}
+
+func (c *Check) isBannedType(mediaType string) bool {
+	if _, ok := c.bannedTypes[mediaType]; ok {
+		return true
+	}
+	if i := strings.IndexByte(mediaType, '/'); i != -1 {
+		_, ok := c.bannedTypes[mediaType[:i]+"/*"]
+		return ok
+	}
+	return false
+}
+
+func (c *Check) isBannedName(filename string) bool {
+	ext := strings.TrimPrefix(path.Ext(strings.TrimRight(strings.ToLower(filename), ". ")), ".")
+	if ext == "" {
+		return false
+	}
+	_, ok := c.bannedExts[ext]
+	return ok
+}
+
+func partFilename(hdr message.Header) string {
+	if _, params, err := hdr.ContentDisposition(); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := hdr.ContentType(); err == nil {
+		return params["name"]
+	}
+	return ""
+}
+
+// walk checks the entity and all its children.
+//
+// It returns *violation if the message is not acceptable and other
+// errors if the message cannot be read.
+func (w *walker) walk(ent *message.Entity, depth int) error {
+	w.parts++
+	if w.c.maxParts != 0 && w.parts > w.c.maxParts {
+		return malformed("Too many MIME parts", nil)
+	}
+	if w.c.maxDepth != 0 && depth > w.c.maxDepth {
+		return malformed("MIME nesting is too deep", nil)
+	}
+
+	mediaType, params, err := ent.Header.ContentType()
+	if err != nil {
+		return malformed("Malformed Content-Type", err)
+	}
+	mediaType = strings.ToLower(mediaType)
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] == "" {
+		return malformed("Missing multipart boundary", nil)
+	}
+
+	if mr := ent.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+				return malformed("Malformed multipart structure", err)
+			}
+			if err := w.walk(part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := partFilename(ent.Header)
+	if w.c.isBannedType(mediaType) || (filename != "" && w.c.isBannedName(filename)) {
+		return &violation{
+			banned: true,
+			reason: "Message contains a prohibited attachment",
+			misc: map[string]interface{}{
+				"content_type": mediaType,
+				"filename":     filename,
+			},
+		}
+	}
+
+	if mediaType == "message/rfc822" || mediaType == "message/global" {
+		inner, err := message.Read(ent.Body)
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return malformed("Malformed encapsulated message", err)
+		}
+		return w.walk(inner, depth+1)
+	}
+
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	r, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{
+					"check":    modName,
+					"smtp_msg": "Internal I/O error",
+				}),
+				true,
+			),
+		}
+	}
+	defer r.Close()
+
+	w := walker{c: s.c}
+	ent, err := message.New(message.Header{Header: hdr}, r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		err = malformed("Malformed message header", err)
+	} else {
+		err = w.walk(ent, 0)
+	}
+	if err == nil {
+		return module.CheckResult{}
+	}
+
+	var v *violation
+	if !errors.As(err, &v) {
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		}
+	}
+
+	s.log.DebugMsg("policy violation", "reason", v.reason, "details", v.misc)
+
+	if v.banned {
+		return s.c.bannedAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      v.reason,
+				CheckName:    modName,
+				Misc:         v.misc,
+			},
+		})
+	}
+	return s.c.malformedAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      v.reason,
+			CheckName:    modName,
+			Misc:         v.misc,
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,197 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mime_policy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func multipart(boundary string, parts ...string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString("--" + boundary + "\r\n" + part + "\r\n")
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.String()
+}
+
+func testMsg(body string) string {
+	return "From: <sender@example.org>\r\n" +
+		"To: <rcpt@example.com>\r\n" +
+		"Subject: Test\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		body
+}
+
+func initCheck(t *testing.T, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testCheck(t *testing.T, c *Check, msg string, code int) {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr, body := testutils.BodyFromStr(t, msg)
+	res := st.CheckBody(context.Background(), hdr, body)
+	if code == 0 {
+		if res.Reject || res.Quarantine {
+			t.Fatalf("unexpected result: %+v", res)
+		}
+		return
+	}
+	if !res.Reject {
+		t.Fatalf("expected reject, got %+v", res)
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) {
+		t.Fatalf("expected SMTPError, got %v", res.Reason)
+	}
+	if smtpErr.Code != 550 || smtpErr.EnhancedCode[1] != code {
+		t.Fatalf("wrong error: %v %v %v", smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := initCheck(t, nil)
+
+	text := "Content-Type: text/plain\r\n\r\nHello!"
+
+	t.Run("plain", func(t *testing.T) {
+		testCheck(t, c, "From: <sender@example.org>\r\n\r\nHello!", 0)
+	})
+	t.Run("allowed attachment", func(t *testing.T) {
+		testCheck(t, c, testMsg(multipart("outer", text,
+			"Content-Type: application/pdf\r\n"+
+				"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n"+
+				"Content-Transfer-Encoding: base64\r\n\r\nAAAA")), 0)
+	})
+	t.Run("banned extension", func(t *testing.T) {
+		testCheck(t, c, testMsg(multipart("outer", text,
+			"Content-Type: application/octet-stream\r\n"+
+				"Content-Disposition: attachment; filename=\"invoice.pdf.EXE\"\r\n\r\nAAAA")), 7)
+	})
+	t.Run("banned extension in name", func(t *testing.T) {
+		testCheck(t, c, testMsg(multipart("outer", text,
+			"Content-Type: application/octet-stream; name=\"report.xlsm\"\r\n\r\nAAAA")), 7)
+	})
+	t.Run("banned type", func(t *testing.T) {
+		testCheck(t, c, testMsg(multipart("outer", text,
+			"Content-Type: application/x-msdownload\r\n\r\nAAAA")), 7)
+	})
+	t.Run("nested message", func(t *testing.T) {
+		testCheck(t, c, testMsg(multipart("outer", text,
+			"Content-Type: message/rfc822\r\n\r\n"+
+				"Content-Type: multipart/mixed; boundary=\"inner\"\r\n\r\n"+
+				multipart("inner", text,
+					"Content-Type: application/octet-stream\r\n"+
+						"Content-Disposition: attachment; filename=\"run.js\"\r\n\r\nAAAA"))), 7)
+	})
+	t.Run("missing boundary", func(t *testing.T) {
+		testCheck(t, c, "Content-Type: multipart/mixed\r\n\r\nHello!", 6)
+	})
+	t.Run("unterminated multipart", func(t *testing.T) {
+		testCheck(t, c, testMsg("--outer\r\n"+text+"\r\n"), 6)
+	})
+	t.Run("malformed content-type", func(t *testing.T) {
+		testCheck(t, c, testMsg(multipart("outer", "Content-Type: text/plain; =\r\n\r\nHello!")), 6)
+	})
+}
+
+func TestCheck_Nesting(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "max_depth", Args: []string{"2"}},
+	})
+
+	nested := func(depth int) string {
+		body := "Content-Type: text/plain\r\n\r\nHello!"
+		for i := 0; i < depth; i++ {
+			boundary := "b" + strings.Repeat("x", i)
+			body = "Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" +
+				multipart(boundary, body)
+		}
+		return "From: <sender@example.org>\r\n" + body
+	}
+
+	testCheck(t, c, nested(2), 0)
+	testCheck(t, c, nested(3), 6)
+}
+
+func TestCheck_MaxParts(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "max_parts", Args: []string{"3"}},
+	})
+
+	text := "Content-Type: text/plain\r\n\r\nHello!"
+	testCheck(t, c, testMsg(multipart("outer", text, text)), 0)
+	testCheck(t, c, testMsg(multipart("outer", text, text, text)), 6)
+}
+
+func TestCheck_Config(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "banned_extensions", Args: []string{".pdf"}},
+		{Name: "banned_types", Args: []string{"image/*"}},
+		{Name: "banned_action", Args: []string{"quarantine"}},
+	})
+
+	text := "Content-Type: text/plain\r\n\r\nHello!"
+	testCheck(t, c, testMsg(multipart("outer", text,
+		"Content-Type: application/octet-stream\r\n"+
+			"Content-Disposition: attachment; filename=\"run.exe\"\r\n\r\nAAAA")), 0)
+
+	for _, part := range []string{
+		"Content-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"a.pdf\"\r\n\r\nAAAA",
+		"Content-Type: image/png\r\n\r\nAAAA",
+	} {
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, body := testutils.BodyFromStr(t, testMsg(multipart("outer", text, part)))
+		res := st.CheckBody(context.Background(), hdr, body)
+		if res.Reject || !res.Quarantine {
+			t.Fatalf("expected quarantine, got %+v", res)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package quota implements the check.quota module that rejects recipients
+// whose mailboxes are over the storage quota.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.quota"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	storage    module.QuotaStorage
+	failAction modconfig.FailAction
+	errAction  modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var storage module.Storage
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &storage)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	quotaStorage, ok := storage.(module.QuotaStorage)
+	if !ok {
+		return fmt.Errorf("%s: storage module does not support quotas", modName)
+	}
+	c.storage = quotaStorage
+
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckRcpt").End()
+
+	used, limit, err := s.c.storage.QuotaUsage(ctx, rcptTo)
+	if err != nil {
+		if !exterrors.IsTemporaryOrUnspec(err) {
+			// Most likely the account does not exist, let the storage
+			// reject it on delivery.
+			s.log.DebugMsg("cannot get quota usage, ignoring", "rcpt", rcptTo, "reason", err.Error())
+			return module.CheckResult{}
+		}
+		return s.c.errAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+				Message:      "Unable to check the mailbox quota",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+	if limit == 0 {
+		return module.CheckResult{}
+	}
+
+	// Size is known only if the client used the SIZE extension, otherwise
+	// it is zero and only already full mailboxes are rejected.
+	size := s.msgMeta.SMTPOpts.Size
+	s.log.DebugMsg("quota usage", "rcpt", rcptTo, "used", used, "limit", limit, "size", size)
+	if used < limit && used+size <= limit {
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         452,
+			EnhancedCode: exterrors.EnhancedCode{4, 2, 2},
+			Message:      "Mailbox is full",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"rcpt":  rcptTo,
+				"used":  used,
+				"limit": limit,
+				"size":  size,
+			},
+		},
+	})
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type usage struct {
+	used, limit int64
+}
+
+type mockStorage struct {
+	usage map[string]usage
+	err   error
+}
+
+func (s mockStorage) QuotaUsage(_ context.Context, rcptTo string) (int64, int64, error) {
+	if s.err != nil {
+		return 0, 0, s.err
+	}
+	u, ok := s.usage[rcptTo]
+	if !ok {
+		return 0, 0, &exterrors.SMTPError{
+			Code:         501,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "User does not exist",
+		}
+	}
+	return u.used, u.limit, nil
+}
+
+func testCheck(t *testing.T, storage mockStorage, size int64, rcpt string, fail bool) {
+	t.Helper()
+
+	c := &Check{
+		instName:   "test",
+		log:        testutils.Logger(t, modName),
+		storage:    storage,
+		failAction: modconfig.FailAction{Reject: true},
+	}
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:       "test",
+		SMTPOpts: smtp.MailOptions{Size: size},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	res := st.CheckRcpt(context.Background(), rcpt)
+	if res.Reject != fail {
+		t.Errorf("%s (size %d): expected reject=%v, got %v (%v)", rcpt, size, fail, res.Reject, res.Reason)
+	}
+	if fail {
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != 452 {
+			t.Errorf("%s (size %d): wrong error: %v", rcpt, size, res.Reason)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	storage := mockStorage{usage: map[string]usage{
+		"empty@example.org":     {used: 0, limit: 1000},
+		"half@example.org":      {used: 500, limit: 1000},
+		"full@example.org":      {used: 1000, limit: 1000},
+		"overfull@example.org":  {used: 1500, limit: 1000},
+		"unlimited@example.org": {used: 1500, limit: 0},
+	}}
+
+	testCheck(t, storage, 0, "empty@example.org", false)
+	testCheck(t, storage, 0, "half@example.org", false)
+	testCheck(t, storage, 500, "half@example.org", false)
+	testCheck(t, storage, 501, "half@example.org", true)
+	testCheck(t, storage, 0, "full@example.org", true)
+	testCheck(t, storage, 0, "overfull@example.org", true)
+	testCheck(t, storage, 0, "unlimited@example.org", false)
+	testCheck(t, storage, 2000, "unlimited@example.org", false)
+	testCheck(t, storage, 0, "nonexistent@example.org", false)
+}
+
+func TestCheck_Error(t *testing.T) {
+	c := &Check{
+		instName:   "test",
+		log:        testutils.Logger(t, modName),
+		storage:    mockStorage{err: errors.New("database is down")},
+		failAction: modconfig.FailAction{Reject: true},
+	}
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	res := st.CheckRcpt(context.Background(), "half@example.org")
+	if res.Reject {
+		t.Fatalf("errors should be ignored by default, got %v", res.Reason)
+	}
+
+	c.errAction = modconfig.FailAction{Reject: true}
+	res = st.CheckRcpt(context.Background(), "half@example.org")
+	if !res.Reject {
+		t.Fatal("expected reject")
+	}
+	if !exterrors.IsTemporary(res.Reason) {
+		t.Fatalf("expected temporary error, got %v", res.Reason)
+	}
+}
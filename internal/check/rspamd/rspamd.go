@@ -29,6 +29,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -53,6 +54,15 @@ type Check struct {
 	tag        string
 	mtaName    string
 
+	milterHeaders  bool
+	rewriteSubject bool
+	timeout        time.Duration
+
+	controllerPath     string
+	controllerPassword string
+	fuzzyFlag          int
+	fuzzyWeight        int
+
 	ioErrAction       modconfig.FailAction
 	errorRespAction   modconfig.FailAction
 	addHdrAction      modconfig.FailAction
@@ -118,6 +128,13 @@ func (c *Check) Init(cfg *config.Map) error {
 			return modconfig.FailAction{Quarantine: true}, nil
 		}, modconfig.FailActionDirective, &c.rewriteSubjAction)
 	cfg.StringList("flags", false, false, []string{"pass_all"}, &flags)
+	cfg.Bool("milter_headers", false, false, &c.milterHeaders)
+	cfg.Bool("rewrite_subject", false, false, &c.rewriteSubject)
+	cfg.Duration("timeout", false, false, 1*time.Minute, &c.timeout)
+	cfg.String("controller_path", false, false, "http://127.0.0.1:11334", &c.controllerPath)
+	cfg.String("controller_password", false, false, "", &c.controllerPassword)
+	cfg.Int("fuzzy_flag", false, false, 0, &c.fuzzyFlag)
+	cfg.Int("fuzzy_weight", false, false, 1, &c.fuzzyWeight)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -126,6 +143,7 @@ func (c *Check) Init(cfg *config.Map) error {
 		Transport: &http.Transport{
 			TLSClientConfig: &tlsConfig,
 		},
+		Timeout: c.timeout,
 	}
 	c.flags = strings.Join(flags, ",")
 
@@ -168,6 +186,10 @@ func addConnHeaders(r *http.Request, meta *module.MsgMetadata, mailFrom string,
 	for _, rcpt := range rcpts {
 		r.Header.Add("Rcpt", rcpt)
 	}
+	// Allows rspamd to use per-user settings and statistics.
+	if len(rcpts) == 1 {
+		r.Header.Add("Deliver-To", rcpts[0])
+	}
 
 	r.Header.Add("Queue-ID", meta.ID)
 
@@ -281,6 +303,15 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 		})
 	}
 
+	res := s.actionResult(respData)
+	res.Score = respData.Score
+	if !res.Reject {
+		s.applyMilter(&res, respData, hdr, body)
+	}
+	return res
+}
+
+func (s *state) actionResult(respData response) module.CheckResult {
 	switch respData.Action {
 	case "no action":
 		return module.CheckResult{}
@@ -348,6 +379,98 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 	return module.CheckResult{}
 }
 
+// applyMilter applies header modifications requested by rspamd
+// (milter_headers module and subject rewriting) to the check result.
+func (s *state) applyMilter(res *module.CheckResult, respData response, hdr textproto.Header, body buffer.Buffer) {
+	if s.c.milterHeaders {
+		for name, values := range respData.Milter.AddHeaders {
+			for _, val := range values {
+				res.Header.Add(name, val)
+			}
+		}
+	}
+
+	removeHeaders := s.c.milterHeaders && len(respData.Milter.RemoveHeaders) != 0
+	rewriteSubject := s.c.rewriteSubject && respData.Action == "rewrite subject" && respData.Subject != ""
+	if !removeHeaders && !rewriteSubject {
+		return
+	}
+
+	newHdr := hdr.Copy()
+	if removeHeaders {
+		for name, idx := range respData.Milter.RemoveHeaders {
+			removeHeader(&newHdr, name, idx)
+		}
+	}
+	if rewriteSubject {
+		newHdr.Set("Subject", respData.Subject)
+	}
+	res.Rewrite = &module.MsgRewrite{
+		Header: newHdr,
+		Body:   body,
+	}
+}
+
+// removeHeader removes the header field as requested by rspamd.
+//
+// idx = 0 means all fields with the name, positive values specify the
+// field index starting from 1, negative values - from the end.
+func removeHeader(hdr *textproto.Header, name string, idx int) {
+	if idx == 0 {
+		hdr.Del(name)
+		return
+	}
+
+	count := len(hdr.Values(name))
+	if idx < 0 {
+		idx = count + idx + 1
+	}
+	if idx <= 0 || idx > count {
+		return
+	}
+
+	fields := hdr.FieldsByKey(name)
+	for i := 1; fields.Next(); i++ {
+		if i == idx {
+			fields.Del()
+			return
+		}
+	}
+}
+
+// milterValues is the list of values for the header field in add_headers
+// object.
+//
+// Rspamd uses either a string, an object with the "value" field or an array
+// of such objects.
+type milterValues []string
+
+func (mv *milterValues) UnmarshalJSON(b []byte) error {
+	type valueObj struct {
+		Value string `json:"value"`
+	}
+
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*mv = milterValues{str}
+		return nil
+	}
+	var obj valueObj
+	if err := json.Unmarshal(b, &obj); err == nil {
+		*mv = milterValues{obj.Value}
+		return nil
+	}
+	var objs []valueObj
+	if err := json.Unmarshal(b, &objs); err != nil {
+		return err
+	}
+	*mv = make(milterValues, 0, len(objs))
+	for _, obj := range objs {
+		*mv = append(*mv, obj.Value)
+	}
+	return nil
+}
+
 type response struct {
 	Score   float64 `json:"score"`
 	Action  string  `json:"action"`
@@ -356,6 +479,80 @@ type response struct {
 		Name  string  `json:"name"`
 		Score float64 `json:"score"`
 	}
+	Milter struct {
+		AddHeaders    map[string]milterValues `json:"add_headers"`
+		RemoveHeaders map[string]int          `json:"remove_headers"`
+	} `json:"milter"`
+}
+
+// LearnMessage implements module.SpamLearner using the rspamd controller.
+//
+// The message is used to train Bayes classifier and, if fuzzy_flag is set,
+// is added to (or removed from) fuzzy storage.
+func (c *Check) LearnMessage(ctx context.Context, username string, spam bool, msg io.Reader) error {
+	blob, err := io.ReadAll(msg)
+	if err != nil {
+		return fmt.Errorf("%s: learn: %w", modName, err)
+	}
+
+	path := "/learnham"
+	if spam {
+		path = "/learnspam"
+	}
+	if err := c.controllerRequest(ctx, path, username, nil, blob); err != nil {
+		return err
+	}
+
+	if c.fuzzyFlag == 0 {
+		return nil
+	}
+	fuzzyHdr := http.Header{}
+	fuzzyHdr.Set("Flag", strconv.Itoa(c.fuzzyFlag))
+	path = "/fuzzydel"
+	if spam {
+		path = "/fuzzyadd"
+		fuzzyHdr.Set("Weight", strconv.Itoa(c.fuzzyWeight))
+	}
+	return c.controllerRequest(ctx, path, username, fuzzyHdr, blob)
+}
+
+func (c *Check) controllerRequest(ctx context.Context, path, username string, hdr http.Header, blob []byte) error {
+	r, err := http.NewRequestWithContext(ctx, "POST", c.controllerPath+path, bytes.NewReader(blob))
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	for k, v := range hdr {
+		r.Header[k] = v
+	}
+	r.Header.Add("User-Agent", "maddy")
+	if c.controllerPassword != "" {
+		r.Header.Add("Password", c.controllerPassword)
+	}
+	if username != "" {
+		r.Header.Add("Deliver-To", username)
+	}
+
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("%s: learn: %w", modName, err)
+	}
+	defer resp.Body.Close()
+
+	// Message was already learned with the same class.
+	if resp.StatusCode == http.StatusAlreadyReported {
+		return nil
+	}
+	if resp.StatusCode/100 != 2 {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("%s: learn: %s: HTTP %d", modName, path, resp.StatusCode)
+		}
+		return fmt.Errorf("%s: learn: %s: HTTP %d: %s", modName, path, resp.StatusCode, errResp.Error)
+	}
+
+	return nil
 }
 
 func (s *state) Close() error {
@@ -0,0 +1,301 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rspamd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testMsg = "From: <foxcpp@example.org>\r\n" +
+	"To: <test@example.org>\r\n" +
+	"Subject: Test\r\n" +
+	"X-Spam: old\r\n" +
+	"X-Spam: older\r\n" +
+	"\r\n" +
+	"Hello!\r\n"
+
+// fakeRspamd records the last request and replies with the configured
+// response.
+type fakeRspamd struct {
+	srv *httptest.Server
+
+	lock    sync.Mutex
+	resp    interface{}
+	status  int
+	lastReq *http.Request
+	lastMsg string
+}
+
+func newFakeRspamd(t *testing.T, resp interface{}) *fakeRspamd {
+	t.Helper()
+	f := &fakeRspamd{resp: resp, status: http.StatusOK}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := io.ReadAll(r.Body)
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.lastReq = r
+		f.lastMsg = string(msg)
+
+		w.WriteHeader(f.status)
+		if err := json.NewEncoder(w).Encode(f.resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func testCheck(t *testing.T, f *fakeRspamd, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, []string{f.srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := mod.(*Check)
+	check.log = testutils.Logger(t, modName)
+	cfg = append(cfg, config.Node{Name: "controller_path", Args: []string{f.srv.URL}})
+	if err := check.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return check
+}
+
+func runCheck(t *testing.T, check *Check, rcpts ...string) module.CheckResult {
+	t.Helper()
+	rdnsFut := future.New()
+	rdnsFut.Set(nil, nil)
+	s, err := check.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID: t.Name(),
+		Conn: &module.ConnState{
+			AuthUser: "foxcpp@example.org",
+			RDNSName: rdnsFut,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.CheckSender(context.Background(), "foxcpp@example.org")
+	for _, rcpt := range rcpts {
+		s.CheckRcpt(context.Background(), rcpt)
+	}
+	hdr, buf := testutils.BodyFromStr(t, testMsg)
+	return s.CheckBody(context.Background(), hdr, buf)
+}
+
+func TestCheck_PerUser(t *testing.T) {
+	f := newFakeRspamd(t, map[string]interface{}{"action": "no action"})
+	check := testCheck(t, f, nil)
+
+	runCheck(t, check, "test@example.org")
+	if got := f.lastReq.Header.Get("User"); got != "foxcpp@example.org" {
+		t.Error("Wrong User:", got)
+	}
+	if got := f.lastReq.Header.Get("Deliver-To"); got != "test@example.org" {
+		t.Error("Wrong Deliver-To:", got)
+	}
+
+	runCheck(t, check, "test@example.org", "test2@example.org")
+	if got := f.lastReq.Header.Values("Deliver-To"); len(got) != 0 {
+		t.Error("Deliver-To is sent for multiple recipients:", got)
+	}
+}
+
+func TestCheck_MilterHeaders(t *testing.T) {
+	resp := map[string]interface{}{
+		"action": "no action",
+		"milter": map[string]interface{}{
+			"add_headers": map[string]interface{}{
+				"X-Spamd-Bar": "+",
+				"X-Spamd-Result": map[string]interface{}{
+					"value": "default: False [1.00 / 15.00]",
+					"order": 0,
+				},
+				"X-Rspamd-Server": []interface{}{
+					map[string]interface{}{"value": "mx1", "order": 0},
+				},
+			},
+			"remove_headers": map[string]interface{}{
+				"X-Spam": 1,
+			},
+		},
+	}
+	f := newFakeRspamd(t, resp)
+
+	t.Run("enabled", func(t *testing.T) {
+		res := runCheck(t, testCheck(t, f, []config.Node{
+			{Name: "milter_headers", Args: []string{"yes"}},
+		}), "test@example.org")
+		if res.Reject || res.Quarantine {
+			t.Fatal("Unexpected check failure:", res.Reason)
+		}
+		if got := res.Header.Get("X-Spamd-Bar"); got != "+" {
+			t.Error("Wrong X-Spamd-Bar:", got)
+		}
+		if got := res.Header.Get("X-Spamd-Result"); got != "default: False [1.00 / 15.00]" {
+			t.Error("Wrong X-Spamd-Result:", got)
+		}
+		if got := res.Header.Get("X-Rspamd-Server"); got != "mx1" {
+			t.Error("Wrong X-Rspamd-Server:", got)
+		}
+		if res.Rewrite == nil {
+			t.Fatal("No rewrite")
+		}
+		if got := res.Rewrite.Header.Values("X-Spam"); len(got) != 1 || got[0] != "older" {
+			t.Error("Wrong X-Spam after removal:", got)
+		}
+	})
+	t.Run("disabled by default", func(t *testing.T) {
+		res := runCheck(t, testCheck(t, f, nil), "test@example.org")
+		if res.Header.Len() != 0 {
+			t.Error("Header is added")
+		}
+		if res.Rewrite != nil {
+			t.Error("Message is rewritten")
+		}
+	})
+}
+
+func TestCheck_RewriteSubject(t *testing.T) {
+	f := newFakeRspamd(t, map[string]interface{}{
+		"action":  "rewrite subject",
+		"score":   7.5,
+		"subject": "[SPAM] Test",
+	})
+
+	res := runCheck(t, testCheck(t, f, []config.Node{
+		{Name: "rewrite_subject", Args: []string{"yes"}},
+	}), "test@example.org")
+	if !res.Quarantine {
+		t.Error("Message is not quarantined")
+	}
+	if res.Rewrite == nil {
+		t.Fatal("No rewrite")
+	}
+	if got := res.Rewrite.Header.Get("Subject"); got != "[SPAM] Test" {
+		t.Error("Wrong Subject:", got)
+	}
+
+	res = runCheck(t, testCheck(t, f, nil), "test@example.org")
+	if !res.Quarantine {
+		t.Error("Message is not quarantined")
+	}
+	if res.Rewrite != nil {
+		t.Error("Message is rewritten")
+	}
+}
+
+func TestCheck_Timeout(t *testing.T) {
+	f := newFakeRspamd(t, map[string]interface{}{"action": "no action"})
+	unblock := make(chan struct{})
+	defer close(unblock)
+	f.srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	})
+
+	res := runCheck(t, testCheck(t, f, []config.Node{
+		{Name: "timeout", Args: []string{"100ms"}},
+		{Name: "io_error_action", Args: []string{"reject"}},
+	}), "test@example.org")
+	if !res.Reject {
+		t.Error("Check is not failed on timeout")
+	}
+}
+
+func TestCheck_LearnMessage(t *testing.T) {
+	f := newFakeRspamd(t, map[string]interface{}{"success": true})
+	check := testCheck(t, f, []config.Node{
+		{Name: "controller_password", Args: []string{"secret"}},
+	})
+
+	if err := check.LearnMessage(context.Background(), "foxcpp@example.org", true, strings.NewReader(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if f.lastReq.URL.Path != "/learnspam" {
+		t.Error("Wrong path:", f.lastReq.URL.Path)
+	}
+	if got := f.lastReq.Header.Get("Password"); got != "secret" {
+		t.Error("Wrong Password:", got)
+	}
+	if got := f.lastReq.Header.Get("Deliver-To"); got != "foxcpp@example.org" {
+		t.Error("Wrong Deliver-To:", got)
+	}
+	if f.lastMsg != testMsg {
+		t.Error("Wrong message:", f.lastMsg)
+	}
+
+	if err := check.LearnMessage(context.Background(), "foxcpp@example.org", false, strings.NewReader(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if f.lastReq.URL.Path != "/learnham" {
+		t.Error("Wrong path:", f.lastReq.URL.Path)
+	}
+
+	check.fuzzyFlag = 11
+	if err := check.LearnMessage(context.Background(), "foxcpp@example.org", true, strings.NewReader(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if f.lastReq.URL.Path != "/fuzzyadd" {
+		t.Error("Wrong path:", f.lastReq.URL.Path)
+	}
+	if got := f.lastReq.Header.Get("Flag"); got != "11" {
+		t.Error("Wrong Flag:", got)
+	}
+	if got := f.lastReq.Header.Get("Weight"); got != "1" {
+		t.Error("Wrong Weight:", got)
+	}
+	if f.lastMsg != testMsg {
+		t.Error("Wrong message:", f.lastMsg)
+	}
+	if err := check.LearnMessage(context.Background(), "foxcpp@example.org", false, strings.NewReader(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if f.lastReq.URL.Path != "/fuzzydel" {
+		t.Error("Wrong path:", f.lastReq.URL.Path)
+	}
+	check.fuzzyFlag = 0
+
+	f.status = http.StatusAlreadyReported
+	f.resp = map[string]interface{}{"error": "already learned"}
+	if err := check.LearnMessage(context.Background(), "", true, strings.NewReader(testMsg)); err != nil {
+		t.Error("Already learned message is reported as error:", err)
+	}
+
+	f.status = http.StatusUnauthorized
+	f.resp = map[string]interface{}{"error": "Unauthorized"}
+	if err := check.LearnMessage(context.Background(), "", true, strings.NewReader(testMsg)); err == nil {
+		t.Error("No error for failed request")
+	}
+}
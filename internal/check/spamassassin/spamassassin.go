@@ -0,0 +1,295 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package spamassassin implements the check.spamassassin module that uses
+// the spamd daemon from SpamAssassin to classify messages.
+package spamassassin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.spamassassin"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	endpoint      string
+	network       string
+	addr          string
+	user          string
+	failOpen      bool
+	spamAction    modconfig.FailAction
+	requiredScore float64
+	rejectScore   float64
+	addHeader     bool
+	rewriteBody   bool
+	maxSize       int64
+	timeout       time.Duration
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.endpoint = inlineArgs[0]
+	case 0:
+		c.endpoint = "tcp://127.0.0.1:783"
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpoint, &c.endpoint)
+	cfg.String("user", false, false, "", &c.user)
+	cfg.Bool("fail_open", false, false, &c.failOpen)
+	cfg.Custom("spam_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.spamAction)
+	cfg.Float("required_score", false, false, 0, &c.requiredScore)
+	cfg.Float("reject_score", false, false, 0, &c.rejectScore)
+	cfg.Bool("add_header", false, true, &c.addHeader)
+	cfg.Bool("rewrite_body", false, false, &c.rewriteBody)
+	cfg.DataSize("max_size", false, false, 512*1024, &c.maxSize)
+	cfg.Duration("timeout", false, false, 1*time.Minute, &c.timeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	endp, err := config.ParseEndpoint(c.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	switch endp.Scheme {
+	case "tcp", "unix":
+	default:
+		return fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
+	}
+	c.network = endp.Network()
+	c.addr = endp.Address()
+
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) ioError(err error) module.CheckResult {
+	if s.c.failOpen {
+		s.log.Error("I/O error, message is not checked", err)
+		return module.CheckResult{}
+	}
+
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during policy check",
+			CheckName:    modName,
+			Err:          err,
+			Misc: map[string]interface{}{
+				"endpoint": s.c.endpoint,
+			},
+		},
+	}
+}
+
+// spamHeader returns X-Spam-* fields from the header returned by spamd.
+func spamHeader(hdr textproto.Header) textproto.Header {
+	res := textproto.Header{}
+	for field := hdr.Fields(); field.Next(); {
+		if !strings.HasPrefix(strings.ToLower(field.Key()), "x-spam-") {
+			continue
+		}
+		raw, err := field.Raw()
+		if err != nil {
+			continue
+		}
+		res.AddRaw(raw)
+	}
+	return res
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	if s.c.maxSize > 0 && int64(body.Len()) > s.c.maxSize {
+		s.log.Msg("message is too big, not checking", "size", body.Len(), "max_size", s.c.maxSize)
+		return module.CheckResult{}
+	}
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	defer bodyR.Close()
+
+	cmd := "CHECK"
+	switch {
+	case s.c.rewriteBody:
+		cmd = "PROCESS"
+	case s.c.addHeader:
+		cmd = "HEADERS"
+	}
+
+	spamdRes, err := spamdRequest(ctx, s.c.network, s.c.addr, cmd, s.c.user,
+		hdrBuf.Len()+body.Len(), io.MultiReader(&hdrBuf, bodyR), s.c.timeout)
+	if err != nil {
+		return s.ioError(err)
+	}
+
+	res := module.CheckResult{Score: spamdRes.score}
+	isSpam := spamdRes.spam
+	if s.c.requiredScore != 0 {
+		isSpam = spamdRes.score >= s.c.requiredScore
+	}
+
+	if spamdRes.content != nil {
+		rd := bufio.NewReader(bytes.NewReader(spamdRes.content))
+		newHdr, err := textproto.ReadHeader(rd)
+		if err != nil {
+			return s.ioError(fmt.Errorf("malformed message returned by spamd: %w", err))
+		}
+
+		if cmd == "PROCESS" && isSpam {
+			newBody, err := io.ReadAll(rd)
+			if err != nil {
+				return s.ioError(err)
+			}
+			res.Rewrite = &module.MsgRewrite{
+				Header: newHdr,
+				Body:   buffer.MemoryBuffer{Slice: newBody},
+			}
+		} else if s.c.addHeader {
+			res.Header = spamHeader(newHdr)
+		}
+	}
+
+	if !isSpam {
+		s.log.DebugMsg("message is not spam", "score", spamdRes.score, "threshold", spamdRes.threshold)
+		return res
+	}
+
+	res.Reason = &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected due to local policy",
+		CheckName:    modName,
+		Misc: map[string]interface{}{
+			"score":     spamdRes.score,
+			"threshold": spamdRes.threshold,
+		},
+	}
+	if s.c.rejectScore != 0 && spamdRes.score >= s.c.rejectScore {
+		res.Reject = true
+		return res
+	}
+	return s.c.spamAction.Apply(res)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+// LearnMessage implements module.SpamLearner using the spamd TELL command.
+//
+// The Bayes database of the configured user is trained, username is ignored
+// since it is not used for checks either.
+func (c *Check) LearnMessage(ctx context.Context, username string, spam bool, msg io.Reader) error {
+	blob, err := io.ReadAll(msg)
+	if err != nil {
+		return fmt.Errorf("%s: learn: %w", modName, err)
+	}
+
+	if err := spamdTell(ctx, c.network, c.addr, c.user, spam, len(blob), bytes.NewReader(blob), c.timeout); err != nil {
+		return fmt.Errorf("%s: learn: %w", modName, err)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
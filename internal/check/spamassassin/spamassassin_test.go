@@ -0,0 +1,398 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spamassassin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testMsg = "From: <foxcpp@example.org>\r\n" +
+	"To: <test@example.org>\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello!\r\n"
+
+// fakeSpamd implements enough of the spamd protocol to test the module.
+// Messages containing "VIAGRA" get score 10, messages containing "BROKEN"
+// cause an error reply, all other messages get score 1. Required score
+// is 5.
+type fakeSpamd struct {
+	l  net.Listener
+	wg sync.WaitGroup
+
+	lastUser  string
+	lastClass string
+	lock      sync.Mutex
+}
+
+func newFakeSpamd(t *testing.T) *fakeSpamd {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSpamd{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		f.wg.Wait()
+	})
+	return f
+}
+
+func (f *fakeSpamd) endpoint() string {
+	return "tcp://" + f.l.Addr().String()
+}
+
+func (f *fakeSpamd) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+
+	reqLine, err := readLine(rd)
+	if err != nil {
+		return
+	}
+	cmd, _, _ := strings.Cut(reqLine, " ")
+	contentLen := 0
+	for {
+		line, err := readLine(rd)
+		if err != nil {
+			return
+		}
+		if line == "" {
+			break
+		}
+		key, value, _ := strings.Cut(line, ": ")
+		switch key {
+		case "Content-length":
+			contentLen, _ = strconv.Atoi(value)
+		case "User":
+			f.lock.Lock()
+			f.lastUser = value
+			f.lock.Unlock()
+		case "Message-class":
+			f.lock.Lock()
+			f.lastClass = value
+			f.lock.Unlock()
+		}
+	}
+	msg := make([]byte, contentLen)
+	if _, err := io.ReadFull(rd, msg); err != nil {
+		return
+	}
+
+	if bytes.Contains(msg, []byte("BROKEN")) {
+		io.WriteString(conn, "SPAMD/1.1 74 EX_TEMPFAIL\r\n\r\n")
+		return
+	}
+	if cmd == "TELL" {
+		io.WriteString(conn, "SPAMD/1.1 0 EX_OK\r\nDidSet: local\r\n\r\n")
+		return
+	}
+
+	score := 1.0
+	if bytes.Contains(msg, []byte("VIAGRA")) {
+		score = 10.0
+	}
+	spam := score >= 5
+	spamStr := "False"
+	flag := "NO"
+	if spam {
+		spamStr = "True"
+		flag = "YES"
+	}
+
+	hdrEnd := bytes.Index(msg, []byte("\r\n\r\n")) + 2
+	newHdr := fmt.Sprintf("X-Spam-Flag: %s\r\nX-Spam-Status: score=%.1f required=5.0\r\n", flag, score) +
+		string(msg[:hdrEnd])
+	var content string
+	switch cmd {
+	case "HEADERS":
+		content = newHdr + "\r\n"
+	case "PROCESS":
+		if spam {
+			newHdr = strings.Replace(newHdr, "Subject: ", "Subject: [SPAM] ", 1)
+			content = newHdr + "\r\nSpam detection software has identified this message as spam.\r\n"
+		} else {
+			content = newHdr + string(msg[hdrEnd:])
+		}
+	}
+
+	io.WriteString(conn, "SPAMD/1.1 0 EX_OK\r\n")
+	if cmd != "CHECK" {
+		fmt.Fprintf(conn, "Content-length: %d\r\n", len(content))
+	}
+	fmt.Fprintf(conn, "Spam: %s ; %.1f / 5.0\r\n\r\n", spamStr, score)
+	io.WriteString(conn, content)
+}
+
+func testCheck(t *testing.T, endpoint string, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, []string{endpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := mod.(*Check)
+	check.log = testutils.Logger(t, modName)
+	if err := check.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return check
+}
+
+func runCheck(t *testing.T, check *Check, msg string) module.CheckResult {
+	t.Helper()
+	s, err := check.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	hdr, buf := testutils.BodyFromStr(t, msg)
+	return s.CheckBody(context.Background(), hdr, buf)
+}
+
+func TestCheck_Ham(t *testing.T) {
+	f := newFakeSpamd(t)
+	check := testCheck(t, f.endpoint(), nil)
+
+	res := runCheck(t, check, testMsg)
+	if res.Reject || res.Quarantine || res.Reason != nil {
+		t.Fatal("Unexpected check failure:", res.Reason)
+	}
+	if got := res.Header.Get("X-Spam-Flag"); got != "NO" {
+		t.Fatal("Wrong X-Spam-Flag:", got)
+	}
+	if res.Header.Has("Subject") {
+		t.Fatal("Non-X-Spam field is copied")
+	}
+}
+
+func TestCheck_Spam(t *testing.T) {
+	f := newFakeSpamd(t)
+
+	t.Run("quarantine", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), nil)
+		res := runCheck(t, check, testMsg+"VIAGRA\r\n")
+		if res.Reject || !res.Quarantine {
+			t.Fatal("Message is not quarantined")
+		}
+		smtpErr, ok := res.Reason.(*exterrors.SMTPError)
+		if !ok || smtpErr.Misc["score"] != 10.0 {
+			t.Fatal("Wrong reason:", res.Reason)
+		}
+		if got := res.Header.Get("X-Spam-Flag"); got != "YES" {
+			t.Fatal("Wrong X-Spam-Flag:", got)
+		}
+	})
+	t.Run("reject_score", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "reject_score", Args: []string{"8"}},
+		})
+		res := runCheck(t, check, testMsg+"VIAGRA\r\n")
+		if !res.Reject {
+			t.Fatal("Message is not rejected")
+		}
+	})
+	t.Run("required_score", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "required_score", Args: []string{"15"}},
+		})
+		res := runCheck(t, check, testMsg+"VIAGRA\r\n")
+		if res.Reject || res.Quarantine || res.Reason != nil {
+			t.Fatal("Unexpected check failure:", res.Reason)
+		}
+
+		check = testCheck(t, f.endpoint(), []config.Node{
+			{Name: "required_score", Args: []string{"0.5"}},
+		})
+		res = runCheck(t, check, testMsg)
+		if !res.Quarantine {
+			t.Fatal("Message is not quarantined")
+		}
+	})
+	t.Run("no header", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "add_header", Args: []string{"no"}},
+		})
+		res := runCheck(t, check, testMsg+"VIAGRA\r\n")
+		if !res.Quarantine {
+			t.Fatal("Message is not quarantined")
+		}
+		if res.Header.Len() != 0 {
+			t.Fatal("Header is added")
+		}
+	})
+}
+
+func TestCheck_RewriteBody(t *testing.T) {
+	f := newFakeSpamd(t)
+	check := testCheck(t, f.endpoint(), []config.Node{
+		{Name: "rewrite_body", Args: []string{"yes"}},
+	})
+
+	res := runCheck(t, check, testMsg)
+	if res.Rewrite != nil {
+		t.Fatal("Ham is rewritten")
+	}
+	if got := res.Header.Get("X-Spam-Flag"); got != "NO" {
+		t.Fatal("Wrong X-Spam-Flag:", got)
+	}
+
+	res = runCheck(t, check, testMsg+"VIAGRA\r\n")
+	if res.Rewrite == nil {
+		t.Fatal("Spam is not rewritten")
+	}
+	if got := res.Rewrite.Header.Get("Subject"); got != "[SPAM] Test" {
+		t.Fatal("Wrong Subject:", got)
+	}
+	if got := res.Rewrite.Header.Get("X-Spam-Flag"); got != "YES" {
+		t.Fatal("Wrong X-Spam-Flag:", got)
+	}
+	body := string(res.Rewrite.Body.(buffer.MemoryBuffer).Slice)
+	if !strings.HasPrefix(body, "Spam detection software") {
+		t.Fatalf("Wrong body: %q", body)
+	}
+}
+
+func TestCheck_User(t *testing.T) {
+	f := newFakeSpamd(t)
+	check := testCheck(t, f.endpoint(), []config.Node{
+		{Name: "user", Args: []string{"maddy"}},
+		{Name: "add_header", Args: []string{"no"}},
+	})
+	runCheck(t, check, testMsg)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.lastUser != "maddy" {
+		t.Fatal("Wrong user:", f.lastUser)
+	}
+}
+
+func TestCheck_Error(t *testing.T) {
+	f := newFakeSpamd(t)
+
+	t.Run("fail closed", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), nil)
+		res := runCheck(t, check, testMsg+"BROKEN\r\n")
+		if !res.Reject {
+			t.Fatal("Message is not rejected")
+		}
+		if !exterrors.IsTemporary(res.Reason) {
+			t.Fatal("Non-temporary error:", res.Reason)
+		}
+	})
+	t.Run("fail open", func(t *testing.T) {
+		check := testCheck(t, f.endpoint(), []config.Node{
+			{Name: "fail_open", Args: []string{"yes"}},
+		})
+		res := runCheck(t, check, testMsg+"BROKEN\r\n")
+		if res.Reject || res.Quarantine || res.Reason != nil {
+			t.Fatal("Unexpected check failure:", res.Reason)
+		}
+	})
+}
+
+func TestParseSpamHeader(t *testing.T) {
+	for _, c := range []struct {
+		value     string
+		spam      bool
+		score     float64
+		threshold float64
+		fail      bool
+	}{
+		{value: "True ; 15.0 / 5.0", spam: true, score: 15, threshold: 5},
+		{value: "False ; -1.2 / 5.0", score: -1.2, threshold: 5},
+		{value: "Yes; 6 / 5", spam: true, score: 6, threshold: 5},
+		{value: "Maybe ; 1 / 5", fail: true},
+		{value: "True 15.0 / 5.0", fail: true},
+		{value: "True ; 15.0", fail: true},
+		{value: "True ; a / 5.0", fail: true},
+	} {
+		spam, score, threshold, err := parseSpamHeader(c.value)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%q: expected error", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.value, err)
+			continue
+		}
+		if spam != c.spam || score != c.score || threshold != c.threshold {
+			t.Errorf("%q: got %v %v %v", c.value, spam, score, threshold)
+		}
+	}
+}
+
+func TestCheck_LearnMessage(t *testing.T) {
+	f := newFakeSpamd(t)
+	check := testCheck(t, f.endpoint(), []config.Node{
+		{Name: "user", Args: []string{"maddy"}},
+	})
+
+	if err := check.LearnMessage(context.Background(), "test@example.org", true, strings.NewReader(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	f.lock.Lock()
+	if f.lastClass != "spam" || f.lastUser != "maddy" {
+		t.Error("Wrong TELL request:", f.lastClass, f.lastUser)
+	}
+	f.lock.Unlock()
+
+	if err := check.LearnMessage(context.Background(), "test@example.org", false, strings.NewReader(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	f.lock.Lock()
+	if f.lastClass != "ham" {
+		t.Error("Wrong Message-class:", f.lastClass)
+	}
+	f.lock.Unlock()
+
+	if err := check.LearnMessage(context.Background(), "", true, strings.NewReader(testMsg+"BROKEN\r\n")); err == nil {
+		t.Error("No error for failed TELL")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spamassassin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client for the spamd protocol, see spamd(1) and the PROTOCOL file
+// in SpamAssassin sources.
+
+// maxReplySize is the limit on the size of the message returned by spamd
+// for HEADERS and PROCESS commands.
+const maxReplySize = 32 * 1024 * 1024
+
+type spamdResult struct {
+	spam      bool
+	score     float64
+	threshold float64
+
+	// Message header (HEADERS) or the complete message (PROCESS) returned by
+	// spamd, nil for CHECK.
+	content []byte
+}
+
+// spamdRequest sends the message to spamd using the specified command and
+// returns the parsed reply. spamd closes the connection after each reply, so
+// connections are not reused.
+func spamdRequest(ctx context.Context, network, addr, cmd, user string, msgLen int, msg io.Reader, timeout time.Duration) (*spamdResult, error) {
+	conn, err := spamdSend(ctx, network, addr, cmd, user, nil, msgLen, msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return readReply(bufio.NewReader(conn), cmd != "CHECK")
+}
+
+// spamdTell sends the TELL command to spamd to train the Bayes classifier
+// using the message. spamd should be started with --allow-tell for this to
+// work.
+func spamdTell(ctx context.Context, network, addr, user string, spam bool, msgLen int, msg io.Reader, timeout time.Duration) error {
+	class := "ham"
+	if spam {
+		class = "spam"
+	}
+	conn, err := spamdSend(ctx, network, addr, "TELL", user,
+		[]string{"Message-class: " + class, "Set: local"}, msgLen, msg, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Reply contains DidSet/DidRemove fields, they are omitted if the message
+	// was already learned, this is not an error.
+	return readStatus(bufio.NewReader(conn))
+}
+
+func spamdSend(ctx context.Context, network, addr, cmd, user string, fields []string, msgLen int, msg io.Reader, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	wr := bufio.NewWriter(conn)
+	fmt.Fprintf(wr, "%s SPAMC/1.5\r\n", cmd)
+	fmt.Fprintf(wr, "Content-length: %d\r\n", msgLen)
+	if user != "" {
+		fmt.Fprintf(wr, "User: %s\r\n", user)
+	}
+	for _, field := range fields {
+		fmt.Fprintf(wr, "%s\r\n", field)
+	}
+	wr.WriteString("\r\n")
+	if _, err := io.Copy(wr, msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := wr.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// readStatus reads the status line of the reply and checks the response code.
+func readStatus(rd *bufio.Reader) error {
+	line, err := readLine(rd)
+	if err != nil {
+		return err
+	}
+	proto, rest, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "SPAMD/") {
+		return fmt.Errorf("malformed status line: %s", line)
+	}
+	codeStr, msg, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return fmt.Errorf("malformed status line: %s", line)
+	}
+	if code != 0 {
+		return fmt.Errorf("spamd error: %d %s", code, msg)
+	}
+	return nil
+}
+
+func readReply(rd *bufio.Reader, withContent bool) (*spamdResult, error) {
+	if err := readStatus(rd); err != nil {
+		return nil, err
+	}
+
+	res := &spamdResult{}
+	contentLen := -1
+	seenSpam := false
+	for {
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed reply header: %s", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(key) {
+		case "content-length":
+			contentLen, err = strconv.Atoi(value)
+			if err != nil || contentLen < 0 {
+				return nil, fmt.Errorf("malformed Content-length: %s", value)
+			}
+		case "spam":
+			res.spam, res.score, res.threshold, err = parseSpamHeader(value)
+			if err != nil {
+				return nil, err
+			}
+			seenSpam = true
+		}
+	}
+	if !seenSpam {
+		return nil, fmt.Errorf("no Spam header in reply")
+	}
+
+	if !withContent {
+		return res, nil
+	}
+	if contentLen > maxReplySize {
+		return nil, fmt.Errorf("reply is too big: %d", contentLen)
+	}
+	if contentLen >= 0 {
+		res.content = make([]byte, contentLen)
+		if _, err := io.ReadFull(rd, res.content); err != nil {
+			return nil, err
+		}
+	} else {
+		content, err := io.ReadAll(io.LimitReader(rd, maxReplySize))
+		if err != nil {
+			return nil, err
+		}
+		res.content = content
+	}
+	return res, nil
+}
+
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// parseSpamHeader parses the value of Spam header field in the
+// "True ; 15.0 / 5.0" format.
+func parseSpamHeader(value string) (spam bool, score, threshold float64, err error) {
+	flag, scores, ok := strings.Cut(value, ";")
+	if !ok {
+		return false, 0, 0, fmt.Errorf("malformed Spam header: %s", value)
+	}
+	switch strings.ToLower(strings.TrimSpace(flag)) {
+	case "true", "yes":
+		spam = true
+	case "false", "no":
+	default:
+		return false, 0, 0, fmt.Errorf("malformed Spam header: %s", value)
+	}
+
+	scoreStr, thresholdStr, ok := strings.Cut(scores, "/")
+	if !ok {
+		return false, 0, 0, fmt.Errorf("malformed Spam header: %s", value)
+	}
+	score, err = strconv.ParseFloat(strings.TrimSpace(scoreStr), 64)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("malformed Spam header: %s", value)
+	}
+	threshold, err = strconv.ParseFloat(strings.TrimSpace(thresholdStr), 64)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("malformed Spam header: %s", value)
+	}
+	return spam, score, threshold, nil
+}
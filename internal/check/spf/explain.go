@@ -0,0 +1,392 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+const (
+	maxExplanationLen = 256
+	maxRedirects      = 10
+	maxPTRNames       = 10
+)
+
+var errInvalidMacro = errors.New("spf: invalid macro")
+
+// macroEnv contains values used for macro expansion as defined in
+// RFC 7208, Section 7.
+//
+// blitiri.com.ar/go/spf expands macros in mechanisms but does not process
+// exp= modifiers, so we do it ourselves.
+type macroEnv struct {
+	ctx      context.Context
+	resolver dns.Resolver
+
+	ip       net.IP
+	sender   string
+	helo     string
+	receiver string
+	now      time.Time
+
+	ptr map[string]string
+}
+
+func splitSender(sender string) (local, domain string) {
+	at := strings.LastIndexByte(sender, '@')
+	if at == -1 {
+		return "", sender
+	}
+	return sender[:at], sender[at+1:]
+}
+
+// expand expands macros in the macro-string. If exp is true, macros allowed
+// only in explanation strings (c, r, t) are accepted.
+func (e *macroEnv) expand(s, domain string, exp bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			return "", errInvalidMacro
+		}
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				return "", errInvalidMacro
+			}
+			val, err := e.macro(s[i+1:i+end], domain, exp)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(val)
+			i += end
+		default:
+			return "", errInvalidMacro
+		}
+	}
+	return b.String(), nil
+}
+
+func (e *macroEnv) macro(spec, domain string, exp bool) (string, error) {
+	if spec == "" {
+		return "", errInvalidMacro
+	}
+	letter, rest := spec[0], spec[1:]
+
+	digitsEnd := 0
+	for digitsEnd < len(rest) && rest[digitsEnd] >= '0' && rest[digitsEnd] <= '9' {
+		digitsEnd++
+	}
+	digits := 0
+	if digitsEnd != 0 {
+		var err error
+		digits, err = strconv.Atoi(rest[:digitsEnd])
+		if err != nil || digits == 0 {
+			return "", errInvalidMacro
+		}
+		rest = rest[digitsEnd:]
+	}
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delims := rest
+	if strings.Trim(delims, ".-+,/_=") != "" {
+		return "", errInvalidMacro
+	}
+	if delims == "" {
+		delims = "."
+	}
+
+	var val string
+	switch letter | 0x20 { // ASCII lower-case
+	case 's':
+		val = e.sender
+	case 'l':
+		val, _ = splitSender(e.sender)
+		if val == "" {
+			val = "postmaster"
+		}
+	case 'o':
+		_, val = splitSender(e.sender)
+	case 'd':
+		val = domain
+	case 'i':
+		val = ipMacro(e.ip)
+	case 'p':
+		val = e.validatedPTR(domain)
+	case 'v':
+		val = "in-addr"
+		if e.ip.To4() == nil {
+			val = "ip6"
+		}
+	case 'h':
+		val = e.helo
+	case 'c':
+		if !exp {
+			return "", errInvalidMacro
+		}
+		val = e.ip.String()
+	case 'r':
+		if !exp {
+			return "", errInvalidMacro
+		}
+		val = e.receiver
+		if val == "" {
+			val = "unknown"
+		}
+	case 't':
+		if !exp {
+			return "", errInvalidMacro
+		}
+		val = strconv.FormatInt(e.now.Unix(), 10)
+	default:
+		return "", errInvalidMacro
+	}
+
+	parts := strings.FieldsFunc(val, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits != 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	val = strings.Join(parts, ".")
+
+	if letter >= 'A' && letter <= 'Z' {
+		val = urlEscape(val)
+	}
+	return val, nil
+}
+
+// urlEscape escapes all characters except "unreserved" ones as defined in
+// RFC 3986.
+func urlEscape(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
+
+func ipMacro(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&15]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// validatedPTR returns the validated domain name of the client IP as
+// defined in RFC 7208, Section 5.5.
+func (e *macroEnv) validatedPTR(domain string) string {
+	if name, ok := e.ptr[domain]; ok {
+		return name
+	}
+
+	names, err := e.resolver.LookupAddr(e.ctx, e.ip.String())
+	if err != nil {
+		return "unknown"
+	}
+	if len(names) > maxPTRNames {
+		names = names[:maxPTRNames]
+	}
+
+	validated := "unknown"
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		ok := false
+		for _, addr := range addrs {
+			if addr.IP.Equal(e.ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		if dns.Equal(name, domain) || strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(domain)) {
+			validated = name
+			break
+		}
+		if validated == "unknown" {
+			validated = name
+		}
+	}
+
+	if e.ptr == nil {
+		e.ptr = make(map[string]string)
+	}
+	e.ptr[domain] = validated
+	return validated
+}
+
+// spfModifiers returns the values of exp= and redirect= modifiers from the
+// SPF record of the domain.
+func spfModifiers(ctx context.Context, r dns.Resolver, domain string) (exp, redirect string, err error) {
+	txts, err := r.LookupTXT(ctx, dns.FQDN(domain))
+	if err != nil {
+		return "", "", err
+	}
+
+	var record string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || (len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ")) {
+			if record != "" {
+				return "", "", errors.New("spf: multiple SPF records")
+			}
+			record = txt
+		}
+	}
+
+	if record == "" {
+		return "", "", nil
+	}
+
+	hasAll := false
+	for _, term := range strings.Fields(record)[1:] {
+		lterm := strings.ToLower(term)
+		switch {
+		case strings.HasPrefix(lterm, "exp="):
+			exp = term[len("exp="):]
+		case strings.HasPrefix(lterm, "redirect="):
+			redirect = term[len("redirect="):]
+		case strings.TrimLeft(lterm, "+-~?") == "all":
+			hasAll = true
+		}
+	}
+	// redirect= is ignored if there is "all" mechanism.
+	if hasAll {
+		redirect = ""
+	}
+	return exp, redirect, nil
+}
+
+// sanitizeExplanation removes characters that can't be used in the SMTP
+// response and limits the explanation length.
+func sanitizeExplanation(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7E {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) > maxExplanationLen {
+		s = s[:maxExplanationLen]
+	}
+	return s
+}
+
+// explanation returns the explanation string published by the sender
+// domain using the exp= modifier (RFC 7208, Section 6.2).
+//
+// Empty string is returned if there is no explanation or it can't be
+// retrieved.
+func (s *state) explanation(ctx context.Context) string {
+	env := &macroEnv{
+		ctx:      ctx,
+		resolver: s.c.resolver,
+		ip:       s.ip,
+		sender:   strings.TrimSuffix(s.sender, "."),
+		helo:     s.msgMeta.Conn.Hostname,
+		receiver: s.c.hostname,
+		now:      time.Now(),
+	}
+
+	domain := s.domain
+	for i := 0; i < maxRedirects; i++ {
+		exp, redirect, err := spfModifiers(ctx, s.c.resolver, domain)
+		if err != nil {
+			s.log.DebugMsg("failed to fetch SPF record for explanation", "domain", domain, "err", err)
+			return ""
+		}
+
+		if exp != "" {
+			target, err := env.expand(exp, domain, false)
+			if err != nil {
+				s.log.DebugMsg("malformed exp= modifier", "domain", domain, "err", err)
+				return ""
+			}
+			txts, err := s.c.resolver.LookupTXT(ctx, dns.FQDN(target))
+			if err != nil || len(txts) != 1 {
+				s.log.DebugMsg("failed to fetch explanation", "domain", domain, "target", target, "err", err)
+				return ""
+			}
+			text, err := env.expand(txts[0], domain, true)
+			if err != nil {
+				s.log.DebugMsg("malformed explanation", "domain", domain, "err", err)
+				return ""
+			}
+			return sanitizeExplanation(text)
+		}
+
+		if redirect == "" {
+			return ""
+		}
+		domain, err = env.expand(redirect, domain, false)
+		if err != nil {
+			s.log.DebugMsg("malformed redirect= modifier", "domain", domain, "err", err)
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+)
+
+func TestMacroExpand(t *testing.T) {
+	env := &macroEnv{
+		ctx: context.Background(),
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"3.2.0.192.in-addr.arpa.": {PTR: []string{"other.example.", "mx.email.example.com."}},
+			"mx.email.example.com.":   {A: []string{"192.0.2.3"}},
+			"other.example.":          {A: []string{"192.0.2.3"}},
+		}},
+		ip:       net.IPv4(192, 0, 2, 3),
+		sender:   "strong-bad@email.example.com",
+		helo:     "mx.email.example.com",
+		receiver: "mx.example.org",
+		now:      time.Unix(1700000000, 0),
+	}
+	env6 := *env
+	env6.ip = net.ParseIP("2001:db8::cb01")
+
+	// Examples from RFC 7208, Section 7.4.
+	for _, tc := range []struct {
+		env  *macroEnv
+		in   string
+		out  string
+		exp  bool
+		fail bool
+	}{
+		{env: env, in: "%{s}", out: "strong-bad@email.example.com"},
+		{env: env, in: "%{o}", out: "email.example.com"},
+		{env: env, in: "%{d}", out: "email.example.com"},
+		{env: env, in: "%{d4}", out: "email.example.com"},
+		{env: env, in: "%{d3}", out: "email.example.com"},
+		{env: env, in: "%{d2}", out: "example.com"},
+		{env: env, in: "%{d1}", out: "com"},
+		{env: env, in: "%{dr}", out: "com.example.email"},
+		{env: env, in: "%{d2r}", out: "example.email"},
+		{env: env, in: "%{l}", out: "strong-bad"},
+		{env: env, in: "%{l-}", out: "strong.bad"},
+		{env: env, in: "%{lr}", out: "strong-bad"},
+		{env: env, in: "%{lr-}", out: "bad.strong"},
+		{env: env, in: "%{l1r-}", out: "strong"},
+		{env: env, in: "%{ir}.%{v}._spf.%{d2}", out: "3.2.0.192.in-addr._spf.example.com"},
+		{env: env, in: "%{lr-}.lp._spf.%{d2}", out: "bad.strong.lp._spf.example.com"},
+		{env: env, in: "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", out: "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{env: env, in: "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", out: "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{env: env, in: "%{d2}.trusted-domains.example.net", out: "example.com.trusted-domains.example.net"},
+		{env: &env6, in: "%{ir}.%{v}._spf.%{d2}", out: "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+		{env: env, in: "%{p}", out: "mx.email.example.com"},
+		{env: env, in: "%{S}", out: "strong-bad%40email.example.com"},
+		{env: env, in: "100%% %_ %-", out: "100%   %20"},
+		{env: env, in: "%{c} %{r} %{t}", out: "192.0.2.3 mx.example.org 1700000000", exp: true},
+		{env: env, in: "%{c}", fail: true},
+		{env: env, in: "%{x}", fail: true},
+		{env: env, in: "%{d0}", fail: true},
+		{env: env, in: "%{d", fail: true},
+		{env: env, in: "%x", fail: true},
+	} {
+		out, err := tc.env.expand(tc.in, "email.example.com", tc.exp)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%s: expected error, got %q", tc.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if out != tc.out {
+			t.Errorf("%s: want %q, got %q", tc.in, tc.out, out)
+		}
+	}
+}
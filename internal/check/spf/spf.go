@@ -25,6 +25,7 @@ import (
 	"net"
 	"runtime/debug"
 	"runtime/trace"
+	"strings"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/emersion/go-message/textproto"
@@ -56,6 +57,10 @@ type Check struct {
 	permerrAction  modconfig.FailAction
 	temperrAction  modconfig.FailAction
 
+	override    module.Table
+	explanation bool
+	hostname    string
+
 	log      log.Logger
 	resolver dns.Resolver
 }
@@ -103,6 +108,9 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.temperrAction)
+	modconfig.Table(cfg, "override", false, false, nil, &c.override)
+	cfg.Bool("explanation", false, true, &c.explanation)
+	cfg.String("hostname", true, false, "", &c.hostname)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
@@ -123,6 +131,12 @@ type state struct {
 	log      log.Logger
 
 	skip bool
+
+	// Values used for SPF evaluation, saved for explanation string expansion
+	// and override table lookups.
+	ip     net.IP
+	sender string
+	domain string
 }
 
 func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
@@ -134,7 +148,7 @@ func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadat
 	}, nil
 }
 
-func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
+func (s *state) spfResult(ctx context.Context, res spf.Result, err error) module.CheckResult {
 	_, fromDomain, _ := address.Split(s.msgMeta.OriginalFrom)
 	spfAuth := &authres.SPFResult{
 		Value: authres.ResultNone,
@@ -148,94 +162,105 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		spfAuth.Reason = "no policy"
 	}
 
+	var (
+		action modconfig.FailAction
+		reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
+			CheckName:    modName,
+			Err:          err,
+		}
+	)
 	switch res {
 	case spf.None:
 		spfAuth.Value = authres.ResultNone
-		return s.c.noneAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
-				Message:      "No SPF policy",
-				CheckName:    modName,
-				Err:          err,
-			},
-			AuthResult: []authres.Result{spfAuth},
-		})
+		action = s.c.noneAction
+		reason.Message = "No SPF policy"
 	case spf.Neutral:
 		spfAuth.Value = authres.ResultNeutral
-		return s.c.neutralAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
-				Message:      "Neutral SPF result is not permitted",
-				CheckName:    modName,
-				Err:          err,
-			},
-			AuthResult: []authres.Result{spfAuth},
-		})
+		action = s.c.neutralAction
+		reason.Message = "Neutral SPF result is not permitted"
 	case spf.Pass:
 		spfAuth.Value = authres.ResultPass
 		return module.CheckResult{AuthResult: []authres.Result{spfAuth}}
 	case spf.Fail:
 		spfAuth.Value = authres.ResultFail
-		return s.c.failAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
-				Message:      "SPF authentication failed",
-				CheckName:    modName,
-				Err:          err,
-			},
-			AuthResult: []authres.Result{spfAuth},
-		})
+		action = s.c.failAction
+		reason.Message = "SPF authentication failed"
+		if s.c.explanation {
+			if exp := s.explanation(ctx); exp != "" {
+				reason.Message += ": " + exp
+				reason.Misc = map[string]interface{}{"explanation": exp}
+			}
+		}
 	case spf.SoftFail:
 		spfAuth.Value = authres.ResultSoftFail
-		return s.c.softfailAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
-				Message:      "SPF authentication soft-failed",
-				CheckName:    modName,
-				Err:          err,
-			},
-			AuthResult: []authres.Result{spfAuth},
-		})
+		action = s.c.softfailAction
+		reason.Message = "SPF authentication soft-failed"
 	case spf.TempError:
 		spfAuth.Value = authres.ResultTempError
-		return s.c.temperrAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         451,
-				EnhancedCode: exterrors.EnhancedCode{4, 7, 23},
-				Message:      "SPF authentication failed with a temporary error",
-				CheckName:    modName,
-				Err:          err,
-			},
-			AuthResult: []authres.Result{spfAuth},
-		})
+		action = s.c.temperrAction
+		reason.Code = 451
+		reason.EnhancedCode = exterrors.EnhancedCode{4, 7, 23}
+		reason.Message = "SPF authentication failed with a temporary error"
 	case spf.PermError:
 		spfAuth.Value = authres.ResultPermError
-		return s.c.permerrAction.Apply(module.CheckResult{
+		action = s.c.permerrAction
+		reason.Message = "SPF authentication failed with a permanent error"
+	default:
+		return module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
-				Message:      "SPF authentication failed with a permanent error",
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 23},
+				Message:      fmt.Sprintf("Unknown SPF status: %s", res),
 				CheckName:    modName,
 				Err:          err,
 			},
 			AuthResult: []authres.Result{spfAuth},
-		})
+		}
 	}
 
-	return module.CheckResult{
-		Reason: &exterrors.SMTPError{
-			Code:         550,
-			EnhancedCode: exterrors.EnhancedCode{4, 7, 23},
-			Message:      fmt.Sprintf("Unknown SPF status: %s", res),
-			CheckName:    modName,
-			Err:          err,
-		},
+	if override, ok := s.overrideAction(ctx); ok {
+		action = override
+	}
+
+	return action.Apply(module.CheckResult{
+		Reason:     reason,
 		AuthResult: []authres.Result{spfAuth},
+	})
+}
+
+// overrideAction returns the action configured for the sender domain (or
+// any of its parent domains) in the override table.
+func (s *state) overrideAction(ctx context.Context) (modconfig.FailAction, bool) {
+	if s.c.override == nil {
+		return modconfig.FailAction{}, false
+	}
+
+	domain := s.domain
+	for domain != "" {
+		val, ok, err := s.c.override.Lookup(ctx, domain)
+		if err != nil {
+			s.log.Error("override table lookup failed", err, "domain", domain)
+			return modconfig.FailAction{}, false
+		}
+		if ok {
+			action, err := modconfig.ParseActionDirective(strings.Fields(val))
+			if err != nil {
+				s.log.Error("malformed override table entry", err, "domain", domain)
+				return modconfig.FailAction{}, false
+			}
+			s.log.DebugMsg("using action from the override table", "domain", domain, "action", val)
+			return action, true
+		}
+
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			break
+		}
+		domain = domain[dot+1:]
 	}
+	return modconfig.FailAction{}, false
 }
 
 func (s *state) relyOnDMARC(ctx context.Context, hdr textproto.Header) bool {
@@ -333,12 +358,17 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		}
 	}
 
+	s.ip = ip.IP
+	s.sender = mailFrom
+	_, s.domain, _ = address.Split(mailFrom)
+	s.domain = strings.ToLower(strings.TrimSuffix(s.domain, "."))
+
 	if s.c.enforceEarly {
 		res, err := spf.CheckHostWithSender(ip.IP,
 			dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom,
 			spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
 		s.log.Debugf("result: %s (%v)", res, err)
-		return s.spfResult(res, err)
+		return s.spfResult(ctx, res, err)
 	}
 
 	// We start evaluation in parallel to other message processing,
@@ -402,13 +432,13 @@ func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buf
 			s.log.DebugMsg("deferring action due to a DMARC policy", "result", res.res, "err", res.err)
 		}
 
-		checkRes := s.spfResult(res.res, res.err)
+		checkRes := s.spfResult(ctx, res.res, res.err)
 		checkRes.Quarantine = false
 		checkRes.Reject = false
 		return checkRes
 	}
 
-	return s.spfResult(res.res, res.err)
+	return s.spfResult(ctx, res.res, res.err)
 }
 
 func (s *state) Close() error {
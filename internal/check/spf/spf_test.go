@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testZones = map[string]mockdns.Zone{
+	"example.org.": {
+		TXT: []string{"v=spf1 ip4:192.0.2.1 redirect=_spf.example.org"},
+	},
+	"_spf.example.org.": {
+		TXT: []string{"v=spf1 ip4:192.0.2.2 -all exp=explain._spf.%{d}"},
+	},
+	"explain._spf._spf.example.org.": {
+		TXT: []string{"%{i} is not one of %{d}'s designated mail servers, see http://%{d}/why.html?s=%{S}"},
+	},
+	"partner.example.": {
+		TXT: []string{"v=spf1 -all"},
+	},
+}
+
+func testCheck(t *testing.T, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	c.resolver = &mockdns.Resolver{Zones: testZones}
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkConn(t *testing.T, c *Check, ip net.IP, mailFrom string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: mailFrom,
+		Conn: &module.ConnState{
+			Hostname:   "mx.example.com",
+			RemoteAddr: &net.TCPAddr{IP: ip, Port: 25},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	return st.CheckConnection(context.Background())
+}
+
+func TestCheck_Explanation(t *testing.T) {
+	c := testCheck(t, []config.Node{
+		{Name: "enforce_early", Args: []string{"yes"}},
+		{Name: "fail_action", Args: []string{"reject"}},
+	})
+
+	res := checkConn(t, c, net.IPv4(192, 0, 2, 1), "user@example.org")
+	if res.Reject {
+		t.Fatalf("unexpected reject: %v", res.Reason)
+	}
+
+	res = checkConn(t, c, net.IPv4(192, 0, 2, 99), "user@example.org")
+	if !res.Reject {
+		t.Fatal("expected reject")
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(res.Reason, &smtpErr) {
+		t.Fatalf("expected SMTPError, got %v", res.Reason)
+	}
+	want := "SPF authentication failed: 192.0.2.99 is not one of _spf.example.org's designated mail servers, " +
+		"see http://_spf.example.org/why.html?s=user%40example.org"
+	if smtpErr.Message != want {
+		t.Errorf("wrong message:\n%s\nwant:\n%s", smtpErr.Message, want)
+	}
+}
+
+func TestCheck_Override(t *testing.T) {
+	c := testCheck(t, []config.Node{
+		{Name: "enforce_early", Args: []string{"yes"}},
+		{Name: "fail_action", Args: []string{"reject"}},
+	})
+	c.override = testutils.Table{M: map[string]string{
+		"partner.example": "ignore",
+		"example.org":     "quarantine",
+	}}
+
+	res := checkConn(t, c, net.IPv4(192, 0, 2, 99), "user@partner.example")
+	if res.Reject || res.Quarantine {
+		t.Fatalf("unexpected result for overridden domain: %+v", res)
+	}
+	// Authentication-Results still includes the actual result.
+	if len(res.AuthResult) != 1 || res.AuthResult[0].(*authres.SPFResult).Value != authres.ResultFail {
+		t.Fatalf("wrong auth result: %+v", res.AuthResult)
+	}
+
+	// Parent domains are checked too.
+	res = checkConn(t, c, net.IPv4(192, 0, 2, 99), "user@sub.example.org")
+	if res.Reject || !res.Quarantine {
+		t.Fatalf("expected quarantine for subdomain of overridden domain: %+v", res)
+	}
+}
@@ -0,0 +1,298 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tls_downgrade implements the check.tls_downgrade module that
+// detects possible STARTTLS stripping attacks: plaintext connections from
+// senders that used TLS before or announce TLS support using MTA-STS or
+// DANE.
+package tls_downgrade
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName   = "check.tls_downgrade"
+	keyPrefix = "tlsd:"
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	state       module.SharedState
+	remember    time.Duration
+	trackIP     bool
+	trackDomain bool
+	checkPolicy bool
+
+	downgradeAction modconfig.FailAction
+	policyAction    modconfig.FailAction
+
+	mtastsGet   func(context.Context, string) (*mtasts.Policy, error)
+	extResolver *dns.ExtResolver
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var track []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("state", false, false, func() (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", []string{"memory"}, config.Node{}, nil, &st)
+		return st, err
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", node.Args, node, m.Globals, &st)
+		return st, err
+	}, &c.state)
+	cfg.Duration("remember", false, false, 30*24*time.Hour, &c.remember)
+	cfg.StringList("track", false, false, []string{"ip", "domain"}, &track)
+	cfg.Bool("check_policy", false, true, &c.checkPolicy)
+	cfg.Custom("downgrade_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.downgradeAction)
+	cfg.Custom("policy_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.policyAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.remember <= 0 {
+		return config.NodeErr(cfg.Block, "remember should be positive")
+	}
+	for _, scope := range track {
+		switch scope {
+		case "ip":
+			c.trackIP = true
+		case "domain":
+			c.trackDomain = true
+		default:
+			return config.NodeErr(cfg.Block, "unknown track scope: %s", scope)
+		}
+	}
+
+	if c.checkPolicy {
+		cache := mtasts.NewRAMCache()
+		cache.Resolver = dns.DefaultResolver()
+		c.mtastsGet = cache.Get
+
+		var err error
+		c.extResolver, err = dns.NewExtResolver()
+		if err != nil {
+			c.log.Error("cannot initialize DNSSEC-aware resolver, DANE records will not be checked", err)
+		}
+	}
+
+	return nil
+}
+
+// lookupPolicy checks whether the domain announces that its mail servers
+// support TLS. Returned value is the name of the mechanism used to announce
+// it ("mta-sts" or "dane") or an empty string.
+func (c *Check) lookupPolicy(ctx context.Context, domain string) (string, error) {
+	policy, err := c.mtastsGet(ctx, domain)
+	if err != nil && !mtasts.IsNoPolicy(err) {
+		return "", err
+	}
+	if err == nil && policy.Mode == mtasts.ModeEnforce {
+		return "mta-sts", nil
+	}
+
+	if c.extResolver == nil {
+		return "", nil
+	}
+	ad, mxs, err := c.extResolver.AuthLookupMX(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	if !ad {
+		return "", nil
+	}
+	for _, mx := range mxs {
+		ad, recs, err := c.extResolver.AuthLookupTLSA(ctx, "25", "tcp", mx.Host)
+		if err != nil {
+			return "", err
+		}
+		if ad && len(recs) != 0 {
+			return "dane", nil
+		}
+	}
+	return "", nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// CheckSender remembers senders using TLS and checks plaintext connections
+// against the remembered information and policies of the sender domain.
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckSender").End()
+
+	// Only messages from other servers are checked.
+	if s.msgMeta.Conn == nil || s.msgMeta.Conn.AuthUser != "" {
+		return module.CheckResult{}
+	}
+
+	var domain string
+	if mailFrom != "" {
+		addr, err := address.ForLookup(mailFrom)
+		if err != nil {
+			s.log.Error("malformed sender address", err, "mail_from", mailFrom)
+			addr = mailFrom
+		}
+		_, domain, _ = address.Split(addr)
+	}
+
+	type scope struct {
+		name string
+		key  string
+	}
+	var scopes []scope
+	if tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok && s.c.trackIP {
+		scopes = append(scopes, scope{name: "ip", key: keyPrefix + "ip:" + tcpAddr.IP.String()})
+	}
+	if domain != "" && s.c.trackDomain {
+		scopes = append(scopes, scope{name: "domain", key: keyPrefix + "domain:" + domain})
+	}
+
+	if s.msgMeta.Conn.TLS.HandshakeComplete {
+		for _, sc := range scopes {
+			if err := s.c.state.Set(ctx, sc.key, "1", s.c.remember); err != nil {
+				s.log.Error("state store error", err, "scope", sc.name)
+			}
+		}
+		return module.CheckResult{}
+	}
+
+	// Policies are checked first since policy_action is expected to be
+	// stricter.
+	if s.c.checkPolicy && domain != "" {
+		mechanism, err := s.c.lookupPolicy(ctx, domain)
+		if err != nil {
+			s.log.Error("policy lookup failed", err, "domain", domain)
+		}
+		if mechanism != "" {
+			downgrades.WithLabelValues(s.c.instName, mechanism).Inc()
+			return s.c.policyAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         550,
+					EnhancedCode: exterrors.EnhancedCode{5, 7, 10},
+					Message:      "TLS is required for messages from this sender",
+					CheckName:    modName,
+					Misc: map[string]interface{}{
+						"reason": mechanism,
+						"domain": domain,
+					},
+				},
+			})
+		}
+	}
+
+	for _, sc := range scopes {
+		_, ok, err := s.c.state.Get(ctx, sc.key)
+		if err != nil {
+			s.log.Error("state store error", err, "scope", sc.name)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		downgrades.WithLabelValues(s.c.instName, sc.name).Inc()
+		return s.c.downgradeAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 10},
+				Message:      "TLS is expected for messages from this sender, try again later",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"reason": sc.name,
+				},
+			},
+		})
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
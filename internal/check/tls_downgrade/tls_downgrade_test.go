@@ -0,0 +1,166 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls_downgrade
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+
+	_ "github.com/foxcpp/maddy/internal/state"
+)
+
+func initCheck(t *testing.T, cfg []config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkSender(t *testing.T, c *Check, conn *module.ConnState, mailFrom string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "test",
+		OriginalFrom: mailFrom,
+		Conn:         conn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	return st.CheckSender(context.Background(), mailFrom)
+}
+
+func remoteConn(ip string, useTLS bool) *module.ConnState {
+	return &module.ConnState{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+		TLS:        tls.ConnectionState{HandshakeComplete: useTLS},
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "check_policy", Args: []string{"no"}},
+		{Name: "downgrade_action", Args: []string{"reject"}},
+	})
+
+	// Nothing is known about the sender yet.
+	if res := checkSender(t, c, remoteConn("192.0.2.1", false), "a@example.org"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+
+	if res := checkSender(t, c, remoteConn("192.0.2.1", true), "a@example.org"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+
+	res := checkSender(t, c, remoteConn("192.0.2.1", false), "")
+	if !res.Reject {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	if scope := res.Reason.(*exterrors.SMTPError).Misc["reason"]; scope != "ip" {
+		t.Fatalf("wrong reason: %v", scope)
+	}
+
+	res = checkSender(t, c, remoteConn("192.0.2.2", false), "b@EXAMPLE.org")
+	if !res.Reject {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	if scope := res.Reason.(*exterrors.SMTPError).Misc["reason"]; scope != "domain" {
+		t.Fatalf("wrong reason: %v", scope)
+	}
+
+	if res := checkSender(t, c, remoteConn("192.0.2.2", false), "b@example.com"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+
+	// Authenticated users are not checked.
+	conn := remoteConn("192.0.2.1", false)
+	conn.AuthUser = "a@example.org"
+	if res := checkSender(t, c, conn, "a@example.org"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+}
+
+func TestDowngrade_TrackIPOnly(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "check_policy", Args: []string{"no"}},
+		{Name: "track", Args: []string{"ip"}},
+		{Name: "downgrade_action", Args: []string{"quarantine"}},
+	})
+
+	checkSender(t, c, remoteConn("192.0.2.1", true), "a@example.org")
+	if res := checkSender(t, c, remoteConn("192.0.2.2", false), "a@example.org"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+	if res := checkSender(t, c, remoteConn("192.0.2.1", false), "a@example.org"); !res.Quarantine || res.Reject {
+		t.Fatalf("expected quarantine, got %+v", res)
+	}
+}
+
+func TestDowngrade_Policy(t *testing.T) {
+	c := initCheck(t, []config.Node{
+		{Name: "policy_action", Args: []string{"reject"}},
+	})
+	c.extResolver = nil
+	c.mtastsGet = func(_ context.Context, domain string) (*mtasts.Policy, error) {
+		switch domain {
+		case "example.org":
+			return &mtasts.Policy{Mode: mtasts.ModeEnforce, MX: []string{"mx.example.org"}}, nil
+		case "example.net":
+			return &mtasts.Policy{Mode: mtasts.ModeTesting, MX: []string{"mx.example.net"}}, nil
+		}
+		return nil, mtasts.ErrNoPolicy
+	}
+
+	res := checkSender(t, c, remoteConn("192.0.2.1", false), "a@example.org")
+	if !res.Reject {
+		t.Fatalf("expected rejection, got %+v", res)
+	}
+	if code := res.Reason.(*exterrors.SMTPError).Code; code != 550 {
+		t.Fatalf("wrong code: %v", code)
+	}
+
+	for _, from := range []string{"a@example.net", "a@example.com", ""} {
+		if res := checkSender(t, c, remoteConn("192.0.2.1", false), from); res.Reason != nil {
+			t.Fatalf("unexpected result for %s: %v", from, res.Reason)
+		}
+	}
+
+	// Policies do not matter for TLS connections.
+	if res := checkSender(t, c, remoteConn("192.0.2.1", true), "a@example.org"); res.Reason != nil {
+		t.Fatalf("unexpected result: %v", res.Reason)
+	}
+}
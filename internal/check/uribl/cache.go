@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uribl
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// lookupCache keeps the results of recent list lookups, including negative
+// ones, to avoid repeated DNS queries for domains commonly found in messages.
+type lookupCache struct {
+	ttl     time.Duration
+	maxSize int
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	addrs  []net.IP
+	expiry time.Time
+}
+
+func newLookupCache(ttl time.Duration, maxSize int) *lookupCache {
+	return &lookupCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (c *lookupCache) get(query string) ([]net.IP, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[query]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiry) {
+		delete(c.entries, query)
+		return nil, false
+	}
+	return entry.addrs, true
+}
+
+func (c *lookupCache) put(query string, addrs []net.IP) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.maxSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expiry) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	// Still full? Evict random entries.
+	for k := range c.entries {
+		if len(c.entries) < c.maxSize {
+			break
+		}
+		delete(c.entries, k)
+	}
+
+	c.entries[query] = cacheEntry{
+		addrs:  addrs,
+		expiry: now.Add(c.ttl),
+	}
+}
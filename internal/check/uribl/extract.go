@@ -0,0 +1,116 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uribl
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+var urlRe = regexp.MustCompile(`(?i)(?:https?://|www\.)[^\s<>"'(){}\[\]\\^|` + "`" + `]+`)
+
+// extractDomains returns registered domains of URLs found in text parts of
+// the message.
+//
+// At most maxSize bytes are read from each part and at most maxDomains unique
+// domains are returned.
+func extractDomains(hdr textproto.Header, body io.Reader, maxSize int64, maxDomains int) ([]string, error) {
+	ent, err := message.New(message.Header{Header: hdr}, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+
+	var (
+		domains []string
+		seen    = make(map[string]struct{})
+	)
+	errDone := io.EOF
+	err = ent.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			return nil
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		if mediaType != "" && !strings.HasPrefix(mediaType, "text/") {
+			return nil
+		}
+
+		text, err := io.ReadAll(io.LimitReader(part.Body, maxSize))
+		if err != nil {
+			return err
+		}
+		for _, u := range urlRe.FindAll(text, -1) {
+			domain := urlDomain(string(u))
+			if domain == "" {
+				continue
+			}
+			if _, ok := seen[domain]; ok {
+				continue
+			}
+			seen[domain] = struct{}{}
+			domains = append(domains, domain)
+			if len(domains) >= maxDomains {
+				return errDone
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errDone {
+		return domains, err
+	}
+	return domains, nil
+}
+
+// urlDomain returns the registered domain for the URL or an empty string
+// if it can't be determined.
+func urlDomain(rawURL string) string {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	// Text-based extraction often captures the trailing punctuation.
+	rawURL = strings.TrimRight(rawURL, ".,;:!?")
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" || net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return ""
+	}
+	// Blocklists are queried using A-labels.
+	host, err = idna.Lookup.ToASCII(host)
+	if err != nil {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
@@ -0,0 +1,377 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package uribl implements the check.uribl module that checks domains of URLs
+// found in the message body against URI blocklists (SURBL, URIBL, Spamhaus
+// DBL, etc).
+package uribl
+
+import (
+	"context"
+	"net"
+	"runtime/trace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/errgroup"
+)
+
+const modName = "check.uribl"
+
+type List struct {
+	Zone      string
+	ScoreAdj  int
+	Responses []net.IPNet
+}
+
+var defaultList = List{
+	ScoreAdj: 1,
+	Responses: []net.IPNet{
+		{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	},
+}
+
+type URIBL struct {
+	instName  string
+	inlineBls []string
+	bls       []List
+
+	quarantineThres int
+	rejectThres     int
+	maxDomains      int
+	maxSize         int64
+	exclude         map[string]struct{}
+
+	cache    *lookupCache
+	resolver dns.Resolver
+	log      log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &URIBL{
+		instName:  instName,
+		inlineBls: inlineArgs,
+
+		resolver: dns.DefaultResolver(),
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (bl *URIBL) Name() string {
+	return modName
+}
+
+func (bl *URIBL) InstanceName() string {
+	return bl.instName
+}
+
+func (bl *URIBL) Init(cfg *config.Map) error {
+	var (
+		excludeDomains []string
+		cacheTTL       time.Duration
+		cacheSize      int
+	)
+	cfg.Bool("debug", true, false, &bl.log.Debug)
+	cfg.Int("quarantine_threshold", false, false, 1, &bl.quarantineThres)
+	cfg.Int("reject_threshold", false, false, 9999, &bl.rejectThres)
+	cfg.Int("max_domains", false, false, 20, &bl.maxDomains)
+	cfg.DataSize("max_size", false, false, 1024*1024, &bl.maxSize)
+	cfg.StringList("exclude_domains", false, false, nil, &excludeDomains)
+	cfg.Duration("cache_ttl", false, false, 5*time.Minute, &cacheTTL)
+	cfg.Int("cache_size", false, false, 10000, &cacheSize)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	bl.exclude = make(map[string]struct{}, len(excludeDomains))
+	for _, domain := range excludeDomains {
+		aDomain, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "%s: invalid domain in exclude_domains: %s", modName, domain)
+		}
+		bl.exclude[strings.ToLower(aDomain)] = struct{}{}
+	}
+
+	if cacheTTL > 0 && cacheSize > 0 {
+		bl.cache = newLookupCache(cacheTTL, cacheSize)
+	}
+
+	for _, inlineBl := range bl.inlineBls {
+		listCfg := defaultList
+		listCfg.Zone = inlineBl
+		bl.bls = append(bl.bls, listCfg)
+	}
+
+	for _, node := range unknown {
+		if err := bl.readListCfg(node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bl *URIBL) readListCfg(node config.Node) error {
+	var (
+		listCfg      List
+		responseNets []string
+	)
+
+	cfg := config.NewMap(nil, node)
+	cfg.Int("score", false, false, defaultList.ScoreAdj, &listCfg.ScoreAdj)
+	cfg.StringList("responses", false, false, []string{"127.0.0.0/8"}, &responseNets)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, resp := range responseNets {
+		// If there is no / - it is a plain IP address, append
+		// '/32'.
+		if !strings.Contains(resp, "/") {
+			resp += "/32"
+		}
+
+		_, ipNet, err := net.ParseCIDR(resp)
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		listCfg.Responses = append(listCfg.Responses, *ipNet)
+	}
+
+	for _, zone := range append([]string{node.Name}, node.Args...) {
+		zoneCfg := listCfg
+		zoneCfg.Zone = zone
+		bl.bls = append(bl.bls, zoneCfg)
+	}
+
+	return nil
+}
+
+// lookup queries the list for the domain and returns the list of addresses
+// permitted by the list configuration. Empty list is returned if domain is not
+// listed.
+func (bl *URIBL) lookup(ctx context.Context, list List, domain string) ([]net.IP, error) {
+	query := domain + "." + list.Zone
+
+	var addrs []net.IP
+	cached := false
+	if bl.cache != nil {
+		addrs, cached = bl.cache.get(query)
+	}
+	if !cached {
+		ipAddrs, err := bl.resolver.LookupIPAddr(ctx, query)
+		if err != nil {
+			dnsErr, ok := err.(*net.DNSError)
+			if !ok || !dnsErr.IsNotFound {
+				return nil, err
+			}
+		}
+		for _, addr := range ipAddrs {
+			addrs = append(addrs, addr.IP)
+		}
+		if bl.cache != nil {
+			bl.cache.put(query, addrs)
+		}
+	}
+
+	filtered := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		for _, respNet := range list.Responses {
+			if respNet.Contains(addr) {
+				filtered = append(filtered, addr)
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
+
+func (bl *URIBL) checkDomains(ctx context.Context, domains []string) module.CheckResult {
+	var (
+		eg = errgroup.Group{}
+
+		// Protects variables below.
+		lck      sync.Mutex
+		listed   = map[string][]string{}
+		listedOn []string
+	)
+
+	for _, list := range bl.bls {
+		list := list
+		for _, domain := range domains {
+			domain := domain
+			eg.Go(func() error {
+				addrs, err := bl.lookup(ctx, list, domain)
+				if err != nil {
+					return err
+				}
+				if len(addrs) == 0 {
+					return nil
+				}
+
+				lck.Lock()
+				defer lck.Unlock()
+				listed[list.Zone] = append(listed[list.Zone], domain)
+				return nil
+			})
+		}
+	}
+
+	err := eg.Wait()
+	if err != nil {
+		// Lookup error for BL, hard-fail.
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         exterrors.SMTPCode(err, 451, 554),
+				EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 7, 0}),
+				Message:      "DNS error during policy check",
+				Err:          err,
+				CheckName:    modName,
+			},
+		}
+	}
+
+	// Each list contributes its score only once, regardless of how many
+	// domains are listed on it.
+	score := 0
+	var listedDomains []string
+	for _, list := range bl.bls {
+		domains, ok := listed[list.Zone]
+		if !ok {
+			continue
+		}
+		score += list.ScoreAdj
+		listedOn = append(listedOn, list.Zone)
+		listedDomains = append(listedDomains, domains...)
+	}
+	if len(listedOn) == 0 {
+		return module.CheckResult{}
+	}
+	sort.Strings(listedDomains)
+
+	bl.log.DebugMsg("listed", "score", score, "listed_on", listedOn, "domains", listedDomains)
+
+	reason := &exterrors.SMTPError{
+		Code:         554,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Message contains links to blocklisted domains",
+		CheckName:    modName,
+		Misc: map[string]interface{}{
+			"score":     score,
+			"listed_on": listedOn,
+			"domains":   listedDomains,
+		},
+	}
+	if score >= bl.rejectThres {
+		return module.CheckResult{
+			Reject: true,
+			Reason: reason,
+		}
+	}
+	if score >= bl.quarantineThres {
+		return module.CheckResult{
+			Quarantine: true,
+			Reason:     reason,
+		}
+	}
+
+	return module.CheckResult{}
+}
+
+type state struct {
+	bl      *URIBL
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (bl *URIBL) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		bl:      bl,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(bl.log, msgMeta),
+	}, nil
+}
+
+func (*state) CheckConnection(context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckSender(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (*state) CheckRcpt(context.Context, string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	defer bodyR.Close()
+
+	domains, err := extractDomains(hdr, bodyR, s.bl.maxSize, s.bl.maxDomains+len(s.bl.exclude))
+	if err != nil {
+		// Malformed messages are not our business, check whatever was found.
+		s.log.DebugMsg("failed to parse the message", "reason", err)
+	}
+
+	filtered := domains[:0]
+	for _, domain := range domains {
+		if _, ok := s.bl.exclude[domain]; ok {
+			continue
+		}
+		filtered = append(filtered, domain)
+	}
+	if len(filtered) > s.bl.maxDomains {
+		filtered = filtered[:s.bl.maxDomains]
+	}
+	if len(filtered) == 0 {
+		return module.CheckResult{}
+	}
+
+	return s.bl.checkDomains(ctx, filtered)
+}
+
+func (*state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,244 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uribl
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestExtractDomains(t *testing.T) {
+	test := func(msg string, maxDomains int, expected []string) {
+		t.Helper()
+		hdr, body := testutils.BodyFromStr(t, msg)
+		r, err := body.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		domains, err := extractDomains(hdr, r, 1024*1024, maxDomains)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(domains, expected) {
+			t.Errorf("expected %v, got %v", expected, domains)
+		}
+	}
+
+	test("Subject: Test\r\n"+
+		"\r\n"+
+		"Visit https://www.example.org/path?a=b, or http://sub.example.co.uk.\r\n"+
+		"Also www.example.com and https://EXAMPLE.ORG:8080/.\r\n"+
+		"IPs are ignored: http://1.2.3.4/ http://[::1]/\r\n"+
+		"So are hosts without a dot: http://localhost/\r\n", 20,
+		[]string{"example.org", "example.co.uk", "example.com"})
+
+	test("Subject: Test\r\n"+
+		"\r\n"+
+		"https://a.example.org https://b.example.net https://c.example.com\r\n", 2,
+		[]string{"example.org", "example.net"})
+
+	test("Subject: Test\r\n"+
+		"Content-Type: multipart/alternative; boundary=BOUNDARY\r\n"+
+		"\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: text/html\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		// <a href="https://spam.example.net/x">click</a>
+		"PGEgaHJlZj0iaHR0cHM6Ly9zcGFtLmV4YW1wbGUubmV0L3giPmNsaWNrPC9hPg==\r\n"+
+		"--BOUNDARY\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"\r\n"+
+		"https://binary.example.com\r\n"+
+		"--BOUNDARY--\r\n", 20,
+		[]string{"example.net"})
+}
+
+func testURIBL(t *testing.T, zones map[string]mockdns.Zone, bls []List) *URIBL {
+	return &URIBL{
+		bls:             bls,
+		resolver:        &mockdns.Resolver{Zones: zones},
+		log:             testutils.Logger(t, "uribl"),
+		quarantineThres: 1,
+		rejectThres:     2,
+		maxDomains:      20,
+		maxSize:         1024 * 1024,
+		exclude:         map[string]struct{}{},
+	}
+}
+
+func TestCheckDomains(t *testing.T) {
+	test := func(zones map[string]mockdns.Zone, bls []List, domains []string, reject, quarantine bool) {
+		t.Helper()
+		mod := testURIBL(t, zones, bls)
+		result := mod.checkDomains(context.Background(), domains)
+
+		if result.Reject != reject {
+			t.Errorf("Expected Reject = %v, got %v", reject, result.Reject)
+		}
+		if result.Quarantine != quarantine {
+			t.Errorf("Expected Quarantine = %v, got %v", quarantine, result.Quarantine)
+		}
+	}
+
+	list := func(zone string, score int) List {
+		l := defaultList
+		l.Zone = zone
+		l.ScoreAdj = score
+		return l
+	}
+
+	// Not listed.
+	test(nil, []List{list("uribl.example", 1)}, []string{"example.org"}, false, false)
+
+	// Listed, score 1.
+	test(map[string]mockdns.Zone{
+		"example.org.uribl.example.": {A: []string{"127.0.0.2"}},
+	}, []List{list("uribl.example", 1)}, []string{"example.org"}, false, true)
+
+	// Multiple listed domains on the same list count once.
+	test(map[string]mockdns.Zone{
+		"example.org.uribl.example.": {A: []string{"127.0.0.2"}},
+		"example.net.uribl.example.": {A: []string{"127.0.0.2"}},
+	}, []List{list("uribl.example", 1)}, []string{"example.org", "example.net"}, false, true)
+
+	// Scores from different lists add up.
+	test(map[string]mockdns.Zone{
+		"example.org.uribl.example.": {A: []string{"127.0.0.2"}},
+		"example.org.surbl.example.": {A: []string{"127.0.0.2"}},
+	}, []List{list("uribl.example", 1), list("surbl.example", 1)}, []string{"example.org"}, true, false)
+
+	// Responses not permitted by the list configuration are ignored.
+	test(map[string]mockdns.Zone{
+		"example.org.uribl.example.": {A: []string{"127.0.0.1"}},
+	}, []List{{
+		Zone:      "uribl.example",
+		ScoreAdj:  1,
+		Responses: []net.IPNet{{IP: net.IPv4(127, 0, 0, 2), Mask: net.CIDRMask(32, 32)}},
+	}}, []string{"example.org"}, false, false)
+
+	// DNS error, hard-fail.
+	test(map[string]mockdns.Zone{
+		"example.org.uribl.example.": {Err: &net.DNSError{
+			Err:         "i/o timeout",
+			IsTimeout:   true,
+			IsTemporary: true,
+		}},
+	}, []List{list("uribl.example", 1)}, []string{"example.org"}, true, false)
+}
+
+func TestCheckDomains_Cache(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"example.org.uribl.example.": {A: []string{"127.0.0.2"}},
+	}
+	l := defaultList
+	l.Zone = "uribl.example"
+	mod := testURIBL(t, zones, []List{l})
+	mod.cache = newLookupCache(time.Minute, 10)
+
+	if res := mod.checkDomains(context.Background(), []string{"example.org", "example.net"}); !res.Quarantine {
+		t.Fatal("Expected message to be quarantined")
+	}
+
+	// Change the zone contents, cached results should be used.
+	delete(zones, "example.org.uribl.example.")
+	zones["example.net.uribl.example."] = mockdns.Zone{A: []string{"127.0.0.2"}}
+
+	res := mod.checkDomains(context.Background(), []string{"example.org", "example.net"})
+	if !res.Quarantine {
+		t.Fatal("Expected message to be quarantined")
+	}
+	domains := res.Reason.(*exterrors.SMTPError).Misc["domains"]
+	if !reflect.DeepEqual(domains, []string{"example.org"}) {
+		t.Fatal("Cached result is not used:", domains)
+	}
+}
+
+func TestLookupCache_Eviction(t *testing.T) {
+	c := newLookupCache(time.Minute, 2)
+	c.put("a", nil)
+	c.put("b", nil)
+	c.put("c", []net.IP{net.IPv4(127, 0, 0, 2)})
+	if len(c.entries) != 2 {
+		t.Fatal("Cache size limit is not enforced:", len(c.entries))
+	}
+	if addrs, ok := c.get("c"); !ok || len(addrs) != 1 {
+		t.Fatal("Last entry is evicted")
+	}
+
+	c = newLookupCache(-time.Minute, 2)
+	c.put("a", nil)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("Expired entry is returned")
+	}
+}
+
+func TestCheckBody(t *testing.T) {
+	mod, err := New(modName, "", nil, []string{"uribl.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := mod.(*URIBL)
+	bl.resolver = &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"example.org.uribl.example.": {A: []string{"127.0.0.2"}},
+		"example.net.uribl.example.": {A: []string{"127.0.0.2"}},
+	}}
+	bl.log = testutils.Logger(t, modName)
+	err = bl.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "exclude_domains", Args: []string{"example.org"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(body string) module.CheckResult {
+		t.Helper()
+		s, err := bl.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: t.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		hdr, buf := testutils.BodyFromStr(t, "Subject: Test\r\n\r\n"+body)
+		return s.CheckBody(context.Background(), hdr, buf)
+	}
+
+	if res := check("https://example.org/\r\n"); res.Quarantine || res.Reject {
+		t.Fatal("Excluded domain is checked")
+	}
+	res := check("https://example.org/ https://www.example.net/\r\n")
+	if !res.Quarantine {
+		t.Fatal("Expected message to be quarantined")
+	}
+	if !strings.Contains(res.Reason.Error(), "blocklisted") {
+		t.Fatal("Wrong reason:", res.Reason)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package webhook implements the check.http module that delegates message
+// classification to an external HTTP service.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.http"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	url             string
+	headers         http.Header
+	sendBody        bool
+	maxBodySize     int64
+	quarantineScore float64
+	rejectScore     float64
+
+	ioErrAction     modconfig.FailAction
+	errorRespAction modconfig.FailAction
+
+	client *http.Client
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		headers:  http.Header{},
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.url = inlineArgs[0]
+	case 0:
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		tlsConfig tls.Config
+		timeout   time.Duration
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("url", false, c.url == "", c.url, &c.url)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	cfg.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected two arguments: <name> <value>")
+		}
+		c.headers.Add(node.Args[0], node.Args[1])
+		return nil
+	})
+	cfg.Bool("send_body", false, false, &c.sendBody)
+	cfg.DataSize("max_body_size", false, false, 1024*1024, &c.maxBodySize)
+	cfg.Duration("timeout", false, false, 10*time.Second, &timeout)
+	cfg.Float("quarantine_score", false, false, 0, &c.quarantineScore)
+	cfg.Float("reject_score", false, false, 0, &c.rejectScore)
+	cfg.Custom("io_error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.ioErrAction)
+	cfg.Custom("error_resp_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errorRespAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(c.url, "http://") && !strings.HasPrefix(c.url, "https://") {
+		return fmt.Errorf("%s: url should use http or https scheme: %s", modName, c.url)
+	}
+
+	c.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tlsConfig,
+		},
+	}
+
+	return nil
+}
+
+// request is the JSON object sent to the webhook.
+type request struct {
+	MsgID    string              `json:"msg_id"`
+	Conn     *connInfo           `json:"conn,omitempty"`
+	Sender   string              `json:"sender"`
+	Rcpts    []string            `json:"rcpts"`
+	Header   map[string][]string `json:"header"`
+	Size     int                 `json:"size"`
+	Message  []byte              `json:"message,omitempty"`
+	Truncate bool                `json:"truncated,omitempty"`
+}
+
+type connInfo struct {
+	IP       string `json:"ip,omitempty"`
+	Helo     string `json:"helo"`
+	RDNS     string `json:"rdns,omitempty"`
+	AuthUser string `json:"auth_user,omitempty"`
+	Proto    string `json:"proto"`
+	TLS      bool   `json:"tls"`
+}
+
+// response is the JSON object expected from the webhook.
+type response struct {
+	Action       string            `json:"action"`
+	Score        float64           `json:"score"`
+	Message      string            `json:"message"`
+	Code         int               `json:"code"`
+	EnhancedCode string            `json:"enhanced_code"`
+	Headers      map[string]string `json:"headers"`
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.mailFrom = addr
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	s.rcpts = append(s.rcpts, addr)
+	return module.CheckResult{}
+}
+
+func (s *state) buildRequest(ctx context.Context, hdr textproto.Header, body buffer.Buffer) (*request, error) {
+	req := &request{
+		MsgID:  s.msgMeta.ID,
+		Sender: s.mailFrom,
+		Rcpts:  s.rcpts,
+		Header: map[string][]string{},
+		Size:   body.Len(),
+	}
+	if req.Rcpts == nil {
+		req.Rcpts = []string{}
+	}
+
+	for field := hdr.Fields(); field.Next(); {
+		key := http.CanonicalHeaderKey(field.Key())
+		req.Header[key] = append(req.Header[key], field.Value())
+	}
+
+	if conn := s.msgMeta.Conn; conn != nil {
+		req.Conn = &connInfo{
+			Helo:     conn.Hostname,
+			AuthUser: conn.AuthUser,
+			Proto:    conn.Proto,
+			TLS:      conn.TLS.HandshakeComplete,
+		}
+		if tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+			req.Conn.IP = tcpAddr.IP.String()
+		}
+		if conn.RDNSName != nil {
+			name, err := conn.RDNSName.GetContext(ctx)
+			if err == nil && name != nil {
+				req.Conn.RDNS = name.(string)
+			}
+		}
+	}
+
+	if !s.c.sendBody {
+		return req, nil
+	}
+
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		return nil, err
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+	n, err := io.Copy(&msg, io.LimitReader(bodyR, s.c.maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	req.Message = msg.Bytes()
+	req.Truncate = n < int64(body.Len())
+
+	return req, nil
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, modName+"/CheckBody").End()
+
+	req, err := s.buildRequest(ctx, hdr, body)
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+				true,
+			),
+		}
+	}
+	reqBlob, err := json.Marshal(req)
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, "POST", s.c.url, bytes.NewReader(reqBlob))
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	for k, v := range s.c.headers {
+		r.Header[k] = v
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", "maddy")
+
+	resp, err := s.c.client.Do(r)
+	if err != nil {
+		return s.c.ioErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s.c.errorRespAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          fmt.Errorf("HTTP %d", resp.StatusCode),
+			},
+		})
+	}
+
+	var respData response
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return s.c.errorRespAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 9, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+
+	res := s.verdict(respData)
+	for k, v := range respData.Headers {
+		res.Header.Add(k, v)
+	}
+	return res
+}
+
+func (s *state) verdict(respData response) module.CheckResult {
+	action := respData.Action
+	if action == "" || action == "accept" {
+		switch {
+		case s.c.rejectScore != 0 && respData.Score >= s.c.rejectScore:
+			action = "reject"
+		case s.c.quarantineScore != 0 && respData.Score >= s.c.quarantineScore:
+			action = "quarantine"
+		}
+	}
+
+	switch action {
+	case "", "accept":
+		s.log.DebugMsg("message accepted", "score", respData.Score)
+		return module.CheckResult{}
+	case "quarantine":
+		return module.CheckResult{
+			Quarantine: true,
+			Reason:     s.rejectErr(respData, 550, exterrors.EnhancedCode{5, 7, 1}),
+		}
+	case "reject":
+		return module.CheckResult{
+			Reject: true,
+			Reason: s.rejectErr(respData, 550, exterrors.EnhancedCode{5, 7, 1}),
+		}
+	case "tempfail":
+		return module.CheckResult{
+			Reject: true,
+			Reason: s.rejectErr(respData, 451, exterrors.EnhancedCode{4, 7, 1}),
+		}
+	default:
+		return s.c.errorRespAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          fmt.Errorf("unknown action: %s", respData.Action),
+			},
+		})
+	}
+}
+
+// rejectErr builds the error using the code and message from the response,
+// if they match the class of the default code.
+func (s *state) rejectErr(respData response, defCode int, defEnch exterrors.EnhancedCode) *exterrors.SMTPError {
+	err := &exterrors.SMTPError{
+		Code:         defCode,
+		EnhancedCode: defEnch,
+		Message:      "Message rejected due to local policy",
+		CheckName:    modName,
+		Misc: map[string]interface{}{
+			"score":  respData.Score,
+			"action": respData.Action,
+		},
+	}
+	if respData.Message != "" {
+		err.Message = respData.Message
+	}
+	if respData.Code/100 == defCode/100 {
+		err.Code = respData.Code
+	}
+	if ench, ok := parseEnhancedCode(respData.EnhancedCode); ok && ench[0] == defEnch[0] {
+		err.EnhancedCode = ench
+	}
+	return err
+}
+
+func parseEnhancedCode(s string) (exterrors.EnhancedCode, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return exterrors.EnhancedCode{}, false
+	}
+	var code exterrors.EnhancedCode
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return exterrors.EnhancedCode{}, false
+		}
+		code[i] = num
+	}
+	return code, true
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
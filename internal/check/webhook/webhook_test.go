@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testMsg = "From: <foxcpp@example.org>\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello!\r\n"
+
+func testServer(t *testing.T, resp string, lastReq *request, lastHdr *http.Header) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lastReq != nil {
+			if err := json.NewDecoder(r.Body).Decode(lastReq); err != nil {
+				t.Error(err)
+			}
+		}
+		if lastHdr != nil {
+			*lastHdr = r.Header
+		}
+		if resp == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(resp))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func testCheck(t *testing.T, url string, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, []string{url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func runCheck(t *testing.T, c *Check) module.CheckResult {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.CheckSender(context.Background(), "foxcpp@example.org")
+	s.CheckRcpt(context.Background(), "test1@example.org")
+	s.CheckRcpt(context.Background(), "test2@example.org")
+	hdr, body := testutils.BodyFromStr(t, testMsg)
+	return s.CheckBody(context.Background(), hdr, body)
+}
+
+func TestCheck_Request(t *testing.T) {
+	var (
+		req    request
+		reqHdr http.Header
+	)
+	url := testServer(t, `{"action":"accept"}`, &req, &reqHdr)
+
+	res := runCheck(t, testCheck(t, url, []config.Node{
+		{Name: "header", Args: []string{"Authorization", "Bearer secret"}},
+	}))
+	if res.Reject || res.Quarantine || res.Reason != nil {
+		t.Fatal("Unexpected check failure:", res.Reason)
+	}
+	if req.Sender != "foxcpp@example.org" || len(req.Rcpts) != 2 || req.MsgID != "test" {
+		t.Error("Wrong envelope:", req)
+	}
+	if got := req.Header["Subject"]; len(got) != 1 || got[0] != "Test" {
+		t.Error("Wrong header:", req.Header)
+	}
+	if req.Message != nil {
+		t.Error("Body is sent by default")
+	}
+	if got := reqHdr.Get("Authorization"); got != "Bearer secret" {
+		t.Error("Wrong Authorization:", got)
+	}
+
+	runCheck(t, testCheck(t, url, []config.Node{
+		{Name: "send_body", Args: []string{"yes"}},
+	}))
+	if string(req.Message) != testMsg || req.Truncate {
+		t.Errorf("Wrong message: %q", req.Message)
+	}
+
+	runCheck(t, testCheck(t, url, []config.Node{
+		{Name: "send_body", Args: []string{"yes"}},
+		{Name: "max_body_size", Args: []string{"2B"}},
+	}))
+	if !req.Truncate {
+		t.Error("Message is not marked as truncated")
+	}
+}
+
+func TestCheck_Verdict(t *testing.T) {
+	test := func(resp string, cfg []config.Node, reject, quarantine bool, code int) {
+		t.Helper()
+		res := runCheck(t, testCheck(t, testServer(t, resp, nil, nil), cfg))
+		if res.Reject != reject || res.Quarantine != quarantine {
+			t.Errorf("%s: wrong result: reject=%v quarantine=%v", resp, res.Reject, res.Quarantine)
+		}
+		if code == 0 {
+			if res.Reason != nil {
+				t.Errorf("%s: unexpected reason: %v", resp, res.Reason)
+			}
+			return
+		}
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(res.Reason, &smtpErr) || smtpErr.Code != code {
+			t.Errorf("%s: wrong reason: %v", resp, res.Reason)
+		}
+	}
+
+	test(`{"action":"accept"}`, nil, false, false, 0)
+	test(`{"action":"quarantine"}`, nil, false, true, 550)
+	test(`{"action":"reject"}`, nil, true, false, 550)
+	test(`{"action":"reject","code":554,"enhanced_code":"5.7.0","message":"Go away"}`, nil, true, false, 554)
+	test(`{"action":"reject","code":451}`, nil, true, false, 550)
+	test(`{"action":"tempfail"}`, nil, true, false, 451)
+	test(`{"action":"explode"}`, nil, false, false, 451)
+	test(`{"score":5}`, nil, false, false, 0)
+
+	thresholds := []config.Node{
+		{Name: "quarantine_score", Args: []string{"5"}},
+		{Name: "reject_score", Args: []string{"10"}},
+	}
+	test(`{"score":4.9}`, thresholds, false, false, 0)
+	test(`{"score":5}`, thresholds, false, true, 550)
+	test(`{"action":"accept","score":15}`, thresholds, true, false, 550)
+
+	test("", []config.Node{
+		{Name: "error_resp_action", Args: []string{"reject"}},
+	}, true, false, 451)
+}
+
+func TestCheck_Headers(t *testing.T) {
+	url := testServer(t, `{"action":"accept","headers":{"X-Filter-Score":"1.5"}}`, nil, nil)
+	res := runCheck(t, testCheck(t, url, nil))
+	if got := res.Header.Get("X-Filter-Score"); got != "1.5" {
+		t.Error("Wrong X-Filter-Score:", got)
+	}
+}
@@ -1,79 +0,0 @@
-/*
-Maddy Mail Server - Composable all-in-one email server.
-Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
-
-This program is free software: you can redistribute it and/or modify
-it under the terms of the GNU General Public License as published by
-the Free Software Foundation, either version 3 of the License, or
-(at your option) any later version.
-
-This program is distributed in the hope that it will be useful,
-but WITHOUT ANY WARRANTY; without even the implied warranty of
-MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-GNU General Public License for more details.
-
-You should have received a copy of the GNU General Public License
-along with this program.  If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package ctl
-
-import (
-	"fmt"
-
-	imapbackend "github.com/emersion/go-imap/backend"
-	"github.com/foxcpp/maddy/framework/module"
-	"github.com/urfave/cli/v2"
-)
-
-// Copied from go-imap-backend-tests.
-
-// AppendLimitUser is extension for backend.User interface which allows to
-// set append limit value for testing and administration purposes.
-type AppendLimitUser interface {
-	imapbackend.AppendLimitUser
-
-	// SetMessageLimit sets new value for limit.
-	// nil pointer means no limit.
-	SetMessageLimit(val *uint32) error
-}
-
-func imapAcctAppendlimit(be module.Storage, ctx *cli.Context) error {
-	username := ctx.Args().First()
-	if username == "" {
-		return cli.Exit("Error: USERNAME is required", 2)
-	}
-
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
-		return err
-	}
-	userAL, ok := u.(AppendLimitUser)
-	if !ok {
-		return cli.Exit("Error: module.Storage does not support per-user append limit", 2)
-	}
-
-	if ctx.IsSet("value") {
-		val := ctx.Int("value")
-
-		var err error
-		if val == -1 {
-			err = userAL.SetMessageLimit(nil)
-		} else {
-			val32 := uint32(val)
-			err = userAL.SetMessageLimit(&val32)
-		}
-		if err != nil {
-			return err
-		}
-	} else {
-		lim := userAL.CreateMessageLimit()
-		if lim == nil {
-			fmt.Println("No limit")
-		} else {
-			fmt.Println(*lim)
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/foxcpp/maddy"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/urfave/cli/v2"
+)
+
+var controlSocketFlag = &cli.PathFlag{
+	Name:    "socket",
+	Usage:   "Control socket of the running server to use (default: control.sock in runtime_dir from config)",
+	EnvVars: []string{"MADDY_CONTROL_SOCKET"},
+}
+
+var jsonFlag = &cli.BoolFlag{
+	Name:  "json",
+	Usage: "Print the result in JSON format",
+}
+
+// printJSON writes the command result to stdout, it is used instead of
+// the human-readable output if --json is specified.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+func controlSocketPath(ctx *cli.Context) (string, error) {
+	if path := ctx.Path("socket"); path != "" {
+		return path, nil
+	}
+
+	cfgPath := ctx.String("config")
+	if cfgPath == "" {
+		return "", cli.Exit("Error: config is required", 2)
+	}
+	cfgFile, err := os.Open(cfgPath)
+	if err != nil {
+		return "", cli.Exit(fmt.Sprintf("Error: failed to open config: %v", err), 2)
+	}
+	defer cfgFile.Close()
+	cfgNodes, err := parser.Read(cfgFile, cfgFile.Name())
+	if err != nil {
+		return "", cli.Exit(fmt.Sprintf("Error: failed to parse config: %v", err), 2)
+	}
+
+	// Sets config.RuntimeDirectory.
+	if _, _, err := maddy.ReadGlobals(cfgNodes); err != nil {
+		return "", err
+	}
+	return control.DefaultPath(), nil
+}
+
+// callControl connects to the running server and executes the control
+// command.
+func callControl(ctx *cli.Context, command string, args, result interface{}) error {
+	path, err := controlSocketPath(ctx)
+	if err != nil {
+		return err
+	}
+
+	c, err := control.Dial(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Call(command, args, result); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	return nil
+}
+
+// callModule executes the control command that operates on the configuration
+// block specified using --cfg-block.
+//
+// The command is executed by the running server if its control socket is
+// available. Otherwise, the configuration block is initialized in-process,
+// unless the socket is specified explicitly.
+func callModule(ctx *cli.Context, command string, args, result interface{}) error {
+	path, err := controlSocketPath(ctx)
+	if err != nil {
+		return err
+	}
+
+	c, err := control.Dial(path)
+	if err != nil {
+		if ctx.IsSet("socket") {
+			return err
+		}
+		return callLocal(ctx, command, args, result)
+	}
+	defer c.Close()
+
+	if err := c.Call(command, args, result); err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	return nil
+}
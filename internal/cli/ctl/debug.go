@@ -0,0 +1,157 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "debug",
+			Usage: "Debugging utilities for the running server",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "tail",
+					Usage: "Show log messages of the running server as they are written",
+					Description: `Messages are received using the control socket, independently of the log
+configuration. Output uses the same format as the log file, so it can be
+passed to other commands (e.g. maddy trace).
+
+Debug messages are shown only for modules with debug logging enabled, see
+"maddy log level".
+
+Examples:
+  maddy debug tail --module target.remote
+  maddy debug tail --level error
+  maddy debug tail --trace-id 6d0bb5cd0a61f7a4
+`,
+					Flags: []cli.Flag{
+						controlSocketFlag,
+						&cli.StringFlag{
+							Name:  "module",
+							Usage: "Show only messages from the module (same as for maddy log level)",
+						},
+						&cli.StringFlag{
+							Name:  "level",
+							Usage: "Show only messages with at least the specified level: debug, info or error",
+							Value: "debug",
+						},
+						&cli.StringFlag{
+							Name:  "trace-id",
+							Usage: "Show only messages related to the message with the specified trace ID",
+						},
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "Output messages as JSON objects, one per line",
+						},
+					},
+					Action: debugTail,
+				},
+			},
+		})
+}
+
+// tailEntry is the log message as encoded by log.Entry.MarshalJSON.
+type tailEntry struct {
+	Stamp   time.Time              `json:"ts"`
+	Level   log.Level              `json:"level"`
+	Module  string                 `json:"module"`
+	Message string                 `json:"msg"`
+	TraceID string                 `json:"trace_id"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+// format returns the message in the same form as it is written to the log
+// file.
+func (e tailEntry) format() (string, error) {
+	builder := strings.Builder{}
+	builder.WriteString(e.Stamp.UTC().Format("2006-01-02T15:04:05.000Z "))
+	if e.Level == log.LevelDebug {
+		builder.WriteString("[debug] ")
+	}
+	if e.Module != "" {
+		builder.WriteString(e.Module)
+		builder.WriteString(": ")
+	}
+	builder.WriteString(e.Message)
+	builder.WriteRune('\t')
+
+	if e.TraceID != "" {
+		if e.Fields == nil {
+			e.Fields = make(map[string]interface{}, 1)
+		}
+		e.Fields["trace_id"] = e.TraceID
+	}
+	if len(e.Fields) != 0 {
+		fields, err := json.Marshal(e.Fields)
+		if err != nil {
+			return "", err
+		}
+		builder.Write(fields)
+	}
+	return builder.String(), nil
+}
+
+func debugTail(ctx *cli.Context) error {
+	path, err := controlSocketPath(ctx)
+	if err != nil {
+		return err
+	}
+	c, err := control.Dial(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	asJSON := ctx.Bool("json")
+	err = c.Stream("log.tail", control.LogTailArgs{
+		Module:  ctx.String("module"),
+		Level:   log.Level(ctx.String("level")),
+		TraceID: ctx.String("trace-id"),
+	}, func(result json.RawMessage) error {
+		if asJSON {
+			_, err := fmt.Printf("%s\n", result)
+			return err
+		}
+		var e tailEntry
+		if err := json.Unmarshal(result, &e); err != nil {
+			return err
+		}
+		line, err := e.format()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(line)
+		return err
+	})
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "dkim",
+			Usage: "DKIM keys management",
+			Description: `These commands show keys used by modify.dkim instances of the running
+server and DNS records that should be published for them.
+
+The server is contacted using the control socket, by default it is located in
+runtime_dir from maddy.conf.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "keys",
+					Usage: "List DKIM keys and their status",
+					Flags: []cli.Flag{controlSocketFlag, jsonFlag},
+					Action: func(ctx *cli.Context) error {
+						return dkimKeys(ctx)
+					},
+				},
+				{
+					Name:  "records",
+					Usage: "Print DNS records for DKIM keys in the zone file format",
+					Description: `Records for active keys and keys that will be activated by the
+rotation are printed. Records of retired keys are printed only if --all is
+specified.`,
+					Flags: []cli.Flag{
+						controlSocketFlag,
+						jsonFlag,
+						&cli.BoolFlag{
+							Name:  "all",
+							Usage: "Also print records for retired keys",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						return dkimRecords(ctx)
+					},
+				},
+			},
+		})
+}
+
+func dkimKeys(ctx *cli.Context) error {
+	var keys []dkim.KeyInfo
+	if err := callControl(ctx, "dkim.keys", nil, &keys); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(keys)
+	}
+
+	if len(keys) == 0 {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No DKIM keys.")
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tSELECTOR\tSTATUS\tSINCE\tUNTIL")
+	for _, key := range keys {
+		since, until := "-", "-"
+		if !key.Since.IsZero() {
+			since = key.Since.Format(time.RFC1123Z)
+		}
+		if !key.Until.IsZero() {
+			until = key.Until.Format(time.RFC1123Z)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.Domain, key.Selector, key.Status, since, until)
+	}
+	return w.Flush()
+}
+
+// quoteTXT splits the TXT record value into 255 octet strings as required
+// by RFC 1035.
+func quoteTXT(value string) string {
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, `"`+value[:255]+`"`)
+		value = value[255:]
+	}
+	parts = append(parts, `"`+value+`"`)
+	return strings.Join(parts, " ")
+}
+
+func dkimRecords(ctx *cli.Context) error {
+	var keys []dkim.KeyInfo
+	if err := callControl(ctx, "dkim.keys", nil, &keys); err != nil {
+		return err
+	}
+
+	published := make([]dkim.KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		if key.Status == dkim.KeyRetired && !ctx.Bool("all") {
+			continue
+		}
+		published = append(published, key)
+	}
+	if ctx.Bool("json") {
+		return printJSON(published)
+	}
+
+	for _, key := range published {
+		fmt.Printf("; %s key\n", key.Status)
+		fmt.Printf("%s. IN TXT %s\n", key.RecordName, quoteTXT(key.Record))
+	}
+	return nil
+}
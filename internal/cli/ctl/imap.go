@@ -19,7 +19,6 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package ctl
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -28,10 +27,9 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
-	imapsql "github.com/foxcpp/go-imap-sql"
-	"github.com/foxcpp/maddy/framework/module"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
 	"github.com/urfave/cli/v2"
 )
 
@@ -40,6 +38,9 @@ func init() {
 		&cli.Command{
 			Name:  "imap-mboxes",
 			Usage: "IMAP mailboxes (folders) management",
+			Description: `If the server is running, changes are made through it using the control
+socket. Otherwise, the storage configuration block is opened directly.
+`,
 			Subcommands: []*cli.Command{
 				{
 					Name:      "list",
@@ -52,20 +53,15 @@ func init() {
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
+						jsonFlag,
 						&cli.BoolFlag{
 							Name:    "subscribed",
 							Aliases: []string{"s"},
 							Usage:   "List only subscribed mailboxes",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return mboxesList(be, ctx)
-					},
+					Action: mboxesList,
 				},
 				{
 					Name:      "create",
@@ -78,19 +74,13 @@ func init() {
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
 						&cli.StringFlag{
 							Name:  "special",
 							Usage: "Set SPECIAL-USE attribute on mailbox; valid values: archive, drafts, junk, sent, trash",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return mboxesCreate(be, ctx)
-					},
+					Action: mboxesCreate,
 				},
 				{
 					Name:        "remove",
@@ -104,20 +94,14 @@ func init() {
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
 						&cli.BoolFlag{
 							Name:    "yes",
 							Aliases: []string{"y"},
 							Usage:   "Don't ask for confirmation",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return mboxesRemove(be, ctx)
-					},
+					Action: mboxesRemove,
 				},
 				{
 					Name:        "rename",
@@ -131,21 +115,18 @@ func init() {
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return mboxesRename(be, ctx)
-					},
+					Action: mboxesRename,
 				},
 			},
 		})
 	maddycli.AddSubcommand(&cli.Command{
 		Name:  "imap-msgs",
 		Usage: "IMAP messages management",
+		Description: `If the server is running, changes are made through it using the control
+socket. Otherwise, the storage configuration block is opened directly.
+`,
 		Subcommands: []*cli.Command{
 			{
 				Name:        "add",
@@ -159,6 +140,8 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
+					jsonFlag,
 					&cli.StringSliceFlag{
 						Name:    "flag",
 						Aliases: []string{"f"},
@@ -171,14 +154,7 @@ func init() {
 						Usage:   "Set internal date value to specified one in ISO 8601 format (2006-01-02T15:04:05Z07:00)",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsAdd(be, ctx)
-				},
+				Action: msgsAdd,
 			},
 			{
 				Name:        "add-flags",
@@ -192,20 +168,14 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
 					&cli.BoolFlag{
 						Name:    "uid",
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsFlags(be, ctx)
-				},
+				Action: msgsFlags,
 			},
 			{
 				Name:        "rem-flags",
@@ -219,20 +189,14 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
 					&cli.BoolFlag{
 						Name:    "uid",
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsFlags(be, ctx)
-				},
+				Action: msgsFlags,
 			},
 			{
 				Name:        "set-flags",
@@ -246,20 +210,14 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
 					&cli.BoolFlag{
 						Name:    "uid",
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsFlags(be, ctx)
-				},
+				Action: msgsFlags,
 			},
 			{
 				Name:      "remove",
@@ -272,8 +230,9 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
 					&cli.BoolFlag{
-						Name:    "uid,u",
+						Name:    "uid",
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
@@ -283,14 +242,7 @@ func init() {
 						Usage:   "Don't ask for confirmation",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsRemove(be, ctx)
-				},
+				Action: msgsRemove,
 			},
 			{
 				Name:        "copy",
@@ -304,20 +256,14 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
 					&cli.BoolFlag{
 						Name:    "uid",
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsCopy(be, ctx)
-				},
+				Action: msgsCopy,
 			},
 			{
 				Name:        "move",
@@ -331,6 +277,51 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
+					&cli.BoolFlag{
+						Name:    "uid",
+						Aliases: []string{"u"},
+						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
+					},
+				},
+				Action: msgsMove,
+			},
+			{
+				Name:        "learn-spam",
+				Usage:       "Report messages as spam to the junk_learner",
+				Description: "Messages are not moved. junk_learner should be configured for the storage.",
+				ArgsUsage:   "USERNAME MAILBOX SEQSET",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "cfg-block",
+						Usage:   "Module configuration block to use",
+						EnvVars: []string{"MADDY_CFGBLOCK"},
+						Value:   "local_mailboxes",
+					},
+					controlSocketFlag,
+					&cli.BoolFlag{
+						Name:    "uid",
+						Aliases: []string{"u"},
+						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return msgsLearn(ctx, true)
+				},
+			},
+			{
+				Name:        "learn-ham",
+				Usage:       "Report messages as ham (not spam) to the junk_learner",
+				Description: "Messages are not moved. junk_learner should be configured for the storage.",
+				ArgsUsage:   "USERNAME MAILBOX SEQSET",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "cfg-block",
+						Usage:   "Module configuration block to use",
+						EnvVars: []string{"MADDY_CFGBLOCK"},
+						Value:   "local_mailboxes",
+					},
+					controlSocketFlag,
 					&cli.BoolFlag{
 						Name:    "uid",
 						Aliases: []string{"u"},
@@ -338,12 +329,7 @@ func init() {
 					},
 				},
 				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsMove(be, ctx)
+					return msgsLearn(ctx, false)
 				},
 			},
 			{
@@ -358,25 +344,20 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
+					jsonFlag,
 					&cli.BoolFlag{
 						Name:    "uid",
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQSET instead of sequence numbers",
 					},
 					&cli.BoolFlag{
-						Name:    "full,f",
+						Name:    "full",
 						Aliases: []string{"f"},
 						Usage:   "Show entire envelope and all server meta-data",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsList(be, ctx)
-				},
+				Action: msgsList,
 			},
 			{
 				Name:        "dump",
@@ -390,51 +371,36 @@ func init() {
 						EnvVars: []string{"MADDY_CFGBLOCK"},
 						Value:   "local_mailboxes",
 					},
+					controlSocketFlag,
+					jsonFlag,
 					&cli.BoolFlag{
 						Name:    "uid",
 						Aliases: []string{"u"},
 						Usage:   "Use UIDs for SEQ instead of sequence numbers",
 					},
 				},
-				Action: func(ctx *cli.Context) error {
-					be, err := openStorage(ctx)
-					if err != nil {
-						return err
-					}
-					defer closeIfNeeded(be)
-					return msgsDump(be, ctx)
-				},
+				Action: msgsDump,
 			},
 		},
 	})
 }
 
-func FormatAddress(addr *imap.Address) string {
-	return fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName)
-}
-
-func FormatAddressList(addrs []*imap.Address) string {
-	res := make([]string, 0, len(addrs))
-	for _, addr := range addrs {
-		res = append(res, FormatAddress(addr))
-	}
-	return strings.Join(res, ", ")
-}
-
-func mboxesList(be module.Storage, ctx *cli.Context) error {
+func mboxesList(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
 	}
 
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
+	var mboxes []imapsql.MailboxInfo
+	if err := callModule(ctx, "imap_mboxes.list", imapsql.AdminArgs{
+		CfgBlock:   ctx.String("cfg-block"),
+		Username:   username,
+		Subscribed: ctx.Bool("subscribed"),
+	}, &mboxes); err != nil {
 		return err
 	}
-
-	mboxes, err := u.ListMailboxes(ctx.Bool("subscribed,s"))
-	if err != nil {
-		return err
+	if ctx.Bool("json") {
+		return printJSON(mboxes)
 	}
 
 	if len(mboxes) == 0 && !ctx.Bool("quiet") {
@@ -452,7 +418,7 @@ func mboxesList(be module.Storage, ctx *cli.Context) error {
 	return nil
 }
 
-func mboxesCreate(be module.Storage, ctx *cli.Context) error {
+func mboxesCreate(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
@@ -462,27 +428,20 @@ func mboxesCreate(be module.Storage, ctx *cli.Context) error {
 		return cli.Exit("Error: NAME is required", 2)
 	}
 
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
-		return err
+	args := imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Mailbox:  name,
 	}
-
 	if ctx.IsSet("special") {
-		attr := "\\" + strings.Title(ctx.String("special")) //nolint:staticcheck
+		args.SpecialUse = "\\" + strings.Title(ctx.String("special")) //nolint:staticcheck
 		// (nolint) strings.Title is perfectly fine there since special mailbox tags will never use Unicode.
-
-		suu, ok := u.(SpecialUseUser)
-		if !ok {
-			return cli.Exit("Error: storage backend does not support SPECIAL-USE IMAP extension", 2)
-		}
-
-		return suu.CreateMailboxSpecial(name, attr)
 	}
 
-	return u.CreateMailbox(name)
+	return callModule(ctx, "imap_mboxes.create", args, nil)
 }
 
-func mboxesRemove(be module.Storage, ctx *cli.Context) error {
+func mboxesRemove(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
@@ -492,14 +451,15 @@ func mboxesRemove(be module.Storage, ctx *cli.Context) error {
 		return cli.Exit("Error: NAME is required", 2)
 	}
 
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
-		return err
+	args := imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Mailbox:  name,
 	}
 
 	if !ctx.Bool("yes") {
-		status, err := u.Status(name, []imap.StatusItem{imap.StatusMessages})
-		if err != nil {
+		var status imapsql.MailboxStatus
+		if err := callModule(ctx, "imap_mboxes.status", args, &status); err != nil {
 			return err
 		}
 
@@ -512,10 +472,10 @@ func mboxesRemove(be module.Storage, ctx *cli.Context) error {
 		}
 	}
 
-	return u.DeleteMailbox(name)
+	return callModule(ctx, "imap_mboxes.remove", args, nil)
 }
 
-func mboxesRename(be module.Storage, ctx *cli.Context) error {
+func mboxesRename(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
@@ -529,15 +489,15 @@ func mboxesRename(be module.Storage, ctx *cli.Context) error {
 		return cli.Exit("Error: NEWNAME is required", 2)
 	}
 
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
-		return err
-	}
-
-	return u.RenameMailbox(oldName, newName)
+	return callModule(ctx, "imap_mboxes.rename", imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Mailbox:  oldName,
+		Target:   newName,
+	}, nil)
 }
 
-func msgsAdd(be module.Storage, ctx *cli.Context) error {
+func msgsAdd(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
@@ -547,74 +507,72 @@ func msgsAdd(be module.Storage, ctx *cli.Context) error {
 		return cli.Exit("Error: MAILBOX is required", 2)
 	}
 
-	u, err := be.GetIMAPAcct(username)
+	body, err := io.ReadAll(os.Stdin)
 	if err != nil {
 		return err
 	}
-
-	flags := ctx.StringSlice("flag")
-	if flags == nil {
-		flags = []string{}
-	}
-
-	date := time.Now()
-	if ctx.IsSet("date") {
-		date = *ctx.Timestamp("date")
+	if len(body) == 0 {
+		return cli.Exit("Error: Empty message, refusing to continue", 2)
 	}
 
-	buf := bytes.Buffer{}
-	if _, err := io.Copy(&buf, os.Stdin); err != nil {
-		return err
+	args := imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Mailbox:  name,
+		Flags:    ctx.StringSlice("flag"),
+		Body:     body,
 	}
-
-	if buf.Len() == 0 {
-		return cli.Exit("Error: Empty message, refusing to continue", 2)
+	if ctx.IsSet("date") {
+		args.Date = ctx.Timestamp("date")
 	}
 
-	status, err := u.Status(name, []imap.StatusItem{imap.StatusUidNext})
-	if err != nil {
+	var res imapsql.MessageAddResult
+	if err := callModule(ctx, "imap_msgs.add", args, &res); err != nil {
 		return err
 	}
-
-	if err := u.CreateMessage(name, flags, date, &buf, nil); err != nil {
-		return err
+	if ctx.Bool("json") {
+		return printJSON(res)
 	}
 
-	// TODO: Use APPENDUID
-	fmt.Println(status.UidNext)
-
+	fmt.Println(res.UID)
 	return nil
 }
 
-func msgsRemove(be module.Storage, ctx *cli.Context) error {
+// seqArgs returns arguments for commands that operate on the set of
+// messages: USERNAME MAILBOX SEQSET.
+func seqArgs(ctx *cli.Context) (imapsql.AdminArgs, error) {
 	username := ctx.Args().First()
 	if username == "" {
-		return cli.Exit("Error: USERNAME is required", 2)
+		return imapsql.AdminArgs{}, cli.Exit("Error: USERNAME is required", 2)
 	}
 	name := ctx.Args().Get(1)
 	if name == "" {
-		return cli.Exit("Error: MAILBOX is required", 2)
+		return imapsql.AdminArgs{}, cli.Exit("Error: MAILBOX is required", 2)
 	}
 	seqset := ctx.Args().Get(2)
 	if seqset == "" {
-		return cli.Exit("Error: SEQSET is required", 2)
+		return imapsql.AdminArgs{}, cli.Exit("Error: SEQSET is required", 2)
 	}
 
 	if !ctx.Bool("uid") {
 		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
 	}
 
-	seq, err := imap.ParseSeqSet(seqset)
-	if err != nil {
-		return err
+	if _, err := imap.ParseSeqSet(seqset); err != nil {
+		return imapsql.AdminArgs{}, err
 	}
 
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
-		return err
-	}
+	return imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Mailbox:  name,
+		SeqSet:   seqset,
+		UID:      ctx.Bool("uid"),
+	}, nil
+}
 
-	_, mbox, err := u.GetMailbox(name, true, nil)
+func msgsRemove(ctx *cli.Context) error {
+	args, err := seqArgs(ctx)
 	if err != nil {
 		return err
 	}
@@ -625,100 +583,70 @@ func msgsRemove(be module.Storage, ctx *cli.Context) error {
 		}
 	}
 
-	mboxB := mbox.(*imapsql.Mailbox)
-	return mboxB.DelMessages(ctx.Bool("uid"), seq)
+	return callModule(ctx, "imap_msgs.remove", args, nil)
 }
 
-func msgsCopy(be module.Storage, ctx *cli.Context) error {
-	username := ctx.Args().First()
-	if username == "" {
-		return cli.Exit("Error: USERNAME is required", 2)
-	}
-	srcName := ctx.Args().Get(1)
-	if srcName == "" {
-		return cli.Exit("Error: SRCMAILBOX is required", 2)
-	}
-	seqset := ctx.Args().Get(2)
-	if seqset == "" {
-		return cli.Exit("Error: SEQSET is required", 2)
+func msgsCopy(ctx *cli.Context) error {
+	args, err := seqArgs(ctx)
+	if err != nil {
+		return err
 	}
-	tgtName := ctx.Args().Get(3)
-	if tgtName == "" {
+	args.Target = ctx.Args().Get(3)
+	if args.Target == "" {
 		return cli.Exit("Error: TGTMAILBOX is required", 2)
 	}
 
-	if !ctx.Bool("uid") {
-		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
-	}
-
-	seq, err := imap.ParseSeqSet(seqset)
-	if err != nil {
-		return err
-	}
+	return callModule(ctx, "imap_msgs.copy", args, nil)
+}
 
-	u, err := be.GetIMAPAcct(username)
+func msgsMove(ctx *cli.Context) error {
+	args, err := seqArgs(ctx)
 	if err != nil {
 		return err
 	}
-
-	_, srcMbox, err := u.GetMailbox(srcName, true, nil)
-	if err != nil {
-		return err
+	args.Target = ctx.Args().Get(3)
+	if args.Target == "" {
+		return cli.Exit("Error: TGTMAILBOX is required", 2)
 	}
 
-	return srcMbox.CopyMessages(ctx.Bool("uid"), seq, tgtName)
+	return callModule(ctx, "imap_msgs.move", args, nil)
 }
 
-func msgsMove(be module.Storage, ctx *cli.Context) error {
+func msgsLearn(ctx *cli.Context, spam bool) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
 	}
-	srcName := ctx.Args().Get(1)
-	if srcName == "" {
-		return cli.Exit("Error: SRCMAILBOX is required", 2)
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return cli.Exit("Error: MAILBOX is required", 2)
 	}
 	seqset := ctx.Args().Get(2)
 	if seqset == "" {
 		return cli.Exit("Error: SEQSET is required", 2)
 	}
-	tgtName := ctx.Args().Get(3)
-	if tgtName == "" {
-		return cli.Exit("Error: TGTMAILBOX is required", 2)
-	}
 
-	if !ctx.Bool("uid") {
-		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
-	}
-
-	seq, err := imap.ParseSeqSet(seqset)
-	if err != nil {
-		return err
-	}
-
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
-		return err
-	}
-
-	_, srcMbox, err := u.GetMailbox(srcName, true, nil)
-	if err != nil {
-		return err
-	}
-
-	moveMbox := srcMbox.(*imapsql.Mailbox)
-
-	return moveMbox.MoveMessages(ctx.Bool("uid"), seq, tgtName)
+	return callModule(ctx, "imap_msgs.learn", imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Mailbox:  name,
+		SeqSet:   seqset,
+		UID:      ctx.Bool("uid"),
+		Spam:     spam,
+	}, nil)
 }
 
-func msgsList(be module.Storage, ctx *cli.Context) error {
+// listArgs returns arguments for commands that operate on the optional set
+// of messages: USERNAME MAILBOX [SEQSET]. All messages are used if SEQSET
+// is not specified.
+func listArgs(ctx *cli.Context) (imapsql.AdminArgs, error) {
 	username := ctx.Args().First()
 	if username == "" {
-		return cli.Exit("Error: USERNAME is required", 2)
+		return imapsql.AdminArgs{}, cli.Exit("Error: USERNAME is required", 2)
 	}
 	mboxName := ctx.Args().Get(1)
 	if mboxName == "" {
-		return cli.Exit("Error: MAILBOX is required", 2)
+		return imapsql.AdminArgs{}, cli.Exit("Error: MAILBOX is required", 2)
 	}
 	seqset := ctx.Args().Get(2)
 	uid := ctx.Bool("uid")
@@ -729,165 +657,123 @@ func msgsList(be module.Storage, ctx *cli.Context) error {
 		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
 	}
 
-	seq, err := imap.ParseSeqSet(seqset)
-	if err != nil {
-		return err
+	if _, err := imap.ParseSeqSet(seqset); err != nil {
+		return imapsql.AdminArgs{}, err
 	}
 
-	u, err := be.GetIMAPAcct(username)
+	return imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Mailbox:  mboxName,
+		SeqSet:   seqset,
+		UID:      uid,
+	}, nil
+}
+
+func msgsList(ctx *cli.Context) error {
+	args, err := listArgs(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, mbox, err := u.GetMailbox(mboxName, true, nil)
-	if err != nil {
+	var msgs []imapsql.MessageInfo
+	if err := callModule(ctx, "imap_msgs.list", args, &msgs); err != nil {
 		return err
 	}
+	if ctx.Bool("json") {
+		return printJSON(msgs)
+	}
 
-	ch := make(chan *imap.Message, 10)
-	go func() {
-		err = mbox.ListMessages(uid, seq, []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchFlags, imap.FetchUid}, ch)
-	}()
+	for _, msg := range msgs {
+		var date time.Time
+		if msg.Date != nil {
+			date = *msg.Date
+		}
 
-	for msg := range ch {
 		if !ctx.Bool("full") {
-			fmt.Printf("UID %d: %s - %s\n  %v, %v\n\n", msg.Uid, FormatAddressList(msg.Envelope.From), msg.Envelope.Subject, msg.Flags, msg.Envelope.Date)
+			fmt.Printf("UID %d: %s - %s\n  %v, %v\n\n", msg.UID, strings.Join(msg.From, ", "), msg.Subject, msg.Flags, date)
 			continue
 		}
 
 		fmt.Println("- Server meta-data:")
-		fmt.Println("UID:", msg.Uid)
+		fmt.Println("UID:", msg.UID)
 		fmt.Println("Sequence number:", msg.SeqNum)
 		fmt.Println("Flags:", msg.Flags)
 		fmt.Println("Body size:", msg.Size)
 		fmt.Println("Internal date:", msg.InternalDate.Unix(), msg.InternalDate)
 		fmt.Println("- Envelope:")
-		if len(msg.Envelope.From) != 0 {
-			fmt.Println("From:", FormatAddressList(msg.Envelope.From))
+		if len(msg.From) != 0 {
+			fmt.Println("From:", strings.Join(msg.From, ", "))
 		}
-		if len(msg.Envelope.To) != 0 {
-			fmt.Println("To:", FormatAddressList(msg.Envelope.To))
+		if len(msg.To) != 0 {
+			fmt.Println("To:", strings.Join(msg.To, ", "))
 		}
-		if len(msg.Envelope.Cc) != 0 {
-			fmt.Println("CC:", FormatAddressList(msg.Envelope.Cc))
+		if len(msg.Cc) != 0 {
+			fmt.Println("CC:", strings.Join(msg.Cc, ", "))
 		}
-		if len(msg.Envelope.Bcc) != 0 {
-			fmt.Println("BCC:", FormatAddressList(msg.Envelope.Bcc))
+		if len(msg.Bcc) != 0 {
+			fmt.Println("BCC:", strings.Join(msg.Bcc, ", "))
 		}
-		if msg.Envelope.InReplyTo != "" {
-			fmt.Println("In-Reply-To:", msg.Envelope.InReplyTo)
+		if msg.InReplyTo != "" {
+			fmt.Println("In-Reply-To:", msg.InReplyTo)
 		}
-		if msg.Envelope.MessageId != "" {
-			fmt.Println("Message-Id:", msg.Envelope.MessageId)
+		if msg.MessageID != "" {
+			fmt.Println("Message-Id:", msg.MessageID)
 		}
-		if !msg.Envelope.Date.IsZero() {
-			fmt.Println("Date:", msg.Envelope.Date.Unix(), msg.Envelope.Date)
+		if msg.Date != nil {
+			fmt.Println("Date:", date.Unix(), date)
 		}
-		if msg.Envelope.Subject != "" {
-			fmt.Println("Subject:", msg.Envelope.Subject)
+		if msg.Subject != "" {
+			fmt.Println("Subject:", msg.Subject)
 		}
 		fmt.Println()
 	}
-	return err
+	return nil
 }
 
-func msgsDump(be module.Storage, ctx *cli.Context) error {
-	username := ctx.Args().First()
-	if username == "" {
-		return cli.Exit("Error: USERNAME is required", 2)
-	}
-	mboxName := ctx.Args().Get(1)
-	if mboxName == "" {
-		return cli.Exit("Error: MAILBOX is required", 2)
-	}
-	seqset := ctx.Args().Get(2)
-	uid := ctx.Bool("uid")
-	if seqset == "" {
-		seqset = "1:*"
-		uid = true
-	} else if !uid {
-		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
-	}
-
-	seq, err := imap.ParseSeqSet(seqset)
+func msgsDump(ctx *cli.Context) error {
+	args, err := listArgs(ctx)
 	if err != nil {
 		return err
 	}
 
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
+	var msgs []imapsql.MessageBody
+	if err := callModule(ctx, "imap_msgs.dump", args, &msgs); err != nil {
 		return err
 	}
-
-	_, mbox, err := u.GetMailbox(mboxName, true, nil)
-	if err != nil {
-		return err
+	if ctx.Bool("json") {
+		return printJSON(msgs)
 	}
 
-	ch := make(chan *imap.Message, 10)
-	go func() {
-		err = mbox.ListMessages(uid, seq, []imap.FetchItem{imap.FetchRFC822}, ch)
-	}()
-
-	for msg := range ch {
-		for _, v := range msg.Body {
-			if _, err := io.Copy(os.Stdout, v); err != nil {
-				return err
-			}
+	for _, msg := range msgs {
+		if _, err := os.Stdout.Write(msg.Body); err != nil {
+			return err
 		}
 	}
-	return err
+	return nil
 }
 
-func msgsFlags(be module.Storage, ctx *cli.Context) error {
-	username := ctx.Args().First()
-	if username == "" {
-		return cli.Exit("Error: USERNAME is required", 2)
-	}
-	name := ctx.Args().Get(1)
-	if name == "" {
-		return cli.Exit("Error: MAILBOX is required", 2)
-	}
-	seqStr := ctx.Args().Get(2)
-	if seqStr == "" {
-		return cli.Exit("Error: SEQ is required", 2)
-	}
-
-	if !ctx.Bool("uid") {
-		fmt.Fprintln(os.Stderr, "WARNING: --uid=true will be the default in 0.7")
-	}
-
-	seq, err := imap.ParseSeqSet(seqStr)
-	if err != nil {
-		return err
-	}
-
-	u, err := be.GetIMAPAcct(username)
-	if err != nil {
-		return err
-	}
-
-	_, mbox, err := u.GetMailbox(name, false, nil)
+func msgsFlags(ctx *cli.Context) error {
+	args, err := seqArgs(ctx)
 	if err != nil {
 		return err
 	}
 
-	flags := ctx.Args().Slice()[3:]
-	if len(flags) == 0 {
+	args.Flags = ctx.Args().Slice()[3:]
+	if len(args.Flags) == 0 {
 		return cli.Exit("Error: at least once FLAG is required", 2)
 	}
 
-	var op imap.FlagsOp
 	switch ctx.Command.Name {
 	case "add-flags":
-		op = imap.AddFlags
+		args.FlagsOp = "add"
 	case "rem-flags":
-		op = imap.RemoveFlags
+		args.FlagsOp = "remove"
 	case "set-flags":
-		op = imap.SetFlags
+		args.FlagsOp = "set"
 	default:
 		panic("unknown command: " + ctx.Command.Name)
 	}
 
-	return mbox.UpdateMessagesFlags(ctx.Bool("uid"), seq, op, true, flags)
+	return callModule(ctx, "imap_msgs.flags", args, nil)
 }
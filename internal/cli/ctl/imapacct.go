@@ -24,9 +24,9 @@ import (
 	"os"
 
 	"github.com/emersion/go-imap"
-	"github.com/foxcpp/maddy/framework/module"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
 	"github.com/urfave/cli/v2"
 )
 
@@ -46,6 +46,9 @@ flag for subcommands.
 Note that in default configuration it is not enough to create an IMAP storage
 account to grant server access. Additionally, user credentials should
 be created using 'creds' subcommand.
+
+If the server is running, changes are made through it using the control
+socket. Otherwise, the configuration block is opened directly.
 `,
 			Subcommands: []*cli.Command{
 				{
@@ -58,15 +61,10 @@ be created using 'creds' subcommand.
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
+						jsonFlag,
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return imapAcctList(be, ctx)
-					},
+					Action: imapAcctList,
 				},
 				{
 					Name:  "create",
@@ -81,6 +79,8 @@ creates a set of default folder (mailboxes) with special-use attribute set.`,
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
+						jsonFlag,
 						&cli.StringFlag{
 							Name:  "sent-name",
 							Usage: "Name of special mailbox for sent messages, use empty string to not create any",
@@ -107,14 +107,7 @@ creates a set of default folder (mailboxes) with special-use attribute set.`,
 							Value: "Archive",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return imapAcctCreate(be, ctx)
-					},
+					Action: imapAcctCreate,
 				},
 				{
 					Name:  "remove",
@@ -130,20 +123,14 @@ or other buffering takes effect.`,
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
 						&cli.BoolFlag{
 							Name:    "yes",
 							Aliases: []string{"y"},
 							Usage:   "Don't ask for confirmation",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return imapAcctRemove(be, ctx)
-					},
+					Action: imapAcctRemove,
 				},
 				{
 					Name:  "appendlimit",
@@ -166,39 +153,28 @@ APPENDLIMIT value (either global or per-account) cannot be larger than
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_mailboxes",
 						},
+						controlSocketFlag,
+						jsonFlag,
 						&cli.IntFlag{
 							Name:    "value",
 							Aliases: []string{"v"},
 							Usage:   "Set APPENDLIMIT to specified value (in bytes)",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return imapAcctAppendlimit(be, ctx)
-					},
+					Action: imapAcctAppendlimit,
 				},
 			},
 		})
 }
 
-type SpecialUseUser interface {
-	CreateMailboxSpecial(name, specialUseAttr string) error
-}
-
-func imapAcctList(be module.Storage, ctx *cli.Context) error {
-	mbe, ok := be.(module.ManageableStorage)
-	if !ok {
-		return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
-	}
-
-	list, err := mbe.ListIMAPAccts()
-	if err != nil {
+func imapAcctList(ctx *cli.Context) error {
+	var list []string
+	if err := callModule(ctx, "imap_acct.list", imapsql.AdminArgs{CfgBlock: ctx.String("cfg-block")}, &list); err != nil {
 		return err
 	}
+	if ctx.Bool("json") {
+		return printJSON(list)
+	}
 
 	if len(list) == 0 && !ctx.Bool("quiet") {
 		fmt.Fprintln(os.Stderr, "No users.")
@@ -210,73 +186,48 @@ func imapAcctList(be module.Storage, ctx *cli.Context) error {
 	return nil
 }
 
-func imapAcctCreate(be module.Storage, ctx *cli.Context) error {
-	mbe, ok := be.(module.ManageableStorage)
-	if !ok {
-		return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
-	}
-
+func imapAcctCreate(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
 	}
 
-	if err := mbe.CreateIMAPAcct(username); err != nil {
-		return err
-	}
-
-	act, err := mbe.GetIMAPAcct(username)
-	if err != nil {
-		return fmt.Errorf("failed to get user: %w", err)
+	args := imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
 	}
-
-	suu, ok := act.(SpecialUseUser)
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Note: Storage backend does not support SPECIAL-USE IMAP extension")
-	}
-
-	createMbox := func(name, specialUseAttr string) error {
-		if suu == nil {
-			return act.CreateMailbox(name)
+	for _, mbox := range []struct {
+		flag, attr string
+	}{
+		{"sent-name", imap.SentAttr},
+		{"trash-name", imap.TrashAttr},
+		{"junk-name", imap.JunkAttr},
+		{"drafts-name", imap.DraftsAttr},
+		{"archive-name", imap.ArchiveAttr},
+	} {
+		if name := ctx.String(mbox.flag); name != "" {
+			args.SpecialMailboxes = append(args.SpecialMailboxes, imapsql.MailboxInfo{
+				Name:       name,
+				Attributes: []string{mbox.attr},
+			})
 		}
-		return suu.CreateMailboxSpecial(name, specialUseAttr)
 	}
 
-	if name := ctx.String("sent-name"); name != "" {
-		if err := createMbox(name, imap.SentAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create sent folder: %v", err)
-		}
-	}
-	if name := ctx.String("trash-name"); name != "" {
-		if err := createMbox(name, imap.TrashAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create trash folder: %v", err)
-		}
-	}
-	if name := ctx.String("junk-name"); name != "" {
-		if err := createMbox(name, imap.JunkAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create junk folder: %v", err)
-		}
-	}
-	if name := ctx.String("drafts-name"); name != "" {
-		if err := createMbox(name, imap.DraftsAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create drafts folder: %v", err)
-		}
+	var res imapsql.AcctCreateResult
+	if err := callModule(ctx, "imap_acct.create", args, &res); err != nil {
+		return err
 	}
-	if name := ctx.String("archive-name"); name != "" {
-		if err := createMbox(name, imap.ArchiveAttr); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create archive folder: %v", err)
-		}
+	if ctx.Bool("json") {
+		return printJSON(res)
 	}
 
+	for _, warn := range res.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warn)
+	}
 	return nil
 }
 
-func imapAcctRemove(be module.Storage, ctx *cli.Context) error {
-	mbe, ok := be.(module.ManageableStorage)
-	if !ok {
-		return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
-	}
-
+func imapAcctRemove(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
@@ -288,5 +239,42 @@ func imapAcctRemove(be module.Storage, ctx *cli.Context) error {
 		}
 	}
 
-	return mbe.DeleteIMAPAcct(username)
+	return callModule(ctx, "imap_acct.remove", imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+	}, nil)
+}
+
+func imapAcctAppendlimit(ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	args := imapsql.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+	}
+	if ctx.IsSet("value") {
+		val := int64(ctx.Int("value"))
+		args.AppendLimit = &val
+	}
+
+	var res imapsql.AppendLimit
+	if err := callModule(ctx, "imap_acct.appendlimit", args, &res); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(res)
+	}
+	if ctx.IsSet("value") {
+		return nil
+	}
+
+	if res.Limit == nil {
+		fmt.Println("No limit")
+	} else {
+		fmt.Println(*res.Limit)
+	}
+	return nil
 }
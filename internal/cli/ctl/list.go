@@ -0,0 +1,140 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/target/list"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:     "cfg-block",
+		Usage:    "Module configuration block to use",
+		EnvVars:  []string{"MADDY_CFGBLOCK"},
+		Required: true,
+	}
+
+	listCmd := func(name, usage, argsUsage string, action cli.ActionFunc, flags ...cli.Flag) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags:     append([]cli.Flag{cfgBlockFlag, controlSocketFlag}, flags...),
+			Action:    action,
+		}
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "list",
+			Usage: "Mailing list management",
+			Description: `These commands manage members and held messages of mailing lists
+defined using target.list.
+
+Corresponding target.list module should be defined in maddy.conf as a
+top-level config block, the block name is specified using --cfg-block
+argument for subcommands.
+
+If the server is running, changes are made through it using the control
+socket. Otherwise, the configuration block is opened directly.
+`,
+			Subcommands: []*cli.Command{
+				listCmd("members", "List members of the list", "", listMembers, jsonFlag),
+				listCmd("subscribe", "Add the address to the list", "ADDRESS", listSubscribe),
+				listCmd("unsubscribe", "Remove the address from the list", "ADDRESS", listUnsubscribe),
+				listCmd("held", "List messages waiting for moderator approval", "", listHeld, jsonFlag),
+				listCmd("approve", "Distribute the held message", "ID", listApprove),
+				listCmd("reject", "Discard the held message", "ID", listReject),
+			},
+		})
+}
+
+func listMembers(ctx *cli.Context) error {
+	var members []string
+	if err := callModule(ctx, "list.members", list.AdminArgs{CfgBlock: ctx.String("cfg-block")}, &members); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(members)
+	}
+
+	if len(members) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No members.")
+	}
+	for _, member := range members {
+		fmt.Println(member)
+	}
+	return nil
+}
+
+func listSubscribe(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+	return callModule(ctx, "list.subscribe", list.AdminArgs{CfgBlock: ctx.String("cfg-block"), Address: addr}, nil)
+}
+
+func listUnsubscribe(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+	return callModule(ctx, "list.unsubscribe", list.AdminArgs{CfgBlock: ctx.String("cfg-block"), Address: addr}, nil)
+}
+
+func listHeld(ctx *cli.Context) error {
+	var held []list.HeldInfo
+	if err := callModule(ctx, "list.held", list.AdminArgs{CfgBlock: ctx.String("cfg-block")}, &held); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(held)
+	}
+
+	if len(held) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No held messages.")
+	}
+	for _, msg := range held {
+		fmt.Printf("%s %s %s %q\n", msg.ID, msg.Received.Format(time.RFC3339), msg.Sender, msg.Subject)
+	}
+	return nil
+}
+
+func listApprove(ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return cli.Exit("Error: ID is required", 2)
+	}
+	return callModule(ctx, "list.approve", list.AdminArgs{CfgBlock: ctx.String("cfg-block"), ID: id}, nil)
+}
+
+func listReject(ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return cli.Exit("Error: ID is required", 2)
+	}
+	return callModule(ctx, "list.reject", list.AdminArgs{CfgBlock: ctx.String("cfg-block"), ID: id}, nil)
+}
@@ -0,0 +1,203 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/history"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "log",
+			Usage: "Logging control and delivery history",
+			Description: `These commands change logging settings of the running server without
+restarting it and search the delivery history. Logging changes are not
+persisted and are lost on restart.
+
+The server is contacted using the control socket, by default it is located in
+runtime_dir from maddy.conf.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "level",
+					Usage: "Enable or disable debug logging",
+					Description: `LEVEL is one of:
+  debug - write debug messages
+  info  - do not write debug messages
+  reset - use the value from the configuration
+
+If MODULE is specified, the level is changed only for it. MODULE is the name
+shown in log messages (e.g. remote or smtp, also matches smtp/sasl), the full
+module name (e.g. target.remote) or the configuration block name to change the
+level only for a specific instance (e.g. outbound_delivery). Level set for a
+module takes precedence over the level set for all modules.
+
+Use "maddy log level reset" to remove all changes.
+
+Examples:
+  maddy log level debug target.remote
+  maddy log level info
+`,
+					ArgsUsage: "LEVEL [MODULE]",
+					Flags:     []cli.Flag{controlSocketFlag, jsonFlag},
+					Action: func(ctx *cli.Context) error {
+						level := ctx.Args().First()
+						if level == "" {
+							return cli.Exit("Error: LEVEL is required", 2)
+						}
+						var overrides []log.DebugOverride
+						if err := callControl(ctx, "log.set_level", control.LogLevelArgs{
+							Module: ctx.Args().Get(1),
+							Level:  level,
+						}, &overrides); err != nil {
+							return err
+						}
+						return printLogLevels(ctx, overrides)
+					},
+				},
+				{
+					Name:  "levels",
+					Usage: "Show log levels changed at runtime",
+					Flags: []cli.Flag{controlSocketFlag, jsonFlag},
+					Action: func(ctx *cli.Context) error {
+						var overrides []log.DebugOverride
+						if err := callControl(ctx, "log.levels", nil, &overrides); err != nil {
+							return err
+						}
+						return printLogLevels(ctx, overrides)
+					},
+				},
+				{
+					Name:  "search",
+					Usage: "Search the delivery history",
+					Description: `Show what happened to messages: whether they were received or rejected and
+how delivery attempts ended. delivery_history should be enabled in
+maddy.conf. Conditions are combined, addresses are matched
+case-insensitively.
+
+Examples:
+  maddy log search --rcpt foxcpp@example.org --since 24h
+  maddy log search --id 7ee3cdb6
+`,
+					Flags: []cli.Flag{
+						controlSocketFlag,
+						jsonFlag,
+						&cli.StringFlag{
+							Name:  "rcpt",
+							Usage: "Show events for the recipient address",
+						},
+						&cli.StringFlag{
+							Name:  "sender",
+							Usage: "Show events for messages from the sender address",
+						},
+						&cli.StringFlag{
+							Name:  "id",
+							Usage: "Show events for the message ID",
+						},
+						&cli.DurationFlag{
+							Name:  "since",
+							Usage: "Show only events that happened during the specified period",
+						},
+						&cli.IntFlag{
+							Name:  "limit",
+							Usage: "Maximum amount of events to show, most recent are shown",
+							Value: 100,
+						},
+					},
+					Action: logSearch,
+				},
+			},
+		})
+}
+
+func logSearch(ctx *cli.Context) error {
+	q := history.Query{
+		MsgID:  ctx.String("id"),
+		Sender: ctx.String("sender"),
+		Rcpt:   ctx.String("rcpt"),
+		Limit:  ctx.Int("limit"),
+	}
+	if q.MsgID == "" && q.Sender == "" && q.Rcpt == "" {
+		return cli.Exit("Error: at least one of --rcpt, --sender or --id is required", 2)
+	}
+	if since := ctx.Duration("since"); since != 0 {
+		q.Since = time.Now().Add(-since)
+	}
+
+	var events []history.Event
+	if err := callControl(ctx, "log.search", q, &events); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		if events == nil {
+			events = []history.Event{}
+		}
+		return printJSON(events)
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(os.Stderr, "No matching events.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tID\tEVENT\tMODULE\tFROM\tRCPT\tDETAILS")
+	for _, ev := range events {
+		from := ev.Sender
+		if from == "" {
+			from = "<>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ev.Time.Local().Format(time.DateTime), ev.MsgID, ev.Kind, ev.Module, from, ev.Rcpt, ev.Details)
+	}
+	return w.Flush()
+}
+
+func printLogLevels(ctx *cli.Context, overrides []log.DebugOverride) error {
+	if ctx.Bool("json") {
+		if overrides == nil {
+			overrides = []log.DebugOverride{}
+		}
+		return printJSON(overrides)
+	}
+	if len(overrides) == 0 {
+		fmt.Println("No changes, levels from the configuration are used.")
+		return nil
+	}
+	for _, o := range overrides {
+		module := o.Module
+		if module == "" {
+			module = "(all modules)"
+		}
+		level := "info"
+		if o.Debug {
+			level = "debug"
+		}
+		fmt.Printf("%s: %s\n", module, level)
+	}
+	return nil
+}
@@ -19,26 +19,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package ctl
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 
 	"github.com/foxcpp/maddy"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
-	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/urfave/cli/v2"
 )
 
-func closeIfNeeded(i interface{}) {
-	if c, ok := i.(io.Closer); ok {
-		c.Close()
-	}
-}
-
 func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
 	cfgPath := ctx.String("config")
 	if cfgPath == "" {
@@ -88,46 +82,43 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 	return globals, &mod, nil
 }
 
-func openStorage(ctx *cli.Context) (module.Storage, error) {
-	globals, mod, err := getCfgBlockModule(ctx)
+// callLocal initializes the configuration block specified using --cfg-block
+// in-process and executes the control command for it. It is used by
+// callModule if the server is not running.
+func callLocal(ctx *cli.Context, command string, args, result interface{}) error {
+	_, mod, err := getCfgBlockModule(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	storage, ok := mod.Instance.(module.Storage)
-	if !ok {
-		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not an IMAP storage", ctx.String("cfg-block")), 2)
-	}
-
-	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
-		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	// Initialized modules are closed using shutdown hooks.
+	defer hooks.RunHooks(hooks.EventShutdown)
+	inst, err := module.GetInstance(mod.Instance.InstanceName())
+	if err != nil {
+		return fmt.Errorf("Error: module initialization failed: %w", err)
 	}
 
-	if updStore, ok := mod.Instance.(updatepipe.Backend); ok {
+	if updStore, ok := inst.(updatepipe.Backend); ok {
 		if err := updStore.EnableUpdatePipe(updatepipe.ModePush); err != nil && !errors.Is(err, os.ErrNotExist) {
 			fmt.Fprintf(os.Stderr, "Failed to initialize update pipe, do not remove messages from mailboxes open by clients: %v\n", err)
 		}
-	} else {
+	} else if _, ok := inst.(module.Storage); ok {
 		fmt.Fprintf(os.Stderr, "No update pipe support, do not remove messages from mailboxes open by clients\n")
 	}
 
-	return storage, nil
-}
-
-func openUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
-	globals, mod, err := getCfgBlockModule(ctx)
+	res, err := control.Call(command, args)
 	if err != nil {
-		return nil, err
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
 	}
-
-	userDB, ok := mod.Instance.(module.PlainUserDB)
-	if !ok {
-		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not a local credentials store", ctx.String("cfg-block")), 2)
+	if result == nil || res == nil {
+		return nil
 	}
 
-	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
-		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	// Pass the result through JSON so it is decoded the same way as
+	// the one received from the server.
+	resBlob, err := json.Marshal(res)
+	if err != nil {
+		return err
 	}
-
-	return userDB, nil
+	return json.Unmarshal(resBlob, result)
 }
@@ -0,0 +1,214 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/modify/pgp"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "local_pgp",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "pgp",
+			Usage: "OpenPGP keys management for encryption at rest",
+			Description: `These commands manage public keys used by modify.pgp_encrypt.
+
+Corresponding modify.pgp_encrypt module should be defined in maddy.conf as
+a top-level config block. By default the block name should be local_pgp (
+can be changed using --cfg-block argument for subcommands).
+
+If the server is running, changes are made through it using the control
+socket. Otherwise, the configuration block is opened directly.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List addresses with keys",
+					Flags:  []cli.Flag{cfgBlockFlag, controlSocketFlag, jsonFlag},
+					Action: pgpList,
+				},
+				{
+					Name:      "show",
+					Usage:     "Show keys of the address",
+					ArgsUsage: "ADDRESS",
+					Flags:     []cli.Flag{cfgBlockFlag, controlSocketFlag, jsonFlag},
+					Action:    pgpShow,
+				},
+				{
+					Name:  "import",
+					Usage: "Set the key of the address",
+					Description: `Reads the key in binary or ASCII-armored format from FILE or stdin.
+
+Existing key of the address is replaced.
+`,
+					ArgsUsage: "ADDRESS [FILE]",
+					Flags:     []cli.Flag{cfgBlockFlag, controlSocketFlag, jsonFlag},
+					Action:    pgpImport,
+				},
+				{
+					Name:  "fetch",
+					Usage: "Set the key of the address using Web Key Directory",
+					Description: `Fetches the key from OpenPGP Web Key Directory (WKD) of the address domain.
+
+Existing key of the address is replaced.
+`,
+					ArgsUsage: "ADDRESS",
+					Flags:     []cli.Flag{cfgBlockFlag, controlSocketFlag, jsonFlag},
+					Action:    pgpFetch,
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove the key of the address and disable encryption for it",
+					ArgsUsage: "ADDRESS",
+					Flags:     []cli.Flag{cfgBlockFlag, controlSocketFlag},
+					Action:    pgpRemove,
+				},
+			},
+		})
+}
+
+func pgpList(ctx *cli.Context) error {
+	var addrs []string
+	if err := callModule(ctx, "pgp.list", pgp.AdminArgs{CfgBlock: ctx.String("cfg-block")}, &addrs); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(addrs)
+	}
+
+	if len(addrs) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No keys.")
+	}
+	for _, addr := range addrs {
+		fmt.Println(addr)
+	}
+	return nil
+}
+
+func printKeys(keys []pgp.KeyInfo) {
+	for _, k := range keys {
+		fmt.Println("Fingerprint:", k.Fingerprint)
+		fmt.Println("Created:", k.Created.Format(time.RFC1123Z))
+		for _, name := range k.UserIDs {
+			fmt.Println("User ID:", name)
+		}
+		fmt.Println()
+	}
+}
+
+func pgpShow(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+
+	var keys []pgp.KeyInfo
+	if err := callModule(ctx, "pgp.show", pgp.AdminArgs{CfgBlock: ctx.String("cfg-block"), Address: addr}, &keys); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(keys)
+	}
+
+	printKeys(keys)
+	return nil
+}
+
+func pgpImport(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+
+	var (
+		keyData []byte
+		err     error
+	)
+	if path := ctx.Args().Get(1); path != "" {
+		keyData, err = os.ReadFile(path)
+	} else {
+		keyData, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	entities, err := pgp.ParseKey(keyData)
+	if err != nil {
+		return err
+	}
+	if !pgp.HasAddress(entities, addr) {
+		fmt.Fprintln(os.Stderr, "Warning: key user IDs do not contain the address")
+	}
+
+	var keys []pgp.KeyInfo
+	if err := callModule(ctx, "pgp.import", pgp.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Address:  addr,
+		Key:      keyData,
+	}, &keys); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(keys)
+	}
+	return nil
+}
+
+func pgpFetch(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+
+	var keys []pgp.KeyInfo
+	if err := callModule(ctx, "pgp.fetch", pgp.AdminArgs{CfgBlock: ctx.String("cfg-block"), Address: addr}, &keys); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(keys)
+	}
+
+	for _, k := range keys {
+		fmt.Println("Fingerprint:", k.Fingerprint)
+	}
+	return nil
+}
+
+func pgpRemove(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+	return callModule(ctx, "pgp.remove", pgp.AdminArgs{CfgBlock: ctx.String("cfg-block"), Address: addr}, nil)
+}
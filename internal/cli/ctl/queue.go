@@ -0,0 +1,449 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	queueFlag := &cli.StringFlag{
+		Name:  "queue",
+		Usage: "Act only on the specified queue (config block name or location for inline queues)",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "queue",
+			Usage: "Outbound queue management",
+			Description: `These commands inspect and manage messages stored in target.queue
+instances of the running server.
+
+The server is contacted using the control socket, by default it is located in
+runtime_dir from maddy.conf.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List queued messages",
+					Flags: []cli.Flag{controlSocketFlag, queueFlag, jsonFlag},
+					Action: func(ctx *cli.Context) error {
+						return queueList(ctx)
+					},
+				},
+				{
+					Name:      "show",
+					Usage:     "Show queued message details",
+					ArgsUsage: "MSGID",
+					Flags:     []cli.Flag{controlSocketFlag, queueFlag, jsonFlag},
+					Action: func(ctx *cli.Context) error {
+						return queueShow(ctx, false)
+					},
+				},
+				{
+					Name:  "flush",
+					Usage: "Attempt delivery of all queued messages now",
+					Flags: []cli.Flag{controlSocketFlag, queueFlag, jsonFlag},
+					Action: func(ctx *cli.Context) error {
+						var count int
+						if err := callControl(ctx, "queue.flush", queue.AdminArgs{Queue: ctx.String("queue")}, &count); err != nil {
+							return err
+						}
+						if ctx.Bool("json") {
+							return printJSON(count)
+						}
+						fmt.Println("Scheduled delivery for", count, "messages")
+						return nil
+					},
+				},
+				{
+					Name:      "retry",
+					Usage:     "Attempt delivery of the message now",
+					ArgsUsage: "MSGID",
+					Flags:     []cli.Flag{controlSocketFlag, queueFlag},
+					Action: func(ctx *cli.Context) error {
+						id := ctx.Args().First()
+						if id == "" {
+							return cli.Exit("Error: MSGID is required", 2)
+						}
+						return callControl(ctx, "queue.retry", queue.AdminArgs{Queue: ctx.String("queue"), ID: id}, nil)
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "Cancel delivery and remove the message from queue",
+					Description: `By default, the message is removed silently. Use --bounce to send
+a delivery failure notification to the sender.`,
+					ArgsUsage: "MSGID",
+					Flags: []cli.Flag{
+						controlSocketFlag, queueFlag,
+						&cli.BoolFlag{
+							Name:  "bounce",
+							Usage: "Send a delivery failure notification to the sender",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						id := ctx.Args().First()
+						if id == "" {
+							return cli.Exit("Error: MSGID is required", 2)
+						}
+						if !ctx.Bool("yes") {
+							if !clitools2.Confirmation("Are you sure you want to cancel delivery of this message?", false) {
+								return errors.New("Cancelled")
+							}
+						}
+						return callControl(ctx, "queue.delete", queue.AdminArgs{
+							Queue:  ctx.String("queue"),
+							ID:     id,
+							Bounce: ctx.Bool("bounce"),
+						}, nil)
+					},
+				},
+				{
+					Name:  "quarantine",
+					Usage: "Quarantined messages management",
+					Description: `These commands manage messages held by queues with hold_quarantined
+enabled. Quarantined messages are not delivered until released.
+`,
+					Subcommands: []*cli.Command{
+						{
+							Name:  "list",
+							Usage: "List quarantined messages",
+							Flags: []cli.Flag{controlSocketFlag, queueFlag, jsonFlag},
+							Action: func(ctx *cli.Context) error {
+								return quarantineList(ctx)
+							},
+						},
+						{
+							Name:      "show",
+							Usage:     "Show quarantined message details",
+							ArgsUsage: "MSGID",
+							Flags:     []cli.Flag{controlSocketFlag, queueFlag, jsonFlag},
+							Action: func(ctx *cli.Context) error {
+								return queueShow(ctx, false)
+							},
+						},
+						{
+							Name:      "release",
+							Usage:     "Release the message from quarantine and deliver it",
+							ArgsUsage: "MSGID",
+							Flags:     []cli.Flag{controlSocketFlag, queueFlag},
+							Action: func(ctx *cli.Context) error {
+								id := ctx.Args().First()
+								if id == "" {
+									return cli.Exit("Error: MSGID is required", 2)
+								}
+								return callControl(ctx, "queue.quarantine.release", queue.AdminArgs{Queue: ctx.String("queue"), ID: id}, nil)
+							},
+						},
+						{
+							Name:  "delete",
+							Usage: "Remove the quarantined message",
+							Description: `By default, the message is removed silently. Use --bounce to send
+a delivery failure notification to the sender.`,
+							ArgsUsage: "MSGID",
+							Flags: []cli.Flag{
+								controlSocketFlag, queueFlag,
+								&cli.BoolFlag{
+									Name:  "bounce",
+									Usage: "Send a delivery failure notification to the sender",
+								},
+								&cli.BoolFlag{
+									Name:    "yes",
+									Aliases: []string{"y"},
+									Usage:   "Don't ask for confirmation",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								id := ctx.Args().First()
+								if id == "" {
+									return cli.Exit("Error: MSGID is required", 2)
+								}
+								if !ctx.Bool("yes") {
+									if !clitools2.Confirmation("Are you sure you want to remove this message?", false) {
+										return errors.New("Cancelled")
+									}
+								}
+								return callControl(ctx, "queue.quarantine.delete", queue.AdminArgs{
+									Queue:  ctx.String("queue"),
+									ID:     id,
+									Bounce: ctx.Bool("bounce"),
+								}, nil)
+							},
+						},
+					},
+				},
+				{
+					Name:  "dead-letter",
+					Usage: "Dead letter store management",
+					Description: `These commands manage permanently failed messages kept by queues
+with dead_letter enabled.
+`,
+					Subcommands: []*cli.Command{
+						{
+							Name:  "list",
+							Usage: "List messages in the dead letter store",
+							Flags: []cli.Flag{controlSocketFlag, queueFlag, jsonFlag},
+							Action: func(ctx *cli.Context) error {
+								return deadLetterList(ctx)
+							},
+						},
+						{
+							Name:      "show",
+							Usage:     "Show dead letter details",
+							ArgsUsage: "ID",
+							Flags:     []cli.Flag{controlSocketFlag, queueFlag, jsonFlag},
+							Action: func(ctx *cli.Context) error {
+								return queueShow(ctx, true)
+							},
+						},
+						{
+							Name:      "requeue",
+							Usage:     "Move the message back to the queue and attempt delivery now",
+							ArgsUsage: "ID",
+							Flags:     []cli.Flag{controlSocketFlag, queueFlag},
+							Action: func(ctx *cli.Context) error {
+								id := ctx.Args().First()
+								if id == "" {
+									return cli.Exit("Error: ID is required", 2)
+								}
+								return callControl(ctx, "queue.dead_letter.requeue", queue.AdminArgs{Queue: ctx.String("queue"), ID: id}, nil)
+							},
+						},
+						{
+							Name:      "delete",
+							Usage:     "Remove the message from the dead letter store",
+							ArgsUsage: "ID",
+							Flags: []cli.Flag{
+								controlSocketFlag, queueFlag,
+								&cli.BoolFlag{
+									Name:    "yes",
+									Aliases: []string{"y"},
+									Usage:   "Don't ask for confirmation",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								id := ctx.Args().First()
+								if id == "" {
+									return cli.Exit("Error: ID is required", 2)
+								}
+								if !ctx.Bool("yes") {
+									if !clitools2.Confirmation("Are you sure you want to remove this message?", false) {
+										return errors.New("Cancelled")
+									}
+								}
+								return callControl(ctx, "queue.dead_letter.delete", queue.AdminArgs{Queue: ctx.String("queue"), ID: id}, nil)
+							},
+						},
+					},
+				},
+			},
+		})
+}
+
+func formatNextAttempt(info queue.MessageInfo) string {
+	switch {
+	case info.Quarantined:
+		return "quarantined"
+	case info.Delivering:
+		return "delivering now"
+	case info.NextAttempt.IsZero():
+		return "not scheduled"
+	}
+	until := time.Until(info.NextAttempt).Round(time.Second)
+	if until <= 0 {
+		return "now"
+	}
+	return "in " + until.String()
+}
+
+func maxTries(tries map[string]int) int {
+	res := 0
+	for _, count := range tries {
+		if count > res {
+			res = count
+		}
+	}
+	return res
+}
+
+func queueList(ctx *cli.Context) error {
+	var msgs []queue.MessageInfo
+	if err := callControl(ctx, "queue.list", queue.AdminArgs{Queue: ctx.String("queue")}, &msgs); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(msgs)
+	}
+
+	if len(msgs) == 0 {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No queued messages.")
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tQUEUE\tFROM\tRCPTS\tPRIO\tTRIES\tNEXT ATTEMPT")
+	for _, msg := range msgs {
+		from := msg.From
+		if from == "" {
+			from = "<>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", msg.ID, msg.Queue, from, len(msg.To), msg.Priority, maxTries(msg.Tries), formatNextAttempt(msg))
+	}
+	return w.Flush()
+}
+
+func quarantineList(ctx *cli.Context) error {
+	var msgs []queue.MessageInfo
+	if err := callControl(ctx, "queue.quarantine.list", queue.AdminArgs{Queue: ctx.String("queue")}, &msgs); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(msgs)
+	}
+
+	if len(msgs) == 0 {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No quarantined messages.")
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tQUEUE\tFROM\tRCPTS\tRECEIVED AT")
+	for _, msg := range msgs {
+		from := msg.From
+		if from == "" {
+			from = "<>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", msg.ID, msg.Queue, from, len(msg.To), msg.FirstAttempt.Format(time.RFC1123Z))
+	}
+	return w.Flush()
+}
+
+func deadLetterList(ctx *cli.Context) error {
+	var msgs []queue.MessageInfo
+	if err := callControl(ctx, "queue.dead_letter.list", queue.AdminArgs{Queue: ctx.String("queue")}, &msgs); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(msgs)
+	}
+
+	if len(msgs) == 0 {
+		if !ctx.Bool("quiet") {
+			fmt.Fprintln(os.Stderr, "No dead letters.")
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tQUEUE\tFROM\tRCPTS\tFAILED AT")
+	for _, msg := range msgs {
+		from := msg.From
+		if from == "" {
+			from = "<>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", msg.ID, msg.Queue, from, len(msg.To), msg.LastAttempt.Format(time.RFC1123Z))
+	}
+	return w.Flush()
+}
+
+func queueShow(ctx *cli.Context, deadLetter bool) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return cli.Exit("Error: MSGID is required", 2)
+	}
+
+	cmd := "queue.show"
+	if deadLetter {
+		cmd = "queue.dead_letter.show"
+	}
+	var msg queue.MessageDetails
+	if err := callControl(ctx, cmd, queue.AdminArgs{Queue: ctx.String("queue"), ID: id}, &msg); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(msg)
+	}
+
+	fmt.Println("ID:", msg.ID)
+	if msg.TraceID != "" {
+		fmt.Println("Trace ID:", msg.TraceID)
+	}
+	fmt.Println("Queue:", msg.Queue)
+	if msg.From == "" {
+		fmt.Println("From: <>")
+	} else {
+		fmt.Println("From:", msg.From)
+	}
+	fmt.Println("First attempt:", msg.FirstAttempt.Format(time.RFC1123Z))
+	if deadLetter {
+		fmt.Println("Failed at:", msg.LastAttempt.Format(time.RFC1123Z))
+	} else {
+		fmt.Println("Last attempt:", msg.LastAttempt.Format(time.RFC1123Z))
+		fmt.Println("Next attempt:", formatNextAttempt(msg.MessageInfo))
+	}
+	fmt.Println("Priority:", msg.Priority)
+	fmt.Println("Body size:", msg.BodySize)
+	fmt.Println()
+
+	rcpts := append([]string(nil), msg.To...)
+	sort.Strings(rcpts)
+	if deadLetter {
+		fmt.Println("Failed recipients:")
+	} else {
+		fmt.Println("Pending recipients:")
+	}
+	for _, rcpt := range rcpts {
+		if deadLetter {
+			fmt.Printf("  %s\n", rcpt)
+		} else {
+			fmt.Printf("  %s (tries: %d)\n", rcpt, msg.Tries[rcpt])
+		}
+		if lastErr := msg.Errors[rcpt]; lastErr != "" {
+			fmt.Println("    Last error:", lastErr)
+		}
+	}
+	fmt.Println()
+
+	fmt.Println("Header:")
+	for _, line := range strings.Split(strings.TrimRight(msg.Header, "\r\n"), "\r\n") {
+		fmt.Println("  " + line)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/log"
+	parser "github.com/foxcpp/maddy/framework/logparser"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "trace",
+			Usage: "Show the lifecycle of a message",
+			Description: `Show all log entries and the queue state for the message with the
+specified trace ID.
+
+Trace ID is assigned to each message on reception, it is included in the
+Received header field, log messages (trace_id field), DSNs and queue webhook
+events. Log entries are read from the specified files or from stdin if none
+are specified, e.g.:
+
+  journalctl -u maddy -o cat | maddy trace 6d0bb5cd0a61f7a4
+
+If the server is running, the queue is also queried using the control socket.
+`,
+			ArgsUsage: "TRACEID",
+			Flags: []cli.Flag{
+				controlSocketFlag,
+				&cli.StringSliceFlag{
+					Name:    "log",
+					Aliases: []string{"l"},
+					Usage:   "Read log entries from `FILE`, can be specified multiple times",
+				},
+				&cli.BoolFlag{
+					Name:  "no-queue",
+					Usage: "Do not query the queue of the running server",
+				},
+				jsonFlag,
+			},
+			Action: traceMsg,
+		})
+}
+
+// traceLog returns log entries related to the message with the specified trace
+// ID.
+//
+// Entries that have only the msg_id field are matched as well if the message
+// ID was seen in an entry with the trace ID before.
+func traceLog(r io.Reader, traceID string) ([]parser.Msg, error) {
+	var (
+		msgs   []parser.Msg
+		msgIDs = map[string]bool{}
+	)
+
+	scnr := bufio.NewScanner(r)
+	scnr.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scnr.Scan() {
+		line := scnr.Text()
+		if !strings.Contains(line, "msg_id") && !strings.Contains(line, traceID) {
+			continue
+		}
+
+		msg, err := parser.Parse(line)
+		if err != nil {
+			continue
+		}
+
+		msgID, _ := msg.Context["msg_id"].(string)
+		if id, _ := msg.Context["trace_id"].(string); id == traceID {
+			if msgID != "" {
+				msgIDs[msgID] = true
+			}
+		} else if msgID == "" || !msgIDs[msgID] {
+			continue
+		}
+
+		msgs = append(msgs, msg)
+	}
+	return msgs, scnr.Err()
+}
+
+func formatLogMsg(msg parser.Msg) string {
+	var sb strings.Builder
+	if !msg.Stamp.IsZero() {
+		sb.WriteString(msg.Stamp.UTC().Format(parser.ISO8601_UTC))
+		sb.WriteString(" ")
+	}
+	if msg.Module != "" {
+		sb.WriteString(msg.Module)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(msg.Message)
+
+	keys := make([]string, 0, len(msg.Context))
+	for k := range msg.Context {
+		if k == "msg_id" || k == "trace_id" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		val, err := json.Marshal(msg.Context[k])
+		if err != nil {
+			continue
+		}
+		sb.WriteString(" ")
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.Write(val)
+	}
+	return sb.String()
+}
+
+func traceMsg(ctx *cli.Context) error {
+	traceID := ctx.Args().First()
+	if traceID == "" {
+		return cli.Exit("Error: TRACEID is required", 2)
+	}
+
+	var msgs []parser.Msg
+	if files := ctx.StringSlice("log"); len(files) != 0 {
+		for _, path := range files {
+			f, err := os.Open(path)
+			if err != nil {
+				return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+			}
+			fileMsgs, err := traceLog(f, traceID)
+			f.Close()
+			if err != nil {
+				return cli.Exit(fmt.Sprintf("Error: %s: %v", path, err), 1)
+			}
+			msgs = append(msgs, fileMsgs...)
+		}
+	} else {
+		var err error
+		msgs, err = traceLog(os.Stdin, traceID)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Stamp.Before(msgs[j].Stamp)
+	})
+
+	var queued []queue.MessageInfo
+	if !ctx.Bool("no-queue") {
+		var all []queue.MessageInfo
+		if err := callControl(ctx, "queue.list", queue.AdminArgs{}, &all); err != nil {
+			// Server may be not running, it is fine if only logs
+			// are inspected.
+			fmt.Fprintln(os.Stderr, "Queue state is not available:", err)
+		}
+		for _, msg := range all {
+			if msg.TraceID == traceID {
+				queued = append(queued, msg)
+			}
+		}
+	}
+
+	if ctx.Bool("json") {
+		return printTraceJSON(msgs, queued)
+	}
+
+	if len(msgs) == 0 {
+		fmt.Fprintln(os.Stderr, "No log entries found.")
+	}
+	for _, msg := range msgs {
+		fmt.Println(formatLogMsg(msg))
+	}
+
+	for _, msg := range queued {
+		fmt.Println()
+		fmt.Printf("Queued in %s as %s, next attempt: %s\n", msg.Queue, msg.ID, formatNextAttempt(msg))
+		for _, rcpt := range msg.To {
+			if errMsg := msg.Errors[rcpt]; errMsg != "" {
+				fmt.Printf("  %s (%d tries): %s\n", rcpt, msg.Tries[rcpt], errMsg)
+			} else {
+				fmt.Printf("  %s (%d tries)\n", rcpt, msg.Tries[rcpt])
+			}
+		}
+	}
+	return nil
+}
+
+// printTraceJSON writes log entries in the same form as "debug tail --json"
+// does together with the queue state of the message.
+func printTraceJSON(msgs []parser.Msg, queued []queue.MessageInfo) error {
+	res := struct {
+		Log   []tailEntry         `json:"log"`
+		Queue []queue.MessageInfo `json:"queue"`
+	}{
+		Log:   make([]tailEntry, 0, len(msgs)),
+		Queue: queued,
+	}
+	if res.Queue == nil {
+		res.Queue = []queue.MessageInfo{}
+	}
+	for _, msg := range msgs {
+		e := tailEntry{
+			Stamp:   msg.Stamp,
+			Level:   log.LevelInfo,
+			Module:  msg.Module,
+			Message: msg.Message,
+			Fields:  make(map[string]interface{}, len(msg.Context)),
+		}
+		if msg.Debug {
+			e.Level = log.LevelDebug
+		}
+		for k, v := range msg.Context {
+			if k == "trace_id" {
+				e.TraceID, _ = v.(string)
+				continue
+			}
+			e.Fields[k] = v
+		}
+		res.Log = append(res.Log, e)
+	}
+	return printJSON(res)
+}
@@ -0,0 +1,103 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/logparser"
+)
+
+func TestTraceLog(t *testing.T) {
+	logs := strings.Join([]string{
+		"2006-01-02T15:04:05.000Z smtp: incoming message\t{\"msg_id\":\"aaa\",\"trace_id\":\"t1\",\"sender\":\"a@example.org\"}",
+		"2006-01-02T15:04:05.000Z smtp: incoming message\t{\"msg_id\":\"bbb\",\"trace_id\":\"t2\"}",
+		"2006-01-02T15:04:06.000Z queue: delivery attempt failed\t{\"msg_id\":\"aaa\",\"rcpt\":\"b@example.org\"}",
+		"2006-01-02T15:04:06.000Z queue: delivery attempt failed\t{\"msg_id\":\"bbb\",\"rcpt\":\"c@example.org\"}",
+		"2006-01-02T15:04:07.000Z queue: generated failed DSN\t{\"msg_id\":\"aaa\",\"trace_id\":\"t1\",\"dsn_id\":\"ccc\"}",
+		"2006-01-02T15:04:08.000Z queue: delivered\t{\"msg_id\":\"ccc\",\"trace_id\":\"t1\"}",
+		"2006-01-02T15:04:09.000Z smtp: unrelated message",
+		"malformed line with msg_id",
+	}, "\n")
+
+	msgs, err := traceLog(strings.NewReader(logs), "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, msg.Message+" "+msg.Context["msg_id"].(string))
+	}
+	want := []string{
+		"incoming message aaa",
+		"delivery attempt failed aaa",
+		"generated failed DSN aaa",
+		"delivered ccc",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Wrong entries matched:\n got  %q\n want %q", got, want)
+	}
+}
+
+func TestTraceLog_MsgIDBeforeTrace(t *testing.T) {
+	// Entries with msg_id only are matched only after the message ID is
+	// linked with the trace ID.
+	logs := strings.Join([]string{
+		"2006-01-02T15:04:05.000Z smtp: early entry\t{\"msg_id\":\"aaa\"}",
+		"2006-01-02T15:04:06.000Z smtp: incoming message\t{\"msg_id\":\"aaa\",\"trace_id\":\"t1\"}",
+	}, "\n")
+
+	msgs, err := traceLog(strings.NewReader(logs), "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Message != "incoming message" {
+		t.Errorf("Wrong entries matched: %+v", msgs)
+	}
+}
+
+func TestFormatLogMsg(t *testing.T) {
+	test := func(msg parser.Msg, expected string) {
+		t.Helper()
+		if got := formatLogMsg(msg); got != expected {
+			t.Errorf("Wrong formatting:\n got  %q\n want %q", got, expected)
+		}
+	}
+
+	test(parser.Msg{Message: "hello", Context: map[string]interface{}{}}, "hello")
+	test(parser.Msg{
+		Stamp:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		Module:  "queue",
+		Message: "delivered",
+		Context: map[string]interface{}{
+			"rcpt":     "b@example.org",
+			"attempt":  float64(2),
+			"msg_id":   "aaa",
+			"trace_id": "t1",
+		},
+	}, `2006-01-02T15:04:05.000Z queue: delivered attempt=2 rcpt="b@example.org"`)
+	test(parser.Msg{
+		Stamp:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.FixedZone("", 3*60*60)),
+		Message: "local time",
+		Context: map[string]interface{}{},
+	}, "2006-01-02T12:04:05.000Z local time")
+}
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/traffic"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "traffic",
+			Usage: "Per-domain traffic accounting",
+			Description: `Messages exchanged with other servers are counted by local and remote domain.
+Messages received from unauthenticated clients are accounted to the recipient
+domain, messages sent by target.remote are accounted to the sender domain.
+
+The server is contacted using the control socket, by default it is located in
+runtime_dir from maddy.conf.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "dump",
+					Usage: "Write collected counters as CSV",
+					Description: `Write counters collected since the server start or the last reset to stdout
+in CSV format with the following columns:
+
+  period_start,period_end,direction,local_domain,remote_domain,messages,bytes
+
+direction is "received" or "sent". Times are in RFC 3339 format. Counters are
+not persisted and are lost on restart. With --json, the report is written as a
+JSON object instead.
+
+Use --reset to start a new accounting period, e.g. to write a file for each
+billing period from cron:
+  maddy traffic dump --reset > /var/lib/maddy/traffic-$(date +%F).csv
+`,
+					Flags: []cli.Flag{
+						controlSocketFlag,
+						&cli.BoolFlag{
+							Name:  "reset",
+							Usage: "Clear counters after writing them",
+						},
+						jsonFlag,
+					},
+					Action: trafficDump,
+				},
+			},
+		})
+}
+
+func trafficDump(ctx *cli.Context) error {
+	var report traffic.Report
+	if err := callControl(ctx, "traffic.dump", traffic.DumpArgs{Reset: ctx.Bool("reset")}, &report); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		if report.Records == nil {
+			report.Records = []traffic.Record{}
+		}
+		return printJSON(report)
+	}
+
+	start := report.Start.UTC().Format(time.RFC3339)
+	end := report.End.UTC().Format(time.RFC3339)
+
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write([]string{"period_start", "period_end", "direction", "local_domain", "remote_domain", "messages", "bytes"}); err != nil {
+		return err
+	}
+	for _, rec := range report.Records {
+		if err := w.Write([]string{
+			start, end,
+			rec.Direction, rec.LocalDomain, rec.RemoteDomain,
+			strconv.FormatUint(rec.Messages, 10), strconv.FormatUint(rec.Bytes, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
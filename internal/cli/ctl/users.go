@@ -24,7 +24,6 @@ import (
 	"os"
 	"strings"
 
-	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth/pass_table"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
@@ -46,6 +45,9 @@ can be changed using --cfg-block argument for subcommands).
 
 Note that it is not enough to create user credentials in order to grant 
 IMAP access - IMAP account should be also created using 'imap-acct create' subcommand.
+
+If the server is running, changes are made through it using the control
+socket. Otherwise, the configuration block is opened directly.
 `,
 			Subcommands: []*cli.Command{
 				{
@@ -58,15 +60,10 @@ IMAP access - IMAP account should be also created using 'imap-acct create' subco
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_authdb",
 						},
+						controlSocketFlag,
+						jsonFlag,
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return usersList(be, ctx)
-					},
+					Action: usersList,
 				},
 				{
 					Name:  "create",
@@ -84,6 +81,7 @@ using command flags. Otherwise, these options cannot be used.
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_authdb",
 						},
+						controlSocketFlag,
 						&cli.StringFlag{
 							Name:    "password",
 							Aliases: []string{"p"},
@@ -100,14 +98,7 @@ using command flags. Otherwise, these options cannot be used.
 							Value: bcrypt.DefaultCost,
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return usersCreate(be, ctx)
-					},
+					Action: usersCreate,
 				},
 				{
 					Name:      "remove",
@@ -120,26 +111,25 @@ using command flags. Otherwise, these options cannot be used.
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_authdb",
 						},
+						controlSocketFlag,
 						&cli.BoolFlag{
 							Name:    "yes",
 							Aliases: []string{"y"},
 							Usage:   "Don't ask for confirmation",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return usersRemove(be, ctx)
-					},
+					Action: usersRemove,
 				},
 				{
-					Name:        "password",
-					Usage:       "Change account password",
-					Description: "Reads password from stdin",
-					ArgsUsage:   "USERNAME",
+					Name:  "password",
+					Usage: "Change account password",
+					Description: `Reads password from stdin.
+
+If configuration block uses auth.pass_table with password policy directives,
+new password should satisfy them. If password_max_age is used, new password
+should differ from the current one.
+`,
+					ArgsUsage: "USERNAME",
 					Flags: []cli.Flag{
 						&cli.StringFlag{
 							Name:    "cfg-block",
@@ -147,30 +137,27 @@ using command flags. Otherwise, these options cannot be used.
 							EnvVars: []string{"MADDY_CFGBLOCK"},
 							Value:   "local_authdb",
 						},
+						controlSocketFlag,
 						&cli.StringFlag{
 							Name:    "password",
 							Aliases: []string{"p"},
 							Usage:   "Use `PASSWORD` instead of reading password from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
 						},
 					},
-					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
-						if err != nil {
-							return err
-						}
-						defer closeIfNeeded(be)
-						return usersPassword(be, ctx)
-					},
+					Action: usersPassword,
 				},
 			},
 		})
 }
 
-func usersList(be module.PlainUserDB, ctx *cli.Context) error {
-	list, err := be.ListUsers()
-	if err != nil {
+func usersList(ctx *cli.Context) error {
+	var list []string
+	if err := callModule(ctx, "creds.list", pass_table.CredsArgs{CfgBlock: ctx.String("cfg-block")}, &list); err != nil {
 		return err
 	}
+	if ctx.Bool("json") {
+		return printJSON(list)
+	}
 
 	if len(list) == 0 && !ctx.Bool("quiet") {
 		fmt.Fprintln(os.Stderr, "No users.")
@@ -182,7 +169,7 @@ func usersList(be module.PlainUserDB, ctx *cli.Context) error {
 	return nil
 }
 
-func usersCreate(be module.PlainUserDB, ctx *cli.Context) error {
+func usersCreate(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return cli.Exit("Error: USERNAME is required", 2)
@@ -199,18 +186,21 @@ func usersCreate(be module.PlainUserDB, ctx *cli.Context) error {
 		}
 	}
 
-	if beHash, ok := be.(*pass_table.Auth); ok {
-		return beHash.CreateUserHash(username, pass, ctx.String("hash"), pass_table.HashOpts{
-			BcryptCost: ctx.Int("bcrypt-cost"),
-		})
-	} else if ctx.IsSet("hash") || ctx.IsSet("bcrypt-cost") {
-		return cli.Exit("Error: --hash cannot be used with non-pass_table credentials DB", 2)
-	} else {
-		return be.CreateUser(username, pass)
+	args := pass_table.CredsArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Password: pass,
+	}
+	// Defaults are used for non-pass_table credentials DB, it is an error
+	// to set them explicitly.
+	if ctx.IsSet("hash") || ctx.IsSet("bcrypt-cost") {
+		args.Hash = ctx.String("hash")
+		args.BcryptCost = ctx.Int("bcrypt-cost")
 	}
+	return callModule(ctx, "creds.create", args, nil)
 }
 
-func usersRemove(be module.PlainUserDB, ctx *cli.Context) error {
+func usersRemove(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return errors.New("Error: USERNAME is required")
@@ -222,10 +212,13 @@ func usersRemove(be module.PlainUserDB, ctx *cli.Context) error {
 		}
 	}
 
-	return be.DeleteUser(username)
+	return callModule(ctx, "creds.remove", pass_table.CredsArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+	}, nil)
 }
 
-func usersPassword(be module.PlainUserDB, ctx *cli.Context) error {
+func usersPassword(ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
 		return errors.New("Error: USERNAME is required")
@@ -242,5 +235,9 @@ func usersPassword(be module.PlainUserDB, ctx *cli.Context) error {
 		}
 	}
 
-	return be.SetUserPassword(username, pass)
+	return callModule(ctx, "creds.password", pass_table.CredsArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Username: username,
+		Password: pass,
+	}, nil)
 }
@@ -0,0 +1,223 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/modify/vacation"
+	"github.com/urfave/cli/v2"
+)
+
+const vacationDateLayout = "2006-01-02"
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "local_vacation",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "vacation",
+			Usage: "Auto-reply (vacation) settings management",
+			Description: `These commands manage auto-reply settings used by modify.vacation.
+
+Corresponding modify.vacation module should be defined in maddy.conf as
+a top-level config block. By default the block name should be local_vacation (
+can be changed using --cfg-block argument for subcommands).
+
+If the server is running, changes are made through it using the control
+socket. Otherwise, the configuration block is opened directly.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List addresses with auto-replies configured",
+					Flags:  []cli.Flag{cfgBlockFlag, controlSocketFlag, jsonFlag},
+					Action: vacationList,
+				},
+				{
+					Name:      "show",
+					Usage:     "Show auto-reply settings for the address",
+					ArgsUsage: "ADDRESS",
+					Flags:     []cli.Flag{cfgBlockFlag, controlSocketFlag, jsonFlag},
+					Action:    vacationShow,
+				},
+				{
+					Name:  "set",
+					Usage: "Enable auto-replies for the address",
+					Description: `Reads the reply text from stdin unless --message is specified.
+
+Existing settings for the address are replaced.
+`,
+					ArgsUsage: "ADDRESS",
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						controlSocketFlag,
+						&cli.StringFlag{
+							Name:  "subject",
+							Usage: "Reply subject, \"Auto: \" + original subject is used if not set",
+						},
+						&cli.StringFlag{
+							Name:    "message",
+							Aliases: []string{"m"},
+							Usage:   "Use `TEXT` instead of reading the reply text from stdin",
+						},
+						&cli.StringFlag{
+							Name:  "start",
+							Usage: "Send replies starting at the specified date (YYYY-MM-DD)",
+						},
+						&cli.StringFlag{
+							Name:  "end",
+							Usage: "Send replies until the end of the specified date (YYYY-MM-DD)",
+						},
+						&cli.DurationFlag{
+							Name:  "interval",
+							Usage: "Min. time between replies to the same sender, module default is used if not set",
+						},
+					},
+					Action: vacationSet,
+				},
+				{
+					Name:      "disable",
+					Usage:     "Disable auto-replies for the address",
+					ArgsUsage: "ADDRESS",
+					Flags:     []cli.Flag{cfgBlockFlag, controlSocketFlag},
+					Action:    vacationDisable,
+				},
+			},
+		})
+}
+
+func vacationList(ctx *cli.Context) error {
+	var addrs []string
+	if err := callModule(ctx, "vacation.list", vacation.AdminArgs{CfgBlock: ctx.String("cfg-block")}, &addrs); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(addrs)
+	}
+
+	if len(addrs) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No auto-replies configured.")
+	}
+	for _, addr := range addrs {
+		fmt.Println(addr)
+	}
+	return nil
+}
+
+func vacationShow(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+
+	var s vacation.Status
+	if err := callModule(ctx, "vacation.show", vacation.AdminArgs{CfgBlock: ctx.String("cfg-block"), Address: addr}, &s); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(s)
+	}
+
+	status := "active"
+	if !s.Active {
+		status = "inactive"
+	}
+	fmt.Println("Status:", status)
+	if !s.Start.IsZero() {
+		fmt.Println("Start:", s.Start.Format(time.RFC1123Z))
+	}
+	if !s.End.IsZero() {
+		fmt.Println("End:", s.End.Format(time.RFC1123Z))
+	}
+	if s.Interval != 0 {
+		fmt.Println("Interval:", s.Interval)
+	}
+	if s.Subject != "" {
+		fmt.Println("Subject:", s.Subject)
+	}
+	fmt.Println()
+	fmt.Println(s.Message)
+	return nil
+}
+
+func vacationSet(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+
+	s := vacation.Settings{
+		Subject:  ctx.String("subject"),
+		Message:  ctx.String("message"),
+		Interval: ctx.Duration("interval"),
+	}
+	if s.Message == "" {
+		msg, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		s.Message = string(msg)
+	}
+	if s.Message == "" {
+		return errors.New("Error: reply text is empty")
+	}
+
+	if start := ctx.String("start"); start != "" {
+		t, err := time.ParseInLocation(vacationDateLayout, start, time.Local)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: malformed start date: %v", err), 2)
+		}
+		s.Start = t
+	}
+	if end := ctx.String("end"); end != "" {
+		t, err := time.ParseInLocation(vacationDateLayout, end, time.Local)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: malformed end date: %v", err), 2)
+		}
+		s.End = t.AddDate(0, 0, 1)
+	}
+	if !s.Start.IsZero() && !s.End.IsZero() && !s.Start.Before(s.End) {
+		return cli.Exit("Error: end date is before the start date", 2)
+	}
+
+	return callModule(ctx, "vacation.set", vacation.AdminArgs{
+		CfgBlock: ctx.String("cfg-block"),
+		Address:  addr,
+		Settings: &s,
+	}, nil)
+}
+
+func vacationDisable(ctx *cli.Context) error {
+	addr := ctx.Args().First()
+	if addr == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+	return callModule(ctx, "vacation.disable", vacation.AdminArgs{CfgBlock: ctx.String("cfg-block"), Address: addr}, nil)
+}
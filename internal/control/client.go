@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Client is a control socket connection. It is not safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	scnr *bufio.Scanner
+}
+
+// Dial connects to the control socket of the running server.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("control: cannot connect to the server (is it running?): %w", err)
+	}
+	scnr := bufio.NewScanner(conn)
+	scnr.Buffer(make([]byte, 0, 4096), MaxRequestSize)
+	return &Client{conn: conn, scnr: scnr}, nil
+}
+
+// Call executes the command on the server. args is encoded as JSON, if
+// result is not nil, returned value is decoded into it.
+//
+// Errors returned by the command handler are returned as is, without
+// additional context.
+func (c *Client) Call(command string, args, result interface{}) error {
+	if err := c.send(command, args); err != nil {
+		return err
+	}
+
+	resp, err := c.read()
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result != nil && len(resp.Result) != 0 {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("control: malformed response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Stream executes the stream command on the server and calls f for each
+// received result until the stream ends or f returns an error. The client
+// can't be used after Stream returns.
+func (c *Client) Stream(command string, args interface{}, f func(result json.RawMessage) error) error {
+	if err := c.send(command, args); err != nil {
+		return err
+	}
+
+	for {
+		resp, err := c.read()
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		if !resp.More {
+			return nil
+		}
+		if err := f(resp.Result); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) send(command string, args interface{}) error {
+	req := Request{Command: command}
+	if args != nil {
+		var err error
+		req.Args, err = json.Marshal(args)
+		if err != nil {
+			return fmt.Errorf("control: %w", err)
+		}
+	}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) read() (Response, error) {
+	if !c.scnr.Scan() {
+		if err := c.scnr.Err(); err != nil {
+			return Response{}, fmt.Errorf("control: %w", err)
+		}
+		return Response{}, errors.New("control: connection closed by server")
+	}
+
+	var resp Response
+	if err := json.Unmarshal(c.scnr.Bytes(), &resp); err != nil {
+		return Response{}, fmt.Errorf("control: malformed response: %w", err)
+	}
+	return resp, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,428 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package control implements the control socket used by maddy subcommands to
+// inspect and manage the running server.
+//
+// The socket is stream-oriented and each request and response is a single
+// line with a JSON object:
+//
+//	{"command": "queue.list", "args": {...}}\n
+//	{"result": ...}\n or {"error": "..."}\n
+//
+// Multiple requests can be sent over the same connection, they are processed
+// sequentially.
+//
+// Stream commands send multiple results, each in a separate response with
+// "more" set to true, followed by the final response without a result:
+//
+//	{"result": ..., "more": true}\n
+//	{}\n or {"error": "..."}\n
+//
+// Stream continues until the client closes the connection or the handler
+// stops, the connection can't be used for other requests.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+const (
+	// SocketName is the name of the control socket file in the runtime
+	// directory.
+	SocketName = "control.sock"
+
+	// MaxRequestSize is the max. size of a single request or response line.
+	MaxRequestSize = 64 * 1024 * 1024
+)
+
+// Handler processes a single command. args contains the raw JSON value
+// passed by the client (nil if omitted), returned value is encoded as JSON
+// and sent back.
+type Handler func(args json.RawMessage) (interface{}, error)
+
+// StreamHandler processes a stream command. send writes a single result to
+// the client, done is closed when the client disconnects or the server is
+// stopped. The stream ends when the handler returns.
+type StreamHandler func(args json.RawMessage, send func(interface{}) error, done <-chan struct{}) error
+
+type Request struct {
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	// Set for results of stream commands, except for the final response.
+	More bool `json:"more,omitempty"`
+}
+
+var (
+	handlers       = make(map[string]Handler)
+	streamHandlers = make(map[string]StreamHandler)
+	// Commands with arguments that should not be logged.
+	sensitive    = make(map[string]bool)
+	handlersLock sync.RWMutex
+)
+
+// Register adds the command handler to the global registry.
+//
+// command must be unique. Register will panic if the handler for the
+// specified command already exists.
+//
+// You probably want to call this function from func init() of the package.
+func Register(command string, h Handler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	if _, ok := handlers[command]; ok {
+		panic("control: handler for command is already registered: " + command)
+	}
+	if _, ok := streamHandlers[command]; ok {
+		panic("control: handler for command is already registered: " + command)
+	}
+	handlers[command] = h
+}
+
+// RegisterSensitive is the same as Register, but arguments of the command
+// are not written to the debug log. It should be used for commands that
+// accept passwords or message contents.
+func RegisterSensitive(command string, h Handler) {
+	Register(command, h)
+
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+	sensitive[command] = true
+}
+
+// RegisterStream adds the stream command handler to the global registry.
+//
+// As with Register, command must be unique.
+func RegisterStream(command string, h StreamHandler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	if _, ok := handlers[command]; ok {
+		panic("control: handler for command is already registered: " + command)
+	}
+	if _, ok := streamHandlers[command]; ok {
+		panic("control: handler for command is already registered: " + command)
+	}
+	streamHandlers[command] = h
+}
+
+// ErrUnknownCommand is returned by Call if there is no handler for the
+// command.
+var ErrUnknownCommand = errors.New("control: unknown command")
+
+// Call runs the command handler in-process, args are encoded as JSON the
+// same way the client does it. It is used to expose commands over other
+// interfaces.
+func Call(command string, args interface{}) (interface{}, error) {
+	handlersLock.RLock()
+	h := handlers[command]
+	handlersLock.RUnlock()
+	if h == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, command)
+	}
+
+	var rawArgs json.RawMessage
+	if args != nil {
+		var err error
+		rawArgs, err = json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h(rawArgs)
+}
+
+// Commands returns a sorted list of registered commands.
+func Commands() []string {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+
+	cmds := make([]string, 0, len(handlers)+len(streamHandlers))
+	for cmd := range handlers {
+		cmds = append(cmds, cmd)
+	}
+	for cmd := range streamHandlers {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	return cmds
+}
+
+// DefaultPath returns the control socket path for the current
+// config.RuntimeDirectory value.
+func DefaultPath() string {
+	return filepath.Join(config.RuntimeDirectory, SocketName)
+}
+
+type Server struct {
+	Log log.Logger
+
+	listener net.Listener
+	path     string
+	wg       sync.WaitGroup
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+}
+
+// Listen creates the control socket at the specified path and starts
+// accepting connections.
+//
+// Stale socket file left by a previous server process is removed. The socket
+// is accessible only by the user running the server.
+func Listen(path string) (*Server, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control: socket %s is used by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("control: %w", err)
+		}
+	}
+
+	l, err := listenPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("control: %w", err)
+	}
+
+	s := &Server{
+		Log:      log.Logger{Name: "control"},
+		listener: l,
+		path:     path,
+		conns:    map[net.Conn]struct{}{},
+	}
+	go s.accept()
+	return s, nil
+}
+
+// listenPrivate creates the socket in a temporary directory accessible only
+// by the current user and moves it to path once permissions are restricted, so
+// the socket is never accessible by other users.
+func listenPrivate(path string) (*net.UnixListener, error) {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, SocketName)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is moved, it is removed by Server.Close.
+	l.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.Log.Error("accept failed", err)
+			}
+			return
+		}
+		s.connsLock.Lock()
+		s.conns[conn] = struct{}{}
+		s.connsLock.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+
+			s.connsLock.Lock()
+			delete(s.conns, conn)
+			s.connsLock.Unlock()
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	scnr := bufio.NewScanner(conn)
+	// Requests can contain message bodies.
+	scnr.Buffer(make([]byte, 0, 4096), MaxRequestSize)
+	enc := json.NewEncoder(conn)
+	for scnr.Scan() {
+		var req Request
+		var resp Response
+		if err := json.Unmarshal(scnr.Bytes(), &req); err != nil {
+			resp.Error = "malformed request: " + err.Error()
+		} else {
+			handlersLock.RLock()
+			sh := streamHandlers[req.Command]
+			handlersLock.RUnlock()
+			if sh != nil {
+				s.serveStream(scnr, enc, req, sh)
+				return
+			}
+			resp = s.handle(req)
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			s.Log.Error("response write failed", err)
+			return
+		}
+	}
+}
+
+func (s *Server) handle(req Request) (resp Response) {
+	handlersLock.RLock()
+	h := handlers[req.Command]
+	noLog := sensitive[req.Command]
+	handlersLock.RUnlock()
+	if h == nil {
+		resp.Error = "unknown command: " + req.Command
+		return
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			s.Log.Printf("panic during command %s: %v\n%s", req.Command, err, debug.Stack())
+			resp = Response{Error: "internal server error"}
+		}
+	}()
+
+	if noLog {
+		s.Log.DebugMsg("command", "command", req.Command)
+	} else {
+		s.Log.DebugMsg("command", "command", req.Command, "args", string(req.Args))
+	}
+
+	res, err := h(req.Args)
+	if err != nil {
+		resp.Error = err.Error()
+		return
+	}
+	resp.Result, err = json.Marshal(res)
+	if err != nil {
+		resp.Error = "result serialization: " + err.Error()
+	}
+	return
+}
+
+// serveStream runs the stream command handler. The connection is not used
+// for other requests afterwards.
+func (s *Server) serveStream(scnr *bufio.Scanner, enc *json.Encoder, req Request, h StreamHandler) {
+	// Nothing is expected from the client, reading fails once it
+	// disconnects or Close sets the deadline.
+	done := make(chan struct{})
+	go func() {
+		for scnr.Scan() {
+		}
+		close(done)
+	}()
+
+	s.Log.DebugMsg("stream command", "command", req.Command, "args", string(req.Args))
+
+	var resp Response
+	func() {
+		defer func() {
+			if err := recover(); err != nil {
+				s.Log.Printf("panic during command %s: %v\n%s", req.Command, err, debug.Stack())
+				resp = Response{Error: "internal server error"}
+			}
+		}()
+
+		err := h(req.Args, func(v interface{}) error {
+			res, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("result serialization: %w", err)
+			}
+			return enc.Encode(Response{Result: res, More: true})
+		}, done)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}()
+
+	select {
+	case <-done:
+		// Client is gone, nobody to send the final response to.
+	default:
+		if err := enc.Encode(resp); err != nil {
+			s.Log.Error("response write failed", err)
+		}
+	}
+}
+
+// Close stops accepting new connections, closes existing ones once running
+// commands complete and removes the socket file.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.connsLock.Lock()
+	for conn := range s.conns {
+		// Unblock reads, responses for commands in progress can still be
+		// written.
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsLock.Unlock()
+
+	s.wg.Wait()
+
+	if rmErr := os.Remove(s.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// ParseArgs is a helper for Handler implementations that decodes args into v.
+// Omitted args leave v unchanged.
+func ParseArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("malformed arguments: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+func TestServer(t *testing.T) {
+	Register("test.echo", func(args json.RawMessage) (interface{}, error) {
+		var v struct {
+			Value string `json:"value"`
+		}
+		if err := ParseArgs(args, &v); err != nil {
+			return nil, err
+		}
+		if v.Value == "" {
+			return nil, errors.New("empty value")
+		}
+		return v, nil
+	})
+	Register("test.panic", func(json.RawMessage) (interface{}, error) {
+		panic("oops")
+	})
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, SocketName)
+	srv, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("Wrong socket permissions: %v", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("Temporary files are left: %v", entries)
+	}
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var res struct {
+		Value string `json:"value"`
+	}
+	if err := c.Call("test.echo", map[string]string{"value": "foo"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Value != "foo" {
+		t.Fatalf("Wrong result: %+v", res)
+	}
+
+	if err := c.Call("test.echo", nil, nil); err == nil || err.Error() != "empty value" {
+		t.Fatal("Expected handler error, got", err)
+	}
+	if err := c.Call("test.panic", nil, nil); err == nil {
+		t.Fatal("Expected error for panicking handler")
+	}
+	if err := c.Call("test.unknown", nil, nil); err == nil {
+		t.Fatal("Expected error for unknown command")
+	}
+
+	// Connection should still be usable after errors.
+	if err := c.Call("test.echo", map[string]string{"value": "bar"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Value != "bar" {
+		t.Fatalf("Wrong result: %+v", res)
+	}
+
+	// Second server should not hijack the socket of the running one.
+	if _, err := Listen(path); err == nil {
+		t.Fatal("Expected Listen to fail for socket in use")
+	}
+}
+
+func TestCall(t *testing.T) {
+	Register("test.call", func(args json.RawMessage) (interface{}, error) {
+		var v struct {
+			Value string `json:"value"`
+		}
+		if err := ParseArgs(args, &v); err != nil {
+			return nil, err
+		}
+		return v.Value, nil
+	})
+
+	res, err := Call("test.call", map[string]string{"value": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "foo" {
+		t.Fatalf("Wrong result: %v", res)
+	}
+
+	if _, err := Call("test.unknown", nil); !errors.Is(err, ErrUnknownCommand) {
+		t.Fatal("Expected ErrUnknownCommand, got", err)
+	}
+}
+
+func TestServer_Stream(t *testing.T) {
+	RegisterStream("test.count", func(args json.RawMessage, send func(interface{}) error, done <-chan struct{}) error {
+		var n int
+		if err := ParseArgs(args, &n); err != nil {
+			return err
+		}
+		if n < 0 {
+			return errors.New("negative count")
+		}
+		for i := 0; i < n; i++ {
+			if err := send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	path := filepath.Join(t.TempDir(), SocketName)
+	srv, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	count := func(n int) ([]int, error) {
+		c, err := Dial(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		var res []int
+		err = c.Stream("test.count", n, func(result json.RawMessage) error {
+			var i int
+			if err := json.Unmarshal(result, &i); err != nil {
+				return err
+			}
+			res = append(res, i)
+			return nil
+		})
+		return res, err
+	}
+
+	res, err := count(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0] != 0 || res[2] != 2 {
+		t.Fatalf("Wrong results: %v", res)
+	}
+	if _, err := count(-1); err == nil || err.Error() != "negative count" {
+		t.Fatal("Expected handler error, got", err)
+	}
+}
+
+func TestLogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SocketName)
+	srv, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries := make(chan map[string]interface{}, 10)
+	go func() {
+		_ = c.Stream("log.tail", LogTailArgs{Module: "target.remote", Level: log.LevelInfo}, func(result json.RawMessage) error {
+			var e map[string]interface{}
+			if err := json.Unmarshal(result, &e); err != nil {
+				return err
+			}
+			entries <- e
+			return nil
+		})
+		close(entries)
+	}()
+
+	// Wait for the subscription to be registered.
+	l := log.Logger{Name: "remote", Out: log.NopOutput{}, Debug: true}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.Msg("ping")
+		select {
+		case <-entries:
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("No messages received")
+			}
+			continue
+		}
+		break
+	}
+
+	l.Debugf("debug message")
+	log.Logger{Name: "smtp", Out: log.NopOutput{}}.Msg("unrelated")
+	l.Msg("delivered", "trace_id", "abcd")
+
+	for {
+		select {
+		case e := <-entries:
+			if e["msg"] == "ping" {
+				continue
+			}
+			if e["msg"] != "delivered" || e["module"] != "remote" || e["trace_id"] != "abcd" {
+				t.Fatalf("Wrong entry: %v", e)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message is not received")
+		}
+	}
+}
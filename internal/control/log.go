@@ -0,0 +1,148 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// Amount of messages buffered for log.tail, if the client is too slow to
+// read them, messages are dropped.
+const tailBuffer = 1024
+
+// LogLevelArgs are the arguments of the log.set_level command.
+type LogLevelArgs struct {
+	// Module selector (logger or instance name), empty to change the level
+	// for all modules.
+	Module string `json:"module,omitempty"`
+
+	// debug, info or reset (use the value from the configuration).
+	Level string `json:"level"`
+}
+
+// LogTailArgs are the arguments of the log.tail command. Empty fields match
+// all messages.
+type LogTailArgs struct {
+	// Module selector, same as for log.set_level.
+	Module string `json:"module,omitempty"`
+
+	// Minimal level of messages: debug, info or error. Debug messages are
+	// written only if debug logging is enabled for the module.
+	Level log.Level `json:"level,omitempty"`
+
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+func (args LogTailArgs) match(e log.Entry) bool {
+	switch args.Level {
+	case log.LevelInfo:
+		if e.Level == log.LevelDebug {
+			return false
+		}
+	case log.LevelError:
+		if e.Level != log.LevelError {
+			return false
+		}
+	}
+	if args.Module != "" && !e.FromModule(args.Module) {
+		return false
+	}
+	if args.TraceID != "" && fmt.Sprint(e.Fields["trace_id"]) != args.TraceID {
+		return false
+	}
+	return true
+}
+
+// tailLog sends log messages matching args until the client disconnects.
+func tailLog(rawArgs json.RawMessage, send func(interface{}) error, done <-chan struct{}) error {
+	var args LogTailArgs
+	if err := ParseArgs(rawArgs, &args); err != nil {
+		return err
+	}
+	switch args.Level {
+	case "", log.LevelDebug, log.LevelInfo, log.LevelError:
+	default:
+		return fmt.Errorf("unknown log level: %s", args.Level)
+	}
+
+	var dropped atomic.Int64
+	entries := make(chan log.Entry, tailBuffer)
+	cancel := log.Subscribe(func(e log.Entry) {
+		if !args.match(e) {
+			return
+		}
+		select {
+		case entries <- e:
+		default:
+			dropped.Add(1)
+		}
+	})
+	defer cancel()
+
+	for {
+		select {
+		case e := <-entries:
+			if n := dropped.Swap(0); n != 0 {
+				if err := send(log.Entry{
+					Stamp:   e.Stamp,
+					Level:   log.LevelError,
+					Module:  "control",
+					Message: "messages dropped, client is too slow",
+					Fields:  map[string]interface{}{"count": n},
+				}); err != nil {
+					return err
+				}
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func init() {
+	Register("log.set_level", func(rawArgs json.RawMessage) (interface{}, error) {
+		var args LogLevelArgs
+		if err := ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		switch args.Level {
+		case "debug":
+			log.SetDebug(args.Module, true)
+		case "info":
+			log.SetDebug(args.Module, false)
+		case "reset":
+			log.ResetDebug(args.Module)
+		default:
+			return nil, fmt.Errorf("unknown log level: %s", args.Level)
+		}
+		log.Logger{Name: "control"}.Msg("log level changed", "module", args.Module, "level", args.Level)
+		return log.DebugOverrides(), nil
+	})
+	Register("log.levels", func(json.RawMessage) (interface{}, error) {
+		return log.DebugOverrides(), nil
+	})
+	RegisterStream("log.tail", tailLog)
+}
@@ -109,6 +109,29 @@ type EvalResult struct {
 	DKIMAligned bool
 }
 
+// AsDKIMResult returns the DKIM verification result stored in res.
+//
+// check.dkim reports results using authres.GenericResult with "dkim" method to
+// include signature details not supported by authres.DKIMResult, such
+// results are converted. selector is returned if known.
+func AsDKIMResult(res authres.Result) (dkimRes *authres.DKIMResult, selector string, ok bool) {
+	switch res := res.(type) {
+	case *authres.DKIMResult:
+		return res, "", true
+	case *authres.GenericResult:
+		if res.Method != "dkim" {
+			return nil, "", false
+		}
+		return &authres.DKIMResult{
+			Value:      res.Value,
+			Reason:     res.Params["reason"],
+			Domain:     res.Params["header.d"],
+			Identifier: res.Params["header.i"],
+		}, res.Params["header.s"], true
+	}
+	return nil, "", false
+}
+
 // EvaluateAlignment checks whether identifiers authenticated by SPF and DKIM are in alignment
 // with the RFC5322.Domain.
 //
@@ -125,7 +148,7 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 		dkimTempFail = false
 	)
 	for _, res := range results {
-		if dkimRes, ok := res.(*authres.DKIMResult); ok {
+		if dkimRes, _, ok := AsDKIMResult(res); ok {
 			dkimPresent = true
 
 			// We want to return DKIM result for a signature provided by the orgDomain,
@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/internal/dmarc"
+)
+
+// Aggregate report format, RFC 7489, Appendix C.
+
+type (
+	feedback struct {
+		XMLName  xml.Name        `xml:"feedback"`
+		Version  string          `xml:"version"`
+		Metadata reportMetadata  `xml:"report_metadata"`
+		Policy   policyPublished `xml:"policy_published"`
+		Records  []*reportRecord `xml:"record"`
+	}
+	reportMetadata struct {
+		OrgName   string    `xml:"org_name"`
+		Email     string    `xml:"email"`
+		ReportID  string    `xml:"report_id"`
+		DateRange dateRange `xml:"date_range"`
+	}
+	dateRange struct {
+		Begin int64 `xml:"begin"`
+		End   int64 `xml:"end"`
+	}
+	policyPublished struct {
+		Domain string `xml:"domain"`
+		ADKIM  string `xml:"adkim,omitempty"`
+		ASPF   string `xml:"aspf,omitempty"`
+		P      string `xml:"p"`
+		SP     string `xml:"sp,omitempty"`
+		Pct    int    `xml:"pct"`
+	}
+	reportRecord struct {
+		Row         row         `xml:"row"`
+		Identifiers identifiers `xml:"identifiers"`
+		AuthResults authResults `xml:"auth_results"`
+	}
+	row struct {
+		SourceIP        string          `xml:"source_ip"`
+		Count           int             `xml:"count"`
+		PolicyEvaluated policyEvaluated `xml:"policy_evaluated"`
+	}
+	policyEvaluated struct {
+		Disposition string           `xml:"disposition"`
+		DKIM        string           `xml:"dkim"`
+		SPF         string           `xml:"spf"`
+		Reasons     []policyOverride `xml:"reason,omitempty"`
+	}
+	policyOverride struct {
+		Type    string `xml:"type"`
+		Comment string `xml:"comment,omitempty"`
+	}
+	identifiers struct {
+		HeaderFrom string `xml:"header_from"`
+	}
+	authResults struct {
+		DKIM []dkimAuthResult `xml:"dkim,omitempty"`
+		SPF  []spfAuthResult  `xml:"spf"`
+	}
+	dkimAuthResult struct {
+		Domain   string `xml:"domain"`
+		Selector string `xml:"selector,omitempty"`
+		Result   string `xml:"result"`
+	}
+	spfAuthResult struct {
+		Domain string `xml:"domain"`
+		Scope  string `xml:"scope,omitempty"`
+		Result string `xml:"result"`
+	}
+)
+
+type domainStats struct {
+	Policy  policyPublished
+	Records []*reportRecord
+}
+
+func newPolicyPublished(domain string, rec *dmarc.Record) policyPublished {
+	pp := policyPublished{
+		Domain: domain,
+		ADKIM:  string(rec.DKIMAlignment),
+		ASPF:   string(rec.SPFAlignment),
+		P:      string(rec.Policy),
+		SP:     string(rec.SubdomainPolicy),
+		Pct:    100,
+	}
+	if rec.Percent != nil {
+		pp.Pct = *rec.Percent
+	}
+	return pp
+}
+
+func alignedResult(aligned bool, value authres.ResultValue) string {
+	if aligned && value == authres.ResultPass {
+		return "pass"
+	}
+	return "fail"
+}
+
+func newRow(res Result) *reportRecord {
+	disposition := string(res.Disposition)
+	if disposition == "" {
+		disposition = string(dmarc.PolicyNone)
+	}
+
+	rec := &reportRecord{
+		Row: row{
+			SourceIP: res.SourceIP.String(),
+			PolicyEvaluated: policyEvaluated{
+				Disposition: disposition,
+				DKIM:        alignedResult(res.Eval.DKIMAligned, res.Eval.DKIMResult.Value),
+				SPF:         alignedResult(res.Eval.SPFAligned, res.Eval.SPFResult.Value),
+			},
+		},
+		Identifiers: identifiers{
+			HeaderFrom: strings.ToLower(res.HeaderFrom),
+		},
+	}
+	if res.SampledOut {
+		rec.Row.PolicyEvaluated.Reasons = []policyOverride{{Type: "sampled_out"}}
+	}
+
+	for _, ar := range res.AuthResults {
+		if dkimRes, selector, ok := dmarc.AsDKIMResult(ar); ok {
+			rec.AuthResults.DKIM = append(rec.AuthResults.DKIM, dkimAuthResult{
+				Domain:   dkimRes.Domain,
+				Selector: selector,
+				Result:   string(dkimRes.Value),
+			})
+			continue
+		}
+		switch ar := ar.(type) {
+		case *authres.SPFResult:
+			spf := spfAuthResult{
+				Domain: ar.From,
+				Scope:  "mfrom",
+				Result: string(ar.Value),
+			}
+			if spf.Domain == "" {
+				spf.Domain = ar.Helo
+				spf.Scope = "helo"
+			}
+			if _, domain, ok := strings.Cut(spf.Domain, "@"); ok {
+				spf.Domain = domain
+			}
+			rec.AuthResults.SPF = append(rec.AuthResults.SPF, spf)
+		}
+	}
+	// spf element is required by the schema.
+	if len(rec.AuthResults.SPF) == 0 {
+		rec.AuthResults.SPF = []spfAuthResult{{Result: string(authres.ResultNone)}}
+	}
+	return rec
+}
+
+// sameAs reports whether rows can be merged by summing the message count.
+func (rec *reportRecord) sameAs(other *reportRecord) bool {
+	a, b := rec, other
+	if a.Row.SourceIP != b.Row.SourceIP || a.Identifiers != b.Identifiers {
+		return false
+	}
+	pa, pb := a.Row.PolicyEvaluated, b.Row.PolicyEvaluated
+	if pa.Disposition != pb.Disposition || pa.DKIM != pb.DKIM || pa.SPF != pb.SPF ||
+		len(pa.Reasons) != len(pb.Reasons) {
+		return false
+	}
+	if len(a.AuthResults.DKIM) != len(b.AuthResults.DKIM) || len(a.AuthResults.SPF) != len(b.AuthResults.SPF) {
+		return false
+	}
+	for i := range a.AuthResults.DKIM {
+		if a.AuthResults.DKIM[i] != b.AuthResults.DKIM[i] {
+			return false
+		}
+	}
+	for i := range a.AuthResults.SPF {
+		if a.AuthResults.SPF[i] != b.AuthResults.SPF[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,553 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package report implements generation of DMARC aggregate reports
+// (RFC 7489, Section 7.2).
+//
+// Results of DMARC evaluation for received messages are aggregated per policy
+// domain and, once per reporting interval, reports are sent to the addresses
+// published by the domain in the rua tag.
+package report
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	modName = "dmarc_reports"
+
+	pendingFile = "pending.json"
+	archiveDir  = "archive"
+)
+
+// Result is the result of the DMARC evaluation for a single message.
+type Result struct {
+	SourceIP     net.IP
+	HeaderFrom   string
+	PolicyDomain string
+	Record       *dmarc.Record
+	Eval         dmarc.EvalResult
+	// Policy applied to the message.
+	Disposition dmarc.Policy
+	// Set if the policy was not applied because of the pct tag.
+	SampledOut bool
+	// DKIM and SPF results for the message.
+	AuthResults []authres.Result
+}
+
+// Reporter aggregates results of DMARC evaluation and sends aggregate
+// reports to domains that request them.
+type Reporter struct {
+	instName string
+
+	dir      string
+	org      string
+	contact  string
+	from     string
+	hostname string
+	interval time.Duration
+	maxSize  int64
+	exclude  []string
+	sender   module.DeliveryTarget
+	resolver dns.Resolver
+	log      log.Logger
+
+	lock    sync.Mutex
+	start   time.Time
+	pending map[string]*domainStats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type state struct {
+	Start   time.Time
+	Domains []*domainStats
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Reporter{
+		instName: instName,
+		pending:  map[string]*domainStats{},
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (r *Reporter) Name() string {
+	return modName
+}
+
+func (r *Reporter) InstanceName() string {
+	return r.instName
+}
+
+func (r *Reporter) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &r.log.Debug)
+	cfg.String("hostname", true, true, "", &r.hostname)
+	cfg.String("dir", false, false, "dmarc_reports", &r.dir)
+	cfg.String("organization", false, false, "", &r.org)
+	cfg.String("contact", false, false, "", &r.contact)
+	cfg.String("from", false, false, "", &r.from)
+	cfg.Duration("interval", false, false, 24*time.Hour, &r.interval)
+	cfg.DataSize("max_size", false, false, 10*1024*1024, &r.maxSize)
+	cfg.StringList("exclude_domains", false, false, nil, &r.exclude)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &r.sender)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if r.interval <= 0 {
+		return fmt.Errorf("%s: interval should be positive", modName)
+	}
+
+	if err := r.init(r.hostname, dns.DefaultResolver()); err != nil {
+		return err
+	}
+	r.Start()
+	return nil
+}
+
+func (r *Reporter) init(hostname string, resolver dns.Resolver) error {
+	r.hostname = hostname
+	r.resolver = resolver
+	if r.org == "" {
+		r.org = hostname
+	}
+	if r.contact == "" {
+		r.contact = "postmaster@" + hostname
+	}
+	if r.from == "" {
+		r.from = "dmarc-noreply@" + hostname
+	}
+	for i, domain := range r.exclude {
+		r.exclude[i] = strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+
+	if err := os.MkdirAll(filepath.Join(r.dir, archiveDir), 0o700); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if err := r.loadPending(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+func (r *Reporter) loadPending() error {
+	f, err := os.Open(filepath.Join(r.dir, pendingFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			r.start = time.Now().UTC().Truncate(time.Second)
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var st state
+	if err := json.NewDecoder(f).Decode(&st); err != nil {
+		return fmt.Errorf("malformed pending state: %w", err)
+	}
+	r.start = st.Start
+	for _, stats := range st.Domains {
+		r.pending[stats.Policy.Domain] = stats
+	}
+	return nil
+}
+
+func (r *Reporter) savePending() error {
+	r.lock.Lock()
+	st := state{
+		Start:   r.start,
+		Domains: make([]*domainStats, 0, len(r.pending)),
+	}
+	for _, stats := range r.pending {
+		st.Domains = append(st.Domains, stats)
+	}
+	blob, err := json.Marshal(st)
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(r.dir, pendingFile)
+	if err := os.WriteFile(path+".tmp", blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (r *Reporter) excluded(domain string) bool {
+	for _, excl := range r.exclude {
+		if domain == excl || strings.HasSuffix(domain, "."+excl) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record adds the result of the DMARC evaluation to the aggregated
+// statistics. Results for messages without a DMARC policy or a source IP
+// are ignored.
+func (r *Reporter) Record(res Result) {
+	if res.Record == nil || res.SourceIP == nil || len(res.Record.ReportURIAggregate) == 0 {
+		return
+	}
+	policyDomain := strings.ToLower(res.PolicyDomain)
+	if r.excluded(policyDomain) {
+		return
+	}
+
+	row := newRow(res)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats, ok := r.pending[policyDomain]
+	if !ok {
+		stats = &domainStats{}
+		r.pending[policyDomain] = stats
+	}
+	// The most recently seen policy is reported.
+	stats.Policy = newPolicyPublished(policyDomain, res.Record)
+
+	for _, rec := range stats.Records {
+		if rec.sameAs(row) {
+			rec.Row.Count++
+			return
+		}
+	}
+	row.Row.Count = 1
+	stats.Records = append(stats.Records, row)
+}
+
+func (r *Reporter) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.loop()
+}
+
+func (r *Reporter) loop() {
+	defer close(r.done)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during DMARC reporting: %v\n%s", err, stack)
+		}
+	}()
+
+	saveTick := time.NewTicker(10 * time.Minute)
+	defer saveTick.Stop()
+
+	for {
+		r.lock.Lock()
+		next := r.start.Add(r.interval)
+		r.lock.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			r.report(context.Background(), time.Now())
+		case <-saveTick.C:
+			timer.Stop()
+			if err := r.savePending(); err != nil {
+				r.log.Error("failed to save pending statistics", err)
+			}
+		case <-r.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (r *Reporter) Close() error {
+	if r.stop != nil {
+		close(r.stop)
+		<-r.done
+	}
+	return r.savePending()
+}
+
+// report generates and sends reports for the current period.
+func (r *Reporter) report(ctx context.Context, now time.Time) {
+	r.lock.Lock()
+	dateRange := dateRange{
+		Begin: r.start.Unix(),
+		End:   now.UTC().Truncate(time.Second).Unix(),
+	}
+	pending := r.pending
+	r.pending = map[string]*domainStats{}
+	r.start = time.Unix(dateRange.End, 0).UTC()
+	r.lock.Unlock()
+
+	for domain, stats := range pending {
+		fb := feedback{
+			Version: "1.0",
+			Metadata: reportMetadata{
+				OrgName:   r.org,
+				Email:     r.contact,
+				ReportID:  time.Unix(dateRange.End, 0).UTC().Format("20060102T150405Z") + "_" + domain + "@" + r.hostname,
+				DateRange: dateRange,
+			},
+			Policy:  stats.Policy,
+			Records: stats.Records,
+		}
+		if err := r.sendReport(ctx, domain, fb); err != nil {
+			r.log.Error("failed to send report", err, "domain", domain, "report_id", fb.Metadata.ReportID)
+		}
+	}
+
+	if err := r.savePending(); err != nil {
+		r.log.Error("failed to save pending statistics", err)
+	}
+}
+
+func (r *Reporter) sendReport(ctx context.Context, domain string, fb feedback) error {
+	blob, err := xml.MarshalIndent(fb, "", "  ")
+	if err != nil {
+		return err
+	}
+	blob = append([]byte(xml.Header), blob...)
+
+	archivePath := filepath.Join(r.dir, archiveDir, fb.Metadata.ReportID+".xml")
+	if err := os.WriteFile(archivePath, blob, 0o600); err != nil {
+		return err
+	}
+
+	// Use the current record, reporting addresses might have changed since
+	// the messages were received.
+	_, rec, err := dmarc.FetchRecord(ctx, r.resolver, domain)
+	if err != nil {
+		return err
+	}
+	if rec == nil || len(rec.ReportURIAggregate) == 0 {
+		r.log.DebugMsg("no rua in DMARC record, report is only archived", "domain", domain)
+		return nil
+	}
+
+	var gzBlob bytes.Buffer
+	gzw := gzip.NewWriter(&gzBlob)
+	if _, err := gzw.Write(blob); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, uri := range rec.ReportURIAggregate {
+		rcpt, limit, err := parseReportURI(uri)
+		if err != nil {
+			r.log.Error("malformed rua URI", err, "domain", domain, "rua", uri)
+			lastErr = err
+			continue
+		}
+		if r.maxSize > 0 && (limit == 0 || limit > r.maxSize) {
+			limit = r.maxSize
+		}
+		if limit > 0 && int64(gzBlob.Len()) > limit {
+			r.log.Msg("report is too big, not sending", "domain", domain, "rua", uri, "size", gzBlob.Len(), "limit", limit)
+			continue
+		}
+
+		if err := r.verifyDestination(ctx, domain, rcpt); err != nil {
+			r.log.Msg("external report destination is not authorized", "domain", domain, "rua", uri, "reason", err.Error())
+			continue
+		}
+
+		if err := r.sendMail(ctx, rcpt, domain, fb, gzBlob.Bytes()); err != nil {
+			r.log.Error("report delivery failed", err, "domain", domain, "rua", uri)
+			lastErr = err
+			continue
+		}
+		r.log.Msg("report sent", "domain", domain, "rua", uri, "report_id", fb.Metadata.ReportID)
+	}
+	return lastErr
+}
+
+// parseReportURI parses the rua URI with the optional size limit
+// (RFC 7489, Section 6.2).
+func parseReportURI(uri string) (rcpt string, limit int64, err error) {
+	if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+		return "", 0, fmt.Errorf("unsupported URI scheme: %s", uri)
+	}
+	addr := uri[len("mailto:"):]
+
+	if sep := strings.LastIndexByte(addr, '!'); sep != -1 {
+		sizeStr := strings.ToLower(addr[sep+1:])
+		addr = addr[:sep]
+
+		mult := int64(1)
+		if sizeStr != "" {
+			switch sizeStr[len(sizeStr)-1] {
+			case 'k':
+				mult = 1 << 10
+			case 'm':
+				mult = 1 << 20
+			case 'g':
+				mult = 1 << 30
+			case 't':
+				mult = 1 << 40
+			}
+			if mult != 1 {
+				sizeStr = sizeStr[:len(sizeStr)-1]
+			}
+		}
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size < 0 {
+			return "", 0, fmt.Errorf("malformed size limit: %s", uri)
+		}
+		limit = size * mult
+	}
+
+	if _, _, err := address.Split(addr); err != nil {
+		return "", 0, err
+	}
+	return addr, limit, nil
+}
+
+// verifyDestination checks whether the domain of rcpt accepts reports for
+// policyDomain (RFC 7489, Section 7.1).
+func (r *Reporter) verifyDestination(ctx context.Context, policyDomain, rcpt string) error {
+	_, rcptDomain, err := address.Split(rcpt)
+	if err != nil {
+		return err
+	}
+	rcptDomain = strings.ToLower(rcptDomain)
+
+	policyOrg, err := publicsuffix.EffectiveTLDPlusOne(policyDomain)
+	if err != nil {
+		return err
+	}
+	rcptOrg, err := publicsuffix.EffectiveTLDPlusOne(rcptDomain)
+	if err != nil {
+		return err
+	}
+	if policyOrg == rcptOrg {
+		return nil
+	}
+
+	txts, err := r.resolver.LookupTXT(ctx, dns.FQDN(policyDomain+"._report._dmarc."+rcptDomain))
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return errors.New("no authorization record")
+		}
+		return err
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			return nil
+		}
+	}
+	return errors.New("no authorization record")
+}
+
+func (r *Reporter) sendMail(ctx context.Context, rcpt, domain string, fb feedback, gzBlob []byte) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	textPart := make(textproto.MIMEHeader)
+	textPart.Set("Content-Type", "text/plain; charset=utf-8")
+	w, err := mw.CreatePart(textPart)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "This is an aggregate DMARC report from %s for %s.\r\n", r.org, domain)
+
+	// RFC 7489, Section 7.2.1.1.
+	filename := fmt.Sprintf("%s!%s!%d!%d.xml.gz", r.hostname, domain,
+		fb.Metadata.DateRange.Begin, fb.Metadata.DateRange.End)
+	reportPart := make(textproto.MIMEHeader)
+	reportPart.Set("Content-Type", "application/gzip")
+	reportPart.Set("Content-Transfer-Encoding", "base64")
+	reportPart.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w, err = mw.CreatePart(reportPart)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(gzBlob)
+	for len(encoded) > 76 {
+		fmt.Fprintf(w, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(w, "%s\r\n", encoded)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	hdr := msgtextproto.Header{}
+	hdr.Add("From", r.from)
+	hdr.Add("To", rcpt)
+	hdr.Add("Subject", "Report Domain: "+domain+" Submitter: "+r.org+" Report-ID: <"+fb.Metadata.ReportID+">")
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+r.hostname+">")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", `multipart/mixed; boundary="`+mw.Boundary()+`"`)
+
+	msgMeta := &module.MsgMetadata{ID: msgID}
+	delivery, err := r.sender.Start(ctx, msgMeta, r.from)
+	if err != nil {
+		return err
+	}
+	if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func init() {
+	module.Register(modName, New)
+}
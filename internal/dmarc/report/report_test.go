@@ -0,0 +1,246 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testReporter(t *testing.T, zones map[string]mockdns.Zone) (*Reporter, *testutils.Target) {
+	t.Helper()
+	sender := &testutils.Target{}
+	r := &Reporter{
+		dir:      t.TempDir(),
+		interval: 24 * time.Hour,
+		pending:  map[string]*domainStats{},
+		sender:   sender,
+		log:      testutils.Logger(t, modName),
+	}
+	if err := r.init("mx.example.com", &mockdns.Resolver{Zones: zones}); err != nil {
+		t.Fatal(err)
+	}
+	return r, sender
+}
+
+func testResult(t *testing.T, ip string, dkimRes authres.ResultValue) Result {
+	t.Helper()
+	return Result{
+		SourceIP:     net.ParseIP(ip),
+		HeaderFrom:   "example.org",
+		PolicyDomain: "example.org",
+		Record: &dmarc.Record{
+			Policy:             dmarc.PolicyReject,
+			ReportURIAggregate: []string{"mailto:dmarc@example.org"},
+		},
+		Eval: dmarc.EvalResult{
+			DKIMAligned: true,
+			DKIMResult:  authres.DKIMResult{Value: dkimRes, Domain: "example.org"},
+		},
+		Disposition: dmarc.PolicyNone,
+		AuthResults: []authres.Result{
+			&authres.DKIMResult{Value: dkimRes, Domain: "example.org"},
+			&authres.SPFResult{Value: authres.ResultNone, From: "example.org"},
+		},
+	}
+}
+
+func readReport(t *testing.T, msg testutils.Msg) feedback {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(msg.Body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal("No report attachment:", err)
+		}
+		if part.Header.Get("Content-Type") != "application/gzip" {
+			continue
+		}
+		gzr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := io.ReadAll(gzr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fb feedback
+		if err := xml.Unmarshal(blob, &fb); err != nil {
+			t.Fatal(err)
+		}
+		return fb
+	}
+}
+
+func TestReporter_Report(t *testing.T) {
+	r, sender := testReporter(t, map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.org"},
+		},
+	})
+
+	r.Record(testResult(t, "192.0.2.1", authres.ResultPass))
+	r.Record(testResult(t, "192.0.2.1", authres.ResultPass))
+	r.Record(testResult(t, "192.0.2.2", authres.ResultFail))
+	r.report(context.Background(), time.Now())
+
+	if len(sender.Messages) != 1 {
+		t.Fatal("Wrong amount of reports sent:", len(sender.Messages))
+	}
+	msg := sender.Messages[0]
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "dmarc@example.org" {
+		t.Fatal("Wrong recipient:", msg.RcptTo)
+	}
+
+	fb := readReport(t, msg)
+	if fb.Policy.Domain != "example.org" || fb.Policy.P != "reject" || fb.Policy.Pct != 100 {
+		t.Error("Wrong policy_published:", fb.Policy)
+	}
+	if fb.Metadata.OrgName != "mx.example.com" {
+		t.Error("Wrong org_name:", fb.Metadata.OrgName)
+	}
+	if len(fb.Records) != 2 {
+		t.Fatal("Wrong amount of records:", len(fb.Records))
+	}
+	for _, rec := range fb.Records {
+		switch rec.Row.SourceIP {
+		case "192.0.2.1":
+			if rec.Row.Count != 2 || rec.Row.PolicyEvaluated.DKIM != "pass" {
+				t.Error("Wrong row:", rec.Row)
+			}
+		case "192.0.2.2":
+			if rec.Row.Count != 1 || rec.Row.PolicyEvaluated.DKIM != "fail" {
+				t.Error("Wrong row:", rec.Row)
+			}
+		default:
+			t.Error("Unexpected row:", rec.Row)
+		}
+		if rec.Identifiers.HeaderFrom != "example.org" {
+			t.Error("Wrong header_from:", rec.Identifiers.HeaderFrom)
+		}
+		if len(rec.AuthResults.DKIM) != 1 || len(rec.AuthResults.SPF) != 1 {
+			t.Error("Wrong auth_results:", rec.AuthResults)
+		}
+	}
+
+	// Statistics are reset after the report.
+	if len(r.pending) != 0 {
+		t.Error("Pending statistics are not reset")
+	}
+}
+
+func TestReporter_ExternalDestination(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=reject; rua=mailto:dmarc@reports.example"},
+		},
+	}
+
+	r, sender := testReporter(t, zones)
+	r.Record(testResult(t, "192.0.2.1", authres.ResultPass))
+	r.report(context.Background(), time.Now())
+	if len(sender.Messages) != 0 {
+		t.Fatal("Report sent to unauthorized destination")
+	}
+
+	zones["example.org._report._dmarc.reports.example."] = mockdns.Zone{
+		TXT: []string{"v=DMARC1"},
+	}
+	r, sender = testReporter(t, zones)
+	r.Record(testResult(t, "192.0.2.1", authres.ResultPass))
+	r.report(context.Background(), time.Now())
+	if len(sender.Messages) != 1 {
+		t.Fatal("Report is not sent to authorized destination")
+	}
+}
+
+func TestReporter_SizeLimit(t *testing.T) {
+	r, sender := testReporter(t, map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=reject; rua=mailto:small@example.org!10,mailto:dmarc@example.org!10k"},
+		},
+	})
+	r.Record(testResult(t, "192.0.2.1", authres.ResultPass))
+	r.report(context.Background(), time.Now())
+
+	if len(sender.Messages) != 1 || sender.Messages[0].RcptTo[0] != "dmarc@example.org" {
+		t.Fatal("Size limit is not respected")
+	}
+}
+
+func TestReporter_Exclude(t *testing.T) {
+	r, sender := testReporter(t, map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.org"},
+		},
+	})
+	r.exclude = []string{"example.org"}
+	r.Record(testResult(t, "192.0.2.1", authres.ResultPass))
+	r.report(context.Background(), time.Now())
+
+	if len(sender.Messages) != 0 {
+		t.Fatal("Report is sent for excluded domain")
+	}
+}
+
+func TestParseReportURI(t *testing.T) {
+	test := func(uri, rcpt string, limit int64, fail bool) {
+		t.Helper()
+		actualRcpt, actualLimit, err := parseReportURI(uri)
+		if fail {
+			if err == nil {
+				t.Errorf("Expected error for %q", uri)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", uri, err)
+			return
+		}
+		if actualRcpt != rcpt || actualLimit != limit {
+			t.Errorf("parseReportURI(%q) = %q, %d; want %q, %d", uri, actualRcpt, actualLimit, rcpt, limit)
+		}
+	}
+
+	test("mailto:dmarc@example.org", "dmarc@example.org", 0, false)
+	test("MAILTO:dmarc@example.org", "dmarc@example.org", 0, false)
+	test("mailto:dmarc@example.org!100", "dmarc@example.org", 100, false)
+	test("mailto:dmarc@example.org!10k", "dmarc@example.org", 10*1024, false)
+	test("mailto:dmarc@example.org!2m", "dmarc@example.org", 2*1024*1024, false)
+	test("mailto:dmarc@example.org!m", "", 0, true)
+	test("https://example.org/dmarc", "", 0, true)
+}
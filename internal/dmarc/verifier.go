@@ -54,6 +54,8 @@ func (errPanic) Error() string {
 type Verifier struct {
 	fetchCh     chan verifyData
 	fetchCancel context.CancelFunc
+	// Result of the record lookup used by Apply.
+	data verifyData
 
 	resolver Resolver
 
@@ -112,6 +114,12 @@ func (v *Verifier) FetchRecord(ctx context.Context, header textproto.Header) {
 	}()
 }
 
+// PolicyRecord returns the DMARC record used by Apply and the domain it was
+// found at. rec is nil if there is no record or Apply was not called yet.
+func (v *Verifier) PolicyRecord() (policyDomain string, rec *Record) {
+	return v.data.policyDomain, v.data.record
+}
+
 // Apply actually performs all actions necessary to apply a DMARC policy to the message.
 //
 // The authRes slice should contain results for DKIM and SPF checks. FetchRecord should be
@@ -128,6 +136,7 @@ func (v *Verifier) FetchRecord(ctx context.Context, header textproto.Header) {
 // whether to apply a policy with the pct key.
 func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 	data := <-v.fetchCh
+	v.data = data
 	if data.recordErr != nil {
 		result := authres.DMARCResult{
 			Value:  authres.ResultPermError,
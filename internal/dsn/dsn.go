@@ -45,6 +45,10 @@ type ReportingMTAInfo struct {
 	// Message identifier, included as 'X-Maddy-MsgId: MSGID' field.
 	XMessageID string
 
+	// Trace identifier of the message, included as 'X-Maddy-TraceID: ID'
+	// field.
+	XTraceID string
+
 	// Time when message was enqueued for delivery by Reporting MTA.
 	ArrivalDate time.Time
 
@@ -92,6 +96,9 @@ func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
 	if info.XMessageID != "" {
 		h.Add("X-Maddy-MsgID", info.XMessageID)
 	}
+	if info.XTraceID != "" {
+		h.Add("X-Maddy-TraceID", info.XTraceID)
+	}
 
 	if !info.ArrivalDate.IsZero() {
 		h.Add("Arrival-Date", info.ArrivalDate.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
@@ -187,10 +194,23 @@ type Envelope struct {
 
 // GenerateDSN is a top-level function that should be used for generation of the DSNs.
 //
+// tmpls is used for the human-readable part, built-in English text is used
+// if it is nil.
+//
 // DSN header will be returned, body itself will be written to outWriter.
-func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+func GenerateDSN(tmpls *Templates, utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
 	partWriter := textproto.NewMultipartWriter(outWriter)
 
+	tmpl, lang := tmpls.Select(failedHeader)
+	data := newTemplateData(tmpls, lang, mtaInfo, rcptsInfo)
+	if tmpl == failedText && data.Delayed {
+		tmpl = delayedText
+	}
+	subject, err := executeSubject(tmpl, data)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+
 	reportHeader := textproto.Header{}
 	reportHeader.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
 	reportHeader.Add("Message-Id", envelope.MsgID)
@@ -200,11 +220,14 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	reportHeader.Add("Auto-Submitted", "auto-replied")
 	reportHeader.Add("To", envelope.To)
 	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	reportHeader.Add("Subject", subject)
+	if lang != "" {
+		reportHeader.Add("Content-Language", lang)
+	}
 
 	defer partWriter.Close()
 
-	if err := writeHumanReadablePart(partWriter, mtaInfo, rcptsInfo); err != nil {
+	if err := writeHumanReadablePart(partWriter, tmpl, data); err != nil {
 		return textproto.Header{}, err
 	}
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
@@ -255,44 +278,18 @@ func writeMachineReadablePart(utf8 bool, w *textproto.MultipartWriter, mtaInfo R
 	return nil
 }
 
-// failedText is the text of the human-readable part of DSN.
-var failedText = template.Must(template.New("dsn-text").Parse(`
-This is the mail delivery system at {{.ReportingMTA}}.
-
-Unfortunately, your message could not be delivered to one or more
-recipients. The usual cause of this problem is invalid
-recipient address or maintenance at the recipient side.
-
-Contact the postmaster for further assistance, provide the Message ID (below):
-
-Message ID: {{.XMessageID}}
-Arrival: {{.ArrivalDate}}
-Last delivery attempt: {{.LastAttemptDate}}
-
-`))
-
-func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+func writeHumanReadablePart(w *textproto.MultipartWriter, tmpl *template.Template, data TemplateData) error {
 	humanHeader := textproto.Header{}
 	humanHeader.Add("Content-Transfer-Encoding", "8bit")
 	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
 	humanHeader.Add("Content-Description", "Notification")
+	if data.Language != "" {
+		humanHeader.Add("Content-Language", data.Language)
+	}
 	humanWriter, err := w.CreatePart(humanHeader)
 	if err != nil {
 		return err
 	}
 
-	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
-	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
-
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
-		return err
-	}
-
-	for _, rcpt := range rcptsInfo {
-		if _, err := fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return tmpl.Execute(humanWriter, data)
 }
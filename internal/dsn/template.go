@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dsn
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+const (
+	defaultSubject        = "Undelivered Mail Returned to Sender"
+	defaultDelayedSubject = "Delayed Mail (still being retried)"
+)
+
+// failedText is the built-in text of the human-readable part of DSN.
+var failedText = template.Must(template.New("dsn-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Unfortunately, your message could not be delivered to one or more
+recipients. The usual cause of this problem is invalid
+recipient address or maintenance at the recipient side.
+
+Contact {{if .Contact}}{{.Contact}}{{else}}the postmaster{{end}} for further assistance, provide the Message ID (below):
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+{{range .Recipients}}Delivery to {{.Address}} failed with error: {{.Error}}
+{{end}}`))
+
+// delayedText is the built-in text used instead of failedText for delay
+// notifications.
+var delayedText = template.Must(template.New("dsn-delayed-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message could not be delivered yet to one or more recipients.
+Delivery will be retried, no action is required from you. You will
+be notified if the message cannot be delivered at all.
+
+Contact {{if .Contact}}{{.Contact}}{{else}}the postmaster{{end}} for further assistance, provide the Message ID (below):
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+{{range .Recipients}}Delivery to {{.Address}} is delayed, last error: {{.Error}}
+{{end}}`))
+
+// TemplateData is the value passed to the human-readable part templates.
+type TemplateData struct {
+	ReportingMTAInfo
+
+	// Contact information specified by the server administrator.
+	Contact string
+
+	// Language of the template used.
+	Language string
+
+	// Set if this is a delay notification, delivery to all listed
+	// recipients will be retried.
+	Delayed bool
+
+	Recipients []TemplateRcpt
+}
+
+type TemplateRcpt struct {
+	Address string
+	// Status code, e.g. 5.1.1.
+	Status string
+	Error  string
+}
+
+// Templates is a set of templates for the human-readable part of DSNs in
+// multiple languages.
+//
+// Each template may define the "subject" template that is used for the
+// Subject header field.
+type Templates struct {
+	Contact string
+
+	defaultLang string
+	langs       map[string]*template.Template
+}
+
+// NewTemplates loads templates from files, files maps the language tag
+// (e.g. "en" or "pt-br") to the path of the template.
+//
+// If there is no template for defaultLang, the built-in one is used.
+func NewTemplates(defaultLang, contact string, files map[string]string) (*Templates, error) {
+	t := &Templates{
+		Contact:     contact,
+		defaultLang: strings.ToLower(defaultLang),
+		langs:       make(map[string]*template.Template, len(files)),
+	}
+	for lang, path := range files {
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("dsn: %w", err)
+		}
+		tmpl, err := template.New(path).Parse(string(blob))
+		if err != nil {
+			return nil, fmt.Errorf("dsn: %w", err)
+		}
+		t.langs[strings.ToLower(lang)] = tmpl
+	}
+	return t, nil
+}
+
+// Select returns the template to use for the DSN about the message with
+// the specified header and the language of that template.
+//
+// Accept-Language and Content-Language fields of the original message
+// are considered. Select can be called on the nil Templates.
+func (t *Templates) Select(header textproto.Header) (*template.Template, string) {
+	if t == nil {
+		return failedText, ""
+	}
+
+	for _, field := range []string{"Accept-Language", "Content-Language"} {
+		for _, lang := range strings.Split(header.Get(field), ",") {
+			// Strip quality values and comments.
+			if i := strings.IndexAny(lang, ";("); i != -1 {
+				lang = lang[:i]
+			}
+			lang = strings.ToLower(strings.TrimSpace(lang))
+			if lang == "" {
+				continue
+			}
+			if tmpl, ok := t.langs[lang]; ok {
+				return tmpl, lang
+			}
+			if i := strings.IndexByte(lang, '-'); i != -1 {
+				if tmpl, ok := t.langs[lang[:i]]; ok {
+					return tmpl, lang[:i]
+				}
+			}
+		}
+	}
+
+	if tmpl, ok := t.langs[t.defaultLang]; ok {
+		return tmpl, t.defaultLang
+	}
+	return failedText, ""
+}
+
+func newTemplateData(t *Templates, lang string, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) TemplateData {
+	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
+	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
+
+	data := TemplateData{
+		ReportingMTAInfo: mtaInfo,
+		Language:         lang,
+		Recipients:       make([]TemplateRcpt, 0, len(rcptsInfo)),
+	}
+	if t != nil {
+		data.Contact = t.Contact
+	}
+	data.Delayed = len(rcptsInfo) != 0
+	for _, rcpt := range rcptsInfo {
+		if rcpt.Action != ActionDelayed {
+			data.Delayed = false
+		}
+		tr := TemplateRcpt{
+			Address: rcpt.FinalRecipient,
+			Status:  fmt.Sprintf("%d.%d.%d", rcpt.Status[0], rcpt.Status[1], rcpt.Status[2]),
+		}
+		if rcpt.DiagnosticCode != nil {
+			tr.Error = rcpt.DiagnosticCode.Error()
+		}
+		data.Recipients = append(data.Recipients, tr)
+	}
+	return data
+}
+
+func executeSubject(tmpl *template.Template, data TemplateData) (string, error) {
+	def := defaultSubject
+	if data.Delayed {
+		def = defaultDelayedSubject
+	}
+
+	subjTmpl := tmpl.Lookup("subject")
+	if subjTmpl == nil {
+		return def, nil
+	}
+
+	var subject bytes.Buffer
+	if err := subjTmpl.Execute(&subject, data); err != nil {
+		return "", err
+	}
+	value := strings.Join(strings.Fields(subject.String()), " ")
+	if value == "" {
+		return def, nil
+	}
+	return mime.QEncoding.Encode("utf-8", value), nil
+}
@@ -0,0 +1,200 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dsn
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func testGenerate(t *testing.T, tmpls *Templates, failedHeader textproto.Header) (textproto.Header, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	hdr, err := GenerateDSN(tmpls, false, Envelope{
+		MsgID: "<dsn@example.org>",
+		From:  "MAILER-DAEMON@example.org",
+		To:    "sender@example.org",
+	}, ReportingMTAInfo{
+		ReportingMTA:    "mx.example.org",
+		XSender:         "sender@example.org",
+		XMessageID:      "0123456789",
+		ArrivalDate:     time.Now(),
+		LastAttemptDate: time.Now(),
+	}, []RecipientInfo{
+		{
+			FinalRecipient: "rcpt@example.com",
+			Action:         ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+			DiagnosticCode: &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "No such user",
+			},
+		},
+	}, failedHeader, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, body.String()
+}
+
+func TestGenerateDSN_Default(t *testing.T) {
+	hdr, body := testGenerate(t, nil, textproto.Header{})
+
+	if subj := hdr.Get("Subject"); subj != defaultSubject {
+		t.Error("Wrong subject:", subj)
+	}
+	for _, s := range []string{
+		"Contact the postmaster for further assistance",
+		"Message ID: 0123456789",
+		"Delivery to rcpt@example.com failed with error: SMTP error 550: No such user",
+		"Status: 5.1.1",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Body does not contain %q:\n%s", s, body)
+		}
+	}
+}
+
+func TestGenerateDSN_Delayed(t *testing.T) {
+	var body bytes.Buffer
+	hdr, err := GenerateDSN(nil, false, Envelope{
+		MsgID: "<dsn@example.org>",
+		From:  "MAILER-DAEMON@example.org",
+		To:    "sender@example.org",
+	}, ReportingMTAInfo{
+		ReportingMTA: "mx.example.org",
+		XMessageID:   "0123456789",
+	}, []RecipientInfo{
+		{
+			FinalRecipient: "rcpt@example.com",
+			Action:         ActionDelayed,
+			Status:         smtp.EnhancedCode{4, 4, 1},
+			DiagnosticCode: &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+				Message:      "Connection timed out",
+			},
+		},
+	}, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subj := hdr.Get("Subject"); subj != defaultDelayedSubject {
+		t.Error("Wrong subject:", subj)
+	}
+	for _, s := range []string{
+		"Delivery will be retried",
+		"Delivery to rcpt@example.com is delayed, last error: SMTP error 451: Connection timed out",
+		"Action: delayed",
+		"Status: 4.4.1",
+	} {
+		if !strings.Contains(body.String(), s) {
+			t.Errorf("Body does not contain %q:\n%s", s, body.String())
+		}
+	}
+}
+
+func TestGenerateDSN_Templates(t *testing.T) {
+	dir := t.TempDir()
+	dePath := filepath.Join(dir, "de.tmpl")
+	err := os.WriteFile(dePath, []byte(`{{define "subject"}}Unzustellbar: {{(index .Recipients 0).Address}}{{end}}
+Ihre Nachricht konnte nicht zugestellt werden.
+{{range .Recipients}}{{.Address}}: {{.Status}}
+{{end}}Kontakt: {{.Contact}}, ID: {{.XMessageID}}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpls, err := NewTemplates("en", "support@example.org", map[string]string{"de": dePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Content-Language", "de-AT")
+	hdr, body := testGenerate(t, tmpls, failedHeader)
+
+	if subj := hdr.Get("Subject"); subj != "Unzustellbar: rcpt@example.com" {
+		t.Error("Wrong subject:", subj)
+	}
+	if lang := hdr.Get("Content-Language"); lang != "de" {
+		t.Error("Wrong Content-Language:", lang)
+	}
+	for _, s := range []string{
+		"Ihre Nachricht konnte nicht zugestellt werden.",
+		"rcpt@example.com: 5.1.1",
+		"Kontakt: support@example.org, ID: 0123456789",
+		// Machine-readable part is kept intact.
+		"Final-Recipient: rfc822; rcpt@example.com",
+		"Status: 5.1.1",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Body does not contain %q:\n%s", s, body)
+		}
+	}
+
+	// No matching language, default (built-in) template is used with the
+	// contact information.
+	hdr, body = testGenerate(t, tmpls, textproto.Header{})
+	if subj := hdr.Get("Subject"); subj != defaultSubject {
+		t.Error("Wrong subject:", subj)
+	}
+	if !strings.Contains(body, "Contact support@example.org for further assistance") {
+		t.Errorf("Contact is not included:\n%s", body)
+	}
+}
+
+func TestTemplates_Select(t *testing.T) {
+	tmpls := &Templates{
+		defaultLang: "en",
+		langs: map[string]*template.Template{
+			"en":    template.Must(template.New("en").Parse("")),
+			"pt-br": template.Must(template.New("pt-br").Parse("")),
+		},
+	}
+
+	test := func(field, value, expectLang string) {
+		t.Helper()
+		h := textproto.Header{}
+		if field != "" {
+			h.Add(field, value)
+		}
+		_, lang := tmpls.Select(h)
+		if lang != expectLang {
+			t.Errorf("%s: %s: expected %s, got %s", field, value, expectLang, lang)
+		}
+	}
+
+	test("", "", "en")
+	test("Accept-Language", "fr, pt-BR;q=0.8", "pt-br")
+	test("Content-Language", "EN-us", "en")
+	test("Content-Language", "fr", "en")
+}
@@ -0,0 +1,324 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminapi
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
+)
+
+// Account is the account state returned by the API.
+type Account struct {
+	Name string `json:"name"`
+	// Credentials are present in the auth module.
+	Credentials bool `json:"credentials"`
+	// Mailbox is present in the storage module.
+	Mailbox bool `json:"mailbox"`
+}
+
+// Quota is the storage usage of the account, in bytes. Zero limit means that
+// no quota is set.
+type Quota struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+type accountRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type quotaRequest struct {
+	// Limit uses the same format as the quota directive (e.g. 1G).
+	Limit string `json:"limit"`
+}
+
+var (
+	errNoAccounts = errorf(http.StatusNotImplemented, "accounts management is not configured")
+	errNoAuth     = errorf(http.StatusNotImplemented, "credentials management is not configured")
+	errNoQuotas   = errorf(http.StatusNotImplemented, "quotas management is not configured")
+)
+
+// accounts handles /v1/accounts requests:
+//
+//	GET    /v1/accounts
+//	POST   /v1/accounts
+//	GET    /v1/accounts/NAME
+//	DELETE /v1/accounts/NAME
+//	PUT    /v1/accounts/NAME/password
+//	GET    /v1/accounts/NAME/quota
+//	PUT    /v1/accounts/NAME/quota
+//	DELETE /v1/accounts/NAME/quota
+func (e *Endpoint) accounts(r *http.Request, path []string) (interface{}, error) {
+	if e.userDB == nil && e.storage == nil {
+		return nil, errNoAccounts
+	}
+
+	switch {
+	case len(path) == 0:
+		switch r.Method {
+		case http.MethodGet:
+			return e.listAccounts()
+		case http.MethodPost:
+			return e.createAccount(r)
+		}
+		return nil, methodNotAllowed(http.MethodGet, http.MethodPost)
+	case len(path) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			return e.getAccount(path[0])
+		case http.MethodDelete:
+			return nil, e.deleteAccount(r, path[0])
+		}
+		return nil, methodNotAllowed(http.MethodGet, http.MethodDelete)
+	case len(path) == 2 && path[1] == "password":
+		if r.Method != http.MethodPut {
+			return nil, methodNotAllowed(http.MethodPut)
+		}
+		return nil, e.setPassword(r, path[0])
+	case len(path) == 2 && path[1] == "quota":
+		switch r.Method {
+		case http.MethodGet:
+			return e.getQuota(r, path[0])
+		case http.MethodPut:
+			return nil, e.setQuota(r, path[0])
+		case http.MethodDelete:
+			return nil, e.resetQuota(r, path[0])
+		}
+		return nil, methodNotAllowed(http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+	return nil, errorf(http.StatusNotFound, "unknown path")
+}
+
+func (e *Endpoint) listAccounts() ([]Account, error) {
+	accts := make(map[string]*Account)
+	get := func(name string) *Account {
+		acct := accts[name]
+		if acct == nil {
+			acct = &Account{Name: name}
+			accts[name] = acct
+		}
+		return acct
+	}
+
+	if e.userDB != nil {
+		users, err := e.userDB.ListUsers()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range users {
+			get(name).Credentials = true
+		}
+	}
+	if e.storage != nil {
+		mboxes, err := e.storage.ListIMAPAccts()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range mboxes {
+			get(name).Mailbox = true
+		}
+	}
+
+	res := make([]Account, 0, len(accts))
+	for _, acct := range accts {
+		res = append(res, *acct)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+func (e *Endpoint) getAccount(name string) (Account, error) {
+	accts, err := e.listAccounts()
+	if err != nil {
+		return Account{}, err
+	}
+	for _, acct := range accts {
+		if acct.Name == name {
+			return acct, nil
+		}
+	}
+	return Account{}, errorf(http.StatusNotFound, "unknown account: %s", name)
+}
+
+func (e *Endpoint) checkPassword(password string) error {
+	if password == "" {
+		return errorf(http.StatusBadRequest, "password is required")
+	}
+	if pt, ok := e.userDB.(*pass_table.Auth); ok {
+		if err := pt.Policy().Check(password); err != nil {
+			return errorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+	return nil
+}
+
+// createAccount creates credentials and the mailbox for the account,
+// depending on what modules are configured.
+func (e *Endpoint) createAccount(r *http.Request) (Account, error) {
+	var req accountRequest
+	if err := readJSON(r, &req); err != nil {
+		return Account{}, err
+	}
+	if req.Name == "" {
+		return Account{}, errorf(http.StatusBadRequest, "name is required")
+	}
+	if e.userDB != nil {
+		if err := e.checkPassword(req.Password); err != nil {
+			return Account{}, err
+		}
+	}
+
+	if _, err := e.getAccount(req.Name); err == nil {
+		return Account{}, errorf(http.StatusConflict, "account already exists: %s", req.Name)
+	}
+
+	acct := Account{Name: req.Name}
+	if e.userDB != nil {
+		if err := e.userDB.CreateUser(req.Name, req.Password); err != nil {
+			return Account{}, err
+		}
+		acct.Credentials = true
+	}
+	if e.storage != nil {
+		if err := e.storage.CreateIMAPAcct(req.Name); err != nil {
+			if acct.Credentials {
+				if err := e.userDB.DeleteUser(req.Name); err != nil {
+					e.logger.Error("failed to remove credentials of partially created account", err, "username", req.Name)
+				}
+			}
+			return Account{}, err
+		}
+		acct.Mailbox = true
+	}
+
+	e.logger.Msg("account created", "username", req.Name, "src_ip", r.RemoteAddr)
+	return acct, nil
+}
+
+func (e *Endpoint) deleteAccount(r *http.Request, name string) error {
+	acct, err := e.getAccount(name)
+	if err != nil {
+		return err
+	}
+
+	if acct.Credentials {
+		if err := e.userDB.DeleteUser(name); err != nil {
+			return err
+		}
+	}
+	if acct.Mailbox {
+		if err := e.storage.DeleteIMAPAcct(name); err != nil {
+			return err
+		}
+	}
+
+	e.logger.Msg("account deleted", "username", name, "src_ip", r.RemoteAddr)
+	return nil
+}
+
+func (e *Endpoint) setPassword(r *http.Request, name string) error {
+	if e.userDB == nil {
+		return errNoAuth
+	}
+	var req passwordRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if err := e.checkPassword(req.Password); err != nil {
+		return err
+	}
+	acct, err := e.getAccount(name)
+	if err != nil {
+		return err
+	}
+	if !acct.Credentials {
+		return errorf(http.StatusNotFound, "no credentials for account: %s", name)
+	}
+
+	if err := e.userDB.SetUserPassword(name, req.Password); err != nil {
+		return err
+	}
+
+	e.logger.Msg("password changed", "username", name, "src_ip", r.RemoteAddr)
+	return nil
+}
+
+func (e *Endpoint) getQuota(r *http.Request, name string) (Quota, error) {
+	qs, ok := e.storage.(module.QuotaStorage)
+	if !ok {
+		return Quota{}, errNoQuotas
+	}
+	acct, err := e.getAccount(name)
+	if err != nil {
+		return Quota{}, err
+	}
+	if !acct.Mailbox {
+		return Quota{}, errorf(http.StatusNotFound, "no mailbox for account: %s", name)
+	}
+
+	used, limit, err := qs.QuotaUsage(r.Context(), name)
+	if err != nil {
+		return Quota{}, err
+	}
+	return Quota{Used: used, Limit: limit}, nil
+}
+
+func (e *Endpoint) setQuota(r *http.Request, name string) error {
+	if e.quotas == nil {
+		return errNoQuotas
+	}
+	var req quotaRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if _, err := config.ParseDataSize(req.Limit); err != nil {
+		return errorf(http.StatusBadRequest, "malformed limit: %v", err)
+	}
+
+	if err := e.quotas.SetKey(name, req.Limit); err != nil {
+		return err
+	}
+
+	e.logger.Msg("quota changed", "username", name, "limit", req.Limit, "src_ip", r.RemoteAddr)
+	return nil
+}
+
+func (e *Endpoint) resetQuota(r *http.Request, name string) error {
+	if e.quotas == nil {
+		return errNoQuotas
+	}
+
+	if err := e.quotas.RemoveKey(name); err != nil {
+		return err
+	}
+
+	e.logger.Msg("quota reset", "username", name, "src_ip", r.RemoteAddr)
+	return nil
+}
@@ -0,0 +1,288 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package adminapi implements the HTTP API for account, alias, quota and
+// queue management.
+//
+// Requests and responses use JSON. All requests should contain the
+// configured token in the "Authorization: Bearer" header. Errors are
+// reported as {"error": "..."} objects with the corresponding HTTP status.
+package adminapi
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "admin_api"
+
+// maxBodySize is the maximum size of the request body.
+const maxBodySize = 64 * 1024
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	tokenHash [sha256.Size]byte
+	tlsConfig *tls.Config
+
+	userDB  module.PlainUserDB
+	storage module.ManageableStorage
+	aliases module.MutableTable
+	quotas  module.MutableTable
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func mutableTable(name string, tbl module.Table) (module.MutableTable, error) {
+	if tbl == nil {
+		return nil, nil
+	}
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s: table is not mutable", modName, name)
+	}
+	return mtbl, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var (
+		token          string
+		storage        module.Storage
+		aliases, quota module.Table
+	)
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("token", false, true, "", &token)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Custom("auth", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var db module.PlainUserDB
+		err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &db)
+		return db, err
+	}, &e.userDB)
+	cfg.Custom("storage", false, false, nil, modconfig.StorageDirective, &storage)
+	modconfig.Table(cfg, "aliases", false, false, nil, &aliases)
+	modconfig.Table(cfg, "quotas", false, false, nil, &quota)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(token) < 16 {
+		return fmt.Errorf("%s: token should be at least 16 characters long", modName)
+	}
+	e.tokenHash = sha256.Sum256([]byte(token))
+
+	if storage != nil {
+		var ok bool
+		e.storage, ok = storage.(module.ManageableStorage)
+		if !ok {
+			return fmt.Errorf("%s: storage does not support accounts management", modName)
+		}
+	}
+	var err error
+	if e.aliases, err = mutableTable("aliases", aliases); err != nil {
+		return err
+	}
+	if e.quotas, err = mutableTable("quotas", quota); err != nil {
+		return err
+	}
+
+	e.serv.Handler = e
+	e.serv.ReadHeaderTimeout = time.Minute
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+// httpError is the error with the HTTP status that should be reported to
+// the client.
+type httpError struct {
+	status int
+	msg    string
+	// Methods allowed for the resource, set for 405 errors.
+	allow []string
+}
+
+func (err httpError) Error() string {
+	return err.msg
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func methodNotAllowed(allow ...string) error {
+	return httpError{status: http.StatusMethodNotAllowed, msg: "method not allowed", allow: allow}
+}
+
+// handler processes the request and returns the value that is sent to the
+// client as JSON. nil value results in the 204 No Content response.
+type handler func(r *http.Request, path []string) (interface{}, error)
+
+func (e *Endpoint) authorized(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	hash := sha256.Sum256([]byte(strings.TrimPrefix(header, "Bearer ")))
+	return subtle.ConstantTimeCompare(hash[:], e.tokenHash[:]) == 1
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.authorized(r) {
+		e.logger.Msg("unauthorized request", "src_ip", r.RemoteAddr, "path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="maddy"`)
+		e.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "v1" {
+		e.writeError(w, r, errorf(http.StatusNotFound, "unknown path"))
+		return
+	}
+
+	var h handler
+	switch path[1] {
+	case "accounts":
+		h = e.accounts
+	case "aliases":
+		h = e.aliasesHandler
+	case "queue":
+		h = e.queue
+	default:
+		e.writeError(w, r, errorf(http.StatusNotFound, "unknown path"))
+		return
+	}
+
+	e.logger.DebugMsg("request", "src_ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	res, err := h(r, path[2:])
+	if err != nil {
+		e.writeError(w, r, err)
+		return
+	}
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	e.writeJSON(w, http.StatusOK, res)
+}
+
+func (e *Endpoint) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		e.logger.Error("failed to write the response", err)
+	}
+}
+
+func (e *Endpoint) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var httpErr httpError
+	if errors.As(err, &httpErr) {
+		status = httpErr.status
+		if len(httpErr.allow) != 0 {
+			w.Header().Set("Allow", strings.Join(httpErr.allow, ", "))
+		}
+	} else {
+		e.logger.Error("request failed", err, "src_ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+	}
+	e.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// readJSON decodes the request body into v.
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "malformed request body: %v", err)
+	}
+	return nil
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,319 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testToken = "0123456789abcdef"
+
+type memTable struct {
+	testutils.Table
+}
+
+func (t memTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t.M))
+	for k := range t.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t memTable) SetKey(k, v string) error {
+	t.M[k] = v
+	return nil
+}
+
+func (t memTable) RemoveKey(k string) error {
+	delete(t.M, k)
+	return nil
+}
+
+type userDB struct {
+	users map[string]string
+}
+
+func (db userDB) AuthPlain(username, password string) error {
+	if db.users[username] != password {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
+
+func (db userDB) ListUsers() ([]string, error) {
+	users := make([]string, 0, len(db.users))
+	for u := range db.users {
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (db userDB) CreateUser(username, password string) error {
+	db.users[username] = password
+	return nil
+}
+
+func (db userDB) SetUserPassword(username, password string) error {
+	db.users[username] = password
+	return nil
+}
+
+func (db userDB) DeleteUser(username string) error {
+	delete(db.users, username)
+	return nil
+}
+
+type storage struct {
+	accts map[string]struct{}
+	// Used for CreateIMAPAcct failures.
+	err error
+}
+
+func (s storage) GetOrCreateIMAPAcct(string) (imapbackend.User, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s storage) GetIMAPAcct(string) (imapbackend.User, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s storage) IMAPExtensions() []string {
+	return nil
+}
+
+func (s storage) ListIMAPAccts() ([]string, error) {
+	accts := make([]string, 0, len(s.accts))
+	for a := range s.accts {
+		accts = append(accts, a)
+	}
+	return accts, nil
+}
+
+func (s storage) CreateIMAPAcct(username string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.accts[username] = struct{}{}
+	return nil
+}
+
+func (s storage) DeleteIMAPAcct(username string) error {
+	delete(s.accts, username)
+	return nil
+}
+
+func (s storage) QuotaUsage(_ context.Context, rcptTo string) (used, limit int64, err error) {
+	return 1024, 2048, nil
+}
+
+func testEndpoint(t *testing.T) *Endpoint {
+	return &Endpoint{
+		logger:    testutils.Logger(t, modName),
+		tokenHash: sha256.Sum256([]byte(testToken)),
+		userDB:    userDB{users: map[string]string{}},
+		storage:   storage{accts: map[string]struct{}{}},
+		aliases:   memTable{testutils.Table{M: map[string]string{}}},
+		quotas:    memTable{testutils.Table{M: map[string]string{}}},
+	}
+}
+
+func doRequest(t *testing.T, e *Endpoint, method, path, body string, res interface{}) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+
+	if res != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatalf("%s %s: malformed response: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAuthorization(t *testing.T) {
+	e := testEndpoint(t)
+
+	for _, header := range []string{"", "Bearer", "Bearer wrong", "Basic " + testToken} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/accounts", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", header, w.Code)
+		}
+	}
+
+	if code := doRequest(t, e, http.MethodGet, "/v1/accounts", "", nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	e := testEndpoint(t)
+
+	if code := doRequest(t, e, http.MethodPost, "/v1/accounts", `{"name":"foo@example.org"}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for missing password, got %d", code)
+	}
+
+	var acct Account
+	if code := doRequest(t, e, http.MethodPost, "/v1/accounts", `{"name":"foo@example.org","password":"123"}`, &acct); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if acct != (Account{Name: "foo@example.org", Credentials: true, Mailbox: true}) {
+		t.Fatalf("wrong account: %+v", acct)
+	}
+	if code := doRequest(t, e, http.MethodPost, "/v1/accounts", `{"name":"foo@example.org","password":"123"}`, nil); code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", code)
+	}
+
+	// Mailbox without credentials.
+	e.storage.(storage).accts["bar@example.org"] = struct{}{}
+
+	var accts []Account
+	if code := doRequest(t, e, http.MethodGet, "/v1/accounts", "", &accts); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(accts) != 2 || accts[0] != (Account{Name: "bar@example.org", Mailbox: true}) || accts[1] != acct {
+		t.Fatalf("wrong accounts: %+v", accts)
+	}
+
+	if code := doRequest(t, e, http.MethodPut, "/v1/accounts/foo@example.org/password", `{"password":"456"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if err := e.userDB.AuthPlain("foo@example.org", "456"); err != nil {
+		t.Fatal("password is not changed:", err)
+	}
+	if code := doRequest(t, e, http.MethodPut, "/v1/accounts/bar@example.org/password", `{"password":"456"}`, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+
+	if code := doRequest(t, e, http.MethodDelete, "/v1/accounts/foo@example.org", "", nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if code := doRequest(t, e, http.MethodGet, "/v1/accounts/foo@example.org", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+}
+
+func TestAccounts_CreateRollback(t *testing.T) {
+	e := testEndpoint(t)
+	e.storage = storage{accts: map[string]struct{}{}, err: errors.New("db failure")}
+
+	if code := doRequest(t, e, http.MethodPost, "/v1/accounts", `{"name":"foo@example.org","password":"123"}`, nil); code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", code)
+	}
+	if users, _ := e.userDB.ListUsers(); len(users) != 0 {
+		t.Fatalf("credentials are not removed: %v", users)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	e := testEndpoint(t)
+	e.storage.(storage).accts["foo@example.org"] = struct{}{}
+
+	var quota Quota
+	if code := doRequest(t, e, http.MethodGet, "/v1/accounts/foo@example.org/quota", "", &quota); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if quota != (Quota{Used: 1024, Limit: 2048}) {
+		t.Fatalf("wrong quota: %+v", quota)
+	}
+
+	if code := doRequest(t, e, http.MethodPut, "/v1/accounts/foo@example.org/quota", `{"limit":"1Q"}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	if code := doRequest(t, e, http.MethodPut, "/v1/accounts/foo@example.org/quota", `{"limit":"1G"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	quotas := e.quotas.(memTable).M
+	if quotas["foo@example.org"] != "1G" {
+		t.Fatalf("quota is not set: %v", quotas)
+	}
+	if code := doRequest(t, e, http.MethodDelete, "/v1/accounts/foo@example.org/quota", "", nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if len(quotas) != 0 {
+		t.Fatalf("quota is not removed: %v", quotas)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	e := testEndpoint(t)
+
+	if code := doRequest(t, e, http.MethodPut, "/v1/aliases/postmaster@example.org", `{"target":"foo@example.org"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if code := doRequest(t, e, http.MethodPut, "/v1/aliases/abuse@example.org", `{"target":"foo@example.org"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+
+	var aliases []Alias
+	if code := doRequest(t, e, http.MethodGet, "/v1/aliases", "", &aliases); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(aliases) != 2 || aliases[0] != (Alias{"abuse@example.org", "foo@example.org"}) {
+		t.Fatalf("wrong aliases: %+v", aliases)
+	}
+
+	if code := doRequest(t, e, http.MethodDelete, "/v1/aliases/abuse@example.org", "", nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if code := doRequest(t, e, http.MethodGet, "/v1/aliases/abuse@example.org", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+
+	e.aliases = nil
+	if code := doRequest(t, e, http.MethodGet, "/v1/aliases", "", nil); code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", code)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	e := testEndpoint(t)
+
+	var msgs []json.RawMessage
+	if code := doRequest(t, e, http.MethodGet, "/v1/queue", "", &msgs); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := doRequest(t, e, http.MethodGet, "/v1/queue?queue=unknown", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+	if code := doRequest(t, e, http.MethodGet, "/v1/queue/aabbcc", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+	if code := doRequest(t, e, http.MethodPut, "/v1/queue/aabbcc", "", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", code)
+	}
+}
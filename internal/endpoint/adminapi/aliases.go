@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminapi
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Alias is the alias table entry.
+type Alias struct {
+	Alias  string `json:"alias"`
+	Target string `json:"target"`
+}
+
+type aliasRequest struct {
+	Target string `json:"target"`
+}
+
+var errNoAliases = errorf(http.StatusNotImplemented, "aliases management is not configured")
+
+// aliasesHandler handles /v1/aliases requests:
+//
+//	GET    /v1/aliases
+//	GET    /v1/aliases/ALIAS
+//	PUT    /v1/aliases/ALIAS
+//	DELETE /v1/aliases/ALIAS
+func (e *Endpoint) aliasesHandler(r *http.Request, path []string) (interface{}, error) {
+	if e.aliases == nil {
+		return nil, errNoAliases
+	}
+
+	switch len(path) {
+	case 0:
+		if r.Method != http.MethodGet {
+			return nil, methodNotAllowed(http.MethodGet)
+		}
+		return e.listAliases(r)
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			return e.getAlias(r, path[0])
+		case http.MethodPut:
+			return nil, e.setAlias(r, path[0])
+		case http.MethodDelete:
+			return nil, e.deleteAlias(r, path[0])
+		}
+		return nil, methodNotAllowed(http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+	return nil, errorf(http.StatusNotFound, "unknown path")
+}
+
+func (e *Endpoint) listAliases(r *http.Request) ([]Alias, error) {
+	keys, err := e.aliases.Keys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	res := make([]Alias, 0, len(keys))
+	for _, key := range keys {
+		target, ok, err := e.aliases.Lookup(r.Context(), key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// Removed concurrently.
+			continue
+		}
+		res = append(res, Alias{Alias: key, Target: target})
+	}
+	return res, nil
+}
+
+func (e *Endpoint) getAlias(r *http.Request, alias string) (Alias, error) {
+	target, ok, err := e.aliases.Lookup(r.Context(), alias)
+	if err != nil {
+		return Alias{}, err
+	}
+	if !ok {
+		return Alias{}, errorf(http.StatusNotFound, "unknown alias: %s", alias)
+	}
+	return Alias{Alias: alias, Target: target}, nil
+}
+
+func (e *Endpoint) setAlias(r *http.Request, alias string) error {
+	var req aliasRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.Target == "" {
+		return errorf(http.StatusBadRequest, "target is required")
+	}
+
+	if err := e.aliases.SetKey(alias, req.Target); err != nil {
+		return err
+	}
+
+	e.logger.Msg("alias changed", "alias", alias, "target", req.Target, "src_ip", r.RemoteAddr)
+	return nil
+}
+
+func (e *Endpoint) deleteAlias(r *http.Request, alias string) error {
+	if _, err := e.getAlias(r, alias); err != nil {
+		return err
+	}
+
+	if err := e.aliases.RemoveKey(alias); err != nil {
+		return err
+	}
+
+	e.logger.Msg("alias deleted", "alias", alias, "src_ip", r.RemoteAddr)
+	return nil
+}
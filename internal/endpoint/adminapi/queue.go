@@ -0,0 +1,90 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminapi
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+// queue handles /v1/queue requests using queue control commands:
+//
+//	GET    /v1/queue             (queue.list)
+//	POST   /v1/queue/flush       (queue.flush)
+//	GET    /v1/queue/ID          (queue.show)
+//	DELETE /v1/queue/ID          (queue.delete)
+//	POST   /v1/queue/ID/retry    (queue.retry)
+//
+// The "queue" query parameter limits the request to the specific queue,
+// DELETE accepts "bounce=true" to send a bounce to the sender.
+func (e *Endpoint) queue(r *http.Request, path []string) (interface{}, error) {
+	args := queue.AdminArgs{
+		Queue:  r.URL.Query().Get("queue"),
+		Bounce: r.URL.Query().Get("bounce") == "true",
+	}
+
+	var cmd string
+	switch {
+	case len(path) == 0:
+		if r.Method != http.MethodGet {
+			return nil, methodNotAllowed(http.MethodGet)
+		}
+		cmd = "queue.list"
+	case len(path) == 1 && path[0] == "flush":
+		if r.Method != http.MethodPost {
+			return nil, methodNotAllowed(http.MethodPost)
+		}
+		cmd = "queue.flush"
+	case len(path) == 1:
+		args.ID = path[0]
+		switch r.Method {
+		case http.MethodGet:
+			cmd = "queue.show"
+		case http.MethodDelete:
+			cmd = "queue.delete"
+		default:
+			return nil, methodNotAllowed(http.MethodGet, http.MethodDelete)
+		}
+	case len(path) == 2 && path[1] == "retry":
+		if r.Method != http.MethodPost {
+			return nil, methodNotAllowed(http.MethodPost)
+		}
+		args.ID = path[0]
+		cmd = "queue.retry"
+	default:
+		return nil, errorf(http.StatusNotFound, "unknown path")
+	}
+
+	res, err := control.Call(cmd, args)
+	switch {
+	case errors.Is(err, queue.ErrUnknownMessage), errors.Is(err, queue.ErrUnknownQueue):
+		return nil, errorf(http.StatusNotFound, "%v", err)
+	case errors.Is(err, queue.ErrNotScheduled):
+		return nil, errorf(http.StatusConflict, "%v", err)
+	case err != nil:
+		return nil, err
+	}
+	if cmd != "queue.list" && cmd != "queue.show" {
+		e.logger.Msg("queue command", "command", cmd, "queue", args.Queue, "msg_id", args.ID, "src_ip", r.RemoteAddr)
+	}
+	return res, nil
+}
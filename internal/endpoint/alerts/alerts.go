@@ -0,0 +1,376 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package alerts implements notifications about abnormal server state
+// detected using the collected metrics.
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const modName = "alerts"
+
+// Alert states reported in notifications.
+const (
+	stateFiring   = "firing"
+	stateResolved = "resolved"
+)
+
+type notification struct {
+	Alert     string    `json:"alert"`
+	State     string    `json:"state"`
+	Time      time.Time `json:"time"`
+	Hostname  string    `json:"hostname"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+}
+
+type condition struct {
+	name      string
+	threshold float64
+
+	// eval returns the current value of the checked metric. ok is false if
+	// there is not enough data to evaluate the condition, the alert state is
+	// not changed then.
+	eval func(mfs []*dto.MetricFamily) (value float64, ok bool)
+	// describe returns a human-readable description of the value.
+	describe func(value float64) string
+
+	firing   bool
+	lastSent time.Time
+}
+
+type Endpoint struct {
+	logger   log.Logger
+	hostname string
+	gatherer prometheus.Gatherer
+
+	interval       time.Duration
+	repeatInterval time.Duration
+	conds          []*condition
+	webhook        *webhook
+	email          *email
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("%s: no arguments expected", modName)
+	}
+	return &Endpoint{
+		logger:   log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		gatherer: prometheus.DefaultGatherer,
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var (
+		queueAge          time.Duration
+		bounceRate        float64
+		bounceMinAttempts int
+		authFailures      int
+	)
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("hostname", true, true, "", &e.hostname)
+	cfg.Duration("interval", false, false, time.Minute, &e.interval)
+	cfg.Duration("repeat_interval", false, false, 4*time.Hour, &e.repeatInterval)
+	cfg.Duration("queue_age", false, false, 0, &queueAge)
+	cfg.Custom("bounce_rate", false, false, func() (interface{}, error) {
+		return float64(0), nil
+	}, parsePercent, &bounceRate)
+	cfg.Int("bounce_min_attempts", false, false, 20, &bounceMinAttempts)
+	cfg.Int("auth_failures", false, false, 0, &authFailures)
+	cfg.Custom("webhook", false, false, nil, parseWebhook, &e.webhook)
+	cfg.Custom("email", false, false, nil, parseEmail, &e.email)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if e.interval <= 0 {
+		return fmt.Errorf("%s: interval should be positive", modName)
+	}
+	if queueAge > 0 {
+		e.conds = append(e.conds, queueAgeCond(queueAge))
+	}
+	if bounceRate > 0 {
+		e.conds = append(e.conds, bounceRateCond(bounceRate, bounceMinAttempts))
+	}
+	if authFailures > 0 {
+		e.conds = append(e.conds, authFailuresCond(authFailures, e.interval))
+	}
+	if len(e.conds) == 0 {
+		return fmt.Errorf("%s: no alert conditions configured", modName)
+	}
+	if e.webhook == nil && e.email == nil {
+		return fmt.Errorf("%s: webhook or email is required", modName)
+	}
+	if e.email != nil && e.email.from == "" {
+		e.email.from = "maddy-alerts@" + e.hostname
+	}
+
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go e.run()
+
+	return nil
+}
+
+func parsePercent(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument is required")
+	}
+	val, err := strconv.ParseFloat(strings.TrimSuffix(node.Args[0], "%"), 64)
+	if err != nil || val < 0 || val > 100 {
+		return nil, config.NodeErr(node, "invalid percentage: %s", node.Args[0])
+	}
+	return val, nil
+}
+
+func (e *Endpoint) run() {
+	defer close(e.done)
+
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+
+	// Counter-based conditions need the initial values.
+	e.evaluate(time.Now())
+	for {
+		select {
+		case now := <-t.C:
+			e.evaluate(now)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// evaluate checks all conditions and sends notifications for alerts that
+// changed their state or are firing for longer than repeat_interval.
+func (e *Endpoint) evaluate(now time.Time) {
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		// Gather returns partial results with errors, use them anyway.
+		e.logger.Error("failed to gather metrics", err)
+	}
+
+	for _, c := range e.conds {
+		value, ok := c.eval(mfs)
+		if !ok {
+			continue
+		}
+		e.logger.DebugMsg("condition evaluated", "alert", c.name, "value", value, "threshold", c.threshold)
+
+		var state string
+		switch exceeded := value > c.threshold; {
+		case exceeded && (!c.firing || now.Sub(c.lastSent) >= e.repeatInterval):
+			state = stateFiring
+		case !exceeded && c.firing:
+			state = stateResolved
+		default:
+			continue
+		}
+
+		c.firing = state == stateFiring
+		c.lastSent = now
+		e.send(notification{
+			Alert:     c.name,
+			State:     state,
+			Time:      now,
+			Hostname:  e.hostname,
+			Value:     value,
+			Threshold: c.threshold,
+			Message:   c.describe(value),
+		})
+	}
+}
+
+func (e *Endpoint) send(n notification) {
+	e.logger.Msg("alert "+n.State, "alert", n.Alert, "value", n.Value, "threshold", n.Threshold)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	if e.webhook != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.webhook.send(ctx, n); err != nil {
+				e.logger.Error("webhook notification failed", err, "alert", n.Alert)
+			}
+		}()
+	}
+	if e.email != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.email.send(ctx, e.hostname, n); err != nil {
+				e.logger.Error("email notification failed", err, "alert", n.Alert)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func queueAgeCond(threshold time.Duration) *condition {
+	return &condition{
+		name:      "queue_age",
+		threshold: threshold.Seconds(),
+		eval: func(mfs []*dto.MetricFamily) (float64, bool) {
+			return metricMax(mfs, "maddy_queue_oldest_message_age_seconds"), true
+		},
+		describe: func(value float64) string {
+			return fmt.Sprintf("Oldest queued message was received %v ago (threshold: %v)",
+				(time.Duration(value) * time.Second).Round(time.Second), threshold)
+		},
+	}
+}
+
+func bounceRateCond(threshold float64, minAttempts int) *condition {
+	var prevFailed, prevDelivered float64
+	first := true
+	return &condition{
+		name:      "bounce_rate",
+		threshold: threshold,
+		eval: func(mfs []*dto.MetricFamily) (float64, bool) {
+			failed := metricSum(mfs, "maddy_queue_delivery_attempts", "result", "failed")
+			delivered := metricSum(mfs, "maddy_queue_delivery_attempts", "result", "delivered")
+			failedDelta, deliveredDelta := failed-prevFailed, delivered-prevDelivered
+			prevFailed, prevDelivered = failed, delivered
+			if first {
+				first = false
+				return 0, false
+			}
+
+			total := failedDelta + deliveredDelta
+			if total < float64(minAttempts) || total <= 0 {
+				return 0, false
+			}
+			return failedDelta / total * 100, true
+		},
+		describe: func(value float64) string {
+			return fmt.Sprintf("%.1f%% of delivery attempts failed permanently (threshold: %v%%)",
+				value, threshold)
+		},
+	}
+}
+
+func authFailuresCond(threshold int, interval time.Duration) *condition {
+	var prev float64
+	first := true
+	return &condition{
+		name:      "auth_failures",
+		threshold: float64(threshold),
+		eval: func(mfs []*dto.MetricFamily) (float64, bool) {
+			cur := metricSum(mfs, "maddy_auth_failures", "", "")
+			delta := cur - prev
+			prev = cur
+			if first {
+				first = false
+				return 0, false
+			}
+			return math.Max(delta, 0), true
+		},
+		describe: func(value float64) string {
+			return fmt.Sprintf("%d failed authentication attempts in the last %v (threshold: %d)",
+				int(value), interval, threshold)
+		},
+	}
+}
+
+// metricSum returns the sum of all counter and gauge values of the metric,
+// optionally filtered by the label value.
+func metricSum(mfs []*dto.MetricFamily, name, label, labelValue string) float64 {
+	var sum float64
+	forEachValue(mfs, name, label, labelValue, func(v float64) {
+		sum += v
+	})
+	return sum
+}
+
+// metricMax returns the maximum value of the metric or 0 if there are none.
+func metricMax(mfs []*dto.MetricFamily, name string) float64 {
+	var max float64
+	forEachValue(mfs, name, "", "", func(v float64) {
+		if v > max {
+			max = v
+		}
+	})
+	return max
+}
+
+func forEachValue(mfs []*dto.MetricFamily, name, label, labelValue string, f func(float64)) {
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			if label != "" {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == label && lp.GetValue() != labelValue {
+						continue metrics
+					}
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				f(m.Counter.GetValue())
+			case m.Gauge != nil:
+				f(m.Gauge.GetValue())
+			}
+		}
+	}
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if e.stop == nil {
+		return nil
+	}
+	close(e.stop)
+	<-e.done
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
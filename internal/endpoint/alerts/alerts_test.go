@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package alerts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEvaluate(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	attempts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maddy_queue_delivery_attempts",
+	}, []string{"module", "result"})
+	oldest := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maddy_queue_oldest_message_age_seconds",
+	}, []string{"module"})
+	reg.MustRegister(attempts, oldest)
+
+	var received []notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, n)
+	}))
+	defer srv.Close()
+
+	tgt := testutils.Target{}
+	e := &Endpoint{
+		logger:         testutils.Logger(t, modName),
+		hostname:       "mx.example.org",
+		gatherer:       reg,
+		repeatInterval: time.Hour,
+		conds: []*condition{
+			queueAgeCond(time.Hour),
+			bounceRateCond(50, 4),
+		},
+		webhook: &webhook{
+			url:     srv.URL,
+			headers: http.Header{"Authorization": []string{"Bearer secret"}},
+			client:  http.DefaultClient,
+		},
+		email: &email{
+			from:   "alerts@example.org",
+			to:     []string{"postmaster@example.org"},
+			target: &tgt,
+		},
+	}
+
+	now := time.Now()
+	expect := func(alerts ...string) {
+		t.Helper()
+		var got []string
+		for _, n := range received {
+			got = append(got, n.Alert+" "+n.State)
+		}
+		if strings.Join(got, ",") != strings.Join(alerts, ",") {
+			t.Fatalf("wrong notifications: %v", got)
+		}
+		if len(tgt.Messages) != len(alerts) {
+			t.Fatalf("wrong amount of emails: %d", len(tgt.Messages))
+		}
+	}
+
+	// Baseline for counters.
+	e.evaluate(now)
+	expect()
+
+	oldest.WithLabelValues("remote_queue").Set(2 * 3600)
+	oldest.WithLabelValues("local_queue").Set(60)
+	attempts.WithLabelValues("remote_queue", "failed").Add(3)
+	attempts.WithLabelValues("remote_queue", "delivered").Add(1)
+	attempts.WithLabelValues("remote_queue", "deferred").Add(10)
+	now = now.Add(time.Minute)
+	e.evaluate(now)
+	expect("queue_age firing", "bounce_rate firing")
+	if received[0].Value != 2*3600 || received[0].Hostname != "mx.example.org" {
+		t.Errorf("wrong notification: %+v", received[0])
+	}
+	if received[1].Value != 75 {
+		t.Errorf("wrong bounce rate: %v", received[1].Value)
+	}
+	if subj := tgt.Messages[0].Header.Get("Subject"); subj != "[FIRING] queue_age alert on mx.example.org" {
+		t.Errorf("wrong subject: %s", subj)
+	}
+
+	// Still firing, but repeat_interval did not pass yet. Bounce rate is not
+	// evaluated due to the low amount of attempts.
+	attempts.WithLabelValues("remote_queue", "delivered").Add(1)
+	now = now.Add(time.Minute)
+	e.evaluate(now)
+	expect("queue_age firing", "bounce_rate firing")
+
+	now = now.Add(time.Hour)
+	oldest.WithLabelValues("remote_queue").Set(0)
+	attempts.WithLabelValues("remote_queue", "delivered").Add(10)
+	e.evaluate(now)
+	expect("queue_age firing", "bounce_rate firing", "queue_age resolved", "bounce_rate resolved")
+}
+
+func TestEvaluate_Repeat(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	failures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maddy_auth_failures",
+	}, []string{"module", "mechanism"})
+	reg.MustRegister(failures)
+
+	tgt := testutils.Target{}
+	e := &Endpoint{
+		logger:         testutils.Logger(t, modName),
+		hostname:       "mx.example.org",
+		gatherer:       reg,
+		repeatInterval: time.Hour,
+		conds:          []*condition{authFailuresCond(10, time.Minute)},
+		email: &email{
+			from:   "alerts@example.org",
+			to:     []string{"postmaster@example.org"},
+			target: &tgt,
+		},
+	}
+
+	now := time.Now()
+	e.evaluate(now)
+	for i := 0; i < 3; i++ {
+		failures.WithLabelValues("submission", "PLAIN").Add(20)
+		now = now.Add(30 * time.Minute)
+		e.evaluate(now)
+	}
+
+	// Firing at 30m, then repeated at 1h30m.
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("wrong amount of emails: %d", len(tgt.Messages))
+	}
+	if body := string(tgt.Messages[0].Body); !strings.Contains(body, "20 failed authentication attempts") {
+		t.Errorf("wrong body: %s", body)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// webhook sends notifications as JSON POST requests.
+type webhook struct {
+	url     string
+	headers http.Header
+	client  *http.Client
+}
+
+func parseWebhook(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument is required")
+	}
+	u, err := url.Parse(node.Args[0])
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, config.NodeErr(node, "http or https URL is required")
+	}
+
+	wh := &webhook{
+		url:     node.Args[0],
+		headers: http.Header{},
+	}
+	var timeout time.Duration
+	cm := config.NewMap(m.Globals, node)
+	cm.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected 2 arguments")
+		}
+		wh.headers.Add(node.Args[0], node.Args[1])
+		return nil
+	})
+	cm.Duration("timeout", false, false, 10*time.Second, &timeout)
+	if _, err := cm.Process(); err != nil {
+		return nil, err
+	}
+	wh.client = &http.Client{Timeout: timeout}
+
+	return wh, nil
+}
+
+func (wh *webhook) send(ctx context.Context, n notification) error {
+	blob, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	for k, v := range wh.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP status: %v", resp.Status)
+	}
+	return nil
+}
+
+// email sends notifications as plain-text messages using the configured
+// delivery target.
+type email struct {
+	from   string
+	to     []string
+	target module.DeliveryTarget
+}
+
+func parseEmail(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	em := &email{}
+	cm := config.NewMap(m.Globals, node)
+	cm.String("from", false, false, "", &em.from)
+	cm.StringList("to", false, true, nil, &em.to)
+	cm.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &em.target)
+	if _, err := cm.Process(); err != nil {
+		return nil, err
+	}
+
+	return em, nil
+}
+
+func (em *email) send(ctx context.Context, hostname string, n notification) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s\r\n\r\n", n.Message)
+	fmt.Fprintf(&body, "Alert: %s\r\n", n.Alert)
+	fmt.Fprintf(&body, "State: %s\r\n", n.State)
+	fmt.Fprintf(&body, "Server: %s\r\n", n.Hostname)
+	fmt.Fprintf(&body, "Time: %s\r\n", n.Time.Format(time.RFC3339))
+
+	hdr := textproto.Header{}
+	hdr.Add("From", em.from)
+	hdr.Add("To", strings.Join(em.to, ", "))
+	hdr.Add("Subject", fmt.Sprintf("[%s] %s alert on %s", strings.ToUpper(n.State), n.Alert, n.Hostname))
+	hdr.Add("Date", n.Time.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+hostname+">")
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+
+	msgMeta := &module.MsgMetadata{ID: msgID}
+	delivery, err := em.target.Start(ctx, msgMeta, em.from)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range em.to {
+		if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			delivery.Abort(ctx)
+			return err
+		}
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package dovecotsasld
 
 import (
+	"context"
 	"fmt"
 	stdlog "log"
 	"net"
@@ -48,13 +49,20 @@ type Endpoint struct {
 	authMap       module.Table
 
 	srv *dovecotsasl.Server
+
+	// Context passed to authentication code. go-dovecot-sasl does not expose
+	// the connection to mechanism handlers, so it is cancelled only when the
+	// endpoint is closed.
+	ctx    context.Context
+	cancel func()
 }
 
 func New(_ string, addrs []string) (module.Module, error) {
 	return &Endpoint{
 		addrs: addrs,
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/saslauth"},
+			Log:  log.Logger{Name: modName + "/saslauth"},
+			Name: modName,
 		},
 		log: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
 	}, nil
@@ -75,10 +83,13 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.authNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.authMap)
+	cfg.Custom("auth_limits", false, false, nil, auth.LimitsDirective, &endp.saslAuth.Limits)
+	cfg.Custom("auth_policy", false, false, nil, auth.PolicyDirective, &endp.saslAuth.Policy)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	endp.ctx, endp.cancel = context.WithCancel(context.Background())
 	endp.srv = dovecotsasl.NewServer()
 	endp.srv.Log = stdlog.New(endp.log, "", 0)
 
@@ -92,7 +103,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 				remoteAddr = &net.TCPAddr{IP: req.RemoteIP, Port: int(req.RemotePort)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, remoteAddr, func(_ string) error { return nil })
+			return endp.saslAuth.CreateSASL(endp.ctx, mech, remoteAddr, func(_ string) error { return nil })
 		})
 	}
 
@@ -123,6 +134,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 }
 
 func (endp *Endpoint) Close() error {
+	endp.cancel()
 	return endp.srv.Close()
 }
 
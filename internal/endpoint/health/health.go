@@ -0,0 +1,211 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package health implements an HTTP endpoint for liveness and readiness
+// probes.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const modName = "health"
+
+type check struct {
+	name  string
+	check func(ctx context.Context) error
+
+	// Used to log only changes of the check status.
+	failing atomic.Bool
+}
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	checks  []*check
+	timeout time.Duration
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+	mux         *http.ServeMux
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var dnsProbe string
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.Callback("check", func(m *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one module reference is required")
+		}
+		for _, arg := range node.Args {
+			var hc module.HealthChecker
+			if err := modconfig.ModuleFromNode("", []string{arg}, node, m.Globals, &hc); err != nil {
+				return err
+			}
+			e.checks = append(e.checks, &check{
+				name:  strings.TrimPrefix(arg, "&"),
+				check: hc.CheckHealth,
+			})
+		}
+		return nil
+	})
+	cfg.String("dns_probe", false, false, "", &dnsProbe)
+	cfg.Duration("timeout", false, false, 5*time.Second, &e.timeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if dnsProbe == "" {
+		dnsProbe, _ = cfg.Globals["hostname"].(string)
+	}
+	if dnsProbe != "" && dnsProbe != "off" {
+		resolver := dns.DefaultResolver()
+		e.checks = append(e.checks, &check{
+			name: "dns",
+			check: func(ctx context.Context) error {
+				_, err := resolver.LookupHost(ctx, dnsProbe)
+				return err
+			},
+		})
+	}
+
+	e.mux = http.NewServeMux()
+	e.mux.HandleFunc("/healthz", e.live)
+	e.mux.HandleFunc("/readyz", e.ready)
+	e.mux.Handle("/metrics", promhttp.Handler())
+	e.serv.Handler = e.mux
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			return fmt.Errorf("%s: TLS is not supported yet", modName)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+// live reports that the process is running and serving requests.
+func (e *Endpoint) live(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// ready runs all configured checks in parallel and reports their results.
+// 503 status is returned if any of them failed.
+func (e *Endpoint) ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), e.timeout)
+	defer cancel()
+
+	errs := make([]error, len(e.checks))
+	var wg sync.WaitGroup
+	for i, c := range e.checks {
+		i, c := i, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.check(ctx)
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	var body strings.Builder
+	for i, c := range e.checks {
+		if errs[i] != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&body, "[-]%s failed: %v\n", c.name, errs[i])
+			if !c.failing.Swap(true) {
+				e.logger.Error("readiness check failed", errs[i], "check", c.name)
+			}
+			continue
+		}
+		fmt.Fprintf(&body, "[+]%s ok\n", c.name)
+		if c.failing.Swap(false) {
+			e.logger.Msg("readiness check recovered", "check", c.name)
+		}
+	}
+	if status == http.StatusOK {
+		body.WriteString("ok\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body.String()))
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
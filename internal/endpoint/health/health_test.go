@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestReady(t *testing.T) {
+	var dbErr error
+	e := &Endpoint{
+		logger:  testutils.Logger(t, modName),
+		timeout: time.Second,
+		checks: []*check{
+			{name: "queue", check: func(context.Context) error { return nil }},
+			{name: "db", check: func(context.Context) error { return dbErr }},
+		},
+	}
+
+	get := func() (int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, body := get(); code != http.StatusOK || body != "[+]queue ok\n[+]db ok\nok\n" {
+		t.Fatalf("wrong response: %d %q", code, body)
+	}
+
+	dbErr = errors.New("connection refused")
+	code, body := get()
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]db failed: connection refused\n") {
+		t.Fatalf("wrong response: %d %q", code, body)
+	}
+	if !e.checks[1].failing.Load() {
+		t.Fatal("check is not marked as failing")
+	}
+
+	dbErr = nil
+	if code, _ := get(); code != http.StatusOK || e.checks[1].failing.Load() {
+		t.Fatal("check did not recover")
+	}
+}
+
+func TestReady_Timeout(t *testing.T) {
+	e := &Endpoint{
+		logger:  testutils.Logger(t, modName),
+		timeout: 10 * time.Millisecond,
+		checks: []*check{
+			{name: "slow", check: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}},
+		},
+	}
+	rec := httptest.NewRecorder()
+	e.ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status: %d", rec.Code)
+	}
+}
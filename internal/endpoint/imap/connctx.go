@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// connContexts tracks contexts of open connections so they can be passed to
+// authentication code. go-imap does not provide a way to attach values to a
+// connection, so contexts are looked up using the remote address.
+type connContexts struct {
+	lock sync.Mutex
+	m    map[string]context.Context
+}
+
+// get returns the context of the connection with the specified remote
+// address. It is cancelled once the connection is closed.
+func (cc *connContexts) get(addr net.Addr) context.Context {
+	if addr != nil {
+		cc.lock.Lock()
+		ctx := cc.m[addr.String()]
+		cc.lock.Unlock()
+		if ctx != nil {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+func (cc *connContexts) listener(l net.Listener) net.Listener {
+	return ctxListener{Listener: l, cc: cc}
+}
+
+type ctxListener struct {
+	net.Listener
+	cc *connContexts
+}
+
+func (l ctxListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	key := conn.RemoteAddr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	l.cc.lock.Lock()
+	defer l.cc.lock.Unlock()
+	if l.cc.m == nil {
+		l.cc.m = make(map[string]context.Context)
+	}
+	if _, ok := l.cc.m[key]; ok {
+		// Address is not unique (e.g. for Unix sockets), the context
+		// cannot be looked up reliably.
+		cancel()
+		return conn, nil
+	}
+	l.cc.m[key] = ctx
+
+	return &ctxConn{Conn: conn, release: func() {
+		cancel()
+		l.cc.lock.Lock()
+		delete(l.cc.m, key)
+		l.cc.lock.Unlock()
+	}}, nil
+}
+
+type ctxConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *ctxConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,64 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestConnContexts(t *testing.T) {
+	var cc connContexts
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = cc.listener(l)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := cc.get(conn.RemoteAddr())
+	if ctx == context.Background() {
+		t.Fatal("No context for the open connection")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Context is cancelled before the connection is closed")
+	}
+
+	conn.Close()
+	if ctx.Err() == nil {
+		t.Fatal("Context is not cancelled after the connection is closed")
+	}
+	if cc.get(conn.RemoteAddr()) != context.Background() {
+		t.Fatal("Context is not removed after the connection is closed")
+	}
+	if cc.get(nil) != context.Background() {
+		t.Fatal("Unexpected context for nil address")
+	}
+}
@@ -42,6 +42,7 @@ import (
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/panics"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/updatepipe"
@@ -55,6 +56,7 @@ type Endpoint struct {
 
 	tlsConfig   *tls.Config
 	listenersWg sync.WaitGroup
+	conns       connContexts
 
 	saslAuth auth.SASLAuth
 
@@ -71,7 +73,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		addrs: addrs,
 		Log:   log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:  log.Logger{Name: modName + "/sasl"},
+			Name: modName,
 		},
 	}
 
@@ -100,6 +103,8 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.authNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.authMap)
+	cfg.Custom("auth_limits", false, false, nil, auth.LimitsDirective, &endp.saslAuth.Limits)
+	cfg.Custom("auth_policy", false, false, nil, auth.PolicyDirective, &endp.saslAuth.Policy)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -122,10 +127,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	endp.serv = imapserver.New(endp)
 	endp.serv.AllowInsecureAuth = insecureAuth
 	endp.serv.TLSConfig = endp.tlsConfig
-	if ioErrors {
-		endp.serv.ErrorLog = &endp.Log
-	} else {
-		endp.serv.ErrorLog = log.Logger{Out: log.NopOutput{}}
+	endp.serv.ErrorLog = panics.ServerLog{
+		Log:     endp.Log,
+		What:    "IMAP connection",
+		Discard: !ioErrors,
 	}
 	if ioDebug {
 		endp.serv.Debug = endp.Log.DebugWriter()
@@ -141,13 +146,18 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		mech := mech
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string) error {
-				return endp.openAccount(c, identity)
+			ctx := endp.conns.get(c.Info().RemoteAddr)
+			return endp.saslAuth.CreateSASL(ctx, mech, c.Info().RemoteAddr, func(identity string) error {
+				return endp.openAccount(ctx, c, identity)
 			})
 		})
 	}
 
-	return endp.setupListeners(addresses)
+	if err := endp.setupListeners(addresses); err != nil {
+		return err
+	}
+	sessions.add(endp)
+	return nil
 }
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
@@ -160,6 +170,8 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		l = endp.conns.listener(l)
+
 		if addr.IsTLS() {
 			if endp.tlsConfig == nil {
 				return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
@@ -199,6 +211,7 @@ func (endp *Endpoint) InstanceName() string {
 }
 
 func (endp *Endpoint) Close() error {
+	sessions.remove(endp)
 	for _, l := range endp.listeners {
 		l.Close()
 	}
@@ -255,8 +268,8 @@ func (endp *Endpoint) usernameForStorage(ctx context.Context, saslUsername strin
 	return mapped, nil
 }
 
-func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
-	username, err := endp.usernameForStorage(context.TODO(), identity)
+func (endp *Endpoint) openAccount(ctx context.Context, c imapserver.Conn, identity string) error {
+	username, err := endp.usernameForStorage(ctx, identity)
 	if err != nil {
 		if errors.Is(err, imapbackend.ErrInvalidCredentials) {
 			return err
@@ -269,21 +282,24 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 	if err != nil {
 		return err
 	}
-	ctx := c.Context()
-	ctx.State = imap.AuthenticatedState
-	ctx.User = u
+	connCtx := c.Context()
+	connCtx.State = imap.AuthenticatedState
+	connCtx.User = u
 	return nil
 }
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	ctx := endp.conns.get(connInfo.RemoteAddr)
+
 	// saslAuth handles AuthMap calling.
-	err := endp.saslAuth.AuthPlain(username, password)
+	err := endp.saslAuth.AuthPlain(ctx, connInfo.RemoteAddr, username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
+		endp.saslAuth.RecordFailure(sasl.Login)
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
-	storageUsername, err := endp.usernameForStorage(context.TODO(), username)
+	storageUsername, err := endp.usernameForStorage(ctx, username)
 	if err != nil {
 		if errors.Is(err, imapbackend.ErrInvalidCredentials) {
 			return nil, err
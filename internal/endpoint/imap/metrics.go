@@ -0,0 +1,79 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"sync"
+
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sessionsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName("maddy", "imap", "sessions"),
+	"Amount of open IMAP sessions",
+	[]string{"module"}, nil,
+)
+
+// sessionsCollector reports the amount of open sessions for all running
+// endpoints. Connections are counted on scrape so no bookkeeping is needed.
+type sessionsCollector struct {
+	lock      sync.Mutex
+	endpoints map[*Endpoint]struct{}
+}
+
+var sessions = &sessionsCollector{endpoints: make(map[*Endpoint]struct{})}
+
+func (sc *sessionsCollector) add(endp *Endpoint) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.endpoints[endp] = struct{}{}
+}
+
+func (sc *sessionsCollector) remove(endp *Endpoint) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	delete(sc.endpoints, endp)
+}
+
+func (sc *sessionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+}
+
+func (sc *sessionsCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	// Multiple endpoints may share the module name.
+	counts := make(map[string]int, len(sc.endpoints))
+	for endp := range sc.endpoints {
+		count := counts[endp.Name()]
+		endp.serv.ForEachConn(func(imapserver.Conn) {
+			count++
+		})
+		counts[endp.Name()] = count
+	}
+	for name, count := range counts {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(count), name)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(sessions)
+}
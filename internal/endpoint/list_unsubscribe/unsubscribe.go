@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package listunsubscribe implements the HTTP endpoint for one-click
+// unsubscription from target.list mailing lists (RFC 8058).
+package listunsubscribe
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/list"
+)
+
+const modName = "list_unsubscribe"
+
+// confirmPage is shown for GET requests. Links are not followed
+// automatically to prevent unsubscription by link scanners, the form sends
+// the same POST request as mail clients do.
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe from {{.List}}</title></head>
+<body>
+<form method="post">
+<p>Unsubscribe from the {{.List}} mailing list?</p>
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button type="submit">Unsubscribe</button>
+</form>
+</body>
+</html>
+`))
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	lists map[string]*list.Target
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		lists:  make(map[string]*list.Target),
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.Callback("lists", func(m *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one list is required")
+		}
+		for _, arg := range node.Args {
+			var l *list.Target
+			ref := config.Node{Name: node.Name, Args: []string{arg}, File: node.File, Line: node.Line}
+			if err := modconfig.ModuleFromNode("target", ref.Args, ref, m.Globals, &l); err != nil {
+				return err
+			}
+			e.lists[l.Address()] = l
+		}
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if len(e.lists) == 0 {
+		return fmt.Errorf("%s: no lists configured", modName)
+	}
+
+	e.serv.Handler = e
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			return fmt.Errorf("%s: TLS is not supported yet", modName)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	listAddr, err := address.ForLookup(r.URL.Query().Get("list"))
+	if err != nil {
+		http.Error(w, "Unknown list", http.StatusNotFound)
+		return
+	}
+	l, ok := e.lists[listAddr]
+	if !ok {
+		http.Error(w, "Unknown list", http.StatusNotFound)
+		return
+	}
+	token := r.URL.Query().Get("token")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := confirmPage.Execute(w, struct{ List string }{listAddr}); err != nil {
+			e.logger.Error("failed to write the page", err)
+		}
+	case http.MethodPost:
+		if r.FormValue("List-Unsubscribe") != "One-Click" {
+			http.Error(w, "List-Unsubscribe=One-Click is required", http.StatusBadRequest)
+			return
+		}
+		member, err := l.UnsubscribeByToken(token)
+		if errors.Is(err, list.ErrInvalidToken) {
+			http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			e.logger.Error("unsubscribe failed", err, "list", listAddr, "rcpt", member)
+			http.Error(w, "Internal error, please try again later", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s is unsubscribed from %s.\n", member, listAddr)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
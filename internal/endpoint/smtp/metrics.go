@@ -49,6 +49,15 @@ var (
 		[]string{"module"},
 	)
 
+	loopsDetected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp",
+			Name:      "loops_detected",
+			Help:      "Messages rejected due to too many Received header fields",
+		},
+		[]string{"module"},
+	)
 	ratelimitDefers = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "maddy",
@@ -82,6 +91,8 @@ func init() {
 	prometheus.MustRegister(startedSMTPTransactions)
 	prometheus.MustRegister(completedSMTPTransactions)
 	prometheus.MustRegister(abortedSMTPTransactions)
+	prometheus.MustRegister(loopsDetected)
 	prometheus.MustRegister(ratelimitDefers)
+	prometheus.MustRegister(failedLogins)
 	prometheus.MustRegister(failedCmds)
 }
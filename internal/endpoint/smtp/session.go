@@ -25,12 +25,14 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"runtime/debug"
 	"runtime/trace"
 	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -38,6 +40,10 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/panics"
+	"github.com/foxcpp/maddy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -73,7 +79,11 @@ type Session struct {
 
 	// Specific for this session.
 	// sessionCtx is not used for cancellation or timeouts, only for tracing.
-	sessionCtx       context.Context
+	sessionCtx context.Context
+	// connCtx is cancelled when the client disconnects. It is used for
+	// operations that should not outlive the connection (e.g. AUTH).
+	connCtx          context.Context
+	cancelConn       func()
 	cancelRDNS       func()
 	connState        module.ConnState
 	repeatedMailErrs int
@@ -87,6 +97,7 @@ type Session struct {
 	msgLock     sync.Mutex
 	msgCtx      context.Context
 	msgTask     *trace.Task
+	msgSpan     oteltrace.Span
 	mailFrom    string
 	opts        smtp.MailOptions
 	msgMeta     *module.MsgMetadata
@@ -96,6 +107,36 @@ type Session struct {
 	log log.Logger
 }
 
+// recoverPanic reports the panic in the command handler and replaces the
+// command result with a temporary error so the client can retry later.
+//
+// msgMeta is the metadata of the message being handled, if it is nil,
+// s.msgMeta is used.
+func (s *Session) recoverPanic(cmd string, msgMeta *module.MsgMetadata, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	if msgMeta == nil {
+		msgMeta = s.msgMeta
+	}
+	var fields []interface{}
+	if msgMeta != nil {
+		fields = []interface{}{"msg_id", msgMeta.ID, "trace_id", msgMeta.TraceID}
+	}
+	if s.connState.RemoteAddr != nil {
+		fields = append(fields, "src_ip", s.connState.RemoteAddr.String())
+	}
+	panics.Report(s.log, "SMTP "+cmd, v, debug.Stack(), fields...)
+
+	*err = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error",
+	}
+}
+
 func (s *Session) Reset() {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
@@ -127,7 +168,8 @@ func (s *Session) abort(ctx context.Context) {
 	if err := s.delivery.Abort(ctx); err != nil {
 		s.endp.Log.Error("delivery abort failed", err)
 	}
-	s.log.Msg("aborted", "msg_id", s.msgMeta.ID)
+	s.msgSpan.SetAttributes(attribute.Bool("maddy.aborted", true))
+	s.log.Msg("aborted", "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
 	abortedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
 	s.cleanSession()
 }
@@ -142,24 +184,28 @@ func (s *Session) cleanSession() {
 	s.deliveryErr = nil
 	s.msgCtx = nil
 	s.msgTask.End()
+	s.msgSpan.End()
 }
 
-func (s *Session) AuthPlain(username, password string) error {
+func (s *Session) AuthPlain(username, password string) (err error) {
+	defer s.recoverPanic("AUTH", nil, &err)
+
 	if s.endp.serv.AuthDisabled {
 		return smtp.ErrAuthUnsupported
 	}
 
 	// Executed before authentication and session initialization.
-	if err := s.endp.pipeline.RunEarlyChecks(context.TODO(), &s.connState); err != nil {
+	if err := s.endp.pipeline.RunEarlyChecks(s.connCtx, &s.connState); err != nil {
 		return s.endp.wrapErr("", true, "AUTH", err)
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	err = s.endp.saslAuth.AuthPlain(s.connCtx, s.connState.RemoteAddr, username, password)
 	if err != nil {
 		s.endp.Log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
 
 		failedLogins.WithLabelValues(s.endp.name).Inc()
+		s.endp.saslAuth.RecordFailure(sasl.Plain)
 
 		if exterrors.IsTemporary(err) {
 			return &smtp.SMTPError{
@@ -192,6 +238,10 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if err != nil {
 		return "", err
 	}
+	msgMeta.TraceID, err = module.GenerateTraceID()
+	if err != nil {
+		return "", err
+	}
 
 	if s.connState.AuthUser != "" {
 		s.log.Msg("incoming message",
@@ -199,6 +249,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 			"src_ip", msgMeta.Conn.RemoteAddr.String(),
 			"sender", from,
 			"msg_id", msgMeta.ID,
+			"trace_id", msgMeta.TraceID,
 			"username", s.connState.AuthUser,
 		)
 	} else {
@@ -207,6 +258,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 			"src_ip", msgMeta.Conn.RemoteAddr.String(),
 			"sender", from,
 			"msg_id", msgMeta.ID,
+			"trace_id", msgMeta.TraceID,
 		)
 	}
 
@@ -255,14 +307,21 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	}
 
 	s.msgCtx, s.msgTask = trace.NewTask(ctx, "Incoming Message")
+	s.msgCtx, s.msgSpan = tracing.StartMsg(s.msgCtx, "smtp.receive", msgMeta,
+		attribute.String("maddy.endpoint", s.endp.name),
+		attribute.String("maddy.src_ip", msgMeta.Conn.RemoteAddr.String()),
+		attribute.String("maddy.sender", cleanFrom))
 
 	mailCtx, mailTask := trace.NewTask(s.msgCtx, "MAIL FROM")
 	defer mailTask.End()
+	mailCtx, mailSpan := tracing.Start(mailCtx, "smtp.mail")
 
 	delivery, err := s.endp.pipeline.Start(mailCtx, msgMeta, cleanFrom)
+	tracing.End(mailSpan, err)
 	if err != nil {
 		s.msgCtx = nil
 		s.msgTask.End()
+		tracing.End(s.msgSpan, err)
 		s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
 		return msgMeta.ID, err
 	}
@@ -276,7 +335,9 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	return msgMeta.ID, nil
 }
 
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts *smtp.MailOptions) (err error) {
+	defer s.recoverPanic("MAIL", nil, &err)
+
 	if s.endp.authAlwaysRequired && s.connState.AuthUser == "" {
 		return smtp.ErrAuthRequired
 	}
@@ -335,7 +396,9 @@ func (s *Session) fetchRDNSName(ctx context.Context) {
 	s.connState.RDNSName.Set(name, nil)
 }
 
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
+	defer s.recoverPanic("RCPT", nil, &err)
+
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -362,18 +425,21 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 
 	rcptCtx, rcptTask := trace.NewTask(s.msgCtx, "RCPT TO")
 	defer rcptTask.End()
+	rcptCtx, rcptSpan := tracing.Start(rcptCtx, "smtp.rcpt", attribute.String("maddy.rcpt", to))
 
-	if err := s.rcpt(rcptCtx, to, opts); err != nil {
+	err = s.rcpt(rcptCtx, to, opts)
+	tracing.End(rcptSpan, err)
+	if err != nil {
 		if s.loggedRcptErrors < s.endp.maxLoggedRcptErrors {
-			s.log.Error("RCPT error", err, "rcpt", to, "msg_id", s.msgMeta.ID)
+			s.log.Error("RCPT error", err, "rcpt", to, "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
 			s.loggedRcptErrors++
 			if s.loggedRcptErrors == s.endp.maxLoggedRcptErrors {
-				s.log.Msg("too many RCPT errors, possible dictonary attack", "src_ip", s.connState.RemoteAddr, "msg_id", s.msgMeta.ID)
+				s.log.Msg("too many RCPT errors, possible dictonary attack", "src_ip", s.connState.RemoteAddr, "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
 			}
 		}
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
 	}
-	s.endp.Log.Msg("RCPT ok", "rcpt", to, "msg_id", s.msgMeta.ID)
+	s.endp.Log.Msg("RCPT ok", "rcpt", to, "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
 	return nil
 }
 
@@ -413,6 +479,7 @@ func (s *Session) Logout() error {
 	if s.cancelRDNS != nil {
 		s.cancelRDNS()
 	}
+	s.cancelConn()
 
 	s.endp.sessionCnt.Add(-1)
 
@@ -450,15 +517,22 @@ func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, err
 	return header, buf, nil
 }
 
-func (s *Session) Data(r io.Reader) error {
+func (s *Session) Data(r io.Reader) (err error) {
+	// Session is cleaned before the panic is recovered, so pass msgMeta
+	// explicitly.
+	defer s.recoverPanic("DATA", s.msgMeta, &err)
+
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
 	bodyCtx, bodyTask := trace.NewTask(s.msgCtx, "DATA")
 	defer bodyTask.End()
+	bodyCtx, bodySpan := tracing.Start(bodyCtx, "smtp.data")
+	defer bodySpan.End()
 
 	wrapErr := func(err error) error {
-		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
+		tracing.SetError(bodySpan, err)
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
@@ -491,7 +565,7 @@ func (s *Session) Data(r io.Reader) error {
 		return wrapErr(err)
 	}
 
-	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	s.log.Msg("accepted", "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
 
 	return nil
 }
@@ -505,15 +579,20 @@ func (sw statusWrapper) SetStatus(rcpt string, err error) {
 	sw.sc.SetStatus(rcpt, sw.s.endp.wrapErr(sw.s.msgMeta.ID, !sw.s.opts.UTF8, "DATA", err))
 }
 
-func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
+func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) (err error) {
+	defer s.recoverPanic("DATA", s.msgMeta, &err)
+
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
 	bodyCtx, bodyTask := trace.NewTask(s.msgCtx, "DATA")
 	defer bodyTask.End()
+	bodyCtx, bodySpan := tracing.Start(bodyCtx, "smtp.data")
+	defer bodySpan.End()
 
 	wrapErr := func(err error) error {
-		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
+		tracing.SetError(bodySpan, err)
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
@@ -546,7 +625,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		return wrapErr(err)
 	}
 
-	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	s.log.Msg("accepted", "msg_id", s.msgMeta.ID, "trace_id", s.msgMeta.TraceID)
 
 	return nil
 }
@@ -561,6 +640,7 @@ func (s *Session) checkRoutingLoops(header textproto.Header) error {
 		receivedCount++
 	}
 	if receivedCount > s.endp.maxReceived {
+		loopsDetected.WithLabelValues(s.endp.name).Inc()
 		return &exterrors.SMTPError{
 			Code:         554,
 			EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
@@ -43,6 +43,7 @@ import (
 	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/panics"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/limits"
@@ -63,6 +64,7 @@ type Endpoint struct {
 	buffer func(r io.Reader) (buffer.Buffer, error)
 
 	authAlwaysRequired  bool
+	clientCertAuth      bool
 	submission          bool
 	lmtp                bool
 	deferServerReject   bool
@@ -98,7 +100,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		buffer:     buffer.BufferInMemory,
 		Log:        log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:  log.Logger{Name: modName + "/sasl"},
+			Name: modName,
 		},
 	}
 	return endp, nil
@@ -106,7 +109,7 @@ func New(modName string, addrs []string) (module.Module, error) {
 
 func (endp *Endpoint) Init(cfg *config.Map) error {
 	endp.serv = smtp.NewServer(endp)
-	endp.serv.ErrorLog = endp.Log
+	endp.serv.ErrorLog = panics.ServerLog{Log: endp.Log, What: "SMTP connection"}
 	endp.serv.LMTP = endp.lmtp
 	endp.serv.EnableSMTPUTF8 = true
 	endp.serv.EnableREQUIRETLS = true
@@ -133,7 +136,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 	allLocal := true
 	for _, addr := range addresses {
-		if addr.Scheme != "unix" && !strings.HasPrefix(addr.Host, "127.0.0.") {
+		if addr.Scheme != "unix" && !strings.HasPrefix(addr.Host, "127.0.0.") && addr.Host != "::1" {
 			allLocal = false
 		}
 	}
@@ -267,6 +270,7 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}, bufferModeDirective, &endp.buffer)
 	cfg.Custom("tls", true, endp.name != "lmtp", nil, tls2.TLSDirective, &endp.serv.TLSConfig)
 	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.serv.AllowInsecureAuth)
+	cfg.Bool("client_cert_auth", false, false, &endp.clientCertAuth)
 	cfg.Int("smtp_max_line_length", false, false, 4000, &endp.serv.MaxLineLength)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
@@ -281,6 +285,8 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &endp.limits)
+	cfg.Custom("auth_limits", false, false, nil, auth.LimitsDirective, &endp.saslAuth.Limits)
+	cfg.Custom("auth_policy", false, false, nil, auth.PolicyDirective, &endp.saslAuth.Policy)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
@@ -299,13 +305,13 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}
 	endp.pipeline.Hostname = endp.serv.Domain
 	endp.pipeline.Resolver = endp.resolver
-	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
+	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Instance: endp.name, Debug: endp.Log.Debug}
 	endp.pipeline.FirstPipeline = true
 
 	endp.serv.AuthDisabled = len(endp.saslAuth.SASLMechanisms()) == 0
 	if endp.submission {
 		endp.authAlwaysRequired = true
-		if len(endp.saslAuth.SASLMechanisms()) == 0 {
+		if len(endp.saslAuth.SASLMechanisms()) == 0 && !endp.clientCertAuth {
 			return fmt.Errorf("%s: auth. provider must be set for submission endpoint", endp.name)
 		}
 	}
@@ -321,8 +327,9 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		mech := mech
 
 		endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Conn().RemoteAddr(), func(id string) error {
-				c.Session().(*Session).connState.AuthUser = id
+			sess := c.Session().(*Session)
+			return endp.saslAuth.CreateSASL(sess.connCtx, mech, c.Conn().RemoteAddr(), func(id string) error {
+				sess.connState.AuthUser = id
 				return nil
 			})
 		})
@@ -415,6 +422,7 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 		log:        endp.Log,
 		sessionCtx: context.Background(),
 	}
+	s.connCtx, s.cancelConn = context.WithCancel(context.Background())
 
 	// Used in tests.
 	if conn == nil {
@@ -428,6 +436,10 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 	}
 	if tlsState, ok := conn.TLSConnectionState(); ok {
 		s.connState.TLS = tlsState
+		s.connState.TLSClientIdentity = tls2.ClientIdentity(tlsState)
+		if endp.clientCertAuth && s.connState.TLSClientIdentity != "" {
+			s.connState.AuthUser = s.connState.TLSClientIdentity
+		}
 	}
 
 	if endp.serv.LMTP {
@@ -0,0 +1,114 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package extkey implements private keys that are stored outside of the file
+// system: in PKCS#11 tokens (e.g. HSMs) or in remote signing services.
+//
+// Such keys are referenced using URIs in places where a key file path is
+// expected:
+//
+//	pkcs11:token=maddy;object=dkim?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=/etc/maddy/pin
+//	remote:https://signer.example.org/keys/dkim
+package extkey
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	pkcs11Prefix = "pkcs11:"
+	remotePrefix = "remote:"
+)
+
+var (
+	signers     = map[string]crypto.Signer{}
+	signersLock sync.Mutex
+)
+
+// IsExternal reports whether path is an URI of an external key instead of a
+// file path.
+func IsExternal(path string) bool {
+	return strings.HasPrefix(path, pkcs11Prefix) || strings.HasPrefix(path, remotePrefix)
+}
+
+// Redacted returns the key URI without secrets (PIN or password) for use in
+// log messages.
+func Redacted(uri string) string {
+	switch {
+	case strings.HasPrefix(uri, pkcs11Prefix):
+		// Query attributes contain the module path and PIN.
+		path, _, _ := strings.Cut(uri, "?")
+		return path
+	case strings.HasPrefix(uri, remotePrefix):
+		u, err := url.Parse(strings.TrimPrefix(uri, remotePrefix))
+		if err != nil {
+			return remotePrefix
+		}
+		return remotePrefix + u.Redacted()
+	}
+	return uri
+}
+
+// Load returns the signer for the key referenced by uri.
+//
+// Signers are cached so the same key is not looked up again when
+// configuration is reloaded.
+func Load(uri string) (crypto.Signer, error) {
+	signersLock.Lock()
+	defer signersLock.Unlock()
+
+	if signer, ok := signers[uri]; ok {
+		return signer, nil
+	}
+
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	switch {
+	case strings.HasPrefix(uri, pkcs11Prefix):
+		signer, err = loadPKCS11(uri)
+	case strings.HasPrefix(uri, remotePrefix):
+		signer, err = loadRemote(strings.TrimPrefix(uri, remotePrefix))
+	default:
+		return nil, errors.New("extkey: not a key URI")
+	}
+	if err != nil {
+		return nil, err
+	}
+	signers[uri] = signer
+	return signer, nil
+}
+
+// pssSaltLength returns the actual salt length for RSA-PSS signatures made
+// using opts.
+func pssSaltLength(pub *rsa.PublicKey, opts *rsa.PSSOptions) int {
+	switch opts.SaltLength {
+	case rsa.PSSSaltLengthEqualsHash:
+		return opts.Hash.Size()
+	case rsa.PSSSaltLengthAuto:
+		// Maximum length allowed by the key size.
+		return (pub.N.BitLen()-1+7)/8 - 2 - opts.Hash.Size()
+	}
+	return opts.SaltLength
+}
@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package extkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSigner implements the remote signer protocol using the local key.
+func testSigner(t *testing.T, key crypto.Signer) *httptest.Server {
+	t.Helper()
+
+	pubBlob, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "maddy" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			_ = json.NewEncoder(w).Encode(remoteKeyResponse{PublicKey: pubBlob})
+			return
+		}
+
+		var req remoteSignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var opts crypto.SignerOpts = crypto.Hash(0)
+		if req.Hash == "SHA-256" {
+			opts = crypto.SHA256
+		}
+		if req.PSSSaltLength != nil {
+			opts = &rsa.PSSOptions{SaltLength: *req.PSSSaltLength, Hash: crypto.SHA256}
+		}
+		sig, err := key.Sign(rand.Reader, req.Data, opts)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(remoteSignResponse{Signature: sig})
+	}))
+}
+
+func TestRemoteSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("message")
+	digest := sha256.Sum256(msg)
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey, edKey} {
+		srv := testSigner(t, key)
+		defer srv.Close()
+		uri := "remote:" + strings.Replace(srv.URL, "http://", "http://maddy:secret@", 1) + "/key"
+
+		if !IsExternal(uri) {
+			t.Fatal("IsExternal returned false")
+		}
+		if redacted := Redacted(uri); strings.Contains(redacted, "secret") {
+			t.Error("Password is not redacted:", redacted)
+		}
+
+		signer, err := Load(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(signer.Public(), key.Public()) {
+			t.Fatal("Wrong public key")
+		}
+
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+				t.Error("PKCS #1 v1.5:", err)
+			}
+			pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			sig, err = signer.Sign(rand.Reader, digest[:], pssOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pssOpts); err != nil {
+				t.Error("PSS:", err)
+			}
+		case *ecdsa.PublicKey:
+			sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+				t.Error("ECDSA signature verification failed")
+			}
+		case ed25519.PublicKey:
+			sig, err := signer.Sign(rand.Reader, msg, crypto.Hash(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ed25519.Verify(pub, msg, sig) {
+				t.Error("Ed25519 signature verification failed")
+			}
+		}
+	}
+}
+
+func TestRemoteSigner_Unauthorized(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testSigner(t, key)
+	defer srv.Close()
+
+	if _, err := Load("remote:" + srv.URL + "/key"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestParsePKCS11URI(t *testing.T) {
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinFile, []byte("1234\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	uri, err := parsePKCS11URI("pkcs11:token=maddy%20keys;object=dkim;id=%01%02;type=private" +
+		"?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=file:" + pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pkcs11URI{
+		modulePath: "/usr/lib/softhsm/libsofthsm2.so",
+		token:      "maddy keys",
+		object:     "dkim",
+		id:         []byte{1, 2},
+		pin:        "1234",
+	}
+	if !reflect.DeepEqual(uri, want) {
+		t.Errorf("Wrong result: %+v", uri)
+	}
+
+	for _, bad := range []string{
+		"pkcs11:object=dkim",
+		"pkcs11:token=maddy?module-path=/lib/p11.so",
+		"pkcs11:object=dkim;type=cert?module-path=/lib/p11.so",
+		"pkcs11:object=dkim;serial=1?module-path=/lib/p11.so",
+		"pkcs11:object=%zz?module-path=/lib/p11.so",
+	} {
+		if _, err := parsePKCS11URI(bad); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+
+	if redacted := Redacted("pkcs11:object=dkim?module-path=/lib/p11.so&pin-value=1234"); redacted != "pkcs11:object=dkim" {
+		t.Error("Wrong redacted URI:", redacted)
+	}
+}
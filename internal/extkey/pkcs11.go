@@ -0,0 +1,289 @@
+//go:build cgo && pkcs11
+// +build cgo,pkcs11
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package extkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DigestInfo prefixes for RSA PKCS #1 v1.5 signatures (RFC 8017, Section
+// 9.2), CKM_RSA_PKCS expects the complete DigestInfo structure.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var pssParams = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+var curveOIDs = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// Initialized libraries, indexed by the module path. Protected by
+// signersLock.
+var pkcs11Modules = map[string]*pkcs11.Ctx{}
+
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+
+	// Sessions can't be used concurrently.
+	lock sync.Mutex
+}
+
+func pkcs11Module(path string) (*pkcs11.Ctx, error) {
+	if ctx, ok := pkcs11Modules[path]; ok {
+		return ctx, nil
+	}
+
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("extkey: pkcs11: cannot load %s", path)
+	}
+	err := ctx.Initialize()
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("extkey: pkcs11: %s: %w", path, err)
+	}
+	pkcs11Modules[path] = ctx
+	return ctx, nil
+}
+
+func findSlot(ctx *pkcs11.Ctx, token string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		if token == "" {
+			return slot, nil
+		}
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		// Labels are padded with spaces.
+		if strings.TrimRight(info.Label, " \x00") == token {
+			return slot, nil
+		}
+	}
+	return 0, errors.New("token not found")
+}
+
+func findObject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, uri pkcs11URI) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if uri.object != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, uri.object))
+	}
+	if uri.id != nil {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, uri.id))
+	}
+
+	if err := ctx.FindObjectsInit(session, tmpl); err != nil {
+		return 0, err
+	}
+	objs, _, err := ctx.FindObjects(session, 2)
+	if finalErr := ctx.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch len(objs) {
+	case 0:
+		return 0, errors.New("key not found")
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, errors.New("multiple keys match the URI")
+	}
+}
+
+func readPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err == nil {
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	}
+
+	attrs, err = ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, errors.New("unsupported key type, only RSA and ECDSA keys are supported")
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+		return nil, fmt.Errorf("malformed EC parameters: %w", err)
+	}
+	curve, ok := curveOIDs[oid.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve: %v", oid)
+	}
+	// The point should be wrapped into OCTET STRING, but some tokens return
+	// it as is.
+	point := attrs[1].Value
+	var wrapped []byte
+	if rest, err := asn1.Unmarshal(point, &wrapped); err == nil && len(rest) == 0 {
+		point = wrapped
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("malformed EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func loadPKCS11(uri string) (crypto.Signer, error) {
+	attrs, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := pkcs11Module(attrs.modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, err := findSlot(ctx, attrs.token)
+	if err != nil {
+		return nil, fmt.Errorf("extkey: %s: %w", Redacted(uri), err)
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("extkey: %s: %w", Redacted(uri), err)
+	}
+	fail := func(err error) (crypto.Signer, error) {
+		ctx.CloseSession(session)
+		return nil, fmt.Errorf("extkey: %s: %w", Redacted(uri), err)
+	}
+
+	if attrs.pin != "" {
+		// Login state is shared by all sessions of the application.
+		err := ctx.Login(session, pkcs11.CKU_USER, attrs.pin)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			return fail(err)
+		}
+	}
+
+	key, err := findObject(ctx, session, pkcs11.CKO_PRIVATE_KEY, attrs)
+	if err != nil {
+		return fail(err)
+	}
+	pubObj, err := findObject(ctx, session, pkcs11.CKO_PUBLIC_KEY, attrs)
+	if err != nil {
+		return fail(fmt.Errorf("public key: %w", err))
+	}
+	pub, err := readPublicKey(ctx, session, pubObj)
+	if err != nil {
+		return fail(err)
+	}
+
+	return &pkcs11Signer{
+		ctx:     ctx,
+		session: session,
+		key:     key,
+		pub:     pub,
+	}, nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var (
+		mech *pkcs11.Mechanism
+		data = digest
+	)
+	switch pub := s.pub.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			params, ok := pssParams[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("extkey: pkcs11: unsupported hash: %v", opts.HashFunc())
+			}
+			saltLen := pssSaltLength(pub, pssOpts)
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(params[0], params[1], uint(saltLen)))
+			break
+		}
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("extkey: pkcs11: unsupported hash: %v", opts.HashFunc())
+		}
+		data = make([]byte, 0, len(prefix)+len(digest))
+		data = append(append(data, prefix...), digest...)
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+	case *ecdsa.PublicKey:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mech}, s.key); err != nil {
+		return nil, fmt.Errorf("extkey: pkcs11: %w", err)
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("extkey: pkcs11: %w", err)
+	}
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns r and s concatenated, Go expects ASN.1 structure.
+		half := len(sig) / 2
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{
+			R: new(big.Int).SetBytes(sig[:half]),
+			S: new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
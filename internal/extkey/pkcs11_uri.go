@@ -0,0 +1,113 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package extkey
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// pkcs11URI contains attributes of the PKCS#11 URI (RFC 7512) that are used to
+// find the key.
+type pkcs11URI struct {
+	modulePath string
+	token      string
+	object     string
+	id         []byte
+	pin        string
+}
+
+func parsePKCS11URI(uri string) (pkcs11URI, error) {
+	var res pkcs11URI
+
+	uri = strings.TrimPrefix(uri, pkcs11Prefix)
+	path, query, _ := strings.Cut(uri, "?")
+
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		name, value, err := uriAttr(attr)
+		if err != nil {
+			return pkcs11URI{}, err
+		}
+		switch name {
+		case "token":
+			res.token = value
+		case "object":
+			res.object = value
+		case "id":
+			res.id = []byte(value)
+		case "type":
+			if value != "private" {
+				return pkcs11URI{}, fmt.Errorf("extkey: pkcs11: object type should be private, got %s", value)
+			}
+		default:
+			return pkcs11URI{}, fmt.Errorf("extkey: pkcs11: unsupported attribute: %s", name)
+		}
+	}
+
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+		name, value, err := uriAttr(attr)
+		if err != nil {
+			return pkcs11URI{}, err
+		}
+		switch name {
+		case "module-path":
+			res.modulePath = value
+		case "pin-value":
+			res.pin = value
+		case "pin-source":
+			pin, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+			if err != nil {
+				return pkcs11URI{}, fmt.Errorf("extkey: pkcs11: %w", err)
+			}
+			res.pin = strings.TrimRight(string(pin), "\r\n")
+		default:
+			return pkcs11URI{}, fmt.Errorf("extkey: pkcs11: unsupported query attribute: %s", name)
+		}
+	}
+
+	if res.modulePath == "" {
+		return pkcs11URI{}, errors.New("extkey: pkcs11: module-path is required")
+	}
+	if res.object == "" && res.id == nil {
+		return pkcs11URI{}, errors.New("extkey: pkcs11: object or id is required")
+	}
+	return res, nil
+}
+
+func uriAttr(attr string) (string, string, error) {
+	name, value, ok := strings.Cut(attr, "=")
+	if !ok {
+		return "", "", fmt.Errorf("extkey: pkcs11: malformed attribute: %s", name)
+	}
+	// Values are percent-encoded, '+' is not a space there.
+	value, err := url.PathUnescape(value)
+	if err != nil {
+		return "", "", fmt.Errorf("extkey: pkcs11: malformed %s value: %w", name, err)
+	}
+	return name, value, nil
+}
@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package history implements the delivery history database.
+//
+// History is a compact per-recipient log of what happened to a message:
+// whether it was received or rejected, what checks said about it and how
+// delivery attempts ended. It is used to answer "where did my mail go"
+// questions without looking through the text logs.
+package history
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// Kinds of recorded events.
+const (
+	// Message is accepted for the recipient.
+	Received = "received"
+	// Message is not accepted for the recipient.
+	Rejected = "rejected"
+	// Message is delivered by the queue.
+	Delivered = "delivered"
+	// Delivery attempt failed with a temporary error and will be retried.
+	Deferred = "deferred"
+	// Delivery failed permanently, a bounce is generated (if enabled).
+	Failed = "failed"
+)
+
+// Event is a single delivery history record.
+type Event struct {
+	Time  time.Time `json:"time"`
+	MsgID string    `json:"msg_id"`
+	Kind  string    `json:"event"`
+	// Name of the module instance that recorded the event.
+	Module  string `json:"module"`
+	Sender  string `json:"sender"`
+	Rcpt    string `json:"rcpt"`
+	Details string `json:"details,omitempty"`
+}
+
+// Query selects events to return from Search. Empty fields match any value,
+// addresses are matched case-insensitively.
+type Query struct {
+	MsgID  string    `json:"msg_id,omitempty"`
+	Sender string    `json:"sender,omitempty"`
+	Rcpt   string    `json:"rcpt,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	// Maximum amount of events to return, the most recent ones are
+	// returned if there are more matching events.
+	Limit int `json:"limit,omitempty"`
+}
+
+var defaultStore atomic.Pointer[Store]
+
+// SetDefault sets the store used by Record and Search. nil disables
+// recording.
+func SetDefault(s *Store) {
+	defaultStore.Store(s)
+}
+
+// Enabled reports whether delivery history is recorded.
+func Enabled() bool {
+	return defaultStore.Load() != nil
+}
+
+// Record adds events to the default store. It does nothing if delivery
+// history is disabled. Events with zero Time get the current time.
+//
+// Events are written in background, Record does not block.
+func Record(events ...Event) {
+	s := defaultStore.Load()
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	for _, ev := range events {
+		if ev.Time.IsZero() {
+			ev.Time = now
+		}
+		s.record(ev)
+	}
+}
+
+// Search returns events matching the query from the default store in
+// chronological order.
+func Search(q Query) ([]Event, error) {
+	s := defaultStore.Load()
+	if s == nil {
+		return nil, ErrDisabled
+	}
+	return s.Search(q)
+}
+
+// FormatErr converts the error into a short single-line description
+// suitable for Event.Details. SMTP status codes are included if known.
+func FormatErr(err error) string {
+	if err == nil {
+		return ""
+	}
+	text := strings.Join(strings.Fields(err.Error()), " ")
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code != 0 {
+		c := smtpErr.EnhancedCode
+		if c[0] <= 0 {
+			return fmt.Sprintf("%d %s", smtpErr.Code, text)
+		}
+		return fmt.Sprintf("%d %d.%d.%d %s", smtpErr.Code, c[0], c[1], c[2], text)
+	}
+	return text
+}
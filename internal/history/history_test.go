@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package history
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	if sqliteImpl == "missing" {
+		t.Skip("SQLite support is not compiled in")
+	}
+	s, err := Open(&Config{
+		Driver:    "sqlite3",
+		DSN:       path,
+		Table:     "maddy_delivery_history",
+		Retention: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s := openTestStore(t, path)
+	SetDefault(s)
+
+	now := time.Now()
+	Record(
+		Event{Time: now.Add(-48 * time.Hour), MsgID: "old", Kind: Received, Sender: "a@example.org", Rcpt: "b@example.org"},
+		Event{Time: now.Add(-2 * time.Hour), MsgID: "1", Kind: Received, Sender: "a@example.org", Rcpt: "b@example.org"},
+		Event{Time: now.Add(-2 * time.Hour), MsgID: "1", Kind: Received, Sender: "a@example.org", Rcpt: "c@example.org"},
+		Event{Time: now.Add(-time.Hour), MsgID: "1", Kind: Deferred, Sender: "a@example.org", Rcpt: "b@example.org"},
+		Event{MsgID: "1", Kind: Delivered, Sender: "a@example.org", Rcpt: "B@example.org"},
+		Event{MsgID: "2", Kind: Rejected, Sender: "d@example.org", Rcpt: "b@example.org"},
+	)
+
+	// Close writes pending events, reopen the database to check that.
+	SetDefault(nil)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestStore(t, path)
+	defer s.Close()
+	s.cleanup()
+	SetDefault(s)
+	defer SetDefault(nil)
+
+	kinds := func(events []Event) []string {
+		res := make([]string, 0, len(events))
+		for _, ev := range events {
+			res = append(res, ev.MsgID+":"+ev.Kind+":"+ev.Rcpt)
+		}
+		return res
+	}
+	check := func(q Query, expected ...string) {
+		t.Helper()
+		events, err := Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := kinds(events)
+		if len(actual) != len(expected) {
+			t.Fatalf("wrong events for %+v: %v", q, actual)
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Fatalf("wrong events for %+v: %v", q, actual)
+			}
+		}
+	}
+
+	check(Query{Rcpt: "b@EXAMPLE.org"},
+		"1:received:b@example.org", "1:deferred:b@example.org", "1:delivered:B@example.org", "2:rejected:b@example.org")
+	check(Query{MsgID: "1", Rcpt: "c@example.org"}, "1:received:c@example.org")
+	check(Query{Sender: "d@example.org"}, "2:rejected:b@example.org")
+	check(Query{Rcpt: "b@example.org", Since: now.Add(-90 * time.Minute)},
+		"1:deferred:b@example.org", "1:delivered:B@example.org", "2:rejected:b@example.org")
+	check(Query{Rcpt: "b@example.org", Limit: 1}, "2:rejected:b@example.org")
+	check(Query{MsgID: "old"})
+}
+
+func TestSearchDisabled(t *testing.T) {
+	if _, err := Search(Query{MsgID: "1"}); !errors.Is(err, ErrDisabled) {
+		t.Fatal("expected ErrDisabled, got", err)
+	}
+}
+
+func TestFormatErr(t *testing.T) {
+	err := &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+		Message:      "No such user",
+	}
+	if s := FormatErr(err); s != "550 5.1.1 No such user" {
+		t.Error("wrong formatting:", s)
+	}
+	if s := FormatErr(errors.New("connection\n  refused")); s != "connection refused" {
+		t.Error("wrong formatting:", s)
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package history
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	_ "github.com/lib/pq"
+)
+
+// ErrDisabled is returned by Search if delivery history is not enabled.
+var ErrDisabled = errors.New("history: delivery history is not enabled")
+
+var sqlTableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+const (
+	// Amount of events waiting to be written. If the database is too slow
+	// to keep up, new events are dropped.
+	pendingEvents = 1024
+	// Maximum amount of events written in one transaction.
+	batchSize = 128
+
+	cleanupInterval = time.Hour
+	defaultLimit    = 100
+)
+
+// Config is the delivery history configuration read from the global
+// delivery_history block.
+type Config struct {
+	Driver    string
+	DSN       string
+	Table     string
+	Retention time.Duration
+}
+
+// Directive parses the delivery_history block:
+//
+//	delivery_history {
+//	    driver sqlite3
+//	    dsn delivery_history.db
+//	    table maddy_delivery_history
+//	    retention 720h
+//	}
+func Directive(m *config.Map, node config.Node) (interface{}, error) {
+	cfg := &Config{}
+	var dsnParts []string
+
+	childM := config.NewMap(m.Globals, node)
+	childM.String("driver", false, false, "sqlite3", &cfg.Driver)
+	childM.StringList("dsn", false, false, nil, &dsnParts)
+	childM.String("table", false, false, "maddy_delivery_history", &cfg.Table)
+	childM.Duration("retention", false, false, 30*24*time.Hour, &cfg.Retention)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+	cfg.DSN = strings.Join(dsnParts, " ")
+
+	switch cfg.Driver {
+	case "sqlite3":
+		if sqliteImpl == "missing" {
+			return nil, config.NodeErr(node, "SQLite is not supported, recompile without no_sqlite3 tag set")
+		}
+	case "postgres":
+		if cfg.DSN == "" {
+			return nil, config.NodeErr(node, "dsn is required for postgres driver")
+		}
+	default:
+		return nil, config.NodeErr(node, "unsupported driver: %s", cfg.Driver)
+	}
+	if !sqlTableName.MatchString(cfg.Table) {
+		return nil, config.NodeErr(node, "invalid table name: %s", cfg.Table)
+	}
+	if cfg.Retention <= 0 {
+		return nil, config.NodeErr(node, "retention should be positive")
+	}
+
+	return cfg, nil
+}
+
+// Store keeps delivery history events in a SQL table.
+type Store struct {
+	db        *sql.DB
+	driver    string
+	table     string
+	retention time.Duration
+	log       log.Logger
+
+	events  chan Event
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Open opens the database and starts background writing and removal of
+// expired events. For SQLite, relative DSN is interpreted relative to the
+// state directory.
+func Open(cfg *Config) (*Store, error) {
+	driver, dsn := cfg.Driver, cfg.DSN
+	if driver == "sqlite3" {
+		if dsn == "" {
+			dsn = "delivery_history.db"
+		}
+		if !filepath.IsAbs(dsn) && !strings.HasPrefix(dsn, "file:") {
+			dsn = filepath.Join(config.StateDirectory, dsn)
+		}
+		if sqliteImpl == "modernc" {
+			driver = "sqlite"
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	s := &Store{
+		db:        db,
+		driver:    driver,
+		table:     cfg.Table,
+		retention: cfg.Retention,
+		log:       log.Logger{Name: "history"},
+		events:    make(chan Event, pendingEvents),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if err := s.initSchema(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("history: failed to initialize schema: %w", err)
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// query replaces the table name placeholder and converts the argument
+// placeholders to the form understood by the driver.
+func (s *Store) query(q string) string {
+	q = strings.ReplaceAll(q, "{table}", s.table)
+	if s.driver == "postgres" {
+		return q
+	}
+	for i := 9; i > 0; i-- {
+		q = strings.ReplaceAll(q, fmt.Sprintf("$%d", i), "?")
+	}
+	return q
+}
+
+func (s *Store) initSchema() error {
+	idType := "INTEGER PRIMARY KEY"
+	if s.driver == "postgres" {
+		idType = "BIGSERIAL PRIMARY KEY"
+	}
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS {table} (
+			id ` + idType + `,
+			ts BIGINT NOT NULL,
+			msg_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			module TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			rcpt TEXT NOT NULL,
+			details TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS {table}_ts ON {table} (ts)`,
+		`CREATE INDEX IF NOT EXISTS {table}_msg_id ON {table} (msg_id)`,
+		`CREATE INDEX IF NOT EXISTS {table}_sender ON {table} (LOWER(sender))`,
+		`CREATE INDEX IF NOT EXISTS {table}_rcpt ON {table} (LOWER(rcpt))`,
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.Exec(s.query(stmt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) record(ev Event) {
+	select {
+	case s.events <- ev:
+	default:
+		s.log.Msg("too many pending events, dropping", "msg_id", ev.MsgID, "event", ev.Kind, "rcpt", ev.Rcpt)
+	}
+}
+
+func (s *Store) run() {
+	defer close(s.stopped)
+
+	s.cleanup()
+	cleanupTick := time.NewTicker(cleanupInterval)
+	defer cleanupTick.Stop()
+
+	batch := make([]Event, 0, batchSize)
+	for {
+		select {
+		case ev := <-s.events:
+			batch = append(batch[:0], ev)
+			for len(batch) < batchSize && len(s.events) != 0 {
+				batch = append(batch, <-s.events)
+			}
+			if err := s.write(batch); err != nil {
+				s.log.Error("failed to write events", err, "count", len(batch))
+			}
+		case <-cleanupTick.C:
+			s.cleanup()
+		case <-s.stop:
+			// Write remaining events before exiting.
+			batch = batch[:0]
+			for len(s.events) != 0 {
+				batch = append(batch, <-s.events)
+			}
+			if err := s.write(batch); err != nil {
+				s.log.Error("failed to write events", err, "count", len(batch))
+			}
+			return
+		}
+	}
+}
+
+func (s *Store) write(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(s.query(`INSERT INTO {table} (ts, msg_id, event, module, sender, rcpt, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`))
+	if err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range events {
+		_, err := stmt.Exec(ev.Time.UnixNano(), ev.MsgID, ev.Kind, ev.Module, ev.Sender, ev.Rcpt, ev.Details)
+		if err != nil {
+			tx.Rollback() //nolint:errcheck
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// cleanup removes events older than the retention period.
+func (s *Store) cleanup() {
+	threshold := time.Now().Add(-s.retention).UnixNano()
+	res, err := s.db.Exec(s.query(`DELETE FROM {table} WHERE ts < $1`), threshold)
+	if err != nil {
+		s.log.Error("failed to remove expired events", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n != 0 {
+		s.log.Debugf("removed %d expired events", n)
+	}
+}
+
+// Search returns events matching the query in chronological order.
+func (s *Store) Search(q Query) ([]Event, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	addCond := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.ReplaceAll(cond, "$", fmt.Sprintf("$%d", len(args))))
+	}
+	if q.MsgID != "" {
+		addCond("msg_id = $", q.MsgID)
+	}
+	if q.Sender != "" {
+		addCond("LOWER(sender) = $", strings.ToLower(q.Sender))
+	}
+	if q.Rcpt != "" {
+		addCond("LOWER(rcpt) = $", strings.ToLower(q.Rcpt))
+	}
+	if !q.Since.IsZero() {
+		addCond("ts >= $", q.Since.UnixNano())
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	where := ""
+	if len(conds) != 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	rows, err := s.db.Query(s.query(`SELECT ts, msg_id, event, module, sender, rcpt, details FROM {table} `+
+		where+fmt.Sprintf(` ORDER BY ts DESC, id DESC LIMIT %d`, limit)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	defer rows.Close()
+
+	var res []Event
+	for rows.Next() {
+		var (
+			ev Event
+			ts int64
+		)
+		if err := rows.Scan(&ts, &ev.MsgID, &ev.Kind, &ev.Module, &ev.Sender, &ev.Rcpt, &ev.Details); err != nil {
+			return nil, fmt.Errorf("history: %w", err)
+		}
+		ev.Time = time.Unix(0, ts)
+		res = append(res, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, nil
+}
+
+// Close writes pending events and closes the database.
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.stopped
+	return s.db.Close()
+}
@@ -144,6 +144,9 @@ func (c *Check) expandCommand(msgMeta *module.MsgMetadata, accountName string, r
 					oldestOriginalRcpt = originalRcpt
 				}
 				return oldestOriginalRcpt
+			case "{detail}":
+				detail, _ := msgMeta.RcptDetail(rcptTo)
+				return detail
 			case "{subject}":
 				return hdr.Get("Subject")
 			case "{account_name}":
@@ -0,0 +1,233 @@
+//go:build libdns_desec || !libdns_separate
+// +build libdns_desec !libdns_separate
+
+package libdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/libdns/libdns"
+)
+
+const (
+	desecAPI = "https://desec.io/api/v1"
+	// deSEC does not allow lower TTLs.
+	desecMinTTL = 3600
+	// Amount of retries for throttled requests.
+	desecRetries = 3
+)
+
+var errDesecNotFound = errors.New("libdns.desec: RRset not found")
+
+// desecProvider manages records using deSEC API
+// (https://desec.readthedocs.io/en/latest/dns/rrsets.html).
+type desecProvider struct {
+	token  string
+	apiURL string
+	client http.Client
+
+	// RRsets are replaced as a whole, so concurrent changes to the same RRset
+	// (e.g. for a domain and its wildcard) would lose records.
+	lock sync.Mutex
+}
+
+type desecRRset struct {
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl,omitempty"`
+	Records []string `json:"records"`
+}
+
+func (p *desecProvider) do(ctx context.Context, method, path string, reqBody interface{}, respBody interface{}) error {
+	var body []byte
+	if reqBody != nil {
+		var err error
+		body, err = json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, p.apiURL+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Token "+p.token)
+		if reqBody != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("libdns.desec: %w", err)
+		}
+		respData, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("libdns.desec: %w", err)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests && attempt < desecRetries:
+			delay, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if err != nil || delay <= 0 {
+				delay = 1
+			}
+			select {
+			case <-time.After(time.Duration(delay) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return errDesecNotFound
+		case resp.StatusCode/100 != 2:
+			return fmt.Errorf("libdns.desec: %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(respData)))
+		}
+
+		if respBody != nil && len(respData) != 0 {
+			return json.Unmarshal(respData, respBody)
+		}
+		return nil
+	}
+}
+
+// desecSubname converts the record name into the RRset subname, zone apex
+// uses an empty subname.
+func desecSubname(name string) string {
+	if name == "@" {
+		return ""
+	}
+	return name
+}
+
+func desecPath(zone, subname, typ string) string {
+	if subname == "" {
+		subname = "@"
+	}
+	return "/domains/" + url.PathEscape(strings.TrimSuffix(zone, ".")) + "/rrsets/" +
+		url.PathEscape(subname) + "/" + url.PathEscape(typ) + "/"
+}
+
+func desecValue(rec libdns.Record) string {
+	if rec.Type == "TXT" {
+		return strconv.Quote(rec.Value)
+	}
+	return rec.Value
+}
+
+func (p *desecProvider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, rec := range recs {
+		subname := desecSubname(rec.Name)
+		path := desecPath(zone, subname, rec.Type)
+		value := desecValue(rec)
+
+		var rrset desecRRset
+		err := p.do(ctx, http.MethodGet, path, nil, &rrset)
+		if errors.Is(err, errDesecNotFound) {
+			ttl := int(rec.TTL.Seconds())
+			if ttl < desecMinTTL {
+				ttl = desecMinTTL
+			}
+			err = p.do(ctx, http.MethodPost, "/domains/"+url.PathEscape(strings.TrimSuffix(zone, "."))+"/rrsets/", desecRRset{
+				Subname: subname,
+				Type:    rec.Type,
+				TTL:     ttl,
+				Records: []string{value},
+			}, nil)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		exists := false
+		for _, existing := range rrset.Records {
+			if existing == value {
+				exists = true
+			}
+		}
+		if exists {
+			continue
+		}
+		err = p.do(ctx, http.MethodPatch, path, map[string]interface{}{
+			"records": append(rrset.Records, value),
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+func (p *desecProvider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, rec := range recs {
+		path := desecPath(zone, desecSubname(rec.Name), rec.Type)
+		value := desecValue(rec)
+
+		var rrset desecRRset
+		err := p.do(ctx, http.MethodGet, path, nil, &rrset)
+		if errors.Is(err, errDesecNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Empty list removes the RRset.
+		kept := make([]string, 0, len(rrset.Records))
+		for _, existing := range rrset.Records {
+			if existing != value {
+				kept = append(kept, existing)
+			}
+		}
+		if len(kept) == len(rrset.Records) {
+			continue
+		}
+		if err := p.do(ctx, http.MethodPatch, path, map[string]interface{}{"records": kept}, nil); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+func init() {
+	module.Register("libdns.desec", func(modName, instName string, _, _ []string) (module.Module, error) {
+		p := desecProvider{
+			apiURL: desecAPI,
+			client: http.Client{Timeout: time.Minute},
+		}
+		return &ProviderModule{
+			RecordDeleter:  &p,
+			RecordAppender: &p,
+			setConfig: func(c *config.Map) {
+				c.String("api_token", false, true, "", &p.token)
+			},
+			instName: instName,
+			modName:  modName,
+		}, nil
+	})
+}
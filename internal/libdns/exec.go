@@ -0,0 +1,97 @@
+//go:build libdns_exec || !libdns_separate
+// +build libdns_exec !libdns_separate
+
+package libdns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/libdns/libdns"
+)
+
+// execProvider calls an external command to create and remove records.
+// Default arguments are compatible with the "exec" provider of lego, so
+// existing hook scripts can be reused.
+type execProvider struct {
+	cmd     string
+	args    []string
+	timeout time.Duration
+}
+
+func (p *execProvider) run(ctx context.Context, action, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	for _, rec := range recs {
+		fqdn := libdns.AbsoluteName(rec.Name, zone)
+		if !strings.HasSuffix(fqdn, ".") {
+			fqdn += "."
+		}
+		replacer := strings.NewReplacer(
+			"{action}", action,
+			"{zone}", strings.TrimSuffix(zone, "."),
+			"{name}", rec.Name,
+			"{fqdn}", fqdn,
+			"{type}", rec.Type,
+			"{value}", rec.Value,
+			"{ttl}", strconv.Itoa(int(rec.TTL.Seconds())),
+		)
+		args := make([]string, 0, len(p.args))
+		for _, arg := range p.args {
+			args = append(args, replacer.Replace(arg))
+		}
+
+		cmdCtx, cancel := context.WithTimeout(ctx, p.timeout)
+		cmd := exec.CommandContext(cmdCtx, p.cmd, args...)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("libdns.exec: %s %s failed: %w: %s", action, fqdn, err, strings.TrimSpace(out.String()))
+		}
+	}
+	return recs, nil
+}
+
+func (p *execProvider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.run(ctx, "present", zone, recs)
+}
+
+func (p *execProvider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.run(ctx, "cleanup", zone, recs)
+}
+
+func init() {
+	module.Register("libdns.exec", func(modName, instName string, _, _ []string) (module.Module, error) {
+		p := execProvider{}
+		var cmd []string
+		return &ProviderModule{
+			RecordDeleter:  &p,
+			RecordAppender: &p,
+			setConfig: func(c *config.Map) {
+				c.StringList("command", false, true, nil, &cmd)
+				c.Duration("timeout", false, false, 2*time.Minute, &p.timeout)
+			},
+			afterConfig: func() error {
+				if len(cmd) == 0 {
+					return fmt.Errorf("libdns.exec: command is required")
+				}
+				p.cmd = cmd[0]
+				p.args = cmd[1:]
+				if len(p.args) == 0 {
+					p.args = []string{"{action}", "{fqdn}", "{value}"}
+				}
+				return nil
+			},
+			instName: instName,
+			modName:  modName,
+		}, nil
+	})
+}
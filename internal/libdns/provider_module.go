@@ -5,6 +5,12 @@ import (
 	"github.com/libdns/libdns"
 )
 
+// ProviderModule wraps the libdns provider into the module.
+//
+// DNS providers are modules in the "libdns" namespace that implement
+// libdns.RecordAppender and libdns.RecordDeleter (certmagic.ACMEDNSProvider).
+// They are used by tls.loader.acme to solve DNS-01 challenges, additional
+// providers can be added by registering such modules.
 type ProviderModule struct {
 	libdns.RecordDeleter
 	libdns.RecordAppender
@@ -0,0 +1,187 @@
+//go:build !libdns_separate
+// +build !libdns_separate
+
+package libdns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+var testRecord = libdns.Record{
+	Type:  "TXT",
+	Name:  "_acme-challenge",
+	Value: "token",
+	TTL:   2 * time.Minute,
+}
+
+func TestExecProvider(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	out := filepath.Join(dir, "out")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &execProvider{
+		cmd:     script,
+		args:    []string{"{action}", "{fqdn}", "{value}"},
+		timeout: time.Minute,
+	}
+	ctx := context.Background()
+	if _, err := p.AppendRecords(ctx, "example.org.", []libdns.Record{testRecord}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.DeleteRecords(ctx, "example.org.", []libdns.Record{testRecord}); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present _acme-challenge.example.org. token\ncleanup _acme-challenge.example.org. token\n"
+	if string(calls) != want {
+		t.Errorf("Wrong calls: %q", calls)
+	}
+
+	p.cmd = "false"
+	if _, err := p.AppendRecords(ctx, "example.org.", []libdns.Record{testRecord}); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestWebhookProvider(t *testing.T) {
+	var reqs []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reqs = append(reqs, req)
+	}))
+	defer srv.Close()
+
+	p := &webhookProvider{url: srv.URL, headers: http.Header{}}
+	ctx := context.Background()
+	if _, err := p.AppendRecords(ctx, "example.org.", []libdns.Record{testRecord}); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	p.headers.Set("Authorization", "Bearer secret")
+	if _, err := p.AppendRecords(ctx, "example.org.", []libdns.Record{testRecord}); err != nil {
+		t.Fatal(err)
+	}
+	want := webhookRequest{
+		Action: "present",
+		Zone:   "example.org",
+		Name:   "_acme-challenge",
+		FQDN:   "_acme-challenge.example.org.",
+		Type:   "TXT",
+		Value:  "token",
+		TTL:    120,
+	}
+	if len(reqs) != 1 || reqs[0] != want {
+		t.Errorf("Wrong requests: %+v", reqs)
+	}
+}
+
+// desecServer is a minimal implementation of deSEC RRset API.
+type desecServer struct {
+	lock   sync.Mutex
+	rrsets map[string]desecRRset
+}
+
+func (s *desecServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r.Header.Get("Authorization") != "Token secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/domains/example.org/rrsets/")
+
+	switch r.Method {
+	case http.MethodGet:
+		rrset, ok := s.rrsets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(rrset)
+	case http.MethodPost:
+		var rrset desecRRset
+		if err := json.NewDecoder(r.Body).Decode(&rrset); err != nil || rrset.TTL < desecMinTTL {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.rrsets[rrset.Subname+"/"+rrset.Type+"/"] = rrset
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPatch:
+		rrset, ok := s.rrsets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var patch desecRRset
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(patch.Records) == 0 {
+			delete(s.rrsets, path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		rrset.Records = patch.Records
+		s.rrsets[path] = rrset
+	}
+}
+
+func TestDesecProvider(t *testing.T) {
+	api := &desecServer{rrsets: map[string]desecRRset{}}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	p := &desecProvider{token: "secret", apiURL: srv.URL}
+	ctx := context.Background()
+
+	wildcard := testRecord
+	wildcard.Value = "token2"
+	if _, err := p.AppendRecords(ctx, "example.org.", []libdns.Record{testRecord, wildcard}); err != nil {
+		t.Fatal(err)
+	}
+	rrset := api.rrsets["_acme-challenge/TXT/"]
+	if rrset.TTL != desecMinTTL || len(rrset.Records) != 2 || rrset.Records[0] != `"token"` || rrset.Records[1] != `"token2"` {
+		t.Fatalf("Wrong RRset: %+v", rrset)
+	}
+
+	if _, err := p.DeleteRecords(ctx, "example.org.", []libdns.Record{testRecord}); err != nil {
+		t.Fatal(err)
+	}
+	if rrset := api.rrsets["_acme-challenge/TXT/"]; len(rrset.Records) != 1 || rrset.Records[0] != `"token2"` {
+		t.Fatalf("Wrong RRset: %+v", rrset)
+	}
+	if _, err := p.DeleteRecords(ctx, "example.org.", []libdns.Record{wildcard}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.rrsets["_acme-challenge/TXT/"]; ok {
+		t.Fatal("RRset is not removed")
+	}
+}
@@ -1,5 +1,5 @@
-//go:build libdns_route53 || libdns_all
-// +build libdns_route53 libdns_all
+//go:build libdns_route53 || !libdns_separate
+// +build libdns_route53 !libdns_separate
 
 package libdns
 
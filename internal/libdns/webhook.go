@@ -0,0 +1,117 @@
+//go:build libdns_webhook || !libdns_separate
+// +build libdns_webhook !libdns_separate
+
+package libdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/libdns/libdns"
+)
+
+// webhookProvider sends records to an external HTTP service that manages
+// them.
+type webhookProvider struct {
+	url     string
+	headers http.Header
+	client  http.Client
+}
+
+type webhookRequest struct {
+	Action string `json:"action"`
+	Zone   string `json:"zone"`
+	Name   string `json:"name"`
+	FQDN   string `json:"fqdn"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl"`
+}
+
+func (p *webhookProvider) send(ctx context.Context, action, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	for _, rec := range recs {
+		fqdn := libdns.AbsoluteName(rec.Name, zone)
+		if !strings.HasSuffix(fqdn, ".") {
+			fqdn += "."
+		}
+		reqBody, err := json.Marshal(webhookRequest{
+			Action: action,
+			Zone:   strings.TrimSuffix(zone, "."),
+			Name:   rec.Name,
+			FQDN:   fqdn,
+			Type:   rec.Type,
+			Value:  rec.Value,
+			TTL:    int(rec.TTL.Seconds()),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range p.headers {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("libdns.webhook: %w", err)
+		}
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("libdns.webhook: %s %s failed: %s: %s", action, fqdn, resp.Status, strings.TrimSpace(string(respBody)))
+		}
+	}
+	return recs, nil
+}
+
+func (p *webhookProvider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.send(ctx, "present", zone, recs)
+}
+
+func (p *webhookProvider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return p.send(ctx, "cleanup", zone, recs)
+}
+
+func init() {
+	module.Register("libdns.webhook", func(modName, instName string, _, _ []string) (module.Module, error) {
+		p := webhookProvider{headers: http.Header{}}
+		return &ProviderModule{
+			RecordDeleter:  &p,
+			RecordAppender: &p,
+			setConfig: func(c *config.Map) {
+				c.String("url", false, true, "", &p.url)
+				c.Callback("header", func(_ *config.Map, node config.Node) error {
+					if len(node.Args) != 2 {
+						return config.NodeErr(node, "expected two arguments: name and value")
+					}
+					p.headers.Add(node.Args[0], node.Args[1])
+					return nil
+				})
+				c.Duration("timeout", false, false, time.Minute, &p.client.Timeout)
+			},
+			afterConfig: func() error {
+				u, err := url.Parse(p.url)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					return fmt.Errorf("libdns.webhook: invalid url: %s", p.url)
+				}
+				return nil
+			},
+			instName: instName,
+			modName:  modName,
+		}, nil
+	})
+}
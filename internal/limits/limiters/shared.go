@@ -0,0 +1,60 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limiters
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+var ErrRateExceeded = errors.New("limiters: rate limit exceeded")
+
+// SharedRate implements a fixed-window rate limiter that keeps counters in
+// module.SharedState, allowing multiple server instances to enforce the same
+// limit.
+//
+// Unlike Rate, it does not block if the limit is exceeded,
+// ErrRateExceeded is returned instead. There is also no Release since
+// window counters simply expire.
+type SharedRate struct {
+	Store  module.SharedState
+	Prefix string
+	Burst  int
+	Period time.Duration
+}
+
+func (r SharedRate) TakeContext(ctx context.Context, key string) error {
+	if r.Burst == 0 {
+		return nil
+	}
+
+	window := time.Now().UnixNano() / int64(r.Period)
+	count, err := r.Store.Incr(ctx, r.Prefix+key+":"+strconv.FormatInt(window, 10), r.Period)
+	if err != nil {
+		return err
+	}
+	if count > int64(r.Burst) {
+		return ErrRateExceeded
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limiters
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeState struct {
+	counters map[string]int64
+	err      error
+}
+
+func (s *fakeState) Incr(_ context.Context, key string, _ time.Duration) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.counters[key]++
+	return s.counters[key], nil
+}
+
+func (s *fakeState) Get(context.Context, string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (s *fakeState) Set(context.Context, string, string, time.Duration) error {
+	return nil
+}
+
+func (s *fakeState) Del(context.Context, string) error {
+	return nil
+}
+
+func TestSharedRate(t *testing.T) {
+	store := &fakeState{counters: map[string]int64{}}
+	r := SharedRate{Store: store, Prefix: "test:", Burst: 2, Period: time.Hour}
+
+	for i := 0; i < 2; i++ {
+		if err := r.TakeContext(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.TakeContext(context.Background(), "a"); !errors.Is(err, ErrRateExceeded) {
+		t.Fatal("Limit is not enforced:", err)
+	}
+	if err := r.TakeContext(context.Background(), "b"); err != nil {
+		t.Fatal("Keys are not independent:", err)
+	}
+
+	store.err = errors.New("connection refused")
+	if err := r.TakeContext(context.Background(), "c"); err == nil || errors.Is(err, ErrRateExceeded) {
+		t.Fatal("Store error is not returned:", err)
+	}
+}
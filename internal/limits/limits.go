@@ -28,27 +28,40 @@ package limits
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits/limiters"
 )
 
 type Group struct {
 	instName string
+	log      log.Logger
+
+	// Rate limits kept in the shared state store, indexed by scope.
+	state  module.SharedState
+	shared map[string][]limiters.SharedRate
 
 	global limiters.MultiLimit
 	ip     *limiters.BucketSet // BucketSet of MultiLimit
 	source *limiters.BucketSet // BucketSet of MultiLimit
 	dest   *limiters.BucketSet // BucketSet of MultiLimit
+	user   *limiters.BucketSet // BucketSet of MultiLimit
 }
 
 func New(_, instName string, _, _ []string) (module.Module, error) {
 	return &Group{
 		instName: instName,
+		log:      log.Logger{Name: "limits", Debug: log.DefaultLogger.Debug},
+		shared:   map[string][]limiters.SharedRate{},
 	}, nil
 }
 
@@ -58,9 +71,22 @@ func (g *Group) Init(cfg *config.Map) error {
 		ipL     []func() limiters.L
 		sourceL []func() limiters.L
 		destL   []func() limiters.L
+		userL   []func() limiters.L
 	)
 
 	for _, child := range cfg.Block.Children {
+		if child.Name != "state" {
+			continue
+		}
+		if err := modconfig.ModuleFromNode("state", child.Args, child, cfg.Globals, &g.state); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range cfg.Block.Children {
+		if child.Name == "state" {
+			continue
+		}
 		if len(child.Args) < 1 {
 			return config.NodeErr(child, "at least two arguments are required")
 		}
@@ -71,6 +97,12 @@ func (g *Group) Init(cfg *config.Map) error {
 		)
 		switch kind := child.Args[0]; kind {
 		case "rate":
+			if g.state != nil {
+				if err := g.addSharedRate(child); err != nil {
+					return err
+				}
+				continue
+			}
 			ctor, err = rateCtor(child, child.Args[1:])
 		case "concurrency":
 			ctor, err = concurrencyCtor(child, child.Args[1:])
@@ -90,6 +122,8 @@ func (g *Group) Init(cfg *config.Map) error {
 			sourceL = append(sourceL, ctor)
 		case "destination":
 			destL = append(destL, ctor)
+		case "user":
+			userL = append(userL, ctor)
 		default:
 			return config.NodeErr(child, "unknown limit scope: %v", scope)
 		}
@@ -118,8 +152,18 @@ func (g *Group) Init(cfg *config.Map) error {
 	}
 	if len(destL) != 0 {
 		g.dest = limiters.NewBucketSet(func() limiters.L {
-			l := make([]limiters.L, 0, len(sourceL))
-			for _, ctor := range sourceL {
+			l := make([]limiters.L, 0, len(destL))
+			for _, ctor := range destL {
+				l = append(l, ctor())
+			}
+			return &limiters.MultiLimit{Wrapped: l}
+		}, 1*time.Minute, 20010)
+	}
+
+	if len(userL) != 0 {
+		g.user = limiters.NewBucketSet(func() limiters.L {
+			l := make([]limiters.L, 0, len(userL))
+			for _, ctor := range userL {
 				l = append(l, ctor())
 			}
 			return &limiters.MultiLimit{Wrapped: l}
@@ -129,7 +173,46 @@ func (g *Group) Init(cfg *config.Map) error {
 	return nil
 }
 
-func rateCtor(node config.Node, args []string) (func() limiters.L, error) {
+// addSharedRate adds the rate limit that is enforced using the shared state
+// store.
+func (g *Group) addSharedRate(node config.Node) error {
+	burst, period, err := parseRate(node, node.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch node.Name {
+	case "all", "ip", "source", "destination", "user":
+	default:
+		return config.NodeErr(node, "unknown limit scope: %v", node.Name)
+	}
+
+	g.shared[node.Name] = append(g.shared[node.Name], limiters.SharedRate{
+		Store:  g.state,
+		Prefix: fmt.Sprintf("limits:%s:%s:%d/%v:", g.instName, node.Name, burst, period),
+		Burst:  burst,
+		Period: period,
+	})
+	return nil
+}
+
+// takeShared checks shared rate limits for the scope.
+//
+// Errors from the state store are logged and otherwise ignored to not stop
+// the message flow if the store is not available.
+func (g *Group) takeShared(ctx context.Context, scope, key string) error {
+	for _, r := range g.shared[scope] {
+		if err := r.TakeContext(ctx, key); err != nil {
+			if errors.Is(err, limiters.ErrRateExceeded) {
+				return err
+			}
+			g.log.Error("shared state error, limit is not enforced", err, "scope", scope)
+		}
+	}
+	return nil
+}
+
+func parseRate(node config.Node, args []string) (int, time.Duration, error) {
 	period := 1 * time.Second
 	burst := 0
 
@@ -138,19 +221,28 @@ func rateCtor(node config.Node, args []string) (func() limiters.L, error) {
 		var err error
 		period, err = time.ParseDuration(args[1])
 		if err != nil {
-			return nil, config.NodeErr(node, "%v", err)
+			return 0, 0, config.NodeErr(node, "%v", err)
 		}
 		fallthrough
 	case 1:
 		var err error
 		burst, err = strconv.Atoi(args[0])
 		if err != nil {
-			return nil, config.NodeErr(node, "%v", err)
+			return 0, 0, config.NodeErr(node, "%v", err)
 		}
 	case 0:
-		return nil, config.NodeErr(node, "at least burst size is needed")
+		return 0, 0, config.NodeErr(node, "at least burst size is needed")
 	default:
-		return nil, config.NodeErr(node, "too many arguments")
+		return 0, 0, config.NodeErr(node, "too many arguments")
+	}
+
+	return burst, period, nil
+}
+
+func rateCtor(node config.Node, args []string) (func() limiters.L, error) {
+	burst, period, err := parseRate(node, args)
+	if err != nil {
+		return nil, err
 	}
 
 	return func() limiters.L {
@@ -171,10 +263,61 @@ func concurrencyCtor(node config.Node, args []string) (func() limiters.L, error)
 	}, nil
 }
 
+// ParseSpec parses the comma-separated list of limits in the same format as
+// used in the configuration block, but without the scope, e.g.
+// "concurrency 2, rate 30 1m".
+//
+// Returned function creates a new set of limiters each time it is called.
+func ParseSpec(spec string) (func() limiters.L, error) {
+	var ctors []func() limiters.L
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+
+		node := config.Node{Name: fields[0], Args: fields[1:]}
+		var (
+			ctor func() limiters.L
+			err  error
+		)
+		switch kind := fields[0]; kind {
+		case "rate":
+			ctor, err = rateCtor(node, fields[1:])
+		case "concurrency":
+			ctor, err = concurrencyCtor(node, fields[1:])
+		default:
+			return nil, fmt.Errorf("limits: unknown limit kind: %v", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("limits: %s: %w", strings.TrimSpace(part), err)
+		}
+		ctors = append(ctors, ctor)
+	}
+
+	return func() limiters.L {
+		l := make([]limiters.L, 0, len(ctors))
+		for _, ctor := range ctors {
+			l = append(l, ctor())
+		}
+		return &limiters.MultiLimit{Wrapped: l}
+	}, nil
+}
+
 func (g *Group) TakeMsg(ctx context.Context, addr net.IP, sourceDomain string) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	if err := g.takeShared(ctx, "all", ""); err != nil {
+		return err
+	}
+	if err := g.takeShared(ctx, "ip", addr.String()); err != nil {
+		return err
+	}
+	if err := g.takeShared(ctx, "source", sourceDomain); err != nil {
+		return err
+	}
+
 	if err := g.global.TakeContext(ctx); err != nil {
 		return err
 	}
@@ -196,11 +339,15 @@ func (g *Group) TakeMsg(ctx context.Context, addr net.IP, sourceDomain string) e
 }
 
 func (g *Group) TakeDest(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := g.takeShared(ctx, "destination", domain); err != nil {
+		return err
+	}
 	if g.dest == nil {
 		return nil
 	}
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
 	return g.dest.TakeContext(ctx, domain)
 }
 
@@ -221,6 +368,57 @@ func (g *Group) ReleaseDest(domain string) {
 	g.dest.Release(domain)
 }
 
+// TakeAuth acquires the limits for a single authentication attempt made from
+// the specified IP address using the specified username.
+//
+// "source" and "destination" scopes are not used for authentication attempts,
+// the "user" scope is used instead.
+func (g *Group) TakeAuth(ctx context.Context, addr net.IP, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := g.takeShared(ctx, "all", ""); err != nil {
+		return err
+	}
+	if err := g.takeShared(ctx, "ip", addr.String()); err != nil {
+		return err
+	}
+	if err := g.takeShared(ctx, "user", username); err != nil {
+		return err
+	}
+
+	if err := g.global.TakeContext(ctx); err != nil {
+		return err
+	}
+
+	if g.ip != nil {
+		if err := g.ip.TakeContext(ctx, addr.String()); err != nil {
+			g.global.Release()
+			return err
+		}
+	}
+	if g.user != nil {
+		if err := g.user.TakeContext(ctx, username); err != nil {
+			g.global.Release()
+			if g.ip != nil {
+				g.ip.Release(addr.String())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Group) ReleaseAuth(addr net.IP, username string) {
+	g.global.Release()
+	if g.ip != nil {
+		g.ip.Release(addr.String())
+	}
+	if g.user != nil {
+		g.user.Release(username)
+	}
+}
+
 func (g *Group) Name() string {
 	return "limits"
 }
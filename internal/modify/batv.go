@@ -0,0 +1,256 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	batvPrefix    = "prvs="
+	batvKeyNum    = "0"
+	batvDaySlots  = 1000 // 3 decimal digits
+	batvTagLen    = 10   // K DDD SSSSSS
+	batvHashBytes = 3
+)
+
+var errInvalidBATV = &exterrors.SMTPError{
+	Code:         550,
+	EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+	Message:      "Invalid or expired bounce address tag",
+	TargetName:   "modify.batv",
+	Reason:       "invalid BATV tag",
+}
+
+var errUnsignedBounce = &exterrors.SMTPError{
+	Code:         550,
+	EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+	Message:      "Bounce is not addressed to a signed return path, probably backscatter",
+	TargetName:   "modify.batv",
+	Reason:       "unsigned bounce recipient",
+}
+
+// batv implements Bounce Address Tag Validation.
+//
+// If created with modName = "modify.batv", it signs the envelope sender
+// of outgoing messages using the prvs= scheme.
+// If created with modName = "modify.batv_reverse", it verifies and strips
+// tags from recipient addresses and rejects bounces (messages with the null
+// sender) sent to addresses without a valid tag.
+type batv struct {
+	modName  string
+	instName string
+
+	domains        map[string]struct{}
+	secrets        [][]byte
+	maxAge         int
+	rejectUnsigned bool
+
+	reverse bool
+	now     func() time.Time
+}
+
+type batvState struct {
+	m        *batv
+	isBounce bool
+}
+
+func NewBATV(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("modify.batv: inline arguments are not used")
+	}
+	return &batv{
+		modName:  modName,
+		instName: instName,
+		reverse:  modName == "modify.batv_reverse",
+		now:      time.Now,
+	}, nil
+}
+
+func (b *batv) Init(cfg *config.Map) error {
+	var (
+		domains []string
+		secrets []string
+	)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.StringList("secrets", false, true, nil, &secrets)
+	cfg.Int("max_age", false, false, 7, &b.maxAge)
+	cfg.Bool("reject_unsigned", false, true, &b.rejectUnsigned)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	b.domains = make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		dom, err := dns.ForLookup(d)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid domain %s: %v", d, err)
+		}
+		b.domains[dom] = struct{}{}
+	}
+	for _, secret := range secrets {
+		b.secrets = append(b.secrets, []byte(secret))
+	}
+	if b.maxAge <= 0 || b.maxAge >= batvDaySlots {
+		return config.NodeErr(cfg.Block, "max_age should be between 1 and %d days", batvDaySlots-1)
+	}
+	return nil
+}
+
+func (b *batv) Name() string {
+	return b.modName
+}
+
+func (b *batv) InstanceName() string {
+	return b.instName
+}
+
+func (b *batv) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &batvState{m: b}, nil
+}
+
+func (b *batv) ourDomain(domain string) bool {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return false
+	}
+	_, ok := b.domains[normDomain]
+	return ok
+}
+
+func (s *batvState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if s.m.reverse {
+		s.isBounce = mailFrom == ""
+		return mailFrom, nil
+	}
+	if mailFrom == "" {
+		return mailFrom, nil
+	}
+
+	local, domain, err := address.Split(mailFrom)
+	if err != nil || domain == "" || hasPrefixFold(local, batvPrefix) {
+		return mailFrom, nil
+	}
+	if !s.m.ourDomain(domain) {
+		return mailFrom, nil
+	}
+
+	return batvPrefix + s.m.tag(local+"@"+domain) + "=" + local + "@" + domain, nil
+}
+
+func (s *batvState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if !s.m.reverse {
+		return []string{rcptTo}, nil
+	}
+
+	local, domain, err := address.Split(rcptTo)
+	if err != nil || domain == "" || !s.m.ourDomain(domain) {
+		return []string{rcptTo}, nil
+	}
+
+	if !hasPrefixFold(local, batvPrefix) {
+		if s.isBounce && s.m.rejectUnsigned {
+			return []string{rcptTo}, errUnsignedBounce
+		}
+		return []string{rcptTo}, nil
+	}
+
+	parts := strings.SplitN(local[len(batvPrefix):], "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return []string{rcptTo}, errInvalidBATV
+	}
+	original := parts[1] + "@" + domain
+
+	// Tag is checked only for bounces. Other messages sent to the tagged
+	// address (e.g. replies from broken autoresponders) are delivered to the
+	// original address.
+	if s.isBounce && !s.m.checkTag(parts[0], original) {
+		return []string{rcptTo}, errInvalidBATV
+	}
+	return []string{original}, nil
+}
+
+func (s *batvState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s *batvState) Close() error {
+	return nil
+}
+
+func (b *batv) day() int64 {
+	return (b.now().Unix() / int64(24*time.Hour/time.Second)) % batvDaySlots
+}
+
+func (b *batv) hash(secret []byte, keyDay, addr string) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write([]byte(keyDay))
+	mac.Write([]byte(strings.ToLower(addr)))
+	return hex.EncodeToString(mac.Sum(nil)[:batvHashBytes])
+}
+
+// tag returns the BATV tag (K DDD SSSSSS) for the address.
+func (b *batv) tag(addr string) string {
+	expiry := (b.day() + int64(b.maxAge)) % batvDaySlots
+	keyDay := batvKeyNum + strconv.FormatInt(expiry+batvDaySlots, 10)[1:]
+	return keyDay + b.hash(b.secrets[0], keyDay, addr)
+}
+
+func (b *batv) checkTag(tag, addr string) bool {
+	if len(tag) != batvTagLen {
+		return false
+	}
+	keyDay, hash := tag[:4], tag[4:]
+
+	expiry, err := strconv.ParseInt(keyDay[1:], 10, 64)
+	if err != nil {
+		return false
+	}
+	left := (expiry - b.day() + batvDaySlots) % batvDaySlots
+	if left > int64(b.maxAge) {
+		return false
+	}
+
+	for _, secret := range b.secrets {
+		if strings.EqualFold(hash, b.hash(secret, keyDay, addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	module.Register("modify.batv", NewBATV)
+	module.Register("modify.batv_reverse", NewBATV)
+}
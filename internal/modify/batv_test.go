@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testBATV(t *testing.T, modName string, now time.Time, secrets ...string) *batv {
+	t.Helper()
+
+	mod, err := NewBATV(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := mod.(*batv)
+	err = b.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"example.org"}},
+			{Name: "secrets", Args: secrets},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.now = func() time.Time { return now }
+	return b
+}
+
+func batvRewrite(t *testing.T, b *batv, mailFrom, rcptTo string) (string, []string, error) {
+	t.Helper()
+
+	state, err := b.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	sender, err := state.RewriteSender(context.Background(), mailFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpts, err := state.RewriteRcpt(context.Background(), rcptTo)
+	return sender, rcpts, err
+}
+
+func TestBATV_RoundTrip(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	sign := testBATV(t, "modify.batv", now, "secret")
+	verify := testBATV(t, "modify.batv_reverse", now, "new secret", "secret")
+
+	signed, _, err := batvRewrite(t, sign, "User@example.org", "rcpt@remote.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPrefixFold(signed, "prvs=") {
+		t.Fatal("Not a BATV address:", signed)
+	}
+
+	// Foreign and null senders are not signed.
+	for _, from := range []string{"user@remote.example", ""} {
+		sender, _, err := batvRewrite(t, sign, from, "rcpt@remote.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sender != from {
+			t.Errorf("Sender %q rewritten to %q", from, sender)
+		}
+	}
+
+	_, rcpts, err := batvRewrite(t, verify, "", signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rcpts) != 1 || rcpts[0] != "User@example.org" {
+		t.Error("Wrong decoded address:", rcpts)
+	}
+
+	// Expired.
+	verify.now = func() time.Time { return now.Add(8 * 24 * time.Hour) }
+	if _, _, err := batvRewrite(t, verify, "", signed); err == nil {
+		t.Error("Expected expired tag to be rejected")
+	}
+}
+
+func TestBATV_Reverse(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	verify := testBATV(t, "modify.batv_reverse", now, "secret")
+
+	// Unsigned bounce.
+	if _, _, err := batvRewrite(t, verify, "", "user@example.org"); err == nil {
+		t.Error("Expected unsigned bounce to be rejected")
+	}
+	// Forged tag.
+	if _, _, err := batvRewrite(t, verify, "", "prvs=0123abcdef=user@example.org"); err == nil {
+		t.Error("Expected forged tag to be rejected")
+	}
+
+	// Regular messages are not affected, tags are stripped without checking.
+	_, rcpts, err := batvRewrite(t, verify, "sender@remote.example", "user@example.org")
+	if err != nil || rcpts[0] != "user@example.org" {
+		t.Error("Unexpected result for unsigned regular message:", rcpts, err)
+	}
+	_, rcpts, err = batvRewrite(t, verify, "sender@remote.example", "prvs=0123abcdef=user@example.org")
+	if err != nil || rcpts[0] != "user@example.org" {
+		t.Error("Unexpected result for tagged regular message:", rcpts, err)
+	}
+
+	// Other domains are not affected.
+	_, rcpts, err = batvRewrite(t, verify, "", "user@other.example")
+	if err != nil || rcpts[0] != "user@other.example" {
+		t.Error("Unexpected result for other domain:", rcpts, err)
+	}
+}
@@ -0,0 +1,424 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Max. nesting of multipart entities that is processed.
+const disclaimerMaxDepth = 10
+
+// disclaimer appends the footer to text parts of messages.
+//
+// Only the main body of the message is changed: the first part of
+// multipart/mixed and multipart/related and all alternatives of
+// multipart/alternative. Signed and encrypted parts are never changed since
+// that would break signatures.
+type disclaimer struct {
+	instName string
+
+	senders []string
+	text    string
+	html    string
+
+	log log.Logger
+}
+
+func NewDisclaimer(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.disclaimer: inline arguments are not used")
+	}
+	return &disclaimer{
+		instName: instName,
+		log:      log.Logger{Name: "modify.disclaimer"},
+	}, nil
+}
+
+func (m *disclaimer) Init(cfg *config.Map) error {
+	var (
+		senders            []string
+		textFile, htmlFile string
+	)
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.StringList("sender", false, false, nil, &senders)
+	cfg.String("text", false, false, "", &m.text)
+	cfg.String("text_file", false, false, "", &textFile)
+	cfg.String("html", false, false, "", &m.html)
+	cfg.String("html_file", false, false, "", &htmlFile)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if textFile != "" {
+		text, err := os.ReadFile(textFile)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "%v", err)
+		}
+		m.text = string(text)
+	}
+	if htmlFile != "" {
+		text, err := os.ReadFile(htmlFile)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "%v", err)
+		}
+		m.html = string(text)
+	}
+	m.text = strings.TrimSpace(m.text)
+	m.html = strings.TrimSpace(m.html)
+	if m.text == "" {
+		return config.NodeErr(cfg.Block, "text or text_file is required")
+	}
+	if m.html == "" {
+		m.html = "<p>" + strings.ReplaceAll(html.EscapeString(m.text), "\n", "<br>\n") + "</p>"
+	}
+	m.text = toCRLF(m.text)
+	m.html = toCRLF(m.html)
+
+	var err error
+	m.senders, err = normalizeAddrList(senders)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "invalid sender: %v", err)
+	}
+	return nil
+}
+
+func toCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+func isASCII(s []byte) bool {
+	for _, b := range s {
+		if b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// addFooter adds the footer to the entity if it is a text part or to the
+// main body parts if it is a multipart entity. The header is updated if
+// needed. The false value is returned if the entity is not changed.
+func (m *disclaimer) addFooter(h *textproto.Header, body []byte, depth int) ([]byte, bool, error) {
+	if depth > disclaimerMaxDepth {
+		return nil, false, nil
+	}
+
+	mediaType := "text/plain"
+	params := map[string]string{}
+	if ct := h.Get("Content-Type"); ct != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, false, nil
+		}
+	}
+	if disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && disp == "attachment" {
+		return nil, false, nil
+	}
+
+	switch mediaType {
+	case "text/plain", "text/html":
+		return m.addFooterText(h, body, mediaType, params)
+	case "multipart/mixed", "multipart/related":
+		return m.addFooterMultipart(body, params["boundary"], false, depth)
+	case "multipart/alternative":
+		return m.addFooterMultipart(body, params["boundary"], true, depth)
+	default:
+		// multipart/signed, multipart/encrypted, application/pkcs7-mime,
+		// multipart/report, etc.
+		return nil, false, nil
+	}
+}
+
+// addFooterMultipart adds the footer to the first part or to all parts if
+// all is true. Other parts are copied as is.
+func (m *disclaimer) addFooterMultipart(body []byte, boundary string, all bool, depth int) ([]byte, bool, error) {
+	if boundary == "" {
+		return nil, false, nil
+	}
+
+	var res bytes.Buffer
+	mw := textproto.NewMultipartWriter(&res)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, false, nil
+	}
+
+	changed := false
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), boundary)
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		partBody, err := io.ReadAll(part)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if all || i == 0 {
+			newBody, ok, err := m.addFooter(&part.Header, partBody, depth+1)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				partBody = newBody
+				changed = true
+			}
+		}
+
+		w, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := w.Write(partBody); err != nil {
+			return nil, false, err
+		}
+	}
+	if !changed {
+		return nil, false, nil
+	}
+	if err := mw.Close(); err != nil {
+		return nil, false, err
+	}
+	return res.Bytes(), true, nil
+}
+
+func (m *disclaimer) addFooterText(h *textproto.Header, body []byte, mediaType string, params map[string]string) ([]byte, bool, error) {
+	footer := m.text
+	if mediaType == "text/html" {
+		footer = m.html
+	}
+
+	charset := strings.ToLower(params["charset"])
+	switch charset {
+	case "", "us-ascii", "utf-8":
+	default:
+		// Footer would need to be converted to the part charset.
+		if !isASCII([]byte(footer)) {
+			return nil, false, nil
+		}
+	}
+
+	cte := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+	var text []byte
+	switch cte {
+	case "", "7bit", "8bit", "binary":
+		text = body
+	case "quoted-printable":
+		var err error
+		text, err = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err != nil {
+			return nil, false, nil
+		}
+	case "base64":
+		var err error
+		text, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body)))
+		if err != nil {
+			return nil, false, nil
+		}
+	default:
+		return nil, false, nil
+	}
+
+	// Inline PGP.
+	if bytes.Contains(text, []byte("-----BEGIN PGP ")) {
+		return nil, false, nil
+	}
+
+	if charset == "us-ascii" && !isASCII([]byte(footer)) {
+		params["charset"] = "utf-8"
+		h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+
+	var newText []byte
+	if mediaType == "text/html" {
+		newText = insertHTMLFooter(text, footer)
+	} else {
+		newText = append(newText, bytes.TrimRight(text, "\r\n")...)
+		newText = append(newText, "\r\n\r\n"...)
+		newText = append(newText, footer...)
+		newText = append(newText, "\r\n"...)
+	}
+
+	newBody, newCTE, err := encodeText(newText, cte)
+	if err != nil {
+		return nil, false, err
+	}
+	if newCTE != cte {
+		h.Set("Content-Transfer-Encoding", newCTE)
+	}
+	return newBody, true, nil
+}
+
+// insertHTMLFooter inserts the footer before the closing body tag or at the
+// end if there is no such tag.
+func insertHTMLFooter(text []byte, footer string) []byte {
+	idx := bytes.LastIndex(bytes.ToLower(text), []byte("</body>"))
+	if idx == -1 {
+		idx = len(text)
+	}
+	res := make([]byte, 0, len(text)+len(footer)+2)
+	res = append(res, text[:idx]...)
+	res = append(res, footer...)
+	res = append(res, "\r\n"...)
+	res = append(res, text[idx:]...)
+	return res
+}
+
+// encodeText encodes the text using the original transfer encoding if
+// possible. Quoted-printable is used if the text is not valid for the
+// original encoding anymore.
+func encodeText(text []byte, cte string) ([]byte, string, error) {
+	switch cte {
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(text)
+		var res bytes.Buffer
+		for len(encoded) > 76 {
+			res.WriteString(encoded[:76])
+			res.WriteString("\r\n")
+			encoded = encoded[76:]
+		}
+		res.WriteString(encoded)
+		res.WriteString("\r\n")
+		return res.Bytes(), cte, nil
+	case "", "7bit", "8bit", "binary":
+		if (cte == "8bit" || cte == "binary" || isASCII(text)) && !hasLongLines(text) {
+			return text, cte, nil
+		}
+	}
+
+	var res bytes.Buffer
+	qpw := quotedprintable.NewWriter(&res)
+	if _, err := qpw.Write(text); err != nil {
+		return nil, "", err
+	}
+	if err := qpw.Close(); err != nil {
+		return nil, "", err
+	}
+	return res.Bytes(), "quoted-printable", nil
+}
+
+// hasLongLines reports whether the text has lines longer than allowed by RFC
+// 5322.
+func hasLongLines(text []byte) bool {
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		if len(line) > 998 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *disclaimer) Name() string {
+	return "modify.disclaimer"
+}
+
+func (m *disclaimer) InstanceName() string {
+	return m.instName
+}
+
+type disclaimerState struct {
+	m        *disclaimer
+	mailFrom string
+	log      log.Logger
+}
+
+func (m *disclaimer) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &disclaimerState{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *disclaimerState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	s.mailFrom = mailFrom
+	return mailFrom, nil
+}
+
+func (s *disclaimerState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *disclaimerState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	// Not called since ModifyBody is implemented.
+	return nil
+}
+
+func (s *disclaimerState) ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, "modify.disclaimer/ModifyBody").End()
+
+	if len(s.m.senders) != 0 && !matchAddr(s.m.senders, s.mailFrom) {
+		return body, nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	newHdr := h.Copy()
+	newBlob, ok, err := s.m.addFooter(&newHdr, blob, 0)
+	if err != nil {
+		// Malformed MIME structure, leave it as is.
+		s.log.Error("unable to add footer", err)
+		return body, nil
+	}
+	if !ok {
+		s.log.DebugMsg("no suitable parts for footer")
+		return body, nil
+	}
+
+	*h = newHdr
+	s.log.DebugMsg("footer added")
+	return buffer.MemoryBuffer{Slice: newBlob}, nil
+}
+
+func (s *disclaimerState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.disclaimer", NewDisclaimer)
+}
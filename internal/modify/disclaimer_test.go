@@ -0,0 +1,217 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testDisclaimer(t *testing.T, cfg []config.Node, mailFrom, msg string) (textproto.Header, string) {
+	t.Helper()
+
+	mod, err := NewDisclaimer("modify.disclaimer", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*disclaimer)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(strings.NewReader(strings.ReplaceAll(msg, "\n", "\r\n")))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	if _, err := state.RewriteSender(context.Background(), mailFrom); err != nil {
+		t.Fatal(err)
+	}
+	body, err := module.RewriteBody(context.Background(), state, &hdr, buffer.MemoryBuffer{Slice: blob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := body.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBlob, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, string(newBlob)
+}
+
+// decodedTexts returns decoded contents of all text parts.
+func decodedTexts(t *testing.T, hdr textproto.Header, body string) []string {
+	t.Helper()
+
+	ent, err := message.New(message.Header{Header: hdr}, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	err = ent.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		if !strings.HasPrefix(mediaType, "text/") {
+			return nil
+		}
+		text, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		res = append(res, string(text))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+var disclaimerCfg = []config.Node{
+	{Name: "sender", Args: []string{"example.org"}},
+	{Name: "text", Args: []string{"Confidential – do not forward."}},
+}
+
+func TestDisclaimer_Plain(t *testing.T) {
+	hdr, body := testDisclaimer(t, disclaimerCfg, "user@example.org", `From: <user@example.org>
+Content-Type: text/plain; charset=us-ascii
+
+Hello!
+`)
+	if cte := hdr.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Errorf("wrong Content-Transfer-Encoding: %q", cte)
+	}
+	if ct := hdr.Get("Content-Type"); !strings.Contains(ct, "utf-8") {
+		t.Errorf("charset is not changed: %q", ct)
+	}
+	texts := decodedTexts(t, hdr, body)
+	if len(texts) != 1 || texts[0] != "Hello!\r\n\r\nConfidential – do not forward.\r\n" {
+		t.Errorf("unexpected text: %q", texts)
+	}
+}
+
+func TestDisclaimer_Alternative(t *testing.T) {
+	hdr, body := testDisclaimer(t, disclaimerCfg, "user@example.org", `From: <user@example.org>
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: base64
+
+SGVsbG8h
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+<html><body><p>Hello!</p></body></html>
+--inner--
+--outer
+Content-Type: text/plain
+Content-Disposition: attachment; filename="notes.txt"
+
+Attached notes.
+--outer--
+`)
+	texts := decodedTexts(t, hdr, body)
+	if len(texts) != 3 {
+		t.Fatalf("unexpected parts: %q", texts)
+	}
+	if texts[0] != "Hello!\r\n\r\nConfidential – do not forward.\r\n" {
+		t.Errorf("unexpected plain text: %q", texts[0])
+	}
+	if texts[1] != "<html><body><p>Hello!</p><p>Confidential – do not forward.</p>\r\n</body></html>" {
+		t.Errorf("unexpected HTML: %q", texts[1])
+	}
+	if texts[2] != "Attached notes." {
+		t.Errorf("attachment is changed: %q", texts[2])
+	}
+}
+
+func TestDisclaimer_Skip(t *testing.T) {
+	signed := `From: <user@example.org>
+Content-Type: multipart/signed; boundary=b; protocol="application/pgp-signature"
+
+--b
+Content-Type: text/plain
+
+Hello!
+--b
+Content-Type: application/pgp-signature
+
+signature
+--b--
+`
+	for _, test := range []struct {
+		name     string
+		mailFrom string
+		msg      string
+	}{
+		{"signed", "user@example.org", signed},
+		{"other sender", "user@example.com", "Content-Type: text/plain\n\nHello!\n"},
+		{"inline PGP", "user@example.org", "Content-Type: text/plain\n\n-----BEGIN PGP MESSAGE-----\n...\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, body := testDisclaimer(t, disclaimerCfg, test.mailFrom, test.msg)
+			msgBody := test.msg[strings.Index(test.msg, "\n\n")+2:]
+			if body != strings.ReplaceAll(msgBody, "\n", "\r\n") {
+				t.Errorf("message is changed: %q", body)
+			}
+		})
+	}
+}
+
+func TestDisclaimer_KeepEncoding(t *testing.T) {
+	hdr, body := testDisclaimer(t, []config.Node{
+		{Name: "text", Args: []string{"Footer"}},
+	}, "user@example.org", "Content-Type: text/plain\n\nHello!\n")
+	if hdr.Has("Content-Transfer-Encoding") {
+		t.Error("Content-Transfer-Encoding is set for ASCII text")
+	}
+	if !bytes.Equal([]byte(body), []byte("Hello!\r\n\r\nFooter\r\n")) {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
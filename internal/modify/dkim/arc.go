@@ -0,0 +1,489 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	arcAuthResults = "arc-authentication-results"
+	arcMsgSig      = "arc-message-signature"
+	arcSeal        = "arc-seal"
+
+	// RFC 8617, Section 4.2.1.
+	arcMaxInstance = 50
+)
+
+// Chain validation status values (cv= tag).
+const (
+	arcNone = "none"
+	arcPass = "pass"
+	arcFail = "fail"
+)
+
+// ARC implements the modify.arc module that adds a new ARC set (RFC 8617) to
+// messages. It is intended to be used for messages that are forwarded or
+// redistributed to external recipients so the destination can use the
+// authentication results of this server when the original DKIM signatures are
+// broken or SPF fails.
+type ARC struct {
+	instName string
+
+	domain     string
+	selector   string
+	signer     crypto.Signer
+	authServID string
+	resolver   dns.Resolver
+
+	log log.Logger
+}
+
+func NewARC(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &ARC{
+		instName: instName,
+		resolver: dns.DefaultResolver(),
+		log:      log.Logger{Name: "modify.arc"},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 2:
+		m.domain = inlineArgs[0]
+		m.selector = inlineArgs[1]
+	default:
+		return nil, errors.New("modify.arc: domain and selector are expected as inline arguments")
+	}
+
+	return m, nil
+}
+
+func (m *ARC) Name() string {
+	return "modify.arc"
+}
+
+func (m *ARC) InstanceName() string {
+	return m.instName
+}
+
+func (m *ARC) Init(cfg *config.Map) error {
+	var (
+		keyPathTemplate string
+		newKeyAlgo      string
+		hostname        string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("domain", false, false, m.domain, &m.domain)
+	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.Enum("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("authserv_id", false, false, "", &m.authServID)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.domain == "" {
+		return errors.New("modify.arc: domain is not specified")
+	}
+	if m.selector == "" {
+		return errors.New("modify.arc: selector is not specified")
+	}
+	if m.authServID == "" {
+		m.authServID = hostname
+	}
+	if m.authServID == "" {
+		return errors.New("modify.arc: authserv_id is not specified and hostname is not set")
+	}
+
+	domain, err := dns.ForLookup(m.domain)
+	if err != nil {
+		return fmt.Errorf("modify.arc: invalid domain %s: %w", m.domain, err)
+	}
+	m.domain = domain
+
+	keyValues := strings.NewReplacer("{domain}", m.domain, "{selector}", m.selector)
+	keyPath := keyValues.Replace(keyPathTemplate)
+
+	// Key management is shared with modify.dkim.
+	keys := Modifier{log: m.log}
+	m.signer, _, err = keys.loadOrGenerateKey(keyPath, newKeyAlgo)
+	if err != nil {
+		return err
+	}
+	if _, err := signAlgo(m.signer); err != nil {
+		return fmt.Errorf("modify.arc: %s: %w", keyPath, err)
+	}
+
+	return nil
+}
+
+// arcSet is a set of ARC fields with the same instance number.
+type arcSet struct {
+	aar, ams, as string
+	amsTags      map[string]string
+	asTags       map[string]string
+}
+
+// collectARCSets returns ARC sets present in the header ordered by the
+// instance number. Error is returned if the sets are malformed.
+func collectARCSets(fields []string) ([]*arcSet, error) {
+	sets := make(map[int]*arcSet)
+	getSet := func(value string) (*arcSet, map[string]string, error) {
+		first, _, _ := strings.Cut(value, ";")
+		tags, err := parseTags(value)
+		if err != nil {
+			// ARC-Authentication-Results is not a tag list, only the first
+			// element is.
+			tags, err = parseTags(first)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		i, err := strconv.Atoi(tags["i"])
+		if err != nil || i < 1 || i > arcMaxInstance {
+			return nil, nil, fmt.Errorf("invalid instance: %s", tags["i"])
+		}
+		set := sets[i]
+		if set == nil {
+			set = &arcSet{}
+			sets[i] = set
+		}
+		return set, tags, nil
+	}
+
+	for _, f := range fields {
+		var (
+			set  *arcSet
+			tags map[string]string
+			err  error
+		)
+		switch fieldKey(f) {
+		case arcAuthResults:
+			set, _, err = getSet(fieldValue(f))
+			if err == nil && set.aar != "" {
+				err = errors.New("duplicate ARC-Authentication-Results")
+			}
+			if err == nil {
+				set.aar = f
+			}
+		case arcMsgSig:
+			set, tags, err = getSet(fieldValue(f))
+			if err == nil && set.ams != "" {
+				err = errors.New("duplicate ARC-Message-Signature")
+			}
+			if err == nil {
+				set.ams, set.amsTags = f, tags
+			}
+		case arcSeal:
+			set, tags, err = getSet(fieldValue(f))
+			if err == nil && set.as != "" {
+				err = errors.New("duplicate ARC-Seal")
+			}
+			if err == nil {
+				set.as, set.asTags = f, tags
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]*arcSet, len(sets))
+	for i := 1; i <= len(sets); i++ {
+		set := sets[i]
+		if set == nil || set.aar == "" || set.ams == "" || set.as == "" {
+			return nil, fmt.Errorf("incomplete ARC set %d", i)
+		}
+		res[i-1] = set
+	}
+	return res, nil
+}
+
+func (m *ARC) lookupKey(ctx context.Context, domain, selector string) (crypto.PublicKey, error) {
+	txts, err := m.resolver.LookupTXT(ctx, dns.FQDN(selector+"._domainkey."+domain))
+	if err != nil {
+		return nil, err
+	}
+	if len(txts) == 0 {
+		return nil, errors.New("no key record")
+	}
+	return parseKeyRecord(txts[0])
+}
+
+// sealInput returns the hash of the ARC-Seal signing input for sets, the
+// last set is the one being signed or verified.
+func sealInput(sets []*arcSet) []byte {
+	fields := make([]string, 0, len(sets)*3)
+	for i, set := range sets {
+		fields = append(fields, set.aar, set.ams)
+		if i != len(sets)-1 {
+			fields = append(fields, set.as)
+		}
+	}
+	return signatureInput(fields, sets[len(sets)-1].as, "relaxed")
+}
+
+func (m *ARC) verifySeal(ctx context.Context, sets []*arcSet) error {
+	tags := sets[len(sets)-1].asTags
+	pubkey, err := m.lookupKey(ctx, tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+	return verifyDigest(pubkey, tags["a"], sealInput(sets), tags["b"])
+}
+
+func (m *ARC) verifyMsgSig(ctx context.Context, fields []string, set *arcSet, body []byte) error {
+	tags := set.amsTags
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	limit := -1
+	if l, ok := tags["l"]; ok {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			return fmt.Errorf("malformed l= tag: %s", l)
+		}
+	}
+
+	if got := bodyHash(body, bodyCanon, limit); tags["bh"] != base64.StdEncoding.EncodeToString(got) {
+		return errors.New("body hash mismatch")
+	}
+
+	pubkey, err := m.lookupKey(ctx, tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+	signed := selectFields(fields, strings.Split(tags["h"], ":"))
+	return verifyDigest(pubkey, tags["a"], signatureInput(signed, set.ams, headerCanon), tags["b"])
+}
+
+// validateChain implements the ARC chain validation algorithm (RFC 8617,
+// Section 5.2) and returns the chain validation status.
+func (m *ARC) validateChain(ctx context.Context, fields []string, sets []*arcSet, body []byte) (string, error) {
+	if len(sets) == 0 {
+		return arcNone, nil
+	}
+	last := sets[len(sets)-1]
+	if last.asTags["cv"] == arcFail {
+		return arcFail, errors.New("chain is already failed")
+	}
+	for i, set := range sets {
+		expected := arcPass
+		if i == 0 {
+			expected = arcNone
+		}
+		if set.asTags["cv"] != expected {
+			return arcFail, fmt.Errorf("unexpected cv=%s in set %d", set.asTags["cv"], i+1)
+		}
+	}
+	if err := m.verifyMsgSig(ctx, fields, last, body); err != nil {
+		return arcFail, fmt.Errorf("ARC-Message-Signature %d: %w", len(sets), err)
+	}
+	for i := len(sets); i > 0; i-- {
+		if err := m.verifySeal(ctx, sets[:i]); err != nil {
+			return arcFail, fmt.Errorf("ARC-Seal %d: %w", i, err)
+		}
+	}
+	return arcPass, nil
+}
+
+// authResults returns the Authentication-Results added by this server
+// without the authserv-id.
+func (m *ARC) authResults(fields []string) string {
+	for _, f := range fields {
+		if fieldKey(f) != "authentication-results" {
+			continue
+		}
+		value := fieldValue(f)
+		id, results, _ := strings.Cut(value, ";")
+		if fields := strings.Fields(id); len(fields) == 0 || !strings.EqualFold(fields[0], m.authServID) {
+			continue
+		}
+		return strings.TrimSpace(results)
+	}
+	return ""
+}
+
+func (m *ARC) signedFields(fields []string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range append(append([]string{}, oversignDefault...), signDefault...) {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for _, f := range fields {
+			if fieldKey(f) == name {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, f := range fields {
+		if fieldKey(f) == "dkim-signature" {
+			names = append(names, "dkim-signature")
+		}
+	}
+	return names
+}
+
+// seal creates the new ARC set for the message.
+func (m *ARC) seal(ctx context.Context, h *textproto.Header, body []byte) (string, error) {
+	fields, err := rawFields(*h)
+	if err != nil {
+		return "", err
+	}
+
+	sets, err := collectARCSets(fields)
+	var cv string
+	if err != nil {
+		m.log.Msg("malformed ARC sets, chain is considered failed", "reason", err.Error())
+		cv = arcFail
+	} else {
+		cv, err = m.validateChain(ctx, fields, sets, body)
+		if err != nil {
+			m.log.Msg("ARC chain validation failed", "reason", err.Error())
+		}
+	}
+	if len(sets) >= arcMaxInstance {
+		return "", errors.New("too many ARC sets")
+	}
+	instance := len(sets) + 1
+	algo, _ := signAlgo(m.signer)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	results := m.authResults(fields)
+	if instance > 1 {
+		if results != "" {
+			results += ";\r\n\t"
+		}
+		results += "arc=" + cv
+	}
+	if results == "" {
+		results = "none"
+	}
+	newSet := &arcSet{
+		aar: fmt.Sprintf("ARC-Authentication-Results: i=%d; %s;\r\n\t%s\r\n", instance, m.authServID, results),
+	}
+
+	names := m.signedFields(fields)
+	newSet.ams = fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed;\r\n\td=%s; s=%s; t=%s;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		instance, algo, m.domain, m.selector, now, strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bodyHash(body, "relaxed", -1)))
+	sig, err := signDigest(m.signer, signatureInput(selectFields(fields, names), newSet.ams, "relaxed"))
+	if err != nil {
+		return "", err
+	}
+	newSet.ams += foldSignature(sig) + "\r\n"
+
+	newSet.as = fmt.Sprintf("ARC-Seal: i=%d; a=%s; t=%s; cv=%s;\r\n\td=%s; s=%s;\r\n\tb=",
+		instance, algo, now, cv, m.domain, m.selector)
+	// If the chain is failed, the seal covers only the new set.
+	sealSets := append(sets, newSet)
+	if cv == arcFail {
+		sealSets = []*arcSet{newSet}
+	}
+	sig, err = signDigest(m.signer, sealInput(sealSets))
+	if err != nil {
+		return "", err
+	}
+	newSet.as += foldSignature(sig) + "\r\n"
+
+	h.AddRaw([]byte(newSet.aar))
+	h.AddRaw([]byte(newSet.ams))
+	h.AddRaw([]byte(newSet.as))
+
+	return cv, nil
+}
+
+type arcState struct {
+	m   *ARC
+	log log.Logger
+}
+
+func (m *ARC) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return arcState{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s arcState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s arcState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s arcState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.arc/RewriteBody").End()
+
+	r, err := body.Open()
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+	defer r.Close()
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+
+	cv, err := s.m.seal(ctx, h, blob)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+	s.log.DebugMsg("sealed", "domain", s.m.domain, "cv", cv)
+	return nil
+}
+
+func (s arcState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.arc", NewARC)
+}
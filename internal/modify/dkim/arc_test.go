@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestARC(t *testing.T, dir, domain string, zones map[string]mockdns.Zone) *ARC {
+	t.Helper()
+
+	mod, err := NewARC("", "test", nil, []string{domain, "arc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*ARC)
+	m.log = testutils.Logger(t, m.Name())
+	m.resolver = &mockdns.Resolver{Zones: zones}
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "key_path",
+				Args: []string{filepath.Join(dir, "{domain}.key")},
+			},
+			{
+				Name: "authserv_id",
+				Args: []string{"mx." + domain},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dnsRecord, err := os.ReadFile(filepath.Join(dir, domain+".dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones["arc._domainkey."+domain+"."] = mockdns.Zone{TXT: []string{string(dnsRecord)}}
+
+	return m
+}
+
+func sealTestMsg(t *testing.T, m *ARC, hdr *textproto.Header, body []byte) {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testARCMsg() textproto.Header {
+	hdr := textproto.Header{}
+	hdr.Add("From", "<alice@example.com>")
+	hdr.Add("Subject", "heya   there")
+	hdr.Add("To", "<list@example.org>")
+	hdr.Add("Authentication-Results", "mx.example.org; spf=pass smtp.mailfrom=example.com")
+	return hdr
+}
+
+func checkChain(t *testing.T, m *ARC, hdr textproto.Header, body []byte, expected string) {
+	t.Helper()
+
+	fields, err := rawFields(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sets, err := collectARCSets(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cv, err := m.validateChain(context.Background(), fields, sets, body)
+	if cv != expected {
+		t.Fatalf("expected cv=%s, got %s (%v)", expected, cv, err)
+	}
+}
+
+func TestARC(t *testing.T) {
+	dir := t.TempDir()
+	zones := map[string]mockdns.Zone{}
+	first := newTestARC(t, dir, "example.org", zones)
+	second := newTestARC(t, dir, "example.net", zones)
+
+	hdr := testARCMsg()
+	body := []byte("hello there  \r\n\r\n")
+
+	sealTestMsg(t, first, &hdr, body)
+	if !strings.Contains(hdr.Get("ARC-Seal"), "cv=none") {
+		t.Errorf("wrong first ARC-Seal: %s", hdr.Get("ARC-Seal"))
+	}
+	if aar := hdr.Get("ARC-Authentication-Results"); !strings.Contains(aar, "spf=pass") {
+		t.Errorf("Authentication-Results are not copied: %s", aar)
+	}
+	checkChain(t, first, hdr, body, arcPass)
+
+	sealTestMsg(t, second, &hdr, body)
+	if !strings.Contains(hdr.Get("ARC-Seal"), "i=2;") || !strings.Contains(hdr.Get("ARC-Seal"), "cv=pass") {
+		t.Errorf("wrong second ARC-Seal: %s", hdr.Get("ARC-Seal"))
+	}
+	checkChain(t, first, hdr, body, arcPass)
+
+	// Body modification after the last seal.
+	checkChain(t, first, hdr, []byte("goodbye\r\n"), arcFail)
+
+	// Header modification after the last seal is detected by the AMS.
+	hdr.Set("Subject", "changed")
+	checkChain(t, first, hdr, body, arcFail)
+}
+
+func TestARC_BrokenChain(t *testing.T) {
+	dir := t.TempDir()
+	zones := map[string]mockdns.Zone{}
+	m := newTestARC(t, dir, "example.org", zones)
+
+	hdr := testARCMsg()
+	hdr.AddRaw([]byte("ARC-Seal: i=1; a=rsa-sha256; cv=none; d=example.com; s=x; b=AAAA\r\n"))
+	body := []byte("hello\r\n")
+
+	sealTestMsg(t, m, &hdr, body)
+	if !strings.Contains(hdr.Get("ARC-Seal"), "cv=fail") {
+		t.Errorf("expected cv=fail for incomplete ARC set: %s", hdr.Get("ARC-Seal"))
+	}
+}
+
+// TestCanonicalization verifies DKIM signatures created by go-msgauth using
+// the primitives used for ARC.
+func TestCanonicalization(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, canon := range []dkim.Canonicalization{dkim.CanonicalizationRelaxed, dkim.CanonicalizationSimple} {
+		msg := "From: <alice@example.com>\r\n" +
+			"Subject:   folded\r\n" +
+			"\t subject  \r\n" +
+			"To: <bob@example.org>\r\n" +
+			"\r\n" +
+			"hello   there \r\n" +
+			"\r\n\r\n"
+
+		var signed bytes.Buffer
+		err = dkim.Sign(&signed, strings.NewReader(msg), &dkim.SignOptions{
+			Domain:                 "example.com",
+			Selector:               "test",
+			Signer:                 key,
+			HeaderCanonicalization: canon,
+			BodyCanonicalization:   canon,
+			HeaderKeys:             []string{"From", "Subject", "To", "Subject"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdrBlob, bodyBlob, _ := strings.Cut(signed.String(), "\r\n\r\n")
+		var fields []string
+		for _, line := range strings.SplitAfter(hdrBlob+"\r\n", "\r\n") {
+			if line == "" {
+				continue
+			}
+			if line[0] == '\t' || line[0] == ' ' {
+				fields[len(fields)-1] += line
+				continue
+			}
+			fields = append(fields, line)
+		}
+		sigField := fields[0]
+		tags, err := parseTags(fieldValue(sigField))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := bodyHash([]byte(bodyBlob), string(canon), -1); tags["bh"] != base64.StdEncoding.EncodeToString(got) {
+			t.Errorf("%s: body hash mismatch", canon)
+		}
+		signedFields := selectFields(fields[1:], strings.Split(tags["h"], ":"))
+		digest := signatureInput(signedFields, sigField, string(canon))
+		if err := verifyDigest(key.Public(), tags["a"], digest, tags["b"]); err != nil {
+			t.Errorf("%s: %v", canon, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Minimal implementation of DKIM primitives (RFC 6376) required for ARC
+// (RFC 8617) since go-msgauth does not provide generic signing and
+// verification of fields other than DKIM-Signature.
+
+// rawFields returns header fields in the order they appear in the message,
+// each including the trailing CRLF.
+func rawFields(h textproto.Header) ([]string, error) {
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, h); err != nil {
+		return nil, err
+	}
+
+	var (
+		fields []string
+		cur    strings.Builder
+	)
+	for _, line := range strings.SplitAfter(b.String(), "\n") {
+		if line == "" || line == "\r\n" || line == "\n" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && cur.Len() != 0 {
+			cur.WriteString(line)
+			continue
+		}
+		if cur.Len() != 0 {
+			fields = append(fields, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(line)
+	}
+	if cur.Len() != 0 {
+		fields = append(fields, cur.String())
+	}
+	return fields, nil
+}
+
+func fieldKey(raw string) string {
+	k, _, _ := strings.Cut(raw, ":")
+	return strings.ToLower(strings.TrimSpace(k))
+}
+
+func fieldValue(raw string) string {
+	_, v, _ := strings.Cut(raw, ":")
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(v))
+}
+
+// collapseWSP replaces all sequences of whitespace with a single space.
+func collapseWSP(s string) string {
+	var (
+		b     strings.Builder
+		inWSP bool
+	)
+	for _, c := range s {
+		if c == ' ' || c == '\t' {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			b.WriteByte(' ')
+			inWSP = false
+		}
+		b.WriteRune(c)
+	}
+	if inWSP {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func canonHeader(raw string, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+	k, v, _ := strings.Cut(raw, ":")
+	v = strings.NewReplacer("\r\n", "", "\n", "").Replace(v)
+	v = strings.Trim(collapseWSP(v), " ")
+	return strings.ToLower(strings.TrimSpace(k)) + ":" + v + "\r\n"
+}
+
+func canonBody(body []byte, canon string) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	if canon != "simple" {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(collapseWSP(line), " ")
+		}
+	}
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canon == "simple" {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// stripSignature removes the value of the b= tag from the field.
+func stripSignature(raw string) string {
+	k, v, _ := strings.Cut(raw, ":")
+	parts := strings.Split(v, ";")
+	for i, part := range parts {
+		name, _, ok := strings.Cut(part, "=")
+		if ok && strings.TrimSpace(name) == "b" {
+			parts[i] = part[:strings.Index(part, "=")+1]
+		}
+	}
+	return k + ":" + strings.Join(parts, ";")
+}
+
+// parseTags parses the tag=value list used in DKIM-like fields.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag: %s", part)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", name)
+		}
+		value = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, value)
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// selectFields returns fields listed in names in the order used for
+// signature computation. For repeated names, fields are selected from the
+// bottom up, names without a matching field are skipped.
+func selectFields(fields []string, names []string) []string {
+	used := make(map[int]bool)
+	res := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || fieldKey(fields[i]) != name {
+				continue
+			}
+			used[i] = true
+			res = append(res, fields[i])
+			break
+		}
+	}
+	return res
+}
+
+// signatureInput computes the hash of the canonicalized fields followed by
+// the signature field itself with an empty b= value and no trailing CRLF.
+func signatureInput(fields []string, sigField, canon string) []byte {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(canonHeader(f, canon)))
+	}
+	h.Write([]byte(strings.TrimSuffix(canonHeader(stripSignature(sigField), canon), "\r\n")))
+	return h.Sum(nil)
+}
+
+func bodyHash(body []byte, canon string, limit int) []byte {
+	c := canonBody(body, canon)
+	if limit >= 0 && limit < len(c) {
+		c = c[:limit]
+	}
+	sum := sha256.Sum256(c)
+	return sum[:]
+}
+
+func signAlgo(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported key type: %T", signer.Public())
+	}
+}
+
+func signDigest(signer crypto.Signer, digest []byte) (string, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func verifyDigest(pubkey crypto.PublicKey, algo string, digest []byte, sigB64 string) error {
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	switch pubkey := pubkey.(type) {
+	case *rsa.PublicKey:
+		if algo != "rsa-sha256" {
+			return fmt.Errorf("algorithm mismatch: %s", algo)
+		}
+		return rsa.VerifyPKCS1v15(pubkey, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if algo != "ed25519-sha256" {
+			return fmt.Errorf("algorithm mismatch: %s", algo)
+		}
+		if !ed25519.Verify(pubkey, digest, sig) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type: %T", pubkey)
+	}
+}
+
+// parseKeyRecord parses the public key from the DKIM key record.
+func parseKeyRecord(txt string) (crypto.PublicKey, error) {
+	tags, err := parseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported key record version: %s", v)
+	}
+	if tags["p"] == "" {
+		return nil, errors.New("key is revoked")
+	}
+	blob, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %w", err)
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(blob)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(blob)
+			if err != nil {
+				return nil, fmt.Errorf("malformed public key: %w", err)
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA key")
+		}
+		return rsaPub, nil
+	case "ed25519":
+		if len(blob) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed Ed25519 key")
+		}
+		return ed25519.PublicKey(blob), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", tags["k"])
+	}
+}
+
+// foldSignature splits the long base64 value into multiple lines.
+func foldSignature(sig string) string {
+	const width = 72
+	var b strings.Builder
+	for len(sig) > width {
+		b.WriteString(sig[:width])
+		b.WriteString("\r\n\t")
+		sig = sig[width:]
+	}
+	b.WriteString(sig)
+	return b.String()
+}
@@ -24,7 +24,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/trace"
 	"strings"
 	"time"
@@ -34,10 +33,13 @@ import (
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/extkey"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
 )
@@ -75,6 +77,7 @@ var (
 		"List-Id",
 		"List-Help",
 		"List-Unsubscribe",
+		"List-Unsubscribe-Post",
 		"List-Post",
 		"List-Owner",
 		"List-Archive",
@@ -93,20 +96,37 @@ var (
 	}
 )
 
+// selectorConfig is a selector used to sign messages and the algorithm used
+// to generate keys for it.
+type selectorConfig struct {
+	name string
+	algo string
+}
+
 type Modifier struct {
 	instName string
 
-	domains        []string
-	selector       string
-	signers        map[string]crypto.Signer
-	oversignHeader []string
-	signHeader     []string
-	headerCanon    dkim.Canonicalization
-	bodyCanon      dkim.Canonicalization
-	sigExpiry      time.Duration
-	hash           crypto.Hash
-	multipleFromOk bool
-	signSubdomains bool
+	domains         []string
+	selector        string
+	selectors       []selectorConfig
+	keyPathTemplate string
+	signers         map[string][]*keyChain
+	oversignHeader  []string
+	signHeader      []string
+	headerCanon     dkim.Canonicalization
+	bodyCanon       dkim.Canonicalization
+	sigExpiry       time.Duration
+	hash            crypto.Hash
+	multipleFromOk  bool
+	signSubdomains  bool
+
+	rotateInterval  time.Duration
+	rotatePublish   time.Duration
+	rotateVerifyDNS bool
+	resolver        dns.Resolver
+	stopRotation    chan struct{}
+
+	store *keyStore
 
 	log log.Logger
 }
@@ -114,7 +134,8 @@ type Modifier struct {
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
 		instName: instName,
-		signers:  map[string]crypto.Signer{},
+		signers:  map[string][]*keyChain{},
+		resolver: dns.DefaultResolver(),
 		log:      log.Logger{Name: "modify.dkim"},
 	}
 
@@ -141,15 +162,33 @@ func (m *Modifier) InstanceName() string {
 
 func (m *Modifier) Init(cfg *config.Map) error {
 	var (
-		hashName        string
-		keyPathTemplate string
-		newKeyAlgo      string
+		hashName   string
+		newKeyAlgo string
+		additional []selectorConfig
+		keyTable   module.Table
+		keyDir     string
 	)
 
 	cfg.Bool("debug", true, false, &m.log.Debug)
 	cfg.StringList("domains", false, false, m.domains, &m.domains)
 	cfg.String("selector", false, false, m.selector, &m.selector)
-	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.Callback("additional_selector", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 1 && len(node.Args) != 2 {
+			return config.NodeErr(node, "expected selector and optional key algorithm")
+		}
+		sel := selectorConfig{name: node.Args[0]}
+		if len(node.Args) == 2 {
+			switch node.Args[1] {
+			case "rsa4096", "rsa2048", "ed25519":
+			default:
+				return config.NodeErr(node, "unknown key algorithm: %s", node.Args[1])
+			}
+			sel.algo = node.Args[1]
+		}
+		additional = append(additional, sel)
+		return nil
+	})
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &m.keyPathTemplate)
 	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
 	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
 	cfg.Enum("header_canon", false, false,
@@ -165,55 +204,97 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	cfg.Duration("rotate_interval", false, false, 0, &m.rotateInterval)
+	cfg.Duration("rotate_publish", false, false, 7*Day, &m.rotatePublish)
+	cfg.Bool("rotate_verify_dns", false, true, &m.rotateVerifyDNS)
+	modconfig.Table(cfg, "key_table", false, false, nil, &keyTable)
+	cfg.String("key_dir", false, false, "", &keyDir)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	if len(m.domains) == 0 {
+	if keyTable != nil || keyDir != "" {
+		m.store = newKeyStore(keyTable, keyDir)
+	}
+
+	if len(m.domains) == 0 && m.store == nil {
 		return errors.New("sign_domain: at least one domain is needed")
 	}
-	if m.selector == "" {
+	if len(m.domains) != 0 && m.selector == "" {
 		return errors.New("sign_domain: selector is not specified")
 	}
-	if m.signSubdomains && len(m.domains) > 1 {
+	if m.signSubdomains && len(m.domains) != 1 {
 		return errors.New("sign_domain: only one domain is supported when sign_subdomains is enabled")
 	}
 
+	m.selectors = []selectorConfig{{name: m.selector, algo: newKeyAlgo}}
+	for _, sel := range additional {
+		if sel.algo == "" {
+			sel.algo = newKeyAlgo
+		}
+		for _, existing := range m.selectors {
+			if existing.name == sel.name {
+				return fmt.Errorf("modify.dkim: duplicate selector: %s", sel.name)
+			}
+		}
+		m.selectors = append(m.selectors, sel)
+	}
+	if (len(m.selectors) > 1 || m.rotateInterval != 0) && !strings.Contains(m.keyPathTemplate, "{selector}") {
+		return errors.New("modify.dkim: key_path should contain {selector} when multiple selectors or key rotation are used")
+	}
+	if m.rotateInterval != 0 {
+		if extkey.IsExternal(m.keyPathTemplate) {
+			return errors.New("modify.dkim: key rotation can't be used with keys stored in PKCS#11 tokens or remote signers")
+		}
+		if m.rotateInterval < Day {
+			return errors.New("modify.dkim: rotate_interval should be at least 24h")
+		}
+		if m.rotatePublish >= m.rotateInterval {
+			return errors.New("modify.dkim: rotate_publish should be less than rotate_interval")
+		}
+	}
+
 	m.hash = hashFuncs[hashName]
 	if m.hash == 0 {
 		panic("modify.dkim.Init: Hash function allowed by config matcher but not present in hashFuncs")
 	}
 
+	now := time.Now()
 	for _, domain := range m.domains {
 		if _, err := idna.ToASCII(domain); err != nil {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
 
-		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(keyPathTemplate)
-
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+		normDomain, err := dns.ForLookup(domain)
 		if err != nil {
-			return err
+			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+		}
+		if _, ok := m.signers[normDomain]; ok {
+			continue
 		}
 
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		for _, sel := range m.selectors {
+			chain, err := m.newKeyChain(domain, sel.name, sel.algo, now)
+			if err != nil {
+				return err
 			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
+			m.signers[normDomain] = append(m.signers[normDomain], chain)
 		}
+	}
 
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
-		}
-		m.signers[normDomain] = signer
+	registerModifier(m)
+	if m.rotateInterval != 0 && !module.NoRun {
+		m.rotateAll(now)
+		m.stopRotation = make(chan struct{})
+		go m.rotationLoop()
 	}
+	hooks.AddHook(hooks.EventShutdown, func() {
+		if m.stopRotation != nil {
+			close(m.stopRotation)
+		}
+		unregisterModifier(m)
+	})
 
 	return nil
 }
@@ -288,10 +369,12 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	}
 	// Use first key for null return path (<>) and postmaster (<postmaster>)
 	if domain == "" {
+		if len(s.m.domains) == 0 {
+			s.log.Msg("no key for null envelope sender")
+			return nil
+		}
 		domain = s.m.domains[0]
 	}
-	selector := s.m.selector
-
 	if s.m.signSubdomains {
 		topDomain := s.m.domains[0]
 		if strings.HasSuffix(domain, "."+topDomain) {
@@ -303,8 +386,18 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
 		return nil
 	}
-	keySigner := s.m.signers[normDomain]
-	if keySigner == nil {
+	var keys []signingKey
+	for _, chain := range s.m.signers[normDomain] {
+		keys = append(keys, chain.signingKey())
+	}
+	if len(keys) == 0 && s.m.store != nil {
+		keys, err = s.m.store.Lookup(ctx, normDomain)
+		if err != nil {
+			s.log.Error("key lookup failed", err, "domain", normDomain)
+			return exterrors.WithFields(exterrors.WithTemporary(err, true), map[string]interface{}{"modifier": "modify.dkim"})
+		}
+	}
+	if len(keys) == 0 {
 		s.log.Msg("no key for domain", "domain", normDomain)
 		return nil
 	}
@@ -317,10 +410,42 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		if err != nil {
 			return nil
 		}
+	}
+
+	// All signatures are computed over the same header so they do not cover
+	// each other.
+	headerKeys := s.m.fieldsToSign(h)
+	sigs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		sig, err := s.sign(h, body, domain, key, headerKeys)
+		if err != nil {
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+		if sig != "" {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	// Prepend in the reverse order so the first selector signature is
+	// on top.
+	for i := len(sigs) - 1; i >= 0; i-- {
+		h.AddRaw([]byte(sigs[i]))
+	}
+
+	s.m.log.DebugMsg("signed", "domain", domain, "signatures", len(sigs))
+
+	return nil
+}
 
+// sign returns the DKIM-Signature field created using the key. Empty string
+// is returned if the selector can't be used for the message.
+func (s *state) sign(h *textproto.Header, body buffer.Buffer, domain string, key signingKey, headerKeys []string) (string, error) {
+	selector := key.selector
+	if !s.meta.SMTPOpts.UTF8 {
+		var err error
 		selector, err = idna.ToASCII(selector)
 		if err != nil {
-			return nil
+			return "", nil
 		}
 	}
 
@@ -328,42 +453,38 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		Domain:                 domain,
 		Selector:               selector,
 		Identifier:             "@" + domain,
-		Signer:                 keySigner,
+		Signer:                 key.signer,
 		Hash:                   s.m.hash,
 		HeaderCanonicalization: s.m.headerCanon,
 		BodyCanonicalization:   s.m.bodyCanon,
-		HeaderKeys:             s.m.fieldsToSign(h),
+		HeaderKeys:             headerKeys,
 	}
 	if s.m.sigExpiry != 0 {
 		opts.Expiration = time.Now().Add(s.m.sigExpiry)
 	}
 	signer, err := dkim.NewSigner(&opts)
 	if err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
 	if err := textproto.WriteHeader(signer, *h); err != nil {
 		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
 	r, err := body.Open()
 	if err != nil {
 		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
+	defer r.Close()
 	if _, err := io.Copy(signer, r); err != nil {
 		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
 
 	if err := signer.Close(); err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
-
-	h.AddRaw([]byte(signer.Signature()))
-
-	s.m.log.DebugMsg("signed", "domain", domain)
-
-	return nil
+	return signer.Signature(), nil
 }
 
 func (s state) Close() error {
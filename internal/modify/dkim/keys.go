@@ -31,10 +31,17 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/foxcpp/maddy/internal/extkey"
 )
 
 func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
-	f, err := os.Open(keyPath)
+	if extkey.IsExternal(keyPath) {
+		pkey, err = loadExternalKey(keyPath)
+		return pkey, false, err
+	}
+
+	pemBlob, err := os.ReadFile(keyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			pkey, err = m.generateAndWrite(keyPath, newKeyAlgo)
@@ -42,16 +49,17 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 		}
 		return nil, false, err
 	}
-	defer f.Close()
 
-	pemBlob, err := io.ReadAll(f)
-	if err != nil {
-		return nil, false, err
-	}
+	pkey, err = parseKey(keyPath, pemBlob)
+	return pkey, false, err
+}
+
+func parseKey(keyPath string, pemBlob []byte) (crypto.Signer, error) {
+	var err error
 
 	block, _ := pem.Decode(pemBlob)
 	if block == nil {
-		return nil, false, fmt.Errorf("modify.dkim: %s: invalid PEM block", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: invalid PEM block", keyPath)
 	}
 
 	var key interface{}
@@ -59,35 +67,50 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 	case "PRIVATE KEY": // RFC 5208 aka PKCS #8
 		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	case "RSA PRIVATE KEY": // RFC 3447 aka PKCS #1
 		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	case "EC PRIVATE KEY": // RFC 5915
 		key, err = x509.ParseECPrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: not a private key or unsupported format", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: not a private key or unsupported format", keyPath)
 	}
 
 	switch key := key.(type) {
 	case *rsa.PrivateKey:
 		if err := key.Validate(); err != nil {
-			return nil, false, err
+			return nil, err
 		}
 		key.Precompute()
-		return key, false, nil
+		return key, nil
 	case ed25519.PrivateKey:
-		return key, false, nil
+		return key, nil
 	case *ecdsa.PublicKey:
-		return nil, false, fmt.Errorf("modify.dkim: %s: ECDSA keys are not supported", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: ECDSA keys are not supported", keyPath)
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: unknown key type: %T", keyPath, key)
+		return nil, fmt.Errorf("modify.dkim: %s: unknown key type: %T", keyPath, key)
+	}
+}
+
+// loadExternalKey loads the key stored in a PKCS#11 token or remote signer.
+// Such keys are never generated automatically.
+func loadExternalKey(uri string) (crypto.Signer, error) {
+	signer, err := extkey.Load(uri)
+	if err != nil {
+		return nil, fmt.Errorf("modify.dkim: %w", err)
+	}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("modify.dkim: %s: unsupported key type: %T, only RSA and Ed25519 keys can be used", extkey.Redacted(uri), signer.Public())
 	}
 }
 
@@ -99,16 +122,13 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
-		pkey     crypto.Signer
-		dkimName = newKeyAlgo
-		err      error
+		pkey crypto.Signer
+		err  error
 	)
 	switch newKeyAlgo {
 	case "rsa4096":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
 	case "rsa2048":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
 	case "ed25519":
 		_, pkey, err = ed25519.GenerateKey(rand.Reader)
@@ -130,7 +150,7 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 		return nil, wrapErr(err)
 	}
 
-	_, err = writeDNSRecord(keyPath, dkimName, pkey)
+	_, err = writeDNSRecord(keyPath, pkey)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
@@ -150,33 +170,50 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	return pkey, nil
 }
 
-func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
+// keyRecord returns the DKIM key record (RFC 6376, Section 3.6.1) for the
+// public key of pkey.
+func keyRecord(pkey crypto.Signer) (string, error) {
 	var (
-		keyBlob []byte
-		pubkey  = pkey.Public()
+		keyBlob  []byte
+		algoName string
 	)
-	switch pubkey := pubkey.(type) {
+	switch pubkey := pkey.Public().(type) {
 	case *rsa.PublicKey:
 		var err error
 		keyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
 		if err != nil {
 			return "", err
 		}
+		algoName = "rsa"
 	case ed25519.PublicKey:
 		keyBlob = pubkey
+		algoName = "ed25519"
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		return "", fmt.Errorf("unknown key algorithm: %T", pubkey)
 	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", algoName, base64.StdEncoding.EncodeToString(keyBlob)), nil
+}
 
-	dnsPath := keyPath + ".dns"
+// dnsRecordPath returns the path of the file with the DNS record for the key.
+func dnsRecordPath(keyPath string) string {
 	if filepath.Ext(keyPath) == ".key" {
-		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		return keyPath[:len(keyPath)-4] + ".dns"
+	}
+	return keyPath + ".dns"
+}
+
+func writeDNSRecord(keyPath string, pkey crypto.Signer) (string, error) {
+	keyRecord, err := keyRecord(pkey)
+	if err != nil {
+		return "", err
 	}
+
+	dnsPath := dnsRecordPath(keyPath)
 	dnsF, err := os.Create(dnsPath)
 	if err != nil {
 		return "", err
 	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
+	defer dnsF.Close()
 	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
 		return "", err
 	}
@@ -0,0 +1,282 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/extkey"
+)
+
+// keyStore provides signing keys for domains that are not listed in the
+// configuration. Keys are looked up on each use and reloaded from disk if
+// the key file changes, so domains can be added and keys replaced without
+// restarting the server.
+type keyStore struct {
+	// table maps domains to "selector key_path" values.
+	table module.Table
+	// dir contains keys named {domain}_{selector}.key.
+	dir string
+
+	lock    sync.Mutex
+	cache   map[string]cachedKey
+	dirKeys map[string][]keyRef
+	dirMod  time.Time
+}
+
+type keyRef struct {
+	selector string
+	path     string
+}
+
+type cachedKey struct {
+	modTime time.Time
+	size    int64
+	signer  crypto.Signer
+}
+
+func newKeyStore(table module.Table, dir string) *keyStore {
+	return &keyStore{
+		table: table,
+		dir:   dir,
+		cache: map[string]cachedKey{},
+	}
+}
+
+// parseKeyRef parses the table value in the "selector key_path" format.
+func parseKeyRef(val string) (keyRef, error) {
+	parts := strings.Fields(val)
+	if len(parts) != 2 {
+		return keyRef{}, fmt.Errorf("modify.dkim: malformed key table value, expected selector and key path: %q", val)
+	}
+	return keyRef{selector: parts[0], path: parts[1]}, nil
+}
+
+func (ks *keyStore) tableRefs(ctx context.Context, domain string) ([]keyRef, error) {
+	var vals []string
+	if multi, ok := ks.table.(module.MultiTable); ok {
+		var err error
+		vals, err = multi.LookupMulti(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		val, ok, err := ks.table.Lookup(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			vals = []string{val}
+		}
+	}
+
+	refs := make([]keyRef, 0, len(vals))
+	for _, val := range vals {
+		ref, err := parseKeyRef(val)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// scanDir updates the list of keys in the directory if it was changed since
+// the last scan. Adding, removing or renaming files changes the directory
+// modification time, key contents changes are handled by loadKey.
+//
+// Should be called with ks.lock held.
+func (ks *keyStore) scanDir() error {
+	info, err := os.Stat(ks.dir)
+	if err != nil {
+		return fmt.Errorf("modify.dkim: %w", err)
+	}
+	if ks.dirKeys != nil && info.ModTime().Equal(ks.dirMod) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(ks.dir)
+	if err != nil {
+		return fmt.Errorf("modify.dkim: %w", err)
+	}
+	dirKeys := make(map[string][]keyRef)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".key") {
+			continue
+		}
+		domain, selector, ok := strings.Cut(strings.TrimSuffix(name, ".key"), "_")
+		if !ok || domain == "" || selector == "" {
+			continue
+		}
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			continue
+		}
+		dirKeys[normDomain] = append(dirKeys[normDomain], keyRef{
+			selector: selector,
+			path:     filepath.Join(ks.dir, name),
+		})
+	}
+
+	ks.dirKeys = dirKeys
+	ks.dirMod = info.ModTime()
+	return nil
+}
+
+func (ks *keyStore) dirRefs(domain string) ([]keyRef, error) {
+	if err := ks.scanDir(); err != nil {
+		return nil, err
+	}
+	return ks.dirKeys[domain], nil
+}
+
+// loadKey returns the key from the cache or reads it from disk if it was
+// changed since it was loaded.
+//
+// Should be called with ks.lock held.
+func (ks *keyStore) loadKey(path string) (crypto.Signer, error) {
+	if extkey.IsExternal(path) {
+		// Cached by extkey.
+		return loadExternalKey(path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(ks.cache, path)
+		return nil, fmt.Errorf("modify.dkim: %w", err)
+	}
+	cached, ok := ks.cache[path]
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.signer, nil
+	}
+
+	pemBlob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("modify.dkim: %w", err)
+	}
+	signer, err := parseKey(path, pemBlob)
+	if err != nil {
+		return nil, err
+	}
+	ks.cache[path] = cachedKey{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		signer:  signer,
+	}
+	return signer, nil
+}
+
+// Lookup returns signing keys for the normalized domain. Empty slice is
+// returned if there are no keys for it.
+func (ks *keyStore) Lookup(ctx context.Context, domain string) ([]signingKey, error) {
+	var refs []keyRef
+	if ks.table != nil {
+		var err error
+		refs, err = ks.tableRefs(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if len(refs) == 0 && ks.dir != "" {
+		var err error
+		refs, err = ks.dirRefs(domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]signingKey, 0, len(refs))
+	for _, ref := range refs {
+		signer, err := ks.loadKey(ref.path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, signingKey{selector: ref.selector, path: ref.path, signer: signer})
+	}
+	return keys, nil
+}
+
+// keys returns the information about keys that can be listed. Keys from the
+// table are listed only if the table supports listing keys.
+func (ks *keyStore) keys(ctx context.Context, instName string) ([]KeyInfo, error) {
+	var domains []string
+	if lister, ok := ks.table.(interface{ Keys() ([]string, error) }); ok {
+		tblDomains, err := lister.Keys()
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, tblDomains...)
+	}
+	if ks.dir != "" {
+		ks.lock.Lock()
+		err := ks.scanDir()
+		for domain := range ks.dirKeys {
+			domains = append(domains, domain)
+		}
+		ks.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(domains)
+
+	var res []KeyInfo
+	seen := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+
+		keys, err := ks.Lookup(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			record, err := keyRecord(key.signer)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, KeyInfo{
+				Instance:   instName,
+				Domain:     domain,
+				Selector:   key.selector,
+				Status:     KeyActive,
+				RecordName: key.selector + "._domainkey." + domain,
+				Record:     record,
+			})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestKeyDir(t *testing.T) {
+	dir := t.TempDir()
+
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+	if err := m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "key_dir", Args: []string{dir}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, _ := signTestMsg(t, m, "test@maddy.test")
+	if hdr.Has("DKIM-Signature") {
+		t.Fatal("message signed without a key")
+	}
+
+	// Make sure the directory modification time changes.
+	time.Sleep(10 * time.Millisecond)
+	if _, err := m.generateAndWrite(filepath.Join(dir, "maddy.test_sel1.key"), "ed25519"); err != nil {
+		t.Fatal(err)
+	}
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	record, err := os.ReadFile(filepath.Join(dir, "maddy.test_sel1.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyWithZones(t, map[string]mockdns.Zone{
+		"sel1._domainkey.maddy.test.": {TXT: []string{string(record)}},
+	}, 1, hdr, body)
+
+	// Replaced key is reloaded.
+	time.Sleep(10 * time.Millisecond)
+	if err := os.Remove(filepath.Join(dir, "maddy.test_sel1.key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.generateAndWrite(filepath.Join(dir, "maddy.test_sel1.key"), "rsa2048"); err != nil {
+		t.Fatal(err)
+	}
+	hdr, _ = signTestMsg(t, m, "test@maddy.test")
+	if !containsTag(hdr.Get("DKIM-Signature"), "a=rsa-sha256") {
+		t.Fatal("replaced key is not used")
+	}
+
+	keys, err := m.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Domain != "maddy.test" || keys[0].Selector != "sel1" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+}
+
+func TestKeyTable(t *testing.T) {
+	dir := t.TempDir()
+
+	mod, err := New("", "test", nil, []string{"static.test", "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+	if err := m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "tenant.key")
+	if _, err := m.generateAndWrite(keyPath, "ed25519"); err != nil {
+		t.Fatal(err)
+	}
+	m.store = newKeyStore(testutils.Table{M: map[string]string{
+		"maddy.test":  "tenant " + keyPath,
+		"broken.test": "tenant",
+	}}, "")
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	record, err := os.ReadFile(filepath.Join(dir, "tenant.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyWithZones(t, map[string]mockdns.Zone{
+		"tenant._domainkey.maddy.test.": {TXT: []string{string(record)}},
+	}, 1, hdr, body)
+
+	// Statically configured domains use configured keys.
+	hdr, _ = signTestMsg(t, m, "test@static.test")
+	if !containsTag(hdr.Get("DKIM-Signature"), "s=default") {
+		t.Fatal("static key is not used")
+	}
+
+	if _, err := m.store.Lookup(context.Background(), "broken.test"); err == nil {
+		t.Fatal("expected error for malformed table value")
+	}
+}
@@ -0,0 +1,443 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// signingKey is a key used to sign messages with a specific selector.
+type signingKey struct {
+	selector string
+	path     string
+	signer   crypto.Signer
+}
+
+// rotationState is stored next to the keys to keep track of the rotation
+// progress across restarts.
+type rotationState struct {
+	Current       string    `json:"current"`
+	CurrentSince  time.Time `json:"current_since"`
+	Next          string    `json:"next,omitempty"`
+	Previous      string    `json:"previous,omitempty"`
+	PreviousUntil time.Time `json:"previous_until,omitempty"`
+}
+
+// keyChain is the signing key for a domain and configured selector.
+//
+// If rotation is enabled, the key is periodically replaced with a new one
+// using the selector with the activation date appended (e.g.
+// default-20260115). The new key is generated rotate_publish before it is
+// used so its DNS record can be published. The previous key is reported
+// until signatures created using it expire so its record is not removed too
+// early.
+type keyChain struct {
+	m            *Modifier
+	domain       string
+	baseSelector string
+	algo         string
+	statePath    string
+
+	lock          sync.RWMutex
+	current       signingKey
+	since         time.Time
+	next          *signingKey
+	prev          *signingKey
+	previousUntil time.Time
+}
+
+func (m *Modifier) keyPath(domain, selector string) string {
+	return strings.NewReplacer("{domain}", domain, "{selector}", selector).Replace(m.keyPathTemplate)
+}
+
+func (c *keyChain) loadKey(selector string) (signingKey, error) {
+	path := c.m.keyPath(c.domain, selector)
+	signer, newKey, err := c.m.loadOrGenerateKey(path, c.algo)
+	if err != nil {
+		return signingKey{}, err
+	}
+	if newKey {
+		c.m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+			"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+			c.algo, path, dnsRecordPath(path), selector, c.domain)
+	}
+	return signingKey{selector: selector, path: path, signer: signer}, nil
+}
+
+func (m *Modifier) newKeyChain(domain, selector, algo string, now time.Time) (*keyChain, error) {
+	c := &keyChain{
+		m:            m,
+		domain:       domain,
+		baseSelector: selector,
+		algo:         algo,
+	}
+	if m.rotateInterval == 0 {
+		var err error
+		c.current, err = c.loadKey(selector)
+		return c, err
+	}
+
+	c.statePath = dnsRecordPath(m.keyPath(domain, selector))
+	c.statePath = strings.TrimSuffix(c.statePath, ".dns") + ".rotation"
+
+	state := rotationState{Current: selector, CurrentSince: now}
+	stateBlob, err := os.ReadFile(c.statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("modify.dkim: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(stateBlob, &state); err != nil {
+			return nil, fmt.Errorf("modify.dkim: malformed rotation state %s: %w", c.statePath, err)
+		}
+	}
+
+	c.current, err = c.loadKey(state.Current)
+	if err != nil {
+		return nil, err
+	}
+	c.since = state.CurrentSince
+	if state.Next != "" {
+		next, err := c.loadKey(state.Next)
+		if err != nil {
+			return nil, err
+		}
+		c.next = &next
+	}
+	if state.Previous != "" {
+		path := m.keyPath(domain, state.Previous)
+		if _, err := os.Stat(path); err == nil {
+			prev, err := c.loadKey(state.Previous)
+			if err != nil {
+				return nil, err
+			}
+			c.prev = &prev
+			c.previousUntil = state.PreviousUntil
+		}
+	}
+
+	return c, c.saveState()
+}
+
+func (c *keyChain) saveState() error {
+	c.lock.RLock()
+	state := rotationState{
+		Current:      c.current.selector,
+		CurrentSince: c.since,
+	}
+	if c.next != nil {
+		state.Next = c.next.selector
+	}
+	if c.prev != nil {
+		state.Previous = c.prev.selector
+		state.PreviousUntil = c.previousUntil
+	}
+	c.lock.RUnlock()
+
+	blob, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := c.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, blob, 0o600); err != nil {
+		return fmt.Errorf("modify.dkim: %w", err)
+	}
+	if err := os.Rename(tmpPath, c.statePath); err != nil {
+		return fmt.Errorf("modify.dkim: %w", err)
+	}
+	return nil
+}
+
+// signingKey returns the key that should be used to sign messages now.
+func (c *keyChain) signingKey() signingKey {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.current
+}
+
+// published checks whether the DNS record for the key is published.
+func (c *keyChain) published(ctx context.Context, key signingKey) (bool, error) {
+	record, err := keyRecord(key.signer)
+	if err != nil {
+		return false, err
+	}
+	wantKey := record[strings.Index(record, "p="):]
+
+	txts, err := c.m.resolver.LookupTXT(ctx, key.selector+"._domainkey."+c.domain)
+	if err != nil {
+		return false, err
+	}
+	for _, txt := range txts {
+		if strings.Contains(strings.Join(strings.Fields(txt), ""), wantKey) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rotate generates the next key and activates it when it is time to. It
+// should not be called concurrently.
+func (c *keyChain) rotate(ctx context.Context, now time.Time) error {
+	c.lock.RLock()
+	var (
+		since      = c.since
+		next       = c.next
+		prevExpiry = c.prev != nil && now.After(c.previousUntil)
+	)
+	c.lock.RUnlock()
+
+	changed := false
+	if prevExpiry {
+		c.lock.Lock()
+		c.m.log.Msg("previous DKIM key is no longer used, its DNS record can be removed",
+			"domain", c.domain, "selector", c.prev.selector)
+		c.prev = nil
+		c.lock.Unlock()
+		changed = true
+	}
+
+	activateAt := since.Add(c.m.rotateInterval)
+	if next == nil && !now.Before(activateAt.Add(-c.m.rotatePublish)) {
+		key, err := c.loadKey(c.baseSelector + "-" + activateAt.UTC().Format("20060102"))
+		if err != nil {
+			return err
+		}
+		record, err := keyRecord(key.signer)
+		if err != nil {
+			return err
+		}
+		c.m.log.Msg("generated the next DKIM key, publish its DNS record before it is activated",
+			"domain", c.domain, "selector", key.selector,
+			"record_name", key.selector+"._domainkey."+c.domain,
+			"record", record, "activates_at", activateAt)
+
+		c.lock.Lock()
+		c.next = &key
+		c.lock.Unlock()
+		next = &key
+		changed = true
+	}
+
+	if next != nil && !now.Before(activateAt) {
+		var (
+			ok  = true
+			err error
+		)
+		if c.m.rotateVerifyDNS {
+			ok, err = c.published(ctx, *next)
+		}
+		switch {
+		case err != nil:
+			c.m.log.Error("unable to check the DNS record for the next DKIM key, not activating it", err,
+				"domain", c.domain, "selector", next.selector)
+		case !ok:
+			c.m.log.Msg("DNS record for the next DKIM key is not published, not activating it",
+				"domain", c.domain, "selector", next.selector,
+				"record_name", next.selector+"._domainkey."+c.domain)
+		default:
+			retain := c.m.sigExpiry
+			if retain < c.m.rotatePublish {
+				retain = c.m.rotatePublish
+			}
+
+			c.lock.Lock()
+			prev := c.current
+			c.prev = &prev
+			c.previousUntil = now.Add(retain)
+			c.current = *next
+			c.since = now
+			c.next = nil
+			c.lock.Unlock()
+			changed = true
+
+			c.m.log.Msg("activated the next DKIM key", "domain", c.domain,
+				"selector", next.selector, "previous_selector", prev.selector)
+		}
+	}
+
+	if changed {
+		return c.saveState()
+	}
+	return nil
+}
+
+// KeyInfo describes the key used by modify.dkim and its DNS record.
+type KeyInfo struct {
+	Instance   string    `json:"instance,omitempty"`
+	Domain     string    `json:"domain"`
+	Selector   string    `json:"selector"`
+	Status     string    `json:"status"`
+	RecordName string    `json:"record_name"`
+	Record     string    `json:"record"`
+	Since      time.Time `json:"since,omitempty"`
+	Until      time.Time `json:"until,omitempty"`
+}
+
+const (
+	KeyActive  = "active"
+	KeyPending = "pending"
+	KeyRetired = "retired"
+)
+
+func (c *keyChain) keys() ([]KeyInfo, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	info := func(key signingKey, status string) (KeyInfo, error) {
+		record, err := keyRecord(key.signer)
+		if err != nil {
+			return KeyInfo{}, err
+		}
+		return KeyInfo{
+			Instance:   c.m.instName,
+			Domain:     c.domain,
+			Selector:   key.selector,
+			Status:     status,
+			RecordName: key.selector + "._domainkey." + c.domain,
+			Record:     record,
+		}, nil
+	}
+
+	var res []KeyInfo
+	current, err := info(c.current, KeyActive)
+	if err != nil {
+		return nil, err
+	}
+	current.Since = c.since
+	res = append(res, current)
+	if c.next != nil {
+		next, err := info(*c.next, KeyPending)
+		if err != nil {
+			return nil, err
+		}
+		next.Since = c.since.Add(c.m.rotateInterval)
+		res = append(res, next)
+	}
+	if c.prev != nil {
+		prev, err := info(*c.prev, KeyRetired)
+		if err != nil {
+			return nil, err
+		}
+		prev.Until = c.previousUntil
+		res = append(res, prev)
+	}
+	return res, nil
+}
+
+func (m *Modifier) rotateAll(now time.Time) {
+	for _, chains := range m.signers {
+		for _, c := range chains {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := c.rotate(ctx, now); err != nil {
+				m.log.Error("DKIM key rotation failed", err, "domain", c.domain, "selector", c.baseSelector)
+			}
+			cancel()
+		}
+	}
+}
+
+func (m *Modifier) rotationLoop() {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.rotateAll(time.Now())
+		case <-m.stopRotation:
+			return
+		}
+	}
+}
+
+// Keys returns the information about all keys used by the module.
+func (m *Modifier) Keys() ([]KeyInfo, error) {
+	var res []KeyInfo
+	for _, domain := range m.domains {
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			continue
+		}
+		for _, c := range m.signers[normDomain] {
+			keys, err := c.keys()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, keys...)
+		}
+	}
+	if m.store != nil {
+		keys, err := m.store.keys(context.Background(), m.instName)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, keys...)
+	}
+	return res, nil
+}
+
+var (
+	modifiers     = make(map[*Modifier]struct{})
+	modifiersLock sync.Mutex
+)
+
+func registerModifier(m *Modifier) {
+	modifiersLock.Lock()
+	defer modifiersLock.Unlock()
+	modifiers[m] = struct{}{}
+}
+
+func unregisterModifier(m *Modifier) {
+	modifiersLock.Lock()
+	defer modifiersLock.Unlock()
+	delete(modifiers, m)
+}
+
+func init() {
+	control.Register("dkim.keys", func(_ json.RawMessage) (interface{}, error) {
+		modifiersLock.Lock()
+		defer modifiersLock.Unlock()
+
+		res := []KeyInfo{}
+		for m := range modifiers {
+			keys, err := m.Keys()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, keys...)
+		}
+		sort.Slice(res, func(i, j int) bool {
+			if res[i].Domain != res[j].Domain {
+				return res[i].Domain < res[j].Domain
+			}
+			return res[i].Selector < res[j].Selector
+		})
+		return res, nil
+	})
+}
@@ -0,0 +1,202 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDualSigning(t *testing.T) {
+	dir := t.TempDir()
+
+	mod, err := New("", "test", nil, []string{"maddy.test", "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+	if err := m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+			{Name: "newkey_algo", Args: []string{"rsa2048"}},
+			{Name: "additional_selector", Args: []string{"ed", "ed25519"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	sigs := hdr.Values("DKIM-Signature")
+	if len(sigs) != 2 {
+		t.Fatalf("expected 2 signatures, got %d", len(sigs))
+	}
+	if !containsTag(sigs[0], "a=rsa-sha256") || !containsTag(sigs[1], "a=ed25519-sha256") {
+		t.Errorf("wrong signatures order or algorithms: %v", sigs)
+	}
+
+	zones := map[string]mockdns.Zone{}
+	for _, sel := range []string{"default", "ed"} {
+		record, err := os.ReadFile(filepath.Join(dir, "maddy.test_"+sel+".dns"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zones[sel+"._domainkey.maddy.test."] = mockdns.Zone{TXT: []string{string(record)}}
+	}
+	verifyWithZones(t, zones, 2, hdr, body)
+}
+
+func containsTag(sig, tag string) bool {
+	return strings.Contains(strings.Join(strings.Fields(sig), ""), tag+";")
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	newModifier := func() *Modifier {
+		mod, err := New("", "test", nil, []string{"maddy.test", "default"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*Modifier)
+		m.log = testutils.Logger(t, m.Name())
+		if err := m.Init(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+				{Name: "newkey_algo", Args: []string{"ed25519"}},
+				{Name: "sig_expiry", Args: []string{"24h"}},
+				{Name: "rotate_interval", Args: []string{"720h"}},
+				{Name: "rotate_publish", Args: []string{"168h"}},
+			},
+		})); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m := newModifier()
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{}}
+	m.resolver = resolver
+
+	chain := m.signers["maddy.test"][0]
+	start := chain.since
+	ctx := context.Background()
+
+	expectKeys := func(m *Modifier, statuses ...string) []KeyInfo {
+		t.Helper()
+		keys, err := m.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != len(statuses)/2 {
+			t.Fatalf("expected %d keys, got %+v", len(statuses)/2, keys)
+		}
+		for i, key := range keys {
+			if key.Selector != statuses[i*2] || key.Status != statuses[i*2+1] {
+				t.Errorf("key %d: want %s (%s), got %s (%s)", i, statuses[i*2], statuses[i*2+1], key.Selector, key.Status)
+			}
+		}
+		return keys
+	}
+
+	// Too early to generate the next key.
+	if err := chain.rotate(ctx, start.Add(20*Day)); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(m, "default", KeyActive)
+
+	nextSel := "default-" + start.Add(30*Day).UTC().Format("20060102")
+	if err := chain.rotate(ctx, start.Add(24*Day)); err != nil {
+		t.Fatal(err)
+	}
+	keys := expectKeys(m, "default", KeyActive, nextSel, KeyPending)
+	if _, err := os.Stat(filepath.Join(dir, "maddy.test_"+nextSel+".dns")); err != nil {
+		t.Error("DNS record file for the next key is not written:", err)
+	}
+
+	// Restart should preserve the rotation state.
+	m = newModifier()
+	m.resolver = resolver
+	chain = m.signers["maddy.test"][0]
+	expectKeys(m, "default", KeyActive, nextSel, KeyPending)
+
+	// Not activated until the record is published.
+	if err := chain.rotate(ctx, start.Add(30*Day)); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(m, "default", KeyActive, nextSel, KeyPending)
+	if chain.signingKey().selector != "default" {
+		t.Fatal("unpublished key is used for signing")
+	}
+
+	resolver.Zones[keys[1].RecordName+"."] = mockdns.Zone{TXT: []string{keys[1].Record}}
+	if err := chain.rotate(ctx, start.Add(31*Day)); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(m, nextSel, KeyActive, "default", KeyRetired)
+	if chain.signingKey().selector != nextSel {
+		t.Fatal("next key is not used for signing")
+	}
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	verifyWithZones(t, resolver.Zones, 1, hdr, body)
+
+	// The retired key is reported until signatures expire.
+	if err := chain.rotate(ctx, start.Add(40*Day)); err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(m, nextSel, KeyActive)
+}
+
+func verifyWithZones(t *testing.T, zones map[string]mockdns.Zone, expectSigs int, hdr textproto.Header, body []byte) {
+	t.Helper()
+
+	var fullBody bytes.Buffer
+	if err := textproto.WriteHeader(&fullBody, hdr); err != nil {
+		t.Fatal(err)
+	}
+	fullBody.Write(body)
+
+	resolver := &mockdns.Resolver{Zones: zones}
+	verifs, err := dkim.VerifyWithOptions(&fullBody, &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return resolver.LookupTXT(context.Background(), domain)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != expectSigs {
+		t.Fatalf("expected %d verifications, got %d", expectSigs, len(verifs))
+	}
+	for _, v := range verifs {
+		if v.Err != nil {
+			t.Errorf("verification error for %s: %v", v.Domain, v.Err)
+		}
+	}
+}
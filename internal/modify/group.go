@@ -20,12 +20,15 @@ package modify
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type (
@@ -40,9 +43,18 @@ type (
 
 	groupState struct {
 		states []module.ModifierState
+		// Modifier names used in tracing spans, indexes match states.
+		names []string
 	}
 )
 
+func modifierName(m module.Modifier) string {
+	if mod, ok := m.(module.Module); ok {
+		return mod.Name() + ":" + mod.InstanceName()
+	}
+	return fmt.Sprintf("%T", m)
+}
+
 func (g *Group) Init(cfg *config.Map) error {
 	for _, node := range cfg.Block.Children {
 		mod, err := modconfig.MsgModifier(cfg.Globals, append([]string{node.Name}, node.Args...), node)
@@ -76,14 +88,17 @@ func (g Group) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata)
 			return nil, err
 		}
 		gs.states = append(gs.states, state)
+		gs.names = append(gs.names, modifierName(modifier))
 	}
 	return gs, nil
 }
 
 func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
 	var err error
-	for _, state := range gs.states {
-		mailFrom, err = state.RewriteSender(ctx, mailFrom)
+	for i, state := range gs.states {
+		spanCtx, span := tracing.Start(ctx, "modify.sender", attribute.String("maddy.modifier", gs.names[i]))
+		mailFrom, err = state.RewriteSender(spanCtx, mailFrom)
+		tracing.End(span, err)
 		if err != nil {
 			return "", err
 		}
@@ -94,28 +109,40 @@ func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string
 func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
 	var err error
 	var result = []string{rcptTo}
-	for _, state := range gs.states {
+	for i, state := range gs.states {
+		spanCtx, span := tracing.Start(ctx, "modify.rcpt", attribute.String("maddy.modifier", gs.names[i]))
 		var intermediateResult = []string{}
 		for _, partResult := range result {
 			var partResult_multi []string
-			partResult_multi, err = state.RewriteRcpt(ctx, partResult)
+			partResult_multi, err = state.RewriteRcpt(spanCtx, partResult)
 			if err != nil {
+				tracing.End(span, err)
 				return []string{""}, err
 			}
 			intermediateResult = append(intermediateResult, partResult_multi...)
 		}
+		tracing.End(span, nil)
 		result = intermediateResult
 	}
 	return result, nil
 }
 
 func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
-	for _, state := range gs.states {
-		if err := state.RewriteBody(ctx, h, body); err != nil {
-			return err
+	_, err := gs.ModifyBody(ctx, h, body)
+	return err
+}
+
+func (gs groupState) ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	for i, state := range gs.states {
+		spanCtx, span := tracing.Start(ctx, "modify.body", attribute.String("maddy.modifier", gs.names[i]))
+		var err error
+		body, err = module.RewriteBody(spanCtx, state, h, body)
+		tracing.End(span, err)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return body, nil
 }
 
 func (gs groupState) Close() error {
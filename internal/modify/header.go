@@ -0,0 +1,466 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	nettextproto "net/textproto"
+	"regexp"
+	"runtime/trace"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+var headerPlaceholderRe = regexp.MustCompile(`{[a-zA-Z0-9_.-]+?}`)
+
+type headerActionKind int
+
+const (
+	headerAdd headerActionKind = iota
+	headerReplace
+	headerRemove
+)
+
+type headerAction struct {
+	kind     headerActionKind
+	field    string
+	template string
+
+	// Field names to remove, names ending with * match any field with the
+	// prefix.
+	fields []string
+}
+
+type headerCond struct {
+	field string
+	re    *regexp.Regexp
+}
+
+// headerMatch contains conditions that should be satisfied for header
+// actions to be applied.
+type headerMatch struct {
+	authenticated *bool
+	quarantined   *bool
+	senders       []string
+	minScore      *float64
+	header        []headerCond
+}
+
+// header adds, replaces and removes header fields. Field values can
+// reference message information using placeholders.
+type header struct {
+	instName string
+
+	match   headerMatch
+	actions []headerAction
+
+	log log.Logger
+}
+
+func NewHeader(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.header: inline arguments are not used")
+	}
+	return &header{
+		instName: instName,
+		log:      log.Logger{Name: "modify.header"},
+	}, nil
+}
+
+func parseFieldName(node config.Node, name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+		return "", config.NodeErr(node, "invalid header field name: %q", name)
+	}
+	return nettextproto.CanonicalMIMEHeaderKey(name), nil
+}
+
+func parseOptionalBool(node config.Node) (*bool, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	var val bool
+	switch node.Args[0] {
+	case "yes":
+		val = true
+	case "no":
+	default:
+		return nil, config.NodeErr(node, "bool argument should be 'yes' or 'no'")
+	}
+	return &val, nil
+}
+
+func parseHeaderMatch(m *config.Map, node config.Node) (interface{}, error) {
+	var (
+		match    headerMatch
+		senders  []string
+		minScore *float64
+	)
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Callback("authenticated", func(_ *config.Map, node config.Node) error {
+		val, err := parseOptionalBool(node)
+		match.authenticated = val
+		return err
+	})
+	cfg.Callback("quarantined", func(_ *config.Map, node config.Node) error {
+		val, err := parseOptionalBool(node)
+		match.quarantined = val
+		return err
+	})
+	cfg.StringList("sender", false, false, nil, &senders)
+	cfg.Callback("min_score", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "expected exactly one argument")
+		}
+		val, err := strconv.ParseFloat(node.Args[0], 64)
+		if err != nil {
+			return config.NodeErr(node, "invalid score: %v", err)
+		}
+		minScore = &val
+		return nil
+	})
+	cfg.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 1 && len(node.Args) != 2 {
+			return config.NodeErr(node, "expected field name and optional regexp")
+		}
+		field, err := parseFieldName(node, node.Args[0])
+		if err != nil {
+			return err
+		}
+		cond := headerCond{field: field}
+		if len(node.Args) == 2 {
+			cond.re, err = regexp.Compile(node.Args[1])
+			if err != nil {
+				return config.NodeErr(node, "invalid regexp: %v", err)
+			}
+		}
+		match.header = append(match.header, cond)
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	match.minScore = minScore
+	var err error
+	match.senders, err = normalizeAddrList(senders)
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid sender: %v", err)
+	}
+	return match, nil
+}
+
+func (m *header) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Custom("match", false, false, func() (interface{}, error) {
+		return headerMatch{}, nil
+	}, parseHeaderMatch, &m.match)
+	cfg.Callback("add", func(_ *config.Map, node config.Node) error {
+		return m.parseSetAction(headerAdd, node)
+	})
+	cfg.Callback("replace", func(_ *config.Map, node config.Node) error {
+		return m.parseSetAction(headerReplace, node)
+	})
+	cfg.Callback("remove", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "expected at least one field name")
+		}
+		action := headerAction{kind: headerRemove}
+		for _, name := range node.Args {
+			prefix := strings.HasSuffix(name, "*")
+			field, err := parseFieldName(node, strings.TrimSuffix(name, "*"))
+			if err != nil {
+				return err
+			}
+			if prefix {
+				field += "*"
+			}
+			action.fields = append(action.fields, field)
+		}
+		m.actions = append(m.actions, action)
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(m.actions) == 0 {
+		return config.NodeErr(cfg.Block, "at least one of add, replace or remove is required")
+	}
+	return nil
+}
+
+func (m *header) parseSetAction(kind headerActionKind, node config.Node) error {
+	if len(node.Args) != 2 {
+		return config.NodeErr(node, "expected field name and value")
+	}
+	field, err := parseFieldName(node, node.Args[0])
+	if err != nil {
+		return err
+	}
+	m.actions = append(m.actions, headerAction{
+		kind:     kind,
+		field:    field,
+		template: node.Args[1],
+	})
+	return nil
+}
+
+func (m *header) Name() string {
+	return "modify.header"
+}
+
+func (m *header) InstanceName() string {
+	return m.instName
+}
+
+type headerState struct {
+	m        *header
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	log      log.Logger
+}
+
+func (m *header) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &headerState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *headerState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	s.mailFrom = mailFrom
+	return mailFrom, nil
+}
+
+func (s *headerState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *headerState) totalScore() float64 {
+	var total float64
+	for _, score := range s.msgMeta.CheckScores {
+		total += score
+	}
+	return total
+}
+
+func (s *headerState) matches(h textproto.Header) bool {
+	match := s.m.match
+
+	if match.authenticated != nil {
+		authenticated := s.msgMeta.Conn != nil && s.msgMeta.Conn.AuthUser != ""
+		if authenticated != *match.authenticated {
+			return false
+		}
+	}
+	if match.quarantined != nil && s.msgMeta.Quarantine != *match.quarantined {
+		return false
+	}
+	if len(match.senders) != 0 && !matchAddr(match.senders, s.mailFrom) {
+		return false
+	}
+	if match.minScore != nil && s.totalScore() < *match.minScore {
+		return false
+	}
+	for _, cond := range match.header {
+		if !h.Has(cond.field) {
+			return false
+		}
+		if cond.re == nil {
+			continue
+		}
+		matched := false
+		for _, val := range h.Values(cond.field) {
+			if cond.re.MatchString(val) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeAddrList normalizes the list of addresses and domains for use
+// with matchAddr.
+func normalizeAddrList(entries []string) ([]string, error) {
+	res := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		var (
+			norm string
+			err  error
+		)
+		if strings.Contains(entry, "@") {
+			norm, err = address.ForLookup(entry)
+		} else {
+			norm, err = dns.ForLookup(entry)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry, err)
+		}
+		res = append(res, norm)
+	}
+	return res, nil
+}
+
+// matchAddr reports whether the address or its domain is in the list.
+func matchAddr(list []string, addr string) bool {
+	addr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil {
+		return false
+	}
+	for _, entry := range list {
+		if entry == addr || entry == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *headerState) expand(template string, h textproto.Header) string {
+	val := headerPlaceholderRe.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch name {
+		case "auth_user":
+			if s.msgMeta.Conn == nil {
+				return ""
+			}
+			return s.msgMeta.Conn.AuthUser
+		case "tls_client":
+			if s.msgMeta.Conn == nil {
+				return ""
+			}
+			return s.msgMeta.Conn.TLSClientIdentity
+		case "source_ip":
+			if s.msgMeta.Conn == nil {
+				return ""
+			}
+			tcpAddr, _ := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+			if tcpAddr == nil {
+				return ""
+			}
+			return tcpAddr.IP.String()
+		case "source_host":
+			if s.msgMeta.Conn == nil {
+				return ""
+			}
+			return s.msgMeta.Conn.Hostname
+		case "source_rdns":
+			if s.msgMeta.Conn == nil || s.msgMeta.Conn.RDNSName == nil {
+				return ""
+			}
+			valI, err := s.msgMeta.Conn.RDNSName.Get()
+			if err != nil || valI == nil {
+				return ""
+			}
+			return valI.(string)
+		case "msg_id":
+			return s.msgMeta.ID
+		case "trace_id":
+			return s.msgMeta.TraceID
+		case "sender":
+			return s.msgMeta.OriginalFrom
+		case "subject":
+			return h.Get("Subject")
+		case "quarantined":
+			if s.msgMeta.Quarantine {
+				return "yes"
+			}
+			return "no"
+		case "score":
+			return strconv.FormatFloat(s.totalScore(), 'f', -1, 64)
+		}
+		if checkName := strings.TrimSuffix(name, ".score"); checkName != name {
+			return strconv.FormatFloat(s.msgMeta.CheckScores[checkName], 'f', -1, 64)
+		}
+		return placeholder
+	})
+
+	// Do not let placeholder values inject additional header fields.
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(val)
+}
+
+func removeFields(h *textproto.Header, names []string) {
+	for fields := h.Fields(); fields.Next(); {
+		key := nettextproto.CanonicalMIMEHeaderKey(fields.Key())
+		for _, name := range names {
+			if prefix := strings.TrimSuffix(name, "*"); prefix != name {
+				if strings.HasPrefix(key, prefix) {
+					fields.Del()
+					break
+				}
+				continue
+			}
+			if key == name {
+				fields.Del()
+				break
+			}
+		}
+	}
+}
+
+func (s *headerState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.header/RewriteBody").End()
+
+	if !s.matches(*h) {
+		return nil
+	}
+
+	// Values are expanded using the original header so the result does not
+	// depend on the order of actions.
+	orig := h.Copy()
+	for _, action := range s.m.actions {
+		switch action.kind {
+		case headerAdd:
+			h.Add(action.field, s.expand(action.template, orig))
+		case headerReplace:
+			h.Set(action.field, s.expand(action.template, orig))
+		case headerRemove:
+			removeFields(h, action.fields)
+		}
+	}
+	s.log.DebugMsg("header modified", "actions", len(s.m.actions))
+	return nil
+}
+
+func (s *headerState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.header", NewHeader)
+}
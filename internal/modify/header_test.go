@@ -0,0 +1,154 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testHeader(t *testing.T, cfg []config.Node, msgMeta *module.MsgMetadata, mailFrom string, hdr textproto.Header) textproto.Header {
+	t.Helper()
+
+	mod, err := NewHeader("modify.header", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*header)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := m.ModStateForMsg(context.Background(), msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	if _, err := state.RewriteSender(context.Background(), mailFrom); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+		t.Fatal(err)
+	}
+	return hdr
+}
+
+func TestHeader(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	hdr.Add("User-Agent", "Mail Client 1.0")
+	hdr.Add("Received", "from [10.0.0.1]")
+	hdr.Add("X-Spam-Flag", "NO")
+	hdr.Add("X-Spam-Score", "1")
+
+	msgMeta := &module.MsgMetadata{
+		ID:          "msgid",
+		TraceID:     "traceid",
+		CheckScores: map[string]float64{"rspamd": 5.5, "other": 1},
+		Conn: &module.ConnState{
+			AuthUser:   "user@example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)},
+		},
+	}
+	res := testHeader(t, []config.Node{
+		{Name: "remove", Args: []string{"user-agent", "Received", "X-Spam-*"}},
+		{Name: "add", Args: []string{"X-Authenticated-User", "{auth_user} from {source_ip}"}},
+		{Name: "add", Args: []string{"X-Score", "{score} {rspamd.score} {missing.score} {unknown}"}},
+		{Name: "replace", Args: []string{"Subject", "[{trace_id}] {subject}"}},
+	}, msgMeta, "user@example.org", hdr)
+
+	for _, field := range []string{"User-Agent", "Received", "X-Spam-Flag", "X-Spam-Score"} {
+		if res.Has(field) {
+			t.Errorf("%s is not removed", field)
+		}
+	}
+	for field, want := range map[string]string{
+		"X-Authenticated-User": "user@example.org from 10.0.0.1",
+		"X-Score":              "6.5 5.5 0 {unknown}",
+		"Subject":              "[traceid] Hello",
+	} {
+		if got := res.Values(field); len(got) != 1 || got[0] != want {
+			t.Errorf("%s: want %q, got %q", field, want, got)
+		}
+	}
+}
+
+func TestHeader_Injection(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello\r\nBcc: victim@example.org")
+
+	res := testHeader(t, []config.Node{
+		{Name: "add", Args: []string{"X-Subject", "{subject}"}},
+	}, &module.MsgMetadata{}, "", hdr)
+	if res.Has("Bcc") {
+		t.Fatal("placeholder value injected a header field")
+	}
+	if got := res.Get("X-Subject"); got != "Hello  Bcc: victim@example.org" {
+		t.Fatalf("unexpected value: %q", got)
+	}
+}
+
+func TestHeader_Match(t *testing.T) {
+	authConn := &module.ConnState{AuthUser: "user"}
+
+	test := func(match []config.Node, msgMeta *module.MsgMetadata, mailFrom string, hdr textproto.Header, expected bool) {
+		t.Helper()
+		res := testHeader(t, []config.Node{
+			{Name: "match", Children: match},
+			{Name: "add", Args: []string{"X-Matched", "yes"}},
+		}, msgMeta, mailFrom, hdr)
+		if res.Has("X-Matched") != expected {
+			t.Errorf("match %v: want %v, got %v", match, expected, !expected)
+		}
+	}
+	subjHdr := func(subject string) textproto.Header {
+		hdr := textproto.Header{}
+		hdr.Add("Subject", subject)
+		return hdr
+	}
+
+	authenticated := []config.Node{{Name: "authenticated", Args: []string{"yes"}}}
+	test(authenticated, &module.MsgMetadata{Conn: authConn}, "", textproto.Header{}, true)
+	test(authenticated, &module.MsgMetadata{Conn: &module.ConnState{}}, "", textproto.Header{}, false)
+	test(authenticated, &module.MsgMetadata{}, "", textproto.Header{}, false)
+
+	sender := []config.Node{{Name: "sender", Args: []string{"example.org", "user@example.com"}}}
+	test(sender, &module.MsgMetadata{}, "a@EXAMPLE.org", textproto.Header{}, true)
+	test(sender, &module.MsgMetadata{}, "user@example.com", textproto.Header{}, true)
+	test(sender, &module.MsgMetadata{}, "other@example.com", textproto.Header{}, false)
+
+	score := []config.Node{{Name: "min_score", Args: []string{"5"}}}
+	test(score, &module.MsgMetadata{CheckScores: map[string]float64{"a": 3, "b": 2}}, "", textproto.Header{}, true)
+	test(score, &module.MsgMetadata{CheckScores: map[string]float64{"a": 3}}, "", textproto.Header{}, false)
+
+	header := []config.Node{{Name: "header", Args: []string{"subject", "^\\[ext\\]"}}}
+	test(header, &module.MsgMetadata{}, "", subjHdr("[ext] Hi"), true)
+	test(header, &module.MsgMetadata{}, "", subjHdr("Hi"), false)
+	test(header, &module.MsgMetadata{}, "", textproto.Header{}, false)
+
+	both := append(authenticated, header...)
+	test(both, &module.MsgMetadata{Conn: authConn}, "", subjHdr("[ext] Hi"), true)
+	test(both, &module.MsgMetadata{}, "", subjHdr("[ext] Hi"), false)
+}
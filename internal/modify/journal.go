@@ -0,0 +1,317 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	nettextproto "net/textproto"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	journalEnvelope = "envelope"
+	journalBCC      = "bcc"
+)
+
+// journal delivers copies of messages to the archive address for compliance
+// purposes.
+//
+// In the "bcc" format, the message is delivered as is. In the "envelope"
+// format, the message is attached to the report that also contains envelope
+// information (sender, all recipients including Bcc ones, etc) that is
+// otherwise lost.
+type journal struct {
+	instName string
+
+	target   module.DeliveryTarget
+	addr     string
+	format   string
+	from     string
+	hostname string
+	senders  []string
+	rcpts    []string
+	required bool
+
+	log log.Logger
+}
+
+func NewJournal(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &journal{
+		instName: instName,
+		log:      log.Logger{Name: "modify.journal"},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		m.addr = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("modify.journal: at most one argument is expected")
+	}
+	return m, nil
+}
+
+func (m *journal) Init(cfg *config.Map) error {
+	var senders, rcpts []string
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("hostname", true, true, "", &m.hostname)
+	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &m.target)
+	cfg.String("address", false, false, m.addr, &m.addr)
+	cfg.Enum("format", false, false, []string{journalEnvelope, journalBCC}, journalEnvelope, &m.format)
+	cfg.String("from", false, false, "", &m.from)
+	cfg.StringList("sender", false, false, nil, &senders)
+	cfg.StringList("rcpt", false, false, nil, &rcpts)
+	cfg.Bool("required", false, false, &m.required)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.addr == "" {
+		return config.NodeErr(cfg.Block, "address is required")
+	}
+	if _, _, err := address.Split(m.addr); err != nil {
+		return config.NodeErr(cfg.Block, "invalid address: %v", err)
+	}
+	if m.from == "" {
+		m.from = "postmaster@" + m.hostname
+	}
+
+	var err error
+	m.senders, err = normalizeAddrList(senders)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "invalid sender: %v", err)
+	}
+	m.rcpts, err = normalizeAddrList(rcpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "invalid rcpt: %v", err)
+	}
+	return nil
+}
+
+func (m *journal) Name() string {
+	return "modify.journal"
+}
+
+func (m *journal) InstanceName() string {
+	return m.instName
+}
+
+type journalState struct {
+	m        *journal
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+	log      log.Logger
+}
+
+func (m *journal) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &journalState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *journalState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	s.mailFrom = mailFrom
+	return mailFrom, nil
+}
+
+func (s *journalState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	s.rcpts = append(s.rcpts, rcptTo)
+	return []string{rcptTo}, nil
+}
+
+// matches reports whether the message should be journaled. If neither
+// sender nor recipient filters are set, all messages are journaled.
+func (s *journalState) matches() bool {
+	if len(s.m.senders) == 0 && len(s.m.rcpts) == 0 {
+		return true
+	}
+	if len(s.m.senders) != 0 && matchAddr(s.m.senders, s.mailFrom) {
+		return true
+	}
+	for _, rcpt := range s.rcpts {
+		if matchAddr(s.m.rcpts, rcpt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *journalState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.journal/RewriteBody").End()
+
+	if !s.matches() {
+		return nil
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	copyHdr, copyBody := h.Copy(), body
+	if s.m.format == journalEnvelope {
+		copyHdr, copyBody, err = s.envelopeReport(msgID, h.Copy(), body)
+		if err != nil {
+			return s.fail(err)
+		}
+	}
+
+	if err := s.deliver(ctx, msgID, copyHdr, copyBody); err != nil {
+		return s.fail(err)
+	}
+
+	s.log.DebugMsg("journaled", "journal_id", msgID)
+	return nil
+}
+
+// fail logs the journaling error and returns an error to reject the message
+// if journaling is required.
+func (s *journalState) fail(err error) error {
+	s.log.Error("journaling failed", err, "address", s.m.addr)
+	if !s.m.required {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error",
+		TargetName:   "modify.journal",
+		Err:          err,
+		Reason:       "journaling failed",
+	}
+}
+
+// deliver sends the copy using the null return path so delivery failures
+// are not reported to the original sender.
+func (s *journalState) deliver(ctx context.Context, msgID string, h textproto.Header, body buffer.Buffer) error {
+	msgMeta := &module.MsgMetadata{ID: msgID, TraceID: s.msgMeta.TraceID}
+	delivery, err := s.m.target.Start(ctx, msgMeta, "")
+	if err != nil {
+		return err
+	}
+	if err := delivery.AddRcpt(ctx, s.m.addr, smtp.RcptOptions{}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	if err := delivery.Body(ctx, h, body); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func (s *journalState) envelopeReport(msgID string, h textproto.Header, body buffer.Buffer) (textproto.Header, buffer.Buffer, error) {
+	var report bytes.Buffer
+	mw := multipart.NewWriter(&report)
+
+	textPart := make(nettextproto.MIMEHeader)
+	textPart.Set("Content-Type", "text/plain; charset=utf-8")
+	w, err := mw.CreatePart(textPart)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	sender := s.mailFrom
+	if sender == "" {
+		sender = "<>"
+	}
+	fmt.Fprintf(w, "Sender: %s\r\n", sender)
+	fmt.Fprintf(w, "Recipients: %s\r\n", strings.Join(s.rcpts, ", "))
+	if origID := h.Get("Message-Id"); origID != "" {
+		fmt.Fprintf(w, "Message-ID: %s\r\n", origID)
+	}
+	if s.msgMeta.TraceID != "" {
+		fmt.Fprintf(w, "Trace-ID: %s\r\n", s.msgMeta.TraceID)
+	}
+	if conn := s.msgMeta.Conn; conn != nil {
+		if conn.AuthUser != "" {
+			fmt.Fprintf(w, "Authenticated-User: %s\r\n", conn.AuthUser)
+		}
+		if tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+			fmt.Fprintf(w, "Source-IP: %s\r\n", tcpAddr.IP)
+		}
+	}
+
+	msgPart := make(nettextproto.MIMEHeader)
+	msgPart.Set("Content-Type", "message/rfc822")
+	msgPart.Set("Content-Disposition", "attachment")
+	w, err = mw.CreatePart(msgPart)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if err := textproto.WriteHeader(w, h); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	origSubject, err := (&mime.WordDecoder{}).DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		origSubject = h.Get("Subject")
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", s.m.from)
+	hdr.Add("To", s.m.addr)
+	hdr.Add("Subject", mime.QEncoding.Encode("utf-8", "Journal: "+origSubject))
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+s.m.hostname+">")
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", `multipart/mixed; boundary="`+mw.Boundary()+`"`)
+
+	return hdr, buffer.MemoryBuffer{Slice: report.Bytes()}, nil
+}
+
+func (s *journalState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.journal", NewJournal)
+}
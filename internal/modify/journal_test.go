@@ -0,0 +1,150 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testJournal(t *testing.T, m *journal, mailFrom string, rcpts ...string) error {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:      "test",
+		TraceID: "traceid",
+		Conn:    &module.ConnState{AuthUser: "user"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if _, err := state.RewriteSender(context.Background(), mailFrom); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range rcpts {
+		if _, err := state.RewriteRcpt(context.Background(), rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr, body := testutils.BodyFromStr(t, "Subject: Hello\r\nMessage-Id: <orig@example.org>\r\n\r\nHi!\r\n")
+	return state.RewriteBody(context.Background(), &hdr, body)
+}
+
+func TestJournal_Envelope(t *testing.T) {
+	tgt := &testutils.Target{}
+	m := &journal{
+		target:   tgt,
+		addr:     "journal@archive.example",
+		format:   journalEnvelope,
+		from:     "postmaster@mx.example.org",
+		hostname: "mx.example.org",
+		log:      testutils.Logger(t, "modify.journal"),
+	}
+	if err := testJournal(t, m, "sender@example.org", "to@example.com", "bcc@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 journal message, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "" {
+		t.Error("journal message should use null return path, got", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "journal@archive.example" {
+		t.Error("wrong journal recipients:", msg.RcptTo)
+	}
+	if msg.MsgMeta.TraceID != "traceid" {
+		t.Error("trace ID is not preserved")
+	}
+	if got := msg.Header.Get("Subject"); got != "Journal: Hello" {
+		t.Errorf("wrong subject: %q", got)
+	}
+	body := string(msg.Body)
+	for _, want := range []string{
+		"Sender: sender@example.org\r\n",
+		"Recipients: to@example.com, bcc@example.com\r\n",
+		"Message-ID: <orig@example.org>\r\n",
+		"Authenticated-User: user\r\n",
+		"Content-Type: message/rfc822\r\n",
+		"Subject: Hello\r\n",
+		"\r\n\r\nHi!\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("report does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestJournal_BCC(t *testing.T) {
+	tgt := &testutils.Target{}
+	m := &journal{
+		target: tgt,
+		addr:   "journal@archive.example",
+		format: journalBCC,
+		rcpts:  []string{"example.com"},
+		log:    testutils.Logger(t, "modify.journal"),
+	}
+
+	if err := testJournal(t, m, "sender@example.org", "to@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("non-matching message is journaled")
+	}
+
+	if err := testJournal(t, m, "sender@example.org", "to@example.net", "to@EXAMPLE.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 journal message, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if got := msg.Header.Get("Subject"); got != "Hello" {
+		t.Errorf("message is not copied as is, subject: %q", got)
+	}
+	if string(msg.Body) != "Hi!\r\n" {
+		t.Errorf("message is not copied as is, body: %q", msg.Body)
+	}
+}
+
+func TestJournal_Required(t *testing.T) {
+	tgt := &testutils.Target{StartErr: errors.New("no space left")}
+	m := &journal{
+		target: tgt,
+		addr:   "journal@archive.example",
+		format: journalBCC,
+		log:    testutils.Logger(t, "modify.journal"),
+	}
+	if err := testJournal(t, m, "sender@example.org", "to@example.com"); err != nil {
+		t.Fatal("unexpected error when journaling is not required:", err)
+	}
+
+	m.required = true
+	if err := testJournal(t, m, "sender@example.org", "to@example.com"); err == nil {
+		t.Fatal("expected an error when journaling is required")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// masquerade replaces sender addresses of outgoing messages with public
+// ones (e.g. user@host.internal with user@example.org) in the envelope and
+// in header fields.
+//
+// The table is looked up using the full address first and then using the
+// domain. If the replacement is a domain, only the domain part of the address
+// is replaced.
+type masquerade struct {
+	instName string
+
+	table    module.Table
+	envelope bool
+	headers  []string
+
+	log log.Logger
+}
+
+func NewMasquerade(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.masquerade: inline arguments are not used")
+	}
+	return &masquerade{
+		instName: instName,
+		log:      log.Logger{Name: "modify.masquerade"},
+	}, nil
+}
+
+func (m *masquerade) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	modconfig.Table(cfg, "table", false, true, nil, &m.table)
+	cfg.Bool("envelope", false, true, &m.envelope)
+	cfg.StringList("headers", false, false, []string{"From", "Sender", "Reply-To"}, &m.headers)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *masquerade) Name() string {
+	return "modify.masquerade"
+}
+
+func (m *masquerade) InstanceName() string {
+	return m.instName
+}
+
+// replacement returns the public address for the address. Empty string is
+// returned if the address should not be changed.
+func (m *masquerade) replacement(ctx context.Context, addr string) (string, error) {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil || normAddr == "" {
+		return "", nil
+	}
+
+	newAddr, ok, err := m.table.Lookup(ctx, normAddr)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		if !address.Valid(newAddr) {
+			return "", fmt.Errorf("modify.masquerade: refusing to use invalid address %s", newAddr)
+		}
+		return newAddr, nil
+	}
+
+	mbox, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return "", nil
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return "", nil
+	}
+	newDomain, ok, err := m.table.Lookup(ctx, normDomain)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", nil
+	}
+	if strings.Contains(newDomain, "@") {
+		newAddr = newDomain
+	} else {
+		if !address.ValidDomain(newDomain) {
+			return "", fmt.Errorf("modify.masquerade: refusing to use invalid domain %s", newDomain)
+		}
+		newAddr = mbox + "@" + newDomain
+	}
+	if !address.Valid(newAddr) {
+		return "", fmt.Errorf("modify.masquerade: refusing to use invalid address %s", newAddr)
+	}
+	return newAddr, nil
+}
+
+type masqueradeState struct {
+	m   *masquerade
+	log log.Logger
+}
+
+func (m *masquerade) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return masqueradeState{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s masqueradeState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if !s.m.envelope {
+		return mailFrom, nil
+	}
+	newAddr, err := s.m.replacement(ctx, mailFrom)
+	if err != nil {
+		return mailFrom, exterrors.WithTemporary(err, true)
+	}
+	if newAddr == "" {
+		return mailFrom, nil
+	}
+	s.log.DebugMsg("envelope sender masqueraded", "original", mailFrom, "new", newAddr)
+	return newAddr, nil
+}
+
+func (s masqueradeState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+// rewriteAddrList replaces addresses in the address list field value.
+// Empty string is returned if nothing is changed.
+func (s masqueradeState) rewriteAddrList(ctx context.Context, value string) (string, error) {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		s.log.DebugMsg("malformed address list, not rewriting", "value", value)
+		return "", nil
+	}
+
+	changed := false
+	parts := make([]string, 0, len(list))
+	for _, addr := range list {
+		newAddr, err := s.m.replacement(ctx, addr.Address)
+		if err != nil {
+			return "", err
+		}
+		if newAddr != "" {
+			addr.Address = newAddr
+			changed = true
+		}
+		parts = append(parts, addr.String())
+	}
+	if !changed {
+		return "", nil
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+func (s masqueradeState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.masquerade/RewriteBody").End()
+
+	for _, key := range s.m.headers {
+		values := h.Values(key)
+		if len(values) == 0 {
+			continue
+		}
+
+		changed := false
+		for i, value := range values {
+			newValue, err := s.rewriteAddrList(ctx, value)
+			if err != nil {
+				return exterrors.WithTemporary(err, true)
+			}
+			if newValue != "" {
+				values[i] = newValue
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		// Add prepends fields so add them in the reverse order to keep the
+		// original one.
+		h.Del(key)
+		for i := len(values) - 1; i >= 0; i-- {
+			h.Add(key, values[i])
+		}
+		s.log.DebugMsg("header field masqueraded", "field", key)
+	}
+	return nil
+}
+
+func (s masqueradeState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.masquerade", NewMasquerade)
+}
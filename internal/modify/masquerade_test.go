@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMasquerade(t *testing.T) {
+	m := &masquerade{
+		table: testutils.Table{M: map[string]string{
+			"root@host.internal": "admin@example.org",
+			"host.internal":      "example.org",
+			"bad.internal":       "example..org",
+		}},
+		envelope: true,
+		headers:  []string{"From", "Sender", "Reply-To"},
+		log:      log.Logger{Name: "modify.masquerade"},
+	}
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	for _, test := range []struct {
+		addr, want string
+	}{
+		{"User@host.internal", "User@example.org"},
+		{"root@HOST.internal", "admin@example.org"},
+		{"user@example.com", "user@example.com"},
+		{"", ""},
+	} {
+		got, err := state.RewriteSender(context.Background(), test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("RewriteSender(%q): want %q, got %q", test.addr, test.want, got)
+		}
+	}
+	if _, err := state.RewriteSender(context.Background(), "user@bad.internal"); err == nil {
+		t.Error("expected error for invalid replacement")
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Reply-To", "Team <team@host.internal>, other@example.com")
+	hdr.Add("From", `"Root User" <root@host.internal>`)
+	hdr.Add("To", "user@host.internal")
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{
+		"From":     `"Root User" <admin@example.org>`,
+		"Reply-To": `"Team" <team@example.org>, <other@example.com>`,
+		"To":       "user@host.internal",
+	} {
+		if got := hdr.Values(field); len(got) != 1 || got[0] != want {
+			t.Errorf("%s: want %q, got %q", field, want, got)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pgp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+	"golang.org/x/crypto/openpgp"
+)
+
+// AdminArgs are the arguments of "pgp.*" control commands.
+type AdminArgs struct {
+	CfgBlock string `json:"cfg_block"`
+	Address  string `json:"address,omitempty"`
+	// Key in binary or ASCII-armored format for pgp.import.
+	Key []byte `json:"key,omitempty"`
+}
+
+// KeyInfo describes the key in results of pgp.show, pgp.import and
+// pgp.fetch.
+type KeyInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Created     time.Time `json:"created"`
+	UserIDs     []string  `json:"user_ids"`
+}
+
+func keyInfo(entities openpgp.EntityList) []KeyInfo {
+	res := make([]KeyInfo, 0, len(entities))
+	for _, e := range entities {
+		info := KeyInfo{
+			Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint),
+			Created:     e.PrimaryKey.CreationTime,
+			UserIDs:     make([]string, 0, len(e.Identities)),
+		}
+		for name := range e.Identities {
+			info.UserIDs = append(info.UserIDs, name)
+		}
+		sort.Strings(info.UserIDs)
+		res = append(res, info)
+	}
+	return res
+}
+
+// pgpCommand wraps the handler for a command that operates on the module.
+// Address is required if needAddr is true.
+func pgpCommand(needAddr bool, f func(p *PGP, args AdminArgs) (interface{}, error)) control.Handler {
+	return func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		if needAddr && args.Address == "" {
+			return nil, fmt.Errorf("%s: address is required", modName)
+		}
+		if args.CfgBlock == "" {
+			return nil, fmt.Errorf("%s: cfg_block is required", modName)
+		}
+		mod, err := module.GetInstance(args.CfgBlock)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", modName, err)
+		}
+		p, ok := mod.(*PGP)
+		if !ok {
+			return nil, fmt.Errorf("%s: configuration block %s is not %s", modName, args.CfgBlock, modName)
+		}
+		return f(p, args)
+	}
+}
+
+func init() {
+	control.Register("pgp.list", pgpCommand(false, func(p *PGP, _ AdminArgs) (interface{}, error) {
+		addrs, err := p.Addresses()
+		if err != nil {
+			return nil, err
+		}
+		res := append([]string{}, addrs...)
+		sort.Strings(res)
+		return res, nil
+	}))
+	control.Register("pgp.show", pgpCommand(true, func(p *PGP, args AdminArgs) (interface{}, error) {
+		entities, ok, err := p.Get(context.TODO(), args.Address)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: no key for the address", modName)
+		}
+		return keyInfo(entities), nil
+	}))
+	control.Register("pgp.import", pgpCommand(true, func(p *PGP, args AdminArgs) (interface{}, error) {
+		entities, err := ParseKey(args.Key)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.Import(args.Address, args.Key); err != nil {
+			return nil, err
+		}
+		return keyInfo(entities), nil
+	}))
+	control.Register("pgp.fetch", pgpCommand(true, func(p *PGP, args AdminArgs) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		keyData, err := FetchWKD(ctx, &http.Client{Timeout: 30 * time.Second}, args.Address)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				return nil, fmt.Errorf("%s: the address has no key in Web Key Directory", modName)
+			}
+			return nil, err
+		}
+
+		entities, err := ParseKey(keyData)
+		if err != nil {
+			return nil, err
+		}
+		// Required by the WKD protocol.
+		if !HasAddress(entities, args.Address) {
+			return nil, fmt.Errorf("%s: key from Web Key Directory does not contain the address", modName)
+		}
+		if err := p.Import(args.Address, keyData); err != nil {
+			return nil, err
+		}
+		return keyInfo(entities), nil
+	}))
+	control.Register("pgp.remove", pgpCommand(true, func(p *PGP, args AdminArgs) (interface{}, error) {
+		return nil, p.Remove(args.Address)
+	}))
+}
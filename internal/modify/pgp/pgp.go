@@ -0,0 +1,373 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package pgp implements the modify.pgp_encrypt module that encrypts
+// messages using OpenPGP public keys of recipients before they are stored.
+package pgp
+
+import (
+	"bytes"
+	"context"
+	_ "crypto/sha256" // Used by openpgp.Encrypt.
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	nettextproto "net/textproto"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const modName = "modify.pgp_encrypt"
+
+type PGP struct {
+	instName string
+	log      log.Logger
+
+	keys module.MutableTable
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &PGP{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (p *PGP) Name() string {
+	return modName
+}
+
+func (p *PGP) InstanceName() string {
+	return p.instName
+}
+
+func (p *PGP) Init(cfg *config.Map) error {
+	var keys module.Table
+	cfg.Bool("debug", true, false, &p.log.Debug)
+	modconfig.Table(cfg, "keys", false, true, nil, &keys)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	mutable, ok := keys.(module.MutableTable)
+	if !ok {
+		return config.NodeErr(cfg.Block, "keys table should be mutable (e.g. sql_table)")
+	}
+	p.keys = mutable
+
+	return nil
+}
+
+// ParseKey reads the public key in the binary or ASCII-armored format and
+// checks that it can be used for encryption.
+func ParseKey(keyData []byte) (openpgp.EntityList, error) {
+	var (
+		entities openpgp.EntityList
+		err      error
+	)
+	if bytes.HasPrefix(bytes.TrimSpace(keyData), []byte("-----BEGIN")) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(keyData))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: malformed key: %w", modName, err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("%s: no keys found", modName)
+	}
+
+	// There is no other way to check whether the key has a valid
+	// encryption subkey.
+	w, err := openpgp.Encrypt(io.Discard, entities, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: key can't be used for encryption: %w", modName, err)
+	}
+	w.Close()
+
+	return entities, nil
+}
+
+// HasAddress checks whether any of user IDs of keys contains the address.
+func HasAddress(entities openpgp.EntityList, addr string) bool {
+	addr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	for _, e := range entities {
+		for _, ident := range e.Identities {
+			email, err := address.ForLookup(ident.UserId.Email)
+			if err == nil && email == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get returns the public key of the address.
+func (p *PGP) Get(ctx context.Context, addr string) (openpgp.EntityList, bool, error) {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	val, ok, err := p.keys.Lookup(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	entities, err := ParseKey([]byte(val))
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", key, err)
+	}
+	return entities, true, nil
+}
+
+// Import sets the public key used to encrypt messages for the address. The
+// key can be in the binary or ASCII-armored format. Only public parts of
+// keys are stored.
+func (p *PGP) Import(addr string, keyData []byte) error {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return err
+	}
+	entities, err := ParseKey(keyData)
+	if err != nil {
+		return err
+	}
+
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	for _, e := range entities {
+		if err := e.Serialize(w); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return p.keys.SetKey(key, armored.String())
+}
+
+// Remove disables encryption for the address.
+func (p *PGP) Remove(addr string) error {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return err
+	}
+	return p.keys.RemoveKey(key)
+}
+
+// Addresses returns the list of addresses that have keys.
+func (p *PGP) Addresses() ([]string, error) {
+	return p.keys.Keys()
+}
+
+type state struct {
+	p     *PGP
+	rcpts []string
+	log   log.Logger
+}
+
+func (p *PGP) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		p:   p,
+		log: target.DeliveryLogger(p.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	s.rcpts = append(s.rcpts, rcptTo)
+	return []string{rcptTo}, nil
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	// Not called since ModifyBody is implemented.
+	return nil
+}
+
+// isEncrypted checks whether the message is already encrypted using PGP/MIME
+// or S/MIME.
+func isEncrypted(h *textproto.Header) bool {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "multipart/encrypted":
+		return true
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return params["smime-type"] != "signed-data"
+	}
+	return false
+}
+
+// recipientKeys returns keys of all recipients. Nil is returned if any
+// recipient has no key since the message would be unreadable for them.
+func (s *state) recipientKeys(ctx context.Context) (openpgp.EntityList, error) {
+	var keys openpgp.EntityList
+	for _, rcpt := range s.rcpts {
+		rcptKeys, ok, err := s.p.Get(ctx, rcpt)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			s.log.DebugMsg("no key for recipient, not encrypting", "rcpt", rcpt)
+			return nil, nil
+		}
+		keys = append(keys, rcptKeys...)
+	}
+	return keys, nil
+}
+
+func (s *state) ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, modName+"/ModifyBody").End()
+
+	if len(s.rcpts) == 0 || isEncrypted(h) {
+		return body, nil
+	}
+	keys, err := s.recipientKeys(ctx)
+	if err != nil {
+		s.log.Error("key lookup failed, not encrypting", err)
+		return body, nil
+	}
+	if keys == nil {
+		return body, nil
+	}
+
+	outerHdr, encrypted, err := encrypt(*h, body, keys)
+	if err != nil {
+		s.log.Error("encryption failed, not encrypting", err)
+		return body, nil
+	}
+
+	*h = outerHdr
+	s.log.DebugMsg("message encrypted", "keys", len(keys))
+	return buffer.MemoryBuffer{Slice: encrypted}, nil
+}
+
+// encrypt creates the PGP/MIME (RFC 3156) message. Content-* fields are moved
+// into the encrypted part, other fields are kept as is so the message can
+// still be found by searching the header.
+func encrypt(h textproto.Header, body buffer.Buffer, keys openpgp.EntityList) (textproto.Header, []byte, error) {
+	outerHdr := h.Copy()
+	var contentFields [][2]string
+	for f := outerHdr.Fields(); f.Next(); {
+		if strings.HasPrefix(strings.ToLower(f.Key()), "content-") {
+			contentFields = append(contentFields, [2]string{f.Key(), f.Value()})
+			f.Del()
+		}
+	}
+	innerHdr := textproto.Header{}
+	for i := len(contentFields) - 1; i >= 0; i-- {
+		innerHdr.Add(contentFields[i][0], contentFields[i][1])
+	}
+
+	var res bytes.Buffer
+	mw := multipart.NewWriter(&res)
+
+	versionPart, err := mw.CreatePart(nettextproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if _, err := io.WriteString(versionPart, "Version: 1\r\n"); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	encPart, err := mw.CreatePart(nettextproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	// armor uses LF line endings.
+	var armored bytes.Buffer
+	armorW, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	plainW, err := openpgp.Encrypt(armorW, keys, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if err := textproto.WriteHeader(plainW, innerHdr); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(plainW, r); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if err := plainW.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if err := armorW.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	armored.WriteString("\n")
+	if _, err := encPart.Write(bytes.ReplaceAll(armored.Bytes(), []byte("\n"), []byte("\r\n"))); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	outerHdr.Set("MIME-Version", "1.0")
+	outerHdr.Set("Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": mw.Boundary(),
+	}))
+	return outerHdr, res.Bytes(), nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
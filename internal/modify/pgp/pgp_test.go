@@ -0,0 +1,217 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (t mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t.M))
+	for k := range t.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t mutableTable) SetKey(k, v string) error {
+	t.M[k] = v
+	return nil
+}
+
+func (t mutableTable) RemoveKey(k string) error {
+	delete(t.M, k)
+	return nil
+}
+
+func testPGP(t *testing.T) (*PGP, *openpgp.Entity) {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity("Test", "", "test@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NewEntity does not set algorithm preferences as other implementations
+	// do.
+	for _, ident := range entity.Identities {
+		ident.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		if err := ident.SelfSignature.SignUserId(ident.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pubKey bytes.Buffer
+	if err := entity.Serialize(&pubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &PGP{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		keys:     mutableTable{testutils.Table{M: map[string]string{}}},
+	}
+	if err := p.Import("Test@example.org", pubKey.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return p, entity
+}
+
+func modifyBody(t *testing.T, p *PGP, rcpts []string, msg string) (textproto.Header, []byte) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader(strings.ReplaceAll(msg, "\n", "\r\n")))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := p.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for _, rcpt := range rcpts {
+		if _, err := st.RewriteRcpt(context.Background(), rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, err := module.RewriteBody(context.Background(), st, &hdr, buffer.MemoryBuffer{Slice: blob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := body.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBlob, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, newBlob
+}
+
+const testMsg = `From: <sender@example.com>
+To: <test@example.org>
+Subject: Secret
+Content-Type: text/plain; charset=utf-8
+
+Hello!
+`
+
+func TestEncrypt(t *testing.T) {
+	p, entity := testPGP(t)
+
+	hdr, body := modifyBody(t, p, []string{"test@example.org"}, testMsg)
+	if hdr.Get("Subject") != "Secret" || hdr.Get("From") != "<sender@example.com>" {
+		t.Error("header fields are not preserved")
+	}
+
+	ent, err := message.New(message.Header{Header: hdr}, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := ent.Header.ContentType()
+	if mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("unexpected Content-Type: %s %v", mediaType, params)
+	}
+	mr := ent.MultipartReader()
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	encPart, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := openpgp.ReadMessage(armorReader(t, encPart.Body), openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Content-Type: text/plain; charset=utf-8\r\n\r\nHello!\r\n"
+	if string(plain) != want {
+		t.Errorf("unexpected plaintext: %q", plain)
+	}
+}
+
+func TestEncrypt_Skip(t *testing.T) {
+	p, _ := testPGP(t)
+
+	// Other recipient has no key, message would be unreadable for them.
+	hdr, _ := modifyBody(t, p, []string{"test@example.org", "other@example.org"}, testMsg)
+	if !strings.HasPrefix(hdr.Get("Content-Type"), "text/plain") {
+		t.Error("message is encrypted for recipient without key")
+	}
+
+	encrypted := strings.Replace(testMsg, "text/plain; charset=utf-8", `multipart/encrypted; protocol="application/pgp-encrypted"; boundary=b`, 1)
+	hdr, _ = modifyBody(t, p, []string{"test@example.org"}, encrypted)
+	if !strings.Contains(hdr.Get("Content-Type"), "boundary=b") {
+		t.Error("encrypted message is encrypted again")
+	}
+}
+
+func TestWKDURLs(t *testing.T) {
+	// Example from draft-koch-openpgp-webkey-service.
+	urls, err := wkdURLs("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+		"https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+	}
+	for i := range want {
+		if urls[i] != want[i] {
+			t.Errorf("want %s, got %s", want[i], urls[i])
+		}
+	}
+}
+
+func armorReader(t *testing.T, r io.Reader) io.Reader {
+	t.Helper()
+
+	block, err := armor.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block.Body
+}
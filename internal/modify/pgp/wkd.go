@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pgp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// Max. size of the key returned by the Web Key Directory.
+const wkdMaxKeySize = 256 * 1024
+
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+// ErrKeyNotFound is returned by FetchWKD if there is no key for the address.
+var ErrKeyNotFound = errors.New("pgp: key not found in WKD")
+
+// wkdURLs returns URLs of the key for the address using advanced and direct
+// methods of the OpenPGP Web Key Directory protocol.
+func wkdURLs(addr string) ([]string, error) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return nil, err
+	}
+	if mbox == "" || domain == "" {
+		return nil, fmt.Errorf("pgp: invalid address: %s", addr)
+	}
+	domain = strings.ToLower(domain)
+
+	hash := sha1.Sum([]byte(strings.ToLower(mbox)))
+	hu := zbase32.EncodeToString(hash[:])
+	query := "?l=" + url.QueryEscape(mbox)
+
+	return []string{
+		"https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/hu/" + hu + query,
+		"https://" + domain + "/.well-known/openpgpkey/hu/" + hu + query,
+	}, nil
+}
+
+// FetchWKD fetches the public key of the address from the OpenPGP Web Key
+// Directory of its domain.
+func FetchWKD(ctx context.Context, client *http.Client, addr string) ([]byte, error) {
+	urls, err := wkdURLs(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error = ErrKeyNotFound
+	for _, u := range urls {
+		key, err := fetchKey(ctx, client, u)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.Is(err, ErrKeyNotFound) {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+func fetchKey(ctx context.Context, client *http.Client, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrKeyNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("pgp: %s: unexpected status: %s", u, resp.Status)
+	}
+
+	key, err := io.ReadAll(io.LimitReader(resp.Body, wkdMaxKeySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > wkdMaxKeySize {
+		return nil, fmt.Errorf("pgp: %s: key is too big", u)
+	}
+	return key, nil
+}
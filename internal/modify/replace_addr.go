@@ -19,8 +19,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package modify
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/emersion/go-message/textproto"
@@ -44,8 +48,22 @@ type replaceAddr struct {
 	replaceSender bool
 	replaceRcpt   bool
 	table         module.MultiTable
+	regexps       []aliasRegexp
+
+	recursive  bool
+	maxDepth   int
+	includeDir string
+}
+
+// aliasRegexp is the regexp rule defined using the regexp directive.
+// Replacements can refer to capture groups of the expression ($1, ${name}).
+type aliasRegexp struct {
+	re           *regexp.Regexp
+	replacements []string
 }
 
+const includePrefix = ":include:"
+
 func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Module, error) {
 	r := replaceAddr{
 		modName:       modName,
@@ -59,7 +77,51 @@ func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Mo
 }
 
 func (r *replaceAddr) Init(cfg *config.Map) error {
-	return modconfig.ModuleFromNode("table", r.inlineArgs, cfg.Block, cfg.Globals, &r.table)
+	if len(r.inlineArgs) != 0 {
+		return modconfig.ModuleFromNode("table", r.inlineArgs, cfg.Block, cfg.Globals, &r.table)
+	}
+
+	// Block form: replace_rcpt { table ...; regexp ... }
+	cfg.Custom("table", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var tbl module.MultiTable
+		err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl)
+		return tbl, err
+	}, &r.table)
+	cfg.Callback("regexp", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected regexp and at least one replacement")
+		}
+		re, err := regexp.Compile("^(?:" + node.Args[0] + ")$")
+		if err != nil {
+			return config.NodeErr(node, "invalid regexp: %v", err)
+		}
+		r.regexps = append(r.regexps, aliasRegexp{
+			re:           re,
+			replacements: node.Args[1:],
+		})
+		return nil
+	})
+	cfg.Bool("recursive", false, false, &r.recursive)
+	cfg.Int("max_depth", false, false, 10, &r.maxDepth)
+	cfg.String("include_dir", false, false, "", &r.includeDir)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if r.table == nil && len(r.regexps) == 0 {
+		return fmt.Errorf("%s: at least one table or regexp is required", r.modName)
+	}
+	if r.maxDepth < 1 {
+		return fmt.Errorf("%s: max_depth should be positive", r.modName)
+	}
+	if r.includeDir != "" {
+		var err error
+		r.includeDir, err = filepath.Abs(r.includeDir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.modName, err)
+		}
+	}
+	return nil
 }
 
 func (r replaceAddr) Name() string {
@@ -101,53 +163,230 @@ func (r replaceAddr) Close() error {
 }
 
 func (r replaceAddr) rewrite(ctx context.Context, val string) ([]string, error) {
+	if !r.recursive {
+		results, _, err := r.lookup(ctx, val)
+		return results, err
+	}
+
+	var (
+		results []string
+		seen    = make(map[string]struct{})
+	)
+	err := r.expand(ctx, val, 0, make(map[string]struct{}), func(addr string) {
+		if _, ok := seen[addr]; ok {
+			return
+		}
+		seen[addr] = struct{}{}
+		results = append(results, addr)
+	})
+	if err != nil {
+		return []string{val}, err
+	}
+	return results, nil
+}
+
+// expand recursively replaces the address until there are no replacements
+// for the resulting addresses.
+//
+// path contains addresses that are being expanded, an address that expands
+// to itself (directly or via other aliases) is used as is, this allows
+// aliases like "user: user, archive".
+func (r replaceAddr) expand(ctx context.Context, val string, depth int, path map[string]struct{}, emit func(string)) error {
 	normAddr, err := address.ForLookup(val)
 	if err != nil {
-		return []string{val}, fmt.Errorf("malformed address: %v", err)
+		return fmt.Errorf("malformed address: %v", err)
+	}
+	if _, ok := path[normAddr]; ok {
+		emit(val)
+		return nil
 	}
 
-	replacements, err := r.table.LookupMulti(ctx, normAddr)
+	replacements, matched, err := r.lookup(ctx, val)
 	if err != nil {
-		return []string{val}, err
+		return err
+	}
+	if !matched {
+		emit(val)
+		return nil
+	}
+	if depth >= r.maxDepth {
+		return fmt.Errorf("alias expansion depth limit exceeded for %s", val)
+	}
+
+	path[normAddr] = struct{}{}
+	defer delete(path, normAddr)
+	for _, replacement := range replacements {
+		if err := r.expand(ctx, replacement, depth+1, path, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup does a single replacement step. If there is no replacement for the
+// address, it is returned as is and matched is false.
+func (r replaceAddr) lookup(ctx context.Context, val string) (results []string, matched bool, err error) {
+	normAddr, err := address.ForLookup(val)
+	if err != nil {
+		return []string{val}, false, fmt.Errorf("malformed address: %v", err)
+	}
+
+	var replacements []string
+	if r.table != nil {
+		replacements, err = r.table.LookupMulti(ctx, normAddr)
+		if err != nil {
+			return []string{val}, false, err
+		}
 	}
 	if len(replacements) > 0 {
+		replacements, err = r.readIncludes(replacements, normAddr)
+		if err != nil {
+			return []string{val}, false, err
+		}
 		for _, replacement := range replacements {
 			if !address.Valid(replacement) {
-				return []string{""}, fmt.Errorf("refusing to replace recipient with the invalid address %s", replacement)
+				return []string{""}, false, fmt.Errorf("refusing to replace recipient with the invalid address %s", replacement)
 			}
 		}
-		return replacements, nil
+		return replacements, true, nil
 	}
 
 	mbox, domain, err := address.Split(normAddr)
 	if err != nil {
 		// If we have malformed address here, something is really wrong, but let's
 		// ignore it silently then anyway.
-		return []string{val}, nil
+		return []string{val}, false, nil
 	}
 
 	// mbox is already normalized, since it is a part of address.ForLookup
 	// result.
-	replacements, err = r.table.LookupMulti(ctx, mbox)
-	if err != nil {
-		return []string{val}, err
+	if r.table != nil {
+		replacements, err = r.table.LookupMulti(ctx, mbox)
+		if err != nil {
+			return []string{val}, false, err
+		}
 	}
 	if len(replacements) > 0 {
+		replacements, err = r.readIncludes(replacements, normAddr)
+		if err != nil {
+			return []string{val}, false, err
+		}
 		var results = make([]string, len(replacements))
 		for i, replacement := range replacements {
 			if strings.Contains(replacement, "@") && !strings.HasPrefix(replacement, `"`) && !strings.HasSuffix(replacement, `"`) {
 				if !address.Valid(replacement) {
-					return []string{""}, fmt.Errorf("refusing to replace recipient with invalid address %s", replacement)
+					return []string{""}, false, fmt.Errorf("refusing to replace recipient with invalid address %s", replacement)
 				}
 				results[i] = replacement
 			} else {
 				results[i] = replacement + "@" + domain
 			}
 		}
-		return results, nil
+		return results, true, nil
+	}
+
+	for _, rule := range r.regexps {
+		match := rule.re.FindStringSubmatchIndex(normAddr)
+		if match == nil {
+			continue
+		}
+		results := make([]string, 0, len(rule.replacements))
+		for _, replacement := range rule.replacements {
+			results = append(results, string(rule.re.ExpandString(nil, replacement, normAddr, match)))
+		}
+		results, err = r.readIncludes(results, normAddr)
+		if err != nil {
+			return []string{val}, false, err
+		}
+		for _, result := range results {
+			if !address.Valid(result) {
+				return []string{""}, false, fmt.Errorf("refusing to replace recipient with invalid address %s", result)
+			}
+		}
+		return results, true, nil
 	}
 
-	return []string{val}, nil
+	return []string{val}, false, nil
+}
+
+// readIncludes replaces ":include:path" values with the list of addresses
+// read from the file. Entries without the domain part get the domain of
+// the address being replaced.
+func (r replaceAddr) readIncludes(values []string, normAddr string) ([]string, error) {
+	hasIncludes := false
+	for _, val := range values {
+		if strings.HasPrefix(val, includePrefix) {
+			hasIncludes = true
+			break
+		}
+	}
+	if !hasIncludes {
+		return values, nil
+	}
+
+	results := make([]string, 0, len(values))
+	for _, val := range values {
+		if !strings.HasPrefix(val, includePrefix) {
+			results = append(results, val)
+			continue
+		}
+		included, err := r.readInclude(strings.TrimPrefix(val, includePrefix))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range included {
+			if !strings.Contains(entry, "@") {
+				_, domain, err := address.Split(normAddr)
+				if err == nil && domain != "" {
+					entry += "@" + domain
+				}
+			}
+			results = append(results, entry)
+		}
+	}
+	return results, nil
+}
+
+func (r replaceAddr) readInclude(path string) ([]string, error) {
+	if r.includeDir == "" {
+		return nil, fmt.Errorf("include files are not allowed, include_dir is not set")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.includeDir, path)
+	}
+	path = filepath.Clean(path)
+	if rel, err := filepath.Rel(r.includeDir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("include file %s is outside of include_dir", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results []string
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if strings.HasPrefix(entry, includePrefix) {
+				return nil, fmt.Errorf("%s: nested include files are not allowed", path)
+			}
+			results = append(results, entry)
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
 func init() {
@@ -20,7 +20,10 @@ package modify
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"testing"
 
 	"github.com/foxcpp/maddy/framework/config"
@@ -112,3 +115,58 @@ func TestReplaceAddr_RewriteSender(t *testing.T) {
 func TestReplaceAddr_RewriteRcpt(t *testing.T) {
 	testReplaceAddr(t, "modify.replace_rcpt")
 }
+
+func TestReplaceAddr_Recursive(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "staff"), []byte("# Staff members\nalice@example.org, bob\n\ncarol@example.org\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := replaceAddr{
+		modName:     "modify.replace_rcpt",
+		replaceRcpt: true,
+		recursive:   true,
+		maxDepth:    3,
+		includeDir:  dir,
+		table: testutils.MultiTable{M: map[string][]string{
+			"info@example.org":   {"team@example.org"},
+			"team@example.org":   {"alice@example.org", "dave@example.org"},
+			"alice@example.org":  {"alice@example.org", "archive@example.org"},
+			"staff@example.org":  {":include:staff"},
+			"loop1@example.org":  {"loop2@example.org"},
+			"loop2@example.org":  {"loop1@example.org"},
+			"deep1@example.org":  {"deep2@example.org"},
+			"deep2@example.org":  {"deep3@example.org"},
+			"deep3@example.org":  {"deep4@example.org"},
+			"deep4@example.org":  {"deep5@example.org"},
+			"escape@example.org": {":include:../passwd"},
+		}},
+		regexps: []aliasRegexp{{
+			re:           regexp.MustCompile(`^(?:(.+)@old\.example\.org)$`),
+			replacements: []string{"$1@example.org"},
+		}},
+	}
+
+	test := func(addr string, expected []string) {
+		t.Helper()
+		actual, err := r.RewriteRcpt(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("want %s, got %s", expected, actual)
+		}
+	}
+
+	test("info@example.org", []string{"alice@example.org", "archive@example.org", "dave@example.org"})
+	test("staff@example.org", []string{"alice@example.org", "archive@example.org", "bob@example.org", "carol@example.org"})
+	test("loop1@example.org", []string{"loop1@example.org"})
+	test("team@old.example.org", []string{"alice@example.org", "archive@example.org", "dave@example.org"})
+	test("other@example.org", []string{"other@example.org"})
+
+	for _, addr := range []string{"deep1@example.org", "escape@example.org"} {
+		if _, err := r.RewriteRcpt(context.Background(), addr); err == nil {
+			t.Errorf("expected an error for %s", addr)
+		}
+	}
+}
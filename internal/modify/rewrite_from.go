@@ -0,0 +1,206 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	rewriteFromDMARC  = "dmarc"
+	rewriteFromAlways = "always"
+)
+
+// rewriteFrom replaces the RFC 5322.From address of redistributed messages
+// with an address at the forwarder domain so they pass DMARC checks at the
+// destination (RFC 6377, Section 4.1.3 and common mailing list practice).
+//
+// The original address is kept in Reply-To (unless already present) and
+// X-Original-From fields.
+type rewriteFrom struct {
+	instName string
+
+	address   string
+	domain    string
+	mode      string
+	localDoms map[string]struct{}
+	resolver  dmarc.Resolver
+
+	log log.Logger
+}
+
+func NewRewriteFrom(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &rewriteFrom{
+		instName: instName,
+		resolver: dns.DefaultResolver(),
+		log:      log.Logger{Name: "modify.rewrite_from"},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		m.address = inlineArgs[0]
+	default:
+		return nil, errors.New("modify.rewrite_from: at most one argument is expected")
+	}
+	return m, nil
+}
+
+func (m *rewriteFrom) Init(cfg *config.Map) error {
+	var localDoms []string
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("address", false, false, m.address, &m.address)
+	cfg.Enum("mode", false, false, []string{rewriteFromDMARC, rewriteFromAlways}, rewriteFromDMARC, &m.mode)
+	cfg.StringList("exclude_domains", false, false, nil, &localDoms)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.address == "" {
+		return config.NodeErr(cfg.Block, "address is required")
+	}
+	_, domain, err := address.Split(m.address)
+	if err != nil || domain == "" {
+		return config.NodeErr(cfg.Block, "invalid address: %s", m.address)
+	}
+	m.domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "invalid address domain: %v", err)
+	}
+
+	m.localDoms = make(map[string]struct{}, len(localDoms)+1)
+	m.localDoms[m.domain] = struct{}{}
+	for _, d := range localDoms {
+		dom, err := dns.ForLookup(d)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid domain %s: %v", d, err)
+		}
+		m.localDoms[dom] = struct{}{}
+	}
+	return nil
+}
+
+func (m *rewriteFrom) Name() string {
+	return "modify.rewrite_from"
+}
+
+func (m *rewriteFrom) InstanceName() string {
+	return m.instName
+}
+
+type rewriteFromState struct {
+	m   *rewriteFrom
+	log log.Logger
+}
+
+func (m *rewriteFrom) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return rewriteFromState{m: m, log: target.DeliveryLogger(m.log, msgMeta)}, nil
+}
+
+func (s rewriteFromState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s rewriteFromState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+// needsRewrite checks whether the From domain publishes a DMARC policy
+// that would cause the redistributed message to be rejected or quarantined.
+func (s rewriteFromState) needsRewrite(ctx context.Context, domain string) bool {
+	if s.m.mode == rewriteFromAlways {
+		return true
+	}
+
+	policyDomain, rec, err := dmarc.FetchRecord(ctx, s.m.resolver, domain)
+	if err != nil {
+		// Better be safe than have the message rejected at the destination.
+		s.log.Error("DMARC policy lookup failed, rewriting", err, "domain", domain)
+		return true
+	}
+	if rec == nil {
+		return false
+	}
+	policy := rec.Policy
+	if policyDomain != domain && rec.SubdomainPolicy != "" {
+		policy = rec.SubdomainPolicy
+	}
+	return policy == dmarc.PolicyReject || policy == dmarc.PolicyQuarantine
+}
+
+func (s rewriteFromState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.rewrite_from/RewriteBody").End()
+
+	origFrom := h.Get("From")
+	fromList, err := mail.ParseAddressList(origFrom)
+	if err != nil || len(fromList) != 1 {
+		s.log.Msg("malformed From field, not rewriting", "from", origFrom)
+		return nil
+	}
+	from := fromList[0]
+	_, domain, err := address.Split(from.Address)
+	if err != nil || domain == "" {
+		return nil
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return nil
+	}
+	if _, ok := s.m.localDoms[domain]; ok {
+		return nil
+	}
+	if !s.needsRewrite(ctx, domain) {
+		return nil
+	}
+
+	name := from.Name
+	if name == "" {
+		name = from.Address
+	}
+	newFrom := mail.Address{Name: name + " via " + s.m.domain, Address: s.m.address}
+
+	if h.Get("Reply-To") == "" {
+		h.Set("Reply-To", origFrom)
+	}
+	h.Set("X-Original-From", origFrom)
+	h.Set("From", newFrom.String())
+
+	s.log.DebugMsg("rewritten From", "original", from.Address)
+	return nil
+}
+
+func (s rewriteFromState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.rewrite_from", NewRewriteFrom)
+}
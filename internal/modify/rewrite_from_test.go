@@ -0,0 +1,85 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestRewriteFrom(t *testing.T) {
+	mod, err := NewRewriteFrom("modify.rewrite_from", "", nil, []string{"list@forwarder.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*rewriteFrom)
+	if err := m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "exclude_domains", Args: []string{"local.example"}},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	m.resolver = &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"_dmarc.strict.example.":  {TXT: []string{"v=DMARC1; p=reject"}},
+		"_dmarc.relaxed.example.": {TXT: []string{"v=DMARC1; p=none"}},
+		"_dmarc.local.example.":   {TXT: []string{"v=DMARC1; p=reject"}},
+	}}
+
+	test := func(from, replyTo, expectFrom, expectReplyTo string) {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", from)
+		if replyTo != "" {
+			hdr.Add("Reply-To", replyTo)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := hdr.Get("From"); got != expectFrom {
+			t.Errorf("%s: expected From %q, got %q", from, expectFrom, got)
+		}
+		if got := hdr.Get("Reply-To"); got != expectReplyTo {
+			t.Errorf("%s: expected Reply-To %q, got %q", from, expectReplyTo, got)
+		}
+	}
+
+	test(`"Alice" <alice@strict.example>`, "",
+		`"Alice via forwarder.example" <list@forwarder.example>`, `"Alice" <alice@strict.example>`)
+	test(`<alice@strict.example>`, "<other@strict.example>",
+		`"alice@strict.example via forwarder.example" <list@forwarder.example>`, "<other@strict.example>")
+	test(`<alice@relaxed.example>`, "", `<alice@relaxed.example>`, "")
+	test(`<alice@local.example>`, "", `<alice@local.example>`, "")
+	test(`<alice@nodmarc.example>`, "", `<alice@nodmarc.example>`, "")
+
+	m.mode = rewriteFromAlways
+	test(`<alice@relaxed.example>`, "",
+		`"alice@relaxed.example via forwarder.example" <list@forwarder.example>`, `<alice@relaxed.example>`)
+}
@@ -0,0 +1,183 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smime
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// signingCert is the certificate chain with the private key used to sign
+// messages for a domain.
+type signingCert struct {
+	chain []*x509.Certificate
+	key   crypto.Signer
+}
+
+type certFiles struct {
+	certPath string
+	keyPath  string
+}
+
+type cachedCert struct {
+	certMod, keyMod time.Time
+	cert            *signingCert
+	lastWarning     time.Time
+}
+
+// certStore loads certificates on use and reloads them if files change, so
+// certificates can be renewed without restarting the server.
+type certStore struct {
+	domains       map[string]certFiles
+	dir           string
+	expiryWarning time.Duration
+	log           *log.Logger
+
+	lock  sync.Mutex
+	cache map[string]*cachedCert
+}
+
+// files returns paths to the certificate and key for the normalized domain.
+func (cs *certStore) files(domain string) (certFiles, bool) {
+	if files, ok := cs.domains[domain]; ok {
+		return files, true
+	}
+	if cs.dir == "" {
+		return certFiles{}, false
+	}
+	files := certFiles{
+		certPath: filepath.Join(cs.dir, domain+".crt"),
+		keyPath:  filepath.Join(cs.dir, domain+".key"),
+	}
+	if _, err := os.Stat(files.certPath); err != nil {
+		return certFiles{}, false
+	}
+	return files, true
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func loadCert(files certFiles) (*signingCert, error) {
+	pair, err := tls.LoadX509KeyPair(files.certPath, files.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("smime: %s: unsupported key type", files.keyPath)
+	}
+	cert := &signingCert{key: key}
+	for _, der := range pair.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("smime: %s: %w", files.certPath, err)
+		}
+		cert.chain = append(cert.chain, c)
+	}
+	return cert, nil
+}
+
+// Get returns the certificate for the normalized domain. Nil is returned if
+// there is no certificate for it.
+func (cs *certStore) Get(domain string) (*signingCert, error) {
+	files, ok := cs.files(domain)
+	if !ok {
+		return nil, nil
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	certMod, err := modTime(files.certPath)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+	keyMod, err := modTime(files.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+
+	cached, ok := cs.cache[files.certPath]
+	if !ok || !cached.certMod.Equal(certMod) || !cached.keyMod.Equal(keyMod) {
+		cert, err := loadCert(files)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkUsage(cert.chain[0]); err != nil {
+			return nil, fmt.Errorf("smime: %s: %w", files.certPath, err)
+		}
+		if ok {
+			cs.log.Msg("certificate reloaded", "domain", domain, "path", files.certPath)
+		}
+		cached = &cachedCert{certMod: certMod, keyMod: keyMod, cert: cert}
+		cs.cache[files.certPath] = cached
+	}
+
+	if err := cs.checkExpiry(domain, cached, time.Now()); err != nil {
+		return nil, err
+	}
+	return cached.cert, nil
+}
+
+// checkExpiry returns an error if the certificate is expired or not valid
+// yet and logs a warning (at most once a day) if it expires soon.
+//
+// Should be called with cs.lock held.
+func (cs *certStore) checkExpiry(domain string, cached *cachedCert, now time.Time) error {
+	leaf := cached.cert.chain[0]
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("smime: certificate for %s expired at %v", domain, leaf.NotAfter)
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("smime: certificate for %s is not valid until %v", domain, leaf.NotBefore)
+	}
+	if leaf.NotAfter.Sub(now) < cs.expiryWarning && now.Sub(cached.lastWarning) >= 24*time.Hour {
+		cs.log.Msg("certificate expires soon", "domain", domain, "not_after", leaf.NotAfter)
+		cached.lastWarning = now
+	}
+	return nil
+}
+
+// checkUsage verifies that the certificate can be used to sign messages.
+func checkUsage(cert *x509.Certificate) error {
+	if len(cert.ExtKeyUsage) == 0 {
+		return nil
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageEmailProtection || usage == x509.ExtKeyUsageAny {
+			return nil
+		}
+	}
+	return errors.New("certificate is not valid for email protection")
+}
@@ -0,0 +1,211 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"sort"
+	"time"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA2 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// ASN.1 structures from RFC 5652 (Cryptographic Message Syntax). Only the
+// subset needed to create detached signatures is defined.
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      asn1.RawValue
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// derSet encodes elements as DER SET OF, elements are sorted by their
+// encodings as DER requires.
+func derSet(class, tag int, elements [][]byte) asn1.RawValue {
+	sorted := make([][]byte, len(elements))
+	copy(sorted, elements)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	return asn1.RawValue{
+		Class:      class,
+		Tag:        tag,
+		IsCompound: true,
+		Bytes:      bytes.Join(sorted, nil),
+	}
+}
+
+func newAttribute(typ asn1.ObjectIdentifier, value interface{}) ([]byte, error) {
+	encValue, err := asn1.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(attribute{
+		Type:   typ,
+		Values: derSet(asn1.ClassUniversal, asn1.TagSet, [][]byte{encValue}),
+	})
+}
+
+// signDetached creates the DER-encoded CMS SignedData structure with
+// the detached signature of content. chain[0] is the signer certificate,
+// other certificates are included to help recipients build the chain.
+func signDetached(content []byte, chain []*x509.Certificate, key crypto.Signer, now time.Time) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("smime: no certificates")
+	}
+	cert := chain[0]
+
+	var sigAlgo pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlgo = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlgo = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA2}
+	default:
+		return nil, errors.New("smime: unsupported key type, only RSA and ECDSA are supported")
+	}
+
+	digest := sha256.Sum256(content)
+	var attrs [][]byte
+	for _, attr := range []struct {
+		typ   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidSigningTime, now.UTC()},
+		{oidMessageDigest, digest[:]},
+	} {
+		encAttr, err := newAttribute(attr.typ, attr.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, encAttr)
+	}
+
+	// The signature is calculated over the DER encoding of the attributes
+	// with the SET OF tag, not the implicit [0] tag used in SignerInfo.
+	attrSet, err := asn1.Marshal(derSet(asn1.ClassUniversal, asn1.TagSet, attrs))
+	if err != nil {
+		return nil, err
+	}
+	attrDigest := sha256.Sum256(attrSet)
+	signature, err := key.Sign(rand.Reader, attrDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algo := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	encSignerInfo, err := asn1.Marshal(signerInfo{
+		Version: 1,
+		SID: issuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+			SerialNumber: cert.SerialNumber,
+		},
+		DigestAlgorithm:    sha256Algo,
+		SignedAttrs:        derSet(asn1.ClassContextSpecific, 0, attrs),
+		SignatureAlgorithm: sigAlgo,
+		Signature:          signature,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encDigestAlgo, err := asn1.Marshal(sha256Algo)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([][]byte, 0, len(chain))
+	for _, c := range chain {
+		certs = append(certs, c.Raw)
+	}
+
+	encSignedData, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: derSet(asn1.ClassUniversal, asn1.TagSet, [][]byte{encDigestAlgo}),
+		EncapContentInfo: encapContentInfo{EContentType: oidData},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      bytes.Join(certs, nil),
+		},
+		SignerInfos: derSet(asn1.ClassUniversal, asn1.TagSet, [][]byte{encSignerInfo}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      encSignedData,
+		},
+	})
+}
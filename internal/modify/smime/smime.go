@@ -0,0 +1,290 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package smime implements the modify.smime_sign module that signs outbound
+// messages using S/MIME (RFC 8551) with per-domain certificates.
+package smime
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.smime_sign"
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	store *certStore
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	m.store = &certStore{
+		domains: map[string]certFiles{},
+		log:     &m.log,
+		cache:   map[string]*cachedCert{},
+	}
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Callback("domain", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 3 {
+			return config.NodeErr(node, "expected domain, certificate and key paths")
+		}
+		domain, err := dns.ForLookup(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "invalid domain: %v", err)
+		}
+		m.store.domains[domain] = certFiles{certPath: node.Args[1], keyPath: node.Args[2]}
+		return nil
+	})
+	cfg.String("cert_dir", false, false, "", &m.store.dir)
+	cfg.Duration("expiry_warning", false, false, 30*24*time.Hour, &m.store.expiryWarning)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(m.store.domains) == 0 && m.store.dir == "" {
+		return config.NodeErr(cfg.Block, "at least one domain or cert_dir is required")
+	}
+	for domain := range m.store.domains {
+		if _, err := m.store.Get(domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type state struct {
+	m        *Modifier
+	mailFrom string
+	log      log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	s.mailFrom = mailFrom
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	// Not called since ModifyBody is implemented.
+	return nil
+}
+
+// signerDomain returns the normalized domain of the From address, the
+// envelope sender is used if the From field is missing or malformed.
+func (s *state) signerDomain(h *textproto.Header) string {
+	addr := s.mailFrom
+	if list, err := mail.ParseAddressList(h.Get("From")); err == nil && len(list) != 0 {
+		addr = list[0].Address
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return ""
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// isProtected checks whether the message is already signed or encrypted
+// using S/MIME or PGP/MIME.
+func isProtected(h *textproto.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "multipart/signed", "multipart/encrypted",
+		"application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	}
+	return false
+}
+
+func (s *state) ModifyBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, modName+"/ModifyBody").End()
+
+	if isProtected(h) {
+		s.log.DebugMsg("message is already signed or encrypted, not signing")
+		return body, nil
+	}
+	domain := s.signerDomain(h)
+	if domain == "" {
+		return body, nil
+	}
+	cert, err := s.m.store.Get(domain)
+	if err != nil {
+		s.log.Error("failed to load certificate, not signing", err, "domain", domain)
+		return body, nil
+	}
+	if cert == nil {
+		s.log.DebugMsg("no certificate for domain, not signing", "domain", domain)
+		return body, nil
+	}
+
+	outerHdr, signed, err := sign(*h, body, cert, time.Now())
+	if err != nil {
+		s.log.Error("signing failed, not signing", err, "domain", domain)
+		return body, nil
+	}
+	if signed == nil {
+		s.log.DebugMsg("message has 8-bit content, not signing", "domain", domain)
+		return body, nil
+	}
+
+	*h = outerHdr
+	s.log.DebugMsg("message signed", "domain", domain)
+	return buffer.MemoryBuffer{Slice: signed}, nil
+}
+
+func has8Bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// sign creates the multipart/signed message (RFC 8551, Section 3.5.3).
+// Content-* fields are moved into the signed part, other fields are kept in
+// the outer header. Nil body is returned if the message can't be signed
+// because it contains 8-bit data that may be changed in transit.
+func sign(h textproto.Header, body buffer.Buffer, cert *signingCert, now time.Time) (textproto.Header, []byte, error) {
+	outerHdr := h.Copy()
+	var contentFields [][2]string
+	for f := outerHdr.Fields(); f.Next(); {
+		if strings.HasPrefix(strings.ToLower(f.Key()), "content-") {
+			contentFields = append(contentFields, [2]string{f.Key(), f.Value()})
+			f.Del()
+		}
+	}
+	innerHdr := textproto.Header{}
+	for i := len(contentFields) - 1; i >= 0; i-- {
+		innerHdr.Add(contentFields[i][0], contentFields[i][1])
+	}
+	if !innerHdr.Has("Content-Type") {
+		innerHdr.Add("Content-Type", "text/plain; charset=us-ascii")
+	}
+
+	var content bytes.Buffer
+	if err := textproto.WriteHeader(&content, innerHdr); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(&content, r); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if has8Bit(content.Bytes()) {
+		return textproto.Header{}, nil, nil
+	}
+
+	signature, err := signDetached(content.Bytes(), cert.chain, cert.key, now)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	// multipart.Writer can't be used for the first part since the signed
+	// content should be written exactly as it was signed.
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	var res bytes.Buffer
+	res.WriteString("--" + boundary + "\r\n")
+	res.Write(content.Bytes())
+	res.WriteString("\r\n--" + boundary + "\r\n")
+	res.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	res.WriteString("Content-Transfer-Encoding: base64\r\n")
+	res.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n")
+	res.WriteString("Content-Description: S/MIME Cryptographic Signature\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for len(encoded) > 76 {
+		res.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	res.WriteString(encoded + "\r\n")
+	res.WriteString("--" + boundary + "--\r\n")
+
+	outerHdr.Set("MIME-Version", "1.0")
+	outerHdr.Set("Content-Type", mime.FormatMediaType("multipart/signed", map[string]string{
+		"protocol": "application/pkcs7-signature",
+		"micalg":   "sha-256",
+		"boundary": boundary,
+	}))
+	return outerHdr, res.Bytes(), nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,254 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func writeTestCert(t *testing.T, dir, domain string, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(42),
+		Subject:        pkix.Name{CommonName: domain},
+		EmailAddresses: []string{"user@" + domain},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       notAfter,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, domain+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, domain+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testModifier(t *testing.T, dir string) *Modifier {
+	logger := testutils.Logger(t, modName)
+	return &Modifier{
+		log: logger,
+		store: &certStore{
+			dir:           dir,
+			expiryWarning: 30 * 24 * time.Hour,
+			log:           &logger,
+			cache:         map[string]*cachedCert{},
+		},
+	}
+}
+
+func modify(t *testing.T, m *Modifier, hdr textproto.Header, body string) (textproto.Header, []byte) {
+	t.Helper()
+
+	st, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := st.RewriteSender(context.Background(), "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := module.RewriteBody(context.Background(), st, &hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := res.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, blob
+}
+
+// verify checks the detached signature of content using the certificate
+// included into the signature.
+func verify(t *testing.T, content, sig []byte) {
+	t.Helper()
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(sig, &ci); err != nil {
+		t.Fatal(err)
+	}
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		EncapContentInfo encapContentInfo
+		Certificates     asn1.RawValue `asn1:"tag:0"`
+		SignerInfos      []struct {
+			Version            int
+			SID                asn1.RawValue
+			DigestAlgorithm    pkix.AlgorithmIdentifier
+			SignedAttrs        asn1.RawValue `asn1:"tag:0"`
+			SignatureAlgorithm pkix.AlgorithmIdentifier
+			Signature          []byte
+		} `asn1:"set"`
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		t.Fatal("Wrong amount of signers")
+	}
+	si := sd.SignerInfos[0]
+
+	digest := sha256.Sum256(content)
+	if !bytes.Contains(si.SignedAttrs.Bytes, digest[:]) {
+		t.Fatal("Message digest mismatch")
+	}
+	attrSet := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	if err := cert.CheckSignature(x509.ECDSAWithSHA256, attrSet, si.Signature); err != nil {
+		t.Fatal("Signature verification failed:", err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "example.org", time.Now().Add(365*24*time.Hour))
+	m := testModifier(t, dir)
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "User <user@example.org>")
+	hdr.Add("Subject", "Hello")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=us-ascii")
+	hdr.Add("Content-Transfer-Encoding", "7bit")
+	body := "Hello!\r\n"
+
+	outHdr, outBody := modify(t, m, hdr, body)
+	mediaType, params, err := mime.ParseMediaType(outHdr.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatal("Wrong Content-Type:", outHdr.Get("Content-Type"))
+	}
+	if outHdr.Get("Subject") != "Hello" || outHdr.Has("Content-Transfer-Encoding") {
+		t.Fatal("Wrong outer header")
+	}
+
+	// Extract the signed content exactly as it appears in the message.
+	delim := []byte("--" + params["boundary"] + "\r\n")
+	start := bytes.Index(outBody, delim) + len(delim)
+	end := bytes.Index(outBody[start:], []byte("\r\n--"+params["boundary"]))
+	content := outBody[start : start+end]
+	innerHdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if innerHdr.Get("Content-Transfer-Encoding") != "7bit" || !bytes.HasSuffix(content, []byte(body)) {
+		t.Fatalf("Wrong signed content: %q", content)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(outBody), params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	sigPart, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sigPart.Header.Get("Content-Type"), "application/pkcs7-signature") {
+		t.Fatal("Wrong signature part type")
+	}
+	sigB64, err := io.ReadAll(sigPart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(sigB64), "\r\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(t, content, sig)
+}
+
+func TestSign_Skip(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "example.org", time.Now().Add(365*24*time.Hour))
+	writeTestCert(t, dir, "expired.example.org", time.Now().Add(-time.Minute))
+	m := testModifier(t, dir)
+
+	for _, test := range []struct {
+		name   string
+		fields [][2]string
+		body   string
+	}{
+		{"no certificate", [][2]string{{"From", "user@example.com"}}, "Hello!\r\n"},
+		{"expired certificate", [][2]string{{"From", "user@expired.example.org"}}, "Hello!\r\n"},
+		{"already signed", [][2]string{{"From", "user@example.org"}, {"Content-Type", "multipart/signed; boundary=b"}}, "--b--\r\n"},
+		{"8-bit", [][2]string{{"From", "user@example.org"}}, "Привет!\r\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hdr := textproto.Header{}
+			for _, field := range test.fields {
+				hdr.Add(field[0], field[1])
+			}
+			outHdr, outBody := modify(t, m, hdr, test.body)
+			if string(outBody) != test.body || outHdr.Get("Content-Type") != hdr.Get("Content-Type") {
+				t.Fatal("Message changed")
+			}
+		})
+	}
+}
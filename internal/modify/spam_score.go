@@ -0,0 +1,182 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// spamScore adds X-Spam-* header fields based on the sum of check scores
+// and optionally tags the subject of messages considered spam.
+//
+// Fields added by checks (e.g. rspamd) and upstream servers are replaced so
+// client-side filtering rules see the same fields regardless of the used
+// checks.
+type spamScore struct {
+	instName string
+
+	checks     []string
+	threshold  float64
+	subjectTag string
+
+	log log.Logger
+}
+
+func NewSpamScore(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.spam_score: inline arguments are not used")
+	}
+	return &spamScore{
+		instName: instName,
+		log:      log.Logger{Name: "modify.spam_score"},
+	}, nil
+}
+
+func (m *spamScore) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.StringList("checks", false, false, nil, &m.checks)
+	cfg.Float("threshold", false, false, 5, &m.threshold)
+	cfg.String("subject_tag", false, false, "", &m.subjectTag)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(m.subjectTag, "\r\n") {
+		return config.NodeErr(cfg.Block, "subject_tag should not contain line breaks")
+	}
+	return nil
+}
+
+func (m *spamScore) Name() string {
+	return "modify.spam_score"
+}
+
+func (m *spamScore) InstanceName() string {
+	return m.instName
+}
+
+// score returns the sum of scores of the configured checks and names of
+// checks that contributed to it.
+func (m *spamScore) score(msgMeta *module.MsgMetadata) (float64, []string) {
+	var (
+		total float64
+		tests []string
+	)
+	for name, score := range msgMeta.CheckScores {
+		if len(m.checks) != 0 && !containsString(m.checks, name) {
+			continue
+		}
+		total += score
+		if score != 0 {
+			tests = append(tests, name)
+		}
+	}
+	sort.Strings(tests)
+	return total, tests
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type spamScoreState struct {
+	m       *spamScore
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *spamScore) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return spamScoreState{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s spamScoreState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s spamScoreState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s spamScoreState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.spam_score/RewriteBody").End()
+
+	score, tests := s.m.score(s.msgMeta)
+	isSpam := score >= s.m.threshold
+
+	status := "No"
+	if isSpam {
+		status = "Yes"
+	}
+	status += ", score=" + strconv.FormatFloat(score, 'f', 2, 64) +
+		" required=" + strconv.FormatFloat(s.m.threshold, 'f', 2, 64)
+	if len(tests) != 0 {
+		status += " tests=" + strings.Join(tests, ",")
+	}
+
+	h.Del("X-Spam-Flag")
+	h.Del("X-Spam-Score")
+	h.Del("X-Spam-Status")
+	h.Add("X-Spam-Status", status)
+	h.Add("X-Spam-Score", strconv.FormatFloat(score, 'f', 2, 64))
+	if isSpam {
+		h.Add("X-Spam-Flag", "YES")
+	}
+
+	if isSpam && s.m.subjectTag != "" {
+		subject := h.Get("Subject")
+		if !strings.HasPrefix(subject, s.m.subjectTag) {
+			if subject == "" {
+				h.Set("Subject", s.m.subjectTag)
+			} else {
+				h.Set("Subject", s.m.subjectTag+" "+subject)
+			}
+		}
+	}
+
+	s.log.DebugMsg("spam score", "score", score, "spam", isSpam)
+	return nil
+}
+
+func (s spamScoreState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.spam_score", NewSpamScore)
+}
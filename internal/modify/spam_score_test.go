@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func testSpamScore(t *testing.T, cfg []config.Node, scores map[string]float64, hdr textproto.Header) textproto.Header {
+	t.Helper()
+
+	mod, err := NewSpamScore("modify.spam_score", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*spamScore)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{CheckScores: scores})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	hdr = hdr.Copy()
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+		t.Fatal(err)
+	}
+	return hdr
+}
+
+func TestSpamScore(t *testing.T) {
+	cfg := []config.Node{
+		{Name: "threshold", Args: []string{"6"}},
+		{Name: "subject_tag", Args: []string{"[SPAM]"}},
+		{Name: "checks", Args: []string{"rspamd", "dnsbl"}},
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	hdr.Add("X-Spam-Flag", "NO")
+	hdr.Add("X-Spam-Score", "100")
+	res := testSpamScore(t, cfg, map[string]float64{"rspamd": 5.5, "dnsbl": 1, "other": 10, "spf": 0}, hdr)
+
+	for field, want := range map[string]string{
+		"Subject":       "[SPAM] Hello",
+		"X-Spam-Flag":   "YES",
+		"X-Spam-Score":  "6.50",
+		"X-Spam-Status": "Yes, score=6.50 required=6.00 tests=dnsbl,rspamd",
+	} {
+		if got := res.Values(field); len(got) != 1 || got[0] != want {
+			t.Errorf("%s: want %q, got %q", field, want, got)
+		}
+	}
+
+	// Subject is not tagged twice.
+	res = testSpamScore(t, cfg, map[string]float64{"rspamd": 10}, res)
+	if got := res.Get("Subject"); got != "[SPAM] Hello" {
+		t.Errorf("unexpected subject: %q", got)
+	}
+
+	res = testSpamScore(t, cfg, map[string]float64{"rspamd": 1}, hdr)
+	if got := res.Get("Subject"); got != "Hello" {
+		t.Errorf("non-spam subject is tagged: %q", got)
+	}
+	if res.Has("X-Spam-Flag") {
+		t.Error("X-Spam-Flag is set for non-spam")
+	}
+	if got := res.Get("X-Spam-Status"); got != "No, score=1.00 required=6.00 tests=rspamd" {
+		t.Errorf("unexpected X-Spam-Status: %q", got)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	srsTimeBase      = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	srsTimePrecision = 24 * time.Hour
+	srsTimeSlots     = 1024 // 2 base32 characters
+	srsHashLen       = 4
+)
+
+var errInvalidSRS = &exterrors.SMTPError{
+	Code:         550,
+	EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+	Message:      "Invalid SRS address",
+	TargetName:   "modify.srs",
+}
+
+// srs implements the Sender Rewriting Scheme.
+//
+// If created with modName = "modify.srs", it rewrites the envelope sender
+// of forwarded messages to an address at the SRS domain.
+// If created with modName = "modify.srs_reverse", it decodes SRS recipient
+// addresses (bounces for the forwarded messages) back to the original sender.
+type srs struct {
+	modName  string
+	instName string
+
+	domain    string
+	secrets   [][]byte
+	maxAge    int
+	localDoms map[string]struct{}
+
+	reverse bool
+	now     func() time.Time
+}
+
+func NewSRS(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("modify.srs: inline arguments are not used")
+	}
+	return &srs{
+		modName:  modName,
+		instName: instName,
+		reverse:  modName == "modify.srs_reverse",
+		now:      time.Now,
+	}, nil
+}
+
+func (s *srs) Init(cfg *config.Map) error {
+	var (
+		secrets   []string
+		localDoms []string
+	)
+	cfg.String("domain", false, true, "", &s.domain)
+	cfg.StringList("secrets", false, true, nil, &secrets)
+	cfg.Int("max_age", false, false, 21, &s.maxAge)
+	cfg.StringList("exclude_domains", false, false, nil, &localDoms)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	s.domain, err = dns.ForLookup(s.domain)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "invalid SRS domain: %v", err)
+	}
+	for _, secret := range secrets {
+		s.secrets = append(s.secrets, []byte(secret))
+	}
+	if s.maxAge <= 0 || s.maxAge >= srsTimeSlots {
+		return config.NodeErr(cfg.Block, "max_age should be between 1 and %d days", srsTimeSlots-1)
+	}
+
+	s.localDoms = make(map[string]struct{}, len(localDoms)+1)
+	s.localDoms[s.domain] = struct{}{}
+	for _, d := range localDoms {
+		dom, err := dns.ForLookup(d)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid domain %s: %v", d, err)
+		}
+		s.localDoms[dom] = struct{}{}
+	}
+	return nil
+}
+
+func (s *srs) Name() string {
+	return s.modName
+}
+
+func (s *srs) InstanceName() string {
+	return s.instName
+}
+
+func (s *srs) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return s, nil
+}
+
+func (s *srs) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if s.reverse || mailFrom == "" {
+		return mailFrom, nil
+	}
+
+	local, domain, err := address.Split(mailFrom)
+	if err != nil || domain == "" {
+		// Leave malformed addresses and "postmaster" alone.
+		return mailFrom, nil
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return mailFrom, nil
+	}
+	if _, ok := s.localDoms[normDomain]; ok {
+		return mailFrom, nil
+	}
+
+	return s.forward(local, domain) + "@" + s.domain, nil
+}
+
+func (s *srs) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if !s.reverse {
+		return []string{rcptTo}, nil
+	}
+
+	local, domain, err := address.Split(rcptTo)
+	if err != nil {
+		return []string{rcptTo}, nil
+	}
+	if normDomain, err := dns.ForLookup(domain); err != nil || normDomain != s.domain {
+		return []string{rcptTo}, nil
+	}
+	if !hasPrefixFold(local, "SRS0=") && !hasPrefixFold(local, "SRS1=") {
+		return []string{rcptTo}, nil
+	}
+
+	original, err := s.reverseAddr(local)
+	if err != nil {
+		return []string{rcptTo}, err
+	}
+	return []string{original}, nil
+}
+
+func (s *srs) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s *srs) Close() error {
+	return nil
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func (s *srs) hash(secret []byte, parts ...string) string {
+	mac := hmac.New(sha1.New, secret)
+	for _, p := range parts {
+		mac.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:srsHashLen]
+}
+
+func (s *srs) checkHash(hash string, parts ...string) bool {
+	for _, secret := range s.secrets {
+		if strings.EqualFold(hash, s.hash(secret, parts...)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *srs) timestamp() string {
+	days := s.now().Unix() / int64(srsTimePrecision/time.Second)
+	return string([]byte{
+		srsTimeBase[(days>>5)&31],
+		srsTimeBase[days&31],
+	})
+}
+
+func (s *srs) checkTimestamp(ts string) bool {
+	if len(ts) != 2 {
+		return false
+	}
+	var then int64
+	for _, c := range strings.ToUpper(ts) {
+		i := strings.IndexRune(srsTimeBase, c)
+		if i == -1 {
+			return false
+		}
+		then = then<<5 | int64(i)
+	}
+
+	now := (s.now().Unix() / int64(srsTimePrecision/time.Second)) % srsTimeSlots
+	age := (now - then + srsTimeSlots) % srsTimeSlots
+	return age <= int64(s.maxAge)
+}
+
+// forward returns the SRS local-part for the address.
+func (s *srs) forward(local, domain string) string {
+	switch {
+	case hasPrefixFold(local, "SRS0="):
+		// SRS0=HHHH=TT=domain=local@forwarder becomes
+		// SRS1=HHHH=forwarder==HHHH=TT=domain=local.
+		rest := local[len("SRS0="):]
+		return "SRS1=" + s.hash(s.secrets[0], domain, rest) + "=" + domain + "==" + rest
+	case hasPrefixFold(local, "SRS1="):
+		// Keep the first forwarder, only the hash is replaced.
+		parts := strings.SplitN(local[len("SRS1="):], "=", 3)
+		if len(parts) == 3 && strings.HasPrefix(parts[2], "=") {
+			host, rest := parts[1], parts[2][1:]
+			return "SRS1=" + s.hash(s.secrets[0], host, rest) + "=" + host + "==" + rest
+		}
+	}
+
+	ts := s.timestamp()
+	return "SRS0=" + s.hash(s.secrets[0], ts, domain, local) + "=" + ts + "=" + domain + "=" + local
+}
+
+// reverseAddr decodes the SRS local-part into the original address.
+func (s *srs) reverseAddr(local string) (string, error) {
+	if hasPrefixFold(local, "SRS1=") {
+		parts := strings.SplitN(local[len("SRS1="):], "=", 3)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "=") {
+			return "", errInvalidSRS
+		}
+		hash, host, rest := parts[0], parts[1], parts[2][1:]
+		if !s.checkHash(hash, host, rest) {
+			return "", errInvalidSRS
+		}
+		return "SRS0=" + rest + "@" + host, nil
+	}
+
+	parts := strings.SplitN(local[len("SRS0="):], "=", 4)
+	if len(parts) != 4 {
+		return "", errInvalidSRS
+	}
+	hash, ts, domain, origLocal := parts[0], parts[1], parts[2], parts[3]
+	if !s.checkHash(hash, ts, domain, origLocal) {
+		return "", errInvalidSRS
+	}
+	if !s.checkTimestamp(ts) {
+		return "", &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "SRS address is expired",
+			TargetName:   "modify.srs",
+		}
+	}
+	return origLocal + "@" + domain, nil
+}
+
+func init() {
+	module.Register("modify.srs", NewSRS)
+	module.Register("modify.srs_reverse", NewSRS)
+}
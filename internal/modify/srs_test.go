@@ -0,0 +1,170 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func testSRS(t *testing.T, modName string, now time.Time, secrets ...string) *srs {
+	t.Helper()
+
+	mod, err := NewSRS(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mod.(*srs)
+	err = s.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domain", Args: []string{"forwarder.example"}},
+			{Name: "secrets", Args: secrets},
+			{Name: "exclude_domains", Args: []string{"local.example"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestSRS_RoundTrip(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	fwd := testSRS(t, "modify.srs", now, "secret")
+	rev := testSRS(t, "modify.srs_reverse", now, "secret")
+
+	srsAddr, err := fwd.RewriteSender(context.Background(), "user@sender.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPrefixFold(srsAddr, "SRS0=") {
+		t.Fatal("Not an SRS address:", srsAddr)
+	}
+
+	// modify.srs does not touch recipients.
+	rcpts, err := fwd.RewriteRcpt(context.Background(), srsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcpts[0] != srsAddr {
+		t.Error("Recipient rewritten by modify.srs:", rcpts)
+	}
+
+	rcpts, err = rev.RewriteRcpt(context.Background(), srsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rcpts) != 1 || rcpts[0] != "user@sender.example" {
+		t.Error("Wrong decoded address:", rcpts)
+	}
+}
+
+func TestSRS_NotRewritten(t *testing.T) {
+	fwd := testSRS(t, "modify.srs", time.Now(), "secret")
+
+	for _, addr := range []string{"", "postmaster", "user@local.example", "user@FORWARDER.example"} {
+		res, err := fwd.RewriteSender(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != addr {
+			t.Errorf("%q rewritten to %q", addr, res)
+		}
+	}
+
+	rev := testSRS(t, "modify.srs_reverse", time.Now(), "secret")
+	for _, addr := range []string{"user@forwarder.example", "SRS0=aaaa=AB=a.example=b@other.example"} {
+		res, err := rev.RewriteRcpt(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0] != addr {
+			t.Errorf("%q rewritten to %q", addr, res[0])
+		}
+	}
+}
+
+func TestSRS_SRS1(t *testing.T) {
+	now := time.Now()
+	fwd := testSRS(t, "modify.srs", now, "secret")
+	rev := testSRS(t, "modify.srs_reverse", now, "secret")
+
+	srs0 := "SRS0=HHHH=TT=orig.example=user@first.example"
+	srs1, err := fwd.RewriteSender(context.Background(), srs0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPrefixFold(srs1, "SRS1=") {
+		t.Fatal("Not an SRS1 address:", srs1)
+	}
+
+	// Forwarding SRS1 address again keeps the first forwarder.
+	srs1Again, err := fwd.RewriteSender(context.Background(), srs1[:len(srs1)-len("forwarder.example")]+"second.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srs1Again != srs1 {
+		t.Errorf("Wrong SRS1 rewrite: %s != %s", srs1Again, srs1)
+	}
+
+	rcpts, err := rev.RewriteRcpt(context.Background(), srs1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcpts[0] != srs0 {
+		t.Errorf("Wrong decoded address: %s", rcpts[0])
+	}
+}
+
+func TestSRS_Invalid(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	fwd := testSRS(t, "modify.srs", now, "secret")
+
+	srsAddr, err := fwd.RewriteSender(context.Background(), "user@sender.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Different secret.
+	rev := testSRS(t, "modify.srs_reverse", now, "other")
+	if _, err := rev.RewriteRcpt(context.Background(), srsAddr); err == nil {
+		t.Error("Address with invalid hash accepted")
+	}
+
+	// Old secrets are still accepted.
+	rev = testSRS(t, "modify.srs_reverse", now, "new", "secret")
+	if _, err := rev.RewriteRcpt(context.Background(), srsAddr); err != nil {
+		t.Error("Address signed with the old secret rejected:", err)
+	}
+
+	// Expired.
+	rev = testSRS(t, "modify.srs_reverse", now.Add(22*24*time.Hour), "secret")
+	if _, err := rev.RewriteRcpt(context.Background(), srsAddr); err == nil {
+		t.Error("Expired address accepted")
+	}
+
+	// Malformed.
+	if _, err := rev.RewriteRcpt(context.Background(), "SRS0=broken@forwarder.example"); err == nil {
+		t.Error("Malformed address accepted")
+	}
+}
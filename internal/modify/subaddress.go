@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// subaddressPolicy describes how the detail part of recipient addresses is
+// handled for a domain.
+type subaddressPolicy struct {
+	// Any of these characters separates the detail from the local part.
+	// Empty string disables subaddressing.
+	separators string
+	strip      bool
+	expose     bool
+}
+
+// subaddress handles the detail (subaddress) part of recipient addresses,
+// e.g. "tag" in user+tag@example.org. Depending on the policy, the detail is
+// removed from the address and recorded in MsgMetadata.RcptDetails so it can
+// be used by IMAP filters.
+type subaddress struct {
+	instName string
+
+	defaultPolicy subaddressPolicy
+	domains       map[string]subaddressPolicy
+
+	log log.Logger
+}
+
+func NewSubaddress(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("modify.subaddress: inline arguments are not used")
+	}
+	return &subaddress{
+		instName: instName,
+		domains:  map[string]subaddressPolicy{},
+		log:      log.Logger{Name: "modify.subaddress"},
+	}, nil
+}
+
+func parseSubaddressPolicy(cfg *config.Map, defaults subaddressPolicy) (subaddressPolicy, error) {
+	var (
+		policy = defaults
+		mode   string
+	)
+	defaultMode := "preserve"
+	if defaults.strip {
+		defaultMode = "strip"
+	}
+	cfg.String("separator", false, false, defaults.separators, &policy.separators)
+	cfg.Enum("mode", false, false, []string{"strip", "preserve"}, defaultMode, &mode)
+	cfg.Bool("expose_detail", false, defaults.expose, &policy.expose)
+	if _, err := cfg.Process(); err != nil {
+		return subaddressPolicy{}, err
+	}
+	if policy.separators == "off" {
+		policy.separators = ""
+	}
+	if strings.ContainsAny(policy.separators, "@\" \t") {
+		return subaddressPolicy{}, config.NodeErr(cfg.Block, "invalid separator: %q", policy.separators)
+	}
+	policy.strip = mode == "strip"
+	return policy, nil
+}
+
+func (s *subaddress) Init(cfg *config.Map) error {
+	var domainNodes []config.Node
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	cfg.Callback("domain", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one domain is required")
+		}
+		domainNodes = append(domainNodes, node)
+		return nil
+	})
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	s.defaultPolicy, err = parseSubaddressPolicy(config.NewMap(cfg.Globals, config.Node{Children: unknown}), subaddressPolicy{
+		separators: "+",
+		strip:      true,
+		expose:     true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, node := range domainNodes {
+		policy, err := parseSubaddressPolicy(config.NewMap(cfg.Globals, node), s.defaultPolicy)
+		if err != nil {
+			return err
+		}
+		for _, domain := range node.Args {
+			normDomain, err := dns.ForLookup(domain)
+			if err != nil {
+				return config.NodeErr(node, "invalid domain %s: %v", domain, err)
+			}
+			s.domains[normDomain] = policy
+		}
+	}
+	return nil
+}
+
+func (s *subaddress) Name() string {
+	return "modify.subaddress"
+}
+
+func (s *subaddress) InstanceName() string {
+	return s.instName
+}
+
+// split returns the address without the detail and the detail itself. ok
+// is false if the address has no detail or subaddressing is disabled for
+// the domain.
+func (s *subaddress) split(addr string) (base, detail string, policy subaddressPolicy, ok bool) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil || domain == "" || strings.HasPrefix(mbox, `"`) {
+		return "", "", subaddressPolicy{}, false
+	}
+
+	policy = s.defaultPolicy
+	if normDomain, err := dns.ForLookup(domain); err == nil {
+		if domainPolicy, ok := s.domains[normDomain]; ok {
+			policy = domainPolicy
+		}
+	}
+	if policy.separators == "" {
+		return "", "", policy, false
+	}
+
+	idx := strings.IndexAny(mbox, policy.separators)
+	if idx <= 0 {
+		return "", "", policy, false
+	}
+	return mbox[:idx] + "@" + domain, mbox[idx+1:], policy, true
+}
+
+type subaddressState struct {
+	s       *subaddress
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (s *subaddress) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return subaddressState{
+		s:       s,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(s.log, msgMeta),
+	}, nil
+}
+
+func (st subaddressState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (st subaddressState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	base, detail, policy, ok := st.s.split(rcptTo)
+	if !ok {
+		return []string{rcptTo}, nil
+	}
+
+	result := rcptTo
+	if policy.strip {
+		result = base
+	}
+	if policy.expose {
+		if st.msgMeta.RcptDetails == nil {
+			st.msgMeta.RcptDetails = make(map[string]string)
+		}
+		st.msgMeta.RcptDetails[rcptTo] = detail
+		st.msgMeta.RcptDetails[result] = detail
+	}
+	st.log.DebugMsg("subaddress", "rcpt", rcptTo, "result", result, "detail", detail)
+	return []string{result}, nil
+}
+
+func (st subaddressState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (st subaddressState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.subaddress", NewSubaddress)
+}
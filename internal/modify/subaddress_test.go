@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestSubaddress(t *testing.T) {
+	nodes, err := parser.Read(strings.NewReader(`
+		modify.subaddress {
+			separator +
+			domain example.net {
+				separator +-
+				mode preserve
+			}
+			domain example.com {
+				expose_detail no
+			}
+			domain example.invalid {
+				separator off
+			}
+		}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := NewSubaddress("modify.subaddress", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, nodes[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	msgMeta := &module.MsgMetadata{}
+	state, err := mod.(*subaddress).ModStateForMsg(context.Background(), msgMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	for _, test := range []struct {
+		rcpt, want string
+	}{
+		{"user+tag@example.org", "user@example.org"},
+		{"user+a+b@example.org", "user@example.org"},
+		{"user-tag@example.org", "user-tag@example.org"},
+		{"+tag@example.org", "+tag@example.org"},
+		{"postmaster", "postmaster"},
+		{"other-list@example.net", "other-list@example.net"},
+		{"third+x@example.com", "third@example.com"},
+		{"user+tag@example.invalid", "user+tag@example.invalid"},
+	} {
+		got, err := state.RewriteRcpt(context.Background(), test.rcpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != test.want {
+			t.Errorf("%s: want %s, got %v", test.rcpt, test.want, got)
+		}
+	}
+
+	want := map[string]string{
+		"user+tag@example.org":   "tag",
+		"user+a+b@example.org":   "a+b",
+		"user@example.org":       "a+b",
+		"other-list@example.net": "list",
+	}
+	if !reflect.DeepEqual(msgMeta.RcptDetails, want) {
+		t.Errorf("wrong details: %v", msgMeta.RcptDetails)
+	}
+
+	// Detail is found for rewrites done after modify.subaddress.
+	msgMeta.RcptDetails = map[string]string{"user+tag@example.org": "tag", "user@example.org": "tag"}
+	msgMeta.OriginalRcpts = map[string]string{"alias@example.org": "user+tag@example.org"}
+	if detail, ok := msgMeta.RcptDetail("alias@example.org"); !ok || detail != "tag" {
+		t.Errorf("wrong detail for the rewritten address: %s", detail)
+	}
+	if _, ok := msgMeta.RcptDetail("other@example.org"); ok {
+		t.Error("unexpected detail")
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package vacation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// AdminArgs are the arguments of "vacation.*" control commands.
+type AdminArgs struct {
+	CfgBlock string `json:"cfg_block"`
+	Address  string `json:"address,omitempty"`
+	// New settings for vacation.set.
+	Settings *Settings `json:"settings,omitempty"`
+}
+
+// Status is the result of vacation.show.
+type Status struct {
+	Settings
+	Active bool `json:"active"`
+}
+
+// vacationCommand wraps the handler for a command that operates on the
+// module. Address is required if needAddr is true.
+func vacationCommand(needAddr bool, f func(v *Vacation, args AdminArgs) (interface{}, error)) control.Handler {
+	return func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		if needAddr && args.Address == "" {
+			return nil, errors.New("vacation: address is required")
+		}
+		if args.CfgBlock == "" {
+			return nil, errors.New("vacation: cfg_block is required")
+		}
+		mod, err := module.GetInstance(args.CfgBlock)
+		if err != nil {
+			return nil, fmt.Errorf("vacation: %w", err)
+		}
+		v, ok := mod.(*Vacation)
+		if !ok {
+			return nil, fmt.Errorf("vacation: configuration block %s is not %s", args.CfgBlock, modName)
+		}
+		return f(v, args)
+	}
+}
+
+func init() {
+	control.Register("vacation.list", vacationCommand(false, func(v *Vacation, _ AdminArgs) (interface{}, error) {
+		addrs, err := v.Addresses()
+		if err != nil {
+			return nil, err
+		}
+		res := append([]string{}, addrs...)
+		sort.Strings(res)
+		return res, nil
+	}))
+	control.Register("vacation.show", vacationCommand(true, func(v *Vacation, args AdminArgs) (interface{}, error) {
+		s, ok, err := v.Get(context.TODO(), args.Address)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("vacation: auto-replies are not configured for the address")
+		}
+		return Status{Settings: s, Active: s.Active(time.Now())}, nil
+	}))
+	control.Register("vacation.set", vacationCommand(true, func(v *Vacation, args AdminArgs) (interface{}, error) {
+		if args.Settings == nil {
+			return nil, errors.New("vacation: settings are required")
+		}
+		s := *args.Settings
+		if !s.Start.IsZero() && !s.End.IsZero() && !s.Start.Before(s.End) {
+			return nil, errors.New("vacation: end date is before the start date")
+		}
+		return nil, v.Set(args.Address, s)
+	}))
+	control.Register("vacation.disable", vacationCommand(true, func(v *Vacation, args AdminArgs) (interface{}, error) {
+		return nil, v.Remove(args.Address)
+	}))
+}
@@ -0,0 +1,415 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package vacation implements the modify.vacation module that sends
+// automatic replies on behalf of recipients that are away.
+package vacation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.vacation"
+
+// Settings is the auto-reply configuration of a single address.
+type Settings struct {
+	Subject string `json:"subject,omitempty"`
+	Message string `json:"message"`
+
+	// Replies are sent only between Start and End, zero values mean no
+	// limit.
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+
+	// Min. time between replies to the same correspondent, zero means
+	// the module default.
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// Active reports whether the replies should be sent at the specified time.
+func (s Settings) Active(now time.Time) bool {
+	if !s.Start.IsZero() && now.Before(s.Start) {
+		return false
+	}
+	if !s.End.IsZero() && !now.Before(s.End) {
+		return false
+	}
+	return true
+}
+
+type Vacation struct {
+	instName string
+	log      log.Logger
+
+	settings        module.MutableTable
+	state           module.SharedState
+	target          module.DeliveryTarget
+	defaultInterval time.Duration
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Vacation{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (v *Vacation) Name() string {
+	return modName
+}
+
+func (v *Vacation) InstanceName() string {
+	return v.instName
+}
+
+func (v *Vacation) Init(cfg *config.Map) error {
+	var settings module.Table
+	cfg.Bool("debug", true, false, &v.log.Debug)
+	modconfig.Table(cfg, "settings", false, true, nil, &settings)
+	cfg.Custom("state", false, false, func() (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", []string{"memory"}, config.Node{}, nil, &st)
+		return st, err
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var st module.SharedState
+		err := modconfig.ModuleFromNode("state", node.Args, node, m.Globals, &st)
+		return st, err
+	}, &v.state)
+	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &v.target)
+	cfg.Duration("default_interval", false, false, 7*24*time.Hour, &v.defaultInterval)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	mutable, ok := settings.(module.MutableTable)
+	if !ok {
+		return config.NodeErr(cfg.Block, "settings table should be mutable (e.g. sql_table)")
+	}
+	v.settings = mutable
+
+	return nil
+}
+
+// Get returns the auto-reply settings for the address.
+func (v *Vacation) Get(ctx context.Context, addr string) (Settings, bool, error) {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return Settings{}, false, err
+	}
+	val, ok, err := v.settings.Lookup(ctx, key)
+	if err != nil || !ok {
+		return Settings{}, false, err
+	}
+
+	var s Settings
+	if err := json.Unmarshal([]byte(val), &s); err != nil {
+		return Settings{}, false, fmt.Errorf("%s: malformed settings for %s: %w", modName, key, err)
+	}
+	return s, true, nil
+}
+
+// Set enables auto-replies for the address.
+func (v *Vacation) Set(addr string, s Settings) error {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return err
+	}
+	if s.Message == "" {
+		return errors.New("vacation: message is required")
+	}
+	val, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return v.settings.SetKey(key, string(val))
+}
+
+// Remove disables auto-replies for the address.
+func (v *Vacation) Remove(addr string) error {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return err
+	}
+	return v.settings.RemoveKey(key)
+}
+
+// Addresses returns the list of addresses auto-replies are configured for.
+func (v *Vacation) Addresses() ([]string, error) {
+	return v.settings.Keys()
+}
+
+type state struct {
+	v        *Vacation
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+	log      log.Logger
+}
+
+func (v *Vacation) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		v:       v,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(v.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	s.mailFrom = mailFrom
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	s.rcpts = append(s.rcpts, rcptTo)
+	return []string{rcptTo}, nil
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, modName+"/RewriteBody").End()
+
+	if reason := skipReason(s.msgMeta, s.mailFrom, *h); reason != "" {
+		s.log.DebugMsg("not replying", "reason", reason)
+		return nil
+	}
+
+	for _, rcpt := range s.rcpts {
+		if err := s.reply(ctx, rcpt, *h); err != nil {
+			s.log.Error("failed to send auto-reply", err, "rcpt", rcpt)
+		}
+	}
+	return nil
+}
+
+func (s *state) reply(ctx context.Context, rcpt string, h textproto.Header) error {
+	settings, ok, err := s.v.Get(ctx, rcpt)
+	if err != nil || !ok {
+		return err
+	}
+	if !settings.Active(time.Now()) {
+		return nil
+	}
+
+	// RFC 5230, Section 4.5. Reply only to messages addressed to the
+	// recipient directly.
+	if !addressedTo(h, rcpt) {
+		s.log.DebugMsg("not replying, recipient is not in To or Cc", "rcpt", rcpt)
+		return nil
+	}
+
+	sender, err := address.ForLookup(s.mailFrom)
+	if err != nil {
+		return err
+	}
+	rcptKey, err := address.ForLookup(rcpt)
+	if err != nil {
+		return err
+	}
+	if sender == rcptKey {
+		return nil
+	}
+
+	interval := settings.Interval
+	if interval == 0 {
+		interval = s.v.defaultInterval
+	}
+	count, err := s.v.state.Incr(ctx, "vacation:"+rcptKey+":"+sender, interval)
+	if err != nil {
+		return err
+	}
+	if count > 1 {
+		s.log.DebugMsg("not replying, already replied recently", "rcpt", rcpt, "sender", sender)
+		return nil
+	}
+
+	return s.sendReply(ctx, rcpt, settings, h)
+}
+
+func (s *state) sendReply(ctx context.Context, rcpt string, settings Settings, h textproto.Header) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return err
+	}
+
+	subject := settings.Subject
+	if subject == "" {
+		origSubject, err := (&mime.WordDecoder{}).DecodeHeader(h.Get("Subject"))
+		if err != nil {
+			origSubject = h.Get("Subject")
+		}
+		subject = "Auto: " + origSubject
+	}
+
+	var body bytes.Buffer
+	qpw := quotedprintable.NewWriter(&body)
+	msg := strings.ReplaceAll(settings.Message, "\r\n", "\n")
+	if _, err := qpw.Write([]byte(strings.ReplaceAll(msg, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	if err := qpw.Close(); err != nil {
+		return err
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", rcpt)
+	hdr.Add("To", s.mailFrom)
+	hdr.Add("Subject", mime.QEncoding.Encode("utf-8", subject))
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+domain+">")
+	if origID := h.Get("Message-Id"); origID != "" {
+		hdr.Add("In-Reply-To", origID)
+		refs := h.Get("References")
+		if refs != "" {
+			refs += " "
+		}
+		hdr.Add("References", refs+origID)
+	}
+	// RFC 3834, Section 5.
+	hdr.Add("Auto-Submitted", "auto-replied")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+	hdr.Add("Content-Transfer-Encoding", "quoted-printable")
+
+	// RFC 3834, Section 3.3. Null return path prevents replies to the
+	// auto-reply.
+	msgMeta := &module.MsgMetadata{ID: msgID, TraceID: s.msgMeta.TraceID}
+	delivery, err := s.v.target.Start(ctx, msgMeta, "")
+	if err != nil {
+		return err
+	}
+	if err := delivery.AddRcpt(ctx, s.mailFrom, smtp.RcptOptions{}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		return err
+	}
+
+	s.log.Msg("auto-reply sent", "rcpt", rcpt, "sender", s.mailFrom, "reply_id", msgID)
+	return nil
+}
+
+// addressedTo reports whether the address is listed in To or Cc fields.
+func addressedTo(h textproto.Header, addr string) bool {
+	addr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	for _, field := range []string{"To", "Cc"} {
+		for _, value := range h.Values(field) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				// Fallback for malformed fields.
+				if strings.Contains(strings.ToLower(value), addr) {
+					return true
+				}
+				continue
+			}
+			for _, a := range list {
+				if norm, err := address.ForLookup(a.Address); err == nil && norm == addr {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// skipReason returns the reason to not reply to the message at all or empty
+// string if replies can be sent.
+func skipReason(msgMeta *module.MsgMetadata, mailFrom string, h textproto.Header) string {
+	if mailFrom == "" {
+		return "null sender"
+	}
+	if msgMeta.Quarantine {
+		return "quarantined message"
+	}
+
+	// RFC 5230, Section 4.6.
+	localPart, _, err := address.Split(mailFrom)
+	if err != nil {
+		return "malformed sender"
+	}
+	localPart = strings.ToLower(localPart)
+	switch {
+	case localPart == "mailer-daemon", localPart == "listserv", localPart == "majordomo",
+		strings.HasPrefix(localPart, "owner-"), strings.HasSuffix(localPart, "-request"),
+		strings.HasPrefix(localPart, "noreply"), strings.HasPrefix(localPart, "no-reply"),
+		strings.HasPrefix(localPart, "donotreply"), strings.HasPrefix(localPart, "do-not-reply"):
+		return "automated sender"
+	}
+
+	// RFC 3834, Section 2.
+	if autoSubmitted := strings.TrimSpace(strings.ToLower(h.Get("Auto-Submitted"))); autoSubmitted != "" && autoSubmitted != "no" {
+		return "auto-submitted message"
+	}
+	switch strings.TrimSpace(strings.ToLower(h.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "bulk message"
+	}
+	for _, field := range []string{"List-Id", "List-Unsubscribe", "List-Post", "List-Help"} {
+		if h.Has(field) {
+			return "mailing list message"
+		}
+	}
+	for _, value := range h.Values("X-Auto-Response-Suppress") {
+		value = strings.ToLower(value)
+		if strings.Contains(value, "all") || strings.Contains(value, "oof") {
+			return "auto-response suppressed"
+		}
+	}
+	return ""
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,209 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package vacation
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	modstate "github.com/foxcpp/maddy/internal/state"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (t mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t.M))
+	for k := range t.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t mutableTable) SetKey(k, v string) error {
+	t.M[k] = v
+	return nil
+}
+
+func (t mutableTable) RemoveKey(k string) error {
+	delete(t.M, k)
+	return nil
+}
+
+func testVacation(t *testing.T) (*Vacation, *testutils.Target) {
+	t.Helper()
+
+	st, err := modstate.NewMemory("state.memory", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt := &testutils.Target{}
+	v := &Vacation{
+		instName:        "test",
+		log:             testutils.Logger(t, modName),
+		settings:        mutableTable{testutils.Table{M: map[string]string{}}},
+		state:           st.(module.SharedState),
+		target:          tgt,
+		defaultInterval: 24 * time.Hour,
+	}
+	if err := v.Set("Away@example.org", Settings{Message: "I am on vacation."}); err != nil {
+		t.Fatal(err)
+	}
+	return v, tgt
+}
+
+func deliver(t *testing.T, v *Vacation, mailFrom string, rcpts []string, msg string) {
+	t.Helper()
+
+	st, err := v.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if _, err := st.RewriteSender(context.Background(), mailFrom); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range rcpts {
+		if _, err := st.RewriteRcpt(context.Background(), rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr, body := testutils.BodyFromStr(t, msg)
+	if err := st.RewriteBody(context.Background(), &hdr, body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVacation_Reply(t *testing.T) {
+	v, tgt := testVacation(t)
+
+	deliver(t, v, "sender@example.com", []string{"away@example.org", "other@example.org"},
+		"From: sender@example.com\r\n"+
+			"To: away@example.org, other@example.org\r\n"+
+			"Subject: Hello\r\n"+
+			"Message-Id: <orig@example.com>\r\n"+
+			"\r\n"+
+			"Hi!\r\n")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 reply, got %d", len(tgt.Messages))
+	}
+	reply := tgt.Messages[0]
+	if reply.MailFrom != "" {
+		t.Error("reply should use null return path, got", reply.MailFrom)
+	}
+	if len(reply.RcptTo) != 1 || reply.RcptTo[0] != "sender@example.com" {
+		t.Error("wrong reply recipients:", reply.RcptTo)
+	}
+	for field, want := range map[string]string{
+		"From":           "away@example.org",
+		"To":             "sender@example.com",
+		"Subject":        "Auto: Hello",
+		"In-Reply-To":    "<orig@example.com>",
+		"References":     "<orig@example.com>",
+		"Auto-Submitted": "auto-replied",
+	} {
+		if got := reply.Header.Get(field); got != want {
+			t.Errorf("%s: want %q, got %q", field, want, got)
+		}
+	}
+	if !strings.Contains(string(reply.Body), "I am on vacation.") {
+		t.Errorf("unexpected body: %q", reply.Body)
+	}
+
+	// Second message from the same correspondent is not replied to.
+	deliver(t, v, "sender@example.com", []string{"away@example.org"},
+		"To: away@example.org\r\n\r\nHi again!\r\n")
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected no reply to the second message, got %d replies", len(tgt.Messages))
+	}
+
+	// But another one is.
+	deliver(t, v, "sender2@example.com", []string{"away@example.org"},
+		"To: away@example.org\r\n\r\nHi!\r\n")
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("expected reply to another sender, got %d replies", len(tgt.Messages))
+	}
+}
+
+func TestVacation_NoReply(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		mailFrom string
+		msg      string
+	}{
+		{"null sender", "", "To: away@example.org\r\n\r\nHi!\r\n"},
+		{"mailer-daemon", "MAILER-DAEMON@example.com", "To: away@example.org\r\n\r\nHi!\r\n"},
+		{"list owner", "owner-list@example.com", "To: away@example.org\r\n\r\nHi!\r\n"},
+		{"list request", "list-request@example.com", "To: away@example.org\r\n\r\nHi!\r\n"},
+		{"noreply", "noreply@example.com", "To: away@example.org\r\n\r\nHi!\r\n"},
+		{"self", "away@example.org", "To: away@example.org\r\n\r\nHi!\r\n"},
+		{"auto-submitted", "sender@example.com", "To: away@example.org\r\nAuto-Submitted: auto-replied\r\n\r\nHi!\r\n"},
+		{"precedence", "sender@example.com", "To: away@example.org\r\nPrecedence: bulk\r\n\r\nHi!\r\n"},
+		{"list", "sender@example.com", "To: list@example.com\r\nList-Id: <list.example.com>\r\n\r\nHi!\r\n"},
+		{"suppressed", "sender@example.com", "To: away@example.org\r\nX-Auto-Response-Suppress: OOF, AutoReply\r\n\r\nHi!\r\n"},
+		{"bcc", "sender@example.com", "To: someone@example.org\r\n\r\nHi!\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, tgt := testVacation(t)
+			deliver(t, v, tc.mailFrom, []string{"away@example.org"}, tc.msg)
+			if len(tgt.Messages) != 0 {
+				t.Errorf("unexpected reply: %+v", tgt.Messages[0].Header)
+			}
+		})
+	}
+}
+
+func TestVacation_DateRange(t *testing.T) {
+	v, tgt := testVacation(t)
+	if err := v.Set("away@example.org", Settings{
+		Message: "Back soon",
+		Start:   time.Now().Add(24 * time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, v, "sender@example.com", []string{"away@example.org"}, "To: away@example.org\r\n\r\nHi!\r\n")
+	if len(tgt.Messages) != 0 {
+		t.Fatal("reply sent before the start date")
+	}
+
+	if err := v.Set("away@example.org", Settings{
+		Message: "Back soon",
+		End:     time.Now().Add(-time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, v, "sender@example.com", []string{"away@example.org"}, "To: away@example.org\r\n\r\nHi!\r\n")
+	if len(tgt.Messages) != 0 {
+		t.Fatal("reply sent after the end date")
+	}
+
+	if err := v.Remove("away@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := v.Get(context.Background(), "away@example.org"); ok {
+		t.Fatal("settings are not removed")
+	}
+}
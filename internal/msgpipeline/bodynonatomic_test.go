@@ -22,6 +22,8 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -146,3 +148,45 @@ func TestMsgPipeline_BodyNonAtomic_ExpandAtomic(t *testing.T) {
 		t.Errorf("wrong error for tester@example.org: %v", err)
 	}
 }
+
+func TestMsgPipeline_BodyNonAtomic_Rewrite(t *testing.T) {
+	rwHdr := textproto.Header{}
+	rwHdr.Add("Subject", "[SPAM] test")
+
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			Rewrite: &module.MsgRewrite{
+				Header: rwHdr,
+				Body:   buffer.MemoryBuffer{Slice: []byte("rewritten\r\n")},
+			},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	c := multipleErrs{}
+	testutils.DoTestDeliveryNonAtomic(t, c, &d, "sender@example.org", []string{"tester@example.org"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msg := target.Messages[0]
+	if msg.Header.Get("Subject") != "[SPAM] test" {
+		t.Errorf("wrong Subject value: %s", msg.Header.Get("Subject"))
+	}
+	if string(msg.Body) != "rewritten\r\n" {
+		t.Errorf("wrong body: %q", msg.Body)
+	}
+}
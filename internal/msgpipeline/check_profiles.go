@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// checkProfiles selects an additional set of checks ("profile") to run for
+// each recipient using the table lookup.
+type checkProfiles struct {
+	t              module.Table
+	profiles       map[string][]module.Check
+	defaultProfile string
+}
+
+func parseCheckProfiles(globals map[string]interface{}, node config.Node) (*checkProfiles, error) {
+	cp := &checkProfiles{
+		profiles: map[string][]module.Check{},
+	}
+	if err := modconfig.ModuleFromNode("table", node.Args, config.Node{}, globals, &cp.t); err != nil {
+		return nil, err
+	}
+
+	for _, child := range node.Children {
+		switch child.Name {
+		case "profile":
+			if len(child.Args) != 1 {
+				return nil, config.NodeErr(child, "exactly one argument is required")
+			}
+			name := child.Args[0]
+			if _, ok := cp.profiles[name]; ok {
+				return nil, config.NodeErr(child, "duplicate profile: %s", name)
+			}
+			checks, err := parseChecksGroup(globals, config.Node{
+				Name:     "check",
+				Children: child.Children,
+				File:     child.File,
+				Line:     child.Line,
+			})
+			if err != nil {
+				return nil, err
+			}
+			cp.profiles[name] = checks
+		case "default_profile":
+			if len(child.Args) != 1 {
+				return nil, config.NodeErr(child, "exactly one argument is required")
+			}
+			cp.defaultProfile = child.Args[0]
+		default:
+			return nil, config.NodeErr(child, "unknown directive: %s", child.Name)
+		}
+	}
+
+	if cp.defaultProfile == "" {
+		return nil, config.NodeErr(node, "default_profile is required")
+	}
+	if _, ok := cp.profiles[cp.defaultProfile]; !ok {
+		return nil, config.NodeErr(node, "unknown default profile: %s", cp.defaultProfile)
+	}
+
+	return cp, nil
+}
+
+// forRcpt returns the name of the profile to use for the recipient.
+//
+// The table is queried using the full recipient address first and then
+// using the domain only. If there is no match or the lookup fails,
+// the default profile is used.
+func (cp *checkProfiles) forRcpt(ctx context.Context, l log.Logger, rcptTo string) string {
+	cleanRcpt, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return cp.defaultProfile
+	}
+
+	keys := []string{cleanRcpt}
+	if _, domain, err := address.Split(cleanRcpt); err == nil && domain != "" {
+		keys = append(keys, domain)
+	}
+
+	for _, key := range keys {
+		name, ok, err := cp.t.Lookup(ctx, key)
+		if err != nil {
+			l.Error("check_profiles lookup failed, using default profile", err, "key", key)
+			return cp.defaultProfile
+		}
+		if !ok {
+			continue
+		}
+		if _, ok := cp.profiles[name]; !ok {
+			l.Msg("unknown check profile, using default profile", "key", key, "profile", name)
+			return cp.defaultProfile
+		}
+		return name
+	}
+	return cp.defaultProfile
+}
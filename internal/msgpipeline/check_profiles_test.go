@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheckProfiles_ForRcpt(t *testing.T) {
+	cp := &checkProfiles{
+		t: testutils.Table{M: map[string]string{
+			"postmaster@example.org": "none",
+			"example.org":            "strict",
+			"example.com":            "unknown",
+		}},
+		profiles: map[string][]module.Check{
+			"none":    nil,
+			"strict":  nil,
+			"default": nil,
+		},
+		defaultProfile: "default",
+	}
+
+	test := func(rcpt, expected string) {
+		t.Helper()
+		profile := cp.forRcpt(context.Background(), testutils.Logger(t, "check_profiles"), rcpt)
+		if profile != expected {
+			t.Errorf("wrong profile for %s: want %s, got %s", rcpt, expected, profile)
+		}
+	}
+
+	test("postmaster@example.org", "none")
+	test("PostMaster@EXAMPLE.org", "none")
+	test("user@example.org", "strict")
+	test("user@example.com", "default")
+	test("user@example.net", "default")
+	test("postmaster", "default")
+
+	cp.t = testutils.Table{Err: errors.New("nope")}
+	test("postmaster@example.org", "default")
+}
+
+func TestMsgPipeline_CheckProfiles(t *testing.T) {
+	target := testutils.Target{}
+	globalCheck := testutils.Check{InstName: "global_check"}
+	strictCheck := testutils.Check{
+		InstName: "strict_check",
+		RcptRes:  module.CheckResult{Reject: true, Reason: errors.New("rejected")},
+	}
+	defaultCheck := testutils.Check{InstName: "default_check"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&globalCheck},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			checkProfiles: &checkProfiles{
+				t: testutils.Table{M: map[string]string{
+					"postmaster@example.org": "none",
+					"example.org":            "strict",
+				}},
+				profiles: map[string][]module.Check{
+					"none":    nil,
+					"strict":  {&strictCheck},
+					"default": {&defaultCheck},
+				},
+				defaultProfile: "default",
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"user@example.com", "postmaster@example.org"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	testutils.CheckMsg(t, &target.Messages[0], "sender@example.com", []string{"user@example.com", "postmaster@example.org"})
+
+	if strictCheck.RcptCalls != 0 {
+		t.Fatalf("strict_check should not be called, got %d calls", strictCheck.RcptCalls)
+	}
+	if defaultCheck.RcptCalls != 1 || defaultCheck.BodyCalls != 1 {
+		t.Fatalf("default_check should be called once, got %d rcpt calls and %d body calls",
+			defaultCheck.RcptCalls, defaultCheck.BodyCalls)
+	}
+	if globalCheck.RcptCalls != 2 {
+		t.Fatalf("global_check should be called for each recipient, got %d calls", globalCheck.RcptCalls)
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"user@example.org"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if strictCheck.RcptCalls != 1 {
+		t.Fatalf("strict_check should be called once, got %d calls", strictCheck.RcptCalls)
+	}
+
+	if globalCheck.UnclosedStates != 0 || strictCheck.UnclosedStates != 0 || defaultCheck.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, counters: %d, %d, %d",
+			globalCheck.UnclosedStates, strictCheck.UnclosedStates, defaultCheck.UnclosedStates)
+	}
+}
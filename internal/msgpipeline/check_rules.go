@@ -0,0 +1,580 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+)
+
+// checkRule is a rule from the check_rules block that combines results of
+// multiple checks.
+type checkRule struct {
+	reject bool
+	src    string
+	expr   ruleExpr
+}
+
+// checkOutcome is the summary of the results returned by a single check for
+// the message, used by check rules.
+type checkOutcome struct {
+	failed bool
+	score  float64
+}
+
+// ruleEnv contains the information check rules are evaluated against.
+type ruleEnv struct {
+	checks        map[string]checkOutcome
+	authRes       []authres.Result
+	authenticated bool
+	quarantined   bool
+}
+
+// checkRuleName returns the name used to refer to the check in rules. It is
+// the instance name for checks defined at the top level and the module name
+// (without the check. prefix) for inline definitions.
+func checkRuleName(check module.Check) string {
+	mod, ok := check.(module.Module)
+	if !ok {
+		return objectName(check)
+	}
+	if mod.InstanceName() != "" {
+		return mod.InstanceName()
+	}
+	return strings.TrimPrefix(mod.Name(), "check.")
+}
+
+func parseCheckRules(node config.Node) ([]checkRule, error) {
+	rules := make([]checkRule, 0, len(node.Children))
+	for _, child := range node.Children {
+		var rule checkRule
+		switch child.Name {
+		case "reject":
+			rule.reject = true
+		case "quarantine":
+		default:
+			return nil, config.NodeErr(child, "unknown check rule action: %s", child.Name)
+		}
+		if len(child.Args) == 0 {
+			return nil, config.NodeErr(child, "expected a rule expression")
+		}
+
+		rule.src = strings.Join(child.Args, " ")
+		expr, err := parseRuleExpr(rule.src)
+		if err != nil {
+			return nil, config.NodeErr(child, "invalid rule expression: %v", err)
+		}
+		rule.expr = expr
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// applyCheckRules evaluates rules in order. The first matching reject rule
+// stops evaluation and its error is returned. Rules that can't be evaluated
+// are logged and skipped.
+func (cr *checkRunner) applyCheckRules(rules []checkRule) error {
+	env := ruleEnv{
+		checks:      cr.checkOutcomes,
+		authRes:     cr.mergedRes.AuthResult,
+		quarantined: cr.msgMeta.Quarantine,
+	}
+	if cr.msgMeta.Conn != nil {
+		env.authenticated = cr.msgMeta.Conn.AuthUser != ""
+	}
+
+	for _, rule := range rules {
+		v, err := rule.expr.eval(&env)
+		if err != nil {
+			cr.log.Error("check rule evaluation failed", err, "rule", rule.src)
+			continue
+		}
+		if !v.truthy() {
+			continue
+		}
+
+		if rule.reject {
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Message rejected due to a local policy",
+				CheckName:    "check_rules",
+				Misc: map[string]interface{}{
+					"rule": rule.src,
+				},
+			}
+		}
+		if !cr.msgMeta.Quarantine {
+			cr.msgMeta.Quarantine = true
+			env.quarantined = true
+			cr.log.Msg("quarantined", "check", "check_rules", "rule", rule.src)
+		}
+	}
+	return nil
+}
+
+type valueKind int
+
+const (
+	kindBool valueKind = iota
+	kindNumber
+	kindString
+)
+
+type ruleValue struct {
+	kind valueKind
+	b    bool
+	n    float64
+	s    string
+}
+
+// truthy returns the value of v in a boolean context. Strings (such as
+// authentication results) are true only if they are equal to "pass".
+func (v ruleValue) truthy() bool {
+	switch v.kind {
+	case kindBool:
+		return v.b
+	case kindNumber:
+		return v.n != 0
+	default:
+		return v.s == string(authres.ResultPass)
+	}
+}
+
+type ruleExpr interface {
+	eval(env *ruleEnv) (ruleValue, error)
+}
+
+type (
+	orExpr  struct{ l, r ruleExpr }
+	andExpr struct{ l, r ruleExpr }
+	notExpr struct{ e ruleExpr }
+	cmpExpr struct {
+		op   string
+		l, r ruleExpr
+	}
+	literalExpr struct{ v ruleValue }
+	identExpr   struct{ name string }
+)
+
+func (e orExpr) eval(env *ruleEnv) (ruleValue, error) {
+	l, err := e.l.eval(env)
+	if err != nil {
+		return ruleValue{}, err
+	}
+	if l.truthy() {
+		return ruleValue{kind: kindBool, b: true}, nil
+	}
+	r, err := e.r.eval(env)
+	if err != nil {
+		return ruleValue{}, err
+	}
+	return ruleValue{kind: kindBool, b: r.truthy()}, nil
+}
+
+func (e andExpr) eval(env *ruleEnv) (ruleValue, error) {
+	l, err := e.l.eval(env)
+	if err != nil {
+		return ruleValue{}, err
+	}
+	if !l.truthy() {
+		return ruleValue{kind: kindBool}, nil
+	}
+	r, err := e.r.eval(env)
+	if err != nil {
+		return ruleValue{}, err
+	}
+	return ruleValue{kind: kindBool, b: r.truthy()}, nil
+}
+
+func (e notExpr) eval(env *ruleEnv) (ruleValue, error) {
+	v, err := e.e.eval(env)
+	if err != nil {
+		return ruleValue{}, err
+	}
+	return ruleValue{kind: kindBool, b: !v.truthy()}, nil
+}
+
+func (e literalExpr) eval(*ruleEnv) (ruleValue, error) {
+	return e.v, nil
+}
+
+// eval resolves the identifier. Checks that did not run for the message are
+// considered passed with zero score.
+func (e identExpr) eval(env *ruleEnv) (ruleValue, error) {
+	v, _ := env.lookup(e.name)
+	return v, nil
+}
+
+func (e cmpExpr) eval(env *ruleEnv) (ruleValue, error) {
+	l, err := e.operand(env, e.l)
+	if err != nil {
+		return ruleValue{}, err
+	}
+	r, err := e.operand(env, e.r)
+	if err != nil {
+		return ruleValue{}, err
+	}
+
+	// Strings are converted to the type of the other operand so quoted
+	// literals can be compared with numbers and booleans.
+	if l.kind != r.kind {
+		if l.kind == kindString {
+			l, err = coerce(l, r.kind)
+		} else if r.kind == kindString {
+			r, err = coerce(r, l.kind)
+		} else {
+			err = fmt.Errorf("can't compare %s with %s", l.kind, r.kind)
+		}
+		if err != nil {
+			return ruleValue{}, err
+		}
+	}
+
+	var res bool
+	switch e.op {
+	case "==", "!=":
+		switch l.kind {
+		case kindBool:
+			res = l.b == r.b
+		case kindNumber:
+			res = l.n == r.n
+		default:
+			res = strings.EqualFold(l.s, r.s)
+		}
+		if e.op == "!=" {
+			res = !res
+		}
+	default:
+		if l.kind != kindNumber {
+			return ruleValue{}, fmt.Errorf("%s operator requires numbers, got %s", e.op, l.kind)
+		}
+		switch e.op {
+		case "<":
+			res = l.n < r.n
+		case "<=":
+			res = l.n <= r.n
+		case ">":
+			res = l.n > r.n
+		case ">=":
+			res = l.n >= r.n
+		}
+	}
+	return ruleValue{kind: kindBool, b: res}, nil
+}
+
+// operand evaluates the comparison operand. Unknown identifiers are
+// treated as string literals so results can be written without quoting,
+// e.g. spf != pass.
+func (e cmpExpr) operand(env *ruleEnv, op ruleExpr) (ruleValue, error) {
+	ident, ok := op.(identExpr)
+	if !ok {
+		return op.eval(env)
+	}
+	v, known := env.lookup(ident.name)
+	if !known {
+		return ruleValue{kind: kindString, s: ident.name}, nil
+	}
+	return v, nil
+}
+
+func (k valueKind) String() string {
+	switch k {
+	case kindBool:
+		return "boolean"
+	case kindNumber:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+func coerce(v ruleValue, kind valueKind) (ruleValue, error) {
+	switch kind {
+	case kindNumber:
+		n, err := strconv.ParseFloat(v.s, 64)
+		if err != nil {
+			return ruleValue{}, fmt.Errorf("can't compare %q with a number", v.s)
+		}
+		return ruleValue{kind: kindNumber, n: n}, nil
+	case kindBool:
+		b, err := strconv.ParseBool(v.s)
+		if err != nil {
+			return ruleValue{}, fmt.Errorf("can't compare %q with a boolean", v.s)
+		}
+		return ruleValue{kind: kindBool, b: b}, nil
+	}
+	return v, nil
+}
+
+// lookup returns the value of the named variable. known is false if the name
+// does not refer to a built-in variable, a score or a check that ran for the
+// message.
+func (env *ruleEnv) lookup(name string) (v ruleValue, known bool) {
+	switch name {
+	case "spf", "dkim", "dmarc":
+		return ruleValue{kind: kindString, s: env.authResult(name)}, true
+	case "authenticated":
+		return ruleValue{kind: kindBool, b: env.authenticated}, true
+	case "quarantined":
+		return ruleValue{kind: kindBool, b: env.quarantined}, true
+	case "score":
+		var total float64
+		for _, outcome := range env.checks {
+			total += outcome.score
+		}
+		return ruleValue{kind: kindNumber, n: total}, true
+	}
+
+	if checkName := strings.TrimSuffix(name, ".score"); checkName != name {
+		return ruleValue{kind: kindNumber, n: env.checks[checkName].score}, true
+	}
+	outcome, ok := env.checks[name]
+	return ruleValue{kind: kindBool, b: outcome.failed}, ok
+}
+
+// authResult returns the result of the specified authentication method.
+// For DKIM, "pass" is returned if any signature passed.
+func (env *ruleEnv) authResult(method string) string {
+	res := authres.ResultNone
+	for _, r := range env.authRes {
+		var value authres.ResultValue
+		switch r := r.(type) {
+		case *authres.SPFResult:
+			if method != "spf" {
+				continue
+			}
+			value = r.Value
+		case *authres.DMARCResult:
+			if method != "dmarc" {
+				continue
+			}
+			value = r.Value
+		default:
+			if method != "dkim" {
+				continue
+			}
+			dkimRes, _, ok := dmarc.AsDKIMResult(r)
+			if !ok {
+				continue
+			}
+			value = dkimRes.Value
+		}
+		if value == authres.ResultPass {
+			return string(value)
+		}
+		if res == authres.ResultNone {
+			res = value
+		}
+	}
+	return string(res)
+}
+
+type ruleParser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenizeRule(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '\'':
+			end := strings.IndexByte(src[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, src[i:i+end+2])
+			i += end + 2
+		case strings.ContainsRune("=!<>&|", rune(ch)):
+			op := string(ch)
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("unexpected %q", op)
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		case isIdentRune(rune(ch)):
+			start := i
+			for i < len(src) && isIdentRune(rune(src[i])) {
+				i++
+			}
+			tokens = append(tokens, src[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected %q", ch)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentRune(ch rune) bool {
+	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_' || ch == '.' || ch == '-'
+}
+
+func parseRuleExpr(src string) (ruleExpr, error) {
+	tokens, err := tokenizeRule(src)
+	if err != nil {
+		return nil, err
+	}
+	p := ruleParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch tok := p.peek(); strings.ToLower(tok) {
+		case "||", "or":
+			p.pos++
+			r, err := p.parseAnd()
+			if err != nil {
+				return nil, err
+			}
+			l = orExpr{l, r}
+		default:
+			return l, nil
+		}
+	}
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch tok := p.peek(); strings.ToLower(tok) {
+		case "&&", "and":
+			p.pos++
+			r, err := p.parseNot()
+			if err != nil {
+				return nil, err
+			}
+			l = andExpr{l, r}
+		default:
+			return l, nil
+		}
+	}
+}
+
+func (p *ruleParser) parseNot() (ruleExpr, error) {
+	switch tok := p.peek(); strings.ToLower(tok) {
+	case "!", "not":
+		p.pos++
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *ruleParser) parseCmp() (ruleExpr, error) {
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		r, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return cmpExpr{op: op, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *ruleParser) parseOperand() (ruleExpr, error) {
+	tok := p.peek()
+	p.pos++
+	switch {
+	case tok == "":
+		return nil, errors.New("unexpected end of expression")
+	case tok == "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return e, nil
+	case tok[0] == '\'':
+		return literalExpr{ruleValue{kind: kindString, s: tok[1 : len(tok)-1]}}, nil
+	case isIdentRune(rune(tok[0])):
+		if tok[0] == '-' || unicode.IsDigit(rune(tok[0])) {
+			n, err := strconv.ParseFloat(tok, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number: %v", tok)
+			}
+			return literalExpr{ruleValue{kind: kindNumber, n: n}}, nil
+		}
+		switch strings.ToLower(tok) {
+		case "true", "yes":
+			return literalExpr{ruleValue{kind: kindBool, b: true}}, nil
+		case "false", "no":
+			return literalExpr{ruleValue{kind: kindBool}}, nil
+		case "and", "or", "not":
+			return nil, fmt.Errorf("unexpected %q", tok)
+		}
+		return identExpr{name: tok}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
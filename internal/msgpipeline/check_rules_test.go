@@ -0,0 +1,226 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRuleExpr(t *testing.T) {
+	env := &ruleEnv{
+		checks: map[string]checkOutcome{
+			"dnsbl":      {score: 6},
+			"new_domain": {failed: true, score: 1},
+			"mime":       {},
+		},
+		authRes: []authres.Result{
+			&authres.SPFResult{Value: authres.ResultSoftFail},
+			&authres.DKIMResult{Value: authres.ResultFail, Domain: "a.example.org"},
+			&authres.DKIMResult{Value: authres.ResultPass, Domain: "b.example.org"},
+		},
+	}
+
+	test := func(expr string, expected bool) {
+		t.Helper()
+		e, err := parseRuleExpr(expr)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", expr, err)
+			return
+		}
+		v, err := e.eval(env)
+		if err != nil {
+			t.Errorf("%s: unexpected eval error: %v", expr, err)
+			return
+		}
+		if v.truthy() != expected {
+			t.Errorf("%s: want %v, got %v", expr, expected, v.truthy())
+		}
+	}
+
+	test("dnsbl.score > 5 && spf != pass", true)
+	test("dnsbl.score > 5 AND spf == softfail", true)
+	test("dnsbl.score >= 7 || spf == pass", false)
+	test("new_domain && !authenticated", true)
+	test("new_domain and not dkim", false)
+	test("dkim == pass", true)
+	test("dmarc == none", true)
+	test("mime || unknown_check", false)
+	test("unknown_check.score == 0", true)
+	test("score == 7", true)
+	test("(dnsbl.score > 5 || mime) && new_domain.score < 2", true)
+	test("!(dnsbl.score > 5)", false)
+	test("spf == 'softfail'", true)
+	test("dnsbl.score == '6'", true)
+	test("new_domain == true", true)
+	test("dnsbl.score > -1", true)
+
+	for _, expr := range []string{
+		"",
+		"dnsbl.score >",
+		"(spf == pass",
+		"spf = pass",
+		"spf == pass)",
+		"spf & dkim",
+		"spf == 'pass",
+		"spf == pass and",
+		"dnsbl.score > 5x",
+	} {
+		if _, err := parseRuleExpr(expr); err == nil {
+			t.Errorf("%q: expected a parse error", expr)
+		}
+	}
+
+	for _, expr := range []string{
+		"spf > 1",
+		"new_domain == dnsbl.score",
+		"dnsbl.score == pass",
+	} {
+		e, err := parseRuleExpr(expr)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", expr, err)
+			continue
+		}
+		if _, err := e.eval(env); err == nil {
+			t.Errorf("%s: expected an eval error", expr)
+		}
+	}
+}
+
+func TestParseCheckRules(t *testing.T) {
+	rules, err := parseCheckRules(config.Node{
+		Children: []config.Node{
+			{Name: "reject", Args: []string{"dnsbl.score", ">", "5", "&&", "spf", "!=", "pass"}},
+			{Name: "quarantine", Args: []string{"new_domain && !authenticated"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || !rules[0].reject || rules[1].reject {
+		t.Fatalf("wrong rules: %+v", rules)
+	}
+	if rules[0].src != "dnsbl.score > 5 && spf != pass" {
+		t.Fatalf("wrong rule source: %s", rules[0].src)
+	}
+
+	for _, node := range []config.Node{
+		{Name: "accept", Args: []string{"spf == pass"}},
+		{Name: "reject"},
+		{Name: "reject", Args: []string{"spf =="}},
+	} {
+		if _, err := parseCheckRules(config.Node{Children: []config.Node{node}}); err == nil {
+			t.Errorf("%v: expected an error", node)
+		}
+	}
+}
+
+func TestMsgPipeline_CheckRules(t *testing.T) {
+	test := func(t *testing.T, rules []checkRule, checks []module.Check) (*testutils.Target, error) {
+		t.Helper()
+		target := testutils.Target{}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: checks,
+				checkRules:   rules,
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+		_, err := testutils.DoTestDeliveryErr(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+		return &target, err
+	}
+	rule := func(reject bool, src string) checkRule {
+		expr, err := parseRuleExpr(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return checkRule{reject: reject, src: src, expr: expr}
+	}
+
+	newChecks := func() []module.Check {
+		return []module.Check{
+			&testutils.Check{
+				InstName: "dnsbl",
+				ConnRes:  module.CheckResult{Score: 6},
+			},
+			&testutils.Check{
+				InstName: "new_domain",
+				BodyRes:  module.CheckResult{Score: 1, Reason: errors.New("new domain")},
+			},
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		target, err := test(t, []checkRule{
+			rule(false, "new_domain"),
+			rule(true, "dnsbl.score > 5 && new_domain"),
+		}, newChecks())
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if len(target.Messages) != 0 {
+			t.Fatal("message was delivered")
+		}
+	})
+	t.Run("quarantine", func(t *testing.T) {
+		target, err := test(t, []checkRule{
+			rule(true, "dnsbl.score > 6"),
+			rule(false, "new_domain && !authenticated"),
+		}, newChecks())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(target.Messages) != 1 || !target.Messages[0].MsgMeta.Quarantine {
+			t.Fatal("message is not quarantined")
+		}
+	})
+	t.Run("no match", func(t *testing.T) {
+		target, err := test(t, []checkRule{
+			rule(true, "score > 10"),
+			rule(false, "dnsbl"),
+		}, newChecks())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(target.Messages) != 1 || target.Messages[0].MsgMeta.Quarantine {
+			t.Fatal("message is quarantined")
+		}
+		scores := target.Messages[0].MsgMeta.CheckScores
+		if scores["dnsbl"] != 6 || scores["new_domain"] != 1 {
+			t.Fatalf("wrong check scores: %v", scores)
+		}
+	})
+}
@@ -20,6 +20,7 @@ package msgpipeline
 
 import (
 	"context"
+	"net"
 	"runtime/debug"
 	"sync"
 
@@ -30,7 +31,12 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/panics"
+	"github.com/foxcpp/maddy/framework/slowlog"
 	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/dmarc/report"
+	"github.com/foxcpp/maddy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // checkRunner runs groups of checks, collects and merges results.
@@ -48,11 +54,20 @@ type checkRunner struct {
 	doDMARC       bool
 	didDMARCFetch bool
 	dmarcVerify   *dmarc.Verifier
+	// nil if reports are not generated.
+	dmarcReports *report.Reporter
+
+	checkRules []checkRule
 
 	log log.Logger
 
 	states map[module.Check]module.CheckState
 
+	// Results of each check by name, used by check rules.
+	stateNames    map[module.CheckState]string
+	checkOutcomes map[string]checkOutcome
+	outcomesLock  sync.Mutex
+
 	mergedRes module.CheckResult
 }
 
@@ -64,6 +79,8 @@ func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver)
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
+		stateNames:           make(map[module.CheckState]string),
+		checkOutcomes:        make(map[string]checkOutcome),
 	}
 }
 
@@ -93,6 +110,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 		states = append(states, state)
 		newStates = append(newStates, state)
 		newStatesMap[check] = state
+		cr.stateNames[state] = checkRuleName(check)
 	}
 
 	if len(newStates) == 0 {
@@ -105,7 +123,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	// Done outside of check loop above to make sure we can run these for multiple
 	// checks in parallel.
 	if cr.mailFromReceived {
-		err := cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err := cr.runAndMergeResults(ctx, "connection", newStates, func(s module.CheckState) module.CheckResult {
 			res := s.CheckConnection(ctx)
 			return res
 		})
@@ -113,7 +131,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 			closeStates()
 			return nil, err
 		}
-		err = cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err = cr.runAndMergeResults(ctx, "sender", newStates, func(s module.CheckState) module.CheckResult {
 			res := s.CheckSender(ctx, cr.mailFrom)
 			return res
 		})
@@ -126,20 +144,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	if len(cr.checkedRcpts) != 0 {
 		for _, rcpt := range cr.checkedRcpts {
 			rcpt := rcpt
-			err := cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
-				// Avoid calling CheckRcpt for the same recipient for the same check
-				// multiple times, even if requested.
-				cr.checkedRcptsLock.Lock()
-				if _, ok := cr.checkedRcptsPerCheck[s][rcpt]; ok {
-					cr.checkedRcptsLock.Unlock()
-					return module.CheckResult{}
-				}
-				if cr.checkedRcptsPerCheck[s] == nil {
-					cr.checkedRcptsPerCheck[s] = make(map[string]struct{})
-				}
-				cr.checkedRcptsPerCheck[s][rcpt] = struct{}{}
-				cr.checkedRcptsLock.Unlock()
-
+			err := cr.runAndMergeResults(ctx, "rcpt", cr.uncheckedStates(states, rcpt), func(s module.CheckState) module.CheckResult {
 				res := s.CheckRcpt(ctx, rcpt)
 				return res
 			})
@@ -159,7 +164,9 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	return states, nil
 }
 
-func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
+// runAndMergeResults runs the runner for each state in parallel. stage is
+// used to name the tracing spans created for each check.
+func (cr *checkRunner) runAndMergeResults(ctx context.Context, stage string, states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
 	data := struct {
 		authResLock sync.Mutex
 		headerLock  sync.Mutex
@@ -182,12 +189,21 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 			defer func() {
 				data.wg.Done()
 				if err := recover(); err != nil {
-					stack := debug.Stack()
-					log.Printf("panic during check execution: %v\n%s", err, stack)
+					panics.Report(cr.log, "check execution", err, debug.Stack(),
+						"msg_id", cr.msgMeta.ID, "trace_id", cr.msgMeta.TraceID, "check", cr.stateNames[state], "stage", stage)
 				}
 			}()
 
+			_, span := tracing.Start(ctx, "check."+stage, attribute.String("maddy.check", cr.stateNames[state]))
+			slowOp := slowlog.Start(ctx, slowlog.Check, cr.stateNames[state]+" ("+stage+")")
 			subCheckRes := runner(state)
+			slowOp.End()
+			span.SetAttributes(
+				attribute.Bool("maddy.check.reject", subCheckRes.Reject),
+				attribute.Bool("maddy.check.quarantine", subCheckRes.Quarantine),
+				attribute.Float64("maddy.check.score", subCheckRes.Score))
+			tracing.End(span, subCheckRes.Reason)
+			cr.recordOutcome(state, subCheckRes)
 
 			// We check the length because we don't want to take locks
 			// when it is not necessary.
@@ -207,6 +223,17 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				}
 				data.headerLock.Unlock()
 			}
+			if subCheckRes.Rewrite != nil {
+				data.headerLock.Lock()
+				if cr.mergedRes.Rewrite == nil {
+					cr.mergedRes.Rewrite = subCheckRes.Rewrite
+				} else {
+					cr.log.Msg("message is already rewritten by another check, discarding rewrite")
+				}
+				data.headerLock.Unlock()
+			}
+
+			recordVerdict(cr.stateNames[state], subCheckRes)
 
 			if subCheckRes.Quarantine {
 				data.setQuarantineErr.Do(func() {
@@ -238,6 +265,44 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 	return nil
 }
 
+// recordOutcome updates the per-check summary used by check rules. The
+// highest score returned by the check is used.
+func (cr *checkRunner) recordOutcome(state module.CheckState, res module.CheckResult) {
+	cr.outcomesLock.Lock()
+	defer cr.outcomesLock.Unlock()
+
+	name := cr.stateNames[state]
+	outcome, ok := cr.checkOutcomes[name]
+	if res.Reason != nil {
+		outcome.failed = true
+	}
+	if !ok || res.Score > outcome.score {
+		outcome.score = res.Score
+	}
+	cr.checkOutcomes[name] = outcome
+}
+
+// uncheckedStates returns the states that did not check the recipient yet and
+// marks it as checked for them. This way CheckRcpt is not called for the same
+// recipient for the same check multiple times, even if requested.
+func (cr *checkRunner) uncheckedStates(states []module.CheckState, rcptTo string) []module.CheckState {
+	cr.checkedRcptsLock.Lock()
+	defer cr.checkedRcptsLock.Unlock()
+
+	unchecked := make([]module.CheckState, 0, len(states))
+	for _, s := range states {
+		if _, ok := cr.checkedRcptsPerCheck[s][rcptTo]; ok {
+			continue
+		}
+		if cr.checkedRcptsPerCheck[s] == nil {
+			cr.checkedRcptsPerCheck[s] = make(map[string]struct{})
+		}
+		cr.checkedRcptsPerCheck[s][rcptTo] = struct{}{}
+		unchecked = append(unchecked, s)
+	}
+	return unchecked
+}
+
 func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Check, mailFrom string) error {
 	cr.mailFrom = mailFrom
 	cr.mailFromReceived = true
@@ -253,18 +318,7 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 		return err
 	}
 
-	err = cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
-		cr.checkedRcptsLock.Lock()
-		if _, ok := cr.checkedRcptsPerCheck[s][rcptTo]; ok {
-			cr.checkedRcptsLock.Unlock()
-			return module.CheckResult{}
-		}
-		if cr.checkedRcptsPerCheck[s] == nil {
-			cr.checkedRcptsPerCheck[s] = make(map[string]struct{})
-		}
-		cr.checkedRcptsPerCheck[s][rcptTo] = struct{}{}
-		cr.checkedRcptsLock.Unlock()
-
+	err = cr.runAndMergeResults(ctx, "rcpt", cr.uncheckedStates(states, rcptTo), func(s module.CheckState) module.CheckResult {
 		res := s.CheckRcpt(ctx, rcptTo)
 		return res
 	})
@@ -284,7 +338,7 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 		cr.didDMARCFetch = true
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	return cr.runAndMergeResults(ctx, "body", states, func(s module.CheckState) module.CheckResult {
 		res := s.CheckBody(ctx, header, body)
 		return res
 	})
@@ -297,6 +351,7 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 
 	if cr.doDMARC {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
+		cr.recordDMARC(dmarcRes, policy)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
 		switch policy {
 		case dmarc.PolicyReject:
@@ -327,6 +382,17 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 		}
 	}
 
+	for name, outcome := range cr.checkOutcomes {
+		if cr.msgMeta.CheckScores == nil {
+			cr.msgMeta.CheckScores = make(map[string]float64, len(cr.checkOutcomes))
+		}
+		cr.msgMeta.CheckScores[name] = outcome.score
+	}
+
+	if err := cr.applyCheckRules(cr.checkRules); err != nil {
+		return err
+	}
+
 	// After results for all checks are checked, authRes will be populated with values
 	// we should put into Authentication-Results header.
 	if len(cr.mergedRes.AuthResult) != 0 {
@@ -343,6 +409,41 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	return nil
 }
 
+// recordDMARC adds the DMARC evaluation result to aggregate reports.
+func (cr *checkRunner) recordDMARC(res dmarc.EvalResult, policy dmarc.Policy) {
+	if cr.dmarcReports == nil || cr.msgMeta.Conn == nil {
+		return
+	}
+	// Messages are rejected with a temporary error in this case, the result
+	// will be recorded when the message is retried.
+	if res.Authres.Value == authres.ResultTempError {
+		return
+	}
+	tcpAddr, ok := cr.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	policyDomain, rec := cr.dmarcVerify.PolicyRecord()
+	if rec == nil {
+		return
+	}
+
+	// Apply returns PolicyNone for failed messages if the policy is not
+	// applied because of the pct tag.
+	sampledOut := res.Authres.Value == authres.ResultFail && policy == dmarc.PolicyNone && rec.Policy != dmarc.PolicyNone
+
+	cr.dmarcReports.Record(report.Result{
+		SourceIP:     tcpAddr.IP,
+		HeaderFrom:   res.Authres.From,
+		PolicyDomain: policyDomain,
+		Record:       rec,
+		Eval:         res,
+		Disposition:  policy,
+		SampledOut:   sampledOut,
+		AuthResults:  cr.mergedRes.AuthResult,
+	})
+}
+
 func (cr *checkRunner) close() {
 	cr.dmarcVerify.Close()
 	for _, state := range cr.states {
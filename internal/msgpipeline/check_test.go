@@ -24,6 +24,7 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -191,6 +192,58 @@ func TestMsgPipeline_Headers(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_Rewrite(t *testing.T) {
+	hdr1 := textproto.Header{}
+	hdr1.Add("HDR1", "1")
+	rwHdr := textproto.Header{}
+	rwHdr.Add("Subject", "[SPAM] test")
+
+	target := testutils.Target{}
+	check1, check2 := testutils.Check{
+		BodyRes: module.CheckResult{
+			Header: hdr1,
+		},
+	}, testutils.Check{
+		BodyRes: module.CheckResult{
+			Rewrite: &module.MsgRewrite{
+				Header: rwHdr,
+				Body:   buffer.MemoryBuffer{Slice: []byte("rewritten\r\n")},
+			},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check1, &check2},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msg := target.Messages[0]
+
+	if msg.Header.Get("Subject") != "[SPAM] test" {
+		t.Errorf("wrong Subject value: %s", msg.Header.Get("Subject"))
+	}
+	if msg.Header.Get("HDR1") != "1" {
+		t.Errorf("header field added by check is missing")
+	}
+	if string(msg.Body) != "rewritten\r\n" {
+		t.Errorf("wrong body: %q", msg.Body)
+	}
+}
+
 func TestMsgPipeline_Globalcheck_Errors(t *testing.T) {
 	target := testutils.Target{}
 	check_ := testutils.Check{
@@ -29,6 +29,7 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc/report"
 	"github.com/foxcpp/maddy/internal/modify"
 )
 
@@ -44,6 +45,9 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	dmarcReports    *report.Reporter
+	checkProfiles   *checkProfiles
+	checkRules      []checkRule
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -129,6 +133,25 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
+		case "check_profiles":
+			if cfg.checkProfiles != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'check_profiles' block")
+			}
+			profiles, err := parseCheckProfiles(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.checkProfiles = profiles
+		case "check_rules":
+			rules, err := parseCheckRules(node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.checkRules = append(cfg.checkRules, rules...)
+		case "dmarc_reports":
+			if err := modconfig.GroupFromNode("dmarc_reports", node.Args, node, globals, &cfg.dmarcReports); err != nil {
+				return msgpipelineCfg{}, err
+			}
 		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
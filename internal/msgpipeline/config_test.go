@@ -334,6 +334,61 @@ func TestMsgPipelineCfg_GlobalChecksMultiple(t *testing.T) {
 	}
 }
 
+func TestMsgPipelineCfg_CheckProfiles(t *testing.T) {
+	str := `
+		check_profiles dummy {
+			profile none {
+			}
+			profile strict {
+				test_check
+				test_check
+			}
+			default_profile strict
+		}
+		default_destination {
+			reject 500
+		}
+	`
+
+	cfg, _ := parser.Read(strings.NewReader(str), "literal")
+	parsed, err := parseMsgPipelineRootCfg(nil, cfg)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+
+	if parsed.checkProfiles == nil {
+		t.Fatalf("missing check_profiles")
+	}
+	if len(parsed.checkProfiles.profiles["none"]) != 0 {
+		t.Fatalf("wrong amount of checks in profile none: %d", len(parsed.checkProfiles.profiles["none"]))
+	}
+	if len(parsed.checkProfiles.profiles["strict"]) != 2 {
+		t.Fatalf("wrong amount of checks in profile strict: %d", len(parsed.checkProfiles.profiles["strict"]))
+	}
+	if parsed.checkProfiles.defaultProfile != "strict" {
+		t.Fatalf("wrong default profile: %s", parsed.checkProfiles.defaultProfile)
+	}
+}
+
+func TestMsgPipelineCfg_CheckProfiles_UnknownDefault(t *testing.T) {
+	str := `
+		check_profiles dummy {
+			profile none {
+			}
+			default_profile strict
+		}
+		default_destination {
+			reject 500
+		}
+	`
+
+	cfg, _ := parser.Read(strings.NewReader(str), "literal")
+	_, err := parseMsgPipelineRootCfg(nil, cfg)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
 func TestMsgPipelineCfg_SourceChecks(t *testing.T) {
 	str := `
 		source example.org {
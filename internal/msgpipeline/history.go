@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/history"
+)
+
+// historyCollector remembers recipients rejected during BodyNonAtomic so
+// they are recorded as such in the delivery history.
+type historyCollector struct {
+	rejected map[string]error
+	wrapped  module.StatusCollector
+}
+
+func (hc historyCollector) SetStatus(rcptTo string, err error) {
+	if err != nil {
+		hc.rejected[rcptTo] = err
+	}
+	hc.wrapped.SetStatus(rcptTo, err)
+}
+
+// recordHistory adds delivery history events for all recipients of the
+// message. If err is not nil, the message is rejected for all of them.
+//
+// Only the first pipeline records events, nested pipelines see the same
+// message.
+func (dd *msgpipelineDelivery) recordHistory(err error) {
+	if !dd.d.FirstPipeline || !history.Enabled() {
+		return
+	}
+
+	targets := make(map[string][]string)
+	for tgt, delivery := range dd.deliveries {
+		for _, rcpt := range delivery.recipients {
+			targets[rcpt] = append(targets[rcpt], objectName(tgt))
+		}
+	}
+
+	modName := dd.d.Log.Instance
+	if modName == "" {
+		modName = dd.d.Log.Name
+	}
+	checks := dd.checkRunner.summary()
+	if dd.msgMeta.Quarantine {
+		checks += "; quarantined"
+	}
+
+	events := make([]history.Event, 0, len(targets))
+	for rcpt, rcptTargets := range targets {
+		ev := history.Event{
+			MsgID:  dd.msgMeta.ID,
+			Kind:   history.Received,
+			Module: modName,
+			Sender: dd.msgMeta.OriginalFrom,
+			Rcpt:   rcpt,
+		}
+		rcptErr := err
+		if rcptErr == nil {
+			rcptErr = dd.rejectedRcpts[rcpt]
+		}
+		if rcptErr != nil {
+			ev.Kind = history.Rejected
+			ev.Details = history.FormatErr(rcptErr)
+		} else {
+			sort.Strings(rcptTargets)
+			ev.Details = "to " + strings.Join(rcptTargets, ", ") + "; " + checks
+		}
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Rcpt < events[j].Rcpt
+	})
+	history.Record(events...)
+}
+
+// summary returns a short description of check results for the delivery
+// history.
+func (cr *checkRunner) summary() string {
+	cr.outcomesLock.Lock()
+	defer cr.outcomesLock.Unlock()
+
+	failed := make([]string, 0, len(cr.checkOutcomes))
+	for name, outcome := range cr.checkOutcomes {
+		if !outcome.failed {
+			continue
+		}
+		if outcome.score != 0 {
+			name += fmt.Sprintf(" (score %.1f)", outcome.score)
+		}
+		failed = append(failed, name)
+	}
+	if len(failed) == 0 {
+		return "checks passed"
+	}
+	sort.Strings(failed)
+	return "failed checks: " + strings.Join(failed, ", ")
+}
@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/history"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_History(t *testing.T) {
+	cfg := &history.Config{
+		Driver:    "sqlite3",
+		DSN:       filepath.Join(t.TempDir(), "history.db"),
+		Table:     "history",
+		Retention: time.Hour,
+	}
+	store, err := history.Open(cfg)
+	if err != nil {
+		t.Skip("cannot open history database:", err)
+	}
+	history.SetDefault(store)
+
+	target := testutils.Target{InstName: "local"}
+	check := testutils.Check{InstName: "test_check"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		FirstPipeline: true,
+		Log:           testutils.Logger(t, "msgpipeline"),
+	}
+	d.Log.Instance = "smtp"
+
+	testutils.DoTestDeliveryMeta(t, &d, "sender@example.org", []string{"rcpt@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "sender@example.org",
+		Conn:         &module.ConnState{},
+	})
+
+	check.BodyRes = module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Go away",
+		},
+	}
+	_, err = testutils.DoTestDeliveryErrMeta(t, &d, "sender@example.org", []string{"rcpt@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "sender@example.org",
+		Conn:         &module.ConnState{},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// Flush pending events.
+	history.SetDefault(nil)
+	store.Close()
+	store, err = history.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	events, err := store.Search(history.Query{Rcpt: "rcpt@example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("wrong events: %+v", events)
+	}
+	if ev := events[0]; ev.Kind != history.Received || ev.Module != "smtp" ||
+		ev.Sender != "sender@example.org" || !strings.Contains(ev.Details, "checks passed") {
+		t.Errorf("wrong received event: %+v", ev)
+	}
+	if ev := events[1]; ev.Kind != history.Rejected || ev.Details != "550 5.7.1 Go away" {
+		t.Errorf("wrong rejected event: %+v", ev)
+	}
+}
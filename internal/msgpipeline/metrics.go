@@ -18,7 +18,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package msgpipeline
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	checkReject = prometheus.NewCounterVec(
@@ -39,9 +42,35 @@ var (
 		},
 		[]string{"check"},
 	)
+	checkVerdicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "check",
+			Name:      "verdicts",
+			Help:      "Results returned by checks, verdict is pass, reject, quarantine or ignore (failed check with no action)",
+		},
+		[]string{"check", "verdict"},
+	)
 )
 
+// recordVerdict updates check metrics using the result returned by the check.
+func recordVerdict(check string, res module.CheckResult) {
+	verdict := "pass"
+	switch {
+	case res.Quarantine:
+		verdict = "quarantine"
+		checkQuarantined.WithLabelValues(check).Inc()
+	case res.Reject:
+		verdict = "reject"
+		checkReject.WithLabelValues(check).Inc()
+	case res.Reason != nil:
+		verdict = "ignore"
+	}
+	checkVerdicts.WithLabelValues(check, verdict).Inc()
+}
+
 func init() {
 	prometheus.MustRegister(checkReject)
 	prometheus.MustRegister(checkQuarantined)
+	prometheus.MustRegister(checkVerdicts)
 }
@@ -707,3 +707,36 @@ func TestMsgPipeline_RcptModifier_Errors(t *testing.T) {
 			mod.UnclosedStates, globalMod.UnclosedStates, sourceMod.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_BodyModifier(t *testing.T) {
+	target := testutils.Target{}
+	modifier := testutils.Modifier{
+		InstName: "test_modifier",
+		Body:     []byte("replaced body\r\n"),
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{},
+			perSource:       map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					modifiers: modify.Group{
+						Modifiers: []module.Modifier{modifier},
+					},
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if body := string(target.Messages[0].Body); body != "replaced body\r\n" {
+		t.Fatalf("body is not replaced: %q", body)
+	}
+}
@@ -32,7 +32,7 @@ type Module struct {
 
 func NewModule(modName, instName string, aliases, inlineArgs []string) (module.Module, error) {
 	return &Module{
-		log:      log.Logger{Name: "msgpipeline"},
+		log:      log.Logger{Name: "msgpipeline", Instance: instName},
 		instName: instName,
 	}, nil
 }
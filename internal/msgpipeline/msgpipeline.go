@@ -122,11 +122,15 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 		d:                  d,
 		rcptModifiersState: make(map[*rcptBlock]module.ModifierState),
 		deliveries:         make(map[module.DeliveryTarget]*delivery),
+		usedProfiles:       make(map[string]struct{}),
+		rejectedRcpts:      make(map[string]error),
 		msgMeta:            msgMeta,
 		log:                target.DeliveryLogger(d.Log, msgMeta),
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.dmarcReports = d.dmarcReports
+	dd.checkRunner.checkRules = d.checkRules
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -275,6 +279,15 @@ type msgpipelineDelivery struct {
 	deliveries  map[module.DeliveryTarget]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
+
+	// Names of check profiles selected for at least one recipient.
+	usedProfiles map[string]struct{}
+
+	// Recipients rejected by BodyNonAtomic, used for delivery history.
+	rejectedRcpts map[string]error
+
+	// Size of the message for traffic accounting, 0 if it is not accounted.
+	msgSize int
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
@@ -284,6 +297,14 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 	if err := dd.checkRunner.checkRcpt(ctx, dd.sourceBlock.checks, to); err != nil {
 		return err
 	}
+	if cp := dd.d.checkProfiles; cp != nil {
+		profile := cp.forRcpt(ctx, dd.log, to)
+		dd.log.Debugln("check profile for", to, "=>", profile)
+		if err := dd.checkRunner.checkRcpt(ctx, cp.profiles[profile], to); err != nil {
+			return err
+		}
+		dd.usedProfiles[profile] = struct{}{}
+	}
 
 	originalTo := to
 
@@ -376,18 +397,37 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 }
 
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	dd.measureTraffic(header, body)
+	if err := dd.body(ctx, header, body); err != nil {
+		dd.recordHistory(err)
+		return err
+	}
+	return nil
+}
+
+func (dd *msgpipelineDelivery) body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
 		return err
 	}
 	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
 		return err
 	}
+	for profile := range dd.usedProfiles {
+		if err := dd.checkRunner.checkBody(ctx, dd.d.checkProfiles.profiles[profile], header, body); err != nil {
+			return err
+		}
+	}
 	for blk := range dd.rcptModifiersState {
 		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
 			return err
 		}
 	}
 
+	if rw := dd.checkRunner.mergedRes.Rewrite; rw != nil {
+		header = rw.Header.Copy()
+		body = rw.Body
+	}
+
 	if dd.d.FirstPipeline {
 		// Add Received *after* checks to make sure they see the message literally
 		// how we received it BUT place it below any other field that might be
@@ -406,14 +446,18 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	var err error
+	body, err = module.RewriteBody(ctx, dd.globalModifiersState, &header, body)
+	if err != nil {
 		return err
 	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	body, err = module.RewriteBody(ctx, dd.sourceModifiersState, &header, body)
+	if err != nil {
 		return err
 	}
 	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
+		body, err = module.RewriteBody(ctx, modifiers, &header, body)
+		if err != nil {
 			return err
 		}
 	}
@@ -449,6 +493,9 @@ func (sc statusCollector) SetStatus(rcptTo string, err error) {
 }
 
 func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	c = historyCollector{rejected: dd.rejectedRcpts, wrapped: c}
+	dd.measureTraffic(header, body)
+
 	setStatusAll := func(err error) {
 		for _, delivery := range dd.deliveries {
 			for _, rcpt := range delivery.recipients {
@@ -465,19 +512,34 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		setStatusAll(err)
 		return
 	}
+	for profile := range dd.usedProfiles {
+		if err := dd.checkRunner.checkBody(ctx, dd.d.checkProfiles.profiles[profile], header, body); err != nil {
+			setStatusAll(err)
+			return
+		}
+	}
+
+	if rw := dd.checkRunner.mergedRes.Rewrite; rw != nil {
+		header = rw.Header.Copy()
+		body = rw.Body
+	}
 
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	var err error
+	body, err = module.RewriteBody(ctx, dd.globalModifiersState, &header, body)
+	if err != nil {
 		setStatusAll(err)
 		return
 	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	body, err = module.RewriteBody(ctx, dd.sourceModifiersState, &header, body)
+	if err != nil {
 		setStatusAll(err)
 		return
 	}
 	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
+		body, err = module.RewriteBody(ctx, modifiers, &header, body)
+		if err != nil {
 			setStatusAll(err)
 			return
 		}
@@ -507,9 +569,12 @@ func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
 	for _, delivery := range dd.deliveries {
 		if err := delivery.Commit(ctx); err != nil {
 			// No point in Committing remaining deliveries, everything is broken already.
+			dd.recordHistory(err)
 			return err
 		}
 	}
+	dd.recordHistory(nil)
+	dd.accountTraffic()
 	return nil
 }
 
@@ -0,0 +1,59 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/internal/traffic"
+)
+
+// measureTraffic remembers the size of the message if it should be
+// accounted as received from another server.
+//
+// Messages from authenticated clients are not accounted here, they are
+// accounted by target.remote when sent.
+func (dd *msgpipelineDelivery) measureTraffic(header textproto.Header, body buffer.Buffer) {
+	if !dd.d.FirstPipeline || dd.msgMeta.Conn == nil || dd.msgMeta.Conn.AuthUser != "" {
+		return
+	}
+	dd.msgSize = traffic.MessageSize(header, body)
+}
+
+// accountTraffic records the accepted message once for each recipient
+// domain.
+func (dd *msgpipelineDelivery) accountTraffic() {
+	if dd.msgSize == 0 {
+		return
+	}
+
+	remoteDomain := traffic.Domain(dd.msgMeta.OriginalFrom)
+	localDomains := make(map[string]struct{})
+	for _, delivery := range dd.deliveries {
+		for _, rcpt := range delivery.recipients {
+			if dd.rejectedRcpts[rcpt] != nil {
+				continue
+			}
+			localDomains[traffic.Domain(rcpt)] = struct{}{}
+		}
+	}
+	for domain := range localDomains {
+		traffic.Account(traffic.Received, domain, remoteDomain, dd.msgSize)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/foxcpp/maddy/internal/traffic"
+)
+
+func TestMsgPipeline_Traffic(t *testing.T) {
+	target := testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		FirstPipeline: true,
+		Log:           testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDeliveryMeta(t, &d, "sender@traffic-remote.test",
+		[]string{"rcpt1@traffic-local.test", "rcpt2@TRAFFIC-local.test", "rcpt@traffic-local2.test"},
+		&module.MsgMetadata{
+			OriginalFrom: "sender@traffic-remote.test",
+			Conn:         &module.ConnState{},
+		})
+	// Authenticated clients are accounted when the message is sent.
+	testutils.DoTestDeliveryMeta(t, &d, "sender@traffic-local.test", []string{"rcpt@traffic-remote.test"},
+		&module.MsgMetadata{
+			OriginalFrom: "sender@traffic-local.test",
+			Conn:         &module.ConnState{AuthUser: "sender@traffic-local.test"},
+		})
+
+	found := map[string]uint64{}
+	for _, rec := range traffic.Snapshot(false).Records {
+		if rec.RemoteDomain != "traffic-remote.test" {
+			continue
+		}
+		if rec.Direction != traffic.Received || rec.Bytes == 0 {
+			t.Errorf("unexpected record: %+v", rec)
+		}
+		found[rec.LocalDomain] = rec.Messages
+	}
+	if len(found) != 2 || found["traffic-local.test"] != 1 || found["traffic-local2.test"] != 1 {
+		t.Errorf("wrong records: %v", found)
+	}
+}
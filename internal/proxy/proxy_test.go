@@ -0,0 +1,210 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// greeting is sent by test servers through the tunnel.
+const greeting = "220 mx.example.invalid ESMTP\r\n"
+
+func readGreeting(t *testing.T, conn net.Conn) {
+	t.Helper()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != greeting {
+		t.Fatalf("Wrong data read through the tunnel: %q", line)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Method != http.MethodConnect || req.Host != "mx.example.invalid:25" {
+			t.Errorf("Wrong request: %s %s", req.Method, req.Host)
+		}
+		if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			t.Errorf("Wrong credentials: %s", req.Header.Get("Proxy-Authorization"))
+		}
+		// Greeting is sent together with the response to check it is not
+		// lost in the buffer.
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"+greeting)
+	}()
+
+	u, _ := url.Parse("http://user:pass@" + l.Addr().String())
+	dial, err := Dialer(u, (&net.Dialer{}).DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", "mx.example.invalid:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readGreeting(t, conn)
+}
+
+func TestHTTPConnect_Refused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	u, _ := url.Parse("http://" + l.Addr().String())
+	dial, _ := Dialer(u, (&net.Dialer{}).DialContext)
+	if _, err := dial(context.Background(), "tcp", "mx.example.invalid:25"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Version, methods count, methods.
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		methods := make([]byte, hdr[1])
+		io.ReadFull(conn, methods)
+		conn.Write([]byte{5, 0})
+
+		// Version, command, reserved, address type.
+		req := make([]byte, 4)
+		io.ReadFull(conn, req)
+		if req[1] != 1 || req[3] != 3 {
+			t.Errorf("Unexpected request: %v", req)
+			return
+		}
+		l := make([]byte, 1)
+		io.ReadFull(conn, l)
+		host := make([]byte, l[0])
+		io.ReadFull(conn, host)
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		if string(host) != "mx.example.invalid" || binary.BigEndian.Uint16(port) != 25 {
+			t.Errorf("Wrong destination: %s:%d", host, binary.BigEndian.Uint16(port))
+		}
+
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 25})
+		io.WriteString(conn, greeting)
+	}()
+
+	u, _ := url.Parse("socks5://" + l.Addr().String())
+	dial, err := Dialer(u, (&net.Dialer{}).DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", "mx.example.invalid:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readGreeting(t, conn)
+}
+
+func TestSelector(t *testing.T) {
+	def, _ := url.Parse("socks5://gw1.example.invalid:1080")
+	s := &Selector{
+		def: def,
+		m: testutils.Table{M: map[string]string{
+			"example.org": "http://gw2.example.invalid:3128",
+			"example.com": "direct",
+		}},
+	}
+
+	check := func(key, expected string) {
+		t.Helper()
+		u, err := s.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := Direct
+		if u != nil {
+			actual = u.String()
+		}
+		if actual != expected {
+			t.Errorf("%s: expected %s, got %s", key, expected, actual)
+		}
+	}
+	check("example.org", "http://gw2.example.invalid:3128")
+	check("example.com", Direct)
+	check("example.net", "socks5://gw1.example.invalid:1080")
+
+	s.m = testutils.Table{M: map[string]string{"example.org": "ftp://gw.example.invalid:21"}}
+	if _, err := s.Lookup(context.Background(), "example.org"); err == nil {
+		t.Error("Expected an error for unsupported scheme")
+	}
+
+	var nilSelector *Selector
+	if u, err := nilSelector.Lookup(context.Background(), "example.org"); u != nil || err != nil {
+		t.Error("nil Selector should select direct connection")
+	}
+}
@@ -187,7 +187,10 @@ func (p *P) Return(key string, c Conn) {
 
 	select {
 	case bucket.c <- c:
+		// slot is stored by value, write the updated timestamp back so
+		// actively used keys are not considered stale.
 		bucket.lastUse = time.Now().Unix()
+		p.keys[key] = bucket
 	default:
 		// Let it go, let it go...
 		go c.Close()
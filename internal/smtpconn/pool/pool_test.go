@@ -0,0 +1,150 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	usable  bool
+	lastUse time.Time
+	closed  chan struct{}
+}
+
+func newTestConn() *testConn {
+	return &testConn{
+		usable:  true,
+		lastUse: time.Now(),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *testConn) Usable() bool {
+	return c.usable
+}
+
+func (c *testConn) LastUseAt() time.Time {
+	return c.lastUse
+}
+
+func (c *testConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func testPool() *P {
+	return New(Config{
+		MaxKeys:             10,
+		MaxConnsPerKey:      2,
+		MaxConnLifetimeSec:  150,
+		StaleKeyLifetimeSec: 300,
+	})
+}
+
+func TestPool_Reuse(t *testing.T) {
+	p := testPool()
+	defer p.Close()
+
+	c := newTestConn()
+	p.Return("example.org", c)
+
+	got, err := p.Get(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Fatal("Cached connection is not reused")
+	}
+
+	got, err = p.Get(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatal("Same connection returned twice")
+	}
+}
+
+func TestPool_Unusable(t *testing.T) {
+	p := testPool()
+	defer p.Close()
+
+	c := newTestConn()
+	c.usable = false
+	p.Return("example.org", c)
+
+	got, err := p.Get(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatal("Unusable connection returned")
+	}
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unusable connection is not closed")
+	}
+}
+
+func TestPool_Overflow(t *testing.T) {
+	p := testPool()
+	defer p.Close()
+
+	conns := []*testConn{newTestConn(), newTestConn(), newTestConn()}
+	for _, c := range conns {
+		p.Return("example.org", c)
+	}
+
+	select {
+	case <-conns[2].closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection over MaxConnsPerKey is not closed")
+	}
+}
+
+func TestPool_ActiveKeyNotStale(t *testing.T) {
+	p := testPool()
+	defer p.Close()
+
+	first := newTestConn()
+	p.Return("example.org", first)
+
+	// Pretend the key was created long ago.
+	p.keysLock.Lock()
+	s := p.keys["example.org"]
+	s.lastUse = time.Now().Add(-time.Hour).Unix()
+	p.keys["example.org"] = s
+	p.keysLock.Unlock()
+
+	// Returning a connection should refresh the key.
+	p.Return("example.org", newTestConn())
+	p.CleanUp(context.Background())
+
+	c, err := p.Get(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != first {
+		t.Fatal("Cached connection is not reused after Return")
+	}
+}
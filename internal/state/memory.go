@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package state implements modules providing the module.SharedState
+// interface.
+package state
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type memEntry struct {
+	value   string
+	expires time.Time
+}
+
+// Memory is the in-process implementation of module.SharedState. It is used
+// when state does not need to be shared between multiple instances.
+type Memory struct {
+	instName string
+
+	lock sync.Mutex
+	m    map[string]memEntry
+
+	stop chan struct{}
+}
+
+func NewMemory(_, instName string, _, _ []string) (module.Module, error) {
+	return &Memory{
+		instName: instName,
+		m:        map[string]memEntry{},
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+func (m *Memory) Name() string {
+	return "state.memory"
+}
+
+func (m *Memory) InstanceName() string {
+	return m.instName
+}
+
+func (m *Memory) Init(cfg *config.Map) error {
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	go m.reapLoop()
+	return nil
+}
+
+func (m *Memory) reapLoop() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.reap(time.Now())
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *Memory) reap(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for k, e := range m.m {
+		if !now.Before(e.expires) {
+			delete(m.m, k)
+		}
+	}
+}
+
+// get returns the entry if it exists and is not expired. Lock should be held.
+func (m *Memory) get(key string, now time.Time) (memEntry, bool) {
+	e, ok := m.m[key]
+	if !ok {
+		return memEntry{}, false
+	}
+	if !now.Before(e.expires) {
+		delete(m.m, key)
+		return memEntry{}, false
+	}
+	return e, true
+}
+
+func (m *Memory) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	e, ok := m.get(key, now)
+	if !ok {
+		m.m[key] = memEntry{value: "1", expires: now.Add(ttl)}
+		return 1, nil
+	}
+
+	val, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	val++
+	e.value = strconv.FormatInt(val, 10)
+	m.m[key] = e
+	return val, nil
+}
+
+func (m *Memory) Get(_ context.Context, key string) (string, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.get(key, time.Now())
+	return e.value, ok, nil
+}
+
+func (m *Memory) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.m[key] = memEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *Memory) Del(_ context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.m, key)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	close(m.stop)
+	return nil
+}
+
+func init() {
+	module.Register("state.memory", NewMemory)
+}
@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func testMemory(t *testing.T) *Memory {
+	t.Helper()
+	mod, err := NewMemory("state.memory", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Memory)
+	if err := m.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestMemory_Incr(t *testing.T) {
+	m := testMemory(t)
+	ctx := context.Background()
+
+	for i := int64(1); i <= 3; i++ {
+		val, err := m.Incr(ctx, "a", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != i {
+			t.Fatalf("Wrong counter value: %d, want %d", val, i)
+		}
+	}
+
+	val, err := m.Incr(ctx, "b", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != 1 {
+		t.Fatal("Counters are not independent")
+	}
+
+	if err := m.Set(ctx, "c", "not a number", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Incr(ctx, "c", time.Hour); err == nil {
+		t.Fatal("No error for non-integer value")
+	}
+}
+
+func TestMemory_Expiry(t *testing.T) {
+	m := testMemory(t)
+	ctx := context.Background()
+
+	if _, err := m.Incr(ctx, "a", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(ctx, "b", "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, _ := m.Get(ctx, "b"); !ok || val != "value" {
+		t.Fatal("Wrong value:", val, ok)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, ok, _ := m.Get(ctx, "b"); ok {
+		t.Fatal("Key is not expired")
+	}
+	val, err := m.Incr(ctx, "a", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != 1 {
+		t.Fatal("Counter is not reset after expiry:", val)
+	}
+
+	if err := m.Set(ctx, "c", "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	m.reap(time.Now().Add(2 * time.Hour))
+	if len(m.m) != 0 {
+		t.Fatal("Expired keys are not reaped:", m.m)
+	}
+}
+
+func TestMemory_Del(t *testing.T) {
+	m := testMemory(t)
+	ctx := context.Background()
+
+	if err := m.Set(ctx, "a", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Del(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := m.Get(ctx, "a"); ok {
+		t.Fatal("Key is not removed")
+	}
+	if err := m.Del(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis implements module.SharedState using the Redis server, allowing
+// multiple maddy instances to share the state.
+type Redis struct {
+	instName string
+	addr     string
+
+	prefix string
+	client *redis.Client
+}
+
+func NewRedis(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	r := &Redis{
+		instName: instName,
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		r.addr = inlineArgs[0]
+	case 0:
+		r.addr = "127.0.0.1:6379"
+	default:
+		return nil, fmt.Errorf("state.redis: unexpected amount of inline arguments")
+	}
+
+	return r, nil
+}
+
+func (r *Redis) Name() string {
+	return "state.redis"
+}
+
+func (r *Redis) InstanceName() string {
+	return r.instName
+}
+
+func (r *Redis) Init(cfg *config.Map) error {
+	var (
+		username, password string
+		db                 int
+		useTLS             bool
+		tlsConfig          tls.Config
+		timeout            time.Duration
+	)
+	cfg.String("addr", false, false, r.addr, &r.addr)
+	cfg.String("username", false, false, "", &username)
+	cfg.String("password", false, false, "", &password)
+	cfg.Int("db", false, false, 0, &db)
+	cfg.String("key_prefix", false, false, "maddy:", &r.prefix)
+	cfg.Duration("timeout", false, false, 3*time.Second, &timeout)
+	cfg.Bool("tls", false, false, &useTLS)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	opts := &redis.Options{
+		Addr:         r.addr,
+		Username:     username,
+		Password:     password,
+		DB:           db,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+	if useTLS {
+		opts.TLSConfig = &tlsConfig
+	}
+	r.client = redis.NewClient(opts)
+
+	return nil
+}
+
+// incrScript increments the counter and sets the expiration time only when
+// it is created.
+var incrScript = redis.NewScript(`
+local val = redis.call("INCR", KEYS[1])
+if val == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return val
+`)
+
+func (r *Redis) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	val, err := incrScript.Run(ctx, r.client, []string{r.prefix + key}, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("state.redis: %w", err)
+	}
+	return val, nil
+}
+
+func (r *Redis) Get(ctx context.Context, key string) (string, bool, error) {
+	val, err := r.client.Get(ctx, r.prefix+key).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("state.redis: %w", err)
+	}
+	return val, true, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := r.client.Set(ctx, r.prefix+key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("state.redis: %w", err)
+	}
+	return nil
+}
+
+func (r *Redis) Del(ctx context.Context, key string) error {
+	if err := r.client.Del(ctx, r.prefix+key).Err(); err != nil {
+		return fmt.Errorf("state.redis: %w", err)
+	}
+	return nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+func init() {
+	module.Register("state.redis", NewRedis)
+}
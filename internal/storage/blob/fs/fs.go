@@ -89,7 +89,19 @@ func (s *FSStore) Delete(_ context.Context, keys []string) error {
 	return nil
 }
 
+// CheckHealth implements module.HealthChecker. It checks that the
+// directory is writable.
+func (s *FSStore) CheckHealth(_ context.Context) error {
+	f, err := os.CreateTemp(s.root, ".health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 func init() {
 	var _ module.BlobStore = &FSStore{}
+	var _ module.HealthChecker = &FSStore{}
 	module.Register(FSStore{}.Name(), New)
 }
@@ -190,7 +190,21 @@ func (s *Store) Delete(ctx context.Context, keys []string) error {
 	return lastErr
 }
 
+// CheckHealth implements module.HealthChecker. It checks that the bucket
+// is accessible.
+func (s *Store) CheckHealth(ctx context.Context) error {
+	exists, err := s.cl.BucketExists(ctx, s.bucketName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if !exists {
+		return fmt.Errorf("%s: bucket %s does not exist", modName, s.bucketName)
+	}
+	return nil
+}
+
 func init() {
 	var _ module.BlobStore = &Store{}
+	var _ module.HealthChecker = &Store{}
 	module.Register(modName, New)
 }
@@ -0,0 +1,515 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// AdminArgs are the arguments of "imap_acct.*", "imap_mboxes.*" and
+// "imap_msgs.*" control commands. Only fields used by the command need to
+// be set.
+type AdminArgs struct {
+	CfgBlock string `json:"cfg_block"`
+	Username string `json:"username,omitempty"`
+	Mailbox  string `json:"mailbox,omitempty"`
+
+	// New mailbox name for imap_mboxes.rename, destination mailbox for
+	// imap_msgs.copy and imap_msgs.move.
+	Target string `json:"target,omitempty"`
+
+	// SPECIAL-USE attribute for imap_mboxes.create (e.g. "\Sent").
+	SpecialUse string `json:"special_use,omitempty"`
+	// List only subscribed mailboxes in imap_mboxes.list.
+	Subscribed bool `json:"subscribed,omitempty"`
+	// Mailboxes created by imap_acct.create.
+	SpecialMailboxes []MailboxInfo `json:"special_mailboxes,omitempty"`
+
+	// New APPENDLIMIT value for imap_acct.appendlimit, -1 removes the
+	// limit. Current value is returned if not set.
+	AppendLimit *int64 `json:"append_limit,omitempty"`
+
+	SeqSet string `json:"seqset,omitempty"`
+	UID    bool   `json:"uid,omitempty"`
+
+	// Flags for imap_msgs.add and imap_msgs.flags.
+	Flags []string `json:"flags,omitempty"`
+	// Operation for imap_msgs.flags: "add", "remove" or "set".
+	FlagsOp string `json:"op,omitempty"`
+
+	// Message for imap_msgs.add, internal date is set to the current time
+	// if Date is not set.
+	Body []byte     `json:"body,omitempty"`
+	Date *time.Time `json:"date,omitempty"`
+
+	// Report messages as spam (instead of ham) in imap_msgs.learn.
+	Spam bool `json:"spam,omitempty"`
+}
+
+type MailboxInfo struct {
+	Name string `json:"name"`
+	// Attributes of the mailbox, for imap_acct.create only the SPECIAL-USE
+	// attribute is used.
+	Attributes []string `json:"attributes,omitempty"`
+}
+
+type MailboxStatus struct {
+	Messages    uint32 `json:"messages"`
+	Recent      uint32 `json:"recent"`
+	Unseen      uint32 `json:"unseen"`
+	UIDNext     uint32 `json:"uid_next"`
+	UIDValidity uint32 `json:"uid_validity"`
+}
+
+// MessageInfo is the message summary returned by imap_msgs.list.
+type MessageInfo struct {
+	UID          uint32    `json:"uid"`
+	SeqNum       uint32    `json:"seq_num"`
+	Flags        []string  `json:"flags"`
+	Size         uint32    `json:"size"`
+	InternalDate time.Time `json:"internal_date"`
+
+	// Envelope fields, addresses are formatted as "Name <user@example.org>".
+	Date      *time.Time `json:"date,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	From      []string   `json:"from,omitempty"`
+	To        []string   `json:"to,omitempty"`
+	Cc        []string   `json:"cc,omitempty"`
+	Bcc       []string   `json:"bcc,omitempty"`
+	InReplyTo string     `json:"in_reply_to,omitempty"`
+	MessageID string     `json:"message_id,omitempty"`
+}
+
+type MessageBody struct {
+	UID  uint32 `json:"uid"`
+	Body []byte `json:"body"`
+}
+
+type AppendLimit struct {
+	// nil if there is no limit.
+	Limit *uint32 `json:"limit"`
+}
+
+type AcctCreateResult struct {
+	// Errors for special mailboxes that could not be created, the account
+	// itself is created anyway.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type MessageAddResult struct {
+	UID uint32 `json:"uid"`
+}
+
+type specialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+// Copied from go-imap-backend-tests.
+type appendLimitUser interface {
+	imapbackend.AppendLimitUser
+
+	// SetMessageLimit sets new value for limit.
+	// nil pointer means no limit.
+	SetMessageLimit(val *uint32) error
+}
+
+func lookupStorage(name string) (module.Storage, error) {
+	if name == "" {
+		return nil, errors.New("imapsql: cfg_block is required")
+	}
+	mod, err := module.GetInstance(name)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	be, ok := mod.(module.Storage)
+	if !ok {
+		return nil, fmt.Errorf("imapsql: configuration block %s is not an IMAP storage", name)
+	}
+	return be, nil
+}
+
+// storageCommand wraps the handler for a command that operates on the
+// storage.
+func storageCommand(f func(be module.Storage, args AdminArgs) (interface{}, error)) control.Handler {
+	return func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		be, err := lookupStorage(args.CfgBlock)
+		if err != nil {
+			return nil, err
+		}
+		return f(be, args)
+	}
+}
+
+// userCommand wraps the handler for a command that operates on a single
+// account.
+func userCommand(f func(be module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error)) control.Handler {
+	return storageCommand(func(be module.Storage, args AdminArgs) (interface{}, error) {
+		if args.Username == "" {
+			return nil, errors.New("imapsql: username is required")
+		}
+		u, err := be.GetIMAPAcct(args.Username)
+		if err != nil {
+			return nil, err
+		}
+		return f(be, u, args)
+	})
+}
+
+// mailboxCommand wraps the handler for a command that operates on messages
+// in a mailbox. SeqSet defaults to all messages.
+func mailboxCommand(readOnly bool, f func(mbox imapbackend.Mailbox, seq *imap.SeqSet, args AdminArgs) (interface{}, error)) control.Handler {
+	return userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		if args.Mailbox == "" {
+			return nil, errors.New("imapsql: mailbox is required")
+		}
+		if args.SeqSet == "" {
+			args.SeqSet = "1:*"
+			args.UID = true
+		}
+		seq, err := imap.ParseSeqSet(args.SeqSet)
+		if err != nil {
+			return nil, err
+		}
+		_, mbox, err := u.GetMailbox(args.Mailbox, readOnly, nil)
+		if err != nil {
+			return nil, err
+		}
+		return f(mbox, seq, args)
+	})
+}
+
+func manageableStorage(be module.Storage) (module.ManageableStorage, error) {
+	mbe, ok := be.(module.ManageableStorage)
+	if !ok {
+		return nil, errors.New("imapsql: storage backend does not support accounts management")
+	}
+	return mbe, nil
+}
+
+func formatAddressList(addrs []*imap.Address) []string {
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.PersonalName == "" {
+			res = append(res, addr.Address())
+			continue
+		}
+		res = append(res, fmt.Sprintf("%s <%s>", addr.PersonalName, addr.Address()))
+	}
+	return res
+}
+
+func listMessages(mbox imapbackend.Mailbox, uid bool, seq *imap.SeqSet, items []imap.FetchItem, f func(msg *imap.Message) error) error {
+	ch := make(chan *imap.Message, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mbox.ListMessages(uid, seq, items, ch)
+	}()
+
+	var fErr error
+	for msg := range ch {
+		if fErr == nil {
+			fErr = f(msg)
+		}
+	}
+	err := <-errCh
+	if fErr != nil {
+		return fErr
+	}
+	return err
+}
+
+func init() {
+	control.Register("imap_acct.list", storageCommand(func(be module.Storage, _ AdminArgs) (interface{}, error) {
+		mbe, err := manageableStorage(be)
+		if err != nil {
+			return nil, err
+		}
+		accts, err := mbe.ListIMAPAccts()
+		if err != nil {
+			return nil, err
+		}
+		if accts == nil {
+			accts = []string{}
+		}
+		return accts, nil
+	}))
+	control.Register("imap_acct.create", storageCommand(func(be module.Storage, args AdminArgs) (interface{}, error) {
+		mbe, err := manageableStorage(be)
+		if err != nil {
+			return nil, err
+		}
+		if args.Username == "" {
+			return nil, errors.New("imapsql: username is required")
+		}
+		if err := mbe.CreateIMAPAcct(args.Username); err != nil {
+			return nil, err
+		}
+		u, err := mbe.GetIMAPAcct(args.Username)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: failed to get user: %w", err)
+		}
+
+		var res AcctCreateResult
+		suu, ok := u.(specialUseUser)
+		if !ok && len(args.SpecialMailboxes) != 0 {
+			res.Warnings = append(res.Warnings, "storage backend does not support SPECIAL-USE IMAP extension")
+		}
+		for _, mbox := range args.SpecialMailboxes {
+			if suu == nil || len(mbox.Attributes) == 0 {
+				err = u.CreateMailbox(mbox.Name)
+			} else {
+				err = suu.CreateMailboxSpecial(mbox.Name, mbox.Attributes[0])
+			}
+			if err != nil {
+				res.Warnings = append(res.Warnings, fmt.Sprintf("failed to create %s: %v", mbox.Name, err))
+			}
+		}
+		return res, nil
+	}))
+	control.Register("imap_acct.remove", storageCommand(func(be module.Storage, args AdminArgs) (interface{}, error) {
+		mbe, err := manageableStorage(be)
+		if err != nil {
+			return nil, err
+		}
+		if args.Username == "" {
+			return nil, errors.New("imapsql: username is required")
+		}
+		return nil, mbe.DeleteIMAPAcct(args.Username)
+	}))
+	control.Register("imap_acct.appendlimit", userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		userAL, ok := u.(appendLimitUser)
+		if !ok {
+			return nil, errors.New("imapsql: storage backend does not support per-user append limit")
+		}
+		if args.AppendLimit != nil {
+			var val *uint32
+			if *args.AppendLimit != -1 {
+				if *args.AppendLimit < 0 || *args.AppendLimit > int64(^uint32(0)) {
+					return nil, errors.New("imapsql: append limit is out of range")
+				}
+				val32 := uint32(*args.AppendLimit)
+				val = &val32
+			}
+			if err := userAL.SetMessageLimit(val); err != nil {
+				return nil, err
+			}
+		}
+		return AppendLimit{Limit: userAL.CreateMessageLimit()}, nil
+	}))
+
+	control.Register("imap_mboxes.list", userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		mboxes, err := u.ListMailboxes(args.Subscribed)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]MailboxInfo, 0, len(mboxes))
+		for _, info := range mboxes {
+			res = append(res, MailboxInfo{Name: info.Name, Attributes: info.Attributes})
+		}
+		return res, nil
+	}))
+	control.Register("imap_mboxes.status", userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		if args.Mailbox == "" {
+			return nil, errors.New("imapsql: mailbox is required")
+		}
+		status, err := u.Status(args.Mailbox, []imap.StatusItem{
+			imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
+			imap.StatusUidNext, imap.StatusUidValidity,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return MailboxStatus{
+			Messages:    status.Messages,
+			Recent:      status.Recent,
+			Unseen:      status.Unseen,
+			UIDNext:     status.UidNext,
+			UIDValidity: status.UidValidity,
+		}, nil
+	}))
+	control.Register("imap_mboxes.create", userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		if args.Mailbox == "" {
+			return nil, errors.New("imapsql: mailbox is required")
+		}
+		if args.SpecialUse != "" {
+			suu, ok := u.(specialUseUser)
+			if !ok {
+				return nil, errors.New("imapsql: storage backend does not support SPECIAL-USE IMAP extension")
+			}
+			return nil, suu.CreateMailboxSpecial(args.Mailbox, args.SpecialUse)
+		}
+		return nil, u.CreateMailbox(args.Mailbox)
+	}))
+	control.Register("imap_mboxes.remove", userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		if args.Mailbox == "" {
+			return nil, errors.New("imapsql: mailbox is required")
+		}
+		return nil, u.DeleteMailbox(args.Mailbox)
+	}))
+	control.Register("imap_mboxes.rename", userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		if args.Mailbox == "" || args.Target == "" {
+			return nil, errors.New("imapsql: mailbox and target are required")
+		}
+		return nil, u.RenameMailbox(args.Mailbox, args.Target)
+	}))
+
+	control.RegisterSensitive("imap_msgs.add", userCommand(func(_ module.Storage, u imapbackend.User, args AdminArgs) (interface{}, error) {
+		if args.Mailbox == "" {
+			return nil, errors.New("imapsql: mailbox is required")
+		}
+		if len(args.Body) == 0 {
+			return nil, errors.New("imapsql: empty message")
+		}
+		flags := args.Flags
+		if flags == nil {
+			flags = []string{}
+		}
+		date := time.Now()
+		if args.Date != nil {
+			date = *args.Date
+		}
+
+		status, err := u.Status(args.Mailbox, []imap.StatusItem{imap.StatusUidNext})
+		if err != nil {
+			return nil, err
+		}
+		if err := u.CreateMessage(args.Mailbox, flags, date, bytes.NewReader(args.Body), nil); err != nil {
+			return nil, err
+		}
+		// TODO: Use APPENDUID
+		return MessageAddResult{UID: status.UidNext}, nil
+	}))
+	control.Register("imap_msgs.flags", mailboxCommand(false, func(mbox imapbackend.Mailbox, seq *imap.SeqSet, args AdminArgs) (interface{}, error) {
+		if len(args.Flags) == 0 {
+			return nil, errors.New("imapsql: at least one flag is required")
+		}
+		var op imap.FlagsOp
+		switch args.FlagsOp {
+		case "add":
+			op = imap.AddFlags
+		case "remove":
+			op = imap.RemoveFlags
+		case "set":
+			op = imap.SetFlags
+		default:
+			return nil, fmt.Errorf("imapsql: unknown flags operation: %q", args.FlagsOp)
+		}
+		return nil, mbox.UpdateMessagesFlags(args.UID, seq, op, true, args.Flags)
+	}))
+	control.Register("imap_msgs.remove", mailboxCommand(true, func(mbox imapbackend.Mailbox, seq *imap.SeqSet, args AdminArgs) (interface{}, error) {
+		mboxB, ok := mbox.(*imapsql.Mailbox)
+		if !ok {
+			return nil, errors.New("imapsql: storage backend does not support messages removal")
+		}
+		return nil, mboxB.DelMessages(args.UID, seq)
+	}))
+	control.Register("imap_msgs.copy", mailboxCommand(true, func(mbox imapbackend.Mailbox, seq *imap.SeqSet, args AdminArgs) (interface{}, error) {
+		if args.Target == "" {
+			return nil, errors.New("imapsql: target is required")
+		}
+		return nil, mbox.CopyMessages(args.UID, seq, args.Target)
+	}))
+	control.Register("imap_msgs.move", mailboxCommand(true, func(mbox imapbackend.Mailbox, seq *imap.SeqSet, args AdminArgs) (interface{}, error) {
+		if args.Target == "" {
+			return nil, errors.New("imapsql: target is required")
+		}
+		moveMbox, ok := mbox.(*imapsql.Mailbox)
+		if !ok {
+			return nil, errors.New("imapsql: storage backend does not support messages moving")
+		}
+		return nil, moveMbox.MoveMessages(args.UID, seq, args.Target)
+	}))
+	control.Register("imap_msgs.learn", storageCommand(func(be module.Storage, args AdminArgs) (interface{}, error) {
+		if args.Username == "" || args.Mailbox == "" || args.SeqSet == "" {
+			return nil, errors.New("imapsql: username, mailbox and seqset are required")
+		}
+		seq, err := imap.ParseSeqSet(args.SeqSet)
+		if err != nil {
+			return nil, err
+		}
+		learner, ok := be.(interface {
+			LearnMessages(accountName, mboxName string, uid bool, seqset *imap.SeqSet, spam bool) error
+		})
+		if !ok {
+			return nil, errors.New("imapsql: storage backend does not support spam learning")
+		}
+		return nil, learner.LearnMessages(args.Username, args.Mailbox, args.UID, seq, args.Spam)
+	}))
+	control.Register("imap_msgs.list", mailboxCommand(true, func(mbox imapbackend.Mailbox, seq *imap.SeqSet, args AdminArgs) (interface{}, error) {
+		res := []MessageInfo{}
+		err := listMessages(mbox, args.UID, seq, []imap.FetchItem{
+			imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchFlags, imap.FetchUid,
+		}, func(msg *imap.Message) error {
+			info := MessageInfo{
+				UID:          msg.Uid,
+				SeqNum:       msg.SeqNum,
+				Flags:        msg.Flags,
+				Size:         msg.Size,
+				InternalDate: msg.InternalDate,
+			}
+			if info.Flags == nil {
+				info.Flags = []string{}
+			}
+			if env := msg.Envelope; env != nil {
+				if !env.Date.IsZero() {
+					date := env.Date
+					info.Date = &date
+				}
+				info.Subject = env.Subject
+				info.From = formatAddressList(env.From)
+				info.To = formatAddressList(env.To)
+				info.Cc = formatAddressList(env.Cc)
+				info.Bcc = formatAddressList(env.Bcc)
+				info.InReplyTo = env.InReplyTo
+				info.MessageID = env.MessageId
+			}
+			res = append(res, info)
+			return nil
+		})
+		return res, err
+	}))
+	control.Register("imap_msgs.dump", mailboxCommand(true, func(mbox imapbackend.Mailbox, seq *imap.SeqSet, args AdminArgs) (interface{}, error) {
+		res := []MessageBody{}
+		err := listMessages(mbox, args.UID, seq, []imap.FetchItem{imap.FetchRFC822, imap.FetchUid}, func(msg *imap.Message) error {
+			var body bytes.Buffer
+			for _, v := range msg.Body {
+				if _, err := body.ReadFrom(v); err != nil {
+					return err
+				}
+			}
+			res = append(res, MessageBody{UID: msg.Uid, Body: body.Bytes()})
+			return nil
+		})
+		return res, err
+	}))
+}
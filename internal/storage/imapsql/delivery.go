@@ -30,6 +30,7 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/slowlog"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -61,6 +62,7 @@ func userDoesNotExist(actual error) error {
 
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
 	defer trace.StartRegion(ctx, "sql/AddRcpt").End()
+	defer slowlog.Start(ctx, slowlog.Storage, "imapsql RCPT "+rcptTo).End()
 
 	accountName, err := d.store.deliveryNormalize(ctx, rcptTo)
 	if err != nil {
@@ -71,6 +73,14 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 		return nil
 	}
 
+	used, limit, err := d.store.quotaUsage(ctx, accountName)
+	if err != nil {
+		return err
+	}
+	if limit != 0 && (used >= limit || used+d.msgMeta.SMTPOpts.Size > limit) {
+		return mailboxFull(accountName)
+	}
+
 	// This header is added to the message only for that recipient.
 	// go-imap-sql does certain optimizations to store the message
 	// with small amount of per-recipient data in a efficient way.
@@ -101,6 +111,7 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
+	defer slowlog.Start(ctx, slowlog.Storage, "imapsql DATA").End()
 
 	if !d.msgMeta.Quarantine && d.store.filters != nil {
 		for rcpt, rcptData := range d.addedRcpts {
@@ -151,6 +162,7 @@ func (d *delivery) Abort(ctx context.Context) error {
 
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
+	defer slowlog.Start(ctx, slowlog.Storage, "imapsql commit").End()
 
 	return d.d.Commit()
 }
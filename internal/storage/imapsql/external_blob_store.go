@@ -2,10 +2,12 @@ package imapsql
 
 import (
 	"context"
+	"fmt"
 	"io"
 
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/slowlog"
 )
 
 type ExtBlob struct {
@@ -22,6 +24,14 @@ func (e ExtBlob) Write(p []byte) (n int, err error) {
 
 type WriteExtBlob struct {
 	module.Blob
+
+	// Covers the whole write, from Create to Close.
+	slowOp slowlog.Op
+}
+
+func (w WriteExtBlob) Close() error {
+	defer w.slowOp.End()
+	return w.Blob.Close()
 }
 
 func (w WriteExtBlob) Read(p []byte) (n int, err error) {
@@ -33,18 +43,21 @@ type ExtBlobStore struct {
 }
 
 func (e ExtBlobStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	slowOp := slowlog.Start(context.TODO(), slowlog.Blob, "write "+key)
 	blob, err := e.Base.Create(context.TODO(), key, objSize)
 	if err != nil {
+		slowOp.End()
 		return nil, imapsql.ExternalError{
 			NonExistent: err == module.ErrNoSuchBlob,
 			Key:         key,
 			Err:         err,
 		}
 	}
-	return WriteExtBlob{Blob: blob}, nil
+	return WriteExtBlob{Blob: blob, slowOp: slowOp}, nil
 }
 
 func (e ExtBlobStore) Open(key string) (imapsql.ExtStoreObj, error) {
+	defer slowlog.Start(context.TODO(), slowlog.Blob, "open "+key).End()
 	blob, err := e.Base.Open(context.TODO(), key)
 	if err != nil {
 		return nil, imapsql.ExternalError{
@@ -57,6 +70,7 @@ func (e ExtBlobStore) Open(key string) (imapsql.ExtStoreObj, error) {
 }
 
 func (e ExtBlobStore) Delete(keys []string) error {
+	defer slowlog.Start(context.TODO(), slowlog.Blob, fmt.Sprintf("delete %d blobs", len(keys))).End()
 	err := e.Base.Delete(context.TODO(), keys)
 	if err != nil {
 		return imapsql.ExternalError{
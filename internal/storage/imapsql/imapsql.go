@@ -23,6 +23,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // - module.StorageBackend
 // - module.PlainAuth
 // - module.DeliveryTarget
+// - module.QuotaStorage
 package imapsql
 
 import (
@@ -35,6 +36,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -46,6 +48,7 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/slowlog"
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
@@ -76,6 +79,17 @@ type Storage struct {
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
 	authNormalize     func(context.Context, string) (string, error)
+
+	defaultQuota int64
+	quotaMap     module.Table
+
+	junkLearner module.SpamLearner
+	learnQueue  chan learnJob
+	learnCtx    context.Context
+	learnCancel func()
+	learnWg     sync.WaitGroup
+
+	blobStore module.BlobStore
 }
 
 func (store *Storage) Name() string {
@@ -156,6 +170,23 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.DataSize("quota", false, false, 0, &store.defaultQuota)
+	cfg.Custom("quota_map", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.quotaMap)
+	cfg.Custom("junk_learner", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		check, err := modconfig.MessageCheck(m.Globals, node.Args, node)
+		if err != nil {
+			return nil, err
+		}
+		learner, ok := check.(module.SpamLearner)
+		if !ok {
+			return nil, config.NodeErr(node, "module does not support spam learning")
+		}
+		return learner, nil
+	}, &store.junkLearner)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -271,9 +302,18 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
+	store.blobStore = blobStore
+
 	store.driver = driver
 	store.dsn = dsn
 
+	if store.junkLearner != nil {
+		store.learnQueue = make(chan learnJob, learnQueueSize)
+		store.learnCtx, store.learnCancel = context.WithCancel(context.Background())
+		store.learnWg.Add(1)
+		go store.learnWorker()
+	}
+
 	return nil
 }
 
@@ -384,7 +424,13 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	slowOp := slowlog.Start(context.TODO(), slowlog.Storage, "imapsql account "+accountName)
+	u, err := store.Back.GetOrCreateUser(accountName)
+	slowOp.End()
+	if err != nil || store.junkLearner == nil {
+		return u, err
+	}
+	return learnUser{User: u.(*imapsql.User), store: store}, nil
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -393,7 +439,9 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 		return "", false, nil
 	}
 
+	slowOp := slowlog.Start(ctx, slowlog.Storage, "imapsql lookup "+accountName)
 	usr, err := store.Back.GetUser(accountName)
+	slowOp.End()
 	if err != nil {
 		if errors.Is(err, imapsql.ErrUserDoesntExists) {
 			return "", false, nil
@@ -407,7 +455,27 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 	return "", true, nil
 }
 
+// CheckHealth implements module.HealthChecker. It checks that the database
+// and the message store are accessible.
+func (store *Storage) CheckHealth(ctx context.Context) error {
+	if err := store.Back.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("imapsql: database: %w", err)
+	}
+	if hc, ok := store.blobStore.(module.HealthChecker); ok {
+		if err := hc.CheckHealth(ctx); err != nil {
+			return fmt.Errorf("imapsql: message store: %w", err)
+		}
+	}
+	return nil
+}
+
 func (store *Storage) Close() error {
+	// Abort background junk_learner calls.
+	if store.learnCancel != nil {
+		store.learnCancel()
+		store.learnWg.Wait()
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -0,0 +1,229 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+const (
+	// Max. amount of messages waiting to be reported to junk_learner.
+	// Messages moved when the queue is full are not reported.
+	learnQueueSize = 64
+
+	// Time limit for a single junk_learner call.
+	learnTimeout = time.Minute
+)
+
+type learnJob struct {
+	username string
+	body     []byte
+	spam     bool
+}
+
+// learnUser wraps the go-imap-sql User to report messages moved into and
+// out of the Junk mailbox to the configured junk_learner, closing the
+// feedback loop for trainable classifiers.
+type learnUser struct {
+	*imapsql.User
+	store *Storage
+}
+
+func (u learnUser) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	status, mbox, err := u.User.GetMailbox(name, readOnly, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return status, &learnMailbox{Mailbox: mbox.(*imapsql.Mailbox), u: u}, nil
+}
+
+type learnMailbox struct {
+	*imapsql.Mailbox
+	u learnUser
+}
+
+func (m *learnMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	m.learn(uid, seqset, dest)
+	return m.Mailbox.CopyMessages(uid, seqset, dest)
+}
+
+func (m *learnMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	m.learn(uid, seqset, dest)
+	return m.Mailbox.MoveMessages(uid, seqset, dest)
+}
+
+// learn reports messages that are about to be moved to dest.
+//
+// Message bodies are read before the operation and queued, the junk_learner
+// is called in background to not delay the IMAP command. Errors are only
+// logged since failure to train the classifier should not prevent the user
+// from managing their mailbox.
+func (m *learnMailbox) learn(uid bool, seqset *imap.SeqSet, dest string) {
+	srcJunk := m.u.store.isJunk(m.u.User, m.Name())
+	dstJunk := m.u.store.isJunk(m.u.User, dest)
+
+	var spam bool
+	switch {
+	case !srcJunk && dstJunk:
+		spam = true
+	case srcJunk && !dstJunk && !mboxHasAttr(m.u.User, dest, imap.TrashAttr):
+		spam = false
+	default:
+		return
+	}
+
+	store := m.u.store
+	username := m.u.Username()
+	dropped := 0
+	err := forEachBody(m.Mailbox, uid, seqset, func(body []byte) {
+		select {
+		case store.learnQueue <- learnJob{username: username, body: body, spam: spam}:
+		default:
+			dropped++
+		}
+	})
+	if err != nil {
+		store.Log.Error("failed to read messages for learning", err, "username", username)
+	}
+	if dropped != 0 {
+		store.Log.Msg("learning queue is full, messages not reported", "username", username, "spam", spam, "count", dropped)
+	}
+}
+
+// learnWorker reports queued messages to the junk_learner until Close is
+// called.
+func (store *Storage) learnWorker() {
+	defer store.learnWg.Done()
+	for {
+		select {
+		case <-store.learnCtx.Done():
+			return
+		case job := <-store.learnQueue:
+			if err := store.learnBody(job.username, job.body, job.spam); err != nil {
+				store.Log.Error("failed to learn message", err, "username", job.username, "spam", job.spam)
+				continue
+			}
+			store.Log.DebugMsg("message learned", "username", job.username, "spam", job.spam)
+		}
+	}
+}
+
+func (store *Storage) isJunk(u *imapsql.User, name string) bool {
+	return name == store.junkMbox || mboxHasAttr(u, name, imap.JunkAttr)
+}
+
+func mboxHasAttr(u *imapsql.User, name, attr string) bool {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return false
+	}
+	for _, mbox := range mboxes {
+		if mbox.Name != name {
+			continue
+		}
+		for _, a := range mbox.Attributes {
+			if a == attr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LearnMessages reports the specified messages as spam or ham to the
+// configured junk_learner.
+func (store *Storage) LearnMessages(accountName, mboxName string, uid bool, seqset *imap.SeqSet, spam bool) error {
+	if store.junkLearner == nil {
+		return fmt.Errorf("imapsql: junk_learner is not configured")
+	}
+
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return err
+	}
+	defer u.Logout()
+
+	_, mbox, err := u.GetMailbox(mboxName, true, nil)
+	if err != nil {
+		return err
+	}
+	defer mbox.Close()
+
+	return store.learnMessages(accountName, mbox.(*imapsql.Mailbox), uid, seqset, spam)
+}
+
+func (store *Storage) learnMessages(accountName string, mbox *imapsql.Mailbox, uid bool, seqset *imap.SeqSet, spam bool) error {
+	var lastErr error
+	err := forEachBody(mbox, uid, seqset, func(body []byte) {
+		if err := store.learnBody(accountName, body, spam); err != nil {
+			lastErr = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return lastErr
+}
+
+func (store *Storage) learnBody(accountName string, body []byte, spam bool) error {
+	ctx, cancel := context.WithTimeout(store.learnCtx, learnTimeout)
+	defer cancel()
+	return store.junkLearner.LearnMessage(ctx, accountName, spam, bytes.NewReader(body))
+}
+
+// forEachBody reads full bodies of the specified messages one by one and
+// calls fn for each of them.
+func forEachBody(mbox *imapsql.Mailbox, uid bool, seqset *imap.SeqSet, fn func(body []byte)) error {
+	section, err := imap.ParseBodySectionName("BODY.PEEK[]")
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *imap.Message, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range ch {
+			// Only one section is requested. msg.GetBody cannot be used
+			// since it does not match BODY.PEEK sections.
+			for _, lit := range msg.Body {
+				if lit == nil {
+					continue
+				}
+				body, err := io.ReadAll(lit)
+				if err != nil {
+					continue
+				}
+				fn(body)
+			}
+		}
+	}()
+
+	err = mbox.ListMessages(uid, seqset, []imap.FetchItem{section.FetchItem()}, ch)
+	<-done
+	return err
+}
@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// accountQuota returns the quota configured for the account.
+func (store *Storage) accountQuota(ctx context.Context, accountName string) (int64, error) {
+	if store.quotaMap == nil {
+		return store.defaultQuota, nil
+	}
+
+	val, ok, err := store.quotaMap.Lookup(ctx, accountName)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return store.defaultQuota, nil
+	}
+	quota, err := config.ParseDataSize(val)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: malformed quota for %s: %w", accountName, err)
+	}
+	return int64(quota), nil
+}
+
+// accountUsage returns the total size of messages stored in all mailboxes of
+// the account.
+func (store *Storage) accountUsage(ctx context.Context, accountName string) (int64, error) {
+	query := `SELECT COALESCE(SUM(msgs.bodyLen), 0) FROM msgs
+		INNER JOIN mboxes ON msgs.mboxId = mboxes.id
+		INNER JOIN users ON mboxes.uid = users.id
+		WHERE users.username = ?`
+	if store.driver == "postgres" {
+		query = `SELECT COALESCE(SUM(msgs.bodyLen), 0) FROM msgs
+		INNER JOIN mboxes ON msgs.mboxId = mboxes.id
+		INNER JOIN users ON mboxes.uid = users.id
+		WHERE users.username = $1`
+	}
+
+	var used int64
+	if err := store.Back.DB.QueryRowContext(ctx, query, accountName).Scan(&used); err != nil {
+		return 0, fmt.Errorf("imapsql: quota usage: %w", err)
+	}
+	return used, nil
+}
+
+func (store *Storage) quotaUsage(ctx context.Context, accountName string) (used, limit int64, err error) {
+	limit, err = store.accountQuota(ctx, accountName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit == 0 {
+		return 0, 0, nil
+	}
+
+	used, err = store.accountUsage(ctx, accountName)
+	if err != nil {
+		return 0, 0, err
+	}
+	return used, limit, nil
+}
+
+// QuotaUsage implements module.QuotaStorage.
+func (store *Storage) QuotaUsage(ctx context.Context, rcptTo string) (used, limit int64, err error) {
+	defer trace.StartRegion(ctx, "sql/QuotaUsage").End()
+
+	accountName, err := store.deliveryNormalize(ctx, rcptTo)
+	if err != nil {
+		return 0, 0, userDoesNotExist(err)
+	}
+	return store.quotaUsage(ctx, accountName)
+}
+
+func mailboxFull(accountName string) error {
+	return &exterrors.SMTPError{
+		Code:         452,
+		EnhancedCode: exterrors.EnhancedCode{4, 2, 2},
+		Message:      "Mailbox is full",
+		TargetName:   "imapsql",
+		Misc: map[string]interface{}{
+			"account": accountName,
+		},
+	}
+}
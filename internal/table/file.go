@@ -253,6 +253,19 @@ func (f *File) LookupMulti(_ context.Context, val string) ([]string, error) {
 	return usedFile[val], nil
 }
 
+// Keys returns all keys present in the table.
+func (f *File) Keys() ([]string, error) {
+	f.mLck.RLock()
+	usedFile := f.m
+	f.mLck.RUnlock()
+
+	keys := make([]string, 0, len(usedFile))
+	for k := range usedFile {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
 func init() {
 	module.Register(FileModName, NewFile)
 }
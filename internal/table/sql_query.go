@@ -26,6 +26,7 @@ import (
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/slowlog"
 	_ "github.com/lib/pq"
 )
 
@@ -139,6 +140,8 @@ func (s *SQL) Close() error {
 }
 
 func (s *SQL) Lookup(ctx context.Context, val string) (string, bool, error) {
+	defer slowlog.Start(ctx, slowlog.Storage, s.modName+" lookup "+val).End()
+
 	var (
 		repl string
 		row  *sql.Row
@@ -158,6 +161,8 @@ func (s *SQL) Lookup(ctx context.Context, val string) (string, bool, error) {
 }
 
 func (s *SQL) LookupMulti(ctx context.Context, val string) ([]string, error) {
+	defer slowlog.Start(ctx, slowlog.Storage, s.modName+" lookup "+val).End()
+
 	var (
 		repl []string
 		rows *sql.Rows
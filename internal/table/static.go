@@ -72,6 +72,15 @@ func (s *Static) LookupMulti(ctx context.Context, key string) ([]string, error)
 	return s.m[key], nil
 }
 
+// Keys returns all keys present in the table.
+func (s *Static) Keys() ([]string, error) {
+	keys := make([]string, 0, len(s.m))
+	for k := range s.m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
 func init() {
 	module.Register("table.static", NewStatic)
 }
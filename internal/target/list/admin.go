@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+)
+
+// AdminArgs are the arguments of "list.*" control commands.
+type AdminArgs struct {
+	CfgBlock string `json:"cfg_block"`
+	Address  string `json:"address,omitempty"`
+	ID       string `json:"id,omitempty"`
+}
+
+// HeldInfo describes the held message in list.held results.
+type HeldInfo struct {
+	ID string `json:"id"`
+	HeldMessage
+}
+
+// listCommand wraps the handler for a command that operates on the list.
+func listCommand(f func(t *Target, args AdminArgs) (interface{}, error)) control.Handler {
+	return func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		if args.CfgBlock == "" {
+			return nil, errors.New("list: cfg_block is required")
+		}
+		mod, err := module.GetInstance(args.CfgBlock)
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		t, ok := mod.(*Target)
+		if !ok {
+			return nil, fmt.Errorf("list: configuration block %s is not target.list", args.CfgBlock)
+		}
+		return f(t, args)
+	}
+}
+
+func init() {
+	control.Register("list.members", listCommand(func(t *Target, _ AdminArgs) (interface{}, error) {
+		members, err := t.Members()
+		if err != nil {
+			return nil, err
+		}
+		res := append([]string{}, members...)
+		sort.Strings(res)
+		return res, nil
+	}))
+	control.Register("list.subscribe", listCommand(func(t *Target, args AdminArgs) (interface{}, error) {
+		if args.Address == "" {
+			return nil, errors.New("list: address is required")
+		}
+		return nil, t.Subscribe(args.Address)
+	}))
+	control.Register("list.unsubscribe", listCommand(func(t *Target, args AdminArgs) (interface{}, error) {
+		if args.Address == "" {
+			return nil, errors.New("list: address is required")
+		}
+		return nil, t.Unsubscribe(args.Address)
+	}))
+	control.Register("list.held", listCommand(func(t *Target, _ AdminArgs) (interface{}, error) {
+		held, err := t.Held()
+		if err != nil {
+			return nil, err
+		}
+		res := make([]HeldInfo, 0, len(held))
+		for _, msg := range held {
+			res = append(res, HeldInfo{ID: msg.ID, HeldMessage: msg})
+		}
+		return res, nil
+	}))
+	control.Register("list.approve", listCommand(func(t *Target, args AdminArgs) (interface{}, error) {
+		if args.ID == "" {
+			return nil, errors.New("list: id is required")
+		}
+		return nil, t.Approve(context.TODO(), args.ID)
+	}))
+	control.Register("list.reject", listCommand(func(t *Target, args AdminArgs) (interface{}, error) {
+		if args.ID == "" {
+			return nil, errors.New("list: id is required")
+		}
+		return nil, t.Reject(args.ID)
+	}))
+}
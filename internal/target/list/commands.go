@@ -0,0 +1,252 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const confirmMacLen = 16
+
+var ErrInvalidToken = errors.New("list: invalid or expired token")
+
+// confirmToken returns the token that confirms the subscription change for
+// the address. The token is sent to the address, so the reply with it proves
+// that the request was made by the address owner.
+func (t *Target) confirmToken(action, addr string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + base64.RawURLEncoding.EncodeToString(t.confirmMac(action, addr, exp))
+}
+
+func (t *Target) confirmMac(action, addr, exp string) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write([]byte(strings.Join([]string{t.address, action, addr, exp}, "\x00")))
+	return h.Sum(nil)[:confirmMacLen]
+}
+
+func (t *Target) checkToken(action, addr, token string) error {
+	exp, macB64, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalidToken
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().After(time.Unix(expUnix, 0)) {
+		return ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macB64)
+	if err != nil || !hmac.Equal(mac, t.confirmMac(action, addr, exp)) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// parseCommand extracts the command from the subject, skipping reply and
+// forward prefixes.
+func parseCommand(subject string) (string, []string) {
+	fields := strings.Fields(decodeHeader(subject))
+	for len(fields) != 0 && strings.HasSuffix(fields[0], ":") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToLower(fields[0]), fields[1:]
+}
+
+// handleRequest executes the command sent to the request address and sends
+// the result to the sender. Errors are reported to the sender and logged.
+func (t *Target) handleRequest(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string, h textproto.Header) {
+	if mailFrom == "" {
+		// Bounces and auto-replies.
+		return
+	}
+	sender, err := address.ForLookup(mailFrom)
+	if err != nil {
+		return
+	}
+
+	cmd, args := parseCommand(h.Get("Subject"))
+	subject, reply := t.execCommand(ctx, sender, cmd, args)
+	target.DeliveryLogger(t.log, msgMeta).Msg("list command", "list", t.address, "sender", sender, "command", cmd)
+
+	if err := t.sendNotice(ctx, msgMeta.TraceID, []string{sender}, subject, reply); err != nil {
+		t.log.Error("failed to send command reply", err, "rcpt", sender)
+	}
+}
+
+// execCommand executes the command and returns the subject and the text of
+// the reply. Confirmation requests use the command to send as the subject,
+// so a reply to them confirms the change.
+func (t *Target) execCommand(ctx context.Context, sender, cmd string, args []string) (string, string) {
+	resultSubject := "Re: " + cmd + " (" + t.address + ")"
+	switch cmd {
+	case "subscribe", "unsubscribe":
+		if cmd == "unsubscribe" && len(args) == 1 && t.unsubscribeURL != nil {
+			// Sent using the mailto link from List-Unsubscribe. The token
+			// identifies the member, the sender address may be different
+			// (e.g. if mail is forwarded).
+			member, err := t.UnsubscribeByToken(args[0])
+			if errors.Is(err, ErrInvalidToken) {
+				return resultSubject, "Unsubscribe link is invalid.\n"
+			}
+			if err != nil {
+				t.log.Error("subscription change failed", err, "action", cmd, "rcpt", member)
+				return resultSubject, "Internal error, please try again later.\n"
+			}
+			return resultSubject, fmt.Sprintf("%s is now unsubscribed from %s.\n", member, t.address)
+		}
+		if !t.emailCommands {
+			break
+		}
+		token := t.confirmToken(cmd, sender, time.Now().Add(t.confirmTTL))
+		confirmCmd := "confirm " + cmd + " " + token
+		return confirmCmd, fmt.Sprintf("Someone (hopefully you) asked to %s %s to/from %s.\n\n"+
+			"To confirm, reply to this message or send a message to %s with the subject:\n\n"+
+			"    %s\n\n"+
+			"If you did not request this, ignore this message.\n",
+			cmd, sender, t.address, t.requestAddr, confirmCmd)
+	case "confirm":
+		if !t.emailCommands {
+			break
+		}
+		if len(args) != 2 || (args[0] != "subscribe" && args[0] != "unsubscribe") {
+			return resultSubject, "Malformed confirmation command.\n"
+		}
+		if err := t.checkToken(args[0], sender, args[1]); err != nil {
+			return resultSubject, "Confirmation token is invalid or expired, please start over.\n"
+		}
+		var err error
+		if args[0] == "subscribe" {
+			err = t.Subscribe(sender)
+		} else {
+			err = t.Unsubscribe(sender)
+		}
+		if err != nil {
+			t.log.Error("subscription change failed", err, "action", args[0], "rcpt", sender)
+			return resultSubject, "Internal error, please try again later.\n"
+		}
+		t.log.Msg("subscription changed", "list", t.address, "action", args[0], "rcpt", sender)
+		if args[0] == "subscribe" {
+			return resultSubject, fmt.Sprintf("You are now subscribed to %s.\n", t.address)
+		}
+		return resultSubject, fmt.Sprintf("You are now unsubscribed from %s.\n", t.address)
+	case "approve", "reject":
+		if !t.isModerator(sender) || len(args) != 1 {
+			break
+		}
+		var err error
+		if cmd == "approve" {
+			err = t.Approve(ctx, args[0])
+		} else {
+			err = t.Reject(args[0])
+		}
+		if errors.Is(err, ErrUnknownHeld) {
+			return resultSubject, "The message is already approved, rejected or does not exist.\n"
+		}
+		if err != nil {
+			t.log.Error("moderation failed", err, "action", cmd, "held_id", args[0])
+			return resultSubject, "Internal error, please try again later.\n"
+		}
+		t.log.Msg("held message moderated", "list", t.address, "action", cmd, "held_id", args[0], "moderator", sender)
+		return resultSubject, fmt.Sprintf("Message %s: %s done.\n", args[0], cmd)
+	}
+	return "Help for " + t.address, t.helpText()
+}
+
+func (t *Target) helpText() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "This is the request address of the %s mailing list.\n\n", t.address)
+	b.WriteString("Commands are specified in the message subject:\n\n")
+	if t.emailCommands {
+		b.WriteString("    subscribe      Subscribe to the list\n")
+		b.WriteString("    unsubscribe    Unsubscribe from the list\n")
+	}
+	b.WriteString("    help           Show this message\n")
+	fmt.Fprintf(&b, "\nContact the list owner at %s for help.\n", t.ownerAddr)
+	return b.String()
+}
+
+// sendNotice sends the plain text message from the request address using
+// the null envelope sender.
+func (t *Target) sendNotice(ctx context.Context, traceID string, to []string, subject, text string) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	_, domain, err := address.Split(t.address)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	qpw := quotedprintable.NewWriter(&body)
+	if _, err := qpw.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	if err := qpw.Close(); err != nil {
+		return err
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", t.requestAddr)
+	hdr.Add("To", strings.Join(to, ", "))
+	hdr.Add("Subject", mime.QEncoding.Encode("utf-8", subject))
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+domain+">")
+	hdr.Add("Auto-Submitted", "auto-replied")
+	hdr.Add("List-Id", "<"+t.listID+">")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+	hdr.Add("Content-Transfer-Encoding", "quoted-printable")
+
+	msgMeta := &module.MsgMetadata{ID: msgID, TraceID: traceID}
+	delivery, err := t.target.Start(ctx, msgMeta, "")
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			delivery.Abort(ctx)
+			return err
+		}
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
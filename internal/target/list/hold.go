@@ -0,0 +1,230 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// ErrUnknownHeld is returned for IDs of messages that are not held (e.g.
+// already approved or rejected).
+var ErrUnknownHeld = errors.New("list: no held message with such ID")
+
+// HeldMessage is the information about the message waiting for moderator
+// approval.
+type HeldMessage struct {
+	ID       string    `json:"-"`
+	Sender   string    `json:"sender"`
+	Subject  string    `json:"subject"`
+	Received time.Time `json:"received"`
+}
+
+func validHeldID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (t *Target) heldPath(id, ext string) string {
+	return filepath.Join(t.location, "held", id+ext)
+}
+
+// hold stores the message until it is approved or rejected by a moderator.
+// Returned ID is used in moderation commands and is only known to
+// moderators.
+func (t *Target) hold(sender string, h textproto.Header, body buffer.Buffer) (string, error) {
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(rawID)
+
+	if err := os.MkdirAll(filepath.Join(t.location, "held"), 0o700); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(t.heldPath(id, ".eml"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if err := writeMessage(f, h, body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	meta, err := json.Marshal(HeldMessage{
+		Sender:   sender,
+		Subject:  decodeHeader(h.Get("Subject")),
+		Received: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(t.heldPath(id, ".json"), meta, 0o600); err != nil {
+		os.Remove(t.heldPath(id, ".eml"))
+		return "", err
+	}
+	return id, nil
+}
+
+func writeMessage(w io.Writer, h textproto.Header, body buffer.Buffer) error {
+	if err := textproto.WriteHeader(w, h); err != nil {
+		return err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Held returns the list of messages waiting for approval, oldest first.
+func (t *Target) Held() ([]HeldMessage, error) {
+	entries, err := os.ReadDir(filepath.Join(t.location, "held"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var res []HeldMessage
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validHeldID(id) {
+			continue
+		}
+		msg, err := t.heldInfo(id)
+		if err != nil {
+			t.log.Error("malformed held message metadata", err, "held_id", id)
+			continue
+		}
+		res = append(res, msg)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Received.Before(res[j].Received)
+	})
+	return res, nil
+}
+
+func (t *Target) heldInfo(id string) (HeldMessage, error) {
+	if !validHeldID(id) {
+		return HeldMessage{}, ErrUnknownHeld
+	}
+	blob, err := os.ReadFile(t.heldPath(id, ".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return HeldMessage{}, ErrUnknownHeld
+		}
+		return HeldMessage{}, err
+	}
+	var msg HeldMessage
+	if err := json.Unmarshal(blob, &msg); err != nil {
+		return HeldMessage{}, err
+	}
+	msg.ID = id
+	return msg, nil
+}
+
+// Approve distributes the held message to list members.
+func (t *Target) Approve(ctx context.Context, id string) error {
+	if _, err := t.heldInfo(id); err != nil {
+		return err
+	}
+
+	blob, err := os.ReadFile(t.heldPath(id, ".eml"))
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(bytes.NewReader(blob))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return fmt.Errorf("list: malformed held message %s: %w", id, err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+
+	if err := t.distribute(ctx, "", h, buffer.MemoryBuffer{Slice: body}); err != nil {
+		return err
+	}
+	return t.Reject(id)
+}
+
+// Reject removes the held message without distributing it.
+func (t *Target) Reject(id string) error {
+	if _, err := t.heldInfo(id); err != nil {
+		return err
+	}
+	if err := os.Remove(t.heldPath(id, ".json")); err != nil {
+		return err
+	}
+	if err := os.Remove(t.heldPath(id, ".eml")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func decodeHeader(value string) string {
+	dec, err := (&mime.WordDecoder{}).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return dec
+}
+
+func (t *Target) notifyModerators(ctx context.Context, traceID, id, sender string, h textproto.Header) {
+	text := fmt.Sprintf("A message to %s is waiting for moderator approval.\n\n"+
+		"From: %s\nSubject: %s\n\n"+
+		"To distribute the message, send a message to %s with the subject:\n\n    approve %s\n\n"+
+		"To discard it, use the subject:\n\n    reject %s\n",
+		t.address, sender, decodeHeader(h.Get("Subject")), t.requestAddr, id, id)
+
+	err := t.sendNotice(ctx, traceID, t.moderators, "Message held for "+t.address+" moderation", text)
+	if err != nil {
+		t.log.Error("failed to notify moderators", err, "held_id", id)
+	}
+}
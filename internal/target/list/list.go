@@ -0,0 +1,590 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package list implements target.list module, a simple mailing list manager
+// that redistributes messages to addresses from the members table.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package list
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.list"
+
+// listFields are header fields replaced in distributed messages.
+var listFields = []string{
+	"List-Id", "List-Post", "List-Help", "List-Subscribe", "List-Unsubscribe",
+	"List-Unsubscribe-Post", "List-Archive", "List-Owner", "Precedence",
+}
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	address     string
+	requestAddr string
+	ownerAddr   string
+	displayName string
+	listID      string
+
+	members       module.Table
+	moderators    []string
+	target        module.DeliveryTarget
+	subjectPrefix string
+	replyTo       string
+	posting       string
+	nonMembers    string
+	emailCommands bool
+	confirmTTL    time.Duration
+
+	unsubscribeURL *url.URL
+
+	location string
+	secret   []byte
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var (
+		listAddr   string
+		moderators []string
+		secret     string
+		unsubURL   string
+	)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.String("address", false, true, "", &listAddr)
+	cfg.String("request_address", false, false, "", &t.requestAddr)
+	cfg.String("owner", false, false, "", &t.ownerAddr)
+	cfg.String("display_name", false, false, "", &t.displayName)
+	modconfig.Table(cfg, "members", false, true, nil, &t.members)
+	cfg.StringList("moderators", false, false, nil, &moderators)
+	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &t.target)
+	cfg.String("subject_prefix", false, false, "", &t.subjectPrefix)
+	cfg.Enum("reply_to", false, false, []string{"none", "list"}, "none", &t.replyTo)
+	cfg.Enum("posting", false, false, []string{"open", "members", "moderated"}, "members", &t.posting)
+	cfg.Enum("non_members", false, false, []string{"reject", "hold"}, "reject", &t.nonMembers)
+	cfg.Bool("email_commands", false, false, &t.emailCommands)
+	cfg.Duration("confirm_ttl", false, false, 72*time.Hour, &t.confirmTTL)
+	cfg.String("unsubscribe_url", false, false, "", &unsubURL)
+	cfg.String("location", false, false, "", &t.location)
+	cfg.String("secret", false, false, "", &secret)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	t.address, err = address.ForLookup(listAddr)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "invalid list address: %v", err)
+	}
+	localPart, domain, err := address.Split(t.address)
+	if err != nil || localPart == "" || domain == "" {
+		return config.NodeErr(cfg.Block, "invalid list address: %s", listAddr)
+	}
+	t.listID = localPart + "." + domain
+
+	if t.requestAddr == "" {
+		t.requestAddr = localPart + "-request@" + domain
+	}
+	if t.requestAddr, err = address.ForLookup(t.requestAddr); err != nil {
+		return config.NodeErr(cfg.Block, "invalid request address: %v", err)
+	}
+	if t.ownerAddr == "" {
+		t.ownerAddr = localPart + "-owner@" + domain
+	}
+	if t.ownerAddr, err = address.ForLookup(t.ownerAddr); err != nil {
+		return config.NodeErr(cfg.Block, "invalid owner address: %v", err)
+	}
+	if strings.ContainsAny(t.displayName+t.subjectPrefix, "\r\n") {
+		return config.NodeErr(cfg.Block, "display_name and subject_prefix should not contain line breaks")
+	}
+
+	for _, mod := range moderators {
+		norm, err := address.ForLookup(mod)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid moderator address %s: %v", mod, err)
+		}
+		t.moderators = append(t.moderators, norm)
+	}
+	if len(t.moderators) == 0 && (t.posting == "moderated" || t.nonMembers == "hold") {
+		return config.NodeErr(cfg.Block, "moderators are required to hold messages")
+	}
+
+	if _, ok := t.members.(interface{ Keys() ([]string, error) }); !ok {
+		return config.NodeErr(cfg.Block, "members table should support listing keys (e.g. file or sql_table)")
+	}
+	if _, ok := t.members.(module.MutableTable); t.emailCommands && !ok {
+		return config.NodeErr(cfg.Block, "members table should be mutable to use email_commands")
+	}
+
+	if unsubURL != "" {
+		t.unsubscribeURL, err = url.Parse(unsubURL)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid unsubscribe_url: %v", err)
+		}
+		// RFC 8058 requires HTTPS for one-click unsubscription.
+		if t.unsubscribeURL.Scheme != "https" || t.unsubscribeURL.Host == "" {
+			return config.NodeErr(cfg.Block, "unsubscribe_url should be an absolute https:// URL")
+		}
+		if _, ok := t.members.(module.MutableTable); !ok {
+			return config.NodeErr(cfg.Block, "members table should be mutable to use unsubscribe_url")
+		}
+	}
+
+	if t.location == "" {
+		t.location = filepath.Join(config.StateDirectory, "lists", t.address)
+	}
+	if err := os.MkdirAll(t.location, 0o700); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if secret != "" {
+		t.secret = []byte(secret)
+	} else if err := t.loadSecret(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	return nil
+}
+
+// loadSecret reads the key used to sign confirmation tokens from the list
+// location, generating it if needed.
+func (t *Target) loadSecret() error {
+	path := filepath.Join(t.location, "list.key")
+	keyHex, err := os.ReadFile(path)
+	if err == nil {
+		t.secret, err = hex.DecodeString(strings.TrimSpace(string(keyHex)))
+		if err != nil {
+			return fmt.Errorf("malformed %s: %w", path, err)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	t.secret = make([]byte, 32)
+	if _, err := rand.Read(t.secret); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hex.EncodeToString(t.secret)), 0o600)
+}
+
+// Address returns the normalized posting address of the list.
+func (t *Target) Address() string {
+	return t.address
+}
+
+// Members returns the list of member addresses.
+func (t *Target) Members() ([]string, error) {
+	return t.members.(interface{ Keys() ([]string, error) }).Keys()
+}
+
+// IsMember reports whether the address is subscribed to the list.
+func (t *Target) IsMember(ctx context.Context, addr string) (bool, error) {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return false, err
+	}
+	_, ok, err := t.members.Lookup(ctx, key)
+	return ok, err
+}
+
+// Subscribe adds the address to the members table.
+func (t *Target) Subscribe(addr string) error {
+	mutable, ok := t.members.(module.MutableTable)
+	if !ok {
+		return errors.New("list: members table is not mutable")
+	}
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return err
+	}
+	if !address.Valid(key) || !strings.Contains(key, "@") {
+		return fmt.Errorf("list: invalid address: %s", addr)
+	}
+	return mutable.SetKey(key, time.Now().UTC().Format(time.RFC3339))
+}
+
+// Unsubscribe removes the address from the members table.
+func (t *Target) Unsubscribe(addr string) error {
+	mutable, ok := t.members.(module.MutableTable)
+	if !ok {
+		return errors.New("list: members table is not mutable")
+	}
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return err
+	}
+	return mutable.RemoveKey(key)
+}
+
+func (t *Target) isModerator(addr string) bool {
+	for _, mod := range t.moderators {
+		if mod == addr {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	actionDistribute = "distribute"
+	actionHold       = "hold"
+)
+
+// postAction decides what to do with the message posted by the sender.
+func (t *Target) postAction(ctx context.Context, sender string) (string, error) {
+	if t.isModerator(sender) {
+		return actionDistribute, nil
+	}
+	switch t.posting {
+	case "open":
+		return actionDistribute, nil
+	case "moderated":
+		return actionHold, nil
+	}
+
+	ok, err := t.IsMember(ctx, sender)
+	if err != nil {
+		return "", &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during members lookup",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+	if ok {
+		return actionDistribute, nil
+	}
+	if t.nonMembers == "hold" {
+		return actionHold, nil
+	}
+	return "", &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Only list members can post to the list",
+		TargetName:   modName,
+	}
+}
+
+// listHeader returns the header for the distributed copy of the message.
+func (t *Target) listHeader(h textproto.Header) textproto.Header {
+	h = h.Copy()
+	for _, field := range listFields {
+		h.Del(field)
+	}
+
+	if t.subjectPrefix != "" {
+		subject, err := (&mime.WordDecoder{}).DecodeHeader(h.Get("Subject"))
+		if err != nil {
+			subject = h.Get("Subject")
+		}
+		if !strings.Contains(subject, t.subjectPrefix) {
+			subject = strings.TrimSpace(t.subjectPrefix + " " + subject)
+			h.Set("Subject", mime.QEncoding.Encode("utf-8", subject))
+		}
+	}
+	if t.replyTo == "list" {
+		h.Set("Reply-To", t.address)
+	}
+
+	// RFC 2919 and RFC 2369.
+	listID := "<" + t.listID + ">"
+	if t.displayName != "" {
+		listID = mime.QEncoding.Encode("utf-8", t.displayName) + " " + listID
+	}
+	h.Set("List-Id", listID)
+	h.Set("List-Post", "<mailto:"+t.address+">")
+	h.Set("List-Help", "<mailto:"+t.requestAddr+"?subject=help>")
+	if t.emailCommands {
+		h.Set("List-Subscribe", "<mailto:"+t.requestAddr+"?subject=subscribe>")
+		if t.unsubscribeURL == nil {
+			h.Set("List-Unsubscribe", "<mailto:"+t.requestAddr+"?subject=unsubscribe>")
+		}
+	}
+	h.Set("List-Owner", "<mailto:"+t.ownerAddr+">")
+	h.Set("Precedence", "list")
+	return h
+}
+
+// distribute sends the message to all list members.
+func (t *Target) distribute(ctx context.Context, traceID string, h textproto.Header, body buffer.Buffer) error {
+	members, err := t.Members()
+	if err != nil {
+		return err
+	}
+	rcpts := make([]string, 0, len(members))
+	for _, member := range members {
+		member, err := address.ForLookup(member)
+		if err != nil || member == t.address {
+			continue
+		}
+		rcpts = append(rcpts, member)
+	}
+
+	listHdr := t.listHeader(h)
+	if t.unsubscribeURL == nil {
+		accepted, err := t.distributeTo(ctx, traceID, rcpts, listHdr, body)
+		if err != nil {
+			return err
+		}
+		t.log.Msg("message distributed", "list", t.address, "rcpts", accepted)
+		return nil
+	}
+
+	// Unsubscribe links are personal, so each member gets a separate copy.
+	// Errors for single members are only logged since the message is already
+	// sent to other members and retrying would duplicate it.
+	var (
+		accepted int
+		firstErr error
+	)
+	for _, rcpt := range rcpts {
+		memberHdr := listHdr.Copy()
+		t.setUnsubscribe(&memberHdr, rcpt)
+		n, err := t.distributeTo(ctx, traceID, []string{rcpt}, memberHdr, body)
+		if err != nil {
+			t.log.Error("distribution failed", err, "rcpt", rcpt)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		accepted += n
+	}
+	if accepted == 0 && firstErr != nil {
+		return firstErr
+	}
+	t.log.Msg("message distributed", "list", t.address, "rcpts", accepted)
+	return nil
+}
+
+// distributeTo sends the message with the list header to the specified
+// members and returns the amount of accepted recipients.
+func (t *Target) distributeTo(ctx context.Context, traceID string, rcpts []string, h textproto.Header, body buffer.Buffer) (int, error) {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return 0, err
+	}
+	msgMeta := &module.MsgMetadata{
+		ID:           msgID,
+		TraceID:      traceID,
+		OriginalFrom: t.ownerAddr,
+	}
+	dl := target.DeliveryLogger(t.log, msgMeta)
+
+	delivery, err := t.target.Start(ctx, msgMeta, t.ownerAddr)
+	if err != nil {
+		return 0, err
+	}
+	accepted := 0
+	for _, rcpt := range rcpts {
+		if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			dl.Error("member rejected", err, "rcpt", rcpt)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		if err := delivery.Abort(ctx); err != nil {
+			dl.Error("delivery.Abort failed", err)
+		}
+		dl.Debugf("no recipients to distribute the message to")
+		return 0, nil
+	}
+
+	if err := delivery.Body(ctx, h, body); err != nil {
+		delivery.Abort(ctx)
+		return 0, err
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return accepted, nil
+}
+
+type delivery struct {
+	t        *Target
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	log      log.Logger
+
+	post    bool
+	request bool
+
+	action string
+	header textproto.Header
+	body   buffer.Buffer
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	rcpt, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
+			Message:      "Malformed recipient address",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+	switch rcpt {
+	case d.t.address:
+		d.post = true
+	case d.t.requestAddr:
+		d.request = true
+	default:
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "No such list",
+			TargetName:   modName,
+			Misc: map[string]interface{}{
+				"rcpt": rcptTo,
+			},
+		}
+	}
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	d.header = header
+	d.body = body
+
+	if !d.post {
+		return nil
+	}
+
+	for _, listID := range header.Values("List-Id") {
+		if strings.Contains(listID, "<"+d.t.listID+">") {
+			return &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+				Message:      "Mailing list loop detected",
+				TargetName:   modName,
+			}
+		}
+	}
+	if d.mailFrom == "" {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Messages with null sender can't be posted to the list",
+			TargetName:   modName,
+		}
+	}
+	sender, err := address.ForLookup(d.mailFrom)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
+			Message:      "Malformed sender address",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+
+	d.action, err = d.t.postAction(ctx, sender)
+	return err
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.request {
+		d.t.handleRequest(ctx, d.msgMeta, d.mailFrom, d.header)
+	}
+
+	switch d.action {
+	case actionDistribute:
+		if err := d.t.distribute(ctx, d.msgMeta.TraceID, d.header, d.body); err != nil {
+			return exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{"target": modName}),
+				true,
+			)
+		}
+	case actionHold:
+		id, err := d.t.hold(d.mailFrom, d.header, d.body)
+		if err != nil {
+			return exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{"target": modName}),
+				true,
+			)
+		}
+		d.log.Msg("message held for moderation", "list", d.t.address, "held_id", id)
+		d.t.notifyModerators(ctx, d.msgMeta.TraceID, id, d.mailFrom, d.header)
+	}
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,331 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (t mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(t.M))
+	for k := range t.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t mutableTable) SetKey(k, v string) error {
+	t.M[k] = v
+	return nil
+}
+
+func (t mutableTable) RemoveKey(k string) error {
+	delete(t.M, k)
+	return nil
+}
+
+func testList(t *testing.T) (*Target, *testutils.Target) {
+	t.Helper()
+
+	out := &testutils.Target{}
+	return &Target{
+		log:         testutils.Logger(t, modName),
+		address:     "list@example.org",
+		requestAddr: "list-request@example.org",
+		ownerAddr:   "list-owner@example.org",
+		listID:      "list.example.org",
+		members: mutableTable{testutils.Table{M: map[string]string{
+			"a@example.org": "",
+			"b@example.com": "",
+		}}},
+		moderators:    []string{"mod@example.org"},
+		target:        out,
+		subjectPrefix: "[list]",
+		replyTo:       "list",
+		posting:       "members",
+		nonMembers:    "hold",
+		emailCommands: true,
+		confirmTTL:    time.Hour,
+		location:      t.TempDir(),
+		secret:        []byte("secret"),
+	}, out
+}
+
+func send(t *testing.T, tgt *Target, from, rcpt, subject string) error {
+	t.Helper()
+
+	hdr := textproto.Header{}
+	hdr.Add("From", from)
+	hdr.Add("Subject", subject)
+	hdr.Add("List-Id", "<other.example.net>")
+
+	ctx := context.Background()
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		return err
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func TestList_Distribute(t *testing.T) {
+	tgt, out := testList(t)
+
+	if err := send(t, tgt, "A@example.org", "list@example.org", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Messages) != 1 {
+		t.Fatalf("Wrong amount of messages: %d", len(out.Messages))
+	}
+	msg := out.Messages[0]
+	if msg.MailFrom != "list-owner@example.org" {
+		t.Error("Wrong envelope sender:", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 2 {
+		t.Error("Wrong recipients:", msg.RcptTo)
+	}
+	for field, want := range map[string]string{
+		"Subject":    "[list] Hello",
+		"Reply-To":   "list@example.org",
+		"List-Id":    "<list.example.org>",
+		"List-Post":  "<mailto:list@example.org>",
+		"Precedence": "list",
+	} {
+		if got := msg.Header.Get(field); got != want {
+			t.Errorf("%s: want %q, got %q", field, want, got)
+		}
+	}
+
+	// Prefix is not added twice.
+	if err := send(t, tgt, "a@example.org", "list@example.org", "Re: [list] Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Messages[1].Header.Get("Subject"); got != "Re: [list] Hello" {
+		t.Error("Wrong subject:", got)
+	}
+}
+
+func TestList_Loop(t *testing.T) {
+	tgt, out := testList(t)
+
+	hdr := textproto.Header{}
+	hdr.Add("List-Id", "List <list.example.org>")
+	ctx := context.Background()
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, "a@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "list@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if len(out.Messages) != 0 {
+		t.Fatal("Message distributed")
+	}
+}
+
+func TestList_Moderation(t *testing.T) {
+	tgt, out := testList(t)
+
+	if err := send(t, tgt, "stranger@example.net", "list@example.org", "Buy now"); err != nil {
+		t.Fatal(err)
+	}
+	held, err := tgt.Held()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 1 || held[0].Sender != "stranger@example.net" || held[0].Subject != "Buy now" {
+		t.Fatalf("Wrong held messages: %+v", held)
+	}
+	if len(out.Messages) != 1 || out.Messages[0].RcptTo[0] != "mod@example.org" {
+		t.Fatal("Moderators are not notified")
+	}
+	if !strings.Contains(string(out.Messages[0].Body), "approve "+held[0].ID) {
+		t.Error("Notification does not contain the approve command")
+	}
+
+	// Only moderators can approve.
+	if err := send(t, tgt, "stranger@example.net", "list-request@example.org", "approve "+held[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := tgt.Held(); len(held) != 1 {
+		t.Fatal("Message approved by non-moderator")
+	}
+
+	if err := send(t, tgt, "mod@example.org", "list-request@example.org", "Re: approve "+held[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := tgt.Held(); len(held) != 0 {
+		t.Fatal("Message is still held")
+	}
+	distributed := out.Messages[len(out.Messages)-2]
+	if distributed.Header.Get("Subject") != "[list] Buy now" || len(distributed.RcptTo) != 2 {
+		t.Fatalf("Wrong distributed message: %v %v", distributed.Header.Get("Subject"), distributed.RcptTo)
+	}
+
+	tgt.nonMembers = "reject"
+	if err := send(t, tgt, "stranger@example.net", "list@example.org", "Buy now"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestList_Subscribe(t *testing.T) {
+	tgt, out := testList(t)
+
+	if err := send(t, tgt, "new@example.org", "list-request@example.org", "subscribe"); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Messages) != 1 {
+		t.Fatalf("Wrong amount of messages: %d", len(out.Messages))
+	}
+	confirm := out.Messages[0].Header.Get("Subject")
+	if !strings.HasPrefix(confirm, "confirm subscribe ") {
+		t.Fatal("Wrong confirmation subject:", confirm)
+	}
+	if ok, _ := tgt.IsMember(context.Background(), "new@example.org"); ok {
+		t.Fatal("Subscribed without confirmation")
+	}
+
+	// Token is bound to the address.
+	if err := send(t, tgt, "other@example.org", "list-request@example.org", "Re: "+confirm); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := tgt.IsMember(context.Background(), "other@example.org"); ok {
+		t.Fatal("Subscribed using the token for another address")
+	}
+
+	if err := send(t, tgt, "new@example.org", "list-request@example.org", "Re: "+confirm); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := tgt.IsMember(context.Background(), "new@example.org"); !ok {
+		t.Fatal("Not subscribed")
+	}
+
+	if err := send(t, tgt, "new@example.org", "list@example.org", "test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestList_OneClickUnsubscribe(t *testing.T) {
+	tgt, out := testList(t)
+	tgt.unsubscribeURL, _ = url.Parse("https://lists.example.org/unsubscribe")
+
+	if err := send(t, tgt, "a@example.org", "list@example.org", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Messages) != 2 {
+		t.Fatalf("Wrong amount of messages: %d", len(out.Messages))
+	}
+	tokens := make(map[string]string)
+	for _, msg := range out.Messages {
+		if len(msg.RcptTo) != 1 {
+			t.Fatal("Wrong recipients:", msg.RcptTo)
+		}
+		if got := msg.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+			t.Error("Wrong List-Unsubscribe-Post:", got)
+		}
+		unsub := msg.Header.Get("List-Unsubscribe")
+		link, mailto, ok := strings.Cut(unsub, ", ")
+		if !ok || !strings.HasPrefix(mailto, "<mailto:list-request@example.org?subject=unsubscribe%20") {
+			t.Fatal("Wrong List-Unsubscribe:", unsub)
+		}
+		u, err := url.Parse(strings.Trim(link, "<>"))
+		if err != nil || u.Host != "lists.example.org" || u.Query().Get("list") != "list@example.org" {
+			t.Fatal("Wrong unsubscribe URL:", link)
+		}
+		tokens[msg.RcptTo[0]] = u.Query().Get("token")
+	}
+
+	if _, err := tgt.UnsubscribeByToken(tokens["a@example.org"] + "x"); err != ErrInvalidToken {
+		t.Fatal("Expected ErrInvalidToken, got", err)
+	}
+	member, err := tgt.UnsubscribeByToken(tokens["a@example.org"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member != "a@example.org" {
+		t.Fatal("Wrong member unsubscribed:", member)
+	}
+	if ok, _ := tgt.IsMember(context.Background(), "a@example.org"); ok {
+		t.Fatal("Still subscribed")
+	}
+
+	// mailto link can be used from a different address.
+	if err := send(t, tgt, "forwarded@example.net", "list-request@example.org", "unsubscribe "+tokens["b@example.com"]); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := tgt.IsMember(context.Background(), "b@example.com"); ok {
+		t.Fatal("Still subscribed")
+	}
+}
+
+func TestList_UnknownRcpt(t *testing.T) {
+	tgt, _ := testList(t)
+	if err := send(t, tgt, "a@example.org", "other@example.org", "test"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestList_ControlCommands(t *testing.T) {
+	tgt, _ := testList(t)
+	tgt.instName = "test_list_control"
+	module.RegisterInstance(tgt, nil)
+	module.Initialized[tgt.instName] = true
+
+	if _, err := control.Call("list.subscribe", AdminArgs{CfgBlock: tgt.instName, Address: "c@example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := control.Call("list.members", AdminArgs{CfgBlock: tgt.instName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []string{"a@example.org", "b@example.com", "c@example.org"}) {
+		t.Fatal("Wrong members:", res)
+	}
+
+	if _, err := control.Call("list.members", AdminArgs{CfgBlock: "test_list_unknown"}); err == nil {
+		t.Fatal("Expected an error for unknown block")
+	}
+	if _, err := control.Call("list.subscribe", AdminArgs{CfgBlock: tgt.instName}); err == nil {
+		t.Fatal("Expected an error for missing address")
+	}
+}
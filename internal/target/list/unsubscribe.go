@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// unsubscribeToken returns the token that allows to unsubscribe the member
+// without confirmation (RFC 8058). It does not expire, since it is included
+// into distributed messages that can be read long after they are sent.
+func (t *Target) unsubscribeToken(member string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(member)) + "." +
+		base64.RawURLEncoding.EncodeToString(t.confirmMac("unsubscribe-link", member, ""))
+}
+
+// tokenMember returns the member address the unsubscribe token was issued
+// for.
+func (t *Target) tokenMember(token string) (string, error) {
+	addrB64, macB64, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	member, err := base64.RawURLEncoding.DecodeString(addrB64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macB64)
+	if err != nil || !hmac.Equal(mac, t.confirmMac("unsubscribe-link", string(member), "")) {
+		return "", ErrInvalidToken
+	}
+	return string(member), nil
+}
+
+// UnsubscribeURL returns the one-click unsubscribe URL for the member or an
+// empty string if unsubscribe_url is not configured.
+func (t *Target) UnsubscribeURL(member string) string {
+	if t.unsubscribeURL == nil {
+		return ""
+	}
+	u := *t.unsubscribeURL
+	q := u.Query()
+	q.Set("list", t.address)
+	q.Set("token", t.unsubscribeToken(member))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// UnsubscribeByToken removes the member the token was issued for from the
+// list and returns its address. ErrInvalidToken is returned if the token is
+// not valid.
+func (t *Target) UnsubscribeByToken(token string) (string, error) {
+	member, err := t.tokenMember(token)
+	if err != nil {
+		return "", err
+	}
+	if err := t.Unsubscribe(member); err != nil {
+		return member, err
+	}
+	t.log.Msg("member unsubscribed using the link", "list", t.address, "rcpt", member)
+	return member, nil
+}
+
+// setUnsubscribe adds List-Unsubscribe fields with links personal to the
+// member.
+func (t *Target) setUnsubscribe(h *textproto.Header, member string) {
+	mailto := "mailto:" + t.requestAddr + "?subject=" +
+		url.PathEscape("unsubscribe "+t.unsubscribeToken(member))
+	h.Set("List-Unsubscribe", "<"+t.UnsubscribeURL(member)+">, <"+mailto+">")
+	h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+}
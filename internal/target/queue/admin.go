@@ -0,0 +1,375 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+var (
+	ErrUnknownMessage = errors.New("queue: no such message")
+	ErrNotScheduled   = errors.New("queue: message is not scheduled, it is probably being delivered right now")
+	ErrUnknownQueue   = errors.New("queue: unknown queue")
+)
+
+// MessageInfo is the summary of the queued message state as reported by the
+// administration commands.
+type MessageInfo struct {
+	Queue string `json:"queue"`
+	ID    string `json:"id"`
+	// Trace ID assigned on reception, empty for messages received by older
+	// versions.
+	TraceID string `json:"trace_id,omitempty"`
+	From    string `json:"from"`
+
+	// Recipients delivery to which is not completed yet.
+	To []string `json:"to"`
+
+	Priority     int            `json:"priority"`
+	Tries        map[string]int `json:"tries,omitempty"`
+	FirstAttempt time.Time      `json:"first_attempt"`
+	LastAttempt  time.Time      `json:"last_attempt"`
+
+	// Zero if Delivering is true.
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	Delivering  bool      `json:"delivering,omitempty"`
+	Quarantined bool      `json:"quarantined,omitempty"`
+
+	// Last error for each recipient.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// MessageDetails is the extended version of MessageInfo returned for
+// a single message.
+type MessageDetails struct {
+	MessageInfo
+
+	Header   string `json:"header"`
+	BodySize int64  `json:"body_size"`
+}
+
+var (
+	queues     = make(map[*Queue]struct{})
+	queuesLock sync.Mutex
+)
+
+func registerQueue(q *Queue) {
+	queuesLock.Lock()
+	defer queuesLock.Unlock()
+	queues[q] = struct{}{}
+}
+
+func unregisterQueue(q *Queue) {
+	queuesLock.Lock()
+	defer queuesLock.Unlock()
+	delete(queues, q)
+}
+
+// AdminName returns the name used to refer to the queue in administration
+// commands. It is the configuration block name or the queue location for
+// queues defined inline.
+func (q *Queue) AdminName() string {
+	if q.name != "" {
+		return q.name
+	}
+	return q.location
+}
+
+func (q *Queue) isDelivering(id string) bool {
+	q.deliveringLock.Lock()
+	defer q.deliveringLock.Unlock()
+	_, ok := q.delivering[id]
+	return ok
+}
+
+func (q *Queue) messageInfo(meta *QueueMetadata, nextAttempt time.Time) MessageInfo {
+	info := MessageInfo{
+		Queue:        q.AdminName(),
+		ID:           meta.MsgMeta.ID,
+		TraceID:      meta.MsgMeta.TraceID,
+		From:         meta.From,
+		To:           meta.To,
+		Priority:     meta.Priority,
+		Tries:        meta.TriesCount,
+		FirstAttempt: meta.FirstAttempt,
+		LastAttempt:  meta.LastAttempt,
+		NextAttempt:  nextAttempt,
+		Delivering:   nextAttempt.IsZero() && q.isDelivering(meta.MsgMeta.ID),
+		Quarantined:  meta.Quarantined,
+	}
+	if len(meta.RcptErrs) != 0 {
+		info.Errors = make(map[string]string, len(meta.RcptErrs))
+		for rcpt, err := range meta.RcptErrs {
+			info.Errors[rcpt] = err.Error()
+		}
+	}
+	return info
+}
+
+func (q *Queue) scheduled() map[string]time.Time {
+	slots := q.wheel.Slots()
+	res := make(map[string]time.Time, len(slots))
+	for _, slot := range slots {
+		res[slot.Value.(queueSlot).ID] = slot.Time
+	}
+	return res
+}
+
+// List returns the information about all messages stored in the queue sorted
+// by the first delivery attempt time.
+func (q *Queue) List() ([]MessageInfo, error) {
+	metas, err := q.store.List()
+	if err != nil {
+		return nil, err
+	}
+	scheduled := q.scheduled()
+
+	res := make([]MessageInfo, 0, len(metas))
+	for _, meta := range metas {
+		res = append(res, q.messageInfo(meta, scheduled[meta.MsgMeta.ID]))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].FirstAttempt.Before(res[j].FirstAttempt)
+	})
+	return res, nil
+}
+
+// Inspect returns the detailed information about the queued message.
+func (q *Queue) Inspect(id string) (*MessageDetails, error) {
+	meta, header, body, err := q.store.Open(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUnknownMessage
+		}
+		return nil, err
+	}
+
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+		return nil, err
+	}
+	return &MessageDetails{
+		MessageInfo: q.messageInfo(meta, q.scheduled()[id]),
+		Header:      hdrBlob.String(),
+		BodySize:    int64(body.Len()),
+	}, nil
+}
+
+func (q *Queue) hasMessage(id string) bool {
+	return q.store.Has(id)
+}
+
+// Retry schedules the immediate delivery attempt for the message.
+//
+// Tries counters are not reset and the attempt is counted as an usual one.
+func (q *Queue) Retry(id string) error {
+	removed := q.wheel.Remove(func(slot TimeSlot) bool {
+		return slot.Value.(queueSlot).ID == id
+	})
+	if len(removed) == 0 {
+		if !q.hasMessage(id) {
+			return ErrUnknownMessage
+		}
+		return ErrNotScheduled
+	}
+
+	q.Log.Msg("delivery forced by administrator", "msg_id", id)
+	q.wheel.Add(time.Time{}, removed[0].Value)
+	return nil
+}
+
+// Flush schedules the immediate delivery attempt for all messages in the
+// queue and returns their count.
+func (q *Queue) Flush() int {
+	removed := q.wheel.Remove(func(TimeSlot) bool { return true })
+	q.Log.Msg("queue flush requested by administrator", "count", len(removed))
+	for _, slot := range removed {
+		q.wheel.Add(time.Time{}, slot.Value)
+	}
+	return len(removed)
+}
+
+// Delete cancels the delivery of the message and removes it from the queue.
+//
+// If bounce is true, the delivery status notification is sent to the
+// message sender for all recipients delivery to which was not completed.
+func (q *Queue) Delete(id string, bounce bool) error {
+	removed := q.wheel.Remove(func(slot TimeSlot) bool {
+		return slot.Value.(queueSlot).ID == id
+	})
+	if len(removed) == 0 {
+		if !q.hasMessage(id) {
+			return ErrUnknownMessage
+		}
+		if err := q.DeleteQuarantined(id, bounce); !errors.Is(err, ErrNotQuarantined) {
+			return err
+		}
+		return ErrNotScheduled
+	}
+
+	meta, header, _, err := q.store.Open(id)
+	if err != nil {
+		// Put it back, we may not have removed anything.
+		q.wheel.Add(removed[0].Time, removed[0].Value)
+		return err
+	}
+
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+	dl.Msg("delivery cancelled by administrator", "rcpts", meta.To, "bounce", bounce)
+
+	if bounce {
+		for _, rcpt := range meta.To {
+			meta.RcptErrs[rcpt] = &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+				Message:      "Message delivery cancelled by the server administrator",
+			}
+		}
+		q.emitDSN(meta, header, meta.To, dsn.ActionFailed)
+	}
+
+	q.store.Remove(meta.MsgMeta)
+	return nil
+}
+
+// AdminArgs are the arguments accepted by queue control commands.
+type AdminArgs struct {
+	Queue  string `json:"queue,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Bounce bool   `json:"bounce,omitempty"`
+}
+
+// selectQueues returns the list of queues matching the name, all queues are
+// returned if name is empty.
+func selectQueues(name string) ([]*Queue, error) {
+	queuesLock.Lock()
+	defer queuesLock.Unlock()
+
+	res := make([]*Queue, 0, len(queues))
+	for q := range queues {
+		if name == "" || q.AdminName() == name {
+			res = append(res, q)
+		}
+	}
+	if name != "" && len(res) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownQueue, name)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].AdminName() < res[j].AdminName()
+	})
+	return res, nil
+}
+
+// validMessageID reports whether id can be used to look up the message.
+// IDs are used in file names, so path separators and special names are
+// rejected.
+func validMessageID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\\\x00")
+}
+
+// messageCommand wraps the handler for a command that operates on a single
+// message. The message is looked up in all queues matching the args.
+func messageCommand(f func(q *Queue, args AdminArgs) (interface{}, error)) control.Handler {
+	return func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		if args.ID == "" {
+			return nil, errors.New("queue: message ID is required")
+		}
+		if !validMessageID(args.ID) {
+			return nil, ErrUnknownMessage
+		}
+
+		qs, err := selectQueues(args.Queue)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range qs {
+			if q.hasMessage(args.ID) {
+				return f(q, args)
+			}
+		}
+		return nil, ErrUnknownMessage
+	}
+}
+
+func init() {
+	control.Register("queue.list", func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		qs, err := selectQueues(args.Queue)
+		if err != nil {
+			return nil, err
+		}
+
+		res := []MessageInfo{}
+		for _, q := range qs {
+			msgs, err := q.List()
+			if err != nil {
+				return nil, fmt.Errorf("queue: %s: %w", q.AdminName(), err)
+			}
+			res = append(res, msgs...)
+		}
+		return res, nil
+	})
+	control.Register("queue.show", messageCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return q.Inspect(args.ID)
+	}))
+	control.Register("queue.retry", messageCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return nil, q.Retry(args.ID)
+	}))
+	control.Register("queue.delete", messageCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return nil, q.Delete(args.ID, args.Bounce)
+	}))
+	control.Register("queue.flush", func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		qs, err := selectQueues(args.Queue)
+		if err != nil {
+			return nil, err
+		}
+
+		count := 0
+		for _, q := range qs {
+			count += q.Flush()
+		}
+		return count, nil
+	})
+}
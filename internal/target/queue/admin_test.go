@@ -0,0 +1,143 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// waitScheduled waits until there is exactly one message in the queue and it
+// is scheduled for the next attempt.
+func waitScheduled(t *testing.T, q *Queue) MessageInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		msgs, err := q.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 1 && !msgs[0].NextAttempt.IsZero() {
+			return msgs[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Message was not rescheduled in time")
+	return MessageInfo{}
+}
+
+func TestQueueAdmin_Retry(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("go away"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	info := waitScheduled(t, q)
+	if info.From != "tester@example.com" {
+		t.Error("Wrong sender:", info.From)
+	}
+	if len(info.To) != 1 || info.To[0] != "tester1@example.org" {
+		t.Error("Wrong recipients:", info.To)
+	}
+	if info.Tries["tester1@example.org"] != 1 {
+		t.Error("Wrong tries count:", info.Tries)
+	}
+	if info.Errors["tester1@example.org"] == "" {
+		t.Error("Missing last error:", info.Errors)
+	}
+	if time.Until(info.NextAttempt) < 30*time.Minute {
+		t.Error("Next attempt is scheduled too early:", info.NextAttempt)
+	}
+
+	details, err := q.Inspect(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Header == "" || details.BodySize == 0 {
+		t.Errorf("Missing message contents: %+v", details)
+	}
+
+	if err := q.Retry("nonexistent"); !errors.Is(err, ErrUnknownMessage) {
+		t.Error("Expected ErrUnknownMessage, got", err)
+	}
+	if err := q.Retry(info.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueAdmin_Delete(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("go away"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	info := waitScheduled(t, q)
+	if err := q.Delete(info.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Delete(info.ID, false); !errors.Is(err, ErrUnknownMessage) {
+		t.Error("Expected ErrUnknownMessage for removed message, got", err)
+	}
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueAdmin_InvalidID(t *testing.T) {
+	for _, cmd := range []string{"queue.show", "queue.delete", "queue.dead_letter.show"} {
+		for _, id := range []string{"..", "../meta", "a/b"} {
+			_, err := control.Call(cmd, AdminArgs{ID: id})
+			if !errors.Is(err, ErrUnknownMessage) {
+				t.Errorf("%s %q: expected ErrUnknownMessage, got %v", cmd, id, err)
+			}
+		}
+	}
+}
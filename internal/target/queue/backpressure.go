@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+var (
+	globalSemLock sync.Mutex
+	globalSem     *prioritySemaphore
+)
+
+// sharedSemaphore returns the semaphore limiting the amount of deliveries
+// running in parallel in all queues, as set by the queue_max_parallelism global
+// directive.
+func sharedSemaphore(capacity int) *prioritySemaphore {
+	globalSemLock.Lock()
+	defer globalSemLock.Unlock()
+
+	if globalSem == nil || globalSem.capacity != capacity {
+		globalSem = newPrioritySemaphore(capacity, 0)
+	}
+	return globalSem
+}
+
+// depth returns the amount of messages that are scheduled for delivery or
+// being delivered. Messages held in quarantine are not counted.
+func (q *Queue) depth() int {
+	q.deliveringLock.Lock()
+	delivering := len(q.delivering)
+	q.deliveringLock.Unlock()
+	return q.wheel.Len() + delivering
+}
+
+// checkDepth returns a temporary error if the queue is over max_depth.
+func (q *Queue) checkDepth() error {
+	if q.maxDepth <= 0 {
+		return nil
+	}
+	depth := q.depth()
+	if depth < q.maxDepth {
+		return nil
+	}
+	backpressureRejected.WithLabelValues(q.name, q.location).Inc()
+	return &exterrors.SMTPError{
+		Code:         452,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 1},
+		Message:      "Too many messages in the queue, try again later",
+		TargetName:   "queue",
+		Misc: map[string]interface{}{
+			"depth": depth,
+		},
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/time/rate"
+)
+
+func TestQueueMaxDepth(t *testing.T) {
+	t.Parallel()
+
+	tempErr := exterrors.WithTemporary(errors.New("go away"), true)
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester1@example.org": tempErr},
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	q.maxDepth = 1
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// The message is scheduled for retry and counts towards max_depth.
+	deadline := time.Now().Add(5 * time.Second)
+	for q.depth() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("message is not rescheduled, depth = %d", q.depth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var err error
+	t.Run("rejected", func(t *testing.T) {
+		_, err = testutils.DoTestDeliveryErr(t, q, "tester@example.com", []string{"tester2@example.org"})
+	})
+	if err == nil {
+		t.Fatal("expected the message to be rejected")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Fatalf("backpressure error is not temporary: %v", err)
+	}
+	if code, _ := exterrors.Fields(err)["smtp_code"].(int); code != 452 {
+		t.Fatalf("unexpected SMTP code: %v", exterrors.Fields(err))
+	}
+}
+
+func TestQueueDispatchRate(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.dispatchLimiter = rate.NewLimiter(2, 1)
+	defer cleanQueue(t, q)
+
+	// Subtests are used to get different message IDs.
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+		})
+	}
+
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	start := time.Now()
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("second delivery started too early: %v", elapsed)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Dead letter store keeps copies of messages that failed permanently. Entries
+// use the same ID.meta, ID.header, ID.body layout as the queue itself, but
+// To contains only recipients that failed and ID is unique for each failure
+// since the delivery to different recipients of the same message can fail at
+// different times.
+
+func copyFile(dst string, src io.Reader) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, src); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (q *Queue) removeDeadLetterFiles(id string) {
+	for _, ext := range []string{".meta", ".header", ".body"} {
+		if err := os.Remove(filepath.Join(q.deadLetterDir, id+ext)); err != nil && !os.IsNotExist(err) {
+			q.Log.Error("failed to remove dead letter file", err, "dl_id", id)
+		}
+	}
+}
+
+// storeDeadLetter saves a copy of the message for the failed recipients.
+func (q *Queue) storeDeadLetter(meta *QueueMetadata, header textproto.Header, body buffer.Buffer, failedRcpts []string) {
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+
+	id := meta.MsgMeta.ID + "-" + strconv.FormatInt(time.Now().UnixNano(), 16)
+
+	if err := func() error {
+		var hdrBlob bytes.Buffer
+		if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(q.deadLetterDir, id+".header"), &hdrBlob); err != nil {
+			return err
+		}
+
+		bodyReader, err := body.Open()
+		if err != nil {
+			return err
+		}
+		defer bodyReader.Close()
+		if err := copyFile(filepath.Join(q.deadLetterDir, id+".body"), bodyReader); err != nil {
+			return err
+		}
+
+		dlMeta := *meta
+		dlMeta.MsgMeta = meta.MsgMeta.DeepCopy()
+		dlMeta.MsgMeta.ID = id
+		dlMeta.To = failedRcpts
+		dlMeta.RcptErrs = make(map[string]*smtp.SMTPError, len(failedRcpts))
+		for _, rcpt := range failedRcpts {
+			dlMeta.RcptErrs[rcpt] = meta.RcptErrs[rcpt]
+		}
+		dlMeta.TriesCount = nil
+		dlMeta.LastAttempt = time.Now()
+		return writeMetaFile(filepath.Join(q.deadLetterDir, id+".meta"), &dlMeta)
+	}(); err != nil {
+		dl.Error("failed to store dead letter", err, "dl_id", id)
+		q.removeDeadLetterFiles(id)
+		return
+	}
+
+	dl.Msg("stored to dead letter store", "dl_id", id, "rcpts", failedRcpts)
+}
+
+// DeadLetters returns the information about messages in the dead letter
+// store, LastAttempt is the time of the permanent failure.
+func (q *Queue) DeadLetters() ([]MessageInfo, error) {
+	if q.deadLetterDir == "" {
+		return nil, nil
+	}
+
+	dirInfo, err := os.ReadDir(q.deadLetterDir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]MessageInfo, 0, len(dirInfo)/3)
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		meta, err := readMetaFile(filepath.Join(q.deadLetterDir, entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			q.Log.Error("failed to read dead letter meta-data", err, "file", entry.Name())
+			continue
+		}
+		res = append(res, q.messageInfo(meta, time.Time{}))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastAttempt.Before(res[j].LastAttempt)
+	})
+	return res, nil
+}
+
+func (q *Queue) readDeadLetter(id string) (*QueueMetadata, textproto.Header, error) {
+	if q.deadLetterDir == "" || strings.ContainsAny(id, `/\`) {
+		return nil, textproto.Header{}, ErrUnknownMessage
+	}
+
+	meta, err := readMetaFile(filepath.Join(q.deadLetterDir, id+".meta"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, textproto.Header{}, ErrUnknownMessage
+		}
+		return nil, textproto.Header{}, err
+	}
+
+	hdrFile, err := os.Open(filepath.Join(q.deadLetterDir, id+".header"))
+	if err != nil {
+		return nil, textproto.Header{}, err
+	}
+	defer hdrFile.Close()
+	header, err := textproto.ReadHeader(bufio.NewReader(hdrFile))
+	if err != nil {
+		return nil, textproto.Header{}, err
+	}
+	return meta, header, nil
+}
+
+// InspectDeadLetter returns the detailed information about the message in
+// the dead letter store.
+func (q *Queue) InspectDeadLetter(id string) (*MessageDetails, error) {
+	meta, header, err := q.readDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+		return nil, err
+	}
+	bodyInfo, err := os.Stat(filepath.Join(q.deadLetterDir, id+".body"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageDetails{
+		MessageInfo: q.messageInfo(meta, time.Time{}),
+		Header:      hdrBlob.String(),
+		BodySize:    bodyInfo.Size(),
+	}, nil
+}
+
+// RequeueDeadLetter moves the message from the dead letter store back to the
+// queue and schedules the immediate delivery to the failed recipients. Tries
+// counters and previous errors are reset.
+func (q *Queue) RequeueDeadLetter(id string) error {
+	meta, header, err := q.readDeadLetter(id)
+	if err != nil {
+		return err
+	}
+
+	meta.TriesCount = map[string]int{}
+	meta.RcptErrs = map[string]*smtp.SMTPError{}
+	meta.FirstAttempt = time.Now()
+	meta.LastAttempt = time.Now()
+
+	body, err := q.store.Store(meta, header, buffer.FileBuffer{Path: filepath.Join(q.deadLetterDir, id+".body")})
+	if err != nil {
+		return fmt.Errorf("queue: requeue %s: %w", id, err)
+	}
+	q.removeDeadLetterFiles(id)
+
+	target.DeliveryLogger(q.Log, meta.MsgMeta).Msg("requeued from dead letter store", "rcpts", meta.To)
+
+	q.wheel.Add(time.Time{}, queueSlot{
+		ID:       id,
+		Priority: meta.Priority,
+		Meta:     meta,
+		Hdr:      &header,
+		Body:     body,
+	})
+	return nil
+}
+
+// DeleteDeadLetter removes the message from the dead letter store.
+func (q *Queue) DeleteDeadLetter(id string) error {
+	if _, _, err := q.readDeadLetter(id); err != nil {
+		return err
+	}
+	q.removeDeadLetterFiles(id)
+	q.Log.Msg("dead letter removed by administrator", "dl_id", id)
+	return nil
+}
+
+func (q *Queue) hasDeadLetter(id string) bool {
+	if q.deadLetterDir == "" || strings.ContainsAny(id, `/\`) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(q.deadLetterDir, id+".meta"))
+	return err == nil
+}
+
+// deadLetterCommand is the messageCommand counterpart for commands that
+// operate on a message in the dead letter store.
+func deadLetterCommand(f func(q *Queue, args AdminArgs) (interface{}, error)) control.Handler {
+	return func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		if args.ID == "" {
+			return nil, errors.New("queue: message ID is required")
+		}
+		if !validMessageID(args.ID) {
+			return nil, ErrUnknownMessage
+		}
+
+		qs, err := selectQueues(args.Queue)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range qs {
+			if q.hasDeadLetter(args.ID) {
+				return f(q, args)
+			}
+		}
+		return nil, ErrUnknownMessage
+	}
+}
+
+func init() {
+	control.Register("queue.dead_letter.list", func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		qs, err := selectQueues(args.Queue)
+		if err != nil {
+			return nil, err
+		}
+
+		res := []MessageInfo{}
+		for _, q := range qs {
+			msgs, err := q.DeadLetters()
+			if err != nil {
+				return nil, fmt.Errorf("queue: %s: %w", q.AdminName(), err)
+			}
+			res = append(res, msgs...)
+		}
+		return res, nil
+	})
+	control.Register("queue.dead_letter.show", deadLetterCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return q.InspectDeadLetter(args.ID)
+	}))
+	control.Register("queue.dead_letter.requeue", deadLetterCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return nil, q.RequeueDeadLetter(args.ID)
+	}))
+	control.Register("queue.dead_letter.delete", deadLetterCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return nil, q.DeleteDeadLetter(args.ID)
+	}))
+}
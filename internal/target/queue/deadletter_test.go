@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func waitDeadLetters(t *testing.T, q *Queue, count int) []MessageInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		msgs, err := q.DeadLetters()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == count {
+			return msgs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Dead letter was not stored in time")
+	return nil
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.deadLetterDir = t.TempDir()
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	msgs := waitDeadLetters(t, q, 1)
+	if len(msgs[0].To) != 1 || msgs[0].To[0] != "tester1@example.org" {
+		t.Error("Wrong recipients:", msgs[0].To)
+	}
+	if msgs[0].Errors["tester1@example.org"] == "" {
+		t.Error("Missing error:", msgs[0].Errors)
+	}
+
+	details, err := q.InspectDeadLetter(msgs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Header == "" || details.BodySize == 0 {
+		t.Errorf("Missing message contents: %+v", details)
+	}
+
+	if err := q.RequeueDeadLetter("nonexistent"); !errors.Is(err, ErrUnknownMessage) {
+		t.Error("Expected ErrUnknownMessage, got", err)
+	}
+	if err := q.RequeueDeadLetter(msgs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tester1@example.org" {
+		t.Error("Wrong recipients after requeue:", msg.RcptTo)
+	}
+	waitDeadLetters(t, q, 0)
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
@@ -0,0 +1,487 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Users receive periodic digests listing messages held for them in
+// quarantine. Each entry includes the release code - a token signed by the
+// queue that identifies the message and the recipient. Users release the
+// message by sending the code in the subject of a message to the release
+// address which should be routed to target.quarantine_release.
+
+var (
+	ErrInvalidReleaseCode = errors.New("queue: invalid release code")
+	ErrExpiredReleaseCode = errors.New("queue: release code expired")
+)
+
+const releaseCodeMacLen = 16
+
+type quarantineDigest struct {
+	interval    time.Duration
+	from        string
+	releaseAddr string
+	codeTTL     time.Duration
+	domains     []string
+	secret      []byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func parseQuarantineDigest(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	d := &quarantineDigest{}
+	var secret string
+	cm := config.NewMap(m.Globals, node)
+	cm.Duration("interval", false, false, 24*time.Hour, &d.interval)
+	cm.String("from", false, true, "", &d.from)
+	cm.String("release_address", false, false, "", &d.releaseAddr)
+	cm.Duration("code_ttl", false, false, 7*24*time.Hour, &d.codeTTL)
+	cm.StringList("domains", false, false, nil, &d.domains)
+	cm.String("secret", false, false, "", &secret)
+	if _, err := cm.Process(); err != nil {
+		return nil, err
+	}
+
+	fromAddr, err := mailAddress(d.from)
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid from address: %v", err)
+	}
+	if d.releaseAddr == "" {
+		d.releaseAddr = fromAddr
+	}
+	for i, domain := range d.domains {
+		d.domains[i] = strings.ToLower(domain)
+	}
+	if secret != "" {
+		d.secret = []byte(secret)
+	}
+
+	return d, nil
+}
+
+// mailAddress extracts the address from the "Name <addr>" string.
+func mailAddress(s string) (string, error) {
+	if start := strings.LastIndexByte(s, '<'); start != -1 {
+		end := strings.LastIndexByte(s, '>')
+		if end < start {
+			return "", errors.New("missing closing bracket")
+		}
+		s = s[start+1 : end]
+	}
+	if _, _, err := address.Split(s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// loadSecret reads the key used to sign release codes from the queue
+// location, generating it if needed.
+func (d *quarantineDigest) loadSecret(location string) error {
+	if d.secret != nil {
+		return nil
+	}
+
+	path := filepath.Join(location, "quarantine_digest.key")
+	keyHex, err := os.ReadFile(path)
+	if err == nil {
+		d.secret, err = hex.DecodeString(strings.TrimSpace(string(keyHex)))
+		if err != nil {
+			return fmt.Errorf("queue: malformed %s: %w", path, err)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	d.secret = make([]byte, 32)
+	if _, err := rand.Read(d.secret); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hex.EncodeToString(d.secret)), 0o600)
+}
+
+// wantsDigest reports whether the recipient should receive digests.
+func (d *quarantineDigest) wantsDigest(rcpt string) bool {
+	if len(d.domains) == 0 {
+		return true
+	}
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return false
+	}
+	domain = strings.ToLower(domain)
+	for _, d := range d.domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *quarantineDigest) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, d.secret)
+	h.Write(payload)
+	return h.Sum(nil)[:releaseCodeMacLen]
+}
+
+// releaseCode returns the signed code that releases the message for the
+// recipient.
+func (d *quarantineDigest) releaseCode(queue, id, rcpt string, expires time.Time) string {
+	payload := []byte(strings.Join([]string{
+		queue, id, rcpt, strconv.FormatInt(expires.Unix(), 10),
+	}, "\x00"))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(d.mac(payload))
+}
+
+type releaseCode struct {
+	queue   string
+	id      string
+	rcpt    string
+	expires time.Time
+
+	payload []byte
+	mac     []byte
+}
+
+func parseReleaseCode(code string) (releaseCode, error) {
+	payloadB64, macB64, ok := strings.Cut(code, ".")
+	if !ok {
+		return releaseCode{}, ErrInvalidReleaseCode
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadB64)
+	if err != nil {
+		return releaseCode{}, ErrInvalidReleaseCode
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macB64)
+	if err != nil {
+		return releaseCode{}, ErrInvalidReleaseCode
+	}
+	parts := strings.Split(string(payload), "\x00")
+	if len(parts) != 4 {
+		return releaseCode{}, ErrInvalidReleaseCode
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return releaseCode{}, ErrInvalidReleaseCode
+	}
+	return releaseCode{
+		queue:   parts[0],
+		id:      parts[1],
+		rcpt:    parts[2],
+		expires: time.Unix(expires, 0),
+		payload: payload,
+		mac:     mac,
+	}, nil
+}
+
+// ReleaseByCode verifies the release code sent in the digest and releases
+// the message for the recipient it was issued for.
+func ReleaseByCode(code string) (queue, id, rcpt string, err error) {
+	rc, err := parseReleaseCode(code)
+	if err != nil {
+		return "", "", "", err
+	}
+	qs, err := selectQueues(rc.queue)
+	if err != nil {
+		return "", "", "", ErrInvalidReleaseCode
+	}
+	var q *Queue
+	for _, candidate := range qs {
+		if candidate.digest != nil && hmac.Equal(candidate.digest.mac(rc.payload), rc.mac) {
+			q = candidate
+			break
+		}
+	}
+	if q == nil {
+		return "", "", "", ErrInvalidReleaseCode
+	}
+	if time.Now().After(rc.expires) {
+		return "", "", "", ErrExpiredReleaseCode
+	}
+
+	return rc.queue, rc.id, rc.rcpt, q.ReleaseRcpt(rc.id, rc.rcpt)
+}
+
+// ReleaseRcpt removes the message from quarantine for a single recipient
+// and schedules its delivery.
+//
+// If the message has other recipients, a copy for the recipient is created
+// and the original message stays in quarantine.
+func (q *Queue) ReleaseRcpt(id, rcpt string) error {
+	meta, header, err := q.openQuarantined(id)
+	if err != nil {
+		return err
+	}
+	idx := -1
+	for i, to := range meta.To {
+		if to == rcpt {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		// Already released for the recipient.
+		return fmt.Errorf("%w for %s", ErrNotQuarantined, rcpt)
+	}
+	if len(meta.To) == 1 {
+		return q.Release(id)
+	}
+
+	_, _, body, err := q.store.Open(id)
+	if err != nil {
+		return err
+	}
+	newID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	newMeta := &QueueMetadata{
+		MsgMeta:      meta.MsgMeta.DeepCopy(),
+		From:         meta.From,
+		To:           []string{rcpt},
+		RcptErrs:     map[string]*smtp.SMTPError{},
+		Priority:     meta.Priority,
+		FirstAttempt: meta.FirstAttempt,
+		LastAttempt:  time.Now(),
+	}
+	newMeta.MsgMeta.ID = newID
+	newMeta.MsgMeta.Quarantine = false
+	storedBody, err := q.store.Store(newMeta, header, body)
+	if err != nil {
+		return err
+	}
+
+	meta.To = append(meta.To[:idx:idx], meta.To[idx+1:]...)
+	if err := q.store.UpdateMeta(meta); err != nil {
+		q.store.Remove(newMeta.MsgMeta)
+		return err
+	}
+
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+	dl.Msg("released from quarantine by recipient", "rcpt", rcpt, "new_msg_id", newID)
+	q.wheel.Add(time.Time{}, queueSlot{
+		ID:       newID,
+		Priority: newMeta.Priority,
+		Meta:     newMeta,
+		Hdr:      &header,
+		Body:     storedBody,
+	})
+	return nil
+}
+
+func (q *Queue) startDigests() error {
+	if err := q.digest.loadSecret(q.location); err != nil {
+		return err
+	}
+	q.digest.stop = make(chan struct{})
+	q.digest.done = make(chan struct{})
+	go func() {
+		defer close(q.digest.done)
+		t := time.NewTicker(q.digest.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				q.sendDigests()
+			case <-q.digest.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *Queue) stopDigests() {
+	close(q.digest.stop)
+	<-q.digest.done
+}
+
+type digestEntry struct {
+	meta    *QueueMetadata
+	from    string
+	subject string
+}
+
+// sendDigests sends digests listing quarantined messages not included in
+// the previous digests.
+func (q *Queue) sendDigests() {
+	metas, err := q.store.List()
+	if err != nil {
+		q.Log.Error("failed to list quarantined messages", err)
+		return
+	}
+
+	var (
+		included []*QueueMetadata
+		byRcpt   = make(map[string][]digestEntry)
+	)
+	for _, meta := range metas {
+		if !meta.Quarantined || meta.DigestSent {
+			continue
+		}
+		_, header, _, err := q.store.Open(meta.MsgMeta.ID)
+		if err != nil {
+			target.DeliveryLogger(q.Log, meta.MsgMeta).Error("failed to open quarantined message", err)
+			continue
+		}
+		entry := digestEntry{
+			meta:    meta,
+			from:    decodeHeader(header.Get("From")),
+			subject: decodeHeader(header.Get("Subject")),
+		}
+		for _, rcpt := range meta.To {
+			if q.digest.wantsDigest(rcpt) {
+				byRcpt[rcpt] = append(byRcpt[rcpt], entry)
+			}
+		}
+		included = append(included, meta)
+	}
+
+	rcpts := make([]string, 0, len(byRcpt))
+	for rcpt := range byRcpt {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+	for _, rcpt := range rcpts {
+		if err := q.sendDigest(rcpt, byRcpt[rcpt]); err != nil {
+			q.Log.Error("failed to send quarantine digest", err, "rcpt", rcpt)
+		}
+	}
+
+	for _, meta := range included {
+		// Message might be released while digests were sent, do not
+		// overwrite the updated meta-data.
+		fresh, _, _, err := q.store.Open(meta.MsgMeta.ID)
+		if err != nil || !fresh.Quarantined {
+			continue
+		}
+		fresh.DigestSent = true
+		if err := q.store.UpdateMeta(fresh); err != nil {
+			target.DeliveryLogger(q.Log, meta.MsgMeta).Error("meta-data update", err)
+		}
+	}
+}
+
+func decodeHeader(value string) string {
+	dec, err := (&mime.WordDecoder{}).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return dec
+}
+
+func (q *Queue) writeDigestBody(w *bytes.Buffer, rcpt string, entries []digestEntry) error {
+	expires := time.Now().Add(q.digest.codeTTL)
+
+	qpw := quotedprintable.NewWriter(w)
+	fmt.Fprintf(qpw, "The following messages sent to %s were held in quarantine\r\n", rcpt)
+	fmt.Fprintf(qpw, "as possibly unwanted or malicious and were not delivered.\r\n\r\n")
+	fmt.Fprintf(qpw, "To release a message, send an empty message to %s\r\n", q.digest.releaseAddr)
+	fmt.Fprintf(qpw, "with its release code as the subject or use the release link.\r\n")
+	fmt.Fprintf(qpw, "Release codes expire on %s.\r\n", expires.UTC().Format("2006-01-02 15:04 MST"))
+
+	for i, entry := range entries {
+		code := q.digest.releaseCode(q.AdminName(), entry.meta.MsgMeta.ID, rcpt, expires)
+		link := "mailto:" + q.digest.releaseAddr + "?subject=" + url.PathEscape("Release "+code)
+
+		fmt.Fprintf(qpw, "\r\n%d. From: %s\r\n", i+1, entry.from)
+		fmt.Fprintf(qpw, "   Subject: %s\r\n", entry.subject)
+		fmt.Fprintf(qpw, "   Received: %s\r\n", entry.meta.FirstAttempt.UTC().Format("2006-01-02 15:04 MST"))
+		fmt.Fprintf(qpw, "   Release code: %s\r\n", code)
+		fmt.Fprintf(qpw, "   Release link: <%s>\r\n", link)
+	}
+	return qpw.Close()
+}
+
+func (q *Queue) sendDigest(rcpt string, entries []digestEntry) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	if err := q.writeDigestBody(&body, rcpt, entries); err != nil {
+		return err
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", q.digest.from)
+	hdr.Add("To", rcpt)
+	hdr.Add("Subject", fmt.Sprintf("Quarantine digest: %d new message(s) held", len(entries)))
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+q.autogenMsgDomain+">")
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+	hdr.Add("Content-Transfer-Encoding", "quoted-printable")
+
+	ctx := context.Background()
+	msgMeta := &module.MsgMetadata{ID: msgID}
+	delivery, err := q.dsnPipeline.Start(ctx, msgMeta, "")
+	if err != nil {
+		return err
+	}
+	if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		return err
+	}
+
+	q.Log.Msg("quarantine digest sent", "rcpt", rcpt, "msg_id", msgID, "count", len(entries))
+	return nil
+}
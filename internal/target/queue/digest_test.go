@@ -0,0 +1,177 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var releaseCodeRe = regexp.MustCompile(`Release code: (\S+)`)
+
+func digestReleaseCodes(t *testing.T, msg *testutils.Msg) []string {
+	t.Helper()
+
+	body, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(msg.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []string
+	for _, match := range releaseCodeRe.FindAllStringSubmatch(string(body), -1) {
+		codes = append(codes, match[1])
+	}
+	return codes
+}
+
+func sendRelease(t *testing.T, subject string) error {
+	t.Helper()
+
+	mod, err := NewReleaseTarget(releaseModName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := mod.(*ReleaseTarget)
+	rt.log = testutils.Logger(t, releaseModName)
+
+	delivery, err := rt.Start(context.Background(), &module.MsgMetadata{ID: "release"}, "tester1@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", subject)
+	return delivery.Body(context.Background(), hdr, buffer.MemoryBuffer{})
+}
+
+func TestQueueQuarantineDigest(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.holdQuarantined = true
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.digest = &quarantineDigest{
+		interval:    time.Hour,
+		from:        "Quarantine <quarantine@example.org>",
+		releaseAddr: "quarantine@example.org",
+		codeTTL:     time.Hour,
+		domains:     []string{"example.org"},
+	}
+	if err := q.startDigests(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.net"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		Quarantine:   true,
+	})
+	msgs, err := q.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatal("Wrong quarantined messages:", msgs)
+	}
+	id := msgs[0].ID
+
+	q.sendDigests()
+
+	// Only tester1 is at the domain digests are sent for.
+	digest := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if len(digest.RcptTo) != 1 || digest.RcptTo[0] != "tester1@example.org" {
+		t.Fatal("Wrong digest recipients:", digest.RcptTo)
+	}
+	if digest.MailFrom != "" {
+		t.Error("Wrong MAIL FROM:", digest.MailFrom)
+	}
+	codes := digestReleaseCodes(t, digest)
+	if len(codes) != 1 {
+		t.Fatal("Wrong release codes in digest:", codes)
+	}
+
+	// Messages are listed only once.
+	q.sendDigests()
+	select {
+	case msg := <-dsnTarget.committed:
+		t.Fatal("Unexpected digest:", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := sendRelease(t, "Re: Release "+codes[0][:len(codes[0])-2]+"AA"); err == nil {
+		t.Error("Tampered release code accepted")
+	}
+	if err := sendRelease(t, "Re: Release "+codes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tester1@example.org" {
+		t.Fatal("Wrong recipients of the released message:", msg.RcptTo)
+	}
+	if msg.MsgMeta.Quarantine {
+		t.Error("Quarantine flag is not cleared on release")
+	}
+
+	// The message is still held for the other recipient.
+	msgs, err = q.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != id || strings.Join(msgs[0].To, ",") != "tester2@example.net" {
+		t.Fatal("Wrong quarantined messages after release:", msgs)
+	}
+
+	if err := sendRelease(t, "Release "+codes[0]); err == nil {
+		t.Error("Release code used twice")
+	}
+}
+
+func TestReleaseByCode_Expired(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.digest = &quarantineDigest{interval: time.Hour}
+	if err := q.startDigests(); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanQueue(t, q)
+
+	code := q.digest.releaseCode(q.AdminName(), "id", "tester@example.org", time.Now().Add(-time.Minute))
+	if _, _, _, err := ReleaseByCode(code); !errors.Is(err, ErrExpiredReleaseCode) {
+		t.Error("Expected ErrExpiredReleaseCode, got", err)
+	}
+	if _, _, _, err := ReleaseByCode("garbage"); !errors.Is(err, ErrInvalidReleaseCode) {
+		t.Error("Expected ErrInvalidReleaseCode, got", err)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Reasons for not generating a DSN, used as the reason label of
+// maddy_queue_dsn_suppressed metric.
+const (
+	dsnSuppressNullSender = "null_sender"
+	dsnSuppressReport     = "report"
+	dsnSuppressSpam       = "spam"
+)
+
+// isMailerDaemon checks whether the address belongs to an automated mail
+// system that should never receive bounces.
+func isMailerDaemon(addr string) bool {
+	mbox, _, err := address.Split(addr)
+	if err != nil {
+		return false
+	}
+	mbox = strings.ToLower(mbox)
+	return mbox == "mailer-daemon" || strings.HasPrefix(mbox, "mailer-daemon+")
+}
+
+// isReport checks whether the message is a delivery status notification or
+// a disposition notification. Bouncing these can cause loops between servers.
+func isReport(header textproto.Header) bool {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return false
+	}
+	switch strings.ToLower(params["report-type"]) {
+	case "delivery-status", "disposition-notification":
+		return true
+	}
+	return false
+}
+
+// isSpam checks whether the message was flagged as spam by checks or by
+// an upstream filter.
+func isSpam(meta *QueueMetadata, header textproto.Header) bool {
+	if meta.MsgMeta.Quarantine {
+		return true
+	}
+	if strings.EqualFold(strings.TrimSpace(header.Get("X-Spam-Flag")), "yes") {
+		return true
+	}
+	status := strings.ToLower(strings.TrimSpace(header.Get("X-Spam-Status")))
+	return strings.HasPrefix(status, "yes")
+}
+
+// dsnSuppressReason returns the reason for never sending a DSN for the
+// message or an empty string if it can be sent.
+func dsnSuppressReason(meta *QueueMetadata, header textproto.Header) string {
+	switch {
+	case meta.MsgMeta.OriginalFrom == "" || isMailerDaemon(meta.MsgMeta.OriginalFrom):
+		return dsnSuppressNullSender
+	case isReport(header):
+		return dsnSuppressReport
+	}
+	return ""
+}
+
+// skipSpamDSN checks whether the DSN should not be generated automatically
+// for the message because it is flagged as spam. Sender addresses of spam are
+// usually forged and bounces would go to innocent third parties
+// (backscatter).
+func (q *Queue) skipSpamDSN(meta *QueueMetadata, header textproto.Header) bool {
+	if q.bounceSpam || q.dsnPipeline == nil || !isSpam(meta, header) {
+		return false
+	}
+	dsnSuppressed.WithLabelValues(q.name, q.location, dsnSuppressSpam).Inc()
+	target.DeliveryLogger(q.Log, meta.MsgMeta).Msg("not generating DSN for spam", "reason", dsnSuppressSpam)
+	return true
+}
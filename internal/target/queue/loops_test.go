@@ -0,0 +1,118 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDSNSuppressReason(t *testing.T) {
+	test := func(from, contentType, expected string) {
+		t.Helper()
+		meta := &QueueMetadata{MsgMeta: &module.MsgMetadata{OriginalFrom: from}}
+		hdr := textproto.Header{}
+		if contentType != "" {
+			hdr.Add("Content-Type", contentType)
+		}
+		if reason := dsnSuppressReason(meta, hdr); reason != expected {
+			t.Errorf("dsnSuppressReason(%q, %q) = %q, want %q", from, contentType, reason, expected)
+		}
+	}
+
+	test("", "", dsnSuppressNullSender)
+	test("MAILER-DAEMON@example.org", "", dsnSuppressNullSender)
+	test("mailer-daemon+bounces@example.org", "", dsnSuppressNullSender)
+	test("tester@example.org", "", "")
+	test("tester@example.org", "text/plain", "")
+	test("tester@example.org", `multipart/report; report-type=delivery-status; boundary="b"`, dsnSuppressReport)
+	test("tester@example.org", `multipart/report; report-type=disposition-notification; boundary="b"`, dsnSuppressReport)
+	test("tester@example.org", `multipart/report; report-type=feedback-report; boundary="b"`, "")
+}
+
+func TestIsSpam(t *testing.T) {
+	test := func(quarantine bool, field, value string, expected bool) {
+		t.Helper()
+		meta := &QueueMetadata{MsgMeta: &module.MsgMetadata{Quarantine: quarantine}}
+		hdr := textproto.Header{}
+		if field != "" {
+			hdr.Add(field, value)
+		}
+		if res := isSpam(meta, hdr); res != expected {
+			t.Errorf("isSpam(%v, %s: %s) = %v, want %v", quarantine, field, value, res, expected)
+		}
+	}
+
+	test(false, "", "", false)
+	test(true, "", "", true)
+	test(false, "X-Spam-Flag", "YES", true)
+	test(false, "X-Spam-Flag", "NO", false)
+	test(false, "X-Spam-Status", "Yes, score=7.2 required=5.0", true)
+	test(false, "X-Spam-Status", "No, score=0.1 required=5.0", false)
+}
+
+func TestQueueDSN_Spam(t *testing.T) {
+	test := func(t *testing.T, bounceSpam, expectDSN bool) {
+		dsnTarget := unreliableTarget{
+			committed: make(chan testutils.Msg, 10),
+			aborted:   make(chan testutils.Msg, 10),
+		}
+		dt := unreliableTarget{
+			rcptFailures: []map[string]error{
+				{
+					"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+				},
+			},
+			committed: make(chan testutils.Msg, 10),
+			aborted:   make(chan testutils.Msg, 10),
+		}
+		q := newTestQueue(t, &dt)
+		q.hostname = "mx.example.org"
+		q.autogenMsgDomain = "example.org"
+		q.dsnPipeline = &dsnTarget
+		q.bounceSpam = bounceSpam
+		defer cleanQueue(t, q)
+
+		testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+			OriginalFrom: "tester@example.com",
+			Quarantine:   true,
+		})
+
+		readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+		if expectDSN {
+			readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+			return
+		}
+		select {
+		case msg := <-dsnTarget.committed:
+			t.Fatalf("DSN generated for spam: %s", msg.Body)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	t.Run("suppressed", func(t *testing.T) { test(t, false, false) })
+	t.Run("bounce_spam", func(t *testing.T) { test(t, true, true) })
+}
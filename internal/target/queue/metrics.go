@@ -18,18 +18,176 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package queue
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"time"
 
-var queuedMsgs = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueLengthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("maddy", "queue", "length"),
+		"Amount of queued messages",
+		[]string{"module", "location"}, nil,
+	)
+	messageAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("maddy", "queue", "message_age_seconds"),
+		"Time since reception of stored messages",
+		[]string{"module", "location"}, nil,
+	)
+	oldestMessageAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("maddy", "queue", "oldest_message_age_seconds"),
+		"Time since reception of the oldest stored message",
+		[]string{"module", "location"}, nil,
+	)
+)
+
+// ageBuckets are used for message_age_seconds histogram, from 1 minute to
+// 5 days (default max_lifetime).
+var ageBuckets = []float64{60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 48 * 3600, 120 * 3600}
+
+// ageStatsInterval is the minimal interval between re-computations of
+// message_age_seconds histogram since it requires reading meta-data of all
+// stored messages.
+const ageStatsInterval = time.Minute
+
+var deliveryLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
 		Namespace: "maddy",
 		Subsystem: "queue",
-		Name:      "length",
-		Help:      "Amount of queued messages",
+		Name:      "delivery_latency_seconds",
+		Help:      "Time from message reception to successful delivery to the recipient",
+		Buckets:   []float64{1, 5, 15, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+	},
+	[]string{"module", "location", "domain"},
+)
+
+var deliveryAttempts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "delivery_attempts",
+		Help:      "Delivery attempts for each recipient, result is delivered, deferred or failed",
+	},
+	[]string{"module", "location", "domain", "result"},
+)
+
+var backpressureRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "backpressure_rejected",
+		Help:      "Amount of messages rejected because the queue is over max_depth",
 	},
 	[]string{"module", "location"},
 )
 
+var dsnSuppressed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "dsn_suppressed",
+		Help:      "Amount of DSNs not generated to prevent loops and backscatter",
+	},
+	[]string{"module", "location", "reason"},
+)
+
+// ageStats is the cached message_age_seconds histogram of a queue.
+type ageStats struct {
+	computedAt time.Time
+	count      uint64
+	sum        float64
+	oldest     float64
+	buckets    map[float64]uint64
+}
+
+// messageAgeStats returns the distribution of stored messages age, it is
+// recomputed at most once per ageStatsInterval.
+func (q *Queue) messageAgeStats() ageStats {
+	q.ageStatsLock.Lock()
+	defer q.ageStatsLock.Unlock()
+
+	if time.Since(q.ageStats.computedAt) < ageStatsInterval {
+		return q.ageStats
+	}
+
+	metas, err := q.store.List()
+	if err != nil {
+		q.Log.Error("failed to list messages for metrics", err)
+		return q.ageStats
+	}
+
+	now := time.Now()
+	stats := ageStats{
+		computedAt: now,
+		buckets:    make(map[float64]uint64, len(ageBuckets)),
+	}
+	for _, meta := range metas {
+		age := now.Sub(meta.FirstAttempt).Seconds()
+		stats.count++
+		stats.sum += age
+		if age > stats.oldest {
+			stats.oldest = age
+		}
+		for _, upper := range ageBuckets {
+			if age <= upper {
+				stats.buckets[upper]++
+			}
+		}
+	}
+	q.ageStats = stats
+	return stats
+}
+
+// queueCollector reports length and message age distribution for all
+// running queues. Values are computed on scrape.
+type queueCollector struct{}
+
+func (queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+	ch <- messageAgeDesc
+	ch <- oldestMessageAgeDesc
+}
+
+func (queueCollector) Collect(ch chan<- prometheus.Metric) {
+	queuesLock.Lock()
+	list := make([]*Queue, 0, len(queues))
+	for q := range queues {
+		list = append(list, q)
+	}
+	queuesLock.Unlock()
+
+	for _, q := range list {
+		ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue,
+			float64(q.depth()), q.name, q.location)
+
+		stats := q.messageAgeStats()
+		ch <- prometheus.MustNewConstHistogram(messageAgeDesc, stats.count, stats.sum,
+			stats.buckets, q.name, q.location)
+		ch <- prometheus.MustNewConstMetric(oldestMessageAgeDesc, prometheus.GaugeValue,
+			stats.oldest, q.name, q.location)
+	}
+}
+
+// metricsDomain returns the recipient domain used as a metric label.
+func metricsDomain(rcpt string) string {
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return ""
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
 func init() {
-	prometheus.MustRegister(queuedMsgs)
+	prometheus.MustRegister(queueCollector{})
+	prometheus.MustRegister(deliveryLatency)
+	prometheus.MustRegister(deliveryAttempts)
+	prometheus.MustRegister(dsnSuppressed)
+	prometheus.MustRegister(backpressureRejected)
 }
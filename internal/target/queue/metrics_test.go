@@ -0,0 +1,78 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueueMetrics(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@EXAMPLE.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	q.Close()
+
+	// Metrics are global, location label is unique for each test queue.
+	for result, expected := range map[string]float64{"deferred": 2, "delivered": 2, "failed": 0} {
+		val := testutil.ToFloat64(deliveryAttempts.WithLabelValues(q.name, q.location, "example.org", result))
+		if val != expected {
+			t.Errorf("Wrong delivery_attempts{result=%s}: %v", result, val)
+		}
+	}
+}
+
+func TestQueueMetrics_MessageAge(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	stats := q.messageAgeStats()
+	if stats.count != 1 || stats.buckets[ageBuckets[0]] != 1 || stats.oldest <= 0 {
+		t.Errorf("Wrong age stats: %+v", stats)
+	}
+}
@@ -0,0 +1,335 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// timeWindow is a daily time range, in minutes since midnight. end can be
+// smaller than start for ranges crossing midnight.
+type timeWindow struct {
+	start, end int
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// pacingPolicy limits when and how much mail is delivered to a set of
+// destination domains.
+type pacingPolicy struct {
+	loc     *time.Location
+	windows []timeWindow
+
+	// Max. amount of recipients per day, 0 means no limit.
+	dailyLimit int
+
+	// Daily limits used starting at warmupStart, one per day. dailyLimit is
+	// used after the end of the list.
+	warmupStart time.Time
+	warmup      []int
+
+	lock sync.Mutex
+	day  string
+	sent int
+}
+
+func (p *pacingPolicy) inWindow(t time.Time) bool {
+	if len(p.windows) == 0 {
+		return true
+	}
+	t = t.In(p.loc)
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range p.windows {
+		if w.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWindow returns the earliest time not before t when delivery is allowed
+// by the windows.
+func (p *pacingPolicy) nextWindow(t time.Time) time.Time {
+	if p.inWindow(t) {
+		return t
+	}
+	t = t.In(p.loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, p.loc)
+	var next time.Time
+	for _, w := range p.windows {
+		start := midnight.Add(time.Duration(w.start) * time.Minute)
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// limit returns the max. amount of recipients for the day t belongs to.
+func (p *pacingPolicy) limit(t time.Time) int {
+	if len(p.warmup) == 0 {
+		return p.dailyLimit
+	}
+	t = t.In(p.loc)
+	today := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, p.loc)
+	day := 0
+	if today.After(p.warmupStart) {
+		// Rounded to handle DST changes.
+		day = int((today.Sub(p.warmupStart) + 12*time.Hour) / (24 * time.Hour))
+	}
+	if day < len(p.warmup) {
+		return p.warmup[day]
+	}
+	return p.dailyLimit
+}
+
+// reserve checks whether delivery to one more recipient is allowed at t and
+// accounts for it if so. Otherwise, it returns the time when the delivery
+// should be attempted again.
+func (p *pacingPolicy) reserve(t time.Time) (bool, time.Time) {
+	if !p.inWindow(t) {
+		return false, p.nextWindow(t)
+	}
+
+	limit := p.limit(t)
+	if limit == 0 {
+		return true, time.Time{}
+	}
+
+	local := t.In(p.loc)
+	day := local.Format("2006-01-02")
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.day != day {
+		p.day = day
+		p.sent = 0
+	}
+	if p.sent < limit {
+		p.sent++
+		return true, time.Time{}
+	}
+
+	tomorrow := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, p.loc)
+	return false, p.nextWindow(tomorrow)
+}
+
+// pacing holds per-domain pacing policies configured using the pacing
+// directive. nil pacing allows all deliveries.
+type pacing struct {
+	domains map[string]*pacingPolicy
+}
+
+func (p *pacing) policy(rcpt string) *pacingPolicy {
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return nil
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return nil
+	}
+	return p.domains[domain]
+}
+
+// split returns recipients delivery to which can be attempted at t and the
+// ones that should be held. For held recipients, the earliest time at which
+// delivery to any of them is allowed is returned.
+func (p *pacing) split(rcpts []string, t time.Time) (allowed, held []string, until time.Time) {
+	if p == nil {
+		return rcpts, nil, time.Time{}
+	}
+	allowed = make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		policy := p.policy(rcpt)
+		if policy == nil {
+			allowed = append(allowed, rcpt)
+			continue
+		}
+		ok, next := policy.reserve(t)
+		if ok {
+			allowed = append(allowed, rcpt)
+			continue
+		}
+		held = append(held, rcpt)
+		if until.IsZero() || next.Before(until) {
+			until = next
+		}
+	}
+	return allowed, held, until
+}
+
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("malformed time: %s", s)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("malformed time: %s", s)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("malformed time: %s", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func parseWindows(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one window is required")
+	}
+	windows := make([]timeWindow, 0, len(node.Args))
+	for _, arg := range node.Args {
+		start, end, ok := strings.Cut(arg, "-")
+		if !ok {
+			return nil, config.NodeErr(node, "malformed window, expected HH:MM-HH:MM: %s", arg)
+		}
+		var (
+			w   timeWindow
+			err error
+		)
+		w.start, err = parseClock(start)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		w.end, err = parseClock(end)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		if w.start == w.end {
+			return nil, config.NodeErr(node, "empty window: %s", arg)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parsePacingPolicy(node config.Node, loc *time.Location) (*pacingPolicy, error) {
+	p := &pacingPolicy{loc: loc}
+
+	var (
+		tz     string
+		warmup []string
+	)
+	cfg := config.NewMap(nil, node)
+	cfg.String("timezone", false, false, "", &tz)
+	cfg.Custom("window", false, false, nil, parseWindows, &p.windows)
+	cfg.Int("daily_limit", false, false, 0, &p.dailyLimit)
+	cfg.StringList("warmup", false, false, nil, &warmup)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if tz != "" {
+		var err error
+		p.loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+	}
+	if p.dailyLimit < 0 {
+		return nil, config.NodeErr(node, "daily_limit must not be negative")
+	}
+	if len(warmup) != 0 {
+		if len(warmup) < 2 {
+			return nil, config.NodeErr(node, "warmup: start date and at least one limit are required")
+		}
+		start, err := time.ParseInLocation("2006-01-02", warmup[0], p.loc)
+		if err != nil {
+			return nil, config.NodeErr(node, "warmup: malformed start date: %v", err)
+		}
+		p.warmupStart = start
+		for _, arg := range warmup[1:] {
+			limit, err := strconv.Atoi(arg)
+			if err != nil || limit <= 0 {
+				return nil, config.NodeErr(node, "warmup: limit should be a positive integer: %s", arg)
+			}
+			p.warmup = append(p.warmup, limit)
+		}
+	}
+
+	return p, nil
+}
+
+func parsePacing(_ *config.Map, node config.Node) (interface{}, error) {
+	p := &pacing{domains: make(map[string]*pacingPolicy)}
+
+	var tz string
+	cfg := config.NewMap(nil, node)
+	cfg.String("timezone", false, false, "", &tz)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return nil, err
+	}
+
+	loc := time.Local
+	if tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+	}
+
+	for _, child := range unknown {
+		if child.Name != "domain" {
+			return nil, config.NodeErr(child, "unknown directive: %s", child.Name)
+		}
+		if len(child.Args) == 0 {
+			return nil, config.NodeErr(child, "at least one domain is required")
+		}
+		policy, err := parsePacingPolicy(child, loc)
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range child.Args {
+			domain, err := dns.ForLookup(domain)
+			if err != nil {
+				return nil, config.NodeErr(child, "invalid domain: %v", err)
+			}
+			if _, ok := p.domains[domain]; ok {
+				return nil, config.NodeErr(child, "duplicate pacing policy for domain %s", domain)
+			}
+			p.domains[domain] = policy
+		}
+	}
+	if len(p.domains) == 0 {
+		return nil, config.NodeErr(node, "at least one domain block is required")
+	}
+
+	return p, nil
+}
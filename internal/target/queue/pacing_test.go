@@ -0,0 +1,150 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+)
+
+func TestPacing(t *testing.T) {
+	nodes, err := parser.Read(strings.NewReader(`
+		pacing {
+			timezone UTC
+			domain example.org {
+				window 22:00-06:00
+			}
+			domain EXAMPLE.com example.net {
+				daily_limit 3
+				warmup 2026-10-01 1 2
+			}
+		}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parsePacing(nil, nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := p.(*pacing)
+
+	check := func(now time.Time, rcpts, expectAllowed, expectHeld []string, expectUntil time.Time) {
+		t.Helper()
+		allowed, held, until := pc.split(rcpts, now)
+		if len(allowed) == 0 {
+			allowed = nil
+		}
+		if !reflect.DeepEqual(allowed, expectAllowed) {
+			t.Errorf("%v: expected allowed %v, got %v", now, expectAllowed, allowed)
+		}
+		if !reflect.DeepEqual(held, expectHeld) {
+			t.Errorf("%v: expected held %v, got %v", now, expectHeld, held)
+		}
+		if !until.Equal(expectUntil) {
+			t.Errorf("%v: expected until %v, got %v", now, expectUntil, until)
+		}
+	}
+
+	// Delivery window.
+	check(time.Date(2026, 10, 5, 12, 0, 0, 0, time.UTC),
+		[]string{"a@example.org", "b@example.invalid"},
+		[]string{"b@example.invalid"}, []string{"a@example.org"},
+		time.Date(2026, 10, 5, 22, 0, 0, 0, time.UTC))
+	check(time.Date(2026, 10, 5, 23, 0, 0, 0, time.UTC),
+		[]string{"a@example.org"}, []string{"a@example.org"}, nil, time.Time{})
+	check(time.Date(2026, 10, 6, 5, 59, 0, 0, time.UTC),
+		[]string{"a@example.org"}, []string{"a@example.org"}, nil, time.Time{})
+
+	// Warm-up: 1 recipient on the first day, shared by all domains in the block.
+	day1 := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	check(day1, []string{"a@example.com", "b@example.net"},
+		[]string{"a@example.com"}, []string{"b@example.net"},
+		time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC))
+
+	// 2 on the second day.
+	day2 := day1.AddDate(0, 0, 1)
+	check(day2, []string{"a@example.com", "b@example.net", "c@example.com"},
+		[]string{"a@example.com", "b@example.net"}, []string{"c@example.com"},
+		time.Date(2026, 10, 3, 0, 0, 0, 0, time.UTC))
+
+	// daily_limit after the end of the warm-up.
+	day3 := day2.AddDate(0, 0, 1)
+	check(day3, []string{"a@example.com", "b@example.net", "c@example.com", "d@example.com"},
+		[]string{"a@example.com", "b@example.net", "c@example.com"}, []string{"d@example.com"},
+		time.Date(2026, 10, 4, 0, 0, 0, 0, time.UTC))
+
+	// nil pacing allows everything.
+	var nilPacing *pacing
+	allowed, held, _ := nilPacing.split([]string{"a@example.org"}, day1)
+	if len(allowed) != 1 || len(held) != 0 {
+		t.Errorf("nil pacing held recipients: %v", held)
+	}
+}
+
+func TestPacing_Invalid(t *testing.T) {
+	for _, cfg := range []string{
+		`pacing {}`,
+		`pacing {
+			domain example.org {
+				window 10:00
+			}
+		}`,
+		`pacing {
+			domain example.org {
+				window 10:00-10:00
+			}
+		}`,
+		`pacing {
+			domain example.org {
+				window 25:00-10:00
+			}
+		}`,
+		`pacing {
+			domain example.org {
+				warmup 2026-10-01
+			}
+		}`,
+		`pacing {
+			domain example.org {
+				warmup 2026-10-01 0
+			}
+		}`,
+		`pacing {
+			domain example.org {
+			}
+			domain EXAMPLE.ORG {
+			}
+		}`,
+		`pacing {
+			window 10:00-11:00
+		}`,
+	} {
+		nodes, err := parser.Read(strings.NewReader(cfg), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsePacing(nil, nodes[0]); err == nil {
+			t.Errorf("expected error for %s", cfg)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Message priorities use the MT-PRIORITY (RFC 6710) range.
+const (
+	minPriority = -9
+	maxPriority = 9
+
+	priorityNonUrgent = -4
+	priorityUrgent    = 4
+)
+
+// Values for priority_headers directive.
+const (
+	priorityHeadersNone          = "none"
+	priorityHeadersAuthenticated = "authenticated"
+	priorityHeadersAll           = "all"
+)
+
+func clampPriority(p int) int {
+	if p < minPriority {
+		return minPriority
+	}
+	if p > maxPriority {
+		return maxPriority
+	}
+	return p
+}
+
+// headerPriority returns the message priority requested using header
+// fields. ok is false if there are no such fields.
+func headerPriority(header textproto.Header) (prio int, ok bool) {
+	// RFC 6758.
+	if val := strings.TrimSpace(header.Get("MT-Priority")); val != "" {
+		if p, err := strconv.Atoi(val); err == nil {
+			return clampPriority(p), true
+		}
+	}
+
+	// RFC 2156.
+	switch strings.ToLower(strings.TrimSpace(header.Get("Priority"))) {
+	case "urgent":
+		return priorityUrgent, true
+	case "non-urgent":
+		return priorityNonUrgent, true
+	}
+
+	// Commonly used by MUAs, values are 1 (highest) to 5 (lowest) optionally
+	// followed by a comment.
+	if val := strings.TrimSpace(header.Get("X-Priority")); val != "" {
+		switch val[0] {
+		case '1':
+			return priorityUrgent, true
+		case '2':
+			return priorityUrgent / 2, true
+		case '4':
+			return priorityNonUrgent / 2, true
+		case '5':
+			return priorityNonUrgent, true
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Importance"))) {
+	case "high":
+		return priorityUrgent, true
+	case "low":
+		return priorityNonUrgent, true
+	}
+
+	return 0, false
+}
+
+// isBulk reports whether the message is marked as bulk mail that should not
+// delay other messages.
+func isBulk(header textproto.Header) bool {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return false
+}
+
+// messagePriority determines the priority of the new message.
+//
+// The priority_map entry for the sender address or domain takes precedence.
+// Otherwise, header fields are used. Header fields can always lower the
+// priority, but raising it is subject to the priority_headers directive.
+func (q *Queue) messagePriority(ctx context.Context, meta *QueueMetadata, header textproto.Header) int {
+	if q.priorityMap != nil && meta.From != "" {
+		keys := []string{meta.From}
+		if _, domain, err := address.Split(meta.From); err == nil && domain != "" {
+			keys = append(keys, domain)
+		}
+		for _, key := range keys {
+			val, ok, err := q.priorityMap.Lookup(ctx, key)
+			if err != nil {
+				target.DeliveryLogger(q.Log, meta.MsgMeta).Error("priority_map lookup failed", err, "key", key)
+				break
+			}
+			if !ok {
+				continue
+			}
+			p, err := strconv.Atoi(val)
+			if err != nil {
+				target.DeliveryLogger(q.Log, meta.MsgMeta).Msg("malformed priority_map value", "key", key, "value", val)
+				break
+			}
+			return clampPriority(p)
+		}
+	}
+
+	prio, ok := headerPriority(header)
+	if !ok && isBulk(header) {
+		prio, ok = priorityNonUrgent, true
+	}
+	if !ok {
+		return 0
+	}
+	if prio <= 0 {
+		return prio
+	}
+
+	switch q.priorityHeaders {
+	case priorityHeadersAll:
+		return prio
+	case priorityHeadersAuthenticated:
+		if meta.MsgMeta.Conn != nil && meta.MsgMeta.Conn.AuthUser != "" {
+			return prio
+		}
+	}
+	return 0
+}
+
+// prioritySemaphore limits the amount of deliveries running in parallel.
+// Waiting deliveries are started in the order of their priority, deliveries
+// with the same priority are started in FIFO order.
+//
+// Additionally, the amount of slots that can be used by messages with
+// negative priority can be restricted, so they will not take all slots.
+type prioritySemaphore struct {
+	lock sync.Mutex
+
+	capacity    int
+	lowCapacity int
+
+	used    int
+	usedLow int
+
+	// Sorted by priority (highest first), then by arrival time.
+	waiters []*semWaiter
+}
+
+type semWaiter struct {
+	prio  int
+	ready chan struct{}
+}
+
+func newPrioritySemaphore(capacity, lowCapacity int) *prioritySemaphore {
+	if lowCapacity <= 0 || lowCapacity > capacity {
+		lowCapacity = capacity
+	}
+	return &prioritySemaphore{
+		capacity:    capacity,
+		lowCapacity: lowCapacity,
+	}
+}
+
+func (s *prioritySemaphore) canTake(prio int) bool {
+	if s.used >= s.capacity {
+		return false
+	}
+	return prio >= 0 || s.usedLow < s.lowCapacity
+}
+
+func (s *prioritySemaphore) take(prio int) {
+	s.used++
+	if prio < 0 {
+		s.usedLow++
+	}
+}
+
+func (s *prioritySemaphore) Acquire(prio int) {
+	s.lock.Lock()
+	if len(s.waiters) == 0 && s.canTake(prio) {
+		s.take(prio)
+		s.lock.Unlock()
+		return
+	}
+
+	w := &semWaiter{prio: prio, ready: make(chan struct{})}
+	idx := sort.Search(len(s.waiters), func(i int) bool {
+		return s.waiters[i].prio < prio
+	})
+	s.waiters = append(s.waiters, nil)
+	copy(s.waiters[idx+1:], s.waiters[idx:])
+	s.waiters[idx] = w
+
+	// A waiter might be blocked only by lowCapacity, so the new one can start
+	// right away.
+	s.wakeUp()
+	s.lock.Unlock()
+
+	<-w.ready
+}
+
+func (s *prioritySemaphore) Release(prio int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.used--
+	if prio < 0 {
+		s.usedLow--
+	}
+	s.wakeUp()
+}
+
+// wakeUp starts waiting deliveries while there are free slots. Should be
+// called with lock held.
+func (s *prioritySemaphore) wakeUp() {
+	for i := 0; i < len(s.waiters) && s.used < s.capacity; {
+		w := s.waiters[i]
+		if !s.canTake(w.prio) {
+			i++
+			continue
+		}
+		s.take(w.prio)
+		s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+		close(w.ready)
+	}
+}
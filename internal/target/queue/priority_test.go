@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestHeaderPriority(t *testing.T) {
+	check := func(field, value string, prio int, ok bool) {
+		t.Helper()
+		hdr := textproto.Header{}
+		hdr.Add(field, value)
+		p, pOk := headerPriority(hdr)
+		if p != prio || pOk != ok {
+			t.Errorf("%s: %s: expected %v, %v; got %v, %v", field, value, prio, ok, p, pOk)
+		}
+	}
+
+	check("MT-Priority", "3", 3, true)
+	check("MT-Priority", "-20", -9, true)
+	check("MT-Priority", "junk", 0, false)
+	check("Priority", "urgent", priorityUrgent, true)
+	check("Priority", "non-urgent", priorityNonUrgent, true)
+	check("X-Priority", "1 (Highest)", priorityUrgent, true)
+	check("X-Priority", "3 (Normal)", 0, false)
+	check("X-Priority", "5", priorityNonUrgent, true)
+	check("Importance", "Low", priorityNonUrgent, true)
+	check("Subject", "urgent", 0, false)
+}
+
+func TestMessagePriority(t *testing.T) {
+	q := &Queue{
+		priorityHeaders: priorityHeadersAuthenticated,
+		priorityMap: testutils.Table{M: map[string]string{
+			"alerts@example.org": "6",
+			"news.example.org":   "-5",
+		}},
+	}
+
+	check := func(from, authUser string, hdrFields map[string]string, prio int) {
+		t.Helper()
+		hdr := textproto.Header{}
+		for k, v := range hdrFields {
+			hdr.Add(k, v)
+		}
+		meta := &QueueMetadata{
+			MsgMeta: &module.MsgMetadata{ID: "test", Conn: &module.ConnState{AuthUser: authUser}},
+			From:    from,
+		}
+		if p := q.messagePriority(context.Background(), meta, hdr); p != prio {
+			t.Errorf("%s (auth %q, %v): expected %d, got %d", from, authUser, hdrFields, prio, p)
+		}
+	}
+
+	check("alerts@example.org", "", nil, 6)
+	check("promo@news.example.org", "", map[string]string{"MT-Priority": "9"}, -5)
+	check("user@example.com", "", map[string]string{"MT-Priority": "9"}, 0)
+	check("user@example.com", "user", map[string]string{"MT-Priority": "9"}, 9)
+	check("user@example.com", "", map[string]string{"X-Priority": "5"}, priorityNonUrgent)
+	check("user@example.com", "", map[string]string{"Precedence": "bulk"}, priorityNonUrgent)
+}
+
+func TestPrioritySemaphore(t *testing.T) {
+	s := newPrioritySemaphore(1, 0)
+	s.Acquire(0)
+
+	started := make(chan int, 3)
+	for _, prio := range []int{-4, 0, 5} {
+		prio := prio
+		go func() {
+			s.Acquire(prio)
+			started <- prio
+		}()
+		// Make sure goroutines are queued in the specified order.
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, expected := range []int{5, 0, -4} {
+		s.Release(0)
+		select {
+		case prio := <-started:
+			if prio != expected {
+				t.Fatalf("Expected delivery with priority %d to start, got %d", expected, prio)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Waiter was not woken up")
+		}
+	}
+}
+
+func TestPrioritySemaphore_LowCapacity(t *testing.T) {
+	s := newPrioritySemaphore(2, 1)
+	s.Acquire(-1)
+
+	lowStarted := make(chan struct{})
+	go func() {
+		s.Acquire(-1)
+		close(lowStarted)
+	}()
+
+	select {
+	case <-lowStarted:
+		t.Fatal("Low priority delivery started while low priority slots are used")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Slot is still available for normal messages.
+	normalStarted := make(chan struct{})
+	go func() {
+		s.Acquire(0)
+		close(normalStarted)
+	}()
+	select {
+	case <-normalStarted:
+	case <-time.After(time.Second):
+		t.Fatal("Normal priority delivery was blocked by low priority ones")
+	}
+
+	s.Release(0)
+	s.Release(-1)
+	select {
+	case <-lowStarted:
+	case <-time.After(time.Second):
+		t.Fatal("Low priority delivery was not started after release")
+	}
+}
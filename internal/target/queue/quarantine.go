@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Quarantined messages are kept in the store with Quarantined flag set and
+// are never scheduled for delivery until released by the administrator.
+
+const quarantineHookTimeout = time.Minute
+
+var ErrNotQuarantined = errors.New("queue: message is not quarantined")
+
+// runQuarantineHook executes the configured command to notify about the
+// quarantined message.
+func (q *Queue) runQuarantineHook(meta *QueueMetadata) {
+	if len(q.quarantineHook) == 0 {
+		return
+	}
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+
+	args := make([]string, 0, len(q.quarantineHook)-1)
+	for _, arg := range q.quarantineHook[1:] {
+		args = append(args, strings.NewReplacer(
+			"{msg_id}", meta.MsgMeta.ID,
+			"{sender}", meta.From,
+			"{rcpts}", strings.Join(meta.To, ","),
+			"{queue}", q.AdminName(),
+		).Replace(arg))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quarantineHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, q.quarantineHook[0], args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		dl.Error("quarantine hook failed", err, "output", string(out))
+	}
+}
+
+// quarantine marks the message as quarantined. It should be called before the
+// message is stored.
+func (q *Queue) quarantine(meta *QueueMetadata) bool {
+	if !q.holdQuarantined || !meta.MsgMeta.Quarantine {
+		return false
+	}
+	meta.Quarantined = true
+	return true
+}
+
+// Quarantined returns the information about all quarantined messages.
+func (q *Queue) Quarantined() ([]MessageInfo, error) {
+	msgs, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]MessageInfo, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Quarantined {
+			res = append(res, msg)
+		}
+	}
+	return res, nil
+}
+
+func (q *Queue) openQuarantined(id string) (*QueueMetadata, textproto.Header, error) {
+	meta, header, _, err := q.store.Open(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, textproto.Header{}, ErrUnknownMessage
+		}
+		return nil, textproto.Header{}, err
+	}
+	if !meta.Quarantined {
+		return nil, textproto.Header{}, ErrNotQuarantined
+	}
+	return meta, header, nil
+}
+
+// Release removes the message from quarantine and schedules its delivery.
+//
+// The quarantine flag set by checks is cleared as well so the message is
+// not moved to Junk by the final delivery target.
+func (q *Queue) Release(id string) error {
+	meta, _, err := q.openQuarantined(id)
+	if err != nil {
+		return err
+	}
+
+	meta.Quarantined = false
+	meta.MsgMeta.Quarantine = false
+	if err := q.store.UpdateMeta(meta); err != nil {
+		return err
+	}
+
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+	dl.Msg("released from quarantine by administrator", "rcpts", meta.To)
+	q.wheel.Add(time.Time{}, queueSlot{
+		ID:       id,
+		Priority: meta.Priority,
+	})
+	return nil
+}
+
+// DeleteQuarantined removes the quarantined message.
+//
+// If bounce is true, the delivery status notification is sent to the
+// message sender.
+func (q *Queue) DeleteQuarantined(id string, bounce bool) error {
+	meta, header, err := q.openQuarantined(id)
+	if err != nil {
+		return err
+	}
+
+	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
+	dl.Msg("quarantined message removed by administrator", "rcpts", meta.To, "bounce", bounce)
+
+	if bounce {
+		for _, rcpt := range meta.To {
+			meta.RcptErrs[rcpt] = &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Message rejected by the server administrator",
+			}
+		}
+		q.emitDSN(meta, header, meta.To, dsn.ActionFailed)
+	}
+
+	q.store.Remove(meta.MsgMeta)
+	return nil
+}
+
+func init() {
+	control.Register("queue.quarantine.list", func(rawArgs json.RawMessage) (interface{}, error) {
+		var args AdminArgs
+		if err := control.ParseArgs(rawArgs, &args); err != nil {
+			return nil, err
+		}
+		qs, err := selectQueues(args.Queue)
+		if err != nil {
+			return nil, err
+		}
+
+		res := []MessageInfo{}
+		for _, q := range qs {
+			msgs, err := q.Quarantined()
+			if err != nil {
+				return nil, fmt.Errorf("queue: %s: %w", q.AdminName(), err)
+			}
+			res = append(res, msgs...)
+		}
+		sort.SliceStable(res, func(i, j int) bool {
+			return res[i].FirstAttempt.Before(res[j].FirstAttempt)
+		})
+		return res, nil
+	})
+	control.Register("queue.quarantine.release", messageCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return nil, q.Release(args.ID)
+	}))
+	control.Register("queue.quarantine.delete", messageCommand(func(q *Queue, args AdminArgs) (interface{}, error) {
+		return nil, q.DeleteQuarantined(args.ID, args.Bounce)
+	}))
+}
@@ -0,0 +1,138 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueQuarantine(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	hookOut := filepath.Join(t.TempDir(), "hook")
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueueDir(t, &dt, dir)
+	q.holdQuarantined = true
+	q.quarantineHook = []string{"sh", "-c", "echo {msg_id} > " + hookOut}
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		Quarantine:   true,
+	})
+
+	select {
+	case msg := <-dt.committed:
+		t.Fatal("Quarantined message delivered:", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	msgs, err := q.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || !msgs[0].Quarantined {
+		t.Fatal("Wrong quarantined messages:", msgs)
+	}
+	id := msgs[0].ID
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out, _ := os.ReadFile(hookOut)
+		if strings.TrimSpace(string(out)) == id {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Quarantine hook is not executed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Quarantined messages are not scheduled after restart.
+	q.Close()
+	q = newTestQueueDir(t, &dt, dir)
+	defer cleanQueue(t, q)
+	select {
+	case msg := <-dt.committed:
+		t.Fatal("Quarantined message delivered after restart:", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := q.Retry(id); !errors.Is(err, ErrNotScheduled) {
+		t.Error("Expected ErrNotScheduled, got", err)
+	}
+	if err := q.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if msg.RcptTo[0] != "tester1@example.org" {
+		t.Fatal("Wrong message delivered:", msg.RcptTo)
+	}
+	if msg.MsgMeta.Quarantine {
+		t.Error("Quarantine flag is not cleared on release")
+	}
+
+	// Message is removed after the delivery is committed.
+	deadline = time.Now().Add(5 * time.Second)
+	for q.hasMessage(id) {
+		if time.Now().After(deadline) {
+			t.Fatal("Message is not removed after delivery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := q.Release(id); !errors.Is(err, ErrUnknownMessage) {
+		t.Error("Expected ErrUnknownMessage, got", err)
+	}
+}
+
+func TestQueueQuarantine_Delete(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	q.holdQuarantined = true
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		Quarantine:   true,
+	})
+
+	msgs, err := q.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatal("Wrong quarantined messages:", msgs)
+	}
+
+	if err := q.Delete(msgs[0].ID, false); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
@@ -59,18 +59,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"path/filepath"
-	"runtime"
 	"runtime/debug"
 	"runtime/trace"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -82,9 +78,14 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/panics"
 	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/history"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 )
 
 // partialError describes state of partially successful message delivery.
@@ -126,13 +127,38 @@ type Queue struct {
 	wheel            *TimeWheel
 
 	dsnPipeline module.DeliveryTarget
-
-	// Retry delay is calculated using the following formula:
+	// Templates for the human-readable part of generated DSNs, nil to use
+	// the built-in text.
+	dsnTemplates *dsn.Templates
+	// Message age after which "delayed" DSNs are sent, in ascending order.
+	delayNotify []time.Duration
+
+	holdQuarantined bool
+	// Generate DSNs for messages flagged as spam.
+	bounceSpam     bool
+	quarantineHook []string
+	// Periodic digests of quarantined messages for recipients, nil if
+	// disabled.
+	digest *quarantineDigest
+
+	// Delivery status notifications for applications, nil if disabled.
+	webhook *webhook
+
+	// Per-domain delivery windows and daily limits, nil if not configured.
+	pacing *pacing
+
+	// If retry_schedule does not specify intervals, retry delay is
+	// calculated using the following formula:
 	// initialRetryTime * retryTimeScale ^ (TriesCount - 1)
 
 	initialRetryTime time.Duration
 	retryTimeScale   float64
 	maxTries         int
+	maxLifetime      time.Duration
+
+	// Configured using retry_schedule, see rcptSchedule.
+	retrySchedule *retrySchedule
+	retryDomains  map[string]*retrySchedule
 
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
@@ -149,10 +175,43 @@ type Queue struct {
 	Log    log.Logger
 	Target module.DeliveryTarget
 
+	// Message priority sources, see messagePriority.
+	priorityMap     module.Table
+	priorityHeaders string
+
 	deliveryWg sync.WaitGroup
-	// Buffered channel used to restrict count of deliveries attempted
-	// in parallel.
-	deliverySemaphore chan struct{}
+	// Used to restrict count of deliveries attempted in parallel.
+	deliverySemaphore *prioritySemaphore
+	// Shared by all queues, nil if queue_max_parallelism is not set.
+	globalSemaphore *prioritySemaphore
+	// Limits the rate at which deliveries are started, nil if not limited.
+	dispatchLimiter *rate.Limiter
+	dispatchCtx     context.Context
+	dispatchCancel  context.CancelFunc
+	// Max. amount of messages scheduled for delivery, new messages are
+	// rejected with a temporary error after that. 0 means no limit.
+	maxDepth int
+	// Max. count of deliveries with negative priority attempted in parallel.
+	maxParallelismLow int
+
+	// IDs of messages dispatched from the wheel and not yet rescheduled or
+	// removed.
+	deliveringLock sync.Mutex
+	delivering     map[string]struct{}
+
+	// Cached message age distribution, see messageAgeStats.
+	ageStatsLock sync.Mutex
+	ageStats     ageStats
+
+	// Directory to keep copies of permanently failed messages in, empty if
+	// dead letter store is disabled.
+	deadLetterDir string
+
+	store messageStore
+	// Set if store is shared with other server instances.
+	shared   sharedStore
+	pollStop chan struct{}
+	pollDone chan struct{}
 }
 
 type QueueMetadata struct {
@@ -174,12 +233,29 @@ type QueueMetadata struct {
 	// Amount of times delivery *already tried*.
 	TriesCount map[string]int
 
+	// Message priority in the MT-PRIORITY range (-9 to 9). Deliveries of
+	// messages with higher priority are started first.
+	Priority int `json:",omitempty"`
+
+	// Message is held until released by the administrator.
+	Quarantined bool `json:",omitempty"`
+	// Message was listed in the quarantine digest sent to recipients.
+	DigestSent bool `json:",omitempty"`
+
+	// Amount of delay_notify thresholds for which the DSN was already sent.
+	DelayNotified int `json:",omitempty"`
+
 	FirstAttempt time.Time
 	LastAttempt  time.Time
 }
 
 type queueSlot struct {
-	ID string
+	ID       string
+	Priority int
+
+	// LastAttempt of the message at the time it was scheduled. It is used
+	// to detect attempts made by other instances using the shared store.
+	LastAttempt time.Time
 
 	// If nil - Hdr and Body are invalid, all values should be read from
 	// disk.
@@ -194,7 +270,7 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 		initialRetryTime: 15 * time.Minute,
 		retryTimeScale:   1.25,
 		postInitDelay:    10 * time.Second,
-		Log:              log.Logger{Name: "queue"},
+		Log:              log.Logger{Name: "queue", Instance: instName},
 	}
 	switch len(inlineArgs) {
 	case 0:
@@ -208,10 +284,25 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 }
 
 func (q *Queue) Init(cfg *config.Map) error {
-	var maxParallelism int
+	var (
+		maxParallelism  int
+		maxDispatchRate int
+	)
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
+	cfg.Duration("max_lifetime", false, false, 0, &q.maxLifetime)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
+	cfg.Int("max_parallelism_low_priority", false, false, 0, &q.maxParallelismLow)
+	cfg.Int("max_dispatch_rate", false, false, 0, &maxDispatchRate)
+	cfg.Int("max_depth", false, false, 0, &q.maxDepth)
+	cfg.Enum("priority_headers", false, false,
+		[]string{priorityHeadersNone, priorityHeadersAuthenticated, priorityHeadersAll},
+		priorityHeadersAuthenticated, &q.priorityHeaders)
+	modconfig.Table(cfg, "priority_map", false, false, nil, &q.priorityMap)
+	q.retryDomains = make(map[string]*retrySchedule)
+	cfg.Custom("retry_schedule", false, false, nil, func(_ *config.Map, node config.Node) (interface{}, error) {
+		return parseRetrySchedule(node, true, q.retryDomains)
+	}, &q.retrySchedule)
 	cfg.String("location", false, false, q.location, &q.location)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
 	cfg.String("hostname", true, true, "", &q.hostname)
@@ -219,10 +310,42 @@ func (q *Queue) Init(cfg *config.Map) error {
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
+	cfg.Bool("hold_quarantined", false, false, &q.holdQuarantined)
+	cfg.Bool("bounce_spam", false, false, &q.bounceSpam)
+	cfg.StringList("quarantine_hook", false, false, nil, &q.quarantineHook)
+	cfg.Custom("quarantine_digest", false, false, nil, parseQuarantineDigest, &q.digest)
+	cfg.Custom("dsn_templates", false, false, nil, parseDSNTemplates, &q.dsnTemplates)
+	cfg.Custom("delay_notify", false, false, nil, parseDelayNotify, &q.delayNotify)
+	cfg.Custom("webhook", false, false, nil, parseWebhook, &q.webhook)
+	cfg.Custom("pacing", false, false, nil, parsePacing, &q.pacing)
+	var storeNode *config.Node
+	cfg.Custom("store", false, false, nil, func(_ *config.Map, node config.Node) (interface{}, error) {
+		return &node, nil
+	}, &storeNode)
+	var deadLetter []string
+	cfg.Custom("dead_letter", false, false, nil, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) > 1 {
+			return nil, config.NodeErr(node, "expected at most one argument")
+		}
+		if len(node.Children) != 0 {
+			return nil, config.NodeErr(node, "can't declare a block here")
+		}
+		return append([]string{}, node.Args...), nil
+	}, &deadLetter)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if maxDispatchRate < 0 {
+		return errors.New("queue: max_dispatch_rate must not be negative")
+	}
+	if maxDispatchRate > 0 {
+		q.dispatchLimiter = rate.NewLimiter(rate.Limit(maxDispatchRate), maxDispatchRate)
+	}
+	if globalParallelism, ok := cfg.Globals["queue_max_parallelism"].(int); ok && globalParallelism > 0 {
+		q.globalSemaphore = sharedSemaphore(globalParallelism)
+	}
+
 	if q.dsnPipeline != nil {
 		if q.autogenMsgDomain == "" {
 			return errors.New("queue: autogenerated_msg_domain is required if bounce {} is specified")
@@ -231,6 +354,14 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
 	}
+	if q.digest != nil {
+		if !q.holdQuarantined {
+			return errors.New("queue: quarantine_digest requires hold_quarantined")
+		}
+		if q.dsnPipeline == nil {
+			return errors.New("queue: bounce {} is required to send quarantine digests")
+		}
+	}
 	if q.location == "" && q.name == "" {
 		return errors.New("queue: need explicit location directive or inline argument if defined inline")
 	}
@@ -243,42 +374,104 @@ func (q *Queue) Init(cfg *config.Map) error {
 		return err
 	}
 
+	if storeNode != nil {
+		if len(storeNode.Args) != 1 {
+			return config.NodeErr(*storeNode, "exactly one argument is required")
+		}
+		switch storeNode.Args[0] {
+		case "fs":
+			if len(storeNode.Children) != 0 {
+				return config.NodeErr(*storeNode, "fs store has no options")
+			}
+		case "sql":
+			store, err := openSQLStore(*storeNode, &q.Log)
+			if err != nil {
+				return err
+			}
+			q.store = store
+		default:
+			return config.NodeErr(*storeNode, "unknown store: %s", storeNode.Args[0])
+		}
+	}
+
+	if deadLetter != nil {
+		q.deadLetterDir = filepath.Join(q.location, "dead_letter")
+		if len(deadLetter) == 1 {
+			q.deadLetterDir = deadLetter[0]
+		}
+		if err := os.MkdirAll(q.deadLetterDir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
 	return q.start(maxParallelism)
 }
 
 func (q *Queue) start(maxParallelism int) error {
+	q.dispatchCtx, q.dispatchCancel = context.WithCancel(context.Background())
 	q.wheel = NewTimeWheel(q.dispatch)
-	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.deliverySemaphore = newPrioritySemaphore(maxParallelism, q.maxParallelismLow)
+	q.delivering = make(map[string]struct{})
+	if q.webhook != nil {
+		q.webhook.start(q.Log)
+	}
+	if q.digest != nil {
+		if err := q.startDigests(); err != nil {
+			return err
+		}
+	}
+	if q.store == nil {
+		q.store = &fsStore{location: q.location, log: &q.Log}
+	}
 
 	if err := q.readDiskQueue(); err != nil {
 		return err
 	}
 
+	if shared, ok := q.store.(sharedStore); ok {
+		if isShared, interval := shared.Shared(); isShared {
+			q.shared = shared
+			q.pollStop = make(chan struct{})
+			q.pollDone = make(chan struct{})
+			go q.pollShared(interval)
+		}
+	}
+
+	registerQueue(q)
+
 	q.Log.Debugf("delivery target: %T", q.Target)
 
 	return nil
 }
 
 func (q *Queue) Close() error {
+	unregisterQueue(q)
+	if q.shared != nil {
+		close(q.pollStop)
+		<-q.pollDone
+	}
 	q.wheel.Close()
+	// Deliveries waiting for the dispatch rate limit are not started, messages
+	// stay in the store and are loaded on the next start.
+	q.dispatchCancel()
 	q.deliveryWg.Wait()
+	if q.webhook != nil {
+		q.webhook.close()
+	}
+	if q.digest != nil {
+		q.stopDigests()
+	}
 
-	return nil
+	return q.store.Close()
 }
 
-// discardBroken changes the name of metadata file to have .meta_broken
-// extension.
-//
-// Further attempts to deliver (due to a timewheel) it will fail due to
-// non-existent meta-data file.
-//
-// No error handling is done since this function is called from panic handler.
-func (q *Queue) discardBroken(id string) {
-	err := os.Rename(filepath.Join(q.location, id+".meta"), filepath.Join(q.location, id+".meta_broken"))
-	if err != nil {
-		// Note: Global logger is used in case there is something wrong with Queue.Log.
-		log.Printf("can't mark the queue message as broken: %v", err)
+// CheckHealth implements module.HealthChecker. It checks that the message
+// store is accessible.
+func (q *Queue) CheckHealth(ctx context.Context) error {
+	if err := q.store.CheckHealth(ctx); err != nil {
+		return fmt.Errorf("%s: store: %w", q.name, err)
 	}
+	return nil
 }
 
 func (q *Queue) dispatch(value TimeSlot) {
@@ -286,26 +479,65 @@ func (q *Queue) dispatch(value TimeSlot) {
 
 	q.Log.Debugln("starting delivery for", slot.ID)
 
+	q.deliveringLock.Lock()
+	q.delivering[slot.ID] = struct{}{}
+	q.deliveringLock.Unlock()
+
 	q.deliveryWg.Add(1)
 	go func() {
 		q.Log.Debugln("waiting on delivery semaphore for", slot.ID)
-		q.deliverySemaphore <- struct{}{}
+		q.deliverySemaphore.Acquire(slot.Priority)
+		globalAcquired := false
 		defer func() {
-			<-q.deliverySemaphore
+			if globalAcquired {
+				q.globalSemaphore.Release(slot.Priority)
+			}
+			q.deliverySemaphore.Release(slot.Priority)
 			q.deliveryWg.Done()
 
+			q.deliveringLock.Lock()
+			delete(q.delivering, slot.ID)
+			q.deliveringLock.Unlock()
+
 			if dontRecover {
 				return
 			}
 
 			if err := recover(); err != nil {
-				stack := debug.Stack()
-				log.Printf("panic during queue dispatch %s: %v\n%s", slot.ID, err, stack)
-				q.discardBroken(slot.ID)
+				panics.Report(q.Log, "queue dispatch", err, debug.Stack(), "msg_id", slot.ID)
+				q.store.MarkBroken(slot.ID)
 			}
 		}()
 
 		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
+		if q.dispatchLimiter != nil {
+			if err := q.dispatchLimiter.Wait(q.dispatchCtx); err != nil {
+				return
+			}
+		}
+		if q.globalSemaphore != nil {
+			q.globalSemaphore.Acquire(slot.Priority)
+			globalAcquired = true
+		}
+		if q.shared != nil {
+			locked, err := q.shared.Lock(slot.ID)
+			if err != nil {
+				// Message will be scheduled again by pollShared.
+				q.Log.Error("failed to lock message", err, "msg_id", slot.ID)
+				return
+			}
+			if !locked {
+				q.Log.Debugln("message is handled by another instance or removed", slot.ID)
+				return
+			}
+			defer q.shared.Unlock(slot.ID)
+			defer q.keepLease(slot.ID)()
+
+			// Another instance could have updated the message since it was
+			// scheduled.
+			slot.Meta = nil
+		}
+
 		var (
 			meta *QueueMetadata
 			hdr  textproto.Header
@@ -313,7 +545,7 @@ func (q *Queue) dispatch(value TimeSlot) {
 		)
 		if slot.Meta == nil {
 			var err error
-			meta, hdr, body, err = q.openMessage(slot.ID)
+			meta, hdr, body, err = q.store.Open(slot.ID)
 			if err != nil {
 				q.Log.Error("read message", err, slot.ID)
 				return
@@ -321,6 +553,15 @@ func (q *Queue) dispatch(value TimeSlot) {
 			if meta == nil {
 				panic("wtf")
 			}
+
+			// Attempt was made by another instance after the message was
+			// scheduled, follow the updated schedule. Forced attempts
+			// (zero time) are done anyway.
+			if q.shared != nil && !value.Time.IsZero() && meta.LastAttempt.After(slot.LastAttempt) {
+				q.Log.Debugln("message was attempted by another instance, rescheduling", slot.ID)
+				q.scheduleStored(meta, 0)
+				return
+			}
 		} else {
 			meta = slot.Meta
 			hdr = *slot.Hdr
@@ -352,9 +593,11 @@ func toSMTPErr(err error) *smtp.SMTPError {
 	if ok {
 		res.Code = ctxCode
 	}
-	ctxEnchCode, ok := ctxInfo["smtp_enchcode"].(smtp.EnhancedCode)
-	if ok {
+	switch ctxEnchCode := ctxInfo["smtp_enchcode"].(type) {
+	case smtp.EnhancedCode:
 		res.EnhancedCode = ctxEnchCode
+	case exterrors.EnhancedCode:
+		res.EnhancedCode = smtp.EnhancedCode(ctxEnchCode)
 	}
 	ctxMsg, ok := ctxInfo["smtp_msg"].(string)
 	if ok {
@@ -371,15 +614,55 @@ func toSMTPErr(err error) *smtp.SMTPError {
 	return res
 }
 
+var errHeldExpired = &exterrors.SMTPError{
+	Code:         554,
+	EnhancedCode: exterrors.EnhancedCode{5, 4, 7},
+	Message:      "Message lifetime exceeded while delivery was postponed by pacing policy",
+}
+
+// expireHeld splits recipients held by pacing into the ones that can be
+// held further and the ones that exceeded max_lifetime. RcptErrs is updated
+// for the latter.
+func (q *Queue) expireHeld(meta *QueueMetadata, heldRcpts []string) (held, expired []string) {
+	for _, rcpt := range heldRcpts {
+		sched := q.rcptSchedule(rcpt, meta.RcptErrs[rcpt])
+		if sched.MaxLifetime == 0 || time.Since(meta.FirstAttempt) < sched.MaxLifetime {
+			held = append(held, rcpt)
+			continue
+		}
+		if meta.RcptErrs[rcpt] == nil {
+			meta.RcptErrs[rcpt] = toSMTPErr(errHeldExpired)
+		}
+		expired = append(expired, rcpt)
+	}
+	return held, expired
+}
+
 func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 
-	partialErr := q.deliver(meta, header, body)
-	dl.Debugf("errors: %v", partialErr.Errs)
+	// Recipients held by pacing are not attempted and their attempt counters
+	// are left intact.
+	allowedRcpts, heldRcpts, heldUntil := q.pacing.split(meta.To, time.Now())
+	heldRcpts, expiredRcpts := q.expireHeld(meta, heldRcpts)
+	if len(heldRcpts) != 0 {
+		dl.Msg("delivery postponed by pacing policy", "rcpts", heldRcpts, "until", heldUntil)
+	}
+	if len(allowedRcpts) == 0 && len(expiredRcpts) == 0 {
+		q.wheel.Add(heldUntil, queueSlot{
+			ID:          meta.MsgMeta.ID,
+			Priority:    meta.Priority,
+			LastAttempt: meta.LastAttempt,
+		})
+		return
+	}
+	meta.To = allowedRcpts
 
-	// While iterating the list of recipients we also pick the smallest tries count
-	// and use it to calculate the delay for the next attempt.
-	smallestTriesCount := 999999
+	partialErr := partialError{Errs: map[string]error{}}
+	if len(allowedRcpts) != 0 {
+		partialErr = q.deliver(meta, header, body)
+		dl.Debugf("errors: %v", partialErr.Errs)
+	}
 
 	if meta.TriesCount == nil {
 		meta.TriesCount = make(map[string]int)
@@ -389,11 +672,26 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	// Split list into two parts: recipients that should be retried (newRcpts)
 	// and recipients DSN will be generated for.
 	newRcpts := make([]string, 0, len(partialErr.Errs))
-	failedRcpts := make([]string, 0, len(partialErr.Errs))
+	failedRcpts := make([]string, 0, len(partialErr.Errs)+len(expiredRcpts))
+	var deliveredRcpts []string
+	attempts := make(map[string]int, len(meta.To)+len(expiredRcpts))
+	for _, rcpt := range expiredRcpts {
+		attempts[rcpt] = meta.TriesCount[rcpt]
+		delete(meta.TriesCount, rcpt)
+		dl.Msg("not delivered, lifetime exceeded while held by pacing policy", "rcpt", rcpt)
+		q.recordHistory(meta, history.Failed, rcpt, attempts[rcpt], errHeldExpired)
+		failedRcpts = append(failedRcpts, rcpt)
+	}
 	for _, rcpt := range meta.To {
+		attempts[rcpt] = meta.TriesCount[rcpt] + 1
 		rcptErr, ok := partialErr.Errs[rcpt]
+		domain := metricsDomain(rcpt)
 		if !ok {
 			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
+			deliveryAttempts.WithLabelValues(q.name, q.location, domain, "delivered").Inc()
+			deliveryLatency.WithLabelValues(q.name, q.location, domain).Observe(time.Since(meta.FirstAttempt).Seconds())
+			q.recordHistory(meta, history.Delivered, rcpt, attempts[rcpt], nil)
+			deliveredRcpts = append(deliveredRcpts, rcpt)
 			continue
 		}
 
@@ -402,53 +700,81 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
-		if !temporary || meta.TriesCount[rcpt]+1 >= q.maxTries {
+		sched := q.rcptSchedule(rcpt, meta.RcptErrs[rcpt])
+		expired := sched.MaxLifetime != 0 && time.Since(meta.FirstAttempt) >= sched.MaxLifetime
+		if !temporary || meta.TriesCount[rcpt]+1 >= sched.MaxTries || expired {
 			delete(meta.TriesCount, rcpt)
-			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
+			dl.Msg("not delivered, permanent error", "rcpt", rcpt, "lifetime_exceeded", expired)
+			deliveryAttempts.WithLabelValues(q.name, q.location, domain, "failed").Inc()
+			q.recordHistory(meta, history.Failed, rcpt, attempts[rcpt], rcptErr)
 			failedRcpts = append(failedRcpts, rcpt)
 			continue
 		}
 
 		// Temporary error, increase tries counter and requeue.
+		deliveryAttempts.WithLabelValues(q.name, q.location, domain, "deferred").Inc()
+		q.recordHistory(meta, history.Deferred, rcpt, attempts[rcpt], rcptErr)
 		meta.TriesCount[rcpt]++
 		newRcpts = append(newRcpts, rcpt)
+	}
 
-		// See smallestTriesCount comment.
-		if count := meta.TriesCount[rcpt]; count < smallestTriesCount {
-			smallestTriesCount = count
-		}
+	if len(deliveredRcpts) != 0 {
+		q.webhook.emit(q.webhookEvent(eventDelivered, meta, deliveredRcpts, attempts))
 	}
 
 	// Generate DSN for recipients that failed permanently this time.
 	if len(failedRcpts) != 0 {
-		q.emitDSN(meta, header, failedRcpts)
+		q.webhook.emit(q.webhookEvent(eventBounced, meta, failedRcpts, attempts))
+		if q.deadLetterDir != "" {
+			q.storeDeadLetter(meta, header, body, failedRcpts)
+		}
+		if !q.skipSpamDSN(meta, header) {
+			q.emitDSN(meta, header, failedRcpts, dsn.ActionFailed)
+		}
 	}
 	// No recipients to try, either all failed or all succeeded.
-	if len(newRcpts) == 0 {
-		q.removeFromDisk(meta.MsgMeta)
+	if len(newRcpts) == 0 && len(heldRcpts) == 0 {
+		q.store.Remove(meta.MsgMeta)
 		return
 	}
 
 	meta.To = newRcpts
 	meta.LastAttempt = time.Now()
 
-	if err := q.updateMetadataOnDisk(meta); err != nil {
+	// Recipients held by pacing policy were not attempted, so they are not
+	// reported as delayed.
+	if len(newRcpts) != 0 && q.delayNotificationDue(meta) && !q.skipSpamDSN(meta, header) {
+		q.emitDSN(meta, header, newRcpts, dsn.ActionDelayed)
+	}
+
+	// The smallest delay among all recipients is used, see nextRetryDelay.
+	var nextTryTime time.Time
+	if len(newRcpts) != 0 {
+		nextTryTime = time.Now().Add(q.nextRetryDelay(meta))
+	}
+	if len(heldRcpts) != 0 {
+		if nextTryTime.IsZero() || heldUntil.Before(nextTryTime) {
+			nextTryTime = heldUntil
+		}
+		meta.To = append(meta.To, heldRcpts...)
+	}
+
+	if err := q.store.UpdateMeta(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
 
-	nextTryTime := time.Now()
-	// Delay between retries grows exponentally, the formula is:
-	// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
-	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
-	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
 		"rcpts", meta.To)
+	deferred := q.webhookEvent(eventDeferred, meta, meta.To, attempts)
+	deferred.NextAttempt = &nextTryTime
+	q.webhook.emit(deferred)
 
 	q.wheel.Add(nextTryTime, queueSlot{
-		ID: meta.MsgMeta.ID,
+		ID:          meta.MsgMeta.ID,
+		Priority:    meta.Priority,
+		LastAttempt: meta.LastAttempt,
 
 		// Do not keep (meta-)data in memory to reduce usage.  At this point,
 		// it is safe on disk and next try will reread it.
@@ -458,6 +784,35 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	})
 }
 
+// recordHistory adds the result of the delivery attempt for the recipient
+// to the delivery history.
+func (q *Queue) recordHistory(meta *QueueMetadata, kind, rcpt string, attempt int, rcptErr error) {
+	if !history.Enabled() {
+		return
+	}
+
+	// Use the same sender as recorded when the message was received.
+	sender := meta.MsgMeta.OriginalFrom
+	if sender == "" {
+		sender = meta.From
+	}
+	details := fmt.Sprintf("attempt %d", attempt)
+	if rcptErr != nil {
+		if smtpErr := meta.RcptErrs[rcpt]; smtpErr != nil {
+			rcptErr = smtpErr
+		}
+		details += ": " + history.FormatErr(rcptErr)
+	}
+	history.Record(history.Event{
+		MsgID:   meta.MsgMeta.ID,
+		Kind:    kind,
+		Module:  q.name,
+		Sender:  sender,
+		Rcpt:    rcpt,
+		Details: details,
+	})
+}
+
 func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) partialError {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 	perr := partialError{
@@ -471,9 +826,21 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "Queue delivery")
 	defer msgTask.End()
+	msgCtx, msgSpan := tracing.StartMsg(msgCtx, "queue.deliver", msgMeta,
+		attribute.String("maddy.queue", q.name),
+		attribute.Int("maddy.rcpt_count", len(meta.To)))
+	defer func() {
+		msgSpan.SetAttributes(attribute.Int("maddy.failed_rcpt_count", len(perr.Errs)))
+		if len(perr.Errs) != 0 {
+			tracing.SetError(msgSpan, perr)
+		}
+		msgSpan.End()
+	}()
 
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
+	mailCtx, mailSpan := tracing.Start(mailCtx, "queue.mail")
 	delivery, err := q.Target.Start(mailCtx, msgMeta, meta.From)
+	tracing.End(mailSpan, err)
 	mailTask.End()
 	if err != nil {
 		dl.Debugf("target.Start failed: %v", err)
@@ -487,7 +854,10 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	var acceptedRcpts []string
 	for _, rcpt := range meta.To {
 		rcptCtx, rcptTask := trace.NewTask(msgCtx, "RCPT TO")
-		if err := delivery.AddRcpt(rcptCtx, rcpt, smtp.RcptOptions{} /* TODO: DSN support */); err != nil {
+		rcptCtx, rcptSpan := tracing.Start(rcptCtx, "queue.rcpt", attribute.String("maddy.rcpt", rcpt))
+		err := delivery.AddRcpt(rcptCtx, rcpt, smtp.RcptOptions{} /* TODO: DSN support */)
+		tracing.End(rcptSpan, err)
+		if err != nil {
 			dl.Debugf("delivery.AddRcpt %s failed: %v", rcpt, err)
 			perr.Errs[rcpt] = err
 		} else {
@@ -513,6 +883,8 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 
 	bodyCtx, bodyTask := trace.NewTask(msgCtx, "DATA")
 	defer bodyTask.End()
+	bodyCtx, bodySpan := tracing.Start(bodyCtx, "queue.data")
+	defer bodySpan.End()
 
 	partDelivery, ok := delivery.(module.PartialDelivery)
 	if ok {
@@ -566,9 +938,12 @@ func (qd *queueDelivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.Rcpt
 func (qd *queueDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "queue/Body").End()
 
+	qd.meta.Priority = qd.q.messagePriority(ctx, qd.meta, header)
+	qd.q.quarantine(qd.meta)
+
 	// Body buffer initially passed to us may not be valid after "delivery" to queue completes.
-	// storeNewMessage returns a new buffer object created from message blob stored on disk.
-	storedBody, err := qd.q.storeNewMessage(qd.meta, header, body)
+	// Store returns a new buffer object created from message blob stored on disk.
+	storedBody, err := qd.q.store.Store(qd.meta, header, body)
 	if err != nil {
 		return err
 	}
@@ -582,7 +957,7 @@ func (qd *queueDelivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "queue/Abort").End()
 
 	if qd.body != nil {
-		qd.q.removeFromDisk(qd.meta.MsgMeta)
+		qd.q.store.Remove(qd.meta.MsgMeta)
 	}
 	return nil
 }
@@ -594,11 +969,23 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
+	qd.q.webhook.emit(qd.q.webhookEvent(eventQueued, qd.meta, qd.meta.To, nil))
+
+	if qd.meta.Quarantined {
+		dl := target.DeliveryLogger(qd.q.Log, qd.meta.MsgMeta)
+		dl.Msg("message quarantined, holding until released", "rcpts", qd.meta.To)
+		go qd.q.runQuarantineHook(qd.meta)
+		qd.meta = nil
+		qd.body = nil
+		return nil
+	}
+
 	qd.q.wheel.Add(time.Time{}, queueSlot{
-		ID:   qd.meta.MsgMeta.ID,
-		Meta: qd.meta,
-		Hdr:  &qd.header,
-		Body: qd.body,
+		ID:       qd.meta.MsgMeta.ID,
+		Priority: qd.meta.Priority,
+		Meta:     qd.meta,
+		Hdr:      &qd.header,
+		Body:     qd.body,
 	})
 	qd.meta = nil
 	qd.body = nil
@@ -606,6 +993,10 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 }
 
 func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	if err := q.checkDepth(); err != nil {
+		return nil, err
+	}
+
 	meta := &QueueMetadata{
 		MsgMeta:      msgMeta,
 		From:         mailFrom,
@@ -616,216 +1007,112 @@ func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom
 	return &queueDelivery{q: q, meta: meta}, nil
 }
 
-func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
-	id := msgMeta.ID
-	dl := target.DeliveryLogger(q.Log, msgMeta)
-
-	// Order is important.
-	// If we remove header and body but can't remove meta now - readDiskQueue
-	// will detect and report it.
-	headerPath := filepath.Join(q.location, id+".header")
-	if err := os.Remove(headerPath); err != nil {
-		dl.Error("failed to remove header from disk", err)
-	}
-	bodyPath := filepath.Join(q.location, id+".body")
-	if err := os.Remove(bodyPath); err != nil {
-		dl.Error("failed to remove body from disk", err)
-	}
-	metaPath := filepath.Join(q.location, id+".meta")
-	if err := os.Remove(metaPath); err != nil {
-		dl.Error("failed to remove meta-data from disk", err)
-	}
-	dl.Debugf("removed message from disk")
-}
-
 func (q *Queue) readDiskQueue() error {
-	dirInfo, err := os.ReadDir(q.location)
+	metas, err := q.store.Load()
 	if err != nil {
 		return err
 	}
 
-	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
-
-	loadedCount := 0
-	for _, entry := range dirInfo {
-		// We start loading from meta-data files and then check whether ID.header and ID.body exist.
-		// This allows us to properly detect dangling body files.
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
-			continue
-		}
-		id := entry.Name()[:len(entry.Name())-5]
-
-		meta, err := q.readMessageMeta(id)
-		if err != nil {
-			q.Log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
-			continue
-		}
-
-		// Check header file existence.
-		if _, err := os.Stat(filepath.Join(q.location, id+".header")); err != nil {
-			if os.IsNotExist(err) {
-				q.Log.Printf("header file doesn't exist for msg ID = %s", id)
-				q.tryRemoveDanglingFile(id + ".meta")
-				q.tryRemoveDanglingFile(id + ".body")
-			} else {
-				q.Log.Printf("skipping nonstat'able header file: %v (msg ID = %s)", err, id)
-			}
-			continue
-		}
-
-		// Check body file existence.
-		if _, err := os.Stat(filepath.Join(q.location, id+".body")); err != nil {
-			if os.IsNotExist(err) {
-				q.Log.Printf("body file doesn't exist for msg ID = %s", id)
-				q.tryRemoveDanglingFile(id + ".meta")
-				q.tryRemoveDanglingFile(id + ".header")
-			} else {
-				q.Log.Printf("skipping nonstat'able body file: %v (msg ID = %s)", err, id)
-			}
-			continue
-		}
-
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
-			}
-		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
-
-		if time.Until(nextTryTime) < q.postInitDelay {
-			nextTryTime = time.Now().Add(q.postInitDelay)
-		}
-
-		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
-		q.wheel.Add(nextTryTime, queueSlot{
-			ID: id,
-		})
-		loadedCount++
+	for _, meta := range metas {
+		q.scheduleStored(meta, q.postInitDelay)
 	}
 
-	if loadedCount != 0 {
-		q.Log.Printf("loaded %d saved queue entries", loadedCount)
+	if len(metas) != 0 {
+		q.Log.Printf("loaded %d saved queue entries", len(metas))
 	}
 
 	return nil
 }
 
-func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
-	id := meta.MsgMeta.ID
-
-	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Create(headerPath)
-	if err != nil {
-		return nil, err
-	}
-	defer headerFile.Close()
-
-	if err := textproto.WriteHeader(headerFile, header); err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	bodyReader, err := body.Open()
-	if err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-	defer bodyReader.Close()
-
-	bodyPath := filepath.Join(q.location, id+".body")
-	bodyFile, err := os.Create(bodyPath)
-	if err != nil {
-		return nil, err
-	}
-	defer bodyFile.Close()
-
-	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := q.updateMetadataOnDisk(meta); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := headerFile.Sync(); err != nil {
-		return nil, err
+// scheduleStored schedules the next delivery attempt for the message loaded
+// from the store, attempt is delayed by at least minDelay.
+func (q *Queue) scheduleStored(meta *QueueMetadata, minDelay time.Duration) {
+	if meta.Quarantined {
+		return
 	}
+	id := meta.MsgMeta.ID
+	nextTryTime := meta.LastAttempt.Add(q.nextRetryDelay(meta))
 
-	if err := bodyFile.Sync(); err != nil {
-		return nil, err
+	if time.Until(nextTryTime) < minDelay {
+		nextTryTime = time.Now().Add(minDelay)
 	}
 
-	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
+	q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
+	q.wheel.Add(nextTryTime, queueSlot{
+		ID:          id,
+		Priority:    meta.Priority,
+		LastAttempt: meta.LastAttempt,
+	})
 }
 
-func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
-	metaPath := filepath.Join(q.location, meta.MsgMeta.ID+".meta")
-
-	var file *os.File
-	var err error
-	if runtime.GOOS == "windows" {
-		file, err = os.Create(metaPath)
-		if err != nil {
-			return err
+// pollShared periodically schedules messages that were accepted or
+// rescheduled by other instances using the shared store.
+func (q *Queue) pollShared(interval time.Duration) {
+	defer close(q.pollDone)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.pollStop:
+			return
+		case <-t.C:
 		}
-	} else {
-		file, err = os.Create(metaPath + ".new")
+
+		metas, err := q.shared.Load()
 		if err != nil {
-			return err
+			q.Log.Error("failed to read shared queue", err)
+			continue
 		}
-	}
-	defer file.Close()
-
-	metaCopy := *meta
-	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
-	metaCopy.MsgMeta.Conn = nil
-
-	if err := json.NewEncoder(file).Encode(metaCopy); err != nil {
-		return err
-	}
-
-	if err := file.Sync(); err != nil {
-		return err
-	}
 
-	if runtime.GOOS != "windows" {
-		if err := os.Rename(metaPath+".new", metaPath); err != nil {
-			return err
+		scheduled := q.scheduled()
+		added := 0
+		for _, meta := range metas {
+			id := meta.MsgMeta.ID
+			if _, ok := scheduled[id]; ok || q.isDelivering(id) {
+				continue
+			}
+			q.scheduleStored(meta, 0)
+			added++
+		}
+		if added != 0 {
+			q.Log.Debugf("scheduled %d messages from shared queue", added)
 		}
 	}
-
-	return nil
 }
 
-func (q *Queue) readMessageMeta(id string) (*QueueMetadata, error) {
-	metaPath := filepath.Join(q.location, id+".meta")
-	file, err := os.Open(metaPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	meta := &QueueMetadata{}
-
-	meta.MsgMeta = &module.MsgMetadata{}
+// keepLease periodically renews the lock on the message taken for the
+// delivery attempt until the returned function is called.
+func (q *Queue) keepLease(id string) (stop func()) {
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
 
-	// There is a couple of problems we have to solve before we would be able to
-	// serialize ConnState.
-	// 1. future.Future can't be serialized.
-	// 2. net.Addr can't be deserialized because we don't know the concrete type.
+		t := time.NewTicker(q.shared.LeaseTime() / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-t.C:
+			}
 
-	if err := json.NewDecoder(file).Decode(meta); err != nil {
-		return nil, err
+			renewed, err := q.shared.Renew(id)
+			if err != nil {
+				q.Log.Error("failed to renew message lease", err, "msg_id", id)
+				continue
+			}
+			if !renewed {
+				q.Log.Msg("message lease lost, it may be delivered by another instance", "msg_id", id)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-done
 	}
-
-	return meta, nil
 }
 
 type BufferedReadCloser struct {
@@ -833,65 +1120,92 @@ type BufferedReadCloser struct {
 	io.Closer
 }
 
-func (q *Queue) tryRemoveDanglingFile(name string) {
-	if err := os.Remove(filepath.Join(q.location, name)); err != nil {
-		q.Log.Error("dangling file remove failed", err)
-		return
-	}
-	q.Log.Printf("removed dangling file %s", name)
+func (q *Queue) InstanceName() string {
+	return q.name
 }
 
-func (q *Queue) openMessage(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
-	meta, err := q.readMessageMeta(id)
-	if err != nil {
-		return nil, textproto.Header{}, nil, err
-	}
+func (q *Queue) Name() string {
+	return "queue"
+}
 
-	bodyPath := filepath.Join(q.location, id+".body")
-	_, err = os.Stat(bodyPath)
+func parseDSNTemplates(m *config.Map, node config.Node) (interface{}, error) {
+	var (
+		defaultLang string
+		contact     string
+	)
+	child := config.NewMap(m.Globals, node)
+	child.String("default_language", false, false, "en", &defaultLang)
+	child.String("contact", false, false, "", &contact)
+	child.AllowUnknown()
+	unknown, err := child.Process()
 	if err != nil {
-		if os.IsNotExist(err) {
-			q.tryRemoveDanglingFile(id + ".meta")
-		}
-		return nil, textproto.Header{}, nil, err
+		return nil, err
 	}
-	body := buffer.FileBuffer{Path: bodyPath}
 
-	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Open(headerPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			q.tryRemoveDanglingFile(id + ".meta")
-			q.tryRemoveDanglingFile(id + ".body")
+	files := make(map[string]string, len(unknown))
+	for _, n := range unknown {
+		if n.Name != "template" {
+			return nil, config.NodeErr(n, "unknown directive: %s", n.Name)
 		}
-		return nil, textproto.Header{}, nil, err
+		if len(n.Args) != 2 {
+			return nil, config.NodeErr(n, "expected two arguments: language and file path")
+		}
+		files[n.Args[0]] = n.Args[1]
 	}
 
-	bufferedHeader := bufio.NewReader(headerFile)
-	header, err := textproto.ReadHeader(bufferedHeader)
+	tmpls, err := dsn.NewTemplates(defaultLang, contact, files)
 	if err != nil {
-		return nil, textproto.Header{}, nil, err
+		return nil, config.NodeErr(node, "%v", err)
 	}
-
-	return meta, header, body, nil
+	return tmpls, nil
 }
 
-func (q *Queue) InstanceName() string {
-	return q.name
+func parseDelayNotify(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one duration is required")
+	}
+	res := make([]time.Duration, 0, len(node.Args))
+	for _, arg := range node.Args {
+		dur, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		if dur <= 0 {
+			return nil, config.NodeErr(node, "duration must be positive")
+		}
+		if len(res) != 0 && dur <= res[len(res)-1] {
+			return nil, config.NodeErr(node, "durations must be in ascending order")
+		}
+		res = append(res, dur)
+	}
+	return res, nil
 }
 
-func (q *Queue) Name() string {
-	return "queue"
+// delayNotificationDue reports whether the "delayed" DSN should be sent for
+// the message and marks it as sent. If multiple thresholds passed since the
+// last attempt, only one DSN is sent.
+func (q *Queue) delayNotificationDue(meta *QueueMetadata) bool {
+	due := false
+	age := time.Since(meta.FirstAttempt)
+	for meta.DelayNotified < len(q.delayNotify) && age >= q.delayNotify[meta.DelayNotified] {
+		meta.DelayNotified++
+		due = true
+	}
+	return due
 }
 
-func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
+// emitDSN sends the DSN about rcpts to the message sender. action should be
+// either dsn.ActionFailed or dsn.ActionDelayed.
+func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, rcpts []string, action dsn.Action) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
 		return
 	}
 
-	// Null return-path, used in DSNs.
-	if meta.MsgMeta.OriginalFrom == "" {
+	// Never bounce bounces, this may cause loops.
+	if reason := dsnSuppressReason(meta, header); reason != "" {
+		dsnSuppressed.WithLabelValues(q.name, q.location, reason).Inc()
+		target.DeliveryLogger(q.Log, meta.MsgMeta).Msg("not generating DSN", "reason", reason)
 		return
 	}
 
@@ -910,6 +1224,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		ReportingMTA:    q.hostname,
 		XSender:         meta.From,
 		XMessageID:      meta.MsgMeta.ID,
+		XTraceID:        meta.MsgMeta.TraceID,
 		ArrivalDate:     meta.FirstAttempt,
 		LastAttemptDate: meta.LastAttempt,
 	}
@@ -918,7 +1233,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 	}
 
 	rcptInfo := make([]dsn.RecipientInfo, 0, len(meta.RcptErrs))
-	for _, rcpt := range failedRcpts {
+	for _, rcpt := range rcpts {
 		rcptErr := meta.RcptErrs[rcpt]
 		// rcptErr is stored in RcptErrs using the effective recipient address,
 		// not the original one.
@@ -930,7 +1245,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 
 		rcptInfo = append(rcptInfo, dsn.RecipientInfo{
 			FinalRecipient: rcpt,
-			Action:         dsn.ActionFailed,
+			Action:         action,
 			Status:         rcptErr.EnhancedCode,
 			DiagnosticCode: rcptErr,
 		})
@@ -938,21 +1253,28 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 
 	var dsnBodyBlob bytes.Buffer
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
-	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
+	dsnHeader, err := dsn.GenerateDSN(q.dsnTemplates, meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
 	if err != nil {
-		dl.Error("failed to generate fail DSN", err)
+		dl.Error("failed to generate DSN", err, "action", action)
 		return
 	}
 	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
 
+	// DSN shares the trace ID with the original message so it shows up
+	// in the message lifecycle.
 	dsnMeta := &module.MsgMetadata{
-		ID: dsnID,
+		ID:      dsnID,
+		TraceID: meta.MsgMeta.TraceID,
 		SMTPOpts: smtp.MailOptions{
 			UTF8:       meta.MsgMeta.SMTPOpts.UTF8,
 			RequireTLS: meta.MsgMeta.SMTPOpts.RequireTLS,
 		},
 	}
-	dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	if action == dsn.ActionDelayed {
+		dl.Msg("generated delay DSN", "dsn_id", dsnID)
+	} else {
+		dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	}
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
 	defer msgTask.End()
@@ -665,6 +665,196 @@ func TestQueueDSN(t *testing.T) {
 	}
 }
 
+func TestQueueDSN_TraceID(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		TraceID:      "0123456789abcdef",
+	})
+
+	msg := readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	if msg.MsgMeta.TraceID != "0123456789abcdef" {
+		t.Fatalf("trace ID is not preserved by the queue: %q", msg.MsgMeta.TraceID)
+	}
+
+	msg = readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if msg.MsgMeta.TraceID != "0123456789abcdef" {
+		t.Fatalf("DSN has wrong trace ID: %q", msg.MsgMeta.TraceID)
+	}
+	if !strings.Contains(string(msg.Body), "X-Maddy-Traceid: 0123456789abcdef") {
+		t.Fatalf("trace ID is missing in the DSN report:\n%s", msg.Body)
+	}
+}
+
+func TestQueueDSN_Delayed(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	tempErr := exterrors.WithTemporary(errors.New("go away"), true)
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester1@example.org": tempErr},
+			{"tester1@example.org": tempErr},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.delayNotify = []time.Duration{time.Nanosecond, time.Hour}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	testutils.CheckMsgID(t, readMsgChanTimeout(t, dt.committed, 5*time.Second), "tester@example.com", []string{"tester1@example.org"}, "")
+
+	// Only one delay DSN is sent for the first threshold.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+	if !bytes.Contains(msg.Body, []byte("Action: delayed")) {
+		t.Fatalf("Not a delay DSN:\n%s", msg.Body)
+	}
+	select {
+	case msg := <-dsnTarget.committed:
+		t.Fatalf("Unexpected DSN: %s", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQueueDSN_DelayedHeldRcpt(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	tempErr := exterrors.WithTemporary(errors.New("go away"), true)
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester2@example.org": tempErr},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.delayNotify = []time.Duration{time.Nanosecond, time.Hour}
+
+	// Window that does not include the current time, so all recipients at
+	// example.net are held.
+	now := time.Now().UTC()
+	minute := now.Hour()*60 + now.Minute()
+	q.pacing = &pacing{domains: map[string]*pacingPolicy{
+		"example.net": {
+			loc:     time.UTC,
+			windows: []timeWindow{{start: (minute + 120) % 1440, end: (minute + 180) % 1440}},
+		},
+	}}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.net", "tester2@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	testutils.CheckMsgID(t, readMsgChanTimeout(t, dt.committed, 5*time.Second), "tester@example.com", []string{"tester2@example.org"}, "")
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("Action: delayed")) {
+		t.Fatalf("Not a delay DSN:\n%s", msg.Body)
+	}
+	if !bytes.Contains(msg.Body, []byte("tester2@example.org")) {
+		t.Fatalf("Delayed recipient is missing in DSN:\n%s", msg.Body)
+	}
+	if bytes.Contains(msg.Body, []byte("tester1@example.net")) {
+		t.Fatalf("Held recipient is included in DSN:\n%s", msg.Body)
+	}
+	select {
+	case msg := <-dsnTarget.committed:
+		t.Fatalf("Unexpected DSN: %s", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQueueDSN_HeldRcptExpired(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxLifetime = time.Nanosecond
+
+	now := time.Now().UTC()
+	minute := now.Hour()*60 + now.Minute()
+	q.pacing = &pacing{domains: map[string]*pacingPolicy{
+		"example.net": {
+			loc:     time.UTC,
+			windows: []timeWindow{{start: (minute + 120) % 1440, end: (minute + 180) % 1440}},
+		},
+	}}
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.net", "tester2@example.org"})
+
+	testutils.CheckMsgID(t, readMsgChanTimeout(t, dt.committed, 5*time.Second), "tester@example.com", []string{"tester2@example.org"}, "")
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("Action: failed")) {
+		t.Fatalf("Not a failure DSN:\n%s", msg.Body)
+	}
+	if !bytes.Contains(msg.Body, []byte("tester1@example.net")) {
+		t.Fatalf("Expired recipient is missing in DSN:\n%s", msg.Body)
+	}
+
+	for i := 0; q.hasMessage(id); i++ {
+		if i == 500 {
+			t.Fatal("Message is not removed from the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestQueueDSN_FromEmptyAddr(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,150 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const releaseModName = "target.quarantine_release"
+
+// ReleaseTarget is the delivery target that releases quarantined messages
+// using release codes found in the subject of delivered messages.
+type ReleaseTarget struct {
+	instName string
+	log      log.Logger
+}
+
+func NewReleaseTarget(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", releaseModName)
+	}
+	return &ReleaseTarget{
+		instName: instName,
+		log:      log.Logger{Name: releaseModName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (rt *ReleaseTarget) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &rt.log.Debug)
+	_, err := cfg.Process()
+	return err
+}
+
+func (rt *ReleaseTarget) Name() string {
+	return releaseModName
+}
+
+func (rt *ReleaseTarget) InstanceName() string {
+	return rt.instName
+}
+
+type releaseDelivery struct {
+	rt  *ReleaseTarget
+	log log.Logger
+}
+
+func (rt *ReleaseTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &releaseDelivery{
+		rt:  rt,
+		log: target.DeliveryLogger(rt.log, msgMeta),
+	}, nil
+}
+
+func (rd *releaseDelivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	return nil
+}
+
+func (rd *releaseDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	subject := decodeHeader(header.Get("Subject"))
+
+	var (
+		found    bool
+		released int
+		lastErr  error
+	)
+	for _, word := range strings.Fields(subject) {
+		if !strings.Contains(word, ".") {
+			continue
+		}
+		if _, err := parseReleaseCode(word); err != nil {
+			continue
+		}
+		found = true
+
+		queue, id, rcpt, err := ReleaseByCode(word)
+		if err != nil {
+			rd.log.Error("release failed", err, "queue", queue, "quarantined_msg_id", id, "rcpt", rcpt)
+			lastErr = err
+			continue
+		}
+		rd.log.Msg("message released", "queue", queue, "quarantined_msg_id", id, "rcpt", rcpt)
+		released++
+	}
+
+	if !found {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "No release code found in the subject",
+			TargetName:   releaseModName,
+		}
+	}
+	if released == 0 {
+		msg := "Invalid release code"
+		switch {
+		case errors.Is(lastErr, ErrExpiredReleaseCode):
+			msg = "Release code expired"
+		case errors.Is(lastErr, ErrUnknownMessage), errors.Is(lastErr, ErrNotQuarantined):
+			msg = "Message is already released or removed"
+		}
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      msg,
+			TargetName:   releaseModName,
+			Err:          lastErr,
+		}
+	}
+	return nil
+}
+
+func (rd *releaseDelivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (rd *releaseDelivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+func init() {
+	module.Register(releaseModName, NewReleaseTarget)
+}
@@ -0,0 +1,261 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// retrySchedule describes how delivery to a recipient is retried.
+//
+// Zero values mean that the value is inherited from the enclosing schedule.
+type retrySchedule struct {
+	// Delays between attempts. The last one is used for all further attempts.
+	// If empty, the exponential backoff is used (see Queue.initialRetryTime).
+	Intervals []time.Duration
+
+	MaxTries int
+
+	// Max. time since the first delivery attempt after which the recipient is
+	// considered permanently failed.
+	MaxLifetime time.Duration
+
+	// Used instead of the schedule itself if the last error belongs to the
+	// class, see deferralClass.
+	Classes map[string]*retrySchedule
+}
+
+// Classes of temporary errors with separate retry schedules.
+const (
+	deferralGreylisting = "greylisting"
+	deferralRateLimited = "rate_limited"
+	deferralMailboxFull = "mailbox_full"
+)
+
+var deferralClasses = []string{deferralGreylisting, deferralRateLimited, deferralMailboxFull}
+
+// defaultClasses are used unless overridden by retry_schedule.
+//
+// Greylisting implementations usually accept the message after a few minutes,
+// there is no point in waiting for the generic backoff.
+var defaultClasses = map[string]*retrySchedule{
+	deferralGreylisting: {
+		Intervals: []time.Duration{5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour},
+	},
+}
+
+// override returns the copy of s with non-zero values from other applied.
+func (s retrySchedule) override(other *retrySchedule) retrySchedule {
+	if other == nil {
+		return s
+	}
+	if len(other.Intervals) != 0 {
+		s.Intervals = other.Intervals
+	}
+	if other.MaxTries != 0 {
+		s.MaxTries = other.MaxTries
+	}
+	if other.MaxLifetime != 0 {
+		s.MaxLifetime = other.MaxLifetime
+	}
+	if len(other.Classes) != 0 {
+		classes := make(map[string]*retrySchedule, len(s.Classes)+len(other.Classes))
+		for class, sched := range s.Classes {
+			classes[class] = sched
+		}
+		for class, sched := range other.Classes {
+			classes[class] = sched
+		}
+		s.Classes = classes
+	}
+	return s
+}
+
+func parseRetrySchedule(node config.Node, allowDomains bool, domains map[string]*retrySchedule) (*retrySchedule, error) {
+	s := &retrySchedule{}
+
+	cfg := config.NewMap(nil, node)
+	cfg.Custom("intervals", false, false, nil, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) == 0 {
+			return nil, config.NodeErr(node, "at least one interval is required")
+		}
+		intervals := make([]time.Duration, 0, len(node.Args))
+		for _, arg := range node.Args {
+			dur, err := time.ParseDuration(arg)
+			if err != nil {
+				return nil, config.NodeErr(node, "%v", err)
+			}
+			if dur < 0 {
+				return nil, config.NodeErr(node, "duration must not be negative")
+			}
+			intervals = append(intervals, dur)
+		}
+		return intervals, nil
+	}, &s.Intervals)
+	cfg.Int("max_tries", false, false, 0, &s.MaxTries)
+	cfg.Duration("max_lifetime", false, false, 0, &s.MaxLifetime)
+	classScheds := make([]*retrySchedule, len(deferralClasses))
+	for i, class := range deferralClasses {
+		cfg.Custom(class, false, false, nil, func(_ *config.Map, node config.Node) (interface{}, error) {
+			return parseRetrySchedule(node, false, nil)
+		}, &classScheds[i])
+	}
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return nil, err
+	}
+	for i, sched := range classScheds {
+		if sched == nil {
+			continue
+		}
+		if s.Classes == nil {
+			s.Classes = make(map[string]*retrySchedule)
+		}
+		s.Classes[deferralClasses[i]] = sched
+	}
+
+	for _, node := range unknown {
+		if node.Name != "domain" || !allowDomains {
+			return nil, config.NodeErr(node, "unknown directive: %s", node.Name)
+		}
+		if len(node.Args) == 0 {
+			return nil, config.NodeErr(node, "at least one domain is required")
+		}
+		domainSched, err := parseRetrySchedule(node, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range node.Args {
+			domain, err := dns.ForLookup(domain)
+			if err != nil {
+				return nil, config.NodeErr(node, "invalid domain: %v", err)
+			}
+			if _, ok := domains[domain]; ok {
+				return nil, config.NodeErr(node, "duplicate schedule for domain %s", domain)
+			}
+			domains[domain] = domainSched
+		}
+	}
+
+	if s.MaxTries < 0 {
+		return nil, config.NodeErr(node, "max_tries must not be negative")
+	}
+
+	return s, nil
+}
+
+var (
+	greylistingWords = []string{"greylist", "graylist", "grey-list", "gray-list", "grey list", "gray list"}
+	mailboxFullWords = []string{"mailbox full", "mailbox is full", "quota", "exceeded storage"}
+	rateLimitedWords = []string{
+		"rate limit", "ratelimit", "rate-limit", "too many", "throttl",
+		"slow down", "unusual rate", "rate that prevents", "unexpected volume",
+	}
+)
+
+func containsAny(s string, words []string) bool {
+	for _, word := range words {
+		if strings.Contains(s, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// deferralClass classifies the temporary error by the enhanced status code
+// and common wording used by popular implementations. Empty string is
+// returned for unclassified and permanent errors.
+func deferralClass(err *smtp.SMTPError) string {
+	if err == nil || err.Code/100 != 4 {
+		return ""
+	}
+	msg := strings.ToLower(err.Message)
+	switch {
+	case containsAny(msg, greylistingWords):
+		return deferralGreylisting
+	case err.EnhancedCode == smtp.EnhancedCode{4, 2, 2} || containsAny(msg, mailboxFullWords):
+		return deferralMailboxFull
+	case err.EnhancedCode == smtp.EnhancedCode{4, 7, 28} || containsAny(msg, rateLimitedWords):
+		return deferralRateLimited
+	}
+	return ""
+}
+
+// rcptSchedule returns the retry schedule to use for the recipient with the
+// specified last delivery error.
+func (q *Queue) rcptSchedule(rcpt string, lastErr *smtp.SMTPError) retrySchedule {
+	s := retrySchedule{MaxTries: q.maxTries, MaxLifetime: q.maxLifetime, Classes: defaultClasses}
+	s = s.override(q.retrySchedule)
+
+	if len(q.retryDomains) != 0 {
+		_, domain, err := address.Split(rcpt)
+		if err == nil {
+			if domain, err := dns.ForLookup(domain); err == nil {
+				s = s.override(q.retryDomains[domain])
+			}
+		}
+	}
+
+	if class := deferralClass(lastErr); class != "" {
+		s = s.override(s.Classes[class])
+	}
+	return s
+}
+
+// retryDelay returns the delay before the next delivery attempt after tries
+// unsuccessful attempts.
+func (q *Queue) retryDelay(s retrySchedule, tries int) time.Duration {
+	if tries < 1 {
+		tries = 1
+	}
+	if len(s.Intervals) != 0 {
+		if tries > len(s.Intervals) {
+			return s.Intervals[len(s.Intervals)-1]
+		}
+		return s.Intervals[tries-1]
+	}
+
+	// initialRetryTime * retryTimeScale ^ (tries - 1)
+	return time.Duration(float64(q.initialRetryTime) * math.Pow(q.retryTimeScale, float64(tries-1)))
+}
+
+// nextRetryDelay returns the delay before the next delivery attempt for the
+// message, counting from the last attempt. It is the smallest delay among
+// all pending recipients.
+func (q *Queue) nextRetryDelay(meta *QueueMetadata) time.Duration {
+	var delay time.Duration = -1
+	for _, rcpt := range meta.To {
+		rcptDelay := q.retryDelay(q.rcptSchedule(rcpt, meta.RcptErrs[rcpt]), meta.TriesCount[rcpt])
+		if delay == -1 || rcptDelay < delay {
+			delay = rcptDelay
+		}
+	}
+	if delay == -1 {
+		return 0
+	}
+	return delay
+}
@@ -0,0 +1,154 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+)
+
+func TestRetrySchedule(t *testing.T) {
+	nodes, err := parser.Read(strings.NewReader(`
+		retry_schedule {
+			intervals 1m 5m 1h
+			max_tries 10
+			max_lifetime 48h
+			greylisting {
+				intervals 30s 2m
+			}
+			rate_limited {
+				intervals 2h
+			}
+			domain example.org EXAMPLE.com {
+				intervals 10m
+				max_tries 3
+			}
+		}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &Queue{
+		maxTries:         20,
+		initialRetryTime: 15 * time.Minute,
+		retryTimeScale:   2,
+		retryDomains:     map[string]*retrySchedule{},
+	}
+	q.retrySchedule, err = parseRetrySchedule(nodes[0], true, q.retryDomains)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	greylisted := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Greylisted, try again later"}
+	other := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 0, 0}, Message: "Try again later"}
+	rateLimited := &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 28}, Message: "Our system has detected an unusual rate of mail"}
+
+	check := func(rcpt string, lastErr *smtp.SMTPError, tries int, delay time.Duration, maxTries int) {
+		t.Helper()
+		s := q.rcptSchedule(rcpt, lastErr)
+		if got := q.retryDelay(s, tries); got != delay {
+			t.Errorf("%s, %d tries: expected delay %v, got %v", rcpt, tries, delay, got)
+		}
+		if s.MaxTries != maxTries {
+			t.Errorf("%s: expected max_tries %d, got %d", rcpt, maxTries, s.MaxTries)
+		}
+		if s.MaxLifetime != 48*time.Hour {
+			t.Errorf("%s: max_lifetime is not inherited: %v", rcpt, s.MaxLifetime)
+		}
+	}
+
+	check("test@example.net", other, 1, time.Minute, 10)
+	check("test@example.net", other, 2, 5*time.Minute, 10)
+	check("test@example.net", other, 3, time.Hour, 10)
+	check("test@example.net", other, 10, time.Hour, 10)
+	check("test@example.net", greylisted, 1, 30*time.Second, 10)
+	check("test@example.net", greylisted, 5, 2*time.Minute, 10)
+	check("test@example.org", other, 1, 10*time.Minute, 3)
+	check("test@example.com", other, 2, 10*time.Minute, 3)
+	// Greylisting schedule is inherited by domain schedules.
+	check("test@example.com", greylisted, 1, 30*time.Second, 3)
+	check("test@example.net", rateLimited, 1, 2*time.Hour, 10)
+
+	// No retry_schedule - exponential backoff.
+	q.retrySchedule = nil
+	q.retryDomains = nil
+	s := q.rcptSchedule("test@example.org", other)
+	if s.MaxTries != 20 {
+		t.Error("max_tries is not used for default schedule:", s.MaxTries)
+	}
+	for tries, delay := range []time.Duration{15 * time.Minute, 30 * time.Minute, time.Hour} {
+		if got := q.retryDelay(s, tries+1); got != delay {
+			t.Errorf("%d tries: expected delay %v, got %v", tries+1, delay, got)
+		}
+	}
+
+	// Built-in greylisting schedule.
+	s = q.rcptSchedule("test@example.org", greylisted)
+	if got := q.retryDelay(s, 1); got != 5*time.Minute {
+		t.Error("Default greylisting schedule is not used:", got)
+	}
+}
+
+func TestDeferralClass(t *testing.T) {
+	for _, c := range []struct {
+		code    int
+		enhCode smtp.EnhancedCode
+		msg     string
+		class   string
+	}{
+		{450, smtp.EnhancedCode{4, 2, 0}, "Recipient address rejected: Greylisted, see http://postgrey.schweikert.ch/", deferralGreylisting},
+		{451, smtp.EnhancedCode{4, 7, 1}, "Please try again later (graylisting)", deferralGreylisting},
+		{452, smtp.EnhancedCode{4, 2, 2}, "The email account that you tried to reach is over quota", deferralMailboxFull},
+		{452, smtp.EnhancedCode{4, 0, 0}, "Mailbox is full", deferralMailboxFull},
+		{421, smtp.EnhancedCode{4, 7, 0}, "Messages temporarily deferred due to unexpected volume", deferralRateLimited},
+		{451, smtp.EnhancedCode{4, 7, 650}, "The mail server has been temporarily rate limited", deferralRateLimited},
+		{421, smtp.EnhancedCode{4, 7, 28}, "Try again later", deferralRateLimited},
+		{451, smtp.EnhancedCode{4, 0, 0}, "Try again later", ""},
+		{550, smtp.EnhancedCode{5, 2, 2}, "Mailbox full", ""},
+	} {
+		err := &smtp.SMTPError{Code: c.code, EnhancedCode: c.enhCode, Message: c.msg}
+		if class := deferralClass(err); class != c.class {
+			t.Errorf("%d %v %s: expected %q, got %q", c.code, c.enhCode, c.msg, c.class, class)
+		}
+	}
+}
+
+func TestNextRetryDelay(t *testing.T) {
+	q := &Queue{
+		maxTries:         20,
+		initialRetryTime: time.Hour,
+		retryTimeScale:   1,
+		retryDomains: map[string]*retrySchedule{
+			"example.org": {Intervals: []time.Duration{time.Minute}},
+		},
+	}
+
+	meta := &QueueMetadata{
+		To:         []string{"a@example.com", "b@example.org"},
+		TriesCount: map[string]int{"a@example.com": 1, "b@example.org": 1},
+		RcptErrs:   map[string]*smtp.SMTPError{},
+	}
+	if delay := q.nextRetryDelay(meta); delay != time.Minute {
+		t.Error("Expected the smallest delay to be used, got", delay)
+	}
+}
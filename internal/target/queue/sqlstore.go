@@ -0,0 +1,377 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	_ "github.com/lib/pq"
+)
+
+var sqlTableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// errLeaseLost is returned when the message is locked by another instance.
+var errLeaseLost = errors.New("queue: message is locked by another instance")
+
+// sqlStore keeps messages in a single SQL table. Each message is stored
+// in one row so it is inserted, updated and removed atomically.
+//
+// Message bodies are loaded into memory for delivery attempts.
+//
+// If shared is set, the table can be used by multiple server instances at
+// once. Instances take a lease on the message for the time of the delivery
+// attempt and periodically look for messages accepted by other instances.
+// Messages locked by another instance are not changed or removed.
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+	table  string
+	log    *log.Logger
+
+	shared       bool
+	nodeID       string
+	lease        time.Duration
+	pollInterval time.Duration
+}
+
+func openSQLStore(node config.Node, logger *log.Logger) (*sqlStore, error) {
+	var (
+		driver   string
+		dsnParts []string
+		table    string
+		s        = &sqlStore{log: logger}
+	)
+	defaultNodeID, err := os.Hostname()
+	if err != nil {
+		defaultNodeID = ""
+	}
+	cfg := config.NewMap(nil, node)
+	cfg.String("driver", false, true, "", &driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.String("table", false, false, "maddy_queue", &table)
+	cfg.Bool("shared", false, false, &s.shared)
+	cfg.String("node_id", false, false, defaultNodeID, &s.nodeID)
+	cfg.Duration("lease", false, false, 10*time.Minute, &s.lease)
+	cfg.Duration("poll_interval", false, false, 30*time.Second, &s.pollInterval)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if s.shared && s.nodeID == "" {
+		return nil, config.NodeErr(node, "node_id is required for shared store")
+	}
+	if s.lease <= 0 || s.pollInterval <= 0 {
+		return nil, config.NodeErr(node, "lease and poll_interval should be positive")
+	}
+
+	if !sqlTableName.MatchString(table) {
+		return nil, config.NodeErr(node, "invalid table name: %s", table)
+	}
+
+	switch driver {
+	case "sqlite3":
+		switch sqliteImpl {
+		case "modernc":
+			driver = "sqlite"
+		case "missing":
+			return nil, config.NodeErr(node, "SQLite is not supported, recompile without no_sqlite3 tag set")
+		}
+	case "postgres":
+	default:
+		return nil, config.NodeErr(node, "unsupported driver: %s", driver)
+	}
+
+	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
+	if err != nil {
+		return nil, config.NodeErr(node, "failed to open db: %v", err)
+	}
+
+	s.db = db
+	s.driver = driver
+	s.table = table
+	if err := s.initSchema(); err != nil {
+		db.Close()
+		return nil, config.NodeErr(node, "failed to initialize schema: %v", err)
+	}
+	return s, nil
+}
+
+// query replaces the table name placeholder and converts the argument
+// placeholders to the form understood by the driver.
+func (s *sqlStore) query(q string) string {
+	q = strings.ReplaceAll(q, "{table}", s.table)
+	if s.driver == "postgres" {
+		return q
+	}
+	for i := 9; i > 0; i-- {
+		q = strings.ReplaceAll(q, fmt.Sprintf("$%d", i), "?")
+	}
+	return q
+}
+
+func (s *sqlStore) initSchema() error {
+	blobType := "BLOB"
+	if s.driver == "postgres" {
+		blobType = "BYTEA"
+	}
+	_, err := s.db.Exec(s.query(`CREATE TABLE IF NOT EXISTS {table} (
+		id TEXT PRIMARY KEY NOT NULL,
+		meta TEXT NOT NULL,
+		header ` + blobType + ` NOT NULL,
+		body ` + blobType + ` NOT NULL,
+		broken INTEGER NOT NULL DEFAULT 0,
+		locked_by TEXT NOT NULL DEFAULT '',
+		locked_until BIGINT NOT NULL DEFAULT 0
+	)`))
+	if err != nil {
+		return err
+	}
+
+	// Tables created by older versions have no lease columns.
+	if _, err := s.db.Exec(s.query(`SELECT locked_by, locked_until FROM {table} WHERE 1 = 0`)); err != nil {
+		for _, col := range []string{
+			`locked_by TEXT NOT NULL DEFAULT ''`,
+			`locked_until BIGINT NOT NULL DEFAULT 0`,
+		} {
+			if _, err := s.db.Exec(s.query(`ALTER TABLE {table} ADD COLUMN ` + col)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) MarkBroken(id string) {
+	if _, err := s.db.Exec(s.query(`UPDATE {table} SET broken = 1 WHERE id = $1`), id); err != nil {
+		// Note: Global logger is used in case there is something wrong with Queue.Log.
+		log.Printf("can't mark the queue message as broken: %v", err)
+	}
+}
+
+func (s *sqlStore) Remove(msgMeta *module.MsgMetadata) {
+	dl := target.DeliveryLogger(*s.log, msgMeta)
+	res, err := s.db.Exec(s.query(`DELETE FROM {table}
+		WHERE id = $1 AND (locked_by = '' OR locked_by = $2 OR locked_until < $3)`),
+		msgMeta.ID, s.nodeID, time.Now().Unix())
+	if err != nil {
+		dl.Error("failed to remove message from database", err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 && s.lockedByOthers(msgMeta.ID) {
+		dl.Error("failed to remove message from database", errLeaseLost)
+		return
+	}
+	dl.Debugf("removed message from database")
+}
+
+// lockedByOthers reports whether the message exists and is locked by another
+// instance.
+func (s *sqlStore) lockedByOthers(id string) bool {
+	var one int
+	err := s.db.QueryRow(s.query(`SELECT 1 FROM {table}
+		WHERE id = $1 AND locked_by <> '' AND locked_by <> $2 AND locked_until >= $3`),
+		id, s.nodeID, time.Now().Unix()).Scan(&one)
+	return err == nil
+}
+
+func (s *sqlStore) Load() ([]*QueueMetadata, error) {
+	return s.List()
+}
+
+func (s *sqlStore) List() ([]*QueueMetadata, error) {
+	rows, err := s.db.Query(s.query(`SELECT id, meta FROM {table} WHERE broken = 0`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*QueueMetadata
+	for rows.Next() {
+		var id, metaBlob string
+		if err := rows.Scan(&id, &metaBlob); err != nil {
+			return nil, err
+		}
+		meta, err := decodeMeta(strings.NewReader(metaBlob))
+		if err != nil {
+			s.log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
+			continue
+		}
+		res = append(res, meta)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqlStore) Has(id string) bool {
+	var one int
+	err := s.db.QueryRow(s.query(`SELECT 1 FROM {table} WHERE id = $1 AND broken = 0`), id).Scan(&one)
+	return err == nil
+}
+
+func (s *sqlStore) Store(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	metaBlob, err := json.Marshal(serializableMeta(meta))
+	if err != nil {
+		return nil, err
+	}
+
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+		return nil, err
+	}
+
+	bodyReader, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyReader.Close()
+	bodyBlob, err := io.ReadAll(bodyReader)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(s.query(`INSERT INTO {table} (id, meta, header, body) VALUES ($1, $2, $3, $4)`),
+		meta.MsgMeta.ID, string(metaBlob), hdrBlob.Bytes(), bodyBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.MemoryBuffer{Slice: bodyBlob}, nil
+}
+
+func (s *sqlStore) UpdateMeta(meta *QueueMetadata) error {
+	metaBlob, err := json.Marshal(serializableMeta(meta))
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(s.query(`UPDATE {table} SET meta = $1
+		WHERE id = $2 AND (locked_by = '' OR locked_by = $3 OR locked_until < $4)`),
+		string(metaBlob), meta.MsgMeta.ID, s.nodeID, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		if s.lockedByOthers(meta.MsgMeta.ID) {
+			return errLeaseLost
+		}
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (s *sqlStore) Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	var (
+		metaBlob          string
+		hdrBlob, bodyBlob []byte
+	)
+	err := s.db.QueryRow(s.query(`SELECT meta, header, body FROM {table} WHERE id = $1 AND broken = 0`), id).
+		Scan(&metaBlob, &hdrBlob, &bodyBlob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, textproto.Header{}, nil, os.ErrNotExist
+		}
+		return nil, textproto.Header{}, nil, err
+	}
+
+	meta, err := decodeMeta(strings.NewReader(metaBlob))
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(hdrBlob)))
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	return meta, header, buffer.MemoryBuffer{Slice: bodyBlob}, nil
+}
+
+// Lock takes the lease on the message for the delivery attempt. false is
+// returned if the message is being delivered by another instance or does not
+// exist anymore.
+func (s *sqlStore) Lock(id string) (bool, error) {
+	now := time.Now()
+	res, err := s.db.Exec(s.query(`UPDATE {table} SET locked_by = $1, locked_until = $2
+		WHERE id = $3 AND broken = 0 AND (locked_by = '' OR locked_until < $4)`),
+		s.nodeID, now.Add(s.lease).Unix(), id, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (s *sqlStore) Renew(id string) (bool, error) {
+	res, err := s.db.Exec(s.query(`UPDATE {table} SET locked_until = $1 WHERE id = $2 AND locked_by = $3`),
+		time.Now().Add(s.lease).Unix(), id, s.nodeID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (s *sqlStore) LeaseTime() time.Duration {
+	return s.lease
+}
+
+func (s *sqlStore) Unlock(id string) {
+	_, err := s.db.Exec(s.query(`UPDATE {table} SET locked_by = '', locked_until = 0 WHERE id = $1 AND locked_by = $2`),
+		id, s.nodeID)
+	if err != nil {
+		s.log.Error("failed to release the message lease", err, "msg_id", id)
+	}
+}
+
+func (s *sqlStore) Shared() (bool, time.Duration) {
+	return s.shared, s.pollInterval
+}
+
+func (s *sqlStore) CheckHealth(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,288 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestSQLQueue(t *testing.T, target module.DeliveryTarget, dbPath string, storeOpts ...config.Node) *Queue {
+	mod, _ := NewQueue("", "queue", nil, nil)
+	q := mod.(*Queue)
+	q.initialRetryTime = 0
+	q.retryTimeScale = 1
+	q.postInitDelay = 0
+	q.maxTries = 5
+	q.location = t.TempDir()
+	q.Target = target
+
+	if testing.Verbose() {
+		q.Log = testutils.Logger(t, "queue")
+	} else {
+		q.Log = log.Logger{Out: log.NopOutput{}}
+	}
+
+	store, err := openSQLStore(config.Node{
+		Name: "store",
+		Args: []string{"sql"},
+		Children: append([]config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{"file:" + dbPath + "?_busy_timeout=5000"}},
+		}, storeOpts...),
+	}, &q.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.store = store
+
+	if err := q.start(1); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestQueueSQLStore(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "queue.db")
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("go away"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestSQLQueue(t, &dt, dbPath)
+	q.initialRetryTime = time.Hour
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	info := waitScheduled(t, q)
+	if info.Tries["tester1@example.org"] != 1 {
+		t.Error("Wrong tries count:", info.Tries)
+	}
+	details, err := q.Inspect(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Header == "" || details.BodySize == 0 {
+		t.Errorf("Missing message contents: %+v", details)
+	}
+	if _, err := q.Inspect("nonexistent"); !errors.Is(err, ErrUnknownMessage) {
+		t.Error("Expected ErrUnknownMessage, got", err)
+	}
+	q.Close()
+
+	// Message should be loaded again after restart.
+	q = newTestSQLQueue(t, &dt, dbPath)
+	defer cleanQueue(t, q)
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if len(msg.RcptTo) != 2 {
+		t.Error("Wrong recipients:", msg.RcptTo)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		msgs, err := q.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Message was not removed from the database")
+}
+
+func TestQueueSQLStore_Shared(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "queue.db")
+	sharedOpts := []config.Node{
+		{Name: "shared", Args: []string{"yes"}},
+		{Name: "poll_interval", Args: []string{"50ms"}},
+	}
+
+	failing := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("go away"), true),
+			exterrors.WithTemporary(errors.New("go away"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	qA := newTestSQLQueue(t, &failing, dbPath, append(sharedOpts, config.Node{Name: "node_id", Args: []string{"a"}})...)
+	qA.initialRetryTime = time.Hour
+	defer cleanQueue(t, qA)
+
+	working := unreliableTarget{
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	qB := newTestSQLQueue(t, &working, dbPath, append(sharedOpts, config.Node{Name: "node_id", Args: []string{"b"}})...)
+	defer cleanQueue(t, qB)
+
+	// Accepted by A, first attempt fails and A reschedules it in an hour,
+	// B picks it up and delivers now.
+	testutils.DoTestDelivery(t, qA, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, failing.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, working.committed, 5*time.Second)
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tester1@example.org" {
+		t.Error("Wrong recipients:", msg.RcptTo)
+	}
+
+	select {
+	case <-working.committed:
+		t.Fatal("Message delivered twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	msgs, err := qA.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Error("Message was not removed after delivery:", msgs)
+	}
+}
+
+func TestSQLStore_Lease(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "queue.db")
+	logger := testutils.Logger(t, "queue")
+	openStore := func(nodeID string) *sqlStore {
+		s, err := openSQLStore(config.Node{
+			Name: "store",
+			Args: []string{"sql"},
+			Children: []config.Node{
+				{Name: "driver", Args: []string{"sqlite3"}},
+				{Name: "dsn", Args: []string{"file:" + dbPath + "?_busy_timeout=5000"}},
+				{Name: "shared", Args: []string{"yes"}},
+				{Name: "node_id", Args: []string{nodeID}},
+			},
+		}, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	a, b := openStore("a"), openStore("b")
+
+	meta := &QueueMetadata{
+		MsgMeta: &module.MsgMetadata{ID: "msg"},
+		From:    "tester@example.com",
+		To:      []string{"tester1@example.org"},
+	}
+	if _, err := a.Store(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if locked, err := a.Lock("msg"); err != nil || !locked {
+		t.Fatal("Lock failed:", locked, err)
+	}
+	if locked, _ := b.Lock("msg"); locked {
+		t.Fatal("Message locked twice")
+	}
+	if renewed, err := a.Renew("msg"); err != nil || !renewed {
+		t.Fatal("Renew failed:", renewed, err)
+	}
+	if renewed, _ := b.Renew("msg"); renewed {
+		t.Fatal("Lease renewed by another instance")
+	}
+
+	// Changes by the instance that does not hold the lease are rejected.
+	if err := b.UpdateMeta(meta); !errors.Is(err, errLeaseLost) {
+		t.Fatal("Expected errLeaseLost, got", err)
+	}
+	b.Remove(meta.MsgMeta)
+	if !a.Has("msg") {
+		t.Fatal("Message removed by another instance")
+	}
+	if err := a.UpdateMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Unlock("msg")
+	if err := b.UpdateMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	b.Remove(meta.MsgMeta)
+	if a.Has("msg") {
+		t.Fatal("Message is not removed")
+	}
+}
+
+func TestQueueSQLStore_AttemptedByOther(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestSQLQueue(t, &dt, filepath.Join(t.TempDir(), "queue.db"),
+		config.Node{Name: "shared", Args: []string{"yes"}},
+		config.Node{Name: "node_id", Args: []string{"a"}})
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	// This instance scheduled the message after the attempt an hour ago,
+	// another instance made an attempt a minute ago.
+	scheduledAttempt := time.Now().Add(-time.Hour)
+	meta := &QueueMetadata{
+		MsgMeta:      &module.MsgMetadata{ID: "msg"},
+		From:         "tester@example.com",
+		To:           []string{"tester1@example.org"},
+		TriesCount:   map[string]int{"tester1@example.org": 1},
+		FirstAttempt: scheduledAttempt,
+		LastAttempt:  time.Now().Add(-time.Minute),
+	}
+	if _, err := q.store.Store(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.dispatch(TimeSlot{
+		Time:  time.Now(),
+		Value: queueSlot{ID: "msg", LastAttempt: scheduledAttempt},
+	})
+	q.deliveryWg.Wait()
+
+	select {
+	case <-dt.committed:
+		t.Fatal("Message delivered before the next attempt is due")
+	default:
+	}
+	if next := q.scheduled()["msg"]; time.Until(next) < 30*time.Minute {
+		t.Fatal("Message is not rescheduled, next attempt:", next)
+	}
+}
@@ -0,0 +1,408 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// messageStore is the persistent storage for queued messages.
+//
+// Errors returned for messages that are not stored should satisfy
+// os.IsNotExist.
+type messageStore interface {
+	// Load returns meta-data for all messages that should be scheduled for
+	// delivery on start-up. Incomplete entries are removed or skipped.
+	Load() ([]*QueueMetadata, error)
+
+	// List returns meta-data for all stored messages.
+	List() ([]*QueueMetadata, error)
+
+	Has(id string) bool
+
+	// Store saves a new message. Returned buffer should be used instead of
+	// body for further delivery attempts.
+	Store(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+	UpdateMeta(meta *QueueMetadata) error
+	Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error)
+	Remove(msgMeta *module.MsgMetadata)
+
+	// MarkBroken excludes the message from further delivery attempts while
+	// keeping it for investigation.
+	//
+	// No error handling is done since this function is called from panic
+	// handler.
+	MarkBroken(id string)
+
+	// CheckHealth checks that the storage is accessible.
+	CheckHealth(ctx context.Context) error
+
+	Close() error
+}
+
+// sharedStore is implemented by stores that can be used by multiple server
+// instances at once.
+type sharedStore interface {
+	messageStore
+
+	// Lock marks the message as being delivered by this instance. false is
+	// returned if it is locked by another instance or does not exist anymore.
+	Lock(id string) (bool, error)
+	Unlock(id string)
+
+	// Renew extends the lock taken by Lock. false is returned if the lock was
+	// lost, e.g. taken by another instance after it expired.
+	Renew(id string) (bool, error)
+
+	// LeaseTime returns how long the lock is held without renewal.
+	LeaseTime() time.Duration
+
+	// Shared reports whether the store is actually shared and how often it
+	// should be checked for messages accepted by other instances.
+	Shared() (bool, time.Duration)
+}
+
+// fsStore keeps messages in the directory, each message is stored in three
+// files: ID.meta, ID.header and ID.body.
+type fsStore struct {
+	location string
+	log      *log.Logger
+}
+
+// MarkBroken changes the name of metadata file to have .meta_broken
+// extension.
+//
+// Further attempts to deliver (due to a timewheel) it will fail due to
+// non-existent meta-data file.
+func (s *fsStore) MarkBroken(id string) {
+	err := os.Rename(filepath.Join(s.location, id+".meta"), filepath.Join(s.location, id+".meta_broken"))
+	if err != nil {
+		// Note: Global logger is used in case there is something wrong with Queue.Log.
+		log.Printf("can't mark the queue message as broken: %v", err)
+	}
+}
+
+func (s *fsStore) Remove(msgMeta *module.MsgMetadata) {
+	id := msgMeta.ID
+	dl := target.DeliveryLogger(*s.log, msgMeta)
+
+	// Order is important.
+	// If we remove header and body but can't remove meta now - Load
+	// will detect and report it.
+	headerPath := filepath.Join(s.location, id+".header")
+	if err := os.Remove(headerPath); err != nil {
+		dl.Error("failed to remove header from disk", err)
+	}
+	bodyPath := filepath.Join(s.location, id+".body")
+	if err := os.Remove(bodyPath); err != nil {
+		dl.Error("failed to remove body from disk", err)
+	}
+	metaPath := filepath.Join(s.location, id+".meta")
+	if err := os.Remove(metaPath); err != nil {
+		dl.Error("failed to remove meta-data from disk", err)
+	}
+	dl.Debugf("removed message from disk")
+}
+
+func (s *fsStore) Load() ([]*QueueMetadata, error) {
+	dirInfo, err := os.ReadDir(s.location)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
+
+	var res []*QueueMetadata
+	for _, entry := range dirInfo {
+		// We start loading from meta-data files and then check whether ID.header and ID.body exist.
+		// This allows us to properly detect dangling body files.
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := entry.Name()[:len(entry.Name())-5]
+
+		meta, err := s.readMeta(id)
+		if err != nil {
+			s.log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
+			continue
+		}
+
+		// Check header file existence.
+		if _, err := os.Stat(filepath.Join(s.location, id+".header")); err != nil {
+			if os.IsNotExist(err) {
+				s.log.Printf("header file doesn't exist for msg ID = %s", id)
+				s.tryRemoveDanglingFile(id + ".meta")
+				s.tryRemoveDanglingFile(id + ".body")
+			} else {
+				s.log.Printf("skipping nonstat'able header file: %v (msg ID = %s)", err, id)
+			}
+			continue
+		}
+
+		// Check body file existence.
+		if _, err := os.Stat(filepath.Join(s.location, id+".body")); err != nil {
+			if os.IsNotExist(err) {
+				s.log.Printf("body file doesn't exist for msg ID = %s", id)
+				s.tryRemoveDanglingFile(id + ".meta")
+				s.tryRemoveDanglingFile(id + ".header")
+			} else {
+				s.log.Printf("skipping nonstat'able body file: %v (msg ID = %s)", err, id)
+			}
+			continue
+		}
+
+		res = append(res, meta)
+	}
+
+	return res, nil
+}
+
+func (s *fsStore) List() ([]*QueueMetadata, error) {
+	dirInfo, err := os.ReadDir(s.location)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*QueueMetadata, 0, len(dirInfo)/3)
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".meta")
+
+		meta, err := s.readMeta(id)
+		if err != nil {
+			// Removed while we were reading the directory.
+			if os.IsNotExist(err) {
+				continue
+			}
+			s.log.Error("failed to read meta-data", err, "msg_id", id)
+			continue
+		}
+		res = append(res, meta)
+	}
+	return res, nil
+}
+
+func (s *fsStore) Has(id string) bool {
+	_, err := os.Stat(filepath.Join(s.location, id+".meta"))
+	return err == nil
+}
+
+func (s *fsStore) Store(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	id := meta.MsgMeta.ID
+
+	headerPath := filepath.Join(s.location, id+".header")
+	headerFile, err := os.Create(headerPath)
+	if err != nil {
+		return nil, err
+	}
+	defer headerFile.Close()
+
+	if err := textproto.WriteHeader(headerFile, header); err != nil {
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	bodyReader, err := body.Open()
+	if err != nil {
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+	defer bodyReader.Close()
+
+	bodyPath := filepath.Join(s.location, id+".body")
+	bodyFile, err := os.Create(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer bodyFile.Close()
+
+	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
+		s.tryRemoveDanglingFile(id + ".body")
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	if err := s.UpdateMeta(meta); err != nil {
+		s.tryRemoveDanglingFile(id + ".body")
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	if err := headerFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	if err := bodyFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
+}
+
+func (s *fsStore) UpdateMeta(meta *QueueMetadata) error {
+	return writeMetaFile(filepath.Join(s.location, meta.MsgMeta.ID+".meta"), meta)
+}
+
+func writeMetaFile(metaPath string, meta *QueueMetadata) error {
+	var file *os.File
+	var err error
+	if runtime.GOOS == "windows" {
+		file, err = os.Create(metaPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		file, err = os.Create(metaPath + ".new")
+		if err != nil {
+			return err
+		}
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(serializableMeta(meta)); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Rename(metaPath+".new", metaPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serializableMeta returns the copy of meta without fields that can't be
+// serialized.
+func serializableMeta(meta *QueueMetadata) QueueMetadata {
+	metaCopy := *meta
+	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
+	metaCopy.MsgMeta.Conn = nil
+	return metaCopy
+}
+
+func (s *fsStore) readMeta(id string) (*QueueMetadata, error) {
+	return readMetaFile(filepath.Join(s.location, id+".meta"))
+}
+
+func readMetaFile(metaPath string) (*QueueMetadata, error) {
+	file, err := os.Open(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeMeta(file)
+}
+
+func decodeMeta(r io.Reader) (*QueueMetadata, error) {
+	meta := &QueueMetadata{}
+
+	meta.MsgMeta = &module.MsgMetadata{}
+
+	// There is a couple of problems we have to solve before we would be able to
+	// serialize ConnState.
+	// 1. future.Future can't be serialized.
+	// 2. net.Addr can't be deserialized because we don't know the concrete type.
+
+	if err := json.NewDecoder(r).Decode(meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func (s *fsStore) tryRemoveDanglingFile(name string) {
+	if err := os.Remove(filepath.Join(s.location, name)); err != nil {
+		s.log.Error("dangling file remove failed", err)
+		return
+	}
+	s.log.Printf("removed dangling file %s", name)
+}
+
+func (s *fsStore) Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	bodyPath := filepath.Join(s.location, id+".body")
+	_, err = os.Stat(bodyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.tryRemoveDanglingFile(id + ".meta")
+		}
+		return nil, textproto.Header{}, nil, err
+	}
+	body := buffer.FileBuffer{Path: bodyPath}
+
+	headerPath := filepath.Join(s.location, id+".header")
+	headerFile, err := os.Open(headerPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.tryRemoveDanglingFile(id + ".meta")
+			s.tryRemoveDanglingFile(id + ".body")
+		}
+		return nil, textproto.Header{}, nil, err
+	}
+	defer headerFile.Close()
+
+	bufferedHeader := bufio.NewReader(headerFile)
+	header, err := textproto.ReadHeader(bufferedHeader)
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	return meta, header, body, nil
+}
+
+func (s *fsStore) CheckHealth(_ context.Context) error {
+	// Only .meta files are considered by Load and List, so the file is
+	// not picked up as a message.
+	f, err := os.CreateTemp(s.location, ".health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (s *fsStore) Close() error {
+	return nil
+}
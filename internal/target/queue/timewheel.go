@@ -70,6 +70,46 @@ func (tw *TimeWheel) Add(target time.Time, value interface{}) {
 	tw.updateNotify <- target
 }
 
+// Remove removes all slots for which match returns true and returns them.
+//
+// Removed slots will not be dispatched, even if their time has already come
+// but the dispatch has not started yet.
+func (tw *TimeWheel) Remove(match func(TimeSlot) bool) []TimeSlot {
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+
+	var removed []TimeSlot
+	for e := tw.slots.Front(); e != nil; {
+		next := e.Next()
+		slot := e.Value.(TimeSlot)
+		if match(slot) {
+			tw.slots.Remove(e)
+			removed = append(removed, slot)
+		}
+		e = next
+	}
+	return removed
+}
+
+// Len returns the amount of currently scheduled slots.
+func (tw *TimeWheel) Len() int {
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+	return tw.slots.Len()
+}
+
+// Slots returns all currently scheduled slots in no particular order.
+func (tw *TimeWheel) Slots() []TimeSlot {
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+
+	slots := make([]TimeSlot, 0, tw.slots.Len())
+	for e := tw.slots.Front(); e != nil; e = e.Next() {
+		slots = append(slots, e.Value.(TimeSlot))
+	}
+	return slots
+}
+
 func (tw *TimeWheel) Close() {
 	atomic.StoreUint32(&tw.stopped, 1)
 
@@ -121,10 +161,23 @@ func (tw *TimeWheel) tick() {
 			select {
 			case <-timer.C:
 				tw.slotsLock.Lock()
-				tw.slots.Remove(closestEl)
+				// The slot might have been removed using Remove while we
+				// were waiting.
+				present := false
+				for e := tw.slots.Front(); e != nil; e = e.Next() {
+					if e == closestEl {
+						present = true
+						break
+					}
+				}
+				if present {
+					tw.slots.Remove(closestEl)
+				}
 				tw.slotsLock.Unlock()
 
-				tw.dispatch(closestSlot)
+				if present {
+					tw.dispatch(closestSlot)
+				}
 
 				break selectloop
 			case newTarget := <-tw.updateNotify:
@@ -0,0 +1,306 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// Delivery status events reported to the webhook.
+const (
+	eventQueued    = "queued"
+	eventDelivered = "delivered"
+	eventDeferred  = "deferred"
+	eventBounced   = "bounced"
+)
+
+var allWebhookEvents = []string{eventQueued, eventDelivered, eventDeferred, eventBounced}
+
+type webhookRcpt struct {
+	Address      string `json:"address"`
+	Status       string `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+	AttemptCount int    `json:"attempt_count,omitempty"`
+}
+
+type webhookEvent struct {
+	Event       string        `json:"event"`
+	Time        time.Time     `json:"time"`
+	Queue       string        `json:"queue"`
+	MsgID       string        `json:"msg_id"`
+	TraceID     string        `json:"trace_id,omitempty"`
+	EnvID       string        `json:"envid,omitempty"`
+	From        string        `json:"from"`
+	Rcpts       []webhookRcpt `json:"rcpts"`
+	NextAttempt *time.Time    `json:"next_attempt,omitempty"`
+}
+
+// webhook sends delivery status events as JSON POST requests.
+//
+// Events are sent asynchronously by a single goroutine, in the order they
+// are generated. If the backlog grows beyond webhookBacklog, new events are
+// dropped so a slow endpoint does not hold up deliveries.
+type webhook struct {
+	url     string
+	enabled map[string]bool
+	secret  []byte
+	retries int
+	client  *http.Client
+	log     log.Logger
+
+	pending chan webhookEvent
+	done    chan struct{}
+	once    sync.Once
+
+	// ctx is cancelled on close to abort the request in progress.
+	ctx    context.Context
+	cancel func()
+
+	// closedLock protects pending from being written to after it is
+	// closed. Events emitted after close are dropped.
+	closedLock sync.RWMutex
+	closed     bool
+}
+
+const webhookBacklog = 1024
+
+func parseWebhook(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument is required")
+	}
+	u, err := url.Parse(node.Args[0])
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, config.NodeErr(node, "http or https URL is required")
+	}
+
+	wh := &webhook{
+		url:     node.Args[0],
+		enabled: make(map[string]bool),
+	}
+
+	var (
+		events  []string
+		secret  string
+		timeout time.Duration
+	)
+	cm := config.NewMap(m.Globals, node)
+	cm.StringList("events", false, false, allWebhookEvents, &events)
+	cm.String("secret", false, false, "", &secret)
+	cm.Duration("timeout", false, false, 10*time.Second, &timeout)
+	cm.Int("retries", false, false, 3, &wh.retries)
+	if _, err := cm.Process(); err != nil {
+		return nil, err
+	}
+
+	for _, ev := range events {
+		known := false
+		for _, k := range allWebhookEvents {
+			if ev == k {
+				known = true
+			}
+		}
+		if !known {
+			return nil, config.NodeErr(node, "unknown event: %s", ev)
+		}
+		wh.enabled[ev] = true
+	}
+	if secret != "" {
+		wh.secret = []byte(secret)
+	}
+	wh.client = &http.Client{Timeout: timeout}
+
+	return wh, nil
+}
+
+func (wh *webhook) start(l log.Logger) {
+	wh.log = l
+	wh.log.Name += "/webhook"
+	wh.pending = make(chan webhookEvent, webhookBacklog)
+	wh.ctx, wh.cancel = context.WithCancel(context.Background())
+	wh.done = make(chan struct{})
+	go wh.loop()
+}
+
+func (wh *webhook) close() {
+	wh.once.Do(func() {
+		// Events that are not sent yet are dropped to not hold up the
+		// shutdown.
+		wh.cancel()
+
+		wh.closedLock.Lock()
+		wh.closed = true
+		close(wh.pending)
+		wh.closedLock.Unlock()
+
+		<-wh.done
+	})
+}
+
+// emit schedules the event for sending. It is a no-op if the webhook is not
+// configured or the event is not enabled.
+func (wh *webhook) emit(ev webhookEvent) {
+	if wh == nil || !wh.enabled[ev.Event] {
+		return
+	}
+	ev.Time = time.Now()
+
+	wh.closedLock.RLock()
+	defer wh.closedLock.RUnlock()
+	if wh.closed {
+		wh.log.Msg("webhook is closed, event dropped", "event", ev.Event, "msg_id", ev.MsgID)
+		return
+	}
+
+	select {
+	case wh.pending <- ev:
+	default:
+		wh.log.Msg("backlog is full, event dropped", "event", ev.Event, "msg_id", ev.MsgID)
+	}
+}
+
+func (wh *webhook) loop() {
+	defer close(wh.done)
+	dropped := 0
+	for ev := range wh.pending {
+		if wh.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		wh.send(ev)
+	}
+	if dropped != 0 {
+		wh.log.Msg("pending events dropped on shutdown", "count", dropped)
+	}
+}
+
+func (wh *webhook) send(ev webhookEvent) {
+	blob, err := json.Marshal(ev)
+	if err != nil {
+		wh.log.Error("marshal failed", err)
+		return
+	}
+
+	delay := time.Second
+	for i := 0; ; i++ {
+		err = wh.post(blob)
+		if err == nil {
+			return
+		}
+		if !wh.shouldRetry(err, i, delay) {
+			break
+		}
+		delay *= 2
+	}
+	wh.log.Error("event not sent", err, "event", ev.Event, "msg_id", ev.MsgID)
+}
+
+// shouldRetry waits for the delay before the next attempt and reports whether
+// it should be made.
+func (wh *webhook) shouldRetry(err error, attempt int, delay time.Duration) bool {
+	var perm permanentWebhookError
+	if errors.As(err, &perm) || attempt >= wh.retries {
+		return false
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-wh.ctx.Done():
+		return false
+	}
+}
+
+type permanentWebhookError struct {
+	status int
+}
+
+func (err permanentWebhookError) Error() string {
+	return fmt.Sprintf("webhook: unexpected status %d", err.status)
+}
+
+func (wh *webhook) post(blob []byte) error {
+	req, err := http.NewRequestWithContext(wh.ctx, http.MethodPost, wh.url, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.secret != nil {
+		mac := hmac.New(sha256.New, wh.secret)
+		mac.Write(blob)
+		req.Header.Set("X-Maddy-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook: unexpected status %d", resp.StatusCode)
+	default:
+		return permanentWebhookError{status: resp.StatusCode}
+	}
+}
+
+// webhookEvent builds the event for the listed recipients of the message.
+// attempts contains the number of delivery attempts made for each recipient,
+// it is nil for eventQueued.
+func (q *Queue) webhookEvent(event string, meta *QueueMetadata, rcpts []string, attempts map[string]int) webhookEvent {
+	ev := webhookEvent{
+		Event:   event,
+		Queue:   q.AdminName(),
+		MsgID:   meta.MsgMeta.ID,
+		TraceID: meta.MsgMeta.TraceID,
+		EnvID:   meta.MsgMeta.SMTPOpts.EnvelopeID,
+		From:    meta.From,
+		Rcpts:   make([]webhookRcpt, 0, len(rcpts)),
+	}
+	for _, rcpt := range rcpts {
+		wr := webhookRcpt{Address: rcpt, AttemptCount: attempts[rcpt]}
+		if event != eventDelivered && event != eventQueued {
+			if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+				wr.Status = fmt.Sprintf("%d.%d.%d", rcptErr.EnhancedCode[0], rcptErr.EnhancedCode[1], rcptErr.EnhancedCode[2])
+				wr.Error = strings.TrimSpace(rcptErr.Message)
+			}
+		}
+		ev.Rcpts = append(ev.Rcpts, wr)
+	}
+	return ev
+}
@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueWebhook(t *testing.T) {
+	t.Parallel()
+
+	var (
+		lock   sync.Mutex
+		events []webhookEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(blob)
+		if r.Header.Get("X-Maddy-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("Wrong signature:", r.Header.Get("X-Maddy-Signature"))
+		}
+
+		var ev webhookEvent
+		if err := json.Unmarshal(blob, &ev); err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		events = append(events, ev)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dt := unreliableTarget{
+		bodyFailuresPartial: []map[string]error{
+			{
+				"tester2@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+				"tester3@example.org": &exterrors.SMTPError{
+					Code:         550,
+					EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+					Message:      "No such user",
+				},
+			},
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+
+	mod, _ := NewQueue("", "queue", nil, nil)
+	q := mod.(*Queue)
+	q.initialRetryTime = 0
+	q.retryTimeScale = 1
+	q.maxTries = 5
+	q.location = t.TempDir()
+	q.Target = &dt
+	q.Log = log.Logger{Out: log.NopOutput{}}
+	q.webhook = &webhook{
+		url:     srv.URL,
+		enabled: map[string]bool{eventQueued: true, eventDelivered: true, eventDeferred: true, eventBounced: true},
+		secret:  []byte("secret"),
+		client:  srv.Client(),
+	}
+	if err := q.start(1); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com",
+		[]string{"tester1@example.org", "tester2@example.org", "tester3@example.org"},
+		&module.MsgMetadata{SMTPOpts: smtp.MailOptions{EnvelopeID: "envid"}})
+
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	// Events not sent yet are dropped on close.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		sent := len(events)
+		lock.Unlock()
+		if sent >= 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cleanQueue(t, q)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events, got %d: %+v", len(events), events)
+	}
+	check := func(i int, event string, attempt int, rcpts ...string) {
+		t.Helper()
+		ev := events[i]
+		if ev.Event != event {
+			t.Errorf("events[%d]: expected %s, got %s", i, event, ev.Event)
+		}
+		if ev.EnvID != "envid" || ev.From != "tester@example.com" || ev.MsgID == "" {
+			t.Errorf("events[%d]: wrong envelope information: %+v", i, ev)
+		}
+		if len(ev.Rcpts) != len(rcpts) {
+			t.Fatalf("events[%d]: wrong recipients: %+v", i, ev.Rcpts)
+		}
+		for j, rcpt := range rcpts {
+			if ev.Rcpts[j].Address != rcpt || ev.Rcpts[j].AttemptCount != attempt {
+				t.Errorf("events[%d]: wrong recipient: %+v", i, ev.Rcpts[j])
+			}
+		}
+	}
+	check(0, eventQueued, 0, "tester1@example.org", "tester2@example.org", "tester3@example.org")
+	check(1, eventDelivered, 1, "tester1@example.org")
+	check(2, eventBounced, 1, "tester3@example.org")
+	if events[2].Rcpts[0].Status != "5.1.1" || events[2].Rcpts[0].Error != "No such user" {
+		t.Errorf("Wrong bounce status: %+v", events[2].Rcpts[0])
+	}
+	check(3, eventDeferred, 1, "tester2@example.org")
+	if events[3].NextAttempt == nil {
+		t.Error("Missing next attempt time for deferred event")
+	}
+	check(4, eventDelivered, 2, "tester2@example.org")
+}
+
+func TestQueueWebhook_EmitAfterClose(t *testing.T) {
+	t.Parallel()
+
+	wh := &webhook{
+		enabled: map[string]bool{eventQueued: true},
+		client:  http.DefaultClient,
+	}
+	wh.start(log.Logger{Out: log.NopOutput{}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				wh.emit(webhookEvent{Event: eventQueued, MsgID: "test"})
+			}
+		}()
+	}
+	wh.close()
+	wg.Wait()
+
+	// Should not panic.
+	wh.emit(webhookEvent{Event: eventQueued, MsgID: "test"})
+}
+
+func TestQueueWebhook_CloseStalled(t *testing.T) {
+	t.Parallel()
+
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	wh := &webhook{
+		url:     srv.URL,
+		enabled: map[string]bool{eventQueued: true},
+		retries: 5,
+		client:  &http.Client{Timeout: time.Hour},
+	}
+	wh.start(log.Logger{Out: log.NopOutput{}})
+	for i := 0; i < 10; i++ {
+		wh.emit(webhookEvent{Event: eventQueued, MsgID: "test"})
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		wh.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close is blocked by the stalled endpoint")
+	}
+}
@@ -100,6 +100,11 @@ func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostn
 	}
 	builder.WriteString(" id ")
 	builder.WriteString(msgMeta.ID)
+	if msgMeta.TraceID != "" {
+		builder.WriteString(" (trace ")
+		builder.WriteString(msgMeta.TraceID)
+		builder.WriteString(")")
+	}
 	builder.WriteString("; ")
 	builder.WriteString(time.Now().Format(time.RFC1123Z))
 
@@ -32,7 +32,10 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/proxy"
 	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type mxConn struct {
@@ -42,6 +45,10 @@ type mxConn struct {
 	domain   string
 	dnssecOk bool
 
+	// Key used for the connection in the pool, includes the source
+	// address if source_ips is used.
+	poolKey string
+
 	// Errors occurred previously on this connection.
 	errored bool
 
@@ -54,6 +61,9 @@ type mxConn struct {
 	// MX/TLS security level established for this connection.
 	mxLevel  module.MXLevel
 	tlsLevel module.TLSLevel
+
+	// Releases per-domain limits taken for the current transaction.
+	releaseDomainLimits func()
 }
 
 func (c *mxConn) Usable() bool {
@@ -162,6 +172,7 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	for _, p := range rd.policies {
 		policyLevel, err := p.CheckMX(connCtx, mxLevel, conn.domain, record.Host, conn.dnssecOk)
 		if err != nil {
+			rd.tlsrptRecord(connCtx, conn, record.Host, module.TLSNone, nil, p)
 			return err
 		}
 		if policyLevel > mxLevel {
@@ -185,6 +196,7 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	for _, p := range rd.policies {
 		policyLevel, err := p.CheckConn(connCtx, mxLevel, tlsLevel, conn.domain, record.Host, tlsState)
 		if err != nil {
+			rd.tlsrptRecord(connCtx, conn, record.Host, tlsLevel, tlsErr, p)
 			conn.Close()
 			return exterrors.WithFields(err, map[string]interface{}{"tls_err": tlsErr})
 		}
@@ -193,6 +205,8 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 		}
 	}
 
+	rd.tlsrptRecord(connCtx, conn, record.Host, tlsLevel, tlsErr, nil)
+
 	conn.mxLevel = mxLevel
 	conn.tlsLevel = tlsLevel
 
@@ -207,7 +221,37 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 		return c, nil
 	}
 
-	pooledConn, err := rd.rt.pool.Get(ctx, domain)
+	if rd.rt.domainLimits == nil {
+		return rd.newTransaction(ctx, domain)
+	}
+
+	// Taken before connecting to not open more connections than allowed.
+	region := trace.StartRegion(ctx, "remote/domainLimits.Take")
+	release, err := rd.rt.domainLimits.Take(ctx, domain)
+	region.End()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := rd.newTransaction(ctx, domain)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	conn.releaseDomainLimits = release
+	return conn, nil
+}
+
+// newTransaction gets a connection to the domain from the pool or opens a new
+// one and starts a transaction on it.
+func (rd *remoteDelivery) newTransaction(ctx context.Context, domain string) (*mxConn, error) {
+	var src *sourceIP
+	poolKey := domain
+	if rd.rt.sourceIPs != nil {
+		src = rd.rt.sourceIPs.pick(ctx, rd, domain)
+		poolKey = src.addr.String() + " " + domain
+	}
+
+	pooledConn, err := rd.rt.pool.Get(ctx, poolKey)
 	if err != nil {
 		return nil, err
 	}
@@ -222,11 +266,12 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 			"local_addr", conn.LocalAddr(), "remote_addr", conn.RemoteAddr())
 	} else {
 		rd.Log.DebugMsg("opening new connection", "domain", domain, "cache_ignored", pooledConn != nil)
-		conn, err = rd.newConn(ctx, domain)
+		conn, err = rd.newConn(ctx, domain, src)
 		if err != nil {
 			return nil, err
 		}
 	}
+	conn.poolKey = poolKey
 
 	if rd.msgMeta.SMTPOpts.RequireTLS {
 		if conn.tlsLevel < module.TLSAuthenticated {
@@ -283,7 +328,7 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 	return conn, nil
 }
 
-func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn, error) {
+func (rd *remoteDelivery) newConn(ctx context.Context, domain string, src *sourceIP) (*mxConn, error) {
 	conn := mxConn{
 		reuseLimit: rd.rt.connReuseLimit,
 		C:          smtpconn.New(),
@@ -291,9 +336,34 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 		lastUseAt:  time.Now(),
 	}
 
-	conn.Dialer = rd.rt.dialer
+	dial, v4, v6 := rd.rt.dialer, rd.rt.dialV4, rd.rt.dialV6
 	conn.Log = rd.Log
 	conn.Hostname = rd.rt.hostname
+	if src != nil {
+		dial = src.dialer
+		v4 = src.addr.To4() != nil
+		v6 = !v4
+		if src.hostname != "" {
+			conn.Hostname = src.hostname
+		}
+		rd.Log.DebugMsg("using source address", "domain", domain, "source_ip", src.addr, "hostname", conn.Hostname)
+	}
+	conn.Dialer = dial
+	proxyURL, err := rd.rt.proxy.Lookup(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case proxyURL != nil:
+		// Addresses are resolved by the proxy server.
+		conn.Dialer, err = proxy.Dialer(proxyURL, dial)
+		if err != nil {
+			return nil, err
+		}
+		rd.Log.DebugMsg("using proxy", "domain", domain, "proxy", proxyURL.Redacted())
+	case rd.rt.eyeballs != nil:
+		conn.Dialer = rd.rt.eyeballs.dialer(dial, v4, v6)
+	}
 	conn.AddrInSMTPMsg = true
 	if rd.rt.connectTimeout != 0 {
 		conn.ConnectTimeout = rd.rt.connectTimeout
@@ -310,7 +380,10 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	}
 
 	region := trace.StartRegion(ctx, "remote/LookupMX")
-	dnssecOk, records, err := rd.lookupMX(ctx, domain)
+	lookupCtx, lookupSpan := tracing.Start(ctx, "remote.lookup_mx", attribute.String("maddy.domain", domain))
+	dnssecOk, records, err := rd.lookupMX(lookupCtx, domain)
+	lookupSpan.SetAttributes(attribute.Bool("maddy.dnssec", dnssecOk))
+	tracing.End(lookupSpan, err)
 	region.End()
 	if err != nil {
 		return nil, err
@@ -319,7 +392,7 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 
 	var lastErr error
 	region = trace.StartRegion(ctx, "remote/Connect+TLS")
-	for _, record := range records {
+	for _, record := range rd.rt.mxFailures.sortMX(records) {
 		if record.Host == "." {
 			return nil, &exterrors.SMTPError{
 				Code:         556,
@@ -328,13 +401,27 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 			}
 		}
 
-		if err := rd.attemptMX(ctx, &conn, record); err != nil {
+		mxCtx, mxSpan := tracing.Start(ctx, "remote.connect",
+			attribute.String("maddy.domain", domain),
+			attribute.String("maddy.remote_server", record.Host))
+		err := rd.attemptMX(mxCtx, &conn, record)
+		if err == nil {
+			mxSpan.SetAttributes(
+				attribute.String("maddy.mx_level", conn.mxLevel.String()),
+				attribute.String("maddy.tls_level", conn.tlsLevel.String()))
+		}
+		tracing.End(mxSpan, err)
+		if err != nil {
 			if len(records) != 0 {
 				rd.Log.Error("cannot use MX", err, "remote_server", record.Host, "domain", domain)
 			}
+			if ctx.Err() == nil {
+				rd.rt.mxFailures.failed(record.Host)
+			}
 			lastErr = err
 			continue
 		}
+		rd.rt.mxFailures.succeeded(record.Host)
 		break
 	}
 	region.End()
@@ -0,0 +1,118 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+)
+
+// domainLimits applies concurrency and rate limits to deliveries on
+// per-destination-domain basis. Limits for each domain are looked up in the
+// table, domains not in the table use the default limits.
+//
+// Domains using the same limits specification share a BucketSet, so it is
+// safe to change table contents at run-time.
+type domainLimits struct {
+	table module.Table
+	def   string
+	log   log.Logger
+
+	setsLck sync.Mutex
+	sets    map[string]*limiters.BucketSet
+}
+
+// bucketSet returns the BucketSet for the limits specification or nil if spec
+// is empty.
+func (dl *domainLimits) bucketSet(spec string) (*limiters.BucketSet, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	dl.setsLck.Lock()
+	defer dl.setsLck.Unlock()
+
+	if set, ok := dl.sets[spec]; ok {
+		return set, nil
+	}
+
+	ctor, err := limits.ParseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	set := limiters.NewBucketSet(ctor, 1*time.Minute, 5000)
+	dl.sets[spec] = set
+	return set, nil
+}
+
+// Take acquires limits for the delivery to the domain. Returned function
+// should be called to release them.
+func (dl *domainLimits) Take(ctx context.Context, domain string) (func(), error) {
+	spec, ok, err := dl.table.Lookup(ctx, domain)
+	if err != nil {
+		dl.log.Error("limits lookup failed, using default", err, "domain", domain)
+		ok = false
+	}
+	if !ok {
+		spec = dl.def
+	}
+
+	set, err := dl.bucketSet(spec)
+	if err != nil {
+		dl.log.Error("malformed limits, using default", err, "domain", domain)
+		if set, err = dl.bucketSet(dl.def); err != nil {
+			return nil, err
+		}
+	}
+	if set == nil {
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := set.TakeContext(ctx, domain); err != nil {
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 5},
+			Message:      "Destination domain limits exceeded, try again later",
+			TargetName:   "remote",
+			Reason:       "Domain limit timeout",
+			Err:          err,
+			Misc: map[string]interface{}{
+				"domain": domain,
+			},
+		}
+	}
+	return func() { set.Release(domain) }, nil
+}
+
+func (dl *domainLimits) Close() {
+	dl.setsLck.Lock()
+	defer dl.setsLck.Unlock()
+	for _, set := range dl.sets {
+		set.Close()
+	}
+}
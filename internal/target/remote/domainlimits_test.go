@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDomainLimits(t *testing.T) {
+	dl := &domainLimits{
+		table: testutils.Table{M: map[string]string{
+			"example.org": "concurrency 1",
+			"example.net": "bogus 10",
+		}},
+		def:  "concurrency 2",
+		log:  log.Logger{Out: log.NopOutput{}},
+		sets: map[string]*limiters.BucketSet{},
+	}
+	defer dl.Close()
+
+	take := func(domain string, shouldFail bool) func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		release, err := dl.Take(ctx, domain)
+		if shouldFail {
+			if err == nil {
+				t.Fatal("Expected an error for", domain)
+			}
+			if !exterrors.IsTemporary(err) {
+				t.Error("Error is not temporary:", err)
+			}
+			return nil
+		}
+		if err != nil {
+			t.Fatal("Unexpected error for", domain, err)
+		}
+		return release
+	}
+
+	release := take("example.org", false)
+	take("example.org", true)
+	release()
+	take("example.org", false)()
+
+	// Default limits are applied to unknown domains and for malformed
+	// entries. Each domain gets its own counter.
+	take("example.com", false)
+	take("example.com", false)
+	take("example.com", true)
+	take("example.net", false)
+	take("example.net", false)
+	take("example.net", true)
+}
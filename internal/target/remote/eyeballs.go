@@ -0,0 +1,254 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// failureCache keeps track of recent connection failures for MX hosts and
+// their addresses so they can be tried last next time.
+type failureCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[string]time.Time
+}
+
+// sweepThreshold is the amount of entries after which expired ones are removed
+// from the failureCache.
+const sweepThreshold = 1000
+
+func newFailureCache(ttl time.Duration) *failureCache {
+	return &failureCache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+func (fc *failureCache) failed(key string) {
+	if fc == nil {
+		return
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	now := time.Now()
+	fc.entries[key] = now
+	if len(fc.entries) > sweepThreshold {
+		for k, t := range fc.entries {
+			if now.Sub(t) >= fc.ttl {
+				delete(fc.entries, k)
+			}
+		}
+	}
+}
+
+func (fc *failureCache) succeeded(key string) {
+	if fc == nil {
+		return
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	delete(fc.entries, key)
+}
+
+func (fc *failureCache) failing(key string) bool {
+	if fc == nil {
+		return false
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	t, ok := fc.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Since(t) >= fc.ttl {
+		delete(fc.entries, key)
+		return false
+	}
+	return true
+}
+
+// sortMX moves MX records that failed recently to the end of the list
+// preserving the order otherwise.
+func (fc *failureCache) sortMX(records []*net.MX) []*net.MX {
+	if fc == nil {
+		return records
+	}
+	sorted := make([]*net.MX, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return !fc.failing(sorted[i].Host) && fc.failing(sorted[j].Host)
+	})
+	return sorted
+}
+
+// happyEyeballs implements connection racing described in RFC 8305.
+//
+// Addresses of the host are resolved, sorted so that address families
+// alternate and recently failed addresses are tried last. Then connection
+// attempts are started one by one with the delay between them, without
+// waiting for previous ones to complete. The first established connection
+// is used.
+type happyEyeballs struct {
+	resolver dns.Resolver
+	delay    time.Duration
+	failures *failureCache
+}
+
+// dialer wraps the passed dial function to race connections to all addresses
+// of the host. v4 and v6 specify allowed address families.
+func (he *happyEyeballs) dialer(dial dialFunc, v4, v6 bool) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		ipAddrs, err := he.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := he.sortAddrs(ipAddrs, v4, v6)
+		if len(ips) == 0 {
+			return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+		}
+
+		return he.race(ctx, dial, ips, port)
+	}
+}
+
+// sortAddrs orders addresses as described in RFC 8305 Section 4. IPv6 is
+// preferred, addresses that failed recently are tried after all other ones.
+func (he *happyEyeballs) sortAddrs(addrs []net.IPAddr, v4, v6 bool) []net.IP {
+	var good4, good6, bad4, bad6 []net.IP
+	for _, addr := range addrs {
+		is4 := addr.IP.To4() != nil
+		if (is4 && !v4) || (!is4 && !v6) {
+			continue
+		}
+		failing := he.failures.failing(addr.IP.String())
+		switch {
+		case is4 && !failing:
+			good4 = append(good4, addr.IP)
+		case is4:
+			bad4 = append(bad4, addr.IP)
+		case !failing:
+			good6 = append(good6, addr.IP)
+		default:
+			bad6 = append(bad6, addr.IP)
+		}
+	}
+
+	res := make([]net.IP, 0, len(addrs))
+	res = interleaveAddrs(res, good6, good4)
+	res = interleaveAddrs(res, bad6, bad4)
+	return res
+}
+
+func interleaveAddrs(res, first, second []net.IP) []net.IP {
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+func (he *happyEyeballs) race(ctx context.Context, dial dialFunc, ips []net.IP, port string) (net.Conn, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() <-chan time.Time {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			network := "tcp6"
+			if ip.To4() != nil {
+				network = "tcp4"
+			}
+			conn, err := dial(raceCtx, network, net.JoinHostPort(ip.String(), port))
+			results <- dialResult{conn: conn, ip: ip, err: err}
+		}()
+		if next == len(ips) {
+			return nil
+		}
+		return time.After(he.delay)
+	}
+
+	nextAttempt := start()
+	var firstErr error
+	for pending != 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				he.failures.succeeded(res.ip.String())
+				// Close connections of attempts that will complete later.
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+
+			if ctx.Err() == nil {
+				he.failures.failed(res.ip.String())
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			// Do not wait for the delay to expire if the attempt failed.
+			if next < len(ips) {
+				nextAttempt = start()
+			}
+		case <-nextAttempt:
+			nextAttempt = start()
+		}
+	}
+
+	return nil, firstErr
+}
@@ -0,0 +1,183 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestHappyEyeballs_SortAddrs(t *testing.T) {
+	he := happyEyeballs{failures: newFailureCache(time.Minute)}
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("192.0.2.3")},
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("2001:db8::2")},
+	}
+	he.failures.failed("2001:db8::1")
+
+	test := func(v4, v6 bool, expected ...string) {
+		t.Helper()
+		actual := []string{}
+		for _, ip := range he.sortAddrs(addrs, v4, v6) {
+			actual = append(actual, ip.String())
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Wrong order: %v, expected %v", actual, expected)
+		}
+	}
+
+	test(true, true, "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1")
+	test(true, false, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	test(false, true, "2001:db8::2", "2001:db8::1")
+}
+
+func TestHappyEyeballs_Race(t *testing.T) {
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"mx.example.invalid.": {
+			A:    []string{"192.0.2.1"},
+			AAAA: []string{"2001:db8::1"},
+		},
+	}}
+	he := happyEyeballs{
+		resolver: resolver,
+		delay:    50 * time.Millisecond,
+		failures: newFailureCache(time.Minute),
+	}
+
+	var v6Broken atomic.Bool
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp6" {
+			if v6Broken.Load() {
+				return nil, errors.New("network unreachable")
+			}
+			// Broken path, the attempt hangs until cancelled.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	start := time.Now()
+	conn, err := he.dialer(dial, true, true)(context.Background(), "tcp", "mx.example.invalid:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if time.Since(start) > time.Second {
+		t.Fatal("Connection was not raced:", time.Since(start))
+	}
+	if he.failures.failing("2001:db8::1") {
+		t.Fatal("Cancelled attempt should not be recorded as a failure")
+	}
+
+	v6Broken.Store(true)
+	conn, err = he.dialer(dial, true, true)(context.Background(), "tcp", "mx.example.invalid:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !he.failures.failing("2001:db8::1") {
+		t.Fatal("Failed address is not recorded")
+	}
+
+	_, err = he.dialer(dial, false, true)(context.Background(), "tcp", "mx.example.invalid:25")
+	if err == nil {
+		t.Fatal("Expected an error when all addresses fail")
+	}
+}
+
+func TestFailureCache_SortMX(t *testing.T) {
+	fc := newFailureCache(time.Minute)
+	records := []*net.MX{
+		{Host: "mx1.example.invalid.", Pref: 10},
+		{Host: "mx2.example.invalid.", Pref: 10},
+		{Host: "mx3.example.invalid.", Pref: 20},
+	}
+
+	fc.failed("mx1.example.invalid.")
+	sorted := fc.sortMX(records)
+	if sorted[0].Host != "mx2.example.invalid." || sorted[1].Host != "mx3.example.invalid." || sorted[2].Host != "mx1.example.invalid." {
+		t.Fatalf("Wrong order: %v %v %v", sorted[0].Host, sorted[1].Host, sorted[2].Host)
+	}
+
+	fc.succeeded("mx1.example.invalid.")
+	if sorted := fc.sortMX(records); sorted[0].Host != "mx1.example.invalid." {
+		t.Fatal("Host is still considered failing after success")
+	}
+
+	fc.ttl = 0
+	fc.failed("mx1.example.invalid.")
+	if fc.failing("mx1.example.invalid.") {
+		t.Fatal("Expired entry is considered failing")
+	}
+}
+
+func TestRemoteDelivery_HappyEyeballs(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{
+				{Host: "mx1.example.invalid.", Pref: 10},
+				{Host: "mx2.example.invalid.", Pref: 20},
+			},
+		},
+		// Nothing listens on these.
+		"mx1.example.invalid.": {
+			A: []string{"127.0.0.2"},
+		},
+		"mx2.example.invalid.": {
+			A:    []string{"127.0.0.1"},
+			AAAA: []string{"::1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+	tgt.dialV4, tgt.dialV6 = true, true
+	tgt.mxFailures = newFailureCache(time.Minute)
+	tgt.eyeballs = &happyEyeballs{
+		resolver: tgt.resolver,
+		delay:    50 * time.Millisecond,
+		failures: tgt.mxFailures,
+	}
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	if !tgt.mxFailures.failing("mx1.example.invalid.") {
+		t.Error("Failed MX is not recorded")
+	}
+	if tgt.mxFailures.failing("mx2.example.invalid.") {
+		t.Error("Working MX is recorded as failing")
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+var (
+	// ipBlocklistMsg matches names of well-known DNS blocklists and
+	// reputation services.
+	ipBlocklistMsg = regexp.MustCompile(`(?i)\b(spamhaus|spamcop|barracuda|sorbs|uceprotect|dnsbl|rbl|(block|black|deny) ?list(ed)?)\b`)
+
+	// ipRejectionMsg matches the common wording used by servers rejecting
+	// connections because of the client IP reputation. Both the reference
+	// to the client IP and the rejection reason are required, since messages
+	// like "recipient not listed" or "blocked by content filter" are
+	// used for other rejections too.
+	ipRejectionMsg = regexp.MustCompile(`(?i)\b(ip(v4|v6)?|client host|sending host|connecting host|your host)\b.*\b(block(ed)?|listed|reputation|banned)\b|` +
+		`\b(block(ed)?|listed|reputation|banned)\b.*\b(ip(v4|v6)?|client host|sending host|connecting host|your host)\b`)
+)
+
+// isIPRejection reports whether the error looks like the rejection because
+// of the server IP reputation.
+func isIPRejection(err error) bool {
+	fields := exterrors.Fields(err)
+	code, _ := fields["smtp_code"].(int)
+	if code/100 != 4 && code/100 != 5 {
+		return false
+	}
+	msg, _ := fields["smtp_msg"].(string)
+	return ipBlocklistMsg.MatchString(msg) || ipRejectionMsg.MatchString(msg)
+}
+
+// fallbackState tracks destination domains that should be temporarily
+// delivered to using the fallback relay.
+type fallbackState struct {
+	after    int
+	duration time.Duration
+
+	lock    sync.Mutex
+	domains map[string]*fallbackDomain
+}
+
+type fallbackDomain struct {
+	failures    int
+	activeUntil time.Time
+}
+
+func (s *fallbackState) active(domain string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d, ok := s.domains[domain]
+	if !ok {
+		return false
+	}
+	if d.activeUntil.IsZero() {
+		return false
+	}
+	if time.Now().After(d.activeUntil) {
+		// Try direct delivery again.
+		delete(s.domains, domain)
+		return false
+	}
+	return true
+}
+
+func (s *fallbackState) activate(domain string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cleanup()
+	s.domains[domain] = &fallbackDomain{activeUntil: time.Now().Add(s.duration)}
+}
+
+// failed records the failed direct delivery attempt and reports whether
+// the fallback relay was activated for the domain.
+func (s *fallbackState) failed(domain string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d, ok := s.domains[domain]
+	if !ok {
+		s.cleanup()
+		d = &fallbackDomain{}
+		s.domains[domain] = d
+	}
+	d.failures++
+	if d.failures >= s.after && d.activeUntil.IsZero() {
+		d.activeUntil = time.Now().Add(s.duration)
+		return true
+	}
+	return false
+}
+
+func (s *fallbackState) succeeded(domain string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.domains, domain)
+}
+
+// cleanup removes expired entries if there are too many of them.
+func (s *fallbackState) cleanup() {
+	if len(s.domains) < 10000 {
+		return
+	}
+	now := time.Now()
+	for domain, d := range s.domains {
+		if d.activeUntil.IsZero() || now.After(d.activeUntil) {
+			delete(s.domains, domain)
+		}
+	}
+}
+
+// directFailed handles the failure of the direct delivery to the domain. It
+// returns the error that should be reported for the recipient to, or nil if
+// the recipient was accepted by the fallback relay instead.
+func (rd *remoteDelivery) directFailed(ctx context.Context, domain, to string, opts smtp.RcptOptions, err error, countFailure bool) error {
+	if rd.rt.fallback == nil {
+		return err
+	}
+
+	if isIPRejection(err) {
+		rd.Log.Error("destination rejected our IP, using fallback relay", err, "domain", domain)
+		rd.rt.fallbackState.activate(domain)
+		return rd.addFallbackRcpt(ctx, to, opts)
+	}
+
+	if countFailure && exterrors.IsTemporaryOrUnspec(err) {
+		if _, ok := rd.failedDomains[domain]; !ok {
+			rd.failedDomains[domain] = struct{}{}
+			if rd.rt.fallbackState.failed(domain) {
+				rd.Log.Msg("too many failed direct delivery attempts, using fallback relay", "domain", domain,
+					"duration", rd.rt.fallbackState.duration)
+			}
+		}
+	}
+	return err
+}
+
+func (rd *remoteDelivery) addFallbackRcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
+	if rd.fallback == nil {
+		delivery, err := rd.rt.fallback.Start(ctx, rd.msgMeta, rd.mailFrom)
+		if err != nil {
+			return err
+		}
+		rd.fallback = delivery
+	}
+	if err := rd.fallback.AddRcpt(ctx, to, opts); err != nil {
+		return err
+	}
+	rd.Log.DebugMsg("using fallback relay", "rcpt", to)
+	rd.fallbackRcpts = append(rd.fallbackRcpts, to)
+	return nil
+}
+
+// dataResult updates the fallback state using the result of the message
+// transfer to the domain. IP rejections are converted to temporary errors
+// since the next attempt will use the fallback relay.
+func (rd *remoteDelivery) dataResult(domain string, err error) error {
+	if err == nil {
+		rd.rt.fallbackState.succeeded(domain)
+		return nil
+	}
+	if isIPRejection(err) {
+		rd.Log.Error("destination rejected our IP, will use fallback relay", err, "domain", domain)
+		rd.rt.fallbackState.activate(domain)
+		return exterrors.WithTemporary(err, true)
+	}
+	if exterrors.IsTemporaryOrUnspec(err) {
+		if rd.rt.fallbackState.failed(domain) {
+			rd.Log.Msg("too many failed direct delivery attempts, using fallback relay", "domain", domain,
+				"duration", rd.rt.fallbackState.duration)
+		}
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRemoteDelivery_FallbackOnIPRejection(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	be.RcptErr = map[string]error{
+		"test@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Client host blocked using zen.spamhaus.org",
+		},
+	}
+
+	relay := testutils.Target{}
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.fallback = &relay
+	tgt.fallbackState = &fallbackState{
+		after:    3,
+		duration: time.Hour,
+		domains:  map[string]*fallbackDomain{},
+	}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	testutils.CheckTestMessage(t, &relay, 0, "test@example.com", []string{"test@example.invalid"})
+	if len(be.Messages) != 0 {
+		t.Error("Message delivered directly")
+	}
+
+	// Next delivery should not attempt direct delivery at all.
+	be.RcptErr = nil
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test2@example.invalid"})
+	testutils.CheckTestMessage(t, &relay, 1, "test@example.com", []string{"test2@example.invalid"})
+	if len(be.Messages) != 0 {
+		t.Error("Message delivered directly")
+	}
+}
+
+func TestFallbackState(t *testing.T) {
+	s := &fallbackState{
+		after:    2,
+		duration: time.Hour,
+		domains:  map[string]*fallbackDomain{},
+	}
+
+	if s.failed("example.org") {
+		t.Fatal("Activated after the first failure")
+	}
+	s.succeeded("example.org")
+	if s.failed("example.org") {
+		t.Fatal("Failures counter is not reset on success")
+	}
+	if !s.failed("example.org") {
+		t.Fatal("Not activated after the second failure")
+	}
+	if !s.active("example.org") || s.active("example.com") {
+		t.Fatal("Wrong active state")
+	}
+
+	s.domains["example.org"].activeUntil = time.Now().Add(-time.Second)
+	if s.active("example.org") {
+		t.Fatal("Fallback is still used after duration")
+	}
+}
+
+func TestIsIPRejection(t *testing.T) {
+	for msg, expected := range map[string]bool{
+		"Client host blocked using zen.spamhaus.org":                                      true,
+		"Service unavailable; Client host [192.0.2.1] blocked using Barracuda Reputation": true,
+		"Your IP 192.0.2.1 is listed at bl.spamcop.net":                                   true,
+		"Access denied, banned sending IP [192.0.2.1]":                                    true,
+		"Sending IP has poor reputation":                                                  true,
+		"JunkMail rejected - 192.0.2.1 is in an RBL":                                      true,
+		"Recipient not listed in directory":                                               false,
+		"Message blocked by content filter":                                               false,
+		"User unknown":                                                                    false,
+		"Mailbox is full":                                                                 false,
+		"Message content rejected, spam detected":                                         false,
+	} {
+		err := &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      msg,
+		}
+		if actual := isIPRejection(err); actual != expected {
+			t.Errorf("%q: expected %v, got %v", msg, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// policyTable parses the table directive value and ensures that the table
+// can be used to store policies.
+func policyTable(cfg *config.Map, node config.Node) (interface{}, error) {
+	var tbl module.Table
+	if err := modconfig.ModuleFromNode("table", node.Args, node, cfg.Globals, &tbl); err != nil {
+		return nil, err
+	}
+	mutable, ok := tbl.(module.MutableTable)
+	if !ok {
+		return nil, config.NodeErr(node, "table is not mutable, cannot use it as a cache")
+	}
+	return mutable, nil
+}
+
+// tableSTSStore implements mtasts.Store using the mutable table, this allows
+// to share the cache between multiple instances by using a SQL table.
+type tableSTSStore struct {
+	tbl module.MutableTable
+}
+
+type stsStoreEntry struct {
+	ID        string
+	FetchTime time.Time
+	Policy    *mtasts.Policy
+}
+
+func (s tableSTSStore) List() ([]string, error) {
+	return s.tbl.Keys()
+}
+
+func (s tableSTSStore) Store(domain, id string, fetchTime time.Time, p *mtasts.Policy) error {
+	val, err := json.Marshal(stsStoreEntry{
+		ID:        id,
+		FetchTime: fetchTime,
+		Policy:    p,
+	})
+	if err != nil {
+		return err
+	}
+	return s.tbl.SetKey(domain, string(val))
+}
+
+func (s tableSTSStore) Load(domain string) (id string, fetchTime time.Time, p *mtasts.Policy, err error) {
+	val, ok, err := s.tbl.Lookup(context.TODO(), domain)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	if !ok {
+		return "", time.Time{}, nil, mtasts.ErrNoPolicy
+	}
+
+	var entry stsStoreEntry
+	if err := json.Unmarshal([]byte(val), &entry); err != nil {
+		return "", time.Time{}, nil, fmt.Errorf("malformed cache entry for %s: %w", domain, err)
+	}
+	return entry.ID, entry.FetchTime, entry.Policy, nil
+}
+
+// tlsaCache keeps TLSA records discovered for MX hosts.
+//
+// Cached records are used instead of doing the lookup for refresh period and
+// are enforced if the lookup fails for up to maxAge. Only non-empty record
+// sets are cached.
+type tlsaCache struct {
+	tbl     module.MutableTable
+	refresh time.Duration
+	maxAge  time.Duration
+}
+
+type tlsaCacheEntry struct {
+	FetchTime time.Time
+	Records   []tlsaCacheRecord
+}
+
+type tlsaCacheRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Certificate  string
+}
+
+func (c *tlsaCache) get(ctx context.Context, mx string) ([]dns.TLSA, time.Time, error) {
+	val, ok, err := c.tbl.Lookup(ctx, mx)
+	if err != nil || !ok {
+		return nil, time.Time{}, err
+	}
+
+	var entry tlsaCacheEntry
+	if err := json.Unmarshal([]byte(val), &entry); err != nil {
+		return nil, time.Time{}, fmt.Errorf("malformed cache entry for %s: %w", mx, err)
+	}
+	recs := make([]dns.TLSA, 0, len(entry.Records))
+	for _, r := range entry.Records {
+		recs = append(recs, dns.TLSA{
+			Usage:        r.Usage,
+			Selector:     r.Selector,
+			MatchingType: r.MatchingType,
+			Certificate:  r.Certificate,
+		})
+	}
+	return recs, entry.FetchTime, nil
+}
+
+func (c *tlsaCache) store(mx string, recs []dns.TLSA) error {
+	entry := tlsaCacheEntry{
+		FetchTime: time.Now(),
+		Records:   make([]tlsaCacheRecord, 0, len(recs)),
+	}
+	for _, r := range recs {
+		entry.Records = append(entry.Records, tlsaCacheRecord{
+			Usage:        r.Usage,
+			Selector:     r.Selector,
+			MatchingType: r.MatchingType,
+			Certificate:  r.Certificate,
+		})
+	}
+	val, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.tbl.SetKey(mx, string(val))
+}
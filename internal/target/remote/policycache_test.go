@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type memTable struct {
+	lock sync.Mutex
+	m    map[string]string
+}
+
+func (t *memTable) Lookup(_ context.Context, k string) (string, bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	v, ok := t.m[k]
+	return v, ok, nil
+}
+
+func (t *memTable) Keys() ([]string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	keys := make([]string, 0, len(t.m))
+	for k := range t.m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (t *memTable) RemoveKey(k string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.m, k)
+	return nil
+}
+
+func (t *memTable) SetKey(k, v string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.m[k] = v
+	return nil
+}
+
+func TestTableSTSStore(t *testing.T) {
+	s := tableSTSStore{tbl: &memTable{m: map[string]string{}}}
+
+	if _, _, _, err := s.Load("example.org"); !errors.Is(err, mtasts.ErrNoPolicy) {
+		t.Fatal("Expected ErrNoPolicy, got", err)
+	}
+
+	policy := &mtasts.Policy{
+		Mode:   mtasts.ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	fetchTime := time.Now().Truncate(time.Second)
+	if err := s.Store("example.org", "id1", fetchTime, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	id, gotTime, gotPolicy, err := s.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "id1" || !gotTime.Equal(fetchTime) || !reflect.DeepEqual(gotPolicy, policy) {
+		t.Error("Wrong entry loaded:", id, gotTime, gotPolicy)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []string{"example.org"}) {
+		t.Error("Wrong list:", list)
+	}
+}
+
+func TestRemoteDelivery_DANE_Cache(t *testing.T) {
+	_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			AD: true,
+			A:  []string{"127.0.0.1"},
+		},
+		"_25._tcp.mx.example.invalid.": {
+			AD: true,
+			Misc: tlsaRecord(
+				"_25._tcp.mx.example.invalid.",
+				3, 1, 1, "a9b5cb4d02f996f6385debe9a8952f1af1f4aec7eae0f37c2cd6d0d8ee8391cf"),
+		},
+	}
+
+	tbl := &memTable{m: map[string]string{}}
+	cachingTarget := func(zones map[string]mockdns.Zone) *Target {
+		dnsSrv, tgt := targetWithExtResolver(t, zones)
+		t.Cleanup(func() { dnsSrv.Close() })
+		tgt.policies[0].(*danePolicy).cache = &tlsaCache{
+			tbl:     tbl,
+			refresh: 0, // Always attempt the lookup.
+			maxAge:  time.Hour,
+		}
+		tgt.policies = append(tgt.policies,
+			&localPolicy{
+				minTLSLevel: module.TLSAuthenticated,
+			},
+		)
+		return tgt
+	}
+
+	testutils.DoTestDelivery(t, cachingTarget(zones), "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	if _, ok, _ := tbl.Lookup(context.Background(), "mx.example.invalid."); !ok {
+		t.Fatal("TLSA records are not cached")
+	}
+
+	// Resolver failure, cached records should be used. New zones are used
+	// since the previous DNS server can still serve the queries made for
+	// the first delivery.
+	failZones := make(map[string]mockdns.Zone, len(zones))
+	for name, zone := range zones {
+		failZones[name] = zone
+	}
+	failZones["_25._tcp.mx.example.invalid."] = mockdns.Zone{
+		Err: errors.New("SERVFAIL"),
+	}
+	testutils.DoTestDelivery(t, cachingTarget(failZones), "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.com", []string{"test@example.invalid"})
+}
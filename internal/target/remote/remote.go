@@ -46,8 +46,13 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+	"github.com/foxcpp/maddy/internal/proxy"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tracing"
+	"github.com/foxcpp/maddy/internal/traffic"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/idna"
 )
 
@@ -69,9 +74,23 @@ type Target struct {
 	resolver    dns.Resolver
 	dialer      func(ctx context.Context, network, addr string) (net.Conn, error)
 	extResolver *dns.ExtResolver
+	// Connection racing for dual-stack hosts, nil to use dialer as is.
+	eyeballs *happyEyeballs
+	// Address families allowed by local_ip and force_ipv4.
+	dialV4, dialV6 bool
+	// Recent connection failures for MX hosts, nil if not tracked.
+	mxFailures *failureCache
+	// Proxies for outbound connections selected by recipient domain.
+	proxy *proxy.Selector
 
 	policies          []module.MXAuthPolicy
 	limits            *limits.Group
+	domainLimits      *domainLimits
+	fallback          module.DeliveryTarget
+	sourceIPs         *sourcePool
+	sourceIPMap       module.Table
+	fallbackState     *fallbackState
+	tlsrpt            *tlsrptReporter
 	allowSecOverride  bool
 	relaxedREQUIRETLS bool
 
@@ -96,12 +115,16 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 		name:     instName,
 		resolver: dns.DefaultResolver(),
 		dialer:   (&net.Dialer{}).DialContext,
-		Log:      log.Logger{Name: "remote"},
+		Log:      log.Logger{Name: "remote", Instance: instName},
 	}, nil
 }
 
 func (rt *Target) Init(cfg *config.Map) error {
-	var err error
+	var (
+		err             error
+		sourceIPs       []*sourceIP
+		sourceSelection string
+	)
 	rt.extResolver, err = dns.NewExtResolver()
 	if err != nil {
 		rt.Log.Error("cannot initialize DNSSEC-aware resolver, DNSSEC and DANE are not available", err)
@@ -110,6 +133,10 @@ func (rt *Target) Init(cfg *config.Map) error {
 	cfg.String("hostname", true, true, "", &rt.hostname)
 	cfg.String("local_ip", false, false, "", &rt.localIP)
 	cfg.Bool("force_ipv4", false, false, &rt.ipv4)
+	cfg.Custom("source_ips", false, false, nil, parseSourceIPs, &sourceIPs)
+	cfg.Enum("source_ip_selection", false, false,
+		[]string{sourceRoundRobin, sourceSender, sourceDestination}, sourceRoundRobin, &sourceSelection)
+	modconfig.Table(cfg, "source_ip_map", false, false, nil, &rt.sourceIPMap)
 	cfg.Bool("debug", true, false, &rt.Log.Debug)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return &tls.Config{}, nil
@@ -135,12 +162,31 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &rt.limits)
+	var (
+		domainLimitsTbl module.Table
+		domainLimitsDef string
+		fallbackAfter   int
+		fallbackFor     time.Duration
+	)
+	cfg.Custom("fallback", false, false, nil, modconfig.DeliveryDirective, &rt.fallback)
+	cfg.Int("fallback_after", false, false, 3, &fallbackAfter)
+	cfg.Duration("fallback_duration", false, false, 1*time.Hour, &fallbackFor)
+	cfg.Custom("tlsrpt", false, false, nil, parseTLSRPT, &rt.tlsrpt)
+	modconfig.Table(cfg, "domain_limits", false, false, nil, &domainLimitsTbl)
+	cfg.String("domain_limits_default", false, false, "", &domainLimitsDef)
 	cfg.Bool("requiretls_override", false, true, &rt.allowSecOverride)
 	cfg.Bool("relaxed_requiretls", false, true, &rt.relaxedREQUIRETLS)
 	cfg.Int("conn_reuse_limit", false, false, 10, &rt.connReuseLimit)
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &rt.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &rt.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &rt.submissionTimeout)
+	var (
+		eyeballsDelay time.Duration
+		failureTTL    time.Duration
+	)
+	cfg.Duration("happy_eyeballs_delay", false, false, 250*time.Millisecond, &eyeballsDelay)
+	cfg.Duration("mx_failure_ttl", false, false, 10*time.Minute, &failureTTL)
+	cfg.Custom("proxy", false, false, nil, proxy.ParseDirective, &rt.proxy)
 
 	poolCfg := pool.Config{
 		MaxKeys:             5000,
@@ -156,12 +202,58 @@ func (rt *Target) Init(cfg *config.Map) error {
 	}
 	rt.pool = pool.New(poolCfg)
 
+	if fallbackAfter < 1 {
+		return errors.New("remote: fallback_after should be at least 1")
+	}
+	rt.fallbackState = &fallbackState{
+		after:    fallbackAfter,
+		duration: fallbackFor,
+		domains:  map[string]*fallbackDomain{},
+	}
+
+	if rt.tlsrpt != nil {
+		if err := rt.tlsrpt.init(rt.hostname, rt.resolver, rt.Log); err != nil {
+			return err
+		}
+		rt.tlsrpt.Start()
+	}
+
+	if domainLimitsTbl != nil {
+		rt.domainLimits = &domainLimits{
+			table: domainLimitsTbl,
+			def:   domainLimitsDef,
+			log:   rt.Log,
+			sets:  map[string]*limiters.BucketSet{},
+		}
+		if _, err := rt.domainLimits.bucketSet(domainLimitsDef); err != nil {
+			return fmt.Errorf("remote: domain_limits_default: %w", err)
+		}
+	} else if domainLimitsDef != "" {
+		return errors.New("remote: domain_limits_default requires domain_limits table")
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	rt.hostname, err = idna.ToASCII(rt.hostname)
 	if err != nil {
 		return fmt.Errorf("remote: cannot represent the hostname as an A-label name: %w", err)
 	}
 
+	if len(sourceIPs) != 0 {
+		if rt.localIP != "" {
+			return errors.New("remote: local_ip and source_ips can't be used together")
+		}
+		for _, src := range sourceIPs {
+			if rt.ipv4 && src.addr.To4() == nil {
+				return fmt.Errorf("remote: force_ipv4 is set, but source IP %v is not an IPv4 address", src.addr)
+			}
+		}
+		rt.sourceIPs = &sourcePool{
+			ips:       sourceIPs,
+			selection: sourceSelection,
+		}
+	}
+
+	rt.dialV4, rt.dialV6 = true, !rt.ipv4
 	if rt.localIP != "" {
 		addr, err := net.ResolveTCPAddr("tcp", rt.localIP+":0")
 		if err != nil {
@@ -170,6 +262,10 @@ func (rt *Target) Init(cfg *config.Map) error {
 		rt.dialer = (&net.Dialer{
 			LocalAddr: addr,
 		}).DialContext
+		if !addr.IP.IsUnspecified() {
+			rt.dialV4 = addr.IP.To4() != nil
+			rt.dialV6 = !rt.dialV4
+		}
 	}
 	if rt.ipv4 {
 		dial := rt.dialer
@@ -181,11 +277,30 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 	}
 
+	if failureTTL != 0 {
+		rt.mxFailures = newFailureCache(failureTTL)
+	}
+	if eyeballsDelay != 0 {
+		rt.eyeballs = &happyEyeballs{
+			resolver: rt.resolver,
+			delay:    eyeballsDelay,
+			failures: rt.mxFailures,
+		}
+	}
+
 	return nil
 }
 
 func (rt *Target) Close() error {
 	rt.pool.Close()
+	if rt.domainLimits != nil {
+		rt.domainLimits.Close()
+	}
+	if rt.tlsrpt != nil {
+		if err := rt.tlsrpt.Close(); err != nil {
+			rt.Log.Error("failed to save TLSRPT statistics", err)
+		}
+	}
 
 	return nil
 }
@@ -207,6 +322,12 @@ type remoteDelivery struct {
 	recipients  []string
 	connections map[string]*mxConn
 
+	// Delivery to the fallback relay, nil if it is not used.
+	fallback      module.Delivery
+	fallbackRcpts []string
+	// Domains for which failed direct delivery was already recorded.
+	failedDomains map[string]struct{}
+
 	policies []module.DeliveryMXAuthPolicy
 }
 
@@ -261,12 +382,13 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 	region.End()
 
 	return &remoteDelivery{
-		rt:          rt,
-		mailFrom:    mailFrom,
-		msgMeta:     msgMeta,
-		Log:         target.DeliveryLogger(rt.Log, msgMeta),
-		connections: map[string]*mxConn{},
-		policies:    policies,
+		rt:            rt,
+		mailFrom:      mailFrom,
+		msgMeta:       msgMeta,
+		Log:           target.DeliveryLogger(rt.Log, msgMeta),
+		connections:   map[string]*mxConn{},
+		policies:      policies,
+		failedDomains: map[string]struct{}{},
 	}, nil
 }
 
@@ -307,13 +429,17 @@ func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string, opts smtp.Rcpt
 		}
 	}
 
+	if rd.rt.fallback != nil && rd.rt.fallbackState.active(domain) {
+		return rd.addFallbackRcpt(ctx, to, opts)
+	}
+
 	conn, err := rd.connectionForDomain(ctx, domain)
 	if err != nil {
-		return err
+		return rd.directFailed(ctx, domain, to, opts, err, true)
 	}
 
 	if err := conn.Rcpt(ctx, to, opts); err != nil {
-		return moduleError(err)
+		return rd.directFailed(ctx, domain, to, opts, moduleError(err), false)
 	}
 	conn.lastUseAt = time.Now()
 
@@ -405,6 +531,8 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 
 	var wg sync.WaitGroup
 
+	msgSize := traffic.MessageSize(header, b)
+	senderDomain := traffic.Domain(rd.mailFrom)
 	for i, conn := range rd.connections {
 		i := i
 		conn := conn
@@ -421,31 +549,73 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 			}
 			defer bodyR.Close()
 
-			err = conn.Data(ctx, header, bodyR)
+			dataCtx, dataSpan := tracing.Start(ctx, "remote.data",
+				attribute.String("maddy.domain", conn.domain),
+				attribute.Int("maddy.rcpt_count", len(conn.Rcpts())))
+			err = conn.Data(dataCtx, header, bodyR)
+			tracing.End(dataSpan, err)
+			if rd.rt.fallback != nil {
+				err = rd.dataResult(conn.domain, err)
+			}
 			for _, rcpt := range conn.Rcpts() {
 				c.SetStatus(rcpt, err)
 			}
+			if err == nil {
+				traffic.Account(traffic.Sent, senderDomain, conn.domain, msgSize)
+			}
 			rd.connections[i].errored = err != nil
 			conn.lastUseAt = time.Now()
 		}()
 	}
 
+	if rd.fallback != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			partDelivery, ok := rd.fallback.(module.PartialDelivery)
+			if ok {
+				partDelivery.BodyNonAtomic(ctx, c, header.Copy(), b)
+				return
+			}
+			err := rd.fallback.Body(ctx, header.Copy(), b)
+			for _, rcpt := range rd.fallbackRcpts {
+				c.SetStatus(rcpt, err)
+			}
+		}()
+	}
+
 	wg.Wait()
 }
 
 func (rd *remoteDelivery) Abort(ctx context.Context) error {
+	if rd.fallback != nil {
+		if err := rd.fallback.Abort(ctx); err != nil {
+			rd.Log.Error("fallback delivery.Abort failed", err)
+		}
+	}
 	return rd.Close()
 }
 
 func (rd *remoteDelivery) Commit(ctx context.Context) error {
 	// It is not possible to implement it atomically, so users of remoteDelivery have to
 	// take care of partial failures.
+	if rd.fallback != nil {
+		if err := rd.fallback.Commit(ctx); err != nil {
+			rd.Close()
+			return err
+		}
+	}
 	return rd.Close()
 }
 
 func (rd *remoteDelivery) Close() error {
 	for _, conn := range rd.connections {
 		rd.rt.limits.ReleaseDest(conn.domain)
+		if conn.releaseDomainLimits != nil {
+			conn.releaseDomainLimits()
+			conn.releaseDomainLimits = nil
+		}
 		conn.transactions++
 
 		if !conn.Usable() {
@@ -454,7 +624,7 @@ func (rd *remoteDelivery) Close() error {
 			conn.Close()
 		} else {
 			rd.Log.Debugf("returning connection %v for %s to pool", conn.LocalAddr(), conn.ServerName())
-			rd.rt.pool.Return(conn.domain, conn)
+			rd.rt.pool.Return(conn.poolKey, conn)
 		}
 	}
 
@@ -40,6 +40,7 @@ type (
 	mtastsPolicy struct {
 		cache       *mtasts.Cache
 		mtastsGet   func(context.Context, string) (*mtasts.Policy, error)
+		refresh     time.Duration
 		updaterStop chan struct{}
 		log         log.Logger
 		instName    string
@@ -75,9 +76,12 @@ func (c *mtastsPolicy) Init(cfg *config.Map) error {
 	var (
 		storeType string
 		storeDir  string
+		storeTbl  module.MutableTable
 	)
-	cfg.Enum("cache", false, false, []string{"ram", "fs"}, "fs", &storeType)
+	cfg.Enum("cache", false, false, []string{"ram", "fs", "table"}, "fs", &storeType)
 	cfg.String("fs_dir", false, false, "mtasts_cache", &storeDir)
+	cfg.Custom("table", false, false, nil, policyTable, &storeTbl)
+	cfg.Duration("refresh_interval", false, false, 12*time.Hour, &c.refresh)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -90,6 +94,11 @@ func (c *mtastsPolicy) Init(cfg *config.Map) error {
 		c.cache = mtasts.NewFSCache(storeDir)
 	case "ram":
 		c.cache = mtasts.NewRAMCache()
+	case "table":
+		if storeTbl == nil {
+			return errors.New("mtasts: table is required for table cache")
+		}
+		c.cache = &mtasts.Cache{Store: tableSTSStore{tbl: storeTbl}}
 	default:
 		panic("mtasts policy init: unknown cache type")
 	}
@@ -126,7 +135,7 @@ func (c *mtastsPolicy) updater() {
 	}
 	c.log.Debugln("updating MTA-STS cache... done!")
 
-	t := time.NewTicker(12 * time.Hour)
+	t := time.NewTicker(c.refresh)
 	for {
 		select {
 		case <-t.C:
@@ -348,6 +357,7 @@ func (dnssecPolicy) CheckConn(ctx context.Context, mxLevel module.MXLevel, tlsLe
 type (
 	danePolicy struct {
 		extResolver *dns.ExtResolver
+		cache       *tlsaCache
 		log         log.Logger
 		instName    string
 	}
@@ -383,10 +393,28 @@ func (c *danePolicy) Init(cfg *config.Map) error {
 		c.log.Error("DANE support is no-op: unable to init EDNS resolver", err)
 	}
 
+	var (
+		cacheTbl     module.MutableTable
+		cacheRefresh time.Duration
+		cacheMaxAge  time.Duration
+	)
 	cfg.Bool("debug", true, log.DefaultLogger.Debug, &c.log.Debug)
+	cfg.Custom("cache", false, false, nil, policyTable, &cacheTbl)
+	cfg.Duration("cache_refresh", false, false, time.Hour, &cacheRefresh)
+	cfg.Duration("cache_max_age", false, false, 24*time.Hour, &cacheMaxAge)
 
-	_, err = cfg.Process()
-	return err
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if cacheTbl != nil {
+		c.cache = &tlsaCache{
+			tbl:     cacheTbl,
+			refresh: cacheRefresh,
+			maxAge:  cacheMaxAge,
+		}
+	}
+	return nil
 }
 
 func (c *danePolicy) Start(*module.MsgMetadata) module.DeliveryMXAuthPolicy {
@@ -399,6 +427,39 @@ func (c *danePolicy) Close() error {
 
 func (c *daneDelivery) PrepareDomain(ctx context.Context, domain string) {}
 
+// lookupTLSA is discoverTLSA that also consults the TLSA cache, if it is
+// configured.
+func (c *daneDelivery) lookupTLSA(ctx context.Context, mx string) ([]dns.TLSA, error) {
+	cache := c.c.cache
+	if cache == nil {
+		return c.discoverTLSA(ctx, mx)
+	}
+
+	cached, fetchTime, err := cache.get(ctx, mx)
+	if err != nil {
+		c.c.log.Error("TLSA cache lookup failed", err, "mx", mx)
+	}
+	if len(cached) != 0 && time.Since(fetchTime) < cache.refresh {
+		c.c.log.Debugln("using", len(cached), "cached DANE records for", mx)
+		return cached, nil
+	}
+
+	recs, err := c.discoverTLSA(ctx, mx)
+	if err != nil {
+		if len(cached) != 0 && time.Since(fetchTime) < cache.maxAge && !dns.IsNotFound(err) {
+			c.c.log.Msg("TLSA lookup failed, using cached records", "mx", mx, "reason", err, "fetch_time", fetchTime)
+			return cached, nil
+		}
+		return nil, err
+	}
+	if len(recs) != 0 {
+		if err := cache.store(mx, recs); err != nil {
+			c.c.log.Error("TLSA cache update failed", err, "mx", mx)
+		}
+	}
+	return recs, nil
+}
+
 func (c *daneDelivery) discoverTLSA(ctx context.Context, mx string) ([]dns.TLSA, error) {
 	adA, rname, err := c.c.extResolver.CheckCNAMEAD(ctx, mx)
 	if err != nil {
@@ -484,7 +545,7 @@ func (c *daneDelivery) PrepareConn(ctx context.Context, mx string) {
 			}
 		}()
 
-		c.tlsaFut.Set(c.discoverTLSA(ctx, dns.FQDN(mx)))
+		c.tlsaFut.Set(c.lookupTLSA(ctx, dns.FQDN(mx)))
 	}()
 }
 
@@ -0,0 +1,134 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	"golang.org/x/net/idna"
+)
+
+// sourceIP is one of the local addresses outbound connections can be bound
+// to.
+type sourceIP struct {
+	addr     net.IP
+	hostname string
+	dialer   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+const (
+	sourceRoundRobin  = "round-robin"
+	sourceSender      = "sender"
+	sourceDestination = "destination"
+)
+
+// sourcePool selects the local address for outbound connections.
+type sourcePool struct {
+	ips       []*sourceIP
+	selection string
+
+	next uint32
+}
+
+func parseSourceIPs(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+	if len(node.Children) == 0 {
+		return nil, config.NodeErr(node, "at least one address is required")
+	}
+
+	ips := make([]*sourceIP, 0, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) > 1 || len(child.Children) != 0 {
+			return nil, config.NodeErr(child, "expected format: IP [HOSTNAME]")
+		}
+		addr := net.ParseIP(child.Name)
+		if addr == nil {
+			return nil, config.NodeErr(child, "malformed IP address: %s", child.Name)
+		}
+		src := &sourceIP{addr: addr}
+		if len(child.Args) == 1 {
+			hostname, err := idna.ToASCII(child.Args[0])
+			if err != nil {
+				return nil, config.NodeErr(child, "cannot represent the hostname as an A-label name: %v", err)
+			}
+			src.hostname = hostname
+		}
+
+		network := "tcp6"
+		if addr.To4() != nil {
+			network = "tcp4"
+		}
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: addr}}
+		src.dialer = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			// Source address and the destination should be from the same
+			// address family.
+			return dialer.DialContext(ctx, network, addr)
+		}
+		ips = append(ips, src)
+	}
+	return ips, nil
+}
+
+// pick returns the source address to use for the delivery from sender to the
+// destination domain.
+//
+// ipMap can override the choice for sender or destination domains, its
+// values should be one of the addresses in the pool.
+func (p *sourcePool) pick(ctx context.Context, rd *remoteDelivery, domain string) *sourceIP {
+	var key string
+	switch p.selection {
+	case sourceRoundRobin:
+		i := atomic.AddUint32(&p.next, 1)
+		return p.ips[int(i)%len(p.ips)]
+	case sourceSender:
+		if rd.mailFrom != "" {
+			_, key, _ = address.Split(rd.mailFrom)
+		}
+	case sourceDestination:
+		key = domain
+	}
+
+	if rd.rt.sourceIPMap != nil {
+		val, ok, err := rd.rt.sourceIPMap.Lookup(ctx, key)
+		if err != nil {
+			rd.Log.Error("source IP lookup failed", err, "key", key)
+		} else if ok {
+			if ip := net.ParseIP(val); ip != nil {
+				for _, src := range p.ips {
+					if src.addr.Equal(ip) {
+						return src
+					}
+				}
+			}
+			rd.Log.Msg("source IP map refers to an address not in source_ips, ignoring", "key", key, "value", val)
+		}
+	}
+
+	// Consistently use the same address for the same key.
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return p.ips[int(h.Sum32()%uint32(len(p.ips)))]
+}
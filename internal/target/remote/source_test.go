@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testSourcePool(t *testing.T, selection string, tbl module.Table, ips ...string) (*sourcePool, *remoteDelivery) {
+	p := &sourcePool{selection: selection}
+	for _, ip := range ips {
+		p.ips = append(p.ips, &sourceIP{addr: net.ParseIP(ip)})
+	}
+	rd := &remoteDelivery{
+		rt:  &Target{sourceIPMap: tbl},
+		Log: testutils.Logger(t, "remote"),
+	}
+	return p, rd
+}
+
+func TestSourcePool_RoundRobin(t *testing.T) {
+	p, rd := testSourcePool(t, sourceRoundRobin, nil, "192.0.2.1", "192.0.2.2")
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[p.pick(context.Background(), rd, "example.org").addr.String()]++
+	}
+	if seen["192.0.2.1"] != 2 || seen["192.0.2.2"] != 2 {
+		t.Fatal("Addresses are not used in turn:", seen)
+	}
+}
+
+func TestSourcePool_Sender(t *testing.T) {
+	tbl := testutils.Table{M: map[string]string{
+		"bulk.example.com": "192.0.2.3",
+		"bad.example.com":  "192.0.2.200",
+	}}
+	p, rd := testSourcePool(t, sourceSender, tbl, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	rd.mailFrom = "news@bulk.example.com"
+	if src := p.pick(context.Background(), rd, "example.org"); src.addr.String() != "192.0.2.3" {
+		t.Error("Table mapping is not used, got", src.addr)
+	}
+
+	rd.mailFrom = "test@example.com"
+	first := p.pick(context.Background(), rd, "example.org")
+	for i := 0; i < 5; i++ {
+		if src := p.pick(context.Background(), rd, "example.net"); src != first {
+			t.Fatal("Selection is not consistent for the same sender")
+		}
+	}
+
+	// Addresses outside of the pool are ignored.
+	rd.mailFrom = "test@bad.example.com"
+	if src := p.pick(context.Background(), rd, "example.org"); src.addr.String() == "192.0.2.200" {
+		t.Error("Address outside of the pool is used")
+	}
+}
+
+func TestSourcePool_Destination(t *testing.T) {
+	tbl := testutils.Table{M: map[string]string{
+		"example.org": "192.0.2.2",
+	}}
+	p, rd := testSourcePool(t, sourceDestination, tbl, "192.0.2.1", "192.0.2.2")
+
+	if src := p.pick(context.Background(), rd, "example.org"); src.addr.String() != "192.0.2.2" {
+		t.Error("Table mapping is not used, got", src.addr)
+	}
+}
+
+func TestParseSourceIPs(t *testing.T) {
+	val, err := parseSourceIPs(nil, config.Node{
+		Name: "source_ips",
+		Children: []config.Node{
+			{Name: "192.0.2.1", Args: []string{"mx1.example.org"}},
+			{Name: "2001:db8::1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := val.([]*sourceIP)
+	if len(ips) != 2 {
+		t.Fatal("Wrong amount of addresses:", len(ips))
+	}
+	if ips[0].hostname != "mx1.example.org" || ips[1].hostname != "" {
+		t.Error("Wrong hostnames:", ips[0].hostname, ips[1].hostname)
+	}
+
+	for _, children := range [][]config.Node{
+		nil,
+		{{Name: "not-an-ip"}},
+		{{Name: "192.0.2.1", Args: []string{"a", "b"}}},
+	} {
+		if _, err := parseSourceIPs(nil, config.Node{Name: "source_ips", Children: children}); err == nil {
+			t.Errorf("Expected an error for %v", children)
+		}
+	}
+}
+
+func TestRemoteDelivery_SourceHostname(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.sourceIPs = &sourcePool{
+		selection: sourceRoundRobin,
+		ips: []*sourceIP{
+			{
+				addr:     net.IPv4(127, 0, 0, 1),
+				hostname: "bulk.example.com",
+				dialer:   tgt.dialer,
+			},
+		},
+	}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	if helo := be.Messages[0].Conn.Hostname(); helo != "bulk.example.com" {
+		t.Error("Wrong EHLO hostname:", helo)
+	}
+}
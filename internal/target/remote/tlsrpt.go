@@ -0,0 +1,648 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// SMTP TLS Reporting (RFC 8460) implementation for outbound connections.
+
+const (
+	tlsrptPolicySTS    = "sts"
+	tlsrptPolicyTLSA   = "tlsa"
+	tlsrptPolicyNoPol  = "no-policy-found"
+	tlsrptContentType  = "application/tlsrpt+gzip"
+	tlsrptPendingFile  = "pending.json"
+	tlsrptArchiveDir   = "archive"
+	tlsrptHTTPTimeout  = 30 * time.Second
+	tlsrptMaxPolicyMXs = 20
+)
+
+type (
+	tlsrptReport struct {
+		OrganizationName string               `json:"organization-name"`
+		DateRange        tlsrptDateRange      `json:"date-range"`
+		ContactInfo      string               `json:"contact-info"`
+		ReportID         string               `json:"report-id"`
+		Policies         []*tlsrptPolicyStats `json:"policies"`
+	}
+	tlsrptDateRange struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	}
+	tlsrptPolicyStats struct {
+		Policy         tlsrptPolicy     `json:"policy"`
+		Summary        tlsrptSummary    `json:"summary"`
+		FailureDetails []*tlsrptFailure `json:"failure-details,omitempty"`
+	}
+	tlsrptPolicy struct {
+		Type   string   `json:"policy-type"`
+		String []string `json:"policy-string,omitempty"`
+		Domain string   `json:"policy-domain"`
+		MXHost []string `json:"mx-host,omitempty"`
+	}
+	tlsrptSummary struct {
+		Successful int `json:"total-successful-session-count"`
+		Failed     int `json:"total-failure-session-count"`
+	}
+	tlsrptFailure struct {
+		ResultType          string `json:"result-type"`
+		SendingMTAIP        string `json:"sending-mta-ip,omitempty"`
+		ReceivingMXHostname string `json:"receiving-mx-hostname,omitempty"`
+		ReceivingIP         string `json:"receiving-ip,omitempty"`
+		FailedSessions      int    `json:"failed-session-count"`
+	}
+)
+
+// tlsrptReporter aggregates results of outbound TLS negotiation and
+// periodically sends reports to domains that request them.
+type tlsrptReporter struct {
+	dir      string
+	org      string
+	contact  string
+	from     string
+	hostname string
+	interval time.Duration
+	sender   module.DeliveryTarget
+	resolver dns.Resolver
+	client   *http.Client
+	log      log.Logger
+
+	lock    sync.Mutex
+	start   time.Time
+	pending map[string]*tlsrptPolicyStats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type tlsrptState struct {
+	Start    time.Time
+	Policies []*tlsrptPolicyStats
+}
+
+func parseTLSRPT(cfg *config.Map, node config.Node) (interface{}, error) {
+	r := &tlsrptReporter{
+		client:  &http.Client{Timeout: tlsrptHTTPTimeout},
+		pending: map[string]*tlsrptPolicyStats{},
+	}
+
+	child := config.NewMap(cfg.Globals, node)
+	child.String("dir", false, false, "tlsrpt", &r.dir)
+	child.String("organization", false, false, "", &r.org)
+	child.String("contact", false, false, "", &r.contact)
+	child.String("from", false, false, "", &r.from)
+	child.Duration("interval", false, false, 24*time.Hour, &r.interval)
+	child.Custom("deliver_to", false, false, nil, modconfig.DeliveryDirective, &r.sender)
+	if _, err := child.Process(); err != nil {
+		return nil, err
+	}
+	if r.interval <= 0 {
+		return nil, config.NodeErr(node, "interval should be positive")
+	}
+
+	return r, nil
+}
+
+func (r *tlsrptReporter) init(hostname string, resolver dns.Resolver, logger log.Logger) error {
+	r.hostname = hostname
+	r.resolver = resolver
+	r.log = logger
+	r.log.Name += "/tlsrpt"
+	if r.org == "" {
+		r.org = hostname
+	}
+	if r.contact == "" {
+		r.contact = "postmaster@" + hostname
+	}
+	if r.from == "" {
+		r.from = "tlsrpt-noreply@" + hostname
+	}
+
+	if err := os.MkdirAll(filepath.Join(r.dir, tlsrptArchiveDir), 0o700); err != nil {
+		return fmt.Errorf("remote: tlsrpt: %w", err)
+	}
+	if err := r.loadPending(); err != nil {
+		return fmt.Errorf("remote: tlsrpt: %w", err)
+	}
+	return nil
+}
+
+func (r *tlsrptReporter) loadPending() error {
+	f, err := os.Open(filepath.Join(r.dir, tlsrptPendingFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			r.start = time.Now().UTC().Truncate(time.Second)
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var state tlsrptState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return fmt.Errorf("malformed pending state: %w", err)
+	}
+	r.start = state.Start
+	for _, stats := range state.Policies {
+		r.pending[stats.Policy.Domain+" "+stats.Policy.Type] = stats
+	}
+	return nil
+}
+
+func (r *tlsrptReporter) savePending() error {
+	r.lock.Lock()
+	state := tlsrptState{
+		Start:    r.start,
+		Policies: make([]*tlsrptPolicyStats, 0, len(r.pending)),
+	}
+	for _, stats := range r.pending {
+		state.Policies = append(state.Policies, stats)
+	}
+	blob, err := json.Marshal(state)
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(r.dir, tlsrptPendingFile)
+	if err := os.WriteFile(path+".tmp", blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// record adds the result of a single session to the aggregated statistics.
+//
+// failure is nil for successful sessions.
+func (r *tlsrptReporter) record(policy tlsrptPolicy, failure *tlsrptFailure) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := policy.Domain + " " + policy.Type
+	stats, ok := r.pending[key]
+	if !ok {
+		stats = &tlsrptPolicyStats{Policy: policy}
+		r.pending[key] = stats
+	}
+
+	if failure == nil {
+		stats.Summary.Successful++
+		return
+	}
+
+	stats.Summary.Failed++
+	for _, f := range stats.FailureDetails {
+		if f.ResultType == failure.ResultType && f.SendingMTAIP == failure.SendingMTAIP &&
+			f.ReceivingMXHostname == failure.ReceivingMXHostname && f.ReceivingIP == failure.ReceivingIP {
+			f.FailedSessions++
+			return
+		}
+	}
+	failure.FailedSessions = 1
+	stats.FailureDetails = append(stats.FailureDetails, failure)
+}
+
+func (r *tlsrptReporter) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.loop()
+}
+
+func (r *tlsrptReporter) loop() {
+	defer close(r.done)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during TLSRPT reporting: %v\n%s", err, stack)
+		}
+	}()
+
+	saveTick := time.NewTicker(10 * time.Minute)
+	defer saveTick.Stop()
+
+	for {
+		r.lock.Lock()
+		next := r.start.Add(r.interval)
+		r.lock.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			r.report(context.Background(), time.Now())
+		case <-saveTick.C:
+			timer.Stop()
+			if err := r.savePending(); err != nil {
+				r.log.Error("failed to save pending statistics", err)
+			}
+		case <-r.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (r *tlsrptReporter) Close() error {
+	if r.stop != nil {
+		close(r.stop)
+		<-r.done
+	}
+	return r.savePending()
+}
+
+// report generates and sends reports for the current period.
+func (r *tlsrptReporter) report(ctx context.Context, now time.Time) {
+	r.lock.Lock()
+	dateRange := tlsrptDateRange{
+		Start: r.start,
+		End:   now.UTC().Truncate(time.Second),
+	}
+	pending := r.pending
+	r.pending = map[string]*tlsrptPolicyStats{}
+	r.start = dateRange.End
+	r.lock.Unlock()
+
+	byDomain := map[string][]*tlsrptPolicyStats{}
+	for _, stats := range pending {
+		byDomain[stats.Policy.Domain] = append(byDomain[stats.Policy.Domain], stats)
+	}
+
+	for domain, policies := range byDomain {
+		report := tlsrptReport{
+			OrganizationName: r.org,
+			DateRange:        dateRange,
+			ContactInfo:      r.contact,
+			ReportID:         dateRange.End.Format("20060102T150405Z") + "_" + domain + "@" + r.hostname,
+			Policies:         policies,
+		}
+		if err := r.sendReport(ctx, domain, report); err != nil {
+			r.log.Error("failed to send report", err, "domain", domain, "report_id", report.ReportID)
+		}
+	}
+
+	if err := r.savePending(); err != nil {
+		r.log.Error("failed to save pending statistics", err)
+	}
+}
+
+func (r *tlsrptReporter) sendReport(ctx context.Context, domain string, report tlsrptReport) error {
+	blob, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	archivePath := filepath.Join(r.dir, tlsrptArchiveDir, report.ReportID+".json")
+	if err := os.WriteFile(archivePath, blob, 0o600); err != nil {
+		return err
+	}
+
+	rua, err := r.lookupRUA(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if len(rua) == 0 {
+		r.log.DebugMsg("no TLSRPT policy, report is only archived", "domain", domain)
+		return nil
+	}
+
+	var gzBlob bytes.Buffer
+	gzw := gzip.NewWriter(&gzBlob)
+	if _, err := gzw.Write(blob); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, uri := range rua {
+		switch {
+		case strings.HasPrefix(uri, "mailto:"):
+			err = r.sendMail(ctx, strings.TrimPrefix(uri, "mailto:"), domain, report, gzBlob.Bytes())
+		case strings.HasPrefix(uri, "https:"):
+			err = r.sendHTTPS(ctx, uri, gzBlob.Bytes())
+		default:
+			err = fmt.Errorf("unsupported rua URI: %s", uri)
+		}
+		if err != nil {
+			r.log.Error("report delivery failed", err, "domain", domain, "rua", uri)
+			lastErr = err
+			continue
+		}
+		r.log.Msg("report sent", "domain", domain, "rua", uri, "report_id", report.ReportID)
+	}
+	return lastErr
+}
+
+// lookupRUA returns the list of reporting URIs from the TLSRPT policy of the
+// domain.
+func (r *tlsrptReporter) lookupRUA(ctx context.Context, domain string) ([]string, error) {
+	txts, err := r.resolver.LookupTXT(ctx, dns.FQDN("_smtp._tls."+domain))
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=TLSRPTv1") {
+			continue
+		}
+		for _, field := range strings.Split(txt, ";") {
+			field = strings.TrimSpace(field)
+			if !strings.HasPrefix(field, "rua=") {
+				continue
+			}
+			var rua []string
+			for _, uri := range strings.Split(strings.TrimPrefix(field, "rua="), ",") {
+				rua = append(rua, strings.TrimSpace(uri))
+			}
+			return rua, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *tlsrptReporter) sendHTTPS(ctx context.Context, uri string, gzBlob []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(gzBlob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", tlsrptContentType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP status: %v", resp.Status)
+	}
+	return nil
+}
+
+func (r *tlsrptReporter) sendMail(ctx context.Context, rcpt, domain string, report tlsrptReport, gzBlob []byte) error {
+	if r.sender == nil {
+		return errors.New("deliver_to is not configured")
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	textPart := make(textproto.MIMEHeader)
+	textPart.Set("Content-Type", "text/plain; charset=utf-8")
+	w, err := mw.CreatePart(textPart)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "This is an aggregate TLS report from %s for %s.\r\n", r.org, domain)
+
+	// RFC 8460, Section 5.3.
+	filename := fmt.Sprintf("%s!%s!%d!%d.json.gz", r.hostname, domain,
+		report.DateRange.Start.Unix(), report.DateRange.End.Unix())
+	reportPart := make(textproto.MIMEHeader)
+	reportPart.Set("Content-Type", tlsrptContentType)
+	reportPart.Set("Content-Transfer-Encoding", "base64")
+	reportPart.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w, err = mw.CreatePart(reportPart)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(gzBlob)
+	for len(encoded) > 76 {
+		fmt.Fprintf(w, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(w, "%s\r\n", encoded)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	hdr := msgtextproto.Header{}
+	hdr.Add("From", r.from)
+	hdr.Add("To", rcpt)
+	hdr.Add("Subject", "Report Domain: "+domain+" Submitter: "+r.org+" Report-ID: <"+report.ReportID+">")
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+r.hostname+">")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("TLS-Report-Domain", domain)
+	hdr.Add("TLS-Report-Submitter", r.org)
+	hdr.Add("Content-Type", `multipart/report; report-type="tlsrpt"; boundary="`+mw.Boundary()+`"`)
+
+	msgMeta := &module.MsgMetadata{ID: msgID}
+	delivery, err := r.sender.Start(ctx, msgMeta, r.from)
+	if err != nil {
+		return err
+	}
+	if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body.Bytes()}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+// tlsrptResultType maps the TLS negotiation error to the result type from
+// RFC 8460, Section 4.3.
+func tlsrptResultType(tlsLevel module.TLSLevel, tlsErr error) string {
+	if tlsErr == nil {
+		if tlsLevel == module.TLSNone {
+			return "starttls-not-supported"
+		}
+		return "validation-failure"
+	}
+
+	var (
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		unknownCA  x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.As(tlsErr, &hostErr):
+		return "certificate-host-mismatch"
+	case errors.As(tlsErr, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "certificate-expired"
+	case errors.As(tlsErr, &unknownCA):
+		return "certificate-not-trusted"
+	}
+	return "validation-failure"
+}
+
+// tlsrptPolicy returns the description of the MTA-STS policy used for the
+// delivery, if any.
+func (c *mtastsDelivery) tlsrptPolicy(ctx context.Context, domain string) (tlsrptPolicy, bool) {
+	if c.policyFut == nil {
+		return tlsrptPolicy{}, false
+	}
+	stsI, err := c.policyFut.GetContext(ctx)
+	if err != nil {
+		return tlsrptPolicy{}, false
+	}
+	sts := stsI.(*mtasts.Policy)
+	if sts.Mode == mtasts.ModeNone {
+		return tlsrptPolicy{}, false
+	}
+
+	policy := tlsrptPolicy{
+		Type:   tlsrptPolicySTS,
+		Domain: domain,
+		String: []string{
+			"version: STSv1",
+			"mode: " + string(sts.Mode),
+		},
+	}
+	for i, mx := range sts.MX {
+		if i == tlsrptMaxPolicyMXs {
+			break
+		}
+		policy.String = append(policy.String, "mx: "+mx)
+		policy.MXHost = append(policy.MXHost, mx)
+	}
+	policy.String = append(policy.String, "max_age: "+strconv.Itoa(sts.MaxAge))
+	return policy, true
+}
+
+// hasRecords reports whether usable TLSA records were discovered for the MX.
+func (c *daneDelivery) hasRecords(ctx context.Context) bool {
+	if c.tlsaFut == nil {
+		return false
+	}
+	recsI, err := c.tlsaFut.GetContext(ctx)
+	return err == nil && len(recsI.([]dns.TLSA)) != 0
+}
+
+// tlsrptPolicy returns the description of the policy applied to the
+// connection for TLSRPT. DANE takes precedence over MTA-STS.
+func (rd *remoteDelivery) tlsrptPolicy(ctx context.Context, domain string) tlsrptPolicy {
+	policy := tlsrptPolicy{
+		Type:   tlsrptPolicyNoPol,
+		Domain: domain,
+	}
+	for _, p := range rd.policies {
+		switch p := p.(type) {
+		case *daneDelivery:
+			if p.hasRecords(ctx) {
+				return tlsrptPolicy{Type: tlsrptPolicyTLSA, Domain: domain}
+			}
+		case *mtastsDelivery:
+			if sts, ok := p.tlsrptPolicy(ctx, domain); ok {
+				policy = sts
+			}
+		}
+	}
+	return policy
+}
+
+// tlsrptRecord records the result of the connection attempt, failedPolicy is
+// the policy that rejected the connection, if any.
+func (rd *remoteDelivery) tlsrptRecord(ctx context.Context, conn *mxConn, mx string, tlsLevel module.TLSLevel, tlsErr error, failedPolicy module.DeliveryMXAuthPolicy) {
+	reporter := rd.rt.tlsrpt
+	if reporter == nil {
+		return
+	}
+
+	failure := &tlsrptFailure{
+		ResultType:          tlsrptResultType(tlsLevel, tlsErr),
+		ReceivingMXHostname: strings.TrimSuffix(mx, "."),
+	}
+
+	var policy tlsrptPolicy
+	switch p := failedPolicy.(type) {
+	case nil:
+		policy = rd.tlsrptPolicy(ctx, conn.domain)
+		switch policy.Type {
+		case tlsrptPolicyTLSA:
+			// DANE authentication does not need PKIX to succeed.
+			if tlsLevel == module.TLSAuthenticated {
+				failure = nil
+			}
+		case tlsrptPolicySTS:
+			// Failures are still reported for policies in testing mode.
+			if tlsErr == nil && tlsLevel != module.TLSNone {
+				failure = nil
+			}
+		default:
+			if tlsLevel != module.TLSNone {
+				failure = nil
+			}
+		}
+	case *daneDelivery:
+		policy = tlsrptPolicy{Type: tlsrptPolicyTLSA, Domain: conn.domain}
+		if p.tlsaFut != nil {
+			if _, err := p.tlsaFut.GetContext(ctx); err != nil {
+				failure.ResultType = "dnssec-invalid"
+			}
+		}
+	case *mtastsDelivery:
+		var ok bool
+		policy, ok = p.tlsrptPolicy(ctx, conn.domain)
+		if !ok {
+			policy = tlsrptPolicy{Type: tlsrptPolicySTS, Domain: conn.domain}
+		}
+	default:
+		policy = rd.tlsrptPolicy(ctx, conn.domain)
+	}
+
+	if failure != nil && conn.C != nil && conn.Client() != nil {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			failure.SendingMTAIP = addr.IP.String()
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			failure.ReceivingIP = addr.IP.String()
+		}
+	}
+	reporter.record(policy, failure)
+}
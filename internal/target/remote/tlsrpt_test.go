@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTLSRPTReporter(t *testing.T, dir string, zones map[string]mockdns.Zone) *tlsrptReporter {
+	r := &tlsrptReporter{
+		dir:      dir,
+		interval: 24 * time.Hour,
+		client:   http.DefaultClient,
+		pending:  map[string]*tlsrptPolicyStats{},
+	}
+	if err := r.init("mx.example.com", &mockdns.Resolver{Zones: zones}, testutils.Logger(t, "remote")); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRemoteDelivery_TLSRPT(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tlsrpt = testTLSRPTReporter(t, t.TempDir(), zones)
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	stats := tgt.tlsrpt.pending["example.invalid "+tlsrptPolicyNoPol]
+	if stats == nil {
+		t.Fatal("Session is not recorded")
+	}
+	if stats.Summary.Failed != 1 || len(stats.FailureDetails) != 1 {
+		t.Fatal("Wrong summary:", stats.Summary)
+	}
+	failure := stats.FailureDetails[0]
+	if failure.ResultType != "starttls-not-supported" {
+		t.Error("Wrong result type:", failure.ResultType)
+	}
+	if failure.ReceivingIP != "127.0.0.1" || failure.ReceivingMXHostname != "mx.example.invalid" {
+		t.Error("Wrong failure details:", failure.ReceivingIP, failure.ReceivingMXHostname)
+	}
+}
+
+func TestTLSRPTReporter_Report(t *testing.T) {
+	var received tlsrptReport
+	httpSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != tlsrptContentType {
+			t.Error("Wrong Content-Type:", ct)
+		}
+		gzr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := json.NewDecoder(gzr).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer httpSrv.Close()
+
+	zones := map[string]mockdns.Zone{
+		"_smtp._tls.example.org.": {
+			TXT: []string{"v=TLSRPTv1; rua=mailto:reports@example.org," + httpSrv.URL},
+		},
+	}
+	sender := &testutils.Target{}
+	r := testTLSRPTReporter(t, t.TempDir(), zones)
+	r.sender = sender
+	r.client = httpSrv.Client()
+
+	r.record(tlsrptPolicy{Type: tlsrptPolicySTS, Domain: "example.org"}, nil)
+	r.record(tlsrptPolicy{Type: tlsrptPolicySTS, Domain: "example.org"}, &tlsrptFailure{
+		ResultType:  "certificate-expired",
+		ReceivingIP: "192.0.2.1",
+	})
+	r.record(tlsrptPolicy{Type: tlsrptPolicySTS, Domain: "example.org"}, &tlsrptFailure{
+		ResultType:  "certificate-expired",
+		ReceivingIP: "192.0.2.1",
+	})
+	r.record(tlsrptPolicy{Type: tlsrptPolicyNoPol, Domain: "example.net"}, nil)
+
+	r.report(context.Background(), time.Now())
+
+	if len(received.Policies) != 1 {
+		t.Fatal("Wrong policies in HTTPS report:", received.Policies)
+	}
+	stats := received.Policies[0]
+	if stats.Summary.Successful != 1 || stats.Summary.Failed != 2 {
+		t.Error("Wrong summary:", stats.Summary)
+	}
+	if len(stats.FailureDetails) != 1 || stats.FailureDetails[0].FailedSessions != 2 {
+		t.Error("Failures are not aggregated:", stats.FailureDetails)
+	}
+
+	if len(sender.Messages) != 1 {
+		t.Fatal("Wrong amount of report messages:", len(sender.Messages))
+	}
+	msg := sender.Messages[0]
+	if msg.RcptTo[0] != "reports@example.org" {
+		t.Error("Wrong recipient:", msg.RcptTo)
+	}
+	if d := msg.Header.Get("TLS-Report-Domain"); d != "example.org" {
+		t.Error("Wrong TLS-Report-Domain:", d)
+	}
+
+	// Both domains are archived, even though example.net has no policy.
+	archive, err := os.ReadDir(filepath.Join(r.dir, tlsrptArchiveDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive) != 2 {
+		t.Error("Wrong amount of archived reports:", len(archive))
+	}
+
+	if len(r.pending) != 0 {
+		t.Error("Statistics are not reset after the report")
+	}
+}
+
+func TestTLSRPTReporter_Pending(t *testing.T) {
+	dir := t.TempDir()
+	r := testTLSRPTReporter(t, dir, nil)
+	r.record(tlsrptPolicy{Type: tlsrptPolicySTS, Domain: "example.org"}, nil)
+	start := r.start
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r = testTLSRPTReporter(t, dir, nil)
+	stats := r.pending["example.org "+tlsrptPolicySTS]
+	if stats == nil || stats.Summary.Successful != 1 {
+		t.Fatal("Statistics are not restored")
+	}
+	if !r.start.Equal(start) {
+		t.Error("Period start is not restored")
+	}
+}
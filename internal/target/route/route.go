@@ -0,0 +1,495 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package route implements target.route module that selects the delivery
+// target for the message using conditions on its header, size, check results,
+// sender and recipients.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package route
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.route"
+
+type headerCond struct {
+	field string
+	re    *regexp.Regexp
+}
+
+// route is the delivery target used for messages matching all specified
+// conditions.
+type route struct {
+	name string
+
+	minSize       int64
+	maxSize       int64
+	senders       []string
+	rcpts         []string
+	senderTable   module.Table
+	rcptTable     module.Table
+	header        []headerCond
+	minScore      *float64
+	checkScores   map[string]float64
+	quarantined   *bool
+	authenticated *bool
+
+	target module.DeliveryTarget
+}
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	routes     []*route
+	defaultTgt module.DeliveryTarget
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Callback("route", func(m *config.Map, node config.Node) error {
+		r, err := parseRoute(m, node)
+		if err != nil {
+			return err
+		}
+		if r.name == "" {
+			r.name = strconv.Itoa(len(t.routes) + 1)
+		}
+		t.routes = append(t.routes, r)
+		return nil
+	})
+	cfg.Custom("default", false, true, nil, modconfig.DeliveryDirective, &t.defaultTgt)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseOptionalBool(node config.Node) (*bool, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	var val bool
+	switch node.Args[0] {
+	case "yes":
+		val = true
+	case "no":
+	default:
+		return nil, config.NodeErr(node, "bool argument should be 'yes' or 'no'")
+	}
+	return &val, nil
+}
+
+func parseScore(node config.Node, s string) (float64, error) {
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, config.NodeErr(node, "invalid score: %v", err)
+	}
+	return val, nil
+}
+
+// normalizeAddrList normalizes the list of addresses and domains for use
+// with matchAddr.
+func normalizeAddrList(entries []string) ([]string, error) {
+	res := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		var (
+			norm string
+			err  error
+		)
+		if strings.Contains(entry, "@") {
+			norm, err = address.ForLookup(entry)
+		} else {
+			norm, err = dns.ForLookup(entry)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry, err)
+		}
+		res = append(res, norm)
+	}
+	return res, nil
+}
+
+func parseRoute(m *config.Map, node config.Node) (*route, error) {
+	if len(node.Args) > 1 {
+		return nil, config.NodeErr(node, "at most one argument (route name) is expected")
+	}
+
+	r := &route{
+		checkScores: map[string]float64{},
+	}
+	if len(node.Args) == 1 {
+		r.name = node.Args[0]
+	}
+
+	var senders, rcpts []string
+	cfg := config.NewMap(m.Globals, node)
+	cfg.DataSize("min_size", false, false, 0, &r.minSize)
+	cfg.DataSize("max_size", false, false, 0, &r.maxSize)
+	cfg.StringList("sender", false, false, nil, &senders)
+	cfg.StringList("rcpt", false, false, nil, &rcpts)
+	modconfig.Table(cfg, "sender_table", false, false, nil, &r.senderTable)
+	modconfig.Table(cfg, "rcpt_table", false, false, nil, &r.rcptTable)
+	cfg.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 1 && len(node.Args) != 2 {
+			return config.NodeErr(node, "expected field name and optional regexp")
+		}
+		cond := headerCond{field: node.Args[0]}
+		if len(node.Args) == 2 {
+			var err error
+			cond.re, err = regexp.Compile(node.Args[1])
+			if err != nil {
+				return config.NodeErr(node, "invalid regexp: %v", err)
+			}
+		}
+		r.header = append(r.header, cond)
+		return nil
+	})
+	cfg.Callback("min_score", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "expected exactly one argument")
+		}
+		val, err := parseScore(node, node.Args[0])
+		r.minScore = &val
+		return err
+	})
+	cfg.Callback("check_score", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected check name and min. score")
+		}
+		val, err := parseScore(node, node.Args[1])
+		r.checkScores[node.Args[0]] = val
+		return err
+	})
+	cfg.Callback("quarantined", func(_ *config.Map, node config.Node) error {
+		val, err := parseOptionalBool(node)
+		r.quarantined = val
+		return err
+	})
+	cfg.Callback("authenticated", func(_ *config.Map, node config.Node) error {
+		val, err := parseOptionalBool(node)
+		r.authenticated = val
+		return err
+	})
+	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &r.target)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	r.senders, err = normalizeAddrList(senders)
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid sender: %v", err)
+	}
+	r.rcpts, err = normalizeAddrList(rcpts)
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid rcpt: %v", err)
+	}
+	return r, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+// matchAddr reports whether the address or its domain is in the list or in
+// the table.
+func matchAddr(ctx context.Context, list []string, tbl module.Table, addr string) (bool, error) {
+	addr, err := address.ForLookup(addr)
+	if err != nil {
+		return false, nil
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil {
+		return false, nil
+	}
+	for _, entry := range list {
+		if entry == addr || entry == domain {
+			return true, nil
+		}
+	}
+	if tbl == nil {
+		return false, nil
+	}
+	for _, key := range []string{addr, domain} {
+		if key == "" {
+			continue
+		}
+		_, ok, err := tbl.Lookup(ctx, key)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func matchHeader(h textproto.Header, cond headerCond) bool {
+	for _, val := range h.Values(cond.field) {
+		if cond.re == nil || cond.re.MatchString(val) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks whether all route conditions are satisfied for the message
+// and the recipient.
+func (r *route) matches(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom, rcpt string, h textproto.Header, bodyLen int64) (bool, error) {
+	if r.minSize != 0 && bodyLen < r.minSize {
+		return false, nil
+	}
+	if r.maxSize != 0 && bodyLen > r.maxSize {
+		return false, nil
+	}
+	if r.quarantined != nil && msgMeta.Quarantine != *r.quarantined {
+		return false, nil
+	}
+	if r.authenticated != nil {
+		authenticated := msgMeta.Conn != nil && msgMeta.Conn.AuthUser != ""
+		if authenticated != *r.authenticated {
+			return false, nil
+		}
+	}
+	if r.minScore != nil {
+		var total float64
+		for _, score := range msgMeta.CheckScores {
+			total += score
+		}
+		if total < *r.minScore {
+			return false, nil
+		}
+	}
+	for name, minScore := range r.checkScores {
+		if msgMeta.CheckScores[name] < minScore {
+			return false, nil
+		}
+	}
+	for _, cond := range r.header {
+		if !matchHeader(h, cond) {
+			return false, nil
+		}
+	}
+	if len(r.senders) != 0 || r.senderTable != nil {
+		ok, err := matchAddr(ctx, r.senders, r.senderTable, mailFrom)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if len(r.rcpts) != 0 || r.rcptTable != nil {
+		ok, err := matchAddr(ctx, r.rcpts, r.rcptTable, rcpt)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (t *Target) targetFor(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom, rcpt string, h textproto.Header, bodyLen int64) (string, module.DeliveryTarget, error) {
+	for _, r := range t.routes {
+		ok, err := r.matches(ctx, msgMeta, mailFrom, rcpt, h, bodyLen)
+		if err != nil {
+			return "", nil, &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+				Message:      "Internal error during routing",
+				TargetName:   modName,
+				Err:          err,
+				Misc: map[string]interface{}{
+					"route": r.name,
+				},
+			}
+		}
+		if ok {
+			return r.name, r.target, nil
+		}
+	}
+	return "default", t.defaultTgt, nil
+}
+
+type rcptInfo struct {
+	addr string
+	opts smtp.RcptOptions
+}
+
+type subDelivery struct {
+	module.Delivery
+	rcpts []string
+}
+
+type delivery struct {
+	t        *Target
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	log      log.Logger
+
+	rcpts []rcptInfo
+
+	// Slice is used to keep the order deterministic.
+	deliveries []*subDelivery
+	byTarget   map[module.DeliveryTarget]*subDelivery
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		byTarget: map[module.DeliveryTarget]*subDelivery{},
+	}, nil
+}
+
+// AddRcpt only remembers the recipient since the target can be selected
+// only after the message body is received.
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, opts smtp.RcptOptions) error {
+	d.rcpts = append(d.rcpts, rcptInfo{addr: rcptTo, opts: opts})
+	return nil
+}
+
+// dispatch selects targets for recipients and starts deliveries. fail is
+// called for each recipient that can't be routed, false returned by it
+// stops dispatching.
+func (d *delivery) dispatch(ctx context.Context, h textproto.Header, body buffer.Buffer, fail func(rcpt string, err error) bool) {
+	for _, rcpt := range d.rcpts {
+		name, tgt, err := d.t.targetFor(ctx, d.msgMeta, d.mailFrom, rcpt.addr, h, int64(body.Len()))
+		if err != nil {
+			if !fail(rcpt.addr, err) {
+				return
+			}
+			continue
+		}
+		d.log.DebugMsg("route selected", "rcpt", rcpt.addr, "route", name)
+
+		sub, ok := d.byTarget[tgt]
+		if !ok {
+			subDel, err := tgt.Start(ctx, d.msgMeta, d.mailFrom)
+			if err != nil {
+				if !fail(rcpt.addr, err) {
+					return
+				}
+				continue
+			}
+			sub = &subDelivery{Delivery: subDel}
+			d.byTarget[tgt] = sub
+			d.deliveries = append(d.deliveries, sub)
+		}
+
+		if err := sub.AddRcpt(ctx, rcpt.addr, rcpt.opts); err != nil {
+			if !fail(rcpt.addr, err) {
+				return
+			}
+			continue
+		}
+		sub.rcpts = append(sub.rcpts, rcpt.addr)
+	}
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	var dispatchErr error
+	d.dispatch(ctx, header, body, func(_ string, err error) bool {
+		dispatchErr = err
+		return false
+	})
+	if dispatchErr != nil {
+		return dispatchErr
+	}
+
+	for _, sub := range d.deliveries {
+		if err := sub.Body(ctx, header.Copy(), body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	d.dispatch(ctx, header, body, func(rcpt string, err error) bool {
+		c.SetStatus(rcpt, err)
+		return true
+	})
+
+	for _, sub := range d.deliveries {
+		if partDelivery, ok := sub.Delivery.(module.PartialDelivery); ok {
+			partDelivery.BodyNonAtomic(ctx, c, header.Copy(), body)
+			continue
+		}
+
+		err := sub.Body(ctx, header.Copy(), body)
+		for _, rcpt := range sub.rcpts {
+			c.SetStatus(rcpt, err)
+		}
+	}
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	for _, sub := range d.deliveries {
+		if err := sub.Commit(ctx); err != nil {
+			// No point in Committing remaining deliveries, everything is broken already.
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	var lastErr error
+	for _, sub := range d.deliveries {
+		if err := sub.Abort(ctx); err != nil {
+			d.log.Error("delivery.Abort failed", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func init() {
+	module.Register(modName, New)
+}
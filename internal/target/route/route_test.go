@@ -0,0 +1,100 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package route
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRoute(t *testing.T) {
+	big := testutils.Target{InstName: "big"}
+	partner := testutils.Target{InstName: "partner"}
+	spam := testutils.Target{InstName: "spam"}
+	def := testutils.Target{InstName: "default"}
+	minScore := 5.0
+	quarantined := true
+	tgt := &Target{
+		log: testutils.Logger(t, modName),
+		routes: []*route{
+			{name: "quarantine", quarantined: &quarantined, target: &spam},
+			{name: "spam", minScore: &minScore, target: &spam},
+			{name: "big", minSize: 10000, target: &big},
+			{
+				name:      "partner",
+				rcpts:     []string{"example.net"},
+				rcptTable: testutils.Table{M: map[string]string{"special@example.org": ""}},
+				target:    &partner,
+			},
+			{
+				name:   "header",
+				header: []headerCond{{field: "X-Route", re: regexp.MustCompile("^partner$")}},
+				target: &partner,
+			},
+		},
+		defaultTgt: &def,
+	}
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.invalid", []string{
+		"a@example.org",
+		"special@example.org",
+		"b@example.net",
+	})
+	if len(partner.Messages) != 1 || len(def.Messages) != 1 {
+		t.Fatalf("Wrong amount of messages: %d, %d", len(partner.Messages), len(def.Messages))
+	}
+	testutils.CheckTestMessage(t, &partner, 0, "sender@example.invalid", []string{"special@example.org", "b@example.net"})
+	testutils.CheckTestMessage(t, &def, 0, "sender@example.invalid", []string{"a@example.org"})
+
+	testutils.DoTestDeliveryMeta(t, tgt, "sender@example.invalid", []string{"a@example.org"}, &module.MsgMetadata{
+		CheckScores: map[string]float64{"rspamd": 3, "dnsbl": 2},
+	})
+	testutils.DoTestDeliveryMeta(t, tgt, "sender@example.invalid", []string{"b@example.net"}, &module.MsgMetadata{
+		Quarantine: true,
+	})
+	if len(spam.Messages) != 2 {
+		t.Fatalf("Wrong amount of messages: %d", len(spam.Messages))
+	}
+	if len(big.Messages) != 0 {
+		t.Fatalf("Unexpected message for size route")
+	}
+}
+
+var errTest = errors.New("test error")
+
+func TestRoute_LookupErr(t *testing.T) {
+	def := testutils.Target{InstName: "default"}
+	tgt := &Target{
+		log: testutils.Logger(t, modName),
+		routes: []*route{
+			{name: "broken", senderTable: testutils.Table{Err: errTest}, target: &testutils.Target{}},
+		},
+		defaultTgt: &def,
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.invalid", []string{"a@example.org"}); err == nil {
+		t.Error("Expected an error")
+	}
+	if len(def.Messages) != 0 {
+		t.Error("Message delivered despite lookup error")
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+const (
+	balanceFailover = "failover"
+	balanceWeighted = "weighted"
+)
+
+type upstream struct {
+	endp   config.Endpoint
+	weight int
+
+	// Fields below are protected by balancer.lock.
+	down      bool
+	failures  int
+	successes int
+}
+
+type healthCheck struct {
+	interval     time.Duration
+	timeout      time.Duration
+	failAfter    int
+	recoverAfter int
+}
+
+// balancer orders target endpoints for connection attempts and tracks their
+// health.
+//
+// Healthy endpoints are always tried before the ones marked down. Endpoints
+// are marked down after health.failAfter consecutive failures of active health
+// checks or connection attempts and are considered healthy again after
+// health.recoverAfter consecutive successes.
+type balancer struct {
+	upstreams []*upstream
+	weighted  bool
+	// nil if health checks are disabled.
+	health *healthCheck
+	probe  func(ctx context.Context, endp config.Endpoint) error
+	log    log.Logger
+	// Module instance name used in metrics, metrics are not updated if
+	// empty.
+	name string
+
+	lock sync.Mutex
+	rand *rand.Rand
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func parseWeights(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one weight is required")
+	}
+	weights := make([]int, 0, len(node.Args))
+	for _, arg := range node.Args {
+		w, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "invalid weight: %v", err)
+		}
+		if w < 1 {
+			return nil, config.NodeErr(node, "weight should be at least 1")
+		}
+		weights = append(weights, w)
+	}
+	return weights, nil
+}
+
+func parseHealthCheck(m *config.Map, node config.Node) (interface{}, error) {
+	hc := &healthCheck{}
+	cm := config.NewMap(m.Globals, node)
+	cm.Duration("interval", false, false, 30*time.Second, &hc.interval)
+	cm.Duration("timeout", false, false, 10*time.Second, &hc.timeout)
+	cm.Int("fail_after", false, false, 3, &hc.failAfter)
+	cm.Int("recover_after", false, false, 2, &hc.recoverAfter)
+	if _, err := cm.Process(); err != nil {
+		return nil, err
+	}
+	if hc.interval <= 0 {
+		return nil, config.NodeErr(node, "interval should be positive")
+	}
+	if hc.failAfter < 1 || hc.recoverAfter < 1 {
+		return nil, config.NodeErr(node, "fail_after and recover_after should be at least 1")
+	}
+	return hc, nil
+}
+
+func newBalancer(endpoints []config.Endpoint, weights []int, weighted bool, health *healthCheck, l log.Logger) *balancer {
+	b := &balancer{
+		weighted: weighted,
+		health:   health,
+		log:      l,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for i, endp := range endpoints {
+		up := &upstream{endp: endp, weight: 1}
+		if weights != nil {
+			up.weight = weights[i]
+		}
+		b.upstreams = append(b.upstreams, up)
+	}
+	return b
+}
+
+// order returns endpoints in the order they should be tried.
+func (b *balancer) order() []*upstream {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	healthy := make([]*upstream, 0, len(b.upstreams))
+	var down []*upstream
+	for _, up := range b.upstreams {
+		if up.down {
+			down = append(down, up)
+		} else {
+			healthy = append(healthy, up)
+		}
+	}
+
+	if b.weighted {
+		b.weightedShuffle(healthy)
+	}
+	return append(healthy, down...)
+}
+
+// weightedShuffle reorders the slice so that each next endpoint is picked
+// with the probability proportional to its weight.
+func (b *balancer) weightedShuffle(ups []*upstream) {
+	total := 0
+	for _, up := range ups {
+		total += up.weight
+	}
+	for i := range ups {
+		n := b.rand.Intn(total)
+		for j := i; j < len(ups); j++ {
+			n -= ups[j].weight
+			if n < 0 {
+				ups[i], ups[j] = ups[j], ups[i]
+				break
+			}
+		}
+		total -= ups[i].weight
+	}
+}
+
+// report updates the endpoint health using the result of the connection
+// attempt or the health check.
+func (b *balancer) report(up *upstream, err error) {
+	if b == nil || b.health == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err != nil {
+		up.successes = 0
+		up.failures++
+		if !up.down && up.failures >= b.health.failAfter {
+			up.down = true
+			b.log.Error("upstream is down", err, "downstream_server", up.endp.String())
+			b.setUp(up, false)
+		}
+		return
+	}
+
+	up.failures = 0
+	up.successes++
+	if up.down && up.successes >= b.health.recoverAfter {
+		up.down = false
+		b.log.Msg("upstream is up", "downstream_server", up.endp.String())
+		b.setUp(up, true)
+	}
+}
+
+func (b *balancer) setUp(up *upstream, isUp bool) {
+	if b.name == "" {
+		return
+	}
+	val := 0.0
+	if isUp {
+		val = 1
+	}
+	upstreamUp.WithLabelValues(b.name, up.endp.String()).Set(val)
+}
+
+func (b *balancer) start() {
+	if b.health == nil {
+		return
+	}
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+	go b.checkLoop()
+}
+
+func (b *balancer) close() {
+	if b.stop == nil {
+		return
+	}
+	close(b.stop)
+	<-b.done
+}
+
+func (b *balancer) checkLoop() {
+	defer close(b.done)
+	t := time.NewTicker(b.health.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.checkAll()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *balancer) checkAll() {
+	var wg sync.WaitGroup
+	for _, up := range b.upstreams {
+		wg.Add(1)
+		go func(up *upstream) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), b.health.timeout)
+			defer cancel()
+			err := b.probe(ctx, up.endp)
+			if err != nil {
+				b.log.DebugMsg("health check failed", "downstream_server", up.endp.String(), "reason", err.Error())
+			}
+			b.report(up, err)
+		}(up)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var (
+	testEndpA = config.Endpoint{Scheme: "tcp", Host: "a.example.invalid", Port: "25"}
+	testEndpB = config.Endpoint{Scheme: "tcp", Host: "b.example.invalid", Port: "25"}
+)
+
+func TestBalancer_Weighted(t *testing.T) {
+	b := newBalancer([]config.Endpoint{testEndpA, testEndpB}, []int{9, 1}, true, nil, testutils.Logger(t, "smtp"))
+
+	firstA := 0
+	for i := 0; i < 1000; i++ {
+		order := b.order()
+		if len(order) != 2 {
+			t.Fatal("Wrong amount of upstreams:", len(order))
+		}
+		if order[0].endp == testEndpA {
+			firstA++
+		}
+	}
+	if firstA < 800 || firstA > 970 {
+		t.Fatalf("Weights are not respected, A was picked first %d times out of 1000", firstA)
+	}
+}
+
+func TestBalancer_Health(t *testing.T) {
+	b := newBalancer([]config.Endpoint{testEndpA, testEndpB}, nil, false, &healthCheck{
+		failAfter:    2,
+		recoverAfter: 2,
+	}, testutils.Logger(t, "smtp"))
+
+	first := func() config.Endpoint {
+		return b.order()[0].endp
+	}
+
+	a := b.upstreams[0]
+	b.report(a, errors.New("connection refused"))
+	if first() != testEndpA {
+		t.Fatal("Upstream marked down after a single failure")
+	}
+	b.report(a, errors.New("connection refused"))
+	if first() != testEndpB {
+		t.Fatal("Upstream is not marked down")
+	}
+	if order := b.order(); len(order) != 2 || order[1].endp != testEndpA {
+		t.Fatal("Down upstream should still be tried last")
+	}
+
+	b.report(a, nil)
+	if first() != testEndpB {
+		t.Fatal("Upstream recovered after a single success")
+	}
+	b.report(a, nil)
+	if first() != testEndpA {
+		t.Fatal("Upstream is not recovered")
+	}
+}
+
+func TestBalancer_ActiveCheck(t *testing.T) {
+	b := newBalancer([]config.Endpoint{testEndpA, testEndpB}, nil, false, &healthCheck{
+		interval:     10 * time.Millisecond,
+		timeout:      time.Second,
+		failAfter:    1,
+		recoverAfter: 1,
+	}, testutils.Logger(t, "smtp"))
+
+	var aBroken atomic.Bool
+	aBroken.Store(true)
+	b.probe = func(_ context.Context, endp config.Endpoint) error {
+		if endp == testEndpA && aBroken.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	b.start()
+	defer b.close()
+
+	waitFor := func(endp config.Endpoint) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if b.order()[0].endp == endp {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("Health state is not updated, expected first upstream:", endp)
+	}
+	waitFor(testEndpB)
+	aBroken.Store(false)
+	waitFor(testEndpA)
+}
@@ -0,0 +1,84 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"context"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
+)
+
+// idleConn is an established (and authenticated, if auth is used) connection
+// to the upstream server kept open between transactions.
+//
+// It implements pool.Conn.
+type idleConn struct {
+	*smtpconn.C
+
+	upstream  *upstream
+	lastUseAt time.Time
+}
+
+func (c *idleConn) Usable() bool {
+	if c.C.Client() == nil {
+		return false
+	}
+	return c.C.Client().Reset() == nil
+}
+
+func (c *idleConn) LastUseAt() time.Time {
+	return c.lastUseAt
+}
+
+// idlePoolKey is the only key used in the pool, all upstreams are considered
+// equivalent.
+const idlePoolKey = ""
+
+func newIdlePool(maxIdle int, maxIdleTime int64) *pool.P {
+	return pool.New(pool.Config{
+		MaxKeys:             1,
+		MaxConnsPerKey:      maxIdle,
+		MaxConnLifetimeSec:  maxIdleTime,
+		StaleKeyLifetimeSec: maxIdleTime * 2,
+	})
+}
+
+// getIdle returns the idle connection from the pool or nil if there is none.
+func (u *Downstream) getIdle(ctx context.Context) *idleConn {
+	if u.idle == nil {
+		return nil
+	}
+	conn, err := u.idle.Get(ctx, idlePoolKey)
+	if err != nil || conn == nil {
+		return nil
+	}
+	return conn.(*idleConn)
+}
+
+// putIdle returns the connection to the pool if keepalive is enabled or
+// closes it otherwise.
+func (u *Downstream) putIdle(conn *smtpconn.C, up *upstream) error {
+	if u.idle == nil || up == nil {
+		return conn.Close()
+	}
+	u.idle.Return(idlePoolKey, &idleConn{C: conn, upstream: up, lastUseAt: time.Now()})
+	return nil
+}
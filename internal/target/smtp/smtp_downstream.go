@@ -43,7 +43,9 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/proxy"
 	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
 )
@@ -60,6 +62,11 @@ type Downstream struct {
 	endpoints       []config.Endpoint
 	saslFactory     saslClientFactory
 	tlsConfig       tls.Config
+	proxy           *proxy.Selector
+	// nil if Init was not called, endpoints are tried in order then.
+	balancer *balancer
+	// Idle connections kept for reuse, nil if disabled.
+	idle *pool.P
 
 	connectTimeout    time.Duration
 	commandTimeout    time.Duration
@@ -95,15 +102,34 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	cfg.Bool("attempt_starttls", false, !u.lmtp, &u.attemptStartTLS)
 	cfg.String("hostname", true, true, "", &u.hostname)
 	cfg.StringList("targets", false, false, nil, &targetsArg)
+	var forwardAuth bool
 	cfg.Custom("auth", false, false, func() (interface{}, error) {
 		return nil, nil
-	}, saslAuthDirective, &u.saslFactory)
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		forwardAuth = len(node.Args) != 0 && node.Args[0] == "forward"
+		return saslAuthDirective(m, node)
+	}, &u.saslFactory)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &u.tlsConfig)
+	cfg.Custom("proxy", false, false, nil, proxy.ParseDirective, &u.proxy)
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &u.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &u.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &u.submissionTimeout)
+	var (
+		balance string
+		weights []int
+		health  *healthCheck
+	)
+	cfg.Enum("balance", false, false, []string{balanceFailover, balanceWeighted}, balanceFailover, &balance)
+	cfg.Custom("weights", false, false, nil, parseWeights, &weights)
+	cfg.Custom("health_check", false, false, nil, parseHealthCheck, &health)
+	var (
+		maxIdleCount int
+		maxIdleTime  int64
+	)
+	cfg.Int("conn_max_idle_count", false, false, 0, &maxIdleCount)
+	cfg.Int64("conn_max_idle_time", false, false, 150, &maxIdleTime)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -130,9 +156,122 @@ func (u *Downstream) Init(cfg *config.Map) error {
 		return fmt.Errorf("%s: at least one target endpoint is required", u.modName)
 	}
 
+	if weights != nil {
+		if balance != balanceWeighted {
+			return fmt.Errorf("%s: weights can be used only with balance %s", u.modName, balanceWeighted)
+		}
+		if len(weights) != len(u.endpoints) {
+			return fmt.Errorf("%s: %d weights specified for %d targets", u.modName, len(weights), len(u.endpoints))
+		}
+	}
+	u.balancer = newBalancer(u.endpoints, weights, balance == balanceWeighted, health, u.log)
+	u.balancer.probe = u.probe
+	u.balancer.name = u.instName
+	for _, up := range u.balancer.upstreams {
+		u.balancer.setUp(up, true)
+	}
+	u.balancer.start()
+
+	if maxIdleCount > 0 {
+		// Connections are authenticated using credentials of the
+		// client that submitted the message.
+		if forwardAuth {
+			return fmt.Errorf("%s: conn_max_idle_count cannot be used with auth forward", u.modName)
+		}
+		if maxIdleTime < 1 {
+			return fmt.Errorf("%s: conn_max_idle_time should be at least 1", u.modName)
+		}
+		u.idle = newIdlePool(maxIdleCount, maxIdleTime)
+	}
+
+	return nil
+}
+
+func (u *Downstream) Close() error {
+	if u.balancer != nil {
+		u.balancer.close()
+	}
+	if u.idle != nil {
+		u.idle.Close()
+	}
+	return nil
+}
+
+// upstreams returns endpoints in the order they should be tried.
+func (u *Downstream) upstreams() []*upstream {
+	if u.balancer != nil {
+		return u.balancer.order()
+	}
+	ups := make([]*upstream, 0, len(u.endpoints))
+	for _, endp := range u.endpoints {
+		ups = append(ups, &upstream{endp: endp, weight: 1})
+	}
+	return ups
+}
+
+func (u *Downstream) newConn(l log.Logger) *smtpconn.C {
+	conn := smtpconn.New()
+	conn.Log = l
+	conn.Hostname = u.hostname
+	conn.AddrInSMTPMsg = false
+	if u.connectTimeout != 0 {
+		conn.ConnectTimeout = u.connectTimeout
+	}
+	if u.commandTimeout != 0 {
+		conn.CommandTimeout = u.commandTimeout
+	}
+	if u.submissionTimeout != 0 {
+		conn.SubmissionTimeout = u.submissionTimeout
+	}
+	return conn
+}
+
+// connectEndpoint establishes the connection to the endpoint, optionally via
+// the proxy, and checks the TLS requirement.
+func (u *Downstream) connectEndpoint(ctx context.Context, conn *smtpconn.C, endp config.Endpoint, directDial proxy.DialFunc) error {
+	conn.Dialer = directDial
+	if u.proxy != nil && endp.Network() == "tcp" {
+		dial, proxyURL, err := u.proxy.Dialer(ctx, endp.Host, directDial)
+		if err != nil {
+			return err
+		}
+		if proxyURL != nil {
+			conn.Log.DebugMsg("using proxy", "downstream_server", net.JoinHostPort(endp.Host, endp.Port), "proxy", proxyURL.Redacted())
+		}
+		conn.Dialer = dial
+	}
+
+	var (
+		didTLS bool
+		err    error
+	)
+	if u.lmtp {
+		didTLS, err = conn.ConnectLMTP(ctx, endp, u.attemptStartTLS, &u.tlsConfig)
+	} else {
+		didTLS, err = conn.Connect(ctx, endp, u.attemptStartTLS, &u.tlsConfig)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.Log.DebugMsg("connected", "downstream_server", conn.ServerName())
+
+	if !didTLS && u.requireTLS {
+		conn.Close()
+		return errors.New("TLS is required, but unsupported by downstream")
+	}
 	return nil
 }
 
+// probe checks whether the endpoint is able to accept connections.
+func (u *Downstream) probe(ctx context.Context, endp config.Endpoint) error {
+	conn := u.newConn(u.log)
+	if err := u.connectEndpoint(ctx, conn, endp, conn.Dialer); err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func (u *Downstream) Name() string {
 	return u.modName
 }
@@ -150,6 +289,10 @@ type delivery struct {
 	rcpts    []string
 
 	conn *smtpconn.C
+	// Upstream the connection is established to.
+	upstream *upstream
+	// Set if the connection is in undefined state and cannot be reused.
+	errored bool
 }
 
 // lmtpDelivery implements module.PartialDelivery
@@ -183,50 +326,37 @@ func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mai
 }
 
 func (d *delivery) connect(ctx context.Context) error {
-	// TODO: Review possibility of connection pooling here.
-	var lastErr error
-
-	conn := smtpconn.New()
-	conn.Log = d.log
-	conn.Hostname = d.u.hostname
-	conn.AddrInSMTPMsg = false
-	if d.u.connectTimeout != 0 {
-		conn.ConnectTimeout = d.u.connectTimeout
-	}
-	if d.u.commandTimeout != 0 {
-		conn.CommandTimeout = d.u.commandTimeout
-	}
-	if d.u.submissionTimeout != 0 {
-		conn.SubmissionTimeout = d.u.submissionTimeout
+	if idle := d.u.getIdle(ctx); idle != nil {
+		d.log.DebugMsg("reusing idle connection", "downstream_server", idle.upstream.endp.String())
+		upstreamConns.WithLabelValues(d.u.instName, idle.upstream.endp.String(), "reused").Inc()
+		idle.C.Log = d.log
+		d.conn = idle.C
+		d.upstream = idle.upstream
+		return nil
 	}
 
-	for _, endp := range d.u.endpoints {
-		var (
-			didTLS bool
-			err    error
-		)
-		if d.u.lmtp {
-			didTLS, err = conn.ConnectLMTP(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
-		} else {
-			didTLS, err = conn.Connect(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
-		}
+	var (
+		lastErr   error
+		connected *upstream
+	)
+
+	conn := d.u.newConn(d.log)
+	directDial := conn.Dialer
+	for _, up := range d.u.upstreams() {
+		err := d.u.connectEndpoint(ctx, conn, up.endp, directDial)
+		d.u.balancer.report(up, err)
 		if err != nil {
+			upstreamConns.WithLabelValues(d.u.instName, up.endp.String(), "failed").Inc()
 			if len(d.u.endpoints) != 1 {
-				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
+				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(up.endp.Host, up.endp.Port))
 			}
 			lastErr = err
 			continue
 		}
 
-		d.log.DebugMsg("connected", "downstream_server", conn.ServerName())
-
-		if !didTLS && d.u.requireTLS {
-			conn.Close()
-			lastErr = errors.New("TLS is required, but unsupported by downstream")
-			continue
-		}
-
+		upstreamConns.WithLabelValues(d.u.instName, up.endp.String(), "ok").Inc()
 		lastErr = nil
+		connected = up
 		break
 	}
 	if lastErr != nil {
@@ -247,6 +377,7 @@ func (d *delivery) connect(ctx context.Context) error {
 	}
 
 	d.conn = conn
+	d.upstream = connected
 
 	return nil
 }
@@ -268,7 +399,11 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	}
 
 	defer r.Close()
-	return d.u.moduleError(d.conn.Data(ctx, header, r))
+	if err := d.conn.Data(ctx, header, r); err != nil {
+		d.errored = true
+		return d.u.moduleError(err)
+	}
+	return nil
 }
 
 func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
@@ -278,6 +413,7 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 		for _, rcpt := range d.rcpts {
 			sc.SetStatus(rcpt, modErr)
 		}
+		return
 	}
 	defer r.Close()
 
@@ -297,6 +433,7 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 		rcptIndx++
 	})
 	if err != nil {
+		d.errored = true
 		modErr := d.u.moduleError(err)
 		for _, rcpt := range d.rcpts[rcptIndx:] {
 			sc.SetStatus(rcpt, modErr)
@@ -305,12 +442,17 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 }
 
 func (d *delivery) Abort(ctx context.Context) error {
+	deliveredMsgs.WithLabelValues(d.u.instName, "failed").Inc()
 	d.conn.Close()
 	return nil
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
-	return d.conn.Close()
+	deliveredMsgs.WithLabelValues(d.u.instName, "ok").Inc()
+	if d.errored {
+		return d.conn.Close()
+	}
+	return d.u.putIdle(d.conn, d.upstream)
 }
 
 func init() {
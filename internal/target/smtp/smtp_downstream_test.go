@@ -19,17 +19,22 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp_downstream
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"io"
 	"math/rand"
 	"os"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -149,6 +154,67 @@ func TestDownstreamDelivery_LMTP_ErrorCoerce(t *testing.T) {
 	}
 }
 
+// failingBuffer is a buffer.Buffer that can not be opened.
+type failingBuffer struct {
+	buffer.MemoryBuffer
+}
+
+func (failingBuffer) Open() (io.ReadCloser, error) {
+	return nil, errors.New("open failed")
+}
+
+func TestDownstreamDelivery_LMTP_BodyOpenErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, func(srv *smtp.Server) {
+		srv.LMTP = true
+	})
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		modName: "target.lmtp",
+		lmtp:    true,
+		log:     testutils.Logger(t, "lmtp_downstream"),
+	}
+
+	ctx := context.Background()
+	delivery, err := mod.Start(ctx, &module.MsgMetadata{ID: "test"}, "test@example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpts := []string{"rcpt1@example.invalid", "rcpt2@example.invalid"}
+	for _, rcpt := range rcpts {
+		if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := make(statusCollector)
+	delivery.(module.PartialDelivery).BodyNonAtomic(ctx, &sc, textproto.Header{}, failingBuffer{})
+	if err := delivery.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sc) != len(rcpts) {
+		t.Fatalf("Expected status for each recipient, got %v", sc)
+	}
+	for _, rcpt := range rcpts {
+		if sc[rcpt] == nil {
+			t.Errorf("Expected an error for %s", rcpt)
+		}
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("No message should be delivered")
+	}
+}
+
 type statusCollector map[string]error
 
 func (sc *statusCollector) SetStatus(rcptTo string, err error) {
@@ -208,6 +274,74 @@ func TestDownstreamDelivery_MAILErr(t *testing.T) {
 	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 2}, "Hey")
 }
 
+func TestDownstreamDelivery_Keepalive(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory: testSaslFactory(t, "plain", "test", "testpass"),
+		idle:        newIdlePool(1, 150),
+		log:         testutils.Logger(t, "target.smtp"),
+	}
+	defer mod.Close()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 1, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+
+	if be.SessionCounter != 1 {
+		t.Errorf("Connection was not reused, %d sessions opened", be.SessionCounter)
+	}
+	if be.Messages[1].AuthUser != "test" {
+		t.Errorf("Wrong AuthUser for the second message: %v", be.Messages[1].AuthUser)
+	}
+}
+
+func TestDownstreamDelivery_Keepalive_DataErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.DataErr = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 0, 0},
+		Message:      "Hey",
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		idle: newIdlePool(1, 150),
+		log:  testutils.Logger(t, "target.smtp"),
+	}
+	defer mod.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 451, exterrors.EnhancedCode{4, 0, 0}, "Hey")
+
+	be.DataErr = nil
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.SessionCounter != 2 {
+		t.Errorf("Connection that failed DATA was reused")
+	}
+}
+
 func TestDownstreamDelivery_AttemptTLS(t *testing.T) {
 	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
 	defer srv.Close()
@@ -0,0 +1,292 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package transport implements target.transport module that routes
+// recipients to delivery targets using a table lookup, similarly to the
+// Postfix transport_maps.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package transport
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.transport"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	table      module.Table
+	transports map[string]module.DeliveryTarget
+	defaultTgt string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Target{
+		instName:   instName,
+		log:        log.Logger{Name: modName},
+		transports: map[string]module.DeliveryTarget{},
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	modconfig.Table(cfg, "map", false, true, nil, &t.table)
+	cfg.String("default", false, false, "", &t.defaultTgt)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range unknown {
+		if node.Name != "transport" {
+			return config.NodeErr(node, "unknown directive: %s", node.Name)
+		}
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "transport name and delivery target are required")
+		}
+		name := node.Args[0]
+		if _, ok := t.transports[name]; ok {
+			return config.NodeErr(node, "duplicate transport: %s", name)
+		}
+		tgt, err := modconfig.DeliveryTarget(cfg.Globals, node.Args[1:], node)
+		if err != nil {
+			return err
+		}
+		t.transports[name] = tgt
+	}
+
+	if len(t.transports) == 0 {
+		return config.NodeErr(cfg.Block, "at least one transport is required")
+	}
+	if t.defaultTgt != "" {
+		if _, ok := t.transports[t.defaultTgt]; !ok {
+			return config.NodeErr(cfg.Block, "unknown default transport: %s", t.defaultTgt)
+		}
+	}
+
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+// lookupKeys returns table keys to try for the recipient address in the order
+// of preference: full address, domain and then parent domains prefixed with a
+// dot (".example.org" matches all subdomains of example.org).
+func lookupKeys(rcpt string) ([]string, error) {
+	cleanRcpt, err := address.ForLookup(rcpt)
+	if err != nil {
+		return nil, err
+	}
+	_, domain, err := address.Split(cleanRcpt)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{cleanRcpt}
+	if domain == "" {
+		return keys, nil
+	}
+	keys = append(keys, domain)
+	for {
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			break
+		}
+		keys = append(keys, domain[dot:])
+		domain = domain[dot+1:]
+	}
+	return keys, nil
+}
+
+func (t *Target) transportFor(ctx context.Context, rcpt string) (string, module.DeliveryTarget, error) {
+	keys, err := lookupKeys(rcpt)
+	if err != nil {
+		return "", nil, &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 3},
+			Message:      "Malformed recipient address",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+
+	name := ""
+	for _, key := range keys {
+		val, ok, err := t.table.Lookup(ctx, key)
+		if err != nil {
+			return "", nil, &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+				Message:      "Internal error during transport lookup",
+				TargetName:   modName,
+				Err:          err,
+			}
+		}
+		if ok {
+			name = val
+			break
+		}
+	}
+	if name == "" {
+		name = t.defaultTgt
+	}
+	if name == "" {
+		return "", nil, &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 2},
+			Message:      "No transport for the recipient domain",
+			TargetName:   modName,
+		}
+	}
+
+	tgt, ok := t.transports[name]
+	if !ok {
+		return "", nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+			Message:      "Transport is not configured",
+			TargetName:   modName,
+			Misc: map[string]interface{}{
+				"transport": name,
+			},
+		}
+	}
+	return name, tgt, nil
+}
+
+type subDelivery struct {
+	module.Delivery
+	rcpts []string
+}
+
+type delivery struct {
+	t        *Target
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	log      log.Logger
+
+	// Slice is used to keep the order deterministic.
+	deliveries []*subDelivery
+	byTarget   map[module.DeliveryTarget]*subDelivery
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		byTarget: map[module.DeliveryTarget]*subDelivery{},
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, opts smtp.RcptOptions) error {
+	name, tgt, err := d.t.transportFor(ctx, rcptTo)
+	if err != nil {
+		return err
+	}
+	d.log.DebugMsg("transport selected", "rcpt", rcptTo, "transport", name)
+
+	sub, ok := d.byTarget[tgt]
+	if !ok {
+		subDel, err := tgt.Start(ctx, d.msgMeta, d.mailFrom)
+		if err != nil {
+			return err
+		}
+		sub = &subDelivery{Delivery: subDel}
+		d.byTarget[tgt] = sub
+		d.deliveries = append(d.deliveries, sub)
+	}
+
+	if err := sub.AddRcpt(ctx, rcptTo, opts); err != nil {
+		return err
+	}
+	sub.rcpts = append(sub.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	for _, sub := range d.deliveries {
+		if err := sub.Body(ctx, header.Copy(), body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	for _, sub := range d.deliveries {
+		if partDelivery, ok := sub.Delivery.(module.PartialDelivery); ok {
+			partDelivery.BodyNonAtomic(ctx, c, header.Copy(), body)
+			continue
+		}
+
+		err := sub.Body(ctx, header.Copy(), body)
+		for _, rcpt := range sub.rcpts {
+			c.SetStatus(rcpt, err)
+		}
+	}
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	for _, sub := range d.deliveries {
+		if err := sub.Commit(ctx); err != nil {
+			// No point in Committing remaining deliveries, everything is broken already.
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	var lastErr error
+	for _, sub := range d.deliveries {
+		if err := sub.Abort(ctx); err != nil {
+			d.log.Error("delivery.Abort failed", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func init() {
+	module.Register(modName, New)
+}
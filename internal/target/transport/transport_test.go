@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestLookupKeys(t *testing.T) {
+	keys, err := lookupKeys("Test@Mail.Example.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"test@mail.example.org", "mail.example.org", ".example.org", ".org"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Wrong keys: %v", keys)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	relay := testutils.Target{InstName: "relay"}
+	lmtp := testutils.Target{InstName: "lmtp"}
+	direct := testutils.Target{InstName: "direct"}
+	tgt := &Target{
+		log: testutils.Logger(t, modName),
+		table: testutils.Table{M: map[string]string{
+			"example.org":         "relay",
+			"special@example.org": "lmtp",
+			".example.net":        "lmtp",
+			"example.com":         "missing",
+		}},
+		transports: map[string]module.DeliveryTarget{
+			"relay":  &relay,
+			"lmtp":   &lmtp,
+			"direct": &direct,
+		},
+		defaultTgt: "direct",
+	}
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.invalid", []string{
+		"a@example.org",
+		"special@example.org",
+		"b@sub.example.net",
+		"c@example.invalid",
+	})
+
+	if len(relay.Messages) != 1 || len(lmtp.Messages) != 1 || len(direct.Messages) != 1 {
+		t.Fatalf("Wrong amount of messages: %d, %d, %d", len(relay.Messages), len(lmtp.Messages), len(direct.Messages))
+	}
+	testutils.CheckTestMessage(t, &relay, 0, "sender@example.invalid", []string{"a@example.org"})
+	testutils.CheckTestMessage(t, &lmtp, 0, "sender@example.invalid", []string{"special@example.org", "b@sub.example.net"})
+	testutils.CheckTestMessage(t, &direct, 0, "sender@example.invalid", []string{"c@example.invalid"})
+
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.invalid", []string{"a@example.com"}); err == nil {
+		t.Error("Expected an error for unconfigured transport")
+	}
+}
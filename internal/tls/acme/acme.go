@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/foxcpp/maddy/framework/config"
@@ -12,10 +13,18 @@ import (
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/mholt/acmez/acme"
 )
 
 const modName = "tls.loader.acme"
 
+// Well-known CAs that can be specified by name instead of the directory URL.
+var knownCAs = map[string]string{
+	"letsencrypt": certmagic.LetsEncryptProductionCA,
+	"zerossl":     certmagic.ZeroSSLProductionCA,
+	"buypass":     "https://api.buypass.com/acme/directory",
+}
+
 type Loader struct {
 	instName string
 
@@ -24,58 +33,149 @@ type Loader struct {
 	cfg          *certmagic.Config
 	cancelManage context.CancelFunc
 
+	// Configurations for names listed in issuer blocks.
+	nameCfgs map[string]*certmagic.Config
+
 	log log.Logger
 }
 
+// profile is the ACME configuration used to obtain certificates for a set of
+// names.
+type profile struct {
+	names          []string
+	ca             string
+	testCA         string
+	email          string
+	agreed         bool
+	eab            *acme.EAB
+	keyType        string
+	challenge      string
+	overrideDomain string
+	provider       certmagic.ACMEDNSProvider
+	listenHost     string
+	tlsALPNPort    int
+}
+
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	if len(inlineArgs) != 0 {
 		return nil, fmt.Errorf("%s: no inline args expected", modName)
 	}
 	return &Loader{
 		instName: instName,
+		nameCfgs: make(map[string]*certmagic.Config),
 		log:      log.Logger{Name: modName},
 	}, nil
 }
 
+// profileDirectives adds directives that can be used both at the top level
+// and in issuer blocks to m. Values from defaults are used if directives
+// are not specified.
+func profileDirectives(m *config.Map, defaults profile, p *profile) {
+	m.Custom("ca", false, false, func() (interface{}, error) {
+		return defaults.ca, nil
+	}, caDirective, &p.ca)
+	m.Custom("test_ca", false, false, func() (interface{}, error) {
+		return defaults.testCA, nil
+	}, caDirective, &p.testCA)
+	m.String("email", false, false, defaults.email, &p.email)
+	m.Bool("agreed", false, defaults.agreed, &p.agreed)
+	m.Custom("eab", false, false, func() (interface{}, error) {
+		return defaults.eab, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 2 {
+			return nil, config.NodeErr(node, "expected two arguments: key ID and MAC key")
+		}
+		return &acme.EAB{KeyID: node.Args[0], MACKey: node.Args[1]}, nil
+	}, &p.eab)
+	m.Enum("key_type", false, false,
+		[]string{"p256", "p384", "rsa2048", "rsa4096", "ed25519"}, defaults.keyType, &p.keyType)
+	m.Enum("challenge", false, false,
+		[]string{"dns-01", "tls-alpn-01"}, defaults.challenge, &p.challenge)
+	m.String("override_domain", false, false, defaults.overrideDomain, &p.overrideDomain)
+	m.Custom("dns", false, false, func() (interface{}, error) {
+		return defaults.provider, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var p certmagic.ACMEDNSProvider
+		err := modconfig.ModuleFromNode("libdns", node.Args, node, m.Globals, &p)
+		return p, err
+	}, &p.provider)
+	m.String("listen_host", false, false, defaults.listenHost, &p.listenHost)
+	m.Int("tls_alpn_port", false, false, defaults.tlsALPNPort, &p.tlsALPNPort)
+}
+
+func caDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	if url, ok := knownCAs[node.Args[0]]; ok {
+		return url, nil
+	}
+	return node.Args[0], nil
+}
+
 func (l *Loader) Init(cfg *config.Map) error {
 	var (
-		hostname       string
-		extraNames     []string
-		storePath      string
-		caPath         string
-		testCAPath     string
-		email          string
-		agreed         bool
-		challenge      string
-		overrideDomain string
-		provider       certmagic.ACMEDNSProvider
+		hostname     string
+		storePath    string
+		defaultProf  profile
+		issuerNodes  []config.Node
+		issuerBlocks []profile
 	)
 	cfg.Bool("debug", true, false, &l.log.Debug)
 	cfg.String("hostname", true, true, "", &hostname)
-	cfg.StringList("extra_names", false, false, nil, &extraNames)
+	cfg.StringList("extra_names", false, false, nil, &defaultProf.names)
 	cfg.String("store_path", false, false,
 		filepath.Join(config.StateDirectory, "acme"), &storePath)
-	cfg.String("ca", false, false,
-		certmagic.LetsEncryptProductionCA, &caPath)
-	cfg.String("test_ca", false, false,
-		certmagic.LetsEncryptStagingCA, &testCAPath)
-	cfg.String("email", false, false,
-		"", &email)
-	cfg.String("override_domain", false, false,
-		"", &overrideDomain)
-	cfg.Bool("agreed", false, false, &agreed)
-	cfg.Enum("challenge", false, true,
-		[]string{"dns-01"}, "dns-01", &challenge)
-	cfg.Custom("dns", false, false, func() (interface{}, error) {
-		return nil, nil
-	}, func(m *config.Map, node config.Node) (interface{}, error) {
-		var p certmagic.ACMEDNSProvider
-		err := modconfig.ModuleFromNode("libdns", node.Args, node, m.Globals, &p)
-		return p, err
-	}, &provider)
+	profileDirectives(cfg, profile{
+		ca:          certmagic.LetsEncryptProductionCA,
+		testCA:      certmagic.LetsEncryptStagingCA,
+		keyType:     string(certmagic.P256),
+		challenge:   "dns-01",
+		tlsALPNPort: 443,
+	}, &defaultProf)
+	cfg.Callback("issuer", func(_ *config.Map, node config.Node) error {
+		issuerNodes = append(issuerNodes, node)
+		return nil
+	})
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	defaultProf.names = append([]string{hostname}, defaultProf.names...)
+
+	// Issuer blocks are processed after top-level directives so they can
+	// inherit their values regardless of the order.
+	seen := make(map[string]string)
+	for _, name := range defaultProf.names {
+		seen[name] = "default"
+	}
+	for _, node := range issuerNodes {
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "expected issuer name")
+		}
+		var p profile
+		m := config.NewMap(cfg.Globals, node)
+		m.StringList("names", false, true, nil, &p.names)
+		inherited := defaultProf
+		inherited.testCA = ""
+		profileDirectives(m, inherited, &p)
+		if _, err := m.Process(); err != nil {
+			return err
+		}
+		// Staging environment of one CA is useless for another one.
+		if p.testCA == "" {
+			p.testCA = defaultProf.testCA
+			if p.ca != defaultProf.ca {
+				p.testCA = p.ca
+			}
+		}
+		for _, name := range p.names {
+			if other, ok := seen[name]; ok {
+				return config.NodeErr(node, "%s is already used by %s issuer", name, other)
+			}
+			seen[name] = node.Args[0]
+		}
+		issuerBlocks = append(issuerBlocks, p)
+	}
 
 	cmLog := l.log.Zap()
 
@@ -83,54 +183,104 @@ func (l *Loader) Init(cfg *config.Map) error {
 	l.cache = certmagic.NewCache(certmagic.CacheOptions{
 		Logger: cmLog,
 		GetConfigForCert: func(c certmagic.Certificate) (*certmagic.Config, error) {
+			for _, name := range c.Names {
+				if issuerCfg, ok := l.nameCfgs[name]; ok {
+					return issuerCfg, nil
+				}
+			}
 			return l.cfg, nil
 		},
 	})
 
-	l.cfg = certmagic.New(l.cache, certmagic.Config{
-		Storage:           l.store, // not sure if it is necessary to set these twice
-		Logger:            cmLog,
-		DefaultServerName: hostname,
-	})
-	issuer := certmagic.NewACMEIssuer(l.cfg, certmagic.ACMEIssuer{
-		Logger: cmLog,
-		CA:     caPath,
-		TestCA: testCAPath,
-		Email:  email,
-		Agreed: agreed,
-	})
-
-	switch challenge {
-	case "dns-01":
-		issuer.DisableTLSALPNChallenge = true
-		issuer.DisableHTTPChallenge = true
-		if provider == nil {
-			return fmt.Errorf("tls.loader.acme: dns-01 challenge requires a configured DNS provider")
+	var err error
+	l.cfg, err = l.newConfig(hostname, defaultProf)
+	if err != nil {
+		return err
+	}
+	issuerCfgs := make([]*certmagic.Config, 0, len(issuerBlocks))
+	for _, p := range issuerBlocks {
+		issuerCfg, err := l.newConfig(hostname, p)
+		if err != nil {
+			return err
 		}
-		issuer.DNS01Solver = &certmagic.DNS01Solver{
-			DNSProvider:    provider,
-			OverrideDomain: overrideDomain,
+		for _, name := range p.names {
+			l.nameCfgs[name] = issuerCfg
 		}
-	default:
-		return fmt.Errorf("tls.loader.acme: challenge not supported")
+		issuerCfgs = append(issuerCfgs, issuerCfg)
 	}
-	l.cfg.Issuers = []certmagic.Issuer{issuer}
 
 	if module.NoRun {
 		return nil
 	}
 
 	manageCtx, cancelManage := context.WithCancel(context.Background())
-	err := l.cfg.ManageAsync(manageCtx, append([]string{hostname}, extraNames...))
-	if err != nil {
+	if err := l.cfg.ManageAsync(manageCtx, defaultProf.names); err != nil {
 		cancelManage()
 		return err
 	}
+	for i, issuerCfg := range issuerCfgs {
+		if err := issuerCfg.ManageAsync(manageCtx, issuerBlocks[i].names); err != nil {
+			cancelManage()
+			return err
+		}
+	}
 	l.cancelManage = cancelManage
 
 	return nil
 }
 
+// newConfig creates the certmagic configuration for the profile. All
+// configurations share the same certificate cache, so certificates obtained
+// using any of them are served by GetCertificate.
+func (l *Loader) newConfig(hostname string, p profile) (*certmagic.Config, error) {
+	cmLog := l.log.Zap()
+
+	cfg := certmagic.New(l.cache, certmagic.Config{
+		Storage:           l.store, // not sure if it is necessary to set these twice
+		Logger:            cmLog,
+		DefaultServerName: hostname,
+		KeySource:         certmagic.StandardKeyGenerator{KeyType: certmagic.KeyType(p.keyType)},
+	})
+	issuer := certmagic.NewACMEIssuer(cfg, certmagic.ACMEIssuer{
+		Logger:          cmLog,
+		CA:              p.ca,
+		TestCA:          p.testCA,
+		Email:           p.email,
+		Agreed:          p.agreed,
+		ExternalAccount: p.eab,
+	})
+
+	switch p.challenge {
+	case "dns-01":
+		issuer.DisableTLSALPNChallenge = true
+		issuer.DisableHTTPChallenge = true
+		if p.provider == nil {
+			return nil, fmt.Errorf("tls.loader.acme: dns-01 challenge requires a configured DNS provider")
+		}
+		issuer.DNS01Solver = &certmagic.DNS01Solver{
+			DNSProvider:    p.provider,
+			OverrideDomain: p.overrideDomain,
+		}
+	case "tls-alpn-01":
+		if p.tlsALPNPort <= 0 || p.tlsALPNPort > 65535 {
+			return nil, fmt.Errorf("tls.loader.acme: invalid tls_alpn_port: %d", p.tlsALPNPort)
+		}
+		for _, name := range p.names {
+			if strings.HasPrefix(name, "*.") {
+				return nil, fmt.Errorf("tls.loader.acme: wildcard names require dns-01 challenge: %s", name)
+			}
+		}
+		issuer.DisableHTTPChallenge = true
+		issuer.ListenHost = p.listenHost
+		issuer.AltTLSALPNPort = p.tlsALPNPort
+	default:
+		return nil, fmt.Errorf("tls.loader.acme: challenge not supported")
+	}
+	cfg.Issuers = []certmagic.Issuer{issuer}
+
+	return cfg, nil
+}
+
 func (l *Loader) ConfigureTLS(c *tls.Config) error {
 	c.GetCertificate = l.cfg.GetCertificate
 	return nil
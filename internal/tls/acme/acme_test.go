@@ -0,0 +1,99 @@
+package acme
+
+import (
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func initLoader(t *testing.T, children []config.Node) (*Loader, error) {
+	t.Helper()
+
+	noRun := module.NoRun
+	module.NoRun = true
+	t.Cleanup(func() { module.NoRun = noRun })
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := mod.(*Loader)
+	err = l.Init(config.NewMap(nil, config.Node{Children: append([]config.Node{
+		{Name: "hostname", Args: []string{"mx.example.org"}},
+		{Name: "store_path", Args: []string{t.TempDir()}},
+		{Name: "challenge", Args: []string{"tls-alpn-01"}},
+	}, children...)}))
+	if l.cache != nil {
+		t.Cleanup(l.cache.Stop)
+	}
+	return l, err
+}
+
+func TestLoader_Issuers(t *testing.T) {
+	l, err := initLoader(t, []config.Node{
+		{Name: "email", Args: []string{"admin@example.org"}},
+		{Name: "key_type", Args: []string{"rsa2048"}},
+		{
+			Name: "issuer",
+			Args: []string{"zerossl"},
+			Children: []config.Node{
+				{Name: "names", Args: []string{"example.net", "mx.example.net"}},
+				{Name: "ca", Args: []string{"zerossl"}},
+				{Name: "eab", Args: []string{"kid", "hmac"}},
+				{Name: "key_type", Args: []string{"p384"}},
+			},
+		},
+		{Name: "extra_names", Args: []string{"example.org"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultIss := l.cfg.Issuers[0].(*certmagic.ACMEIssuer)
+	if defaultIss.CA != certmagic.LetsEncryptProductionCA || defaultIss.ExternalAccount != nil {
+		t.Errorf("Wrong default issuer: %s %v", defaultIss.CA, defaultIss.ExternalAccount)
+	}
+	if _, ok := l.nameCfgs["example.org"]; ok {
+		t.Error("Default names should use the default configuration")
+	}
+
+	cfg := l.nameCfgs["mx.example.net"]
+	if cfg == nil || l.nameCfgs["example.net"] != cfg {
+		t.Fatal("Issuer configuration is not used for its names")
+	}
+	iss := cfg.Issuers[0].(*certmagic.ACMEIssuer)
+	if iss.CA != certmagic.ZeroSSLProductionCA || iss.TestCA != certmagic.ZeroSSLProductionCA {
+		t.Error("Wrong CA:", iss.CA, iss.TestCA)
+	}
+	if iss.ExternalAccount == nil || iss.ExternalAccount.KeyID != "kid" || iss.ExternalAccount.MACKey != "hmac" {
+		t.Error("Wrong EAB:", iss.ExternalAccount)
+	}
+	// Inherited.
+	if iss.Email != "admin@example.org" {
+		t.Error("Email is not inherited:", iss.Email)
+	}
+	if kg := cfg.KeySource.(certmagic.StandardKeyGenerator); kg.KeyType != certmagic.P384 {
+		t.Error("Wrong key type:", kg.KeyType)
+	}
+	if kg := l.cfg.KeySource.(certmagic.StandardKeyGenerator); kg.KeyType != certmagic.RSA2048 {
+		t.Error("Wrong default key type:", kg.KeyType)
+	}
+}
+
+func TestLoader_DuplicateNames(t *testing.T) {
+	_, err := initLoader(t, []config.Node{
+		{
+			Name: "issuer",
+			Args: []string{"buypass"},
+			Children: []config.Node{
+				{Name: "names", Args: []string{"mx.example.org"}},
+				{Name: "ca", Args: []string{"buypass"}},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -19,9 +19,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package tls
 
 import (
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sync"
 	"time"
@@ -30,6 +34,8 @@ import (
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/extkey"
+	"github.com/fsnotify/fsnotify"
 )
 
 type FileLoader struct {
@@ -42,8 +48,14 @@ type FileLoader struct {
 	certs     []tls.Certificate
 	certsLock sync.RWMutex
 
+	ocspStapling bool
+	ocsp         *ocspStapler
+
 	reloadTick *time.Ticker
 	stopTick   chan struct{}
+
+	watcher    *fileWatcher
+	watchDelay time.Duration
 }
 
 func NewFileLoader(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -52,12 +64,14 @@ func NewFileLoader(_, instName string, _, inlineArgs []string) (module.Module, e
 		inlineArgs: inlineArgs,
 		log:        log.Logger{Name: "tls.loader.file", Debug: log.DefaultLogger.Debug},
 		stopTick:   make(chan struct{}),
+		watchDelay: 2 * time.Second,
 	}, nil
 }
 
 func (f *FileLoader) Init(cfg *config.Map) error {
 	cfg.StringList("certs", false, false, nil, &f.certPaths)
 	cfg.StringList("keys", false, false, nil, &f.keyPaths)
+	cfg.Bool("ocsp_stapling", false, true, &f.ocspStapling)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -80,6 +94,14 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 		}
 	}
 
+	if f.ocspStapling {
+		modName := f.instName
+		if modName == "" {
+			modName = f.Name()
+		}
+		f.ocsp = newOCSPStapler(modName, filepath.Join(config.StateDirectory, "ocsp"), f.log)
+	}
+
 	if err := f.loadCerts(); err != nil {
 		return err
 	}
@@ -91,6 +113,19 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 		}
 	})
 
+	watcher, err := newFileWatcher()
+	if err == nil {
+		err = watcher.update(f.watchedPaths())
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		f.log.Error("cannot watch certificate files, changes will be checked every minute", err)
+	} else {
+		f.watcher = watcher
+	}
+
 	f.reloadTick = time.NewTicker(time.Minute)
 	go f.reloadTicker()
 	return nil
@@ -99,6 +134,12 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 func (f *FileLoader) Close() error {
 	f.reloadTick.Stop()
 	f.stopTick <- struct{}{}
+	if f.watcher != nil {
+		f.watcher.Close()
+	}
+	if f.ocsp != nil {
+		f.ocsp.Close()
+	}
 	return nil
 }
 
@@ -111,19 +152,105 @@ func (f *FileLoader) InstanceName() string {
 }
 
 func (f *FileLoader) reloadTicker() {
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+		// Files are usually changed in several steps (e.g. certificate and
+		// key are written separately), so the reload is delayed until
+		// changes stop.
+		delayed <-chan time.Time
+	)
+	if f.watcher != nil {
+		events = f.watcher.w.Events
+		errs = f.watcher.w.Errors
+	}
+
+	f.refreshStaples()
 	for {
 		select {
+		case ev := <-events:
+			if f.watcher.relevant(ev) {
+				f.log.Debugln(ev.Name, "changed")
+				delayed = time.After(f.watchDelay)
+			}
+		case err := <-errs:
+			f.log.Error("file watcher error", err)
+		case <-delayed:
+			delayed = nil
+			f.log.Println("certificate files changed, reloading")
+			if err := f.loadCerts(); err != nil {
+				f.log.Error("reload failed", err)
+				continue
+			}
+			if err := f.watcher.update(f.watchedPaths()); err != nil {
+				f.log.Error("cannot watch certificate files", err)
+			}
+			f.refreshStaples()
 		case <-f.reloadTick.C:
 			f.log.Debugln("reloading certs")
 			if err := f.loadCerts(); err != nil {
 				f.log.Error("reload failed", err)
 			}
+			f.refreshStaples()
 		case <-f.stopTick:
 			return
 		}
 	}
 }
 
+func (f *FileLoader) watchedPaths() []string {
+	paths := make([]string, 0, len(f.certPaths)+len(f.keyPaths))
+	paths = append(paths, f.certPaths...)
+	for _, keyPath := range f.keyPaths {
+		if !extkey.IsExternal(keyPath) {
+			paths = append(paths, keyPath)
+		}
+	}
+	return paths
+}
+
+// loadKeyPair is tls.LoadX509KeyPair that also accepts URIs of keys
+// stored in PKCS#11 tokens or remote signers (see extkey package).
+func loadKeyPair(certPath, keyPath string) (tls.Certificate, error) {
+	if !extkey.IsExternal(keyPath) {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("no certificates found")
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	signer, err := extkey.Load(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pub, ok := cert.Leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Public()) {
+		return tls.Certificate{}, errors.New("private key does not match public key")
+	}
+	cert.PrivateKey = signer
+	return cert, nil
+}
+
 func (f *FileLoader) loadCerts() error {
 	if len(f.certPaths) != len(f.keyPaths) {
 		return errors.New("mismatch in certs and keys count")
@@ -139,13 +266,17 @@ func (f *FileLoader) loadCerts() error {
 		certPath := f.certPaths[i]
 		keyPath := f.keyPaths[i]
 
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		cert, err := loadKeyPair(certPath, keyPath)
 		if err != nil {
-			return fmt.Errorf("failed to load %s and %s: %v", certPath, keyPath, err)
+			return fmt.Errorf("failed to load %s and %s: %v", certPath, extkey.Redacted(keyPath), err)
 		}
 		certs = append(certs, cert)
 	}
 
+	if f.ocsp != nil {
+		certs = f.ocsp.attach(certs, f.certPaths)
+	}
+
 	f.certsLock.Lock()
 	defer f.certsLock.Unlock()
 	f.certs = certs
@@ -153,6 +284,26 @@ func (f *FileLoader) loadCerts() error {
 	return nil
 }
 
+// refreshStaples fetches OCSP responses that are missing or should be
+// updated and staples them to loaded certificates.
+func (f *FileLoader) refreshStaples() {
+	if f.ocsp == nil {
+		return
+	}
+
+	f.certsLock.RLock()
+	certs := f.certs
+	f.certsLock.RUnlock()
+
+	if !f.ocsp.refresh(certs, f.certPaths) {
+		return
+	}
+
+	f.certsLock.Lock()
+	defer f.certsLock.Unlock()
+	f.certs = f.ocsp.attach(f.certs, f.certPaths)
+}
+
 func (f *FileLoader) ConfigureTLS(c *tls.Config) error {
 	// Loader function replaces only the whole slice.
 	f.certsLock.RLock()
@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func writeTestCert(t *testing.T, certPath, keyPath, name string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadedName(t *testing.T, f *FileLoader) string {
+	t.Helper()
+
+	var c tls.Config
+	if err := f.ConfigureTLS(&c); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(c.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestFileLoader_Watch(t *testing.T) {
+	// Layout similar to the one used by certbot: files in the "live"
+	// directory are symlinks to files in the "archive" directory.
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	live := filepath.Join(dir, "live")
+	for _, d := range []string{archive, live} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestCert(t, filepath.Join(archive, "cert1.pem"), filepath.Join(archive, "key1.pem"), "old.example.org")
+	certPath := filepath.Join(live, "cert.pem")
+	keyPath := filepath.Join(live, "key.pem")
+	if err := os.Symlink(filepath.Join(archive, "cert1.pem"), certPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(archive, "key1.pem"), keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewFileLoader("tls.loader.file", "", nil, []string{certPath, keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := mod.(*FileLoader)
+	f.log = testutils.Logger(t, "tls.loader.file")
+	f.watchDelay = 10 * time.Millisecond
+	if err := f.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "ocsp_stapling", Args: []string{"no"}},
+	}})); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.watcher == nil {
+		t.Skip("fsnotify is not available")
+	}
+
+	if name := loadedName(t, f); name != "old.example.org" {
+		t.Fatal("Wrong certificate loaded:", name)
+	}
+
+	writeTestCert(t, filepath.Join(archive, "cert2.pem"), filepath.Join(archive, "key2.pem"), "new.example.org")
+	for _, pair := range [][2]string{{"cert2.pem", certPath}, {"key2.pem", keyPath}} {
+		tmp := pair[1] + ".tmp"
+		if err := os.Symlink(filepath.Join(archive, pair[0]), tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for loadedName(t, f) != "new.example.org" {
+		if time.Now().After(deadline) {
+			t.Fatal("Certificate is not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
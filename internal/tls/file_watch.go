@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileWatcher reports changes to certificate and key files.
+//
+// Parent directories are watched instead of files since renewal tools
+// usually replace files (or symlinks to them, like certbot does) instead of
+// writing them in place. Targets of symlinks are watched too.
+type fileWatcher struct {
+	w *fsnotify.Watcher
+
+	dirs  map[string]struct{}
+	paths map[string]struct{}
+}
+
+func newFileWatcher() (*fileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fileWatcher{
+		w:    w,
+		dirs: make(map[string]struct{}),
+	}, nil
+}
+
+// update sets the list of watched files. It should be called again after
+// files are changed since symlink targets may change.
+func (fw *fileWatcher) update(paths []string) error {
+	watched := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		watched[filepath.Clean(path)] = struct{}{}
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			watched[target] = struct{}{}
+		}
+	}
+
+	for path := range watched {
+		dir := filepath.Dir(path)
+		if _, ok := fw.dirs[dir]; ok {
+			continue
+		}
+		if err := fw.w.Add(dir); err != nil {
+			return err
+		}
+		fw.dirs[dir] = struct{}{}
+	}
+	fw.paths = watched
+	return nil
+}
+
+// relevant reports whether the event is for one of watched files.
+func (fw *fileWatcher) relevant(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	_, ok := fw.paths[filepath.Clean(ev.Name)]
+	return ok
+}
+
+func (fw *fileWatcher) Close() error {
+	return fw.w.Close()
+}
@@ -0,0 +1,339 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryDelay is how long to wait before fetching the response again
+	// after a failure.
+	ocspRetryDelay = 10 * time.Minute
+	// ocspDefaultRefresh is used for responses without NextUpdate.
+	ocspDefaultRefresh = 12 * time.Hour
+	// ocspMaxResponse limits the size of responses read from responders.
+	ocspMaxResponse = 1024 * 1024
+)
+
+// ocspStaple is the OCSP state of one certificate.
+type ocspStaple struct {
+	name string
+
+	der  []byte
+	resp *ocsp.Response
+
+	nextTry time.Time
+	// noOCSP is set for certificates that can't be stapled (no responder
+	// URL or no issuer in the chain).
+	noOCSP bool
+}
+
+// valid reports whether the response can be stapled at the time.
+func (s *ocspStaple) valid(now time.Time) bool {
+	if s.resp == nil || s.resp.Status == ocsp.Unknown {
+		return false
+	}
+	return s.resp.NextUpdate.IsZero() || now.Before(s.resp.NextUpdate)
+}
+
+// due reports whether the response should be refreshed. Responses are
+// refreshed after half of their validity period passes.
+func (s *ocspStaple) due(now time.Time) bool {
+	if s.noOCSP || now.Before(s.nextTry) {
+		return false
+	}
+	if s.resp == nil {
+		return true
+	}
+	refreshAt := s.resp.ThisUpdate.Add(ocspDefaultRefresh)
+	if !s.resp.NextUpdate.IsZero() {
+		refreshAt = s.resp.ThisUpdate.Add(s.resp.NextUpdate.Sub(s.resp.ThisUpdate) / 2)
+	}
+	return !now.Before(refreshAt)
+}
+
+// ocspStapler fetches OCSP responses for certificates, caches them in
+// memory and on disk and attaches them to certificates.
+type ocspStapler struct {
+	modName string
+	log     log.Logger
+	dir     string
+	client  http.Client
+
+	lock    sync.Mutex
+	staples map[string]*ocspStaple
+}
+
+func newOCSPStapler(modName, dir string, logger log.Logger) *ocspStapler {
+	s := &ocspStapler{
+		modName: modName,
+		log:     logger,
+		dir:     dir,
+		client:  http.Client{Timeout: 30 * time.Second},
+		staples: make(map[string]*ocspStaple),
+	}
+	ocspMetrics.add(s)
+	return s
+}
+
+func (s *ocspStapler) Close() {
+	ocspMetrics.remove(s)
+}
+
+func certKey(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+func parseChain(cert *tls.Certificate) (leaf, issuer *x509.Certificate, err error) {
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cert.Certificate) < 2 {
+		return leaf, nil, nil
+	}
+	issuer, err = x509.ParseCertificate(cert.Certificate[1])
+	return leaf, issuer, err
+}
+
+// entry returns the state for the certificate, loading the cached response
+// from disk if it is not known yet.
+//
+// s.lock should be held.
+func (s *ocspStapler) entry(cert *tls.Certificate, name string) *ocspStaple {
+	key := certKey(cert)
+	if st, ok := s.staples[key]; ok {
+		return st
+	}
+
+	st := &ocspStaple{name: name}
+	s.staples[key] = st
+
+	leaf, issuer, err := parseChain(cert)
+	if err != nil || len(leaf.OCSPServer) == 0 || issuer == nil {
+		if err == nil && len(leaf.OCSPServer) != 0 {
+			s.log.Msg("certificate chain has no issuer, OCSP stapling is not possible", "cert", name)
+		}
+		st.noOCSP = true
+		return st
+	}
+
+	der, err := os.ReadFile(filepath.Join(s.dir, key+".ocsp"))
+	if err != nil {
+		return st
+	}
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		s.log.Debugf("ignoring cached OCSP response for %s: %v", name, err)
+		return st
+	}
+	st.der = der
+	st.resp = resp
+	return st
+}
+
+// attach returns the copy of certs with valid OCSP responses stapled.
+// names are used in logs and metrics.
+func (s *ocspStapler) attach(certs []tls.Certificate, names []string) []tls.Certificate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	res := make([]tls.Certificate, len(certs))
+	for i := range certs {
+		res[i] = certs[i]
+		res[i].OCSPStaple = nil
+		if st := s.entry(&res[i], names[i]); st.valid(now) {
+			res[i].OCSPStaple = st.der
+		}
+	}
+	return res
+}
+
+// refresh fetches new responses for certificates that need them. It returns
+// true if any response was changed and certificates should be attached
+// again.
+func (s *ocspStapler) refresh(certs []tls.Certificate, names []string) bool {
+	changed := false
+	for i := range certs {
+		cert := &certs[i]
+
+		s.lock.Lock()
+		st := s.entry(cert, names[i])
+		due := st.due(time.Now())
+		s.lock.Unlock()
+		if !due {
+			continue
+		}
+
+		der, resp, err := s.fetch(cert)
+
+		s.lock.Lock()
+		if err != nil {
+			st.nextTry = time.Now().Add(ocspRetryDelay)
+			s.lock.Unlock()
+			s.log.Error("OCSP response fetch failed", err, "cert", names[i])
+			continue
+		}
+		st.der = der
+		st.resp = resp
+		s.lock.Unlock()
+		changed = true
+
+		if resp.Status == ocsp.Revoked {
+			s.log.Msg("certificate is revoked", "cert", names[i], "revoked_at", resp.RevokedAt)
+		}
+		s.log.Debugf("OCSP response for %s updated, next update at %v", names[i], resp.NextUpdate)
+
+		if err := s.store(certKey(cert), der); err != nil {
+			s.log.Error("failed to cache OCSP response", err, "cert", names[i])
+		}
+	}
+	return changed
+}
+
+func (s *ocspStapler) fetch(cert *tls.Certificate) ([]byte, *ocsp.Response, error) {
+	leaf, issuer, err := parseChain(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var lastErr error
+	for _, server := range leaf.OCSPServer {
+		httpResp, err := s.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		der, err := io.ReadAll(io.LimitReader(httpResp.Body, ocspMaxResponse))
+		httpResp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if httpResp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("%s: unexpected status: %s", server, httpResp.Status)
+			continue
+		}
+
+		resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", server, err)
+			continue
+		}
+		if resp.Status == ocsp.Unknown {
+			lastErr = fmt.Errorf("%s: certificate status is unknown", server)
+			continue
+		}
+		return der, resp, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no OCSP responders")
+	}
+	return nil, nil, lastErr
+}
+
+func (s *ocspStapler) store(key string, der []byte) error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, key+".ocsp.tmp")
+	if err := os.WriteFile(tmp, der, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, key+".ocsp"))
+}
+
+// ocspCollector reports the age of stapled responses. The age is computed
+// on each scrape so it can be used for alerting on stale staples.
+type ocspCollector struct {
+	desc *prometheus.Desc
+
+	lock     sync.Mutex
+	staplers map[*ocspStapler]struct{}
+}
+
+func (c *ocspCollector) add(s *ocspStapler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.staplers[s] = struct{}{}
+}
+
+func (c *ocspCollector) remove(s *ocspStapler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.staplers, s)
+}
+
+func (c *ocspCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *ocspCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for s := range c.staplers {
+		s.lock.Lock()
+		for _, st := range s.staples {
+			if !st.valid(now) {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+				now.Sub(st.resp.ThisUpdate).Seconds(), s.modName, st.name)
+		}
+		s.lock.Unlock()
+	}
+}
+
+var ocspMetrics = &ocspCollector{
+	desc: prometheus.NewDesc(
+		"maddy_tls_ocsp_staple_age_seconds",
+		"Time since the stapled OCSP response was produced",
+		[]string{"module", "cert"}, nil,
+	),
+	staplers: make(map[*ocspStapler]struct{}),
+}
+
+func init() {
+	prometheus.MustRegister(ocspMetrics)
+}
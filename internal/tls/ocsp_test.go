@@ -0,0 +1,177 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/ocsp"
+)
+
+func testChain(t *testing.T, ocspURL string) (tls.Certificate, *x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mx.example.org"},
+		DNSNames:     []string{"mx.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		OCSPServer:   []string{ocspURL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der, caDER},
+		PrivateKey:  key,
+	}, ca, caKey
+}
+
+func TestOCSPStapler(t *testing.T) {
+	var (
+		requests int32
+		fail     int32
+		ca       *x509.Certificate
+		caKey    crypto.Signer
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(resp)
+	}))
+	defer srv.Close()
+
+	var cert tls.Certificate
+	cert, ca, caKey = testChain(t, srv.URL)
+	certs := []tls.Certificate{cert}
+	names := []string{"/test/cert.pem"}
+	dir := t.TempDir()
+
+	s := newOCSPStapler("test", dir, testutils.Logger(t, "tls"))
+	defer s.Close()
+	if staple := s.attach(certs, names)[0].OCSPStaple; staple != nil {
+		t.Fatal("Unexpected staple before fetch")
+	}
+	if !s.refresh(certs, names) {
+		t.Fatal("Response is not fetched")
+	}
+	stapled := s.attach(certs, names)
+	if stapled[0].OCSPStaple == nil {
+		t.Fatal("Response is not stapled")
+	}
+	if certs[0].OCSPStaple != nil {
+		t.Fatal("Original certificates are modified")
+	}
+
+	// Not refreshed until half of the validity period passes.
+	if s.refresh(certs, names) || atomic.LoadInt32(&requests) != 1 {
+		t.Fatal("Response is refreshed too early")
+	}
+
+	// Cached response is used after restart.
+	s2 := newOCSPStapler("test", dir, testutils.Logger(t, "tls"))
+	defer s2.Close()
+	if staple := s2.attach(certs, names)[0].OCSPStaple; staple == nil {
+		t.Fatal("Cached response is not used")
+	}
+
+	// Failures are not retried immediately.
+	s3 := newOCSPStapler("test", t.TempDir(), testutils.Logger(t, "tls"))
+	defer s3.Close()
+	atomic.StoreInt32(&fail, 1)
+	if s3.refresh(certs, names) {
+		t.Fatal("Unexpected refresh")
+	}
+	if s3.refresh(certs, names) || atomic.LoadInt32(&requests) != 2 {
+		t.Fatal("Failed fetch is retried immediately")
+	}
+}
+
+func TestOCSPStapler_NoIssuer(t *testing.T) {
+	cert, _, _ := testChain(t, "http://127.0.0.1:0")
+	cert.Certificate = cert.Certificate[:1]
+
+	s := newOCSPStapler("test", t.TempDir(), testutils.Logger(t, "tls"))
+	defer s.Close()
+	if s.refresh([]tls.Certificate{cert}, []string{"cert"}) {
+		t.Fatal("Unexpected refresh")
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// SNILoader selects the certificate loader using the server name requested
+// by the client, so one endpoint can serve certificates for multiple
+// unrelated domains.
+type SNILoader struct {
+	instName string
+
+	// loaders contains loaders for exact names and wildcards ("*.example.org").
+	loaders map[string]module.TLSLoader
+	def     module.TLSLoader
+}
+
+func NewSNILoader(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("tls.loader.sni: inline arguments are not used")
+	}
+	return &SNILoader{
+		instName: instName,
+		loaders:  make(map[string]module.TLSLoader),
+	}, nil
+}
+
+func loaderDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var l module.TLSLoader
+	err := modconfig.ModuleFromNode("tls.loader", node.Args, node, m.Globals, &l)
+	return l, err
+}
+
+func (l *SNILoader) Init(cfg *config.Map) error {
+	cfg.Callback("domain", func(m *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one name is required")
+		}
+
+		var loader module.TLSLoader
+		child := config.NewMap(m.Globals, node)
+		child.Custom("loader", false, true, nil, loaderDirective, &loader)
+		if _, err := child.Process(); err != nil {
+			return err
+		}
+
+		for _, name := range node.Args {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+				return config.NodeErr(node, "only wildcards for the leftmost label are supported: %s", name)
+			}
+			if _, ok := l.loaders[name]; ok {
+				return config.NodeErr(node, "duplicate name: %s", name)
+			}
+			l.loaders[name] = loader
+		}
+		return nil
+	})
+	cfg.Custom("default", false, false, nil, loaderDirective, &l.def)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(l.loaders) == 0 {
+		return errors.New("tls.loader.sni: at least one domain is required")
+	}
+	return nil
+}
+
+// loaderFor returns the loader for the server name. Exact matches take
+// precedence over wildcards.
+func (l *SNILoader) loaderFor(serverName string) module.TLSLoader {
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if serverName != "" {
+		if loader, ok := l.loaders[serverName]; ok {
+			return loader
+		}
+		if _, parent, ok := strings.Cut(serverName, "."); ok {
+			if loader, ok := l.loaders["*."+parent]; ok {
+				return loader
+			}
+		}
+	}
+	return l.def
+}
+
+func (l *SNILoader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loader := l.loaderFor(hello.ServerName)
+	if loader == nil {
+		return nil, fmt.Errorf("tls.loader.sni: no certificate for %q", hello.ServerName)
+	}
+
+	// Loaders are queried on each handshake so reloaded certificates are
+	// picked up.
+	var sub tls.Config
+	if err := loader.ConfigureTLS(&sub); err != nil {
+		return nil, err
+	}
+	if sub.GetCertificate != nil {
+		return sub.GetCertificate(hello)
+	}
+	if len(sub.Certificates) == 0 {
+		return nil, fmt.Errorf("tls.loader.sni: no certificate for %q", hello.ServerName)
+	}
+	if len(sub.Certificates) == 1 {
+		return &sub.Certificates[0], nil
+	}
+
+	// Prefer certificates valid for the name and supported by the client.
+	var supported *tls.Certificate
+	for i := range sub.Certificates {
+		cert := &sub.Certificates[i]
+		if hello.SupportsCertificate(cert) != nil {
+			continue
+		}
+		if supported == nil {
+			supported = cert
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			var err error
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				continue
+			}
+		}
+		if hello.ServerName != "" && leaf.VerifyHostname(hello.ServerName) == nil {
+			return cert, nil
+		}
+	}
+	if supported != nil {
+		return supported, nil
+	}
+	return &sub.Certificates[0], nil
+}
+
+func (l *SNILoader) ConfigureTLS(c *tls.Config) error {
+	c.GetCertificate = l.getCertificate
+	return nil
+}
+
+func (l *SNILoader) Name() string {
+	return "tls.loader.sni"
+}
+
+func (l *SNILoader) InstanceName() string {
+	return l.instName
+}
+
+func init() {
+	var _ module.TLSLoader = &SNILoader{}
+	module.Register("tls.loader.sni", NewSNILoader)
+}
@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestSNILoader(t *testing.T) {
+	nodes, err := parser.Read(strings.NewReader(`
+		domain imap.example.org mail.example.org {
+			loader self_signed imap.example.org mail.example.org
+		}
+		domain *.example.com {
+			loader self_signed wildcard.example.com
+		}
+		domain exact.example.com {
+			loader self_signed exact.example.com
+		}
+		default self_signed default.example.net`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewSNILoader("tls.loader.sni", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := mod.(*SNILoader)
+	if err := l.Init(config.NewMap(nil, config.Node{Children: nodes})); err != nil {
+		t.Fatal(err)
+	}
+
+	var c tls.Config
+	if err := l.ConfigureTLS(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, wantName := range map[string]string{
+		"imap.example.org":  "imap.example.org",
+		"MAIL.example.org.": "imap.example.org",
+		"a.example.com":     "wildcard.example.com",
+		"exact.example.com": "exact.example.com",
+		"a.b.example.com":   "default.example.net",
+		"example.com":       "default.example.net",
+		"":                  "default.example.net",
+	} {
+		cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Errorf("%s: %v", serverName, err)
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.DNSNames[0] != wantName {
+			t.Errorf("%s: wrong certificate: %v", serverName, leaf.DNSNames)
+		}
+	}
+
+	l.def = nil
+	if _, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.net"}); err == nil {
+		t.Error("Expected an error without default loader")
+	}
+}
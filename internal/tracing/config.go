@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Config is the tracing configuration read from the global tracing block.
+type Config struct {
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string
+	SampleRatio float64
+}
+
+// Directive parses the tracing block:
+//
+//	tracing {
+//	    endpoint http://127.0.0.1:4318
+//	    header Authorization "Bearer token"
+//	    service_name maddy
+//	    sample_ratio 1.0
+//	}
+func Directive(m *config.Map, node config.Node) (interface{}, error) {
+	cfg := &Config{Headers: map[string]string{}}
+
+	childM := config.NewMap(m.Globals, node)
+	childM.String("endpoint", false, true, "", &cfg.Endpoint)
+	childM.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected two arguments: name and value")
+		}
+		cfg.Headers[node.Args[0]] = node.Args[1]
+		return nil
+	})
+	childM.String("service_name", false, false, "maddy", &cfg.ServiceName)
+	childM.Float("sample_ratio", false, false, 1, &cfg.SampleRatio)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, config.NodeErr(node, "endpoint should be an http:// or https:// URL")
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, config.NodeErr(node, "sample_ratio should be between 0 and 1")
+	}
+
+	return cfg, nil
+}
+
+// Setup configures the global OpenTelemetry tracer provider to export spans
+// using OTLP over HTTP. Returned function flushes pending spans and should be
+// called on shutdown.
+func Setup(cfg *Config, version string) (func(), error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithHeaders(cfg.Headers),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithIDGenerator(idGenerator{}),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", cfg.ServiceName),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("tracing: %v", err)
+	}))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("tracing: shutdown failed: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,109 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tracing implements OpenTelemetry tracing of message processing.
+//
+// All spans related to a message belong to the same trace, its ID is derived
+// from the maddy trace ID (module.MsgMetadata.TraceID) by prepending zeros
+// to it (random part is kept in the rightmost bytes as recommended by W3C
+// Trace Context and used by ratio-based samplers). This way, delivery
+// attempts made by the queue (possibly after a restart) are attached to the
+// trace started on message reception.
+//
+// If tracing is not configured, the no-op OpenTelemetry implementation is
+// used and functions of this package have negligible overhead.
+package tracing
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/slowlog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/foxcpp/maddy"
+
+type msgTraceKey struct{}
+
+// MsgTraceID converts the maddy trace ID into the OpenTelemetry trace ID.
+// Returned value is invalid (zero) if the trace ID is malformed.
+func MsgTraceID(traceID string) trace.TraceID {
+	var id trace.TraceID
+	raw, err := hex.DecodeString(traceID)
+	if err != nil || len(raw) == 0 || len(raw) > len(id) {
+		return trace.TraceID{}
+	}
+	copy(id[len(id)-len(raw):], raw)
+	return id
+}
+
+// idGenerator uses the trace ID of the message for root spans started by
+// StartMsg and random IDs otherwise.
+type idGenerator struct{}
+
+func (idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	traceID, ok := ctx.Value(msgTraceKey{}).(trace.TraceID)
+	if !ok || !traceID.IsValid() {
+		_, _ = crand.Read(traceID[:])
+	}
+	return traceID, idGenerator{}.NewSpanID(ctx, traceID)
+}
+
+func (idGenerator) NewSpanID(_ context.Context, _ trace.TraceID) trace.SpanID {
+	var spanID trace.SpanID
+	_, _ = crand.Read(spanID[:])
+	return spanID
+}
+
+// Start starts a span that is a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartMsg starts a root span for the message processing, e.g. reception or
+// a delivery attempt. Returned context also makes slow operations logged by
+// the slowlog package include the trace ID.
+func StartMsg(ctx context.Context, name string, msgMeta *module.MsgMetadata, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx = context.WithValue(ctx, msgTraceKey{}, MsgTraceID(msgMeta.TraceID))
+	ctx = slowlog.ContextWithTraceID(ctx, msgMeta.TraceID)
+	attrs = append(attrs,
+		attribute.String("maddy.msg_id", msgMeta.ID),
+		attribute.String("maddy.trace_id", msgMeta.TraceID))
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithNewRoot(), trace.WithAttributes(attrs...))
+}
+
+// SetError records the error, if any, and marks the span as failed.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End records the error, if any, and ends the span.
+func End(span trace.Span, err error) {
+	SetError(span, err)
+	span.End()
+}
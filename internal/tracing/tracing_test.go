@@ -0,0 +1,85 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMsgTraceID(t *testing.T) {
+	id := MsgTraceID("0123456789abcdef")
+	if id.String() != "00000000000000000123456789abcdef" {
+		t.Errorf("Wrong trace ID: %v", id)
+	}
+	for _, malformed := range []string{"", "xyz", "0123456789abcdef0123456789abcdef01"} {
+		if MsgTraceID(malformed).IsValid() {
+			t.Errorf("Expected invalid trace ID for %q", malformed)
+		}
+	}
+}
+
+func TestStartMsg(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exp),
+		sdktrace.WithIDGenerator(idGenerator{}),
+	)
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	msgMeta := &module.MsgMetadata{ID: "msgid", TraceID: "0123456789abcdef"}
+
+	// Both spans belong to the message trace even though the second one is
+	// not started from the context of the first one (e.g. it is a delivery
+	// attempt done by the queue).
+	ctx, span := StartMsg(context.Background(), "smtp.receive", msgMeta)
+	_, child := Start(ctx, "smtp.rcpt")
+	End(child, errors.New("rejected"))
+	End(span, nil)
+	_, attempt := StartMsg(context.Background(), "queue.deliver", msgMeta)
+	End(attempt, nil)
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Wrong amount of spans: %d", len(spans))
+	}
+	for _, s := range spans {
+		if s.SpanContext.TraceID() != MsgTraceID(msgMeta.TraceID) {
+			t.Errorf("Span %s has wrong trace ID: %v", s.Name, s.SpanContext.TraceID())
+		}
+	}
+	if spans[0].Parent.SpanID() != spans[1].SpanContext.SpanID() {
+		t.Error("Child span is not attached to the message span")
+	}
+	if spans[0].Status.Code != codes.Error || spans[1].Status.Code == codes.Error {
+		t.Error("Wrong span status")
+	}
+	if spans[2].Parent.IsValid() {
+		t.Error("Delivery attempt span should be a root span")
+	}
+}
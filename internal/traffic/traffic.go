@@ -0,0 +1,184 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package traffic implements per-domain accounting of messages exchanged
+// with other servers.
+//
+// Messages received from unauthenticated clients are accounted to the
+// recipient domain (local) and the sender domain (remote). Messages sent by
+// target.remote are accounted to the sender domain (local) and the recipient
+// domain (remote).
+package traffic
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Traffic directions.
+const (
+	Received = "received"
+	Sent     = "sent"
+)
+
+var (
+	trafficMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "traffic",
+			Name:      "messages",
+			Help:      "Messages exchanged with other servers by local and remote domain",
+		},
+		[]string{"direction", "local_domain", "remote_domain"},
+	)
+	trafficBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "traffic",
+			Name:      "bytes",
+			Help:      "Size of messages exchanged with other servers by local and remote domain",
+		},
+		[]string{"direction", "local_domain", "remote_domain"},
+	)
+)
+
+type key struct {
+	direction, local, remote string
+}
+
+type counters struct {
+	messages, bytes uint64
+}
+
+// Record is the accounting data for a pair of domains.
+type Record struct {
+	Direction    string `json:"direction"`
+	LocalDomain  string `json:"local_domain"`
+	RemoteDomain string `json:"remote_domain"`
+	Messages     uint64 `json:"messages"`
+	Bytes        uint64 `json:"bytes"`
+}
+
+// Report is the accounting data collected since Start.
+type Report struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Records []Record  `json:"records"`
+}
+
+var (
+	lock   sync.Mutex
+	data   = map[key]*counters{}
+	period = time.Now()
+)
+
+// Account records a message of the specified size exchanged between the
+// domains.
+func Account(direction, localDomain, remoteDomain string, size int) {
+	trafficMessages.WithLabelValues(direction, localDomain, remoteDomain).Inc()
+	trafficBytes.WithLabelValues(direction, localDomain, remoteDomain).Add(float64(size))
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	k := key{direction, localDomain, remoteDomain}
+	c := data[k]
+	if c == nil {
+		c = &counters{}
+		data[k] = c
+	}
+	c.messages++
+	c.bytes += uint64(size)
+}
+
+// Snapshot returns the collected data sorted by direction and domains.
+//
+// If reset is true, the data is cleared and a new accounting period is
+// started. Prometheus metrics are not affected by reset.
+func Snapshot(reset bool) Report {
+	lock.Lock()
+	defer lock.Unlock()
+
+	r := Report{
+		Start:   period,
+		End:     time.Now(),
+		Records: make([]Record, 0, len(data)),
+	}
+	for k, c := range data {
+		r.Records = append(r.Records, Record{
+			Direction:    k.direction,
+			LocalDomain:  k.local,
+			RemoteDomain: k.remote,
+			Messages:     c.messages,
+			Bytes:        c.bytes,
+		})
+	}
+	sort.Slice(r.Records, func(i, j int) bool {
+		a, b := r.Records[i], r.Records[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.LocalDomain != b.LocalDomain {
+			return a.LocalDomain < b.LocalDomain
+		}
+		return a.RemoteDomain < b.RemoteDomain
+	})
+
+	if reset {
+		data = map[key]*counters{}
+		period = r.End
+	}
+	return r
+}
+
+// Domain returns the normalized domain of the address. Empty string is
+// returned for the null return-path and malformed addresses.
+func Domain(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil {
+		return ""
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// MessageSize returns the size of the message including the header.
+func MessageSize(header textproto.Header, body buffer.Buffer) int {
+	var hdr bytes.Buffer
+	_ = textproto.WriteHeader(&hdr, header)
+	return hdr.Len() + body.Len()
+}
+
+func init() {
+	prometheus.MustRegister(trafficMessages)
+	prometheus.MustRegister(trafficBytes)
+}
@@ -0,0 +1,77 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package traffic
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+func TestSnapshot(t *testing.T) {
+	Snapshot(true)
+
+	Account(Sent, "example.org", "example.com", 100)
+	Account(Received, "example.org", "example.net", 10)
+	Account(Sent, "example.org", "example.com", 200)
+	Account(Received, "example.org", "", 20)
+
+	first := Snapshot(true)
+	want := []Record{
+		{Direction: Received, LocalDomain: "example.org", RemoteDomain: "", Messages: 1, Bytes: 20},
+		{Direction: Received, LocalDomain: "example.org", RemoteDomain: "example.net", Messages: 1, Bytes: 10},
+		{Direction: Sent, LocalDomain: "example.org", RemoteDomain: "example.com", Messages: 2, Bytes: 300},
+	}
+	if !reflect.DeepEqual(first.Records, want) {
+		t.Fatalf("wrong records: %+v", first.Records)
+	}
+
+	second := Snapshot(false)
+	if len(second.Records) != 0 {
+		t.Fatalf("counters are not reset: %+v", second.Records)
+	}
+	if !second.Start.Equal(first.End) {
+		t.Errorf("wrong period start: %v, want %v", second.Start, first.End)
+	}
+}
+
+func TestDomain(t *testing.T) {
+	for addr, domain := range map[string]string{
+		"":                  "",
+		"user@EXAMPLE.org":  "example.org",
+		"user@example.org.": "example.org",
+		"malformed":         "",
+	} {
+		if got := Domain(addr); got != domain {
+			t.Errorf("Domain(%q) = %q, want %q", addr, got, domain)
+		}
+	}
+}
+
+func TestMessageSize(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "test")
+	body := buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}
+	// "Subject: test\r\n\r\n" + body
+	if size := MessageSize(hdr, body); size != 17+8 {
+		t.Errorf("wrong size: %d", size)
+	}
+}
@@ -36,8 +36,13 @@ import (
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/panics"
+	"github.com/foxcpp/maddy/framework/slowlog"
 	"github.com/foxcpp/maddy/internal/authz"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/history"
+	"github.com/foxcpp/maddy/internal/tracing"
 	"github.com/urfave/cli/v2"
 
 	// Import packages for side-effect of module registration.
@@ -49,17 +54,36 @@ import (
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/auth/wforce"
 	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
+	_ "github.com/foxcpp/maddy/internal/check/callout"
+	_ "github.com/foxcpp/maddy/internal/check/clamav"
 	_ "github.com/foxcpp/maddy/internal/check/command"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
+	_ "github.com/foxcpp/maddy/internal/check/domain_age"
+	_ "github.com/foxcpp/maddy/internal/check/flood"
+	_ "github.com/foxcpp/maddy/internal/check/geoip"
+	_ "github.com/foxcpp/maddy/internal/check/header_policy"
+	_ "github.com/foxcpp/maddy/internal/check/impersonation"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
+	_ "github.com/foxcpp/maddy/internal/check/mime_policy"
+	_ "github.com/foxcpp/maddy/internal/check/quota"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
+	_ "github.com/foxcpp/maddy/internal/check/spamassassin"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/check/tls_downgrade"
+	_ "github.com/foxcpp/maddy/internal/check/uribl"
+	_ "github.com/foxcpp/maddy/internal/check/webhook"
+	_ "github.com/foxcpp/maddy/internal/dmarc/report"
+	_ "github.com/foxcpp/maddy/internal/endpoint/adminapi"
+	_ "github.com/foxcpp/maddy/internal/endpoint/alerts"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
+	_ "github.com/foxcpp/maddy/internal/endpoint/health"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
+	_ "github.com/foxcpp/maddy/internal/endpoint/list_unsubscribe"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
 	_ "github.com/foxcpp/maddy/internal/imap_filter"
@@ -67,13 +91,20 @@ import (
 	_ "github.com/foxcpp/maddy/internal/libdns"
 	_ "github.com/foxcpp/maddy/internal/modify"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
+	_ "github.com/foxcpp/maddy/internal/modify/pgp"
+	_ "github.com/foxcpp/maddy/internal/modify/smime"
+	_ "github.com/foxcpp/maddy/internal/modify/vacation"
+	_ "github.com/foxcpp/maddy/internal/state"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/s3"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
 	_ "github.com/foxcpp/maddy/internal/table"
+	_ "github.com/foxcpp/maddy/internal/target/list"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"
+	_ "github.com/foxcpp/maddy/internal/target/route"
 	_ "github.com/foxcpp/maddy/internal/target/smtp"
+	_ "github.com/foxcpp/maddy/internal/target/transport"
 	_ "github.com/foxcpp/maddy/internal/tls"
 	_ "github.com/foxcpp/maddy/internal/tls/acme"
 )
@@ -297,8 +328,13 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.Custom("tls_client", false, false, nil, tls.TLSClientBlock, nil)
 	globals.Bool("storage_perdomain", false, false, nil)
 	globals.Bool("auth_perdomain", false, false, nil)
+	globals.Int("queue_max_parallelism", false, false, 0, nil)
 	globals.StringList("auth_domains", false, false, nil, nil)
 	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
+	globals.Custom("tracing", false, false, nil, tracing.Directive, nil)
+	globals.Custom("delivery_history", false, false, nil, history.Directive, nil)
+	globals.Custom("slow_log", false, false, nil, slowlog.Directive, nil)
+	globals.String("panic_reports", false, false, "", nil)
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
 	config.EnumMapped(globals, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto, nil)
 	modconfig.Table(globals, "auth_map", true, false, nil, nil)
@@ -319,6 +355,37 @@ func moduleMain(cfg []config.Node) error {
 
 	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
 
+	// Hooks are run in reverse order, so pending spans are flushed after
+	// all modules are stopped.
+	if tracingCfg, ok := globals["tracing"].(*tracing.Config); ok {
+		shutdown, err := tracing.Setup(tracingCfg, Version)
+		if err != nil {
+			return err
+		}
+		hooks.AddHook(hooks.EventShutdown, shutdown)
+	}
+
+	if slowlogCfg, ok := globals["slow_log"].(*slowlog.Config); ok {
+		slowlog.Configure(slowlogCfg)
+	}
+
+	panicReports, _ := globals["panic_reports"].(string)
+	panics.Configure(panicReports, Version)
+
+	if historyCfg, ok := globals["delivery_history"].(*history.Config); ok {
+		store, err := history.Open(historyCfg)
+		if err != nil {
+			return err
+		}
+		history.SetDefault(store)
+		hooks.AddHook(hooks.EventShutdown, func() {
+			history.SetDefault(nil)
+			if err := store.Close(); err != nil {
+				log.Printf("delivery history close failed: %v", err)
+			}
+		})
+	}
+
 	endpoints, mods, err := RegisterModules(globals, modBlocks)
 	if err != nil {
 		return err
@@ -329,6 +396,18 @@ func moduleMain(cfg []config.Node) error {
 		return err
 	}
 
+	// Not fatal, only management subcommands depend on it.
+	ctlServer, err := control.Listen(control.DefaultPath())
+	if err != nil {
+		log.Printf("failed to start control socket: %v", err)
+	} else {
+		hooks.AddHook(hooks.EventShutdown, func() {
+			if err := ctlServer.Close(); err != nil {
+				log.Printf("control socket close failed: %v", err)
+			}
+		})
+	}
+
 	systemdStatus(SDReady, "Listening for incoming connections...")
 
 	handleSignals()